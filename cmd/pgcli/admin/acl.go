@@ -0,0 +1,66 @@
+package admin
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+
+	"github.com/rkonfj/peerguard/disco"
+	"github.com/spf13/cobra"
+)
+
+func getACLCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "get-acl <network>",
+		Short: "Query network acl from pgmap",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := newClient(cmd)
+			if err != nil {
+				return err
+			}
+			acl, err := c.NetworkACL(args[0])
+			if err != nil {
+				return err
+			}
+			return json.NewEncoder(os.Stdout).Encode(acl)
+		},
+	}
+}
+
+func setACLCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "set-acl <network>",
+		Short: "Set network acl to pgmap, the json acl ({\"rules\":[{\"src\":[\"dev\"],\"dst\":[\"db\"],\"ports\":[\"tcp:5432\"]}]}) is read from the file or stdin, no rules allows all",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			file, err := cmd.Flags().GetString("file")
+			if err != nil {
+				return err
+			}
+			var r io.Reader = os.Stdin
+			if file != "-" {
+				f, err := os.Open(file)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				r = f
+			}
+			var acl disco.ACL
+			if err := json.NewDecoder(r).Decode(&acl); err != nil {
+				return err
+			}
+			if err := acl.Check(); err != nil {
+				return err
+			}
+			c, err := newClient(cmd)
+			if err != nil {
+				return err
+			}
+			return c.PutNetworkACL(args[0], acl)
+		},
+	}
+	cmd.Flags().StringP("file", "f", "-", "acl json file, - is stdin")
+	return cmd
+}
@@ -1,10 +1,16 @@
 package admin
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"os/user"
+	"path/filepath"
 	"strings"
 
+	"github.com/rkonfj/peerguard/cmd/pgcli/token"
+	"github.com/rkonfj/peerguard/peermap/exporter"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 )
@@ -18,11 +24,36 @@ func init() {
 		SilenceUsage: true,
 	}
 	Cmd.PersistentFlags().String("secret-key", "", "key to generate network secret")
-	Cmd.AddCommand(secretCmd())
+	Cmd.PersistentFlags().StringP("server", "s", "", "peermap server url (default the one saved by login)")
+	Cmd.PersistentFlags().String("token-file", "", "file saves the admin token by login (default ~/.peerguard_admin_token.json)")
+	Cmd.AddCommand(loginCmd())
+	secretCmd := token.SecretCmd()
+	secretCmd.Deprecated = "use pgcli token secret instead"
+	Cmd.AddCommand(secretCmd)
 	Cmd.AddCommand(networksCmd())
+	Cmd.AddCommand(deleteNetworkCmd())
+	Cmd.AddCommand(rotateCmd())
 	Cmd.AddCommand(peersCmd())
+	Cmd.AddCommand(historyCmd())
+	Cmd.AddCommand(eventsCmd())
+	Cmd.AddCommand(canariesCmd())
+	Cmd.AddCommand(versionsCmd())
+	Cmd.AddCommand(kickCmd())
 	Cmd.AddCommand(putMetaCmd())
 	Cmd.AddCommand(getMetaCmd())
+	Cmd.AddCommand(setNeighborsCmd())
+	Cmd.AddCommand(getQuotaCmd())
+	Cmd.AddCommand(setQuotaCmd())
+	Cmd.AddCommand(getACLCmd())
+	Cmd.AddCommand(setACLCmd())
+	Cmd.AddCommand(bansCmd())
+	Cmd.AddCommand(banCmd())
+	Cmd.AddCommand(unbanCmd())
+	Cmd.AddCommand(devicesCmd())
+	Cmd.AddCommand(revokeDeviceCmd())
+	Cmd.AddCommand(revokeCmd())
+	Cmd.AddCommand(webauthnCmd())
+	Cmd.AddCommand(exporterCmd())
 }
 
 func requiredArg(flagSet *pflag.FlagSet, argName string) (string, error) {
@@ -39,3 +70,71 @@ func requiredArg(flagSet *pflag.FlagSet, argName string) (string, error) {
 	}
 	return value, nil
 }
+
+// storedToken is the admin token saved by login
+type storedToken struct {
+	Server string `json:"server"`
+	Token  string `json:"token"`
+}
+
+func tokenFile(cmd *cobra.Command) (string, error) {
+	file, err := cmd.Flags().GetString("token-file")
+	if err != nil {
+		return "", err
+	}
+	if file != "" {
+		return file, nil
+	}
+	currentUser, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(currentUser.HomeDir, ".peerguard_admin_token.json"), nil
+}
+
+func loadToken(cmd *cobra.Command) (storedToken, error) {
+	var token storedToken
+	file, err := tokenFile(cmd)
+	if err != nil {
+		return token, err
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return token, err
+	}
+	return token, json.Unmarshal(b, &token)
+}
+
+func saveToken(cmd *cobra.Command, token storedToken) error {
+	file, err := tokenFile(cmd)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, b, 0600)
+}
+
+// newClient creates the client authenticated by the secret key if it is set, by the token saved by login otherwise
+func newClient(cmd *cobra.Command) (*exporter.Client, error) {
+	stored, err := loadToken(cmd)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("load admin token: %w", err)
+	}
+	server, err := requiredArg(cmd.Flags(), "server")
+	if err != nil {
+		if stored.Server == "" {
+			return nil, err
+		}
+		server = stored.Server
+	}
+	if secretKey, err := requiredArg(cmd.Flags(), "secret-key"); err == nil {
+		return exporter.NewClient(server, secretKey)
+	}
+	if stored.Token == "" {
+		return nil, errors.New("required flag \"secret-key\" not set, or run `pgcli admin login` first")
+	}
+	return exporter.NewTokenClient(server, stored.Token)
+}
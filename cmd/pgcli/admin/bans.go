@@ -0,0 +1,69 @@
+package admin
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/rkonfj/peerguard/peermap/exporter"
+	"github.com/spf13/cobra"
+)
+
+func bansCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "bans",
+		Short: "Query the banned peer ids, ips and cidrs from pgmap",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := newClient(cmd)
+			if err != nil {
+				return err
+			}
+			bans, err := c.Bans()
+			if err != nil {
+				return err
+			}
+			return json.NewEncoder(os.Stdout).Encode(bans)
+		},
+	}
+}
+
+func banCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "ban <peerID|ip|cidr>",
+		Short: "Refuse and disconnect the peers matched the peer id, ip or cidr",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			duration, err := cmd.Flags().GetDuration("duration")
+			if err != nil {
+				return err
+			}
+			c, err := newClient(cmd)
+			if err != nil {
+				return err
+			}
+			ban := exporter.Ban{Target: args[0]}
+			if duration > 0 {
+				ban.Expire = time.Now().Add(duration)
+			}
+			return c.Ban(ban)
+		},
+	}
+	cmd.Flags().Duration("duration", 0, "ban duration to expire (0 is forever)")
+	return cmd
+}
+
+func unbanCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "unban <peerID|ip|cidr>",
+		Short: "Lift the ban",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := newClient(cmd)
+			if err != nil {
+				return err
+			}
+			return c.Unban(args[0])
+		},
+	}
+}
@@ -0,0 +1,76 @@
+package admin
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+func devicesCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "devices",
+		Short: "Query devices enrolled by the users from pgmap",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			user, err := cmd.Flags().GetString("user")
+			if err != nil {
+				return err
+			}
+			c, err := newClient(cmd)
+			if err != nil {
+				return err
+			}
+			devices, err := c.Devices(user)
+			if err != nil {
+				return err
+			}
+			return json.NewEncoder(os.Stdout).Encode(devices)
+		},
+	}
+	cmd.Flags().StringP("user", "u", "", "only the devices of the user (oidc email or ldap dn)")
+	return cmd
+}
+
+func revokeDeviceCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "revoke-device <peerID>",
+		Short: "Revoke and disconnect the device",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := newClient(cmd)
+			if err != nil {
+				return err
+			}
+			return c.RevokeDevice(args[0])
+		},
+	}
+	return cmd
+}
+
+func revokeCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "revoke",
+		Short: "Revoke all secrets issued to the user or used by the device, and disconnect the peers using them",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			user, err := cmd.Flags().GetString("user")
+			if err != nil {
+				return err
+			}
+			peerID, err := cmd.Flags().GetString("peer")
+			if err != nil {
+				return err
+			}
+			c, err := newClient(cmd)
+			if err != nil {
+				return err
+			}
+			return c.Revoke(user, peerID)
+		},
+	}
+	cmd.Flags().StringP("user", "u", "", "the user (oidc email or ldap dn)")
+	cmd.Flags().String("peer", "", "the peer id of the device")
+	cmd.MarkFlagsOneRequired("user", "peer")
+	return cmd
+}
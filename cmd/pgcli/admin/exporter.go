@@ -0,0 +1,418 @@
+package admin
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rkonfj/peerguard/peermap/exporter"
+	"github.com/spf13/cobra"
+)
+
+func exporterCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "exporter",
+		Short: "Poll the pgmap exporter api and expose the networks, peers, traffic, devices, quotas, bans, canaries and client versions as prometheus metrics",
+		Long: "Poll the pgmap exporter api with the admin token (or the secret key) and expose the networks, peers, " +
+			"the traffic counters of the peers, devices, quotas and bans as prometheus metrics on /metrics, for the operators who can not modify the pgmap host",
+		Example: "  pgcli admin exporter -s https://peermap.example.com --token $(cat admin.token) --listen :9469",
+		Args:    cobra.NoArgs,
+		RunE:    runExporter,
+	}
+	cmd.Flags().String("token", "", "admin token sent as X-Token (default the secret key or the one saved by login)")
+	cmd.Flags().String("listen", ":9469", "listen address of the metrics")
+	cmd.Flags().Duration("interval", 30*time.Second, "poll interval")
+	return cmd
+}
+
+func runExporter(cmd *cobra.Command, args []string) error {
+	listen, err := cmd.Flags().GetString("listen")
+	if err != nil {
+		return err
+	}
+	interval, err := cmd.Flags().GetDuration("interval")
+	if err != nil {
+		return err
+	}
+	var c *exporter.Client
+	if token, err := requiredArg(cmd.Flags(), "token"); err == nil {
+		server, err := requiredArg(cmd.Flags(), "server")
+		if err != nil {
+			return err
+		}
+		c, err = exporter.NewTokenClient(server, token)
+		if err != nil {
+			return err
+		}
+	} else if c, err = newClient(cmd); err != nil {
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	var p poller
+	p.poll(c)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				p.poll(c)
+			}
+		}
+	}()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(p.metrics())
+	})
+	server := http.Server{Addr: listen, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	slog.Info("Serving metrics", "listen", listen, "interval", interval)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// poller keeps the metrics of the last poll, the metrics of the failed queries are absent
+type poller struct {
+	mutex    sync.RWMutex
+	last     []byte
+	polls    uint64
+	failures map[string]uint64
+}
+
+func (p *poller) metrics() []byte {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.last
+}
+
+func (p *poller) poll(c *exporter.Client) {
+	var w exporter.MetricsWriter
+	var failed []string
+	fail := func(query string, err error) {
+		slog.Error("Poll", "query", query, "err", err)
+		failed = append(failed, query)
+	}
+
+	start := time.Now()
+	networks, err := c.Networks()
+	if err != nil {
+		fail("networks", err)
+	} else {
+		w.Family("peermap_networks", "gauge", "Number of the networks")
+		w.Sample("peermap_networks", nil, float64(len(networks)))
+		w.Family("peermap_network_peers", "gauge", "Number of the peers connected to the network")
+		for _, n := range networks {
+			w.Sample("peermap_network_peers", []string{"network", n.ID, "alias", n.Alias}, float64(n.PeersCount))
+		}
+		w.Family("peermap_network_quality_score", "gauge", "Average quality score (0-100) of the links reported by the peers of the network")
+		for _, n := range networks {
+			if n.Quality != nil {
+				w.Sample("peermap_network_quality_score", []string{"network", n.ID}, float64(n.Quality.Score))
+			}
+		}
+		w.Family("peermap_network_quality_links", "gauge", "Number of the links reported by the peers of the network, by path (direct, relay)")
+		for _, n := range networks {
+			if n.Quality != nil {
+				w.Sample("peermap_network_quality_links", []string{"network", n.ID, "path", "direct"}, float64(n.Quality.Links-n.Quality.Relayed))
+				w.Sample("peermap_network_quality_links", []string{"network", n.ID, "path", "relay"}, float64(n.Quality.Relayed))
+			}
+		}
+		w.Family("peermap_network_rtt_seconds", "gauge", "Percentiles of the round trip time of the peers of the network to the pgmap")
+		for _, n := range networks {
+			if n.RTT == nil {
+				continue
+			}
+			for _, q := range []struct {
+				quantile string
+				value    time.Duration
+			}{{"0.5", n.RTT.P50}, {"0.9", n.RTT.P90}, {"0.99", n.RTT.P99}, {"1", n.RTT.Max}} {
+				w.Sample("peermap_network_rtt_seconds", []string{"network", n.ID, "quantile", q.quantile}, q.value.Seconds())
+			}
+		}
+		w.Family("peermap_network_messages_total", "counter", "Messages received by the peermap from the peers of the network, by control code")
+		for _, n := range networks {
+			for _, code := range slices.Sorted(maps.Keys(n.Messages)) {
+				w.Sample("peermap_network_messages_total", []string{"network", n.ID, "code", code}, float64(n.Messages[code]))
+			}
+		}
+	}
+
+	if networks, err := c.Peers(); err != nil {
+		fail("peers", err)
+	} else {
+		var peers []exporter.PeerStat
+		var labels [][]string
+		for _, n := range networks {
+			stats := n.Stats
+			if len(stats) == 0 { // the older pgmap only has the counters in the metadata of the peer urls
+				stats = parsePeerStats(n.Peers)
+			}
+			for _, stat := range stats {
+				peers = append(peers, stat)
+				labels = append(labels, []string{"network", n.ID, "peer", stat.ID, "ip", stat.IP, "name", stat.Name})
+			}
+		}
+		w.Family("peermap_peer_up", "gauge", "The peer is connected to the network")
+		for i := range peers {
+			w.Sample("peermap_peer_up", labels[i], 1)
+		}
+		w.Family("peermap_peer_info", "gauge", "The client version and the NAT type of the peer")
+		for i, peer := range peers {
+			w.Sample("peermap_peer_info", append(slices.Clone(labels[i]), "version", peer.Version, "nat", peer.NAT), 1)
+		}
+		w.Family("peermap_peer_quality_score", "gauge", "Average quality score (0-100) of the links reported by the peer")
+		for i, peer := range peers {
+			if peer.Quality != nil {
+				w.Sample("peermap_peer_quality_score", labels[i], float64(peer.Quality.Score))
+			}
+		}
+		w.Family("peermap_peer_rtt_seconds", "gauge", "Smoothed round trip time of the peer to the pgmap")
+		for i, peer := range peers {
+			if peer.RTT > 0 {
+				w.Sample("peermap_peer_rtt_seconds", labels[i], peer.RTT.Seconds())
+			}
+		}
+		w.Family("peermap_peer_write_queue", "gauge", "Writes to the peer waiting for the previous one")
+		for i, peer := range peers {
+			w.Sample("peermap_peer_write_queue", labels[i], float64(peer.WriteQueue))
+		}
+		w.Family("peermap_peer_write_max_seconds", "gauge", "Longest time a write to the peer blocked the writer, the wait for the previous one included")
+		for i, peer := range peers {
+			w.Sample("peermap_peer_write_max_seconds", labels[i], peer.WriteMax.Seconds())
+		}
+		for _, counter := range []struct {
+			name, help string
+			value      func(exporter.PeerStat) time.Duration
+		}{
+			{"peermap_peer_write_wait_seconds_total", "Time the writes to the peer waited for the previous ones",
+				func(s exporter.PeerStat) time.Duration { return s.WriteWait }},
+			{"peermap_peer_write_seconds_total", "Time spent writing to the peer",
+				func(s exporter.PeerStat) time.Duration { return s.WriteTime }},
+			{"peermap_peer_ratelimit_wait_seconds_total", "Time the messages from the peer waited for the rate limiters",
+				func(s exporter.PeerStat) time.Duration { return s.RatelimitWait }},
+		} {
+			w.Family(counter.name, "counter", counter.help)
+			for i, peer := range peers {
+				w.Sample(counter.name, labels[i], counter.value(peer).Seconds())
+			}
+		}
+		w.Family("peermap_peer_connect_time_seconds", "gauge", "Unix time the peer connected to the pgmap")
+		for i, peer := range peers {
+			if !peer.ConnectTime.IsZero() {
+				w.Sample("peermap_peer_connect_time_seconds", labels[i], float64(peer.ConnectTime.Unix()))
+			}
+		}
+		for _, counter := range []struct {
+			name, help string
+			value      func(exporter.PeerStat) uint64
+		}{
+			{"peermap_peer_relay_rx_bytes_total", "Bytes relayed by the peermap from the peer",
+				func(s exporter.PeerStat) uint64 { return s.RelayRxBytes }},
+			{"peermap_peer_relay_rx_messages_total", "Messages relayed by the peermap from the peer",
+				func(s exporter.PeerStat) uint64 { return s.RelayRxMessages }},
+			{"peermap_peer_relay_tx_bytes_total", "Bytes relayed by the peermap to the peer",
+				func(s exporter.PeerStat) uint64 { return s.RelayTxBytes }},
+			{"peermap_peer_relay_tx_messages_total", "Messages relayed by the peermap to the peer",
+				func(s exporter.PeerStat) uint64 { return s.RelayTxMessages }},
+			{"peermap_peer_writes_total", "Writes to the peer, the relayed, the disco and the stream messages",
+				func(s exporter.PeerStat) uint64 { return s.Writes }},
+			{"peermap_peer_stream_tx_bytes_total", "Bytes sent to the peer over the peermap stream",
+				func(s exporter.PeerStat) uint64 { return s.StreamTxBytes }},
+			{"peermap_peer_stream_rx_bytes_total", "Bytes received from the peer over the peermap stream",
+				func(s exporter.PeerStat) uint64 { return s.StreamRxBytes }},
+		} {
+			w.Family(counter.name, "counter", counter.help)
+			for i, peer := range peers {
+				w.Sample(counter.name, labels[i], float64(counter.value(peer)))
+			}
+		}
+	}
+
+	quotas := make([]*exporter.NetworkQuota, 0, len(networks))
+	for _, n := range networks {
+		quota, err := c.NetworkQuota(n.ID)
+		if err != nil {
+			fail("quota", err)
+			quotas = nil
+			break
+		}
+		quotas = append(quotas, quota)
+	}
+	if len(quotas) > 0 {
+		w.Family("peermap_network_quota_max_peers", "gauge", "Max peers of the network, 0 is unlimited")
+		for i, quota := range quotas {
+			w.Sample("peermap_network_quota_max_peers", []string{"network", networks[i].ID}, float64(quota.MaxPeers))
+		}
+		w.Family("peermap_network_quota_relay_bytes_per_second", "gauge", "Bytes per second relayed for the network, 0 is unlimited")
+		for i, quota := range quotas {
+			w.Sample("peermap_network_quota_relay_bytes_per_second", []string{"network", networks[i].ID}, float64(quota.RelayLimit))
+		}
+	}
+
+	if devices, err := c.Devices(""); err != nil {
+		fail("devices", err)
+	} else {
+		counts := make(map[[2]string]int)
+		for _, d := range devices {
+			state := "offline"
+			switch {
+			case d.Revoked:
+				state = "revoked"
+			case d.Online:
+				state = "online"
+			}
+			counts[[2]string{d.Network, state}]++
+		}
+		keys := make([][2]string, 0, len(counts))
+		for k := range counts {
+			keys = append(keys, k)
+		}
+		slices.SortFunc(keys, func(a, b [2]string) int { return strings.Compare(a[0]+a[1], b[0]+b[1]) })
+		w.Family("peermap_devices", "gauge", "Number of the devices enrolled by the users, by state (online, offline, revoked)")
+		for _, k := range keys {
+			w.Sample("peermap_devices", []string{"network", k[0], "state", k[1]}, float64(counts[k]))
+		}
+	}
+
+	if bans, err := c.Bans(); err != nil {
+		fail("bans", err)
+	} else {
+		w.Family("peermap_bans", "gauge", "Number of the active bans")
+		w.Sample("peermap_bans", nil, float64(len(bans)))
+	}
+
+	if canaries, err := c.Canaries(); err != nil {
+		fail("canaries", err)
+	} else {
+		w.Family("peermap_canary_up", "gauge", "The canary is joined the network")
+		for _, canary := range canaries {
+			up := 0.0
+			if canary.Connected {
+				up = 1
+			}
+			w.Sample("peermap_canary_up", []string{"network", canary.Network, "name", canary.Name}, up)
+		}
+		for _, counter := range []struct {
+			name, help string
+			value      func(exporter.CanaryProbe) uint64
+		}{
+			{"peermap_canary_probe_sent_total", "Pings sent to the peer by the canary",
+				func(p exporter.CanaryProbe) uint64 { return p.Sent }},
+			{"peermap_canary_probe_received_total", "Replies received from the peer by the canary",
+				func(p exporter.CanaryProbe) uint64 { return p.Received }},
+			{"peermap_canary_probe_direct_total", "Replies received from the peer by the canary over the punched path in both directions",
+				func(p exporter.CanaryProbe) uint64 { return p.Direct }},
+		} {
+			w.Family(counter.name, "counter", counter.help)
+			for _, canary := range canaries {
+				for _, probe := range canary.Probes {
+					w.Sample(counter.name, []string{"network", canary.Network, "peer", probe.Peer}, float64(counter.value(probe)))
+				}
+			}
+		}
+		w.Family("peermap_canary_probe_rtt_seconds", "gauge", "Round trip time of the last reply from the peer")
+		for _, canary := range canaries {
+			for _, probe := range canary.Probes {
+				if probe.Received > 0 {
+					w.Sample("peermap_canary_probe_rtt_seconds", []string{"network", canary.Network, "peer", probe.Peer}, probe.RTT.Seconds())
+				}
+			}
+		}
+		w.Family("peermap_canary_probe_relayed", "gauge", "The last reply from the peer is relayed by the peermap in either direction")
+		for _, canary := range canaries {
+			for _, probe := range canary.Probes {
+				if probe.Received == 0 {
+					continue
+				}
+				relayed := 0.0
+				if probe.Relayed {
+					relayed = 1
+				}
+				w.Sample("peermap_canary_probe_relayed", []string{"network", canary.Network, "peer", probe.Peer}, relayed)
+			}
+		}
+	}
+
+	if summary, err := c.Versions(); err != nil {
+		fail("versions", err)
+	} else {
+		w.Family("peermap_client_versions", "gauge", "Number of the peers connected by the client version")
+		for _, version := range slices.Sorted(maps.Keys(summary.Versions)) {
+			w.Sample("peermap_client_versions", []string{"version", version}, float64(summary.Versions[version]))
+		}
+		w.Family("peermap_client_capabilities", "gauge", "Number of the peers connected supporting the capability")
+		for _, capability := range slices.Sorted(maps.Keys(summary.Capabilities)) {
+			w.Sample("peermap_client_capabilities", []string{"capability", capability}, float64(summary.Capabilities[capability]))
+		}
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.polls++
+	if p.failures == nil {
+		p.failures = make(map[string]uint64)
+	}
+	for _, query := range failed {
+		p.failures[query]++
+	}
+	w.Family("peermap_up", "gauge", "The networks are queried successfully by the last poll")
+	up := 1.0
+	if slices.Contains(failed, "networks") {
+		up = 0
+	}
+	w.Sample("peermap_up", nil, up)
+	w.Family("peermap_exporter_poll_duration_seconds", "gauge", "Duration of the last poll")
+	w.Sample("peermap_exporter_poll_duration_seconds", nil, time.Since(start).Seconds())
+	w.Family("peermap_exporter_polls_total", "counter", "Number of the polls")
+	w.Sample("peermap_exporter_polls_total", nil, float64(p.polls))
+	w.Family("peermap_exporter_poll_failures_total", "counter", "Number of the failed queries by the query")
+	for _, query := range []string{"networks", "peers", "quota", "devices", "bans", "canaries", "versions"} {
+		w.Sample("peermap_exporter_poll_failures_total", []string{"query", query}, float64(p.failures[query]))
+	}
+	p.last = w.Bytes()
+}
+
+// parsePeerStats parses the peer urls pg://<peer id>?<metadata>, the metadata carries the traffic counters
+func parsePeerStats(peers []string) (stats []exporter.PeerStat) {
+	for _, s := range peers {
+		u, err := url.Parse(s)
+		if err != nil {
+			continue
+		}
+		meta := u.Query()
+		stat := exporter.PeerStat{
+			ID:      u.Host,
+			IP:      meta.Get("alias1"),
+			Name:    meta.Get("name"),
+			Version: meta.Get("version"),
+			NAT:     meta.Get("nat"),
+		}
+		stat.RelayRxBytes, _ = strconv.ParseUint(meta.Get("rrx"), 10, 64)
+		stat.StreamTxBytes, _ = strconv.ParseUint(meta.Get("stx"), 10, 64)
+		stat.StreamRxBytes, _ = strconv.ParseUint(meta.Get("srx"), 10, 64)
+		stats = append(stats, stat)
+	}
+	return
+}
@@ -0,0 +1,56 @@
+package admin
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rkonfj/peerguard/peermap/exporter"
+	"github.com/rkonfj/peerguard/peermap/exporter/auth"
+	"github.com/spf13/cobra"
+)
+
+func loginCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "login",
+		Short: "Save the admin token used by the other admin commands",
+		Long:  "Save the admin token used by the other admin commands, the token is generated by the secret key if it is not specified",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			server, err := requiredArg(cmd.Flags(), "server")
+			if err != nil {
+				return err
+			}
+			token, err := cmd.Flags().GetString("token")
+			if err != nil {
+				return err
+			}
+			validDuration, err := cmd.Flags().GetDuration("duration")
+			if err != nil {
+				return err
+			}
+			if token == "" {
+				secretKey, err := requiredArg(cmd.Flags(), "secret-key")
+				if err != nil {
+					return fmt.Errorf("%w, or specify the token", err)
+				}
+				token, err = auth.New(secretKey).GenerateToken(auth.Instruction{
+					ExpiredAt: time.Now().Add(validDuration).Unix(),
+				})
+				if err != nil {
+					return err
+				}
+			}
+			c, err := exporter.NewTokenClient(server, token)
+			if err != nil {
+				return err
+			}
+			if _, err := c.Networks(); err != nil {
+				return fmt.Errorf("verify token: %w", err)
+			}
+			return saveToken(cmd, storedToken{Server: server, Token: token})
+		},
+	}
+	cmd.Flags().String("token", "", "admin token")
+	cmd.Flags().Duration("duration", 30*24*time.Hour, "token duration to expire if it is generated by the secret key")
+	return cmd
+}
@@ -6,7 +6,6 @@ import (
 	"os"
 	"reflect"
 
-	"github.com/rkonfj/peerguard/peermap/exporter"
 	"github.com/spf13/cobra"
 )
 
@@ -16,15 +15,7 @@ func getMetaCmd() *cobra.Command {
 		Short: "Query network metadata from pgmap",
 		Args:  cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			secretKey, err := requiredArg(cmd.InheritedFlags(), "secret-key")
-			if err != nil {
-				return err
-			}
-			server, err := requiredArg(cmd.Flags(), "server")
-			if err != nil {
-				return err
-			}
-			c, err := exporter.NewClient(server, secretKey)
+			c, err := newClient(cmd)
 			if err != nil {
 				return err
 			}
@@ -35,7 +26,6 @@ func getMetaCmd() *cobra.Command {
 			return json.NewEncoder(os.Stdout).Encode(networkMeta)
 		},
 	}
-	cmd.Flags().StringP("server", "s", "", "peermap server url")
 	return cmd
 }
 
@@ -45,14 +35,6 @@ func putMetaCmd() *cobra.Command {
 		Short: "Set network metadata to pgmap",
 		Args:  cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			secretKey, err := requiredArg(cmd.InheritedFlags(), "secret-key")
-			if err != nil {
-				return err
-			}
-			server, err := requiredArg(cmd.Flags(), "server")
-			if err != nil {
-				return err
-			}
 			key, err := cmd.Flags().GetString("key")
 			if err != nil {
 				return err
@@ -61,7 +43,7 @@ func putMetaCmd() *cobra.Command {
 			if err != nil {
 				return err
 			}
-			c, err := exporter.NewClient(server, secretKey)
+			c, err := newClient(cmd)
 			if err != nil {
 				return err
 			}
@@ -73,14 +55,37 @@ func putMetaCmd() *cobra.Command {
 			if !v.IsValid() {
 				return fmt.Errorf("meta %s not found", key)
 			}
+			if v.Kind() != reflect.String {
+				return fmt.Errorf("meta %s is not a string, use the dedicated command to set it", key)
+			}
 			v.SetString(value)
 			json.NewEncoder(os.Stdout).Encode(networkMeta)
 			return c.PutNetworkMeta(args[0], *networkMeta)
 		},
 	}
-	cmd.Flags().StringP("server", "s", "", "peermap server url")
 	cmd.Flags().StringP("key", "k", "", "metadata key")
 	cmd.Flags().StringP("value", "v", "", "metadata value")
 	cmd.MarkFlagRequired("key")
 	return cmd
 }
+
+func setNeighborsCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "set-neighbors <network> [neighbor network] ...",
+		Short: "Set the neighbor networks whose peers are reachable from the network (none to clear)",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := newClient(cmd)
+			if err != nil {
+				return err
+			}
+			networkMeta, err := c.NetworkMeta(args[0])
+			if err != nil {
+				return err
+			}
+			networkMeta.Neighbors = args[1:]
+			json.NewEncoder(os.Stdout).Encode(networkMeta)
+			return c.PutNetworkMeta(args[0], *networkMeta)
+		},
+	}
+}
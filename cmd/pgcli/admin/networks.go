@@ -1,8 +1,11 @@
 package admin
 
 import (
+	"context"
 	"encoding/json"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/rkonfj/peerguard/peermap/exporter"
 	"github.com/spf13/cobra"
@@ -14,25 +17,155 @@ func networksCmd() *cobra.Command {
 		Short: "Query networks from pgmap",
 		Args:  cobra.NoArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			secretKey, err := requiredArg(cmd.InheritedFlags(), "secret-key")
+			c, err := newClient(cmd)
 			if err != nil {
 				return err
 			}
-			server, err := requiredArg(cmd.Flags(), "server")
+			networks, err := c.Networks()
 			if err != nil {
 				return err
 			}
-			c, err := exporter.NewClient(server, secretKey)
+			return json.NewEncoder(os.Stdout).Encode(networks)
+		},
+	}
+	return cmd
+}
+
+func deleteNetworkCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "delete-network <network>",
+		Short: "Disconnect the peers of the network and forget its state, revoke the secrets to keep them out",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := newClient(cmd)
 			if err != nil {
 				return err
 			}
-			networks, err := c.Networks()
+			return c.DeleteNetwork(args[0])
+		},
+	}
+}
+
+func rotateCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "rotate <network>",
+		Short: "Rotate the secrets of the peers connected to the network now",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			revoke, err := cmd.Flags().GetBool("revoke")
 			if err != nil {
 				return err
 			}
-			return json.NewEncoder(os.Stdout).Encode(networks)
+			c, err := newClient(cmd)
+			if err != nil {
+				return err
+			}
+			rotated, err := c.RotateNetworkSecrets(args[0], revoke)
+			if err != nil {
+				return err
+			}
+			return json.NewEncoder(os.Stdout).Encode(map[string]int{"rotated": rotated})
+		},
+	}
+	cmd.Flags().Bool("revoke", false, "revoke all the secrets of the network issued before at once (e.g. leaked), not only after the grace period")
+	return cmd
+}
+
+func historyCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "history",
+		Short: "Query the per-minute peer counts and relayed bytes of the networks kept by pgmap",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			network, err := cmd.Flags().GetString("network")
+			if err != nil {
+				return err
+			}
+			since, err := cmd.Flags().GetString("since")
+			if err != nil {
+				return err
+			}
+			until, err := cmd.Flags().GetString("until")
+			if err != nil {
+				return err
+			}
+			c, err := newClient(cmd)
+			if err != nil {
+				return err
+			}
+			history, err := c.History(network, since, until)
+			if err != nil {
+				return err
+			}
+			return json.NewEncoder(os.Stdout).Encode(history)
+		},
+	}
+	cmd.Flags().StringP("network", "n", "", "only the history of the network")
+	cmd.Flags().String("since", "1h", "start of the history, RFC3339 time or the duration ago")
+	cmd.Flags().String("until", "", "end of the history, RFC3339 time or the duration ago (default now)")
+	return cmd
+}
+
+func canariesCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "canaries",
+		Short: "Query the canaries of pgmap and the results of pinging the peers of their networks",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := newClient(cmd)
+			if err != nil {
+				return err
+			}
+			canaries, err := c.Canaries()
+			if err != nil {
+				return err
+			}
+			return json.NewEncoder(os.Stdout).Encode(canaries)
+		},
+	}
+	return cmd
+}
+
+func versionsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "versions",
+		Short: "Query the distribution of the client versions and capabilities of the peers connected to pgmap",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := newClient(cmd)
+			if err != nil {
+				return err
+			}
+			summary, err := c.Versions()
+			if err != nil {
+				return err
+			}
+			return json.NewEncoder(os.Stdout).Encode(summary)
+		},
+	}
+	return cmd
+}
+
+func eventsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "events",
+		Short: "Stream the events of the networks (peer joined or left, network created, meta or quota changed) as json lines",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			network, err := cmd.Flags().GetString("network")
+			if err != nil {
+				return err
+			}
+			c, err := newClient(cmd)
+			if err != nil {
+				return err
+			}
+			ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer cancel()
+			encoder := json.NewEncoder(os.Stdout)
+			return c.Events(ctx, network, func(e exporter.Event) { encoder.Encode(e) })
 		},
 	}
-	cmd.Flags().StringP("server", "s", "", "peermap server url")
+	cmd.Flags().StringP("network", "n", "", "only the events of the network")
 	return cmd
 }
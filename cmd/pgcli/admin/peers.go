@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"os"
 
-	"github.com/rkonfj/peerguard/peermap/exporter"
 	"github.com/spf13/cobra"
 )
 
@@ -14,15 +13,7 @@ func peersCmd() *cobra.Command {
 		Short: "Query peers from pgmap",
 		Args:  cobra.NoArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			secretKey, err := requiredArg(cmd.InheritedFlags(), "secret-key")
-			if err != nil {
-				return err
-			}
-			server, err := requiredArg(cmd.Flags(), "server")
-			if err != nil {
-				return err
-			}
-			c, err := exporter.NewClient(server, secretKey)
+			c, err := newClient(cmd)
 			if err != nil {
 				return err
 			}
@@ -33,7 +24,20 @@ func peersCmd() *cobra.Command {
 			return json.NewEncoder(os.Stdout).Encode(peers)
 		},
 	}
-
-	cmd.Flags().StringP("server", "s", "", "peermap server url")
 	return cmd
 }
+
+func kickCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "kick <peerID>",
+		Short: "Disconnect the peer, ban or revoke it to keep it out",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := newClient(cmd)
+			if err != nil {
+				return err
+			}
+			return c.Kick(args[0])
+		},
+	}
+}
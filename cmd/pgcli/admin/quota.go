@@ -0,0 +1,68 @@
+package admin
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+func getQuotaCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "get-quota <network>",
+		Short: "Query network quota from pgmap",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := newClient(cmd)
+			if err != nil {
+				return err
+			}
+			quota, err := c.NetworkQuota(args[0])
+			if err != nil {
+				return err
+			}
+			return json.NewEncoder(os.Stdout).Encode(quota)
+		},
+	}
+}
+
+func setQuotaCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "set-quota <network>",
+		Short: "Set network quota to pgmap, the unspecified limits are kept (0 is unlimited)",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := newClient(cmd)
+			if err != nil {
+				return err
+			}
+			quota, err := c.NetworkQuota(args[0])
+			if err != nil {
+				return err
+			}
+			if cmd.Flags().Changed("max-peers") {
+				quota.MaxPeers, _ = cmd.Flags().GetInt("max-peers")
+			}
+			if cmd.Flags().Changed("relay-limit") {
+				quota.RelayLimit, _ = cmd.Flags().GetInt("relay-limit")
+			}
+			if cmd.Flags().Changed("relay-burst") {
+				quota.RelayBurst, _ = cmd.Flags().GetInt("relay-burst")
+			}
+			if cmd.Flags().Changed("disco-limit") {
+				quota.DiscoLimit, _ = cmd.Flags().GetInt("disco-limit")
+			}
+			if cmd.Flags().Changed("disco-burst") {
+				quota.DiscoBurst, _ = cmd.Flags().GetInt("disco-burst")
+			}
+			json.NewEncoder(os.Stdout).Encode(quota)
+			return c.PutNetworkQuota(args[0], *quota)
+		},
+	}
+	cmd.Flags().Int("max-peers", 0, "max peers connected to the network")
+	cmd.Flags().Int("relay-limit", 0, "bytes per second relayed for all peers in the network")
+	cmd.Flags().Int("relay-burst", 0, "relay burst bytes (default the relay limit)")
+	cmd.Flags().Int("disco-limit", 0, "bytes per second of the discovery messages for all peers in the network (0 is 10KiB/s)")
+	cmd.Flags().Int("disco-burst", 0, "discovery burst bytes (default the disco limit)")
+	return cmd
+}
@@ -0,0 +1,31 @@
+package admin
+
+import (
+	"github.com/spf13/cobra"
+)
+
+func webauthnCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "webauthn <user>",
+		Short: "Allow the user to enroll a security key on the next login, or reset the enrolled keys",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			reset, err := cmd.Flags().GetBool("reset")
+			if err != nil {
+				return err
+			}
+			c, err := newClient(cmd)
+			if err != nil {
+				return err
+			}
+			if reset {
+				if err := c.ResetWebAuthn(args[0]); err != nil {
+					return err
+				}
+			}
+			return c.GrantWebAuthnEnrollment(args[0])
+		},
+	}
+	cmd.Flags().Bool("reset", false, "remove the security keys enrolled by the user before allowing the enrollment")
+	return cmd
+}
@@ -0,0 +1,154 @@
+package bench
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rkonfj/peerguard/cmd/pgcli/overlay"
+	"github.com/rkonfj/peerguard/p2p"
+	"github.com/spf13/cobra"
+)
+
+var Cmd *cobra.Command
+
+func init() {
+	Cmd = &cobra.Command{
+		Use:   "bench <peer>",
+		Short: "Measure the throughput, loss and latency to a peer over the p2p network",
+		Long: "Measure the throughput, packets per second, loss and rtt to a peer by the peer id, overlay ip or alias, " +
+			"in both directions over the direct path and the upload over the path relayed by the peermap server. " +
+			"It joins the network as a temporary peer with the stored network secret, the peer answers the upload without any setup " +
+			"and serves the download only if it runs with --bench-download-rate",
+		Args: cobra.ExactArgs(1),
+		RunE: run,
+	}
+	overlay.AddFlags(Cmd.Flags(), 29886)
+	Cmd.Flags().IntP("count", "c", 2000, "packets sent in each direction")
+	Cmd.Flags().Int("size", 1200, fmt.Sprintf("packet size (%d-%d)", p2p.BenchMinSize, p2p.BenchMaxSize))
+	Cmd.Flags().IntP("rate", "r", 2000, "packets sent per second (0 means as fast as possible)")
+	Cmd.Flags().String("path", "all", "the path to bench (direct|relay|all)")
+}
+
+func run(cmd *cobra.Command, args []string) error {
+	count, err := cmd.Flags().GetInt("count")
+	if err != nil {
+		return err
+	}
+	size, err := cmd.Flags().GetInt("size")
+	if err != nil {
+		return err
+	}
+	rate, err := cmd.Flags().GetInt("rate")
+	if err != nil {
+		return err
+	}
+	path, err := cmd.Flags().GetString("path")
+	if err != nil {
+		return err
+	}
+	var paths []bool // relay or not
+	switch path {
+	case "direct":
+		paths = []bool{false}
+	case "relay":
+		paths = []bool{true}
+	case "all":
+		paths = []bool{false, true}
+	default:
+		return fmt.Errorf("unknown path %q", path)
+	}
+	if count <= 0 || count > p2p.BenchMaxCount {
+		return fmt.Errorf("count must be in 1-%d", p2p.BenchMaxCount)
+	}
+	if size < p2p.BenchMinSize || size > p2p.BenchMaxSize {
+		return fmt.Errorf("size must be in %d-%d", p2p.BenchMinSize, p2p.BenchMaxSize)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	conn, err := overlay.Join(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	go conn.Discard() // the bench packets are dispatched by ReadFrom
+
+	peerID, err := conn.Resolve(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("BENCH %s (%s) %d packets of %d bytes\n", args[0], peerID, count, size)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PATH\tDIRECTION\tSENT\tRECEIVED\tLOSS\tTHROUGHPUT\tPPS\tRTT MIN/AVG/MAX\tRELAYED")
+	var benches, failed int
+	for _, relay := range paths {
+		for _, download := range []bool{false, true} {
+			if relay && download { // the peer never relays the downloads
+				continue
+			}
+			benches++
+			result, err := conn.Bench(ctx, peerID, p2p.BenchOptions{
+				Download: download,
+				Relay:    relay,
+				Count:    count,
+				Size:     size,
+				Rate:     rate,
+			})
+			if ctx.Err() != nil {
+				w.Flush()
+				return ctx.Err()
+			}
+			if err != nil {
+				failed++
+				fmt.Fprintf(w, "%s\t%s\t%s\n", pathName(relay), direction(download), err)
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%.1f%%\t%s\t%.0f\t%s/%s/%s\t%d\n",
+				pathName(relay), direction(download), result.Sent, result.Received, result.Loss()*100,
+				bandwidth(result.Bandwidth()), result.PPS(), round(result.MinRTT), round(result.AvgRTT),
+				round(result.MaxRTT), result.Relayed)
+		}
+	}
+	w.Flush()
+	if failed == benches {
+		return errors.New("the peer does not answer the bench")
+	}
+	return nil
+}
+
+func pathName(relay bool) string {
+	if relay {
+		return "relay"
+	}
+	return "direct"
+}
+
+func direction(download bool) string {
+	if download {
+		return "download"
+	}
+	return "upload"
+}
+
+func round(d time.Duration) time.Duration {
+	return d.Round(10 * time.Microsecond)
+}
+
+func bandwidth(bps float64) string {
+	switch {
+	case bps >= 1e9:
+		return fmt.Sprintf("%.2f Gbit/s", bps/1e9)
+	case bps >= 1e6:
+		return fmt.Sprintf("%.2f Mbit/s", bps/1e6)
+	default:
+		return fmt.Sprintf("%.2f Kbit/s", bps/1e3)
+	}
+}
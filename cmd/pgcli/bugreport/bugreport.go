@@ -0,0 +1,243 @@
+package bugreport
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/rkonfj/peerguard/cmd/pgcli/localapi"
+	"github.com/rkonfj/peerguard/cmd/pgcli/vpn"
+	"github.com/rkonfj/peerguard/disco/netcheck"
+	"github.com/spf13/cobra"
+)
+
+var Cmd *cobra.Command
+
+func init() {
+	Cmd = &cobra.Command{
+		Use:   "bugreport",
+		Short: "Gather the diagnostics into an archive to attach to the issues",
+		Long: "Gather the versions, the state, peers and routes of the vpn daemon, the netcheck report, the interfaces, " +
+			"the system routes and the logs into a tar.gz archive. The secrets, tokens and private keys are redacted",
+		Example: "  pgcli bugreport --log /var/log/pgcli.log",
+		Args:    cobra.NoArgs,
+		RunE:    run,
+	}
+	localapi.AddFlags(Cmd.Flags())
+	Cmd.Flags().StringP("output", "o", "", "archive file (default pgcli-bugreport-<time>.tar.gz)")
+	Cmd.Flags().StringSlice("log", nil, "log files to include, the rotated ones (<file>.1 ...) are included as well")
+	Cmd.Flags().StringP("server", "s", os.Getenv("PG_SERVER"), "peermap server url netchecked (default the server of the daemon)")
+	Cmd.Flags().StringSlice("stun", netcheck.DefaultSTUNServers, "stun servers netchecked")
+	Cmd.Flags().Bool("no-netcheck", false, "do not run the netcheck")
+}
+
+// report is the archive being written, the failures of gathering are collected into errors.txt
+type report struct {
+	tw   *tar.Writer
+	time time.Time
+	errs []string
+}
+
+func (r *report) add(name string, b []byte) error {
+	b = redact(b)
+	if err := r.tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(b)), ModTime: r.time}); err != nil {
+		return err
+	}
+	_, err := r.tw.Write(b)
+	return err
+}
+
+func (r *report) addJSON(name string, v any) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return r.add(name, append(b, '\n'))
+}
+
+func (r *report) fail(what string, err error) {
+	r.errs = append(r.errs, fmt.Sprintf("%s: %s", what, err))
+}
+
+func run(cmd *cobra.Command, args []string) error {
+	output, err := cmd.Flags().GetString("output")
+	if err != nil {
+		return err
+	}
+	logs, err := cmd.Flags().GetStringSlice("log")
+	if err != nil {
+		return err
+	}
+	server, err := cmd.Flags().GetString("server")
+	if err != nil {
+		return err
+	}
+	stunServers, err := cmd.Flags().GetStringSlice("stun")
+	if err != nil {
+		return err
+	}
+	noNetcheck, err := cmd.Flags().GetBool("no-netcheck")
+	if err != nil {
+		return err
+	}
+	client, err := localapi.NewClientFromFlags(cmd.Flags())
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if output == "" {
+		output = fmt.Sprintf("pgcli-bugreport-%s.tar.gz", now.Format("20060102-150405"))
+	}
+	f, err := os.OpenFile(output, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gw := gzip.NewWriter(f)
+	r := report{tw: tar.NewWriter(gw), time: now}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := r.gather(ctx, client, server, stunServers, !noNetcheck, logs); err != nil {
+		return err
+	}
+	if len(r.errs) > 0 {
+		if err := r.add("errors.txt", []byte(strings.Join(r.errs, "\n")+"\n")); err != nil {
+			return err
+		}
+	}
+	if err := errors.Join(r.tw.Close(), gw.Close(), f.Close()); err != nil {
+		return err
+	}
+	fmt.Println("Bug report written to", output)
+	for _, e := range r.errs {
+		fmt.Println("  missing", e)
+	}
+	return nil
+}
+
+// gather adds the diagnostics to the archive, only the archive write errors are returned
+func (r *report) gather(ctx context.Context, client *localapi.Client, server string, stunServers []string,
+	netcheckEnabled bool, logs []string) error {
+	err := r.add("version.txt", fmt.Appendf(nil, "pgcli %s-%s\ngo %s %s/%s\n",
+		vpn.Version, vpn.Commit, runtime.Version(), runtime.GOOS, runtime.GOARCH))
+	if err != nil {
+		return err
+	}
+
+	if status, err := client.Status(ctx); err != nil {
+		r.fail("daemon status", err)
+	} else {
+		if server == "" {
+			server = status.Server
+		}
+		if err := r.addJSON("daemon/status.json", status); err != nil {
+			return err
+		}
+		if peers, err := client.Peers(ctx, true); err != nil {
+			r.fail("daemon peers", err)
+		} else if err := r.addJSON("daemon/peers.json", peers); err != nil {
+			return err
+		}
+		if routes, err := client.Routes(ctx); err != nil {
+			r.fail("daemon routes", err)
+		} else if err := r.addJSON("daemon/routes.json", routes); err != nil {
+			return err
+		}
+	}
+
+	if netcheckEnabled {
+		report, err := netcheck.Run(ctx, netcheck.Config{Peermap: server, STUNServers: stunServers})
+		if err != nil {
+			r.fail("netcheck", err)
+		} else if err := r.addJSON("netcheck.json", report); err != nil {
+			return err
+		}
+	}
+
+	if err := r.add("system/interfaces.txt", interfaces()); err != nil {
+		return err
+	}
+	var routes []byte
+	for _, args := range routeCommands() {
+		out, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+		if err != nil {
+			r.fail(strings.Join(args, " "), err)
+		}
+		routes = fmt.Appendf(routes, "$ %s\n%s\n", strings.Join(args, " "), out)
+	}
+	if err := r.add("system/routes.txt", routes); err != nil {
+		return err
+	}
+
+	for _, log := range logs {
+		if err := r.addLog(log); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addLog adds the log file and its rotated ones
+func (r *report) addLog(path string) error {
+	for i := 0; ; i++ {
+		name := path
+		if i > 0 {
+			name = fmt.Sprintf("%s.%d", path, i)
+		}
+		b, err := os.ReadFile(name)
+		if errors.Is(err, os.ErrNotExist) && i > 0 {
+			return nil
+		}
+		if err != nil {
+			r.fail("log "+name, err)
+			return nil
+		}
+		if err := r.add("logs/"+filepath.Base(name), b); err != nil {
+			return err
+		}
+	}
+}
+
+func interfaces() []byte {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return fmt.Appendf(nil, "error: %s\n", err)
+	}
+	var b strings.Builder
+	for _, iface := range ifaces {
+		fmt.Fprintf(&b, "%d: %s mtu %d flags %s", iface.Index, iface.Name, iface.MTU, iface.Flags)
+		if len(iface.HardwareAddr) > 0 {
+			fmt.Fprintf(&b, " hwaddr %s", iface.HardwareAddr)
+		}
+		b.WriteString("\n")
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			fmt.Fprintf(&b, "    %s\n", addr)
+		}
+	}
+	return []byte(b.String())
+}
+
+// routeCommands are the commands dumping the system routes
+func routeCommands() [][]string {
+	switch runtime.GOOS {
+	case "linux":
+		return [][]string{{"ip", "-4", "route", "show", "table", "all"}, {"ip", "-6", "route", "show", "table", "all"}, {"ip", "rule"}}
+	case "windows":
+		return [][]string{{"route", "print"}}
+	default:
+		return [][]string{{"netstat", "-rn"}}
+	}
+}
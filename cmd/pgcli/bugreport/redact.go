@@ -0,0 +1,27 @@
+package bugreport
+
+import "regexp"
+
+const redacted = "[REDACTED]"
+
+// redactions replace the secrets in the logs and the reports, i.e. the values of the secret fields and
+// url parameters, the bearer tokens, the jwts, the url credentials and the pem private keys
+var redactions = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	{regexp.MustCompile(`(?s)-----BEGIN [A-Z ]*PRIVATE KEY-----.*?-----END [A-Z ]*PRIVATE KEY-----`), redacted},
+	{regexp.MustCompile(`(?i)(bearer\s+)[\w.~+/=-]+`), "${1}" + redacted},
+	{regexp.MustCompile(`eyJ[\w-]+\.[\w-]+\.[\w-]*`), redacted},
+	{regexp.MustCompile(`(://)[^/\s:@]+:[^/\s@]+@`), "${1}" + redacted + "@"},
+	{regexp.MustCompile(`(?i)("[\w-]*(?:secret|token|password|passwd|private|key)[\w-]*"\s*:\s*)"(?:[^"\\]|\\.)*"`), `${1}"` + redacted + `"`},
+	{regexp.MustCompile(`(?i)(\b[\w-]*(?:secret|token|password|passwd|private|key)[\w-]*=)("(?:[^"\\]|\\.)*"|[^\s&"]+)`), "${1}" + redacted},
+}
+
+// redact replaces the secrets in b
+func redact(b []byte) []byte {
+	for _, r := range redactions {
+		b = r.re.ReplaceAll(b, []byte(r.repl))
+	}
+	return b
+}
@@ -0,0 +1,118 @@
+package chat
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"unicode"
+
+	"github.com/rkonfj/peerguard/cmd/pgcli/overlay"
+	"github.com/rkonfj/peerguard/rdt"
+	"github.com/spf13/cobra"
+)
+
+var Cmd *cobra.Command
+
+func init() {
+	Cmd = &cobra.Command{
+		Use:   "chat [peer]",
+		Short: "Chat with a peer over the encrypted p2p network",
+		Long: "Chat with a peer over the encrypted p2p network, a quick connectivity test without the vpn. " +
+			"Run `pgcli chat` to wait for the peer, then `pgcli chat <peer id>` printed by it on the other host",
+		Args: cobra.MaximumNArgs(1),
+		RunE: run,
+	}
+	overlay.AddFlags(Cmd.Flags(), 29888)
+}
+
+func run(cmd *cobra.Command, args []string) error {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	network, err := overlay.Join(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	defer network.Close()
+	go network.Discard() // the stream datagrams are dispatched by ReadFrom
+
+	listener, err := rdt.Listen(network.StreamConn())
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		listener.Close() // not idempotent, only closed here
+	}()
+
+	var conn net.Conn
+	if len(args) == 1 {
+		peerID, err := network.Resolve(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		if conn, err = listener.OpenStream(peerID); err != nil {
+			return err
+		}
+		// the peer accepts the stream on the first datagram
+		if _, err := conn.Write([]byte("\n")); err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("Waiting for the peer, run on the other host:\n  pgcli chat %s\n", network.LocalAddr())
+		if conn, err = listener.Accept(); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+	}
+	defer conn.Close()
+	peer := conn.RemoteAddr().String()
+	fmt.Printf("Connected to %s, type the messages (Ctrl-D to quit)\n", peer)
+
+	received := make(chan error, 1)
+	go func() {
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			if line := sanitize(scanner.Text()); line != "" {
+				fmt.Printf("%s> %s\n", peer[:min(8, len(peer))], line)
+			}
+		}
+		received <- scanner.Err()
+	}()
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if _, err := io.WriteString(conn, scanner.Text()+"\n"); err != nil {
+				break
+			}
+		}
+		cancel()
+	}()
+	select {
+	case <-ctx.Done():
+	case err := <-received:
+		if err != nil {
+			return err
+		}
+		fmt.Println("The peer left")
+	}
+	return nil
+}
+
+// sanitize removes the control characters, so that the peer can not inject terminal escape sequences
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && r != '\t' {
+			return -1
+		}
+		return r
+	}, s)
+}
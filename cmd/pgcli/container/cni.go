@@ -0,0 +1,221 @@
+package container
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// cniSupportedVersions are the CNI spec versions of the results the plugin outputs
+var cniSupportedVersions = []string{"0.4.0", "1.0.0"}
+
+// cniConfig is the network config on stdin, the ipam is delegated to the plugin of its type
+type cniConfig struct {
+	CNIVersion string `json:"cniVersion"`
+	Name       string `json:"name"`
+	MTU        int    `json:"mtu"`
+	IPAM       struct {
+		Type string `json:"type"`
+	} `json:"ipam"`
+}
+
+type cniIP struct {
+	Address   string `json:"address"`
+	Gateway   string `json:"gateway,omitempty"`
+	Interface *int   `json:"interface,omitempty"`
+}
+
+type cniInterface struct {
+	Name    string `json:"name"`
+	Sandbox string `json:"sandbox,omitempty"`
+}
+
+type cniRoute struct {
+	Dst string `json:"dst"`
+}
+
+type cniResult struct {
+	CNIVersion string         `json:"cniVersion"`
+	Interfaces []cniInterface `json:"interfaces,omitempty"`
+	IPs        []cniIP        `json:"ips"`
+	Routes     []cniRoute     `json:"routes,omitempty"`
+	DNS        any            `json:"dns,omitempty"`
+}
+
+type cniError struct {
+	CNIVersion string `json:"cniVersion"`
+	Code       int    `json:"code"`
+	Msg        string `json:"msg"`
+}
+
+func runCNI(cmd *cobra.Command, args []string) error {
+	stdin, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+	var cfg cniConfig
+	if len(stdin) > 0 {
+		if err := json.Unmarshal(stdin, &cfg); err != nil {
+			return writeCNIError(cfg, fmt.Errorf("decode network config: %w", err))
+		}
+	}
+	if cfg.MTU == 0 {
+		cfg.MTU = 1400
+	}
+	switch command := os.Getenv("CNI_COMMAND"); command {
+	case "ADD":
+		result, err := cniAdd(cfg, stdin)
+		if err != nil {
+			return writeCNIError(cfg, err)
+		}
+		return json.NewEncoder(os.Stdout).Encode(result)
+	case "DEL":
+		if err := cniDel(cfg, stdin); err != nil {
+			return writeCNIError(cfg, err)
+		}
+		return nil
+	case "CHECK":
+		if !vethExists(hostVethName(os.Getenv("CNI_CONTAINERID"))) {
+			return writeCNIError(cfg, errors.New("the veth of the container is missing"))
+		}
+		return nil
+	case "VERSION":
+		return json.NewEncoder(os.Stdout).Encode(map[string]any{
+			"cniVersion":        cfg.CNIVersion,
+			"supportedVersions": cniSupportedVersions,
+		})
+	default:
+		return writeCNIError(cfg, fmt.Errorf("unknown CNI_COMMAND %q", command))
+	}
+}
+
+// cniAdd allocates the addresses by the ipam plugin, then creates the veth and configures the
+// container side in the netns
+func cniAdd(cfg cniConfig, stdin []byte) (*cniResult, error) {
+	containerID, netnsPath, ifName := os.Getenv("CNI_CONTAINERID"), os.Getenv("CNI_NETNS"), os.Getenv("CNI_IFNAME")
+	if containerID == "" || netnsPath == "" || ifName == "" {
+		return nil, errors.New("CNI_CONTAINERID, CNI_NETNS and CNI_IFNAME are required")
+	}
+	out, err := execIPAM(cfg, stdin)
+	if err != nil {
+		return nil, err
+	}
+	var result cniResult
+	if err := json.Unmarshal(out, &result); err != nil {
+		return nil, fmt.Errorf("decode ipam result: %w", err)
+	}
+	if len(result.IPs) == 0 {
+		return nil, errors.New("no address is allocated by the ipam")
+	}
+	// the default route of the family is via the gateway of its first address, the gateway is
+	// answered by the proxy_arp of the host side if it is not set by the ipam
+	var addrs []netip.Prefix
+	var gateways []netip.Addr
+	for _, ip := range result.IPs {
+		addr, err := netip.ParsePrefix(ip.Address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ipam address %s: %w", ip.Address, err)
+		}
+		gateway := netip.MustParseAddr("169.254.1.1")
+		if addr.Addr().Is6() {
+			gateway = netip.MustParseAddr("fe80::1")
+		}
+		if ip.Gateway != "" {
+			if gateway, err = netip.ParseAddr(ip.Gateway); err != nil {
+				return nil, fmt.Errorf("invalid ipam gateway %s: %w", ip.Gateway, err)
+			}
+		}
+		addrs = append(addrs, addr)
+		gateways = append(gateways, gateway)
+	}
+	hostName, peerName := hostVethName(containerID), peerVethName(containerID)
+	hostAddrs := make([]netip.Addr, 0, len(addrs))
+	for _, addr := range addrs {
+		hostAddrs = append(hostAddrs, addr.Addr())
+	}
+	if err := createVeth(hostName, peerName, cfg.MTU, hostAddrs...); err != nil {
+		return nil, err
+	}
+	if err := setupContainerVeth(peerName, netnsPath, ifName, addrs, gateways); err != nil {
+		deleteVeth(hostName)
+		return nil, err
+	}
+	containerIndex := 1
+	result.CNIVersion = cfg.CNIVersion
+	result.Interfaces = []cniInterface{{Name: hostName}, {Name: ifName, Sandbox: netnsPath}}
+	result.Routes = nil
+	routed := make(map[bool]bool) // is4 => default route added
+	for i := range result.IPs {
+		result.IPs[i].Interface = &containerIndex
+		if result.IPs[i].Gateway == "" {
+			result.IPs[i].Gateway = gateways[i].String()
+		}
+		if is4 := addrs[i].Addr().Is4(); !routed[is4] {
+			routed[is4] = true
+			result.Routes = append(result.Routes, cniRoute{Dst: defaultRoute(addrs[i].Addr())})
+		}
+	}
+	return &result, nil
+}
+
+func cniDel(cfg cniConfig, stdin []byte) error {
+	if _, err := execIPAM(cfg, stdin); err != nil {
+		return err
+	}
+	return deleteVeth(hostVethName(os.Getenv("CNI_CONTAINERID")))
+}
+
+// execIPAM executes the ipam plugin found in the CNI_PATH with the same env and stdin
+func execIPAM(cfg cniConfig, stdin []byte) ([]byte, error) {
+	if cfg.IPAM.Type == "" {
+		return nil, errors.New("ipam type is required")
+	}
+	var plugin string
+	for _, dir := range filepath.SplitList(os.Getenv("CNI_PATH")) {
+		path := filepath.Join(dir, cfg.IPAM.Type)
+		if _, err := os.Stat(path); err == nil {
+			plugin = path
+			break
+		}
+	}
+	if plugin == "" {
+		return nil, fmt.Errorf("ipam plugin %s not found in CNI_PATH", cfg.IPAM.Type)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(plugin)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		var cniErr cniError
+		if json.Unmarshal(stdout.Bytes(), &cniErr) == nil && cniErr.Msg != "" {
+			return nil, fmt.Errorf("ipam %s: %s", cfg.IPAM.Type, cniErr.Msg)
+		}
+		return nil, fmt.Errorf("ipam %s: %w: %s", cfg.IPAM.Type, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+func defaultRoute(addr netip.Addr) string {
+	if addr.Is4() {
+		return "0.0.0.0/0"
+	}
+	return "::/0"
+}
+
+// writeCNIError outputs the error in the CNI format, the runtime reads it from stdout and
+// requires the non-zero exit code
+func writeCNIError(cfg cniConfig, err error) error {
+	json.NewEncoder(os.Stdout).Encode(cniError{CNIVersion: cfg.CNIVersion, Code: 999, Msg: err.Error()})
+	os.Exit(1)
+	return err
+}
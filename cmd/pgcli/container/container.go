@@ -0,0 +1,54 @@
+// Package container attaches the containers to the overlay. The docker command serves a libnetwork
+// remote driver, the cni command is a minimal CNI plugin. Both create a veth pair per container, the
+// container side gets the address allocated by the IPAM of the network and the host side is routed
+// by the node, so the packets cross the tun of the vpn daemon like the ones of the host. The peers
+// reach the containers by routing the subnet via this node (pgcli route add <subnet> <overlay ip>)
+package container
+
+import (
+	"github.com/spf13/cobra"
+)
+
+var Cmd *cobra.Command
+
+func init() {
+	Cmd = &cobra.Command{
+		Use:          "container",
+		Short:        "Attach the containers to the overlay by a docker network driver or a CNI plugin",
+		SilenceUsage: true,
+	}
+	dockerCmd := &cobra.Command{
+		Use:   "docker",
+		Short: "Serve the docker network plugin (docker network create -d peerguard --subnet <subnet> <name>)",
+		Args:  cobra.NoArgs,
+		RunE:  runDocker,
+	}
+	dockerCmd.Flags().String("socket", "/run/docker/plugins/peerguard.sock", "the plugin socket docker discovers the driver by")
+	dockerCmd.Flags().Int("mtu", 1400, "mtu of the container interfaces, lower than the tun mtu")
+	Cmd.AddCommand(dockerCmd)
+	Cmd.AddCommand(&cobra.Command{
+		Use:   "cni",
+		Short: "Run as the CNI plugin, executed by the container runtime with the CNI_* env and the network config on stdin",
+		Long: "Run as the CNI plugin of the type peerguard. Install a shim executing `pgcli container cni` as " +
+			"peerguard in the CNI bin dir, the addresses are allocated by the delegated ipam plugin of the config",
+		Args: cobra.NoArgs,
+		RunE: runCNI,
+	})
+}
+
+// hostVethName is the host side of the veth of the endpoint, the names are limited to 15 bytes
+func hostVethName(id string) string {
+	return "pgc" + shortID(id)
+}
+
+// peerVethName is the temporary name of the container side before it is moved and renamed
+func peerVethName(id string) string {
+	return "pgt" + shortID(id)
+}
+
+func shortID(id string) string {
+	if len(id) > 11 {
+		return id[:11]
+	}
+	return id
+}
@@ -0,0 +1,248 @@
+package container
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/spf13/cobra"
+)
+
+// dockerContentType is the content type of the docker plugin api v1.2
+const dockerContentType = "application/vnd.docker.plugins.v1.2+json"
+
+func runDocker(cmd *cobra.Command, args []string) error {
+	socket, err := cmd.Flags().GetString("socket")
+	if err != nil {
+		return err
+	}
+	mtu, err := cmd.Flags().GetInt("mtu")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(socket), 0755); err != nil {
+		return err
+	}
+	os.Remove(socket)
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	driver := dockerDriver{
+		mtu:       mtu,
+		networks:  make(map[string]dockerNetwork),
+		endpoints: make(map[string]dockerEndpoint),
+	}
+	server := http.Server{Handler: driver.handler()}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	slog.Info("DockerNetworkPlugin", "socket", socket)
+	if err := server.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+type dockerNetwork struct {
+	gateways []netip.Addr
+}
+
+type dockerEndpoint struct {
+	networkID string
+	addrs     []netip.Addr
+}
+
+// dockerDriver is the local scoped libnetwork remote driver, the addresses are allocated by the
+// ipam driver of the network (the default one if not specified)
+type dockerDriver struct {
+	mtu int
+
+	mutex     sync.Mutex
+	networks  map[string]dockerNetwork  // network id as key
+	endpoints map[string]dockerEndpoint // endpoint id as key
+}
+
+type dockerIPAMData struct {
+	Pool    string `json:"Pool"`
+	Gateway string `json:"Gateway"`
+}
+
+type dockerInterface struct {
+	Address     string `json:"Address,omitempty"`
+	AddressIPv6 string `json:"AddressIPv6,omitempty"`
+	MacAddress  string `json:"MacAddress,omitempty"`
+}
+
+type dockerRequest struct {
+	NetworkID  string           `json:"NetworkID"`
+	EndpointID string           `json:"EndpointID"`
+	IPv4Data   []dockerIPAMData `json:"IPv4Data"`
+	IPv6Data   []dockerIPAMData `json:"IPv6Data"`
+	Interface  *dockerInterface `json:"Interface"`
+}
+
+type dockerInterfaceName struct {
+	SrcName   string `json:"SrcName"`
+	DstPrefix string `json:"DstPrefix"`
+}
+
+type dockerJoinResponse struct {
+	InterfaceName dockerInterfaceName `json:"InterfaceName"`
+	Gateway       string              `json:"Gateway,omitempty"`
+	GatewayIPv6   string              `json:"GatewayIPv6,omitempty"`
+}
+
+func (d *dockerDriver) handler() http.Handler {
+	mux := http.NewServeMux()
+	handle := func(method string, fn func(dockerRequest) (any, error)) {
+		mux.HandleFunc("POST /"+method, func(w http.ResponseWriter, r *http.Request) {
+			var req dockerRequest
+			// the requests without body (Plugin.Activate) are decoded as empty
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil && r.ContentLength > 0 {
+				writeDocker(w, nil, fmt.Errorf("decode %s: %w", method, err))
+				return
+			}
+			resp, err := fn(req)
+			if err != nil {
+				slog.Error("DockerNetworkPlugin", "method", method, "err", err)
+			}
+			writeDocker(w, resp, err)
+		})
+	}
+	empty := func(dockerRequest) (any, error) { return struct{}{}, nil }
+	handle("Plugin.Activate", func(dockerRequest) (any, error) {
+		return map[string][]string{"Implements": {"NetworkDriver"}}, nil
+	})
+	handle("NetworkDriver.GetCapabilities", func(dockerRequest) (any, error) {
+		return map[string]string{"Scope": "local", "ConnectivityScope": "local"}, nil
+	})
+	handle("NetworkDriver.CreateNetwork", d.createNetwork)
+	handle("NetworkDriver.DeleteNetwork", d.deleteNetwork)
+	handle("NetworkDriver.CreateEndpoint", d.createEndpoint)
+	handle("NetworkDriver.DeleteEndpoint", d.deleteEndpoint)
+	handle("NetworkDriver.EndpointOperInfo", func(dockerRequest) (any, error) {
+		return map[string]any{"Value": map[string]any{}}, nil
+	})
+	handle("NetworkDriver.Join", d.join)
+	handle("NetworkDriver.Leave", d.leave)
+	handle("NetworkDriver.DiscoverNew", empty)
+	handle("NetworkDriver.DiscoverDelete", empty)
+	handle("NetworkDriver.ProgramExternalConnectivity", empty)
+	handle("NetworkDriver.RevokeExternalConnectivity", empty)
+	return mux
+}
+
+func writeDocker(w http.ResponseWriter, resp any, err error) {
+	w.Header().Set("Content-Type", dockerContentType)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"Err": err.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (d *dockerDriver) createNetwork(req dockerRequest) (any, error) {
+	var network dockerNetwork
+	for _, data := range append(req.IPv4Data, req.IPv6Data...) {
+		if data.Gateway == "" {
+			continue
+		}
+		gateway, err := netip.ParsePrefix(data.Gateway)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gateway %s: %w", data.Gateway, err)
+		}
+		network.gateways = append(network.gateways, gateway.Addr())
+	}
+	if len(network.gateways) == 0 {
+		return nil, errors.New("the network requires a gateway allocated by the ipam")
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.networks[req.NetworkID] = network
+	slog.Info("DockerNetworkCreated", "network", req.NetworkID, "gateways", network.gateways)
+	return struct{}{}, nil
+}
+
+func (d *dockerDriver) deleteNetwork(req dockerRequest) (any, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	delete(d.networks, req.NetworkID)
+	return struct{}{}, nil
+}
+
+func (d *dockerDriver) createEndpoint(req dockerRequest) (any, error) {
+	if req.Interface == nil {
+		return nil, errors.New("the endpoint has no address allocated by the ipam")
+	}
+	endpoint := dockerEndpoint{networkID: req.NetworkID}
+	for _, s := range []string{req.Interface.Address, req.Interface.AddressIPv6} {
+		if s == "" {
+			continue
+		}
+		addr, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid endpoint address %s: %w", s, err)
+		}
+		endpoint.addrs = append(endpoint.addrs, addr.Addr())
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if _, ok := d.networks[req.NetworkID]; !ok {
+		return nil, fmt.Errorf("network %s not found", req.NetworkID)
+	}
+	d.endpoints[req.EndpointID] = endpoint
+	return struct{}{}, nil
+}
+
+func (d *dockerDriver) deleteEndpoint(req dockerRequest) (any, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	delete(d.endpoints, req.EndpointID)
+	return struct{}{}, deleteVeth(hostVethName(req.EndpointID))
+}
+
+// join creates the veth of the endpoint, docker moves the container side into the sandbox and
+// assigns the address of the endpoint to it
+func (d *dockerDriver) join(req dockerRequest) (any, error) {
+	d.mutex.Lock()
+	endpoint, ok := d.endpoints[req.EndpointID]
+	network := d.networks[req.NetworkID]
+	d.mutex.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("endpoint %s not found", req.EndpointID)
+	}
+	if err := createVeth(hostVethName(req.EndpointID), peerVethName(req.EndpointID), d.mtu, endpoint.addrs...); err != nil {
+		return nil, err
+	}
+	resp := dockerJoinResponse{
+		InterfaceName: dockerInterfaceName{SrcName: peerVethName(req.EndpointID), DstPrefix: "eth"},
+	}
+	for _, gateway := range network.gateways {
+		if gateway.Is4() {
+			resp.Gateway = gateway.String()
+		} else {
+			resp.GatewayIPv6 = gateway.String()
+		}
+	}
+	slog.Info("DockerEndpointJoined", "endpoint", req.EndpointID, "addrs", endpoint.addrs)
+	return resp, nil
+}
+
+func (d *dockerDriver) leave(req dockerRequest) (any, error) {
+	return struct{}{}, deleteVeth(hostVethName(req.EndpointID))
+}
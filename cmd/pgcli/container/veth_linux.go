@@ -0,0 +1,128 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// createVeth creates the veth pair and routes the addrs to the host side. The host side answers
+// the arp of the container for any ip (proxy_arp), so the container reaches the gateway and the
+// other containers by the host
+func createVeth(hostName, peerName string, mtu int, addrs ...netip.Addr) error {
+	veth := &netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{Name: hostName, MTU: mtu},
+		PeerName:  peerName,
+	}
+	if err := netlink.LinkAdd(veth); err != nil {
+		return fmt.Errorf("create veth %s: %w", hostName, err)
+	}
+	host, err := netlink.LinkByName(hostName)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(fmt.Sprintf("/proc/sys/net/ipv4/conf/%s/proxy_arp", hostName), []byte("1"), 0644); err != nil {
+		deleteVeth(hostName)
+		return fmt.Errorf("enable proxy_arp: %w", err)
+	}
+	if err := netlink.LinkSetUp(host); err != nil {
+		deleteVeth(hostName)
+		return err
+	}
+	for _, addr := range addrs {
+		route := netlink.Route{
+			LinkIndex: host.Attrs().Index,
+			Dst:       &net.IPNet{IP: addr.AsSlice(), Mask: net.CIDRMask(addr.BitLen(), addr.BitLen())},
+			Scope:     netlink.SCOPE_LINK,
+		}
+		if err := netlink.RouteReplace(&route); err != nil {
+			deleteVeth(hostName)
+			return fmt.Errorf("route %s to %s: %w", addr, hostName, err)
+		}
+	}
+	return nil
+}
+
+// deleteVeth deletes the veth pair by the host side, the routes go with it
+func deleteVeth(hostName string) error {
+	link, err := netlink.LinkByName(hostName)
+	if err != nil {
+		var notFound netlink.LinkNotFoundError
+		if errors.As(err, &notFound) {
+			return nil
+		}
+		return err
+	}
+	return netlink.LinkDel(link)
+}
+
+func vethExists(hostName string) bool {
+	_, err := netlink.LinkByName(hostName)
+	return err == nil
+}
+
+// setupContainerVeth moves the container side into the netns, renames it to ifName and configures
+// the addrs, the on-link route to the gateway and the default route via it of each family
+func setupContainerVeth(peerName, netnsPath, ifName string, addrs []netip.Prefix, gateways []netip.Addr) error {
+	ns, err := netns.GetFromPath(netnsPath)
+	if err != nil {
+		return fmt.Errorf("open netns %s: %w", netnsPath, err)
+	}
+	defer ns.Close()
+	peer, err := netlink.LinkByName(peerName)
+	if err != nil {
+		return err
+	}
+	if err := netlink.LinkSetNsFd(peer, int(ns)); err != nil {
+		return fmt.Errorf("move %s to netns: %w", peerName, err)
+	}
+	handle, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+	link, err := handle.LinkByName(peerName)
+	if err != nil {
+		return err
+	}
+	if err := handle.LinkSetName(link, ifName); err != nil {
+		return fmt.Errorf("rename %s to %s: %w", peerName, ifName, err)
+	}
+	for _, addr := range addrs {
+		ipnet := &net.IPNet{IP: addr.Addr().AsSlice(), Mask: net.CIDRMask(addr.Bits(), addr.Addr().BitLen())}
+		if err := handle.AddrAdd(link, &netlink.Addr{IPNet: ipnet}); err != nil {
+			return fmt.Errorf("add address %s: %w", addr, err)
+		}
+	}
+	if err := handle.LinkSetUp(link); err != nil {
+		return err
+	}
+	routed := make(map[int]bool) // bits => default route added
+	for _, gateway := range gateways {
+		bits := gateway.BitLen()
+		if routed[bits] {
+			continue
+		}
+		routed[bits] = true
+		if err := handle.RouteAdd(&netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       &net.IPNet{IP: gateway.AsSlice(), Mask: net.CIDRMask(bits, bits)},
+			Scope:     netlink.SCOPE_LINK,
+		}); err != nil && !errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("route to gateway %s: %w", gateway, err)
+		}
+		if err := handle.RouteAdd(&netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       &net.IPNet{IP: make(net.IP, bits/8), Mask: net.CIDRMask(0, bits)},
+			Gw:        gateway.AsSlice(),
+		}); err != nil {
+			return fmt.Errorf("default route via %s: %w", gateway, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+
+package container
+
+import (
+	"errors"
+	"net/netip"
+)
+
+func createVeth(string, string, int, ...netip.Addr) error {
+	return errors.ErrUnsupported
+}
+
+func deleteVeth(string) error {
+	return errors.ErrUnsupported
+}
+
+func vethExists(string) bool {
+	return false
+}
+
+func setupContainerVeth(string, string, string, []netip.Prefix, []netip.Addr) error {
+	return errors.ErrUnsupported
+}
@@ -24,4 +24,62 @@ func init() {
 			return nil
 		},
 	}
+	Cmd.AddCommand(exportCmd())
+	Cmd.AddCommand(importCmd())
+}
+
+func exportCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Export the node key pair from the key file",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			keyFile, err := cmd.Flags().GetString("key-file")
+			if err != nil {
+				return err
+			}
+			priv, err := secure.LoadCurve25519File(keyFile)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("priv\t%s\n", priv.String())
+			fmt.Printf("pub\t%s\n", priv.PublicKey.String())
+			return nil
+		},
+	}
+	cmd.Flags().String("key-file", secure.DefaultKeyFile, "curve25519 private key file")
+	return cmd
+}
+
+func importCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "import <priv>",
+		Short: "Import a base58 encoded private key to the key file",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			keyFile, err := cmd.Flags().GetString("key-file")
+			if err != nil {
+				return err
+			}
+			force, err := cmd.Flags().GetBool("force")
+			if err != nil {
+				return err
+			}
+			if _, err := secure.LoadCurve25519File(keyFile); err == nil && !force {
+				return fmt.Errorf("key file %s already exists, use --force to overwrite", keyFile)
+			}
+			priv, err := secure.Curve25519PrivateKey(args[0])
+			if err != nil {
+				return err
+			}
+			if err := secure.StoreCurve25519File(keyFile, priv); err != nil {
+				return err
+			}
+			fmt.Printf("pub\t%s\n", priv.PublicKey.String())
+			return nil
+		},
+	}
+	cmd.Flags().String("key-file", secure.DefaultKeyFile, "curve25519 private key file")
+	cmd.Flags().Bool("force", false, "overwrite the existing key file")
+	return cmd
 }
@@ -0,0 +1,63 @@
+package debug
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/rkonfj/peerguard/cmd/pgcli/localapi"
+	"github.com/spf13/cobra"
+)
+
+var Cmd *cobra.Command
+
+func init() {
+	Cmd = &cobra.Command{
+		Use:          "debug",
+		Short:        "Debug the running vpn daemon by its local api socket",
+		SilenceUsage: true,
+	}
+	localapi.AddFlags(Cmd.PersistentFlags())
+	Cmd.AddCommand(captureCmd())
+}
+
+func captureCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "capture",
+		Short: "Stream the packets captured by the vpn daemon to stdout in pcapng",
+		Long: "Stream the packets crossing the tun device and the decrypted datagrams exchanged with the peers " +
+			"to stdout in pcapng until interrupted, e.g. `pgcli debug capture | wireshark -k -i -` " +
+			"or `... | tcpdump -n -r -`. The datagrams relayed by the peermap server are commented `relayed`",
+		Args: cobra.NoArgs,
+		RunE: capture,
+	}
+	cmd.Flags().String("iface", "all", "the interface to capture (tun|peer|all)")
+	return cmd
+}
+
+func capture(cmd *cobra.Command, args []string) error {
+	client, err := localapi.NewClientFromFlags(cmd.Flags())
+	if err != nil {
+		return err
+	}
+	iface, err := cmd.Flags().GetString("iface")
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	body, err := client.Capture(ctx, iface)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	if _, err := io.Copy(os.Stdout, body); err != nil && ctx.Err() == nil && !errors.Is(err, syscall.EPIPE) {
+		return err
+	}
+	return nil
+}
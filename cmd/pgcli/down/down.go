@@ -0,0 +1,26 @@
+package down
+
+import (
+	"context"
+
+	"github.com/rkonfj/peerguard/cmd/pgcli/localapi"
+	"github.com/spf13/cobra"
+)
+
+var Cmd *cobra.Command
+
+func init() {
+	Cmd = &cobra.Command{
+		Use:   "down",
+		Short: "Pause the overlay without stopping the vpn daemon, the routes are removed and the forwarding is stopped until pgcli up",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, err := localapi.NewClientFromFlags(cmd.Flags())
+			if err != nil {
+				return err
+			}
+			return client.Down(context.Background())
+		},
+	}
+	localapi.AddFlags(Cmd.Flags())
+}
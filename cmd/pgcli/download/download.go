@@ -33,12 +33,7 @@ func init() {
 }
 
 func execute(cmd *cobra.Command, args []string) error {
-	verbose, err := cmd.Flags().GetInt("verbose")
-	if err != nil {
-		return err
-	}
-	slog.SetLogLoggerLevel(slog.Level(verbose))
-
+	var err error
 	downloader := fileshare.Downloader{ListenUDPPort: 29879}
 
 	downloader.Server, err = cmd.Flags().GetString("server")
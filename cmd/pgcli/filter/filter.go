@@ -0,0 +1,59 @@
+package filter
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/rkonfj/peerguard/cmd/pgcli/localapi"
+	"github.com/spf13/cobra"
+)
+
+var Cmd *cobra.Command
+
+func init() {
+	Cmd = &cobra.Command{
+		Use:   "filter",
+		Short: "Manage the packet filter rules of the running vpn daemon",
+		Long: "Manage the packet filter rules on the tun path of the running vpn daemon (pgcli vpn --filter). " +
+			"The first rule matched decides and the packet matching no rule is allowed, append deny as the last " +
+			"rule to deny the others. The filter works with the acl of the network (pgcli admin set-acl)",
+		SilenceUsage: true,
+	}
+	localapi.AddFlags(Cmd.PersistentFlags())
+	Cmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List the rules in order",
+		Args:  cobra.NoArgs,
+		RunE:  list,
+	})
+	Cmd.AddCommand(&cobra.Command{
+		Use:   "set [rule...]",
+		Short: "Replace the rules, e.g. allow,in,proto=tcp,port=22 deny,in (no rules to allow all)",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, err := localapi.NewClientFromFlags(cmd.Flags())
+			if err != nil {
+				return err
+			}
+			return client.SetFilterRules(context.Background(), args)
+		},
+	})
+}
+
+func list(cmd *cobra.Command, args []string) error {
+	client, err := localapi.NewClientFromFlags(cmd.Flags())
+	if err != nil {
+		return err
+	}
+	rules, err := client.FilterRules(context.Background())
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "#\tRULE")
+	for i, rule := range rules {
+		fmt.Fprintf(w, "%d\t%s\n", i+1, rule)
+	}
+	return w.Flush()
+}
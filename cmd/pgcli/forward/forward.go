@@ -0,0 +1,105 @@
+package forward
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/rkonfj/peerguard/cmd/pgcli/overlay"
+	"github.com/rkonfj/peerguard/forward"
+	"github.com/spf13/cobra"
+)
+
+var Cmd *cobra.Command
+
+func init() {
+	Cmd = &cobra.Command{
+		Use:   "forward",
+		Short: "Forward local ports to the ports of peers over the p2p network",
+	}
+	tcpCmd := &cobra.Command{
+		Use:     "tcp <listen addr> <peer>:<port>",
+		Short:   "Listen on the local tcp address and tunnel the connections to the tcp port of the peer",
+		Long:    "Listen on the local tcp address and tunnel the connections to the tcp port of the peer (peer id, overlay ip or alias), the peer runs `pgcli vpn` dials the port on its overlay ip",
+		Example: "  pgcli forward tcp :8080 100.99.0.2:80",
+		Args:    cobra.ExactArgs(2),
+		RunE:    runTCP,
+	}
+	overlay.AddFlags(tcpCmd.Flags(), 29883)
+	Cmd.AddCommand(tcpCmd)
+}
+
+func runTCP(cmd *cobra.Command, args []string) error {
+	peer, port, err := ParseTarget(args[1])
+	if err != nil {
+		return err
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	network, err := overlay.Join(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	defer network.Close()
+	go network.Discard() // the stream datagrams are dispatched by ReadFrom
+
+	peerID, err := network.Resolve(ctx, peer)
+	if err != nil {
+		return err
+	}
+	client, err := forward.NewClient(network.StreamConn())
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	listener, err := net.Listen("tcp", args[0])
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	fmt.Printf("Forwarding %s -> %s (%s) port %d\n", listener.Addr(), peer, peerID, port)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			dialCtx, dialCancel := context.WithTimeout(ctx, 10*time.Second)
+			remote, err := client.Dial(dialCtx, peerID, port)
+			dialCancel()
+			if err != nil {
+				slog.Error("Forward", "from", conn.RemoteAddr(), "err", err)
+				return
+			}
+			forward.Pipe(conn, remote)
+		}()
+	}
+}
+
+// ParseTarget parses <peer>:<port>, the peer is the peer id, overlay ip or alias
+func ParseTarget(target string) (string, uint16, error) {
+	peer, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid target %s: %w", target, err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return "", 0, fmt.Errorf("invalid port %s", portStr)
+	}
+	return peer, uint16(port), nil
+}
@@ -0,0 +1,134 @@
+package key
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+
+	"github.com/rkonfj/peerguard/cmd/pgcli/pins"
+	"github.com/rkonfj/peerguard/secure"
+	"github.com/spf13/cobra"
+)
+
+var Cmd *cobra.Command
+
+func init() {
+	Cmd = &cobra.Command{
+		Use:   "key",
+		Short: "Manage the node key (the peer id is its public key) and the pinned peers",
+	}
+	Cmd.PersistentFlags().String("key-file", secure.DefaultKeyFile, "curve25519 private key file of the vpn")
+	Cmd.PersistentFlags().String("state-key", "env:PG_STATE_KEY", "key the key file is encrypted by (env:NAME, file:PATH or the key itself), the same as the vpn's")
+	Cmd.AddCommand(generateCmd())
+	Cmd.AddCommand(showCmd())
+	Cmd.AddCommand(rotateCmd())
+	Cmd.AddCommand(pins.NewCmd())
+}
+
+func generateCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "generate",
+		Short: "Generate the node key into the key file and print the peer id",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			force, err := cmd.Flags().GetBool("force")
+			if err != nil {
+				return err
+			}
+			keyFile, sealingKey, err := keyFileFlags(cmd)
+			if err != nil {
+				return err
+			}
+			if _, err := os.Stat(keyFile); err == nil && !force {
+				return fmt.Errorf("key file %s already exists, use --force to overwrite or rotate to replace it", keyFile)
+			}
+			priv, err := secure.GenerateCurve25519()
+			if err != nil {
+				return err
+			}
+			if err := secure.StoreSealedCurve25519File(keyFile, priv, sealingKey); err != nil {
+				return err
+			}
+			fmt.Println(priv.PublicKey.String())
+			return nil
+		},
+	}
+	cmd.Flags().Bool("force", false, "overwrite the existing key file")
+	return cmd
+}
+
+func showCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "show",
+		Short: "Print the public key of the node key, which is the peer id of the vpn",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			keyFile, sealingKey, err := keyFileFlags(cmd)
+			if err != nil {
+				return err
+			}
+			priv, err := secure.LoadSealedCurve25519File(keyFile, sealingKey)
+			if err != nil {
+				return err
+			}
+			fmt.Println(priv.PublicKey.String())
+			return nil
+		},
+	}
+}
+
+func rotateCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "rotate",
+		Short: "Replace the node key with a new one, the old one is kept in <key-file>.old",
+		Long: "Replace the node key with a new one, the old one is kept in <key-file>.old. The peer id changes with " +
+			"the key, so the vpn daemon has to be restarted, and the peers pinned the old peer id reject the new " +
+			"one until the pin is cleared or replaced on them",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			keyFile, sealingKey, err := keyFileFlags(cmd)
+			if err != nil {
+				return err
+			}
+			old, err := secure.LoadSealedCurve25519File(keyFile, sealingKey)
+			if errors.Is(err, fs.ErrNotExist) {
+				return fmt.Errorf("key file %s does not exist, use generate instead", keyFile)
+			}
+			if err != nil {
+				return err
+			}
+			priv, err := secure.GenerateCurve25519()
+			if err != nil {
+				return err
+			}
+			if err := secure.StoreSealedCurve25519File(keyFile+".old", old, sealingKey); err != nil {
+				return err
+			}
+			if err := secure.StoreSealedCurve25519File(keyFile, priv, sealingKey); err != nil {
+				return err
+			}
+			fmt.Printf("old\t%s\n", old.PublicKey.String())
+			fmt.Printf("new\t%s\n", priv.PublicKey.String())
+			fmt.Println("Restart the vpn daemon to use the new key. On the peers pinned the old peer id, run " +
+				"`pgcli key pins add <ip> <new> --force` (or `pgcli key pins clear <ip>`)")
+			return nil
+		},
+	}
+}
+
+func keyFileFlags(cmd *cobra.Command) (keyFile string, sealingKey []byte, err error) {
+	keyFile, err = cmd.Flags().GetString("key-file")
+	if err != nil {
+		return
+	}
+	stateKey, err := cmd.Flags().GetString("state-key")
+	if err != nil {
+		return
+	}
+	if stateKey == "env:PG_STATE_KEY" && os.Getenv("PG_STATE_KEY") == "" {
+		stateKey = ""
+	}
+	sealingKey, err = secure.ResolveSealingKey(stateKey, "pgcli")
+	return
+}
@@ -0,0 +1,328 @@
+// Package localapi is the api served by the vpn daemon on its socket (pgcli daemon --socket), used by
+// the thin commands controlling the running daemon without restarting the tun, e.g. up, down and top
+package localapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+const (
+	PathDirect = "direct"
+	PathRelay  = "relay"
+
+	StateUp   = "up"
+	StateDown = "down"
+
+	RuleIntact  = "intact"
+	RuleMissing = "missing"
+	RulePaused  = "paused"
+	RuleUnknown = "unknown"
+
+	// MetricsPort is the port the daemon serves the metrics to the peers on its overlay ips if opted in
+	MetricsPort = 29890
+)
+
+// DefaultSocket is the socket the daemon serves on and the commands request by default
+var DefaultSocket = defaultSocket()
+
+func defaultSocket() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.TempDir(), "pgcli.sock")
+	}
+	return "/var/run/pgcli.sock"
+}
+
+// AddFlags adds the flag of the daemon socket
+func AddFlags(flags *pflag.FlagSet) {
+	flags.String("socket", DefaultSocket, "the local api socket of the vpn daemon")
+}
+
+// NewClientFromFlags creates the client requesting the socket flag
+func NewClientFromFlags(flags *pflag.FlagSet) (*Client, error) {
+	socket, err := flags.GetString("socket")
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(socket), nil
+}
+
+// Status is the state of the daemon
+type Status struct {
+	// State is down if the overlay is paused by down
+	State   string `json:"state"`
+	PeerID  string `json:"peerID,omitempty"`
+	Server  string `json:"server"`
+	Tun     string `json:"tun"`
+	IPv4    string `json:"ipv4,omitempty"`
+	IPv6    string `json:"ipv6,omitempty"`
+	Version string `json:"version"`
+}
+
+// Route is the route to the dst cidr via the overlay ip of a peer
+type Route struct {
+	Dst string `json:"dst"`
+	Via string `json:"via"`
+}
+
+// Peer is the peer known by the vpn daemon
+type Peer struct {
+	ID string `json:"id"`
+	// Name is the hostname advertised by the peer
+	Name string `json:"name,omitempty"`
+	IPv4 string `json:"ipv4,omitempty"`
+	IPv6 string `json:"ipv6,omitempty"`
+	// Path is the path the datagrams are sent to the peer over, empty if nothing is sent yet
+	Path      string        `json:"path,omitempty"`
+	RTT       time.Duration `json:"rtt,omitempty"`
+	RxBytes   uint64        `json:"rxBytes"`
+	TxBytes   uint64        `json:"txBytes"`
+	RxPackets uint64        `json:"rxPackets"`
+	TxPackets uint64        `json:"txPackets"`
+	LastSeen  time.Time     `json:"lastSeen,omitzero"`
+	// Quality is measured by the periodic pings, nil if the peer is not pinged recently
+	Quality *Quality `json:"quality,omitempty"`
+}
+
+// Quality is the connection quality to the peer
+type Quality struct {
+	// Score is 0 (unusable) to 100 (direct, low latency and no loss)
+	Score int `json:"score"`
+	// RTT is smoothed over the recent pings
+	RTT  time.Duration `json:"rtt"`
+	Loss float64       `json:"loss"`
+	// Flaps is the number of the fallbacks from the direct path to the relay in the last 10 minutes
+	Flaps int `json:"flaps"`
+}
+
+// Match reports whether the name (case insensitive), the id or an overlay ip of the peer is s
+func (p Peer) Match(s string) bool {
+	return strings.EqualFold(p.Name, s) || p.ID == s || p.IPv4 == s || p.IPv6 == s
+}
+
+// PeerPath explains how the peer is reached, see Peer.Path
+type PeerPath struct {
+	Peer Peer `json:"peer"`
+	// Addr is the udp addr the datagrams are sent to directly, empty if the peer is not reachable directly
+	Addr string `json:"addr,omitempty"`
+	// Addrs are the udp addrs the peer is active on, the candidates or the ones found by the port scanning
+	Addrs    []string `json:"addrs,omitempty"`
+	LocalNAT string   `json:"localNAT"`
+	PeerNAT  string   `json:"peerNAT"`
+	// Candidates are the addrs received from the peer and tried, LocalCandidates are the ones sent to the peer
+	Candidates      []Candidate `json:"candidates"`
+	LocalCandidates []Candidate `json:"localCandidates"`
+}
+
+// Candidate is an udp addr exchanged by the peermap server for the hole punching
+type Candidate struct {
+	Addr string `json:"addr"`
+	// Type is the kind of the addr, internal, upnp, ip4, ip6 or the NAT type (easy, hard) if discovered by the STUN servers
+	Type        string    `json:"type"`
+	Time        time.Time `json:"time"`
+	PortScanned bool      `json:"portScanned,omitempty"`
+}
+
+// Rules is the system state managed by the daemon, checked against the system. Routes includes the
+// policy routing of the exit node, Firewall is the masquerade rules of the exit node or the subnet
+// router, the daemon installs no kill switch or packet filter rules
+type Rules struct {
+	Tun       string `json:"tun"`
+	Addresses []Rule `json:"addresses"`
+	Routes    []Rule `json:"routes"`
+	Firewall  []Rule `json:"firewall,omitempty"`
+}
+
+// Rule is an address or a route managed by the daemon, State is intact, missing (removed by an
+// external tool), paused (removed by down) or unknown (the check failed, see Error)
+type Rule struct {
+	Rule  string `json:"rule"`
+	State string `json:"state"`
+	Error string `json:"error,omitempty"`
+}
+
+// Metrics is the queue depths, the drop counters and the traffic totals of the daemon
+type Metrics struct {
+	State   string `json:"state"`
+	Version string `json:"version"`
+	// InboundQueue and OutboundQueue are the packets queued from the peers to the tun and vice versa
+	InboundQueue  int `json:"inboundQueue"`
+	OutboundQueue int `json:"outboundQueue"`
+	QueueCap      int `json:"queueCap"`
+	// Drops is the number of the packets dropped by reason
+	Drops     map[string]uint64 `json:"drops"`
+	Peers     int               `json:"peers"`
+	RxBytes   uint64            `json:"rxBytes"`
+	TxBytes   uint64            `json:"txBytes"`
+	RxPackets uint64            `json:"rxPackets"`
+	TxPackets uint64            `json:"txPackets"`
+	// Panics is the number of the goroutine panics recovered by the daemon
+	Panics uint64 `json:"panics"`
+}
+
+// PeerMetrics fetches the metrics of the peer over the overlay, the daemon of the peer
+// serves them only if started with --serve-metrics
+func PeerMetrics(ctx context.Context, ip string) (metrics Metrics, err error) {
+	u := url.URL{Scheme: "http", Host: net.JoinHostPort(ip, strconv.Itoa(MetricsPort)), Path: "/metrics"}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return metrics, fmt.Errorf("request the peer (is it serving the metrics?): %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return metrics, fmt.Errorf("request the peer: %s", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&metrics)
+	return
+}
+
+// Client requests the api on the debug socket
+type Client struct {
+	httpClient http.Client
+}
+
+func NewClient(socket string) *Client {
+	return &Client{httpClient: http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}}}
+}
+
+// Peers lists the peers, the rtt is measured by pinging the peers if rtt is true
+func (c *Client) Peers(ctx context.Context, rtt bool) (peers []Peer, err error) {
+	query := url.Values{}
+	if rtt {
+		query.Set("rtt", "1")
+	}
+	err = c.do(ctx, http.MethodGet, "/peers", query, nil, &peers)
+	return
+}
+
+// Status queries the state of the daemon
+func (c *Client) Status(ctx context.Context) (status Status, err error) {
+	err = c.do(ctx, http.MethodGet, "/status", nil, nil, &status)
+	return
+}
+
+// Up resumes the overlay, the routes removed by down are added back
+func (c *Client) Up(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/up", nil, nil, nil)
+}
+
+// Down pauses the overlay, the routes are removed and the packets to the peers are dropped until up.
+// The daemon keeps the peermap session and the peers
+func (c *Client) Down(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/down", nil, nil, nil)
+}
+
+// Path explains how the peer is reached, the peer is pinged to measure the rtt
+func (c *Client) Path(ctx context.Context, peerID string) (path PeerPath, err error) {
+	err = c.do(ctx, http.MethodGet, "/path", url.Values{"peer": {peerID}}, nil, &path)
+	return
+}
+
+// Metrics queries the metrics of the daemon
+func (c *Client) Metrics(ctx context.Context) (metrics Metrics, err error) {
+	err = c.do(ctx, http.MethodGet, "/metrics", nil, nil, &metrics)
+	return
+}
+
+// Routes lists the routes via the peers
+func (c *Client) Routes(ctx context.Context) (routes []Route, err error) {
+	err = c.do(ctx, http.MethodGet, "/routes", nil, nil, &routes)
+	return
+}
+
+// AddRoute adds the route to the system and the daemon
+func (c *Client) AddRoute(ctx context.Context, route Route) error {
+	return c.do(ctx, http.MethodPost, "/routes", nil, route, nil)
+}
+
+// DelRoute deletes the route from the system and the daemon
+func (c *Client) DelRoute(ctx context.Context, route Route) error {
+	return c.do(ctx, http.MethodDelete, "/routes", url.Values{"dst": {route.Dst}, "via": {route.Via}}, nil, nil)
+}
+
+// Rules lists the addresses and the routes managed by the daemon and checks they are intact
+func (c *Client) Rules(ctx context.Context) (rules Rules, err error) {
+	err = c.do(ctx, http.MethodGet, "/rules", nil, nil, &rules)
+	return
+}
+
+// FilterRules lists the packet filter rules of the daemon in order
+func (c *Client) FilterRules(ctx context.Context) (rules []string, err error) {
+	err = c.do(ctx, http.MethodGet, "/filter", nil, nil, &rules)
+	return
+}
+
+// SetFilterRules replaces the packet filter rules of the daemon, empty allows all
+func (c *Client) SetFilterRules(ctx context.Context, rules []string) error {
+	if rules == nil {
+		rules = []string{}
+	}
+	return c.do(ctx, http.MethodPut, "/filter", nil, rules, nil)
+}
+
+// Capture streams the packets captured on the iface (tun|peer|all) in pcapng until ctx is done
+func (c *Client) Capture(ctx context.Context, iface string) (io.ReadCloser, error) {
+	return c.request(ctx, http.MethodGet, "/capture", url.Values{"iface": {iface}}, nil)
+}
+
+// do requests the api with the json body if in is not nil, and decodes the json response into out if not nil
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	resp, err := c.request(ctx, method, path, query, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp).Decode(out)
+}
+
+func (c *Client) request(ctx context.Context, method, path string, query url.Values, body io.Reader) (io.ReadCloser, error) {
+	u := url.URL{Scheme: "http", Host: "pgcli", Path: path, RawQuery: query.Encode()}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request the daemon: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return resp.Body, nil
+}
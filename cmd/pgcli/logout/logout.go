@@ -0,0 +1,91 @@
+package logout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"time"
+
+	"github.com/rkonfj/peerguard/disco"
+	"github.com/rkonfj/peerguard/p2p"
+	"github.com/rkonfj/peerguard/peermap/network"
+	"github.com/rkonfj/peerguard/secure"
+	"github.com/spf13/cobra"
+)
+
+var Cmd *cobra.Command
+
+func init() {
+	Cmd = &cobra.Command{
+		Use:   "logout",
+		Short: "Revoke the network secret on the peermap server and remove it",
+		Args:  cobra.NoArgs,
+		RunE:  run,
+	}
+	Cmd.Flags().StringP("secret-file", "f", "", "p2p network secret file used if the os keyring is not available (default ~/.peerguard_network_secret.json)")
+	Cmd.Flags().StringP("server", "s", os.Getenv("PG_SERVER"), "peermap server url")
+	Cmd.Flags().String("state-key", "env:PG_STATE_KEY", "key the secret file is encrypted by (env:NAME, file:PATH or the key itself)")
+	Cmd.Flags().Bool("no-keyring", false, "the network secret is stored in the secret file rather than the os keyring")
+	Cmd.Flags().Bool("all", false, "revoke all secrets issued to the same user (logout all devices)")
+}
+
+func run(cmd *cobra.Command, args []string) error {
+	secretFile, err := cmd.Flags().GetString("secret-file")
+	if err != nil {
+		return err
+	}
+	server, err := cmd.Flags().GetString("server")
+	if err != nil {
+		return err
+	}
+	if server == "" {
+		return errors.New("flag \"server\" not set")
+	}
+	all, err := cmd.Flags().GetBool("all")
+	if err != nil {
+		return err
+	}
+	noKeyring, err := cmd.Flags().GetBool("no-keyring")
+	if err != nil {
+		return err
+	}
+	if secretFile == "" {
+		currentUser, err := user.Current()
+		if err != nil {
+			return err
+		}
+		secretFile = filepath.Join(currentUser.HomeDir, ".peerguard_network_secret.json")
+	}
+	stateKey, err := cmd.Flags().GetString("state-key")
+	if err != nil {
+		return err
+	}
+	if stateKey == "env:PG_STATE_KEY" && os.Getenv("PG_STATE_KEY") == "" {
+		stateKey = ""
+	}
+	sealingKey, err := secure.ResolveSealingKey(stateKey, "pgcli")
+	if err != nil {
+		return err
+	}
+	var store disco.SecretStore = p2p.EncryptedFileSecretStore(secretFile, sealingKey)
+	if !noKeyring {
+		store = p2p.KeyringSecretStore(server, secretFile, sealingKey)
+	}
+	secret, err := store.NetworkSecret()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := network.Logout(ctx, server, secret, all); err != nil {
+		return err
+	}
+	if err := store.(interface{ Remove() error }).Remove(); err != nil {
+		return err
+	}
+	fmt.Println("Logged out from", secret.Network)
+	return nil
+}
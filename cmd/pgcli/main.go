@@ -1,14 +1,46 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"log/slog"
+	"time"
 
 	"github.com/rkonfj/peerguard/cmd/pgcli/admin"
+	"github.com/rkonfj/peerguard/cmd/pgcli/bench"
+	"github.com/rkonfj/peerguard/cmd/pgcli/bugreport"
+	"github.com/rkonfj/peerguard/cmd/pgcli/chat"
+	"github.com/rkonfj/peerguard/cmd/pgcli/container"
 	"github.com/rkonfj/peerguard/cmd/pgcli/curve25519"
+	"github.com/rkonfj/peerguard/cmd/pgcli/debug"
+	"github.com/rkonfj/peerguard/cmd/pgcli/down"
 	"github.com/rkonfj/peerguard/cmd/pgcli/download"
+	"github.com/rkonfj/peerguard/cmd/pgcli/filter"
+	"github.com/rkonfj/peerguard/cmd/pgcli/forward"
+	"github.com/rkonfj/peerguard/cmd/pgcli/key"
+	"github.com/rkonfj/peerguard/cmd/pgcli/logout"
+	"github.com/rkonfj/peerguard/cmd/pgcli/metrics"
+	"github.com/rkonfj/peerguard/cmd/pgcli/netcheck"
+	"github.com/rkonfj/peerguard/cmd/pgcli/path"
+	"github.com/rkonfj/peerguard/cmd/pgcli/ping"
+	"github.com/rkonfj/peerguard/cmd/pgcli/pins"
+	"github.com/rkonfj/peerguard/cmd/pgcli/proxy"
+	"github.com/rkonfj/peerguard/cmd/pgcli/recv"
+	"github.com/rkonfj/peerguard/cmd/pgcli/resolve"
+	"github.com/rkonfj/peerguard/cmd/pgcli/route"
+	"github.com/rkonfj/peerguard/cmd/pgcli/rules"
+	"github.com/rkonfj/peerguard/cmd/pgcli/send"
+	"github.com/rkonfj/peerguard/cmd/pgcli/serve"
 	"github.com/rkonfj/peerguard/cmd/pgcli/share"
+	"github.com/rkonfj/peerguard/cmd/pgcli/sshproxy"
+	"github.com/rkonfj/peerguard/cmd/pgcli/status"
+	"github.com/rkonfj/peerguard/cmd/pgcli/token"
+	"github.com/rkonfj/peerguard/cmd/pgcli/top"
+	"github.com/rkonfj/peerguard/cmd/pgcli/up"
 	"github.com/rkonfj/peerguard/cmd/pgcli/vpn"
+	"github.com/rkonfj/peerguard/crash"
+	"github.com/rkonfj/peerguard/disco"
+	"github.com/rkonfj/peerguard/logging"
+	"github.com/rkonfj/peerguard/tracing"
 	"github.com/spf13/cobra"
 )
 
@@ -28,19 +60,59 @@ func main() {
 			if err != nil {
 				return err
 			}
-			slog.SetLogLoggerLevel(slog.Level(verbose))
-			return nil
+			if err := logging.Setup(cmd.Flags(), verbose); err != nil {
+				return err
+			}
+			if err := crash.Setup(cmd.Flags(), "pgcli"); err != nil {
+				return err
+			}
+			return tracing.Setup(cmd.Flags(), "pgcli")
 		},
 	}
 
+	disco.Version = fmt.Sprintf("%s-%s", Version, Commit)
 	vpn.Version = Version
 	vpn.Commit = Commit
 	cmd.AddCommand(vpn.Cmd)
+	cmd.AddCommand(status.Cmd)
+	cmd.AddCommand(up.Cmd)
+	cmd.AddCommand(down.Cmd)
+	cmd.AddCommand(route.Cmd)
+	cmd.AddCommand(rules.Cmd)
+	cmd.AddCommand(filter.Cmd)
+	cmd.AddCommand(resolve.Cmd)
 	cmd.AddCommand(admin.Cmd)
+	cmd.AddCommand(token.Cmd)
 	cmd.AddCommand(curve25519.Cmd)
 	cmd.AddCommand(share.Cmd)
 	cmd.AddCommand(download.Cmd)
+	cmd.AddCommand(send.Cmd)
+	cmd.AddCommand(recv.Cmd)
+	cmd.AddCommand(key.Cmd)
+	cmd.AddCommand(pins.Cmd)
+	cmd.AddCommand(logout.Cmd)
+	cmd.AddCommand(netcheck.Cmd)
+	cmd.AddCommand(ping.Cmd)
+	cmd.AddCommand(path.Cmd)
+	cmd.AddCommand(bench.Cmd)
+	cmd.AddCommand(debug.Cmd)
+	cmd.AddCommand(top.Cmd)
+	cmd.AddCommand(metrics.Cmd)
+	cmd.AddCommand(bugreport.Cmd)
+	cmd.AddCommand(forward.Cmd)
+	cmd.AddCommand(proxy.Cmd)
+	cmd.AddCommand(serve.Cmd)
+	cmd.AddCommand(sshproxy.Cmd)
+	cmd.AddCommand(chat.Cmd)
+	cmd.AddCommand(container.Cmd)
 
 	cmd.PersistentFlags().IntP("verbose", "V", 0, "logger verbosity level")
+	logging.AddFlags(cmd.PersistentFlags())
+	crash.AddFlags(cmd.PersistentFlags())
+	tracing.AddFlags(cmd.PersistentFlags())
 	cmd.Execute()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tracing.Shutdown(ctx)
 }
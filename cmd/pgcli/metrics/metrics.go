@@ -0,0 +1,100 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rkonfj/peerguard/cmd/pgcli/localapi"
+	"github.com/spf13/cobra"
+)
+
+var Cmd *cobra.Command
+
+func init() {
+	Cmd = &cobra.Command{
+		Use:   "metrics [peer]",
+		Short: "Show the queue depths and drop counters of the vpn daemon or a peer",
+		Long: "Show the queue depths, drop counters and traffic totals of the running vpn daemon, or of the peer " +
+			"(peer id or overlay ip) fetched over the overlay. The peer must opt in by running the daemon with --serve-metrics",
+		Example: "  pgcli metrics\n  pgcli metrics 100.99.0.2",
+		Args:    cobra.MaximumNArgs(1),
+		RunE:    run,
+	}
+	localapi.AddFlags(Cmd.Flags())
+	Cmd.Flags().Bool("json", false, "print the metrics as json")
+	Cmd.Flags().Duration("timeout", 5*time.Second, "timeout fetching the metrics")
+}
+
+func run(cmd *cobra.Command, args []string) error {
+	printJSON, err := cmd.Flags().GetBool("json")
+	if err != nil {
+		return err
+	}
+	timeout, err := cmd.Flags().GetDuration("timeout")
+	if err != nil {
+		return err
+	}
+	client, err := localapi.NewClientFromFlags(cmd.Flags())
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var metrics localapi.Metrics
+	if len(args) == 0 {
+		metrics, err = client.Metrics(ctx)
+	} else {
+		var ip string
+		if ip, err = resolve(ctx, client, args[0]); err != nil {
+			return err
+		}
+		metrics, err = localapi.PeerMetrics(ctx, ip)
+	}
+	if err != nil {
+		return err
+	}
+	if printJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(metrics)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "State:\t%s\n", metrics.State)
+	fmt.Fprintf(w, "Version:\t%s\n", metrics.Version)
+	fmt.Fprintf(w, "Peers:\t%d\n", metrics.Peers)
+	fmt.Fprintf(w, "Inbound queue:\t%d/%d\n", metrics.InboundQueue, metrics.QueueCap)
+	fmt.Fprintf(w, "Outbound queue:\t%d/%d\n", metrics.OutboundQueue, metrics.QueueCap)
+	fmt.Fprintf(w, "Rx:\t%d bytes, %d packets\n", metrics.RxBytes, metrics.RxPackets)
+	fmt.Fprintf(w, "Tx:\t%d bytes, %d packets\n", metrics.TxBytes, metrics.TxPackets)
+	fmt.Fprintf(w, "Panics:\t%d\n", metrics.Panics)
+	fmt.Fprintln(w, "Drops:\t")
+	for _, reason := range slices.Sorted(maps.Keys(metrics.Drops)) {
+		fmt.Fprintf(w, "  %s\t%d\n", reason, metrics.Drops[reason])
+	}
+	return w.Flush()
+}
+
+// resolve finds the overlay ip of the peer (peer id or overlay ip) known by the daemon
+func resolve(ctx context.Context, client *localapi.Client, peer string) (string, error) {
+	peers, err := client.Peers(ctx, false)
+	if err != nil {
+		return "", err
+	}
+	for _, p := range peers {
+		if p.ID != peer && p.IPv4 != peer && p.IPv6 != peer {
+			continue
+		}
+		if p.IPv4 != "" {
+			return p.IPv4, nil
+		}
+		return p.IPv6, nil
+	}
+	return "", fmt.Errorf("peer %s not found", peer)
+}
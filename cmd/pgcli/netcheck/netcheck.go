@@ -0,0 +1,129 @@
+package netcheck
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rkonfj/peerguard/disco"
+	"github.com/rkonfj/peerguard/disco/netcheck"
+	"github.com/spf13/cobra"
+)
+
+var Cmd *cobra.Command
+
+func init() {
+	Cmd = &cobra.Command{
+		Use:   "netcheck",
+		Short: "Diagnose the NAT traversal conditions of this host",
+		Long:  "Report the NAT type, IPv6 availability, STUN reachability, port mapping services and peermap latency, explains why the peers are always relayed",
+		Args:  cobra.NoArgs,
+		RunE:  run,
+	}
+	Cmd.Flags().StringP("server", "s", os.Getenv("PG_SERVER"), "peermap server url")
+	Cmd.Flags().StringSlice("stun", netcheck.DefaultSTUNServers, "stun servers, use the same ones as the peermap server")
+	Cmd.Flags().Duration("timeout", 3*time.Second, "timeout of each probe")
+	Cmd.Flags().Bool("json", false, "print the report as json")
+}
+
+func run(cmd *cobra.Command, args []string) error {
+	var cfg netcheck.Config
+	var err error
+	if cfg.Peermap, err = cmd.Flags().GetString("server"); err != nil {
+		return err
+	}
+	if cfg.STUNServers, err = cmd.Flags().GetStringSlice("stun"); err != nil {
+		return err
+	}
+	if cfg.Timeout, err = cmd.Flags().GetDuration("timeout"); err != nil {
+		return err
+	}
+	printJSON, err := cmd.Flags().GetBool("json")
+	if err != nil {
+		return err
+	}
+	report, err := netcheck.Run(context.Background(), cfg)
+	if err != nil {
+		return err
+	}
+	if printJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+	printReport(report)
+	return nil
+}
+
+func printReport(r *netcheck.Report) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+	natType := r.NATType.String()
+	if r.NATType == disco.Unknown {
+		natType = "unknown (less than 2 STUN servers responded)"
+	}
+	fmt.Fprintf(w, "NAT type:\t%s\n", natType)
+	fmt.Fprintf(w, "NAT mapping:\t%s\n", r.NAT.Mapping)
+	fmt.Fprintf(w, "NAT filtering:\t%s\n", r.NAT.Filtering)
+	fmt.Fprintf(w, "Public IPv4:\t%s\n", yesNo(r.IPv4))
+	fmt.Fprintf(w, "Public IPv6:\t%s (reachable: %s)\n", yesNo(r.IPv6), yesNo(r.IPv6Reachable))
+	if r.NAT64 != "" {
+		fmt.Fprintf(w, "NAT64:\t%s\n", r.NAT64)
+	}
+	fmt.Fprintf(w, "UPnP:\t%s\n", portMapping(r.UPnP))
+	fmt.Fprintf(w, "NAT-PMP:\t%s\n", portMapping(r.NATPMP))
+	if r.Peermap != nil {
+		if r.Peermap.Error != "" {
+			fmt.Fprintf(w, "Peermap:\t%s error: %s\n", r.Peermap.Server, r.Peermap.Error)
+		} else {
+			fmt.Fprintf(w, "Peermap:\t%s latency %s\n", r.Peermap.Server, r.Peermap.Latency.Round(time.Millisecond))
+		}
+	}
+	fmt.Fprintln(w, "STUN:\t")
+	for _, s := range append(r.STUN4, r.STUN6...) {
+		if s.Error != "" {
+			fmt.Fprintf(w, "  %s\terror: %s\n", s.Server, s.Error)
+			continue
+		}
+		fmt.Fprintf(w, "  %s\t%s rtt %s\n", s.Server, s.MappedAddr, s.RTT.Round(time.Millisecond))
+	}
+	if hint := hint(r); hint != "" {
+		fmt.Fprintf(w, "\n%s\n", hint)
+	}
+}
+
+// hint explains the most likely reason the peers are relayed
+func hint(r *netcheck.Report) string {
+	var hints []string
+	if r.NATType == disco.Hard && !r.UPnP.Available && !r.NATPMP.Available && !r.IPv6Reachable {
+		hints = append(hints, "The NAT is hard (endpoint dependent mapping) and no port mapping service or IPv6 is available, the peers behind a hard NAT as well are relayed by the peermap server")
+	}
+	if !r.IPv4 && r.IPv6 && r.NAT64 == "" {
+		hints = append(hints, "The network is ipv6-only without NAT64, only the peers having ipv6 are reachable directly")
+	}
+	if r.NATType == disco.Unknown {
+		hints = append(hints, "UDP to the STUN servers seems blocked, the peers are relayed by the peermap server")
+	}
+	return strings.Join(hints, "\n")
+}
+
+func portMapping(r netcheck.PortMappingResult) string {
+	if !r.Available {
+		return "no"
+	}
+	if r.ExternalIP == "" {
+		return "yes"
+	}
+	return fmt.Sprintf("yes (external ip %s)", r.ExternalIP)
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
@@ -0,0 +1,172 @@
+// Package overlay joins the p2p network as a temporary peer for the commands
+// reaching the peers without the vpn, e.g. ping and forward
+package overlay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rkonfj/peerguard/disco"
+	"github.com/rkonfj/peerguard/p2p"
+	"github.com/rkonfj/peerguard/secure"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// AddFlags adds the flags required to join the network
+func AddFlags(flags *pflag.FlagSet, udpPort int) {
+	flags.StringP("server", "s", os.Getenv("PG_SERVER"), "peermap server url")
+	flags.StringP("secret-file", "f", "", "p2p network secret file used if the os keyring is not available (default ~/.peerguard_network_secret.json)")
+	flags.String("state-key", "env:PG_STATE_KEY", "key the secret file is encrypted by (env:NAME, file:PATH or the key itself)")
+	flags.Bool("no-keyring", false, "the network secret is stored in the secret file rather than the os keyring")
+	flags.Int("udp-port", udpPort, "p2p udp listen port")
+	flags.Duration("find-timeout", 10*time.Second, "time to wait for the peer to be found in the network")
+}
+
+// Network is the joined p2p network
+type Network struct {
+	*p2p.PeerPacketConn
+	findTimeout time.Duration
+
+	peersMutex sync.Mutex
+	peers      map[disco.PeerID]url.Values
+	peerFound  chan struct{}
+}
+
+// Join joins the network with the network secret stored by `pgcli vpn`
+func Join(ctx context.Context, cmd *cobra.Command, opts ...p2p.Option) (*Network, error) {
+	server, err := cmd.Flags().GetString("server")
+	if err != nil {
+		return nil, err
+	}
+	if server == "" {
+		return nil, errors.New("flag \"server\" not set")
+	}
+	udpPort, err := cmd.Flags().GetInt("udp-port")
+	if err != nil {
+		return nil, err
+	}
+	findTimeout, err := cmd.Flags().GetDuration("find-timeout")
+	if err != nil {
+		return nil, err
+	}
+	store, err := secretStore(cmd, server)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := store.NetworkSecret(); err != nil {
+		return nil, fmt.Errorf("%w (run `pgcli vpn` to join the network first)", err)
+	}
+	peermap, err := disco.NewPeermapURL(server, store)
+	if err != nil {
+		return nil, err
+	}
+	return Listen(ctx, peermap, findTimeout, append([]p2p.Option{p2p.ListenUDPPort(udpPort)}, opts...)...)
+}
+
+// Listen joins the network of the peermap as a temporary peer with an ephemeral key, the peers
+// are waited for findTimeout by Resolve
+func Listen(ctx context.Context, peermap *disco.Peermap, findTimeout time.Duration, opts ...p2p.Option) (*Network, error) {
+	n := Network{
+		findTimeout: findTimeout,
+		peers:       make(map[disco.PeerID]url.Values),
+		peerFound:   make(chan struct{}, 1),
+	}
+	opts = append([]p2p.Option{
+		p2p.ListenPeerSecure(),
+		p2p.ListenPeerUp(n.onPeer),
+	}, opts...)
+	var err error
+	if n.PeerPacketConn, err = p2p.ListenPacketContext(ctx, peermap, opts...); err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+func (n *Network) onPeer(peerID disco.PeerID, m url.Values) {
+	n.peersMutex.Lock()
+	n.peers[peerID] = m
+	n.peersMutex.Unlock()
+	select {
+	case n.peerFound <- struct{}{}:
+	default:
+	}
+}
+
+// Resolve waits the peer to be found in the network, the peer is the peer id, overlay ip or name
+func (n *Network) Resolve(ctx context.Context, peer string) (disco.PeerID, error) {
+	ctx, cancel := context.WithTimeout(ctx, n.findTimeout)
+	defer cancel()
+	for {
+		if peerID, ok := n.Lookup(peer); ok {
+			return peerID, nil
+		}
+		select {
+		case <-n.peerFound:
+		case <-ctx.Done():
+			return "", fmt.Errorf("peer %s not found in the network: %w", peer, ctx.Err())
+		}
+	}
+}
+
+// Lookup finds the peer found in the network, the peer is the peer id, overlay ip or name
+func (n *Network) Lookup(peer string) (disco.PeerID, bool) {
+	n.peersMutex.Lock()
+	defer n.peersMutex.Unlock()
+	for peerID, m := range n.peers {
+		if peerID.String() == peer || m.Get("alias1") == peer || m.Get("alias2") == peer || m.Get("name") == peer {
+			return peerID, true
+		}
+	}
+	return "", false
+}
+
+// Discard keeps reading the packets, so that the echo and stream datagrams are dispatched
+func (n *Network) Discard() {
+	buf := make([]byte, 65535)
+	for {
+		if _, _, err := n.ReadFrom(buf); err != nil {
+			return
+		}
+	}
+}
+
+func secretStore(cmd *cobra.Command, server string) (disco.SecretStore, error) {
+	secretFile, err := cmd.Flags().GetString("secret-file")
+	if err != nil {
+		return nil, err
+	}
+	noKeyring, err := cmd.Flags().GetBool("no-keyring")
+	if err != nil {
+		return nil, err
+	}
+	if secretFile == "" {
+		currentUser, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+		secretFile = filepath.Join(currentUser.HomeDir, ".peerguard_network_secret.json")
+	}
+	stateKey, err := cmd.Flags().GetString("state-key")
+	if err != nil {
+		return nil, err
+	}
+	if stateKey == "env:PG_STATE_KEY" && os.Getenv("PG_STATE_KEY") == "" {
+		stateKey = ""
+	}
+	sealingKey, err := secure.ResolveSealingKey(stateKey, "pgcli")
+	if err != nil {
+		return nil, err
+	}
+	if noKeyring {
+		return p2p.EncryptedFileSecretStore(secretFile, sealingKey), nil
+	}
+	return p2p.KeyringSecretStore(server, secretFile, sealingKey), nil
+}
@@ -0,0 +1,177 @@
+package path
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rkonfj/peerguard/cmd/pgcli/localapi"
+	"github.com/rkonfj/peerguard/disco"
+	"github.com/spf13/cobra"
+)
+
+var Cmd *cobra.Command
+
+func init() {
+	Cmd = &cobra.Command{
+		Use:   "path <peer>",
+		Short: "Explain how the vpn daemon reaches the peer, directly or relayed, and why",
+		Long: "Explain how the running vpn daemon reaches the peer (by the name, peer id or overlay ip): the hole punching " +
+			"candidates exchanged with the peer and which one won, the NAT types of both sides, and whether the traffic " +
+			"flows directly or is relayed by the peermap server",
+		Args: cobra.ExactArgs(1),
+		RunE: run,
+	}
+	localapi.AddFlags(Cmd.Flags())
+	Cmd.Flags().Bool("json", false, "print the path as json")
+}
+
+func run(cmd *cobra.Command, args []string) error {
+	printJSON, err := cmd.Flags().GetBool("json")
+	if err != nil {
+		return err
+	}
+	client, err := localapi.NewClientFromFlags(cmd.Flags())
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	peers, err := client.Peers(ctx, false)
+	if err != nil {
+		return err
+	}
+	i := slices.IndexFunc(peers, func(p localapi.Peer) bool { return p.Match(args[0]) })
+	if i < 0 {
+		return fmt.Errorf("peer %s not found", args[0])
+	}
+	path, err := client.Path(ctx, peers[i].ID)
+	if err != nil {
+		return err
+	}
+	if printJSON {
+		return json.NewEncoder(os.Stdout).Encode(path)
+	}
+	return printPath(os.Stdout, path)
+}
+
+func printPath(w io.Writer, path localapi.PeerPath) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	peer := path.Peer
+	fmt.Fprintf(tw, "Peer:\t%s", peer.ID)
+	if peer.Name != "" {
+		fmt.Fprintf(tw, " (%s)", peer.Name)
+	}
+	fmt.Fprintln(tw)
+	switch {
+	case peer.Path == localapi.PathDirect && path.Addr != "":
+		fmt.Fprintf(tw, "Path:\tdirect to %s\n", path.Addr)
+	case peer.Path == localapi.PathDirect:
+		fmt.Fprintln(tw, "Path:\tdirect")
+	case peer.Path == localapi.PathRelay:
+		fmt.Fprintln(tw, "Path:\trelayed by the peermap server")
+	default:
+		fmt.Fprintln(tw, "Path:\tunknown, the peer did not reply")
+	}
+	if peer.RTT > 0 {
+		fmt.Fprintf(tw, "RTT:\t%s\n", peer.RTT.Round(10*time.Microsecond))
+	}
+	fmt.Fprintf(tw, "NAT:\tlocal %s, peer %s\n", path.LocalNAT, path.PeerNAT)
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w, "\nCandidates of the peer:")
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "  ADDR\tTYPE\tRECEIVED\tRESULT")
+	for _, c := range path.Candidates {
+		fmt.Fprintf(tw, "  %s\t%s\t%s ago\t%s\n", c.Addr, c.Type, since(c.Time), result(path, c))
+	}
+	for _, addr := range path.Addrs {
+		if !slices.ContainsFunc(path.Candidates, func(c localapi.Candidate) bool { return c.Addr == addr }) {
+			fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\n", addr, "-", "-", result(path, localapi.Candidate{Addr: addr}))
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w, "\nLocal candidates sent to the peer:")
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "  ADDR\tTYPE\tSENT")
+	for _, c := range path.LocalCandidates {
+		fmt.Fprintf(tw, "  %s\t%s\t%s ago\n", c.Addr, c.Type, since(c.Time))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w)
+	for _, line := range explain(path) {
+		fmt.Fprintln(w, line)
+	}
+	return nil
+}
+
+func result(path localapi.PeerPath, c localapi.Candidate) string {
+	var r string
+	switch {
+	case c.Addr == path.Addr:
+		r = "selected"
+	case slices.Contains(path.Addrs, c.Addr):
+		r = "reachable"
+	default:
+		r = "unreachable"
+	}
+	if c.Type == "" {
+		r += ", found by the port scanning or the pings of the peer"
+	}
+	if c.PortScanned {
+		r += ", ports around scanned"
+	}
+	return r
+}
+
+// explain tells why the path is direct or relayed
+func explain(path localapi.PeerPath) (lines []string) {
+	localNAT, peerNAT := disco.NATType(path.LocalNAT), disco.NATType(path.PeerNAT)
+	if path.Addr != "" {
+		i := slices.IndexFunc(path.Candidates, func(c localapi.Candidate) bool { return c.Addr == path.Addr })
+		if i < 0 {
+			return append(lines, fmt.Sprintf("The hole is punched at %s, the addr found by the port scanning or the pings of the peer.", path.Addr))
+		}
+		lines = append(lines, fmt.Sprintf("The hole is punched at the %s candidate %s.", path.Candidates[i].Type, path.Addr))
+		if path.Peer.Path == localapi.PathRelay {
+			lines = append(lines, "The datagrams were relayed before the hole is punched, the next ones go directly.")
+		}
+		return
+	}
+	if len(path.Candidates) == 0 {
+		return append(lines, "No candidate is received from the peer, the peer may not be able to listen udp "+
+			"or the candidates are not exchanged yet (it takes a few seconds after the peer joins).")
+	}
+	lines = append(lines, fmt.Sprintf("None of the %d candidates of the peer replied the disco pings, "+
+		"the datagrams are relayed by the peermap server.", len(path.Candidates)))
+	switch {
+	case localNAT == disco.Hard && peerNAT == disco.Hard:
+		lines = append(lines, "Both sides are behind hard NATs (the mapped port changes per destination), the hole punching "+
+			"rarely succeeds. Enable UPnP or a port forwarding of udp 29877 on either side, or reach each other over ipv6.")
+	case localNAT == disco.Hard || peerNAT == disco.Hard:
+		lines = append(lines, "One side is behind a hard NAT (the mapped port changes per destination), the ports around "+
+			"its candidates are scanned but the guess may miss. Enable UPnP or a port forwarding of udp 29877 on that side.")
+	case path.LocalNAT == disco.Unknown.String() || path.PeerNAT == disco.Unknown.String():
+		lines = append(lines, "The NAT type is unknown, less than 2 STUN servers responded. Run `pgcli netcheck` on both sides.")
+	default:
+		lines = append(lines, "The NATs are easy to punch through, a firewall may drop the udp (port 29877) on either side.")
+	}
+	return
+}
+
+func since(t time.Time) time.Duration {
+	return time.Since(t).Round(time.Second)
+}
@@ -0,0 +1,149 @@
+package ping
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/rkonfj/peerguard/cmd/pgcli/overlay"
+	"github.com/rkonfj/peerguard/p2p"
+	"github.com/spf13/cobra"
+)
+
+var Cmd *cobra.Command
+
+func init() {
+	Cmd = &cobra.Command{
+		Use:   "ping <peer>",
+		Short: "Ping a peer over the p2p network",
+		Long: "Ping a peer by the peer id, overlay ip or alias over the p2p network and report the rtt and whether the path is direct or relayed. " +
+			"It joins the network as a temporary peer with the stored network secret, so the vpn is not required to be running on this host",
+		Args: cobra.ExactArgs(1),
+		RunE: run,
+	}
+	overlay.AddFlags(Cmd.Flags(), 29880)
+	Cmd.Flags().IntP("count", "c", 0, "stop after sending count pings (0 means ping until interrupted)")
+	Cmd.Flags().DurationP("interval", "i", time.Second, "wait interval between sending each ping")
+	Cmd.Flags().DurationP("timeout", "W", 3*time.Second, "time to wait for a reply")
+}
+
+func run(cmd *cobra.Command, args []string) error {
+	count, err := cmd.Flags().GetInt("count")
+	if err != nil {
+		return err
+	}
+	interval, err := cmd.Flags().GetDuration("interval")
+	if err != nil {
+		return err
+	}
+	timeout, err := cmd.Flags().GetDuration("timeout")
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	conn, err := overlay.Join(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	go conn.Discard() // the echo replies are dispatched by ReadFrom
+
+	peerID, err := conn.Resolve(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("PING %s (%s)\n", args[0], peerID)
+	var stats statistics
+	for i := 0; count == 0 || i < count; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(interval):
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		pingCtx, pingCancel := context.WithTimeout(ctx, timeout)
+		pong, err := conn.Ping(pingCtx, peerID)
+		pingCancel()
+		stats.add(pong, err)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			fmt.Printf("seq=%d %s\n", i+1, errString(err))
+			continue
+		}
+		fmt.Printf("seq=%d rtt=%s path=%s\n", pong.Seq, pong.RTT.Round(10*time.Microsecond), path(pong))
+	}
+	stats.print(args[0])
+	if stats.received == 0 {
+		return errors.New("no reply received")
+	}
+	return nil
+}
+
+type statistics struct {
+	sent, received int
+	min, max, sum  time.Duration
+	direct         int
+}
+
+func (s *statistics) add(pong p2p.Pong, err error) {
+	s.sent++
+	if err != nil {
+		return
+	}
+	s.received++
+	if s.min == 0 || pong.RTT < s.min {
+		s.min = pong.RTT
+	}
+	s.max = max(s.max, pong.RTT)
+	s.sum += pong.RTT
+	if !pong.Relayed && !pong.ReplyRelayed {
+		s.direct++
+	}
+}
+
+func (s *statistics) print(target string) {
+	fmt.Printf("--- %s ping statistics ---\n", target)
+	var loss float64
+	if s.sent > 0 {
+		loss = float64(s.sent-s.received) / float64(s.sent) * 100
+	}
+	fmt.Printf("%d sent, %d received, %.1f%% loss, %d direct\n", s.sent, s.received, loss, s.direct)
+	if s.received > 0 {
+		avg := s.sum / time.Duration(s.received)
+		fmt.Printf("rtt min/avg/max = %s/%s/%s\n", s.min.Round(10*time.Microsecond),
+			avg.Round(10*time.Microsecond), s.max.Round(10*time.Microsecond))
+	}
+}
+
+func path(pong p2p.Pong) string {
+	switch {
+	case !pong.Relayed && !pong.ReplyRelayed:
+		return "direct"
+	case pong.Relayed && pong.ReplyRelayed:
+		return "relayed"
+	case pong.Relayed:
+		return "relayed/direct"
+	default:
+		return "direct/relayed"
+	}
+}
+
+func errString(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "timeout"
+	}
+	return err.Error()
+}
@@ -0,0 +1,118 @@
+package pins
+
+import (
+	"errors"
+	"fmt"
+	"os/user"
+	"path/filepath"
+	"slices"
+
+	"github.com/rkonfj/peerguard/disco"
+	"github.com/rkonfj/peerguard/p2p"
+	"github.com/spf13/cobra"
+)
+
+var Cmd *cobra.Command
+
+func init() {
+	Cmd = NewCmd()
+}
+
+// NewCmd creates the pins command, it is mounted as pgcli pins and pgcli key pins
+func NewCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "pins",
+		Short: "Manage the peers pinned on first use by the vpn",
+	}
+	cmd.PersistentFlags().String("pin-file", "", "pin file (default ~/.peerguard_known_peers.json)")
+	cmd.AddCommand(listCmd())
+	cmd.AddCommand(addCmd())
+	cmd.AddCommand(clearCmd())
+	return cmd
+}
+
+func listCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "List pinned peers",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := pinStore(cmd)
+			if err != nil {
+				return err
+			}
+			pins, err := store.Pins()
+			if err != nil {
+				return err
+			}
+			identities := make([]string, 0, len(pins))
+			for identity := range pins {
+				identities = append(identities, identity)
+			}
+			slices.Sort(identities)
+			for _, identity := range identities {
+				fmt.Printf("%s\t%s\n", identity, pins[identity])
+			}
+			return nil
+		},
+	}
+}
+
+func addCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "add <ip> <peer>",
+		Short: "Pin the ip to the peer before it is first seen, e.g. the peer id printed by `pgcli key show` on the peer",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			force, err := cmd.Flags().GetBool("force")
+			if err != nil {
+				return err
+			}
+			store, err := pinStore(cmd)
+			if err != nil {
+				return err
+			}
+			if force {
+				if err := store.Unpin(args[0]); err != nil {
+					return err
+				}
+			}
+			err = store.Pin(args[0], disco.PeerID(args[1]))
+			if errors.Is(err, p2p.ErrPinMismatch{}) {
+				return fmt.Errorf("%w, use --force to replace it", err)
+			}
+			return err
+		},
+	}
+	cmd.Flags().Bool("force", false, "replace the pin if the ip is pinned to another peer")
+	return cmd
+}
+
+func clearCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "clear [ip] ...",
+		Short: "Clear pinned peers (all if no ip is specified)",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := pinStore(cmd)
+			if err != nil {
+				return err
+			}
+			return store.Unpin(args...)
+		},
+	}
+}
+
+func pinStore(cmd *cobra.Command) (p2p.PinStore, error) {
+	pinFile, err := cmd.Flags().GetString("pin-file")
+	if err != nil {
+		return nil, err
+	}
+	if len(pinFile) == 0 {
+		currentUser, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+		pinFile = filepath.Join(currentUser.HomeDir, ".peerguard_known_peers.json")
+	}
+	return &p2p.FilePinStore{StoreFilePath: pinFile}, nil
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/rkonfj/peerguard/cmd/pgcli/overlay"
+	"github.com/rkonfj/peerguard/forward"
+	"github.com/spf13/cobra"
+)
+
+var Cmd *cobra.Command
+
+func init() {
+	Cmd = &cobra.Command{
+		Use:   "proxy",
+		Short: "Run a local proxy reaching the peers over the p2p network without the vpn",
+	}
+	socks5Cmd := &cobra.Command{
+		Use:     "socks5 <listen addr>",
+		Short:   "Run a SOCKS5 proxy dials the peers by the overlay ip, alias or peer id",
+		Long:    "Run a SOCKS5 proxy dials the peers by the overlay ip, alias or peer id, the connections are forwarded to the peers running `pgcli vpn`. No root privilege or tun device is required",
+		Example: "  pgcli proxy socks5 127.0.0.1:1080\n  curl -x socks5h://127.0.0.1:1080 http://100.99.0.2",
+		Args:    cobra.ExactArgs(1),
+		RunE:    runSOCKS5,
+	}
+	overlay.AddFlags(socks5Cmd.Flags(), 29884)
+	Cmd.AddCommand(socks5Cmd)
+}
+
+func runSOCKS5(cmd *cobra.Command, args []string) error {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	network, err := overlay.Join(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	defer network.Close()
+	go network.Discard() // the stream datagrams are dispatched by ReadFrom
+
+	listener, err := net.Listen("tcp", args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Println("SOCKS5 proxy listening on", listener.Addr())
+	return ServeSOCKS5(ctx, network, listener)
+}
+
+// ServeSOCKS5 serves the SOCKS5 proxy dials the peers of the network by the overlay ip, alias or
+// peer id until ctx is done, the network must be read (e.g. by Discard) to dispatch the streams
+func ServeSOCKS5(ctx context.Context, network *overlay.Network, listener net.Listener) error {
+	client, err := forward.NewClient(network.StreamConn())
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	socks5 := forward.SOCKS5{Dial: func(ctx context.Context, host string, port uint16) (net.Conn, error) {
+		peerID, ok := network.Lookup(host)
+		if !ok {
+			return nil, forward.ErrHostUnreachable
+		}
+		return client.Dial(ctx, peerID, port)
+	}}
+	return socks5.Serve(ctx, listener)
+}
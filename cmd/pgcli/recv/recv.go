@@ -0,0 +1,94 @@
+package recv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/rkonfj/peerguard/fileshare"
+	"github.com/schollz/progressbar/v3"
+	"github.com/spf13/cobra"
+)
+
+var Cmd *cobra.Command
+
+func init() {
+	Cmd = &cobra.Command{
+		Use:   "recv",
+		Short: "Receive files sent by `pgcli send`",
+		Args:  cobra.NoArgs,
+		RunE:  execute,
+	}
+	Cmd.Flags().StringP("server", "s", "", "peermap server")
+	Cmd.Flags().StringP("pubnet", "n", "public", "peermap public network")
+	Cmd.Flags().String("key", "", "curve25519 private key in base58 format, keeps the peer id so that senders can resume (default generate a new one)")
+	Cmd.Flags().StringP("dir", "d", ".", "directory the received files are saved to")
+	Cmd.Flags().Int("udp-port", 29882, "p2p udp listen port")
+	Cmd.Flags().IntP("verbose", "V", int(slog.LevelError), "log level")
+}
+
+func execute(cmd *cobra.Command, args []string) error {
+	var err error
+	receiver := fileshare.Receiver{ProgressBar: createBar, OnReceived: onReceived}
+	if receiver.Server, err = cmd.Flags().GetString("server"); err != nil {
+		return err
+	}
+	if len(receiver.Server) == 0 {
+		receiver.Server = os.Getenv("PG_SERVER")
+		if len(receiver.Server) == 0 {
+			return errors.New("unknown peermap server")
+		}
+	}
+	if receiver.Network, err = cmd.Flags().GetString("pubnet"); err != nil {
+		return err
+	}
+	if receiver.PrivateKey, err = cmd.Flags().GetString("key"); err != nil {
+		return err
+	}
+	if receiver.Dir, err = cmd.Flags().GetString("dir"); err != nil {
+		return err
+	}
+	if receiver.ListenUDPPort, err = cmd.Flags().GetInt("udp-port"); err != nil {
+		return err
+	}
+	if stat, err := os.Stat(receiver.Dir); err != nil || !stat.IsDir() {
+		return fmt.Errorf("invalid directory %s", receiver.Dir)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	listener, err := receiver.Listen()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Waiting for files, run `pgcli send <file> %s` on the sender\n", listener.Addr())
+	return receiver.Serve(ctx, listener)
+}
+
+func onReceived(peerID string, path string, checksum []byte) {
+	fmt.Printf("received %s from %s, sha256: %x\n", path, peerID, checksum)
+}
+
+func createBar(total int64, desc string) fileshare.ProgressBar {
+	return progressbar.NewOptions64(
+		total,
+		progressbar.OptionSetDescription(desc),
+		progressbar.OptionSetWriter(os.Stderr),
+		progressbar.OptionShowBytes(true),
+		progressbar.OptionThrottle(500*time.Millisecond),
+		progressbar.OptionShowCount(),
+		progressbar.OptionShowElapsedTimeOnFinish(),
+		progressbar.OptionOnCompletion(func() {
+			fmt.Fprint(os.Stderr, "\n")
+		}),
+		progressbar.OptionSpinnerType(14),
+		progressbar.OptionFullWidth(),
+		progressbar.OptionSetRenderBlankState(true),
+	)
+}
@@ -0,0 +1,75 @@
+package resolve
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/rkonfj/peerguard/cmd/pgcli/localapi"
+	"github.com/spf13/cobra"
+)
+
+var Cmd *cobra.Command
+
+func init() {
+	Cmd = &cobra.Command{
+		Use:   "resolve <name>",
+		Short: "Resolve the peer by the name, peer id or overlay ip from the peer table of the vpn daemon",
+		Long: "Resolve the peer by the name (the hostname advertised by the peer, case insensitive), the peer id or the overlay ip " +
+			"from the peer table of the running vpn daemon",
+		Example: "  pgcli resolve laptop\n  ssh root@$(pgcli resolve --ip laptop)",
+		Args:    cobra.ExactArgs(1),
+		RunE:    run,
+	}
+	localapi.AddFlags(Cmd.Flags())
+	Cmd.Flags().Bool("ip", false, "print the overlay ip only (ipv4 if present)")
+	Cmd.Flags().Bool("json", false, "print the peers as json")
+}
+
+func run(cmd *cobra.Command, args []string) error {
+	ipOnly, err := cmd.Flags().GetBool("ip")
+	if err != nil {
+		return err
+	}
+	printJSON, err := cmd.Flags().GetBool("json")
+	if err != nil {
+		return err
+	}
+	client, err := localapi.NewClientFromFlags(cmd.Flags())
+	if err != nil {
+		return err
+	}
+	peers, err := client.Peers(context.Background(), false)
+	if err != nil {
+		return err
+	}
+	var found []localapi.Peer
+	for _, peer := range peers {
+		if peer.Match(args[0]) {
+			found = append(found, peer)
+		}
+	}
+	if len(found) == 0 {
+		return fmt.Errorf("peer %s not found", args[0])
+	}
+	switch {
+	case printJSON:
+		return json.NewEncoder(os.Stdout).Encode(found)
+	case ipOnly:
+		for _, peer := range found {
+			ip := peer.IPv4
+			if ip == "" {
+				ip = peer.IPv6
+			}
+			fmt.Println(ip)
+		}
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, peer := range found {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", peer.Name, peer.ID, peer.IPv4, peer.IPv6)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,69 @@
+package route
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/rkonfj/peerguard/cmd/pgcli/localapi"
+	"github.com/spf13/cobra"
+)
+
+var Cmd *cobra.Command
+
+func init() {
+	Cmd = &cobra.Command{
+		Use:          "route",
+		Short:        "Manage the routes of the running vpn daemon via the peers",
+		SilenceUsage: true,
+	}
+	localapi.AddFlags(Cmd.PersistentFlags())
+	Cmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List the routes via the peers",
+		Args:  cobra.NoArgs,
+		RunE:  list,
+	})
+	Cmd.AddCommand(&cobra.Command{
+		Use:   "add <cidr> <via>",
+		Short: "Route the cidr to the peer owns the overlay ip via, e.g. the lan behind the peer",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, err := localapi.NewClientFromFlags(cmd.Flags())
+			if err != nil {
+				return err
+			}
+			return client.AddRoute(context.Background(), localapi.Route{Dst: args[0], Via: args[1]})
+		},
+	})
+	Cmd.AddCommand(&cobra.Command{
+		Use:   "del <cidr> <via>",
+		Short: "Delete the route to the cidr via the peer",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, err := localapi.NewClientFromFlags(cmd.Flags())
+			if err != nil {
+				return err
+			}
+			return client.DelRoute(context.Background(), localapi.Route{Dst: args[0], Via: args[1]})
+		},
+	})
+}
+
+func list(cmd *cobra.Command, args []string) error {
+	client, err := localapi.NewClientFromFlags(cmd.Flags())
+	if err != nil {
+		return err
+	}
+	routes, err := client.Routes(context.Background())
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DST\tVIA")
+	for _, route := range routes {
+		fmt.Fprintf(w, "%s\t%s\n", route.Dst, route.Via)
+	}
+	return w.Flush()
+}
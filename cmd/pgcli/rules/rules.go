@@ -0,0 +1,82 @@
+package rules
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rkonfj/peerguard/cmd/pgcli/localapi"
+	"github.com/spf13/cobra"
+)
+
+var Cmd *cobra.Command
+
+func init() {
+	Cmd = &cobra.Command{
+		Use:   "rules",
+		Short: "Print the addresses, routes and firewall rules managed by the vpn daemon and verify they are intact",
+		Long: "Print the addresses of the tun and the routes added by the running vpn daemon, and verify they are still " +
+			"in the system (read by netlink, the routing socket or the ip helper api). The exit routes (the table and " +
+			"the ip rules of --exit-node) are checked as well, and so are the iptables MASQUERADE and FORWARD ACCEPT " +
+			"rules of --advertise-exit-node and --advertise-routes (by iptables -C). The daemon installs no kill switch " +
+			"or packet filter rules. Fails if any is missing",
+		Args: cobra.NoArgs,
+		RunE: run,
+	}
+	localapi.AddFlags(Cmd.Flags())
+	Cmd.Flags().Bool("json", false, "print the rules as json")
+}
+
+func run(cmd *cobra.Command, args []string) error {
+	printJSON, err := cmd.Flags().GetBool("json")
+	if err != nil {
+		return err
+	}
+	client, err := localapi.NewClientFromFlags(cmd.Flags())
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rules, err := client.Rules(ctx)
+	if err != nil {
+		return err
+	}
+	if printJSON {
+		if err := json.NewEncoder(os.Stdout).Encode(rules); err != nil {
+			return err
+		}
+	} else if err := printRules(rules); err != nil {
+		return err
+	}
+	var missing int
+	for _, rule := range slices.Concat(rules.Addresses, rules.Routes, rules.Firewall) {
+		if rule.State == localapi.RuleMissing {
+			missing++
+		}
+	}
+	if missing > 0 {
+		return fmt.Errorf("%d rules are missing, removed by an external tool? run `pgcli route add <cidr> <via>` to restore a route, restart the daemon to restore the others", missing)
+	}
+	return nil
+}
+
+func printRules(rules localapi.Rules) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STATE\tRULE")
+	for _, rule := range slices.Concat(rules.Addresses, rules.Routes, rules.Firewall) {
+		state := rule.State
+		if rule.Error != "" {
+			state += " (" + rule.Error + ")"
+		}
+		fmt.Fprintf(w, "%s\t%s\n", state, rule.Rule)
+	}
+	if len(rules.Firewall) == 0 {
+		fmt.Fprintln(w, "-\tfirewall: none installed by peerguard (neither exit node nor subnet router)")
+	}
+	return w.Flush()
+}
@@ -0,0 +1,79 @@
+package send
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/rkonfj/peerguard/disco"
+	"github.com/rkonfj/peerguard/fileshare"
+	"github.com/schollz/progressbar/v3"
+	"github.com/spf13/cobra"
+)
+
+var Cmd *cobra.Command
+
+func init() {
+	Cmd = &cobra.Command{
+		Use:   "send <file> <peer>",
+		Short: "Send file to the peer running `pgcli recv`",
+		Long:  "Send file to the peer running `pgcli recv`, an interrupted transfer resumes from the part the peer has received",
+		Args:  cobra.ExactArgs(2),
+		RunE:  execute,
+	}
+	Cmd.Flags().StringP("server", "s", "", "peermap server")
+	Cmd.Flags().StringP("pubnet", "n", "public", "peermap public network")
+	Cmd.Flags().Int("udp-port", 29881, "p2p udp listen port")
+	Cmd.Flags().IntP("verbose", "V", int(slog.LevelError), "log level")
+}
+
+func execute(cmd *cobra.Command, args []string) error {
+	var err error
+	sender := fileshare.Sender{ProgressBar: createBar}
+	if sender.Server, err = cmd.Flags().GetString("server"); err != nil {
+		return err
+	}
+	if len(sender.Server) == 0 {
+		sender.Server = os.Getenv("PG_SERVER")
+		if len(sender.Server) == 0 {
+			return errors.New("unknown peermap server")
+		}
+	}
+	if sender.Network, err = cmd.Flags().GetString("pubnet"); err != nil {
+		return err
+	}
+	if sender.ListenUDPPort, err = cmd.Flags().GetInt("udp-port"); err != nil {
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	if err := sender.Send(ctx, args[0], disco.PeerID(args[1])); err != nil {
+		return err
+	}
+	fmt.Println("sent", args[0])
+	return nil
+}
+
+func createBar(total int64, desc string) fileshare.ProgressBar {
+	return progressbar.NewOptions64(
+		total,
+		progressbar.OptionSetDescription(desc),
+		progressbar.OptionSetWriter(os.Stderr),
+		progressbar.OptionShowBytes(true),
+		progressbar.OptionThrottle(500*time.Millisecond),
+		progressbar.OptionShowCount(),
+		progressbar.OptionShowElapsedTimeOnFinish(),
+		progressbar.OptionOnCompletion(func() {
+			fmt.Fprint(os.Stderr, "\n")
+		}),
+		progressbar.OptionSpinnerType(14),
+		progressbar.OptionFullWidth(),
+		progressbar.OptionSetRenderBlankState(true),
+	)
+}
@@ -0,0 +1,228 @@
+package serve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/rkonfj/peerguard/cmd/pgcli/localapi"
+	"github.com/rkonfj/peerguard/forward"
+	"github.com/spf13/cobra"
+)
+
+var Cmd *cobra.Command
+
+func init() {
+	Cmd = &cobra.Command{
+		Use:   "serve",
+		Short: "Serve a local directory or tcp service to the selected peers over the p2p network",
+		Long: "Serve a local directory or tcp service on the overlay ips of the running vpn daemon (pgcli daemon), " +
+			"only the connections from the allowed peers are accepted",
+	}
+	httpCmd := &cobra.Command{
+		Use:     "http <dir>",
+		Short:   "Serve the files of the local directory over http",
+		Example: "  pgcli serve http ./public --allow 100.99.0.2\n  curl http://100.99.0.1/  # on 100.99.0.2",
+		Args:    cobra.ExactArgs(1),
+		RunE:    runHTTP,
+	}
+	addFlags(httpCmd, 80)
+	tcpCmd := &cobra.Command{
+		Use:     "tcp <addr>",
+		Short:   "Tunnel the connections from the peers to the local tcp service",
+		Example: "  pgcli serve tcp 127.0.0.1:3000 --allow 100.99.0.2,100.99.0.3",
+		Args:    cobra.ExactArgs(1),
+		RunE:    runTCP,
+	}
+	addFlags(tcpCmd, 0)
+	Cmd.AddCommand(httpCmd, tcpCmd)
+}
+
+func addFlags(cmd *cobra.Command, port uint16) {
+	localapi.AddFlags(cmd.Flags())
+	cmd.Flags().StringSlice("allow", nil, "peers (peer id or overlay ip) allowed to connect, * allows all peers")
+	usage := "port listening on the overlay ips"
+	if port == 0 {
+		usage += " (default the port of the addr)"
+	}
+	cmd.Flags().Uint16("port", port, usage)
+	cmd.MarkFlagRequired("allow")
+}
+
+func runHTTP(cmd *cobra.Command, args []string) error {
+	dir := args[0]
+	if info, err := os.Stat(dir); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	port, err := cmd.Flags().GetUint16("port")
+	if err != nil {
+		return err
+	}
+	return serve(cmd, port, "directory "+dir, func(ctx context.Context, l net.Listener) error {
+		server := http.Server{Handler: http.FileServer(http.Dir(dir)), ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			<-ctx.Done()
+			server.Close()
+		}()
+		if err := server.Serve(l); !errors.Is(err, http.ErrServerClosed) && ctx.Err() == nil {
+			return err
+		}
+		return nil
+	})
+}
+
+func runTCP(cmd *cobra.Command, args []string) error {
+	addr := args[0]
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid addr %s: %w", addr, err)
+	}
+	port, err := cmd.Flags().GetUint16("port")
+	if err != nil {
+		return err
+	}
+	if port == 0 {
+		p, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil || p == 0 {
+			return fmt.Errorf("invalid port %s", portStr)
+		}
+		port = uint16(p)
+	}
+	return serve(cmd, port, "tcp "+addr, func(ctx context.Context, l net.Listener) error {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return err
+			}
+			go func() {
+				defer conn.Close()
+				var d net.Dialer
+				dialCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+				target, err := d.DialContext(dialCtx, "tcp", addr)
+				cancel()
+				if err != nil {
+					slog.Error("Serve", "from", conn.RemoteAddr(), "err", err)
+					return
+				}
+				forward.Pipe(conn, target)
+			}()
+		}
+	})
+}
+
+// serve listens on the overlay ips of the daemon and handles the connections from the allowed peers
+func serve(cmd *cobra.Command, port uint16, what string, handle func(ctx context.Context, l net.Listener) error) error {
+	allow, err := cmd.Flags().GetStringSlice("allow")
+	if err != nil {
+		return err
+	}
+	client, err := localapi.NewClientFromFlags(cmd.Flags())
+	if err != nil {
+		return err
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	status, err := client.Status(ctx)
+	if err != nil {
+		return err
+	}
+	var addrs []netip.Addr
+	for _, prefix := range []string{status.IPv4, status.IPv6} {
+		if p, err := netip.ParsePrefix(prefix); err == nil {
+			addrs = append(addrs, p.Addr())
+		}
+	}
+	if len(addrs) == 0 {
+		return errors.New("the daemon has no overlay ip")
+	}
+
+	var listeners []net.Listener
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+	for _, addr := range addrs {
+		l, err := net.Listen("tcp", netip.AddrPortFrom(addr, port).String())
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, &allowListener{Listener: l, client: client, allow: allow})
+	}
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		fmt.Printf("Serving %s on %s\n", what, l.Addr())
+		go func() { errs <- handle(ctx, l) }()
+	}
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+// allowListener accepts the connections from the allowed peers only, the peers are resolved by the daemon
+// on every connection, so that the peers joined later are allowed
+type allowListener struct {
+	net.Listener
+	client *localapi.Client
+	allow  []string
+}
+
+func (l *allowListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.allowed(conn.RemoteAddr()) {
+			return conn, nil
+		}
+		slog.Info("ServeDenied", "from", conn.RemoteAddr())
+		conn.Close()
+	}
+}
+
+func (l *allowListener) allowed(addr net.Addr) bool {
+	if slices.Contains(l.allow, "*") {
+		return true
+	}
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := addrPort.Addr().Unmap()
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	peers, err := l.client.Peers(ctx, false)
+	if err != nil {
+		slog.Error("ServeResolvePeers", "err", err)
+		return false
+	}
+	for _, peer := range peers {
+		if !slices.ContainsFunc(l.allow, func(a string) bool { return a == peer.ID || a == peer.IPv4 || a == peer.IPv6 }) {
+			continue
+		}
+		if peer.IPv4 == ip.String() || peer.IPv6 == ip.String() {
+			return true
+		}
+	}
+	return false
+}
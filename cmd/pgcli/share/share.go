@@ -31,12 +31,7 @@ func init() {
 }
 
 func execute(cmd *cobra.Command, args []string) error {
-	verbose, err := cmd.Flags().GetInt("verbose")
-	if err != nil {
-		return err
-	}
-	slog.SetLogLoggerLevel(slog.Level(verbose))
-
+	var err error
 	fileManager := fileshare.FileManager{ListenUDPPort: 29878, ProgressBar: createBar}
 
 	if fileManager.Server, err = cmd.Flags().GetString("server"); err != nil {
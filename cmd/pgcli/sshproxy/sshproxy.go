@@ -0,0 +1,81 @@
+package sshproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/rkonfj/peerguard/cmd/pgcli/overlay"
+	"github.com/rkonfj/peerguard/forward"
+	"github.com/spf13/cobra"
+)
+
+var Cmd *cobra.Command
+
+func init() {
+	Cmd = &cobra.Command{
+		Use:     "ssh-proxy <peer> <port>",
+		Short:   "Pipe stdin/stdout to the tcp port of the peer, used as the OpenSSH ProxyCommand",
+		Long:    "Pipe stdin/stdout to the tcp port of the peer (peer id, overlay ip or alias) over the p2p network, used as the OpenSSH ProxyCommand. The peer runs `pgcli vpn`",
+		Example: "  ssh -o ProxyCommand='pgcli ssh-proxy %h %p' user@100.99.0.2",
+		Args:    cobra.ExactArgs(2),
+		RunE:    run,
+	}
+	overlay.AddFlags(Cmd.Flags(), 29885)
+}
+
+func run(cmd *cobra.Command, args []string) error {
+	port, err := strconv.ParseUint(args[1], 10, 16)
+	if err != nil || port == 0 {
+		return fmt.Errorf("invalid port %s", args[1])
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	network, err := overlay.Join(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	defer network.Close()
+	go network.Discard() // the stream datagrams are dispatched by ReadFrom
+
+	peerID, err := network.Resolve(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	client, err := forward.NewClient(network.StreamConn())
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	dialCtx, dialCancel := context.WithTimeout(ctx, 10*time.Second)
+	conn, err := client.Dial(dialCtx, peerID, uint16(port))
+	dialCancel()
+	if err != nil {
+		return err
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-copyDone(conn, os.Stdin): // the ssh client closed
+		}
+		conn.Close()
+	}()
+	io.Copy(os.Stdout, conn)
+	return nil
+}
+
+func copyDone(dst io.Writer, src io.Reader) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.Copy(dst, src)
+	}()
+	return done
+}
@@ -0,0 +1,93 @@
+package status
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/rkonfj/peerguard/cmd/pgcli/localapi"
+	"github.com/spf13/cobra"
+)
+
+var Cmd *cobra.Command
+
+func init() {
+	Cmd = &cobra.Command{
+		Use:   "status",
+		Short: "Show the state and the peers of the running vpn daemon",
+		Args:  cobra.NoArgs,
+		RunE:  run,
+	}
+	localapi.AddFlags(Cmd.Flags())
+}
+
+func run(cmd *cobra.Command, args []string) error {
+	client, err := localapi.NewClientFromFlags(cmd.Flags())
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	status, err := client.Status(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("State:   %s\n", status.State)
+	fmt.Printf("Peer:    %s\n", dash(status.PeerID))
+	fmt.Printf("Server:  %s\n", status.Server)
+	fmt.Printf("Tun:     %s (%s)\n", status.Tun, addrs(status.IPv4, status.IPv6))
+	fmt.Printf("Version: %s\n", status.Version)
+
+	peers, err := client.Peers(ctx, false)
+	if err != nil {
+		return err
+	}
+	if len(peers) == 0 {
+		return nil
+	}
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PEER\tNAME\tIPV4\tIPV6\tPATH\tQUALITY")
+	for _, peer := range peers {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", peer.ID, dash(peer.Name), dash(peer.IPv4), dash(peer.IPv6), dash(peer.Path), quality(peer.Quality))
+	}
+	return w.Flush()
+}
+
+// quality formats the score with the loss and the flaps if any, e.g. 72 (loss 10%, 2 flaps)
+func quality(q *localapi.Quality) string {
+	if q == nil {
+		return "-"
+	}
+	var notes []string
+	if q.Loss > 0 {
+		notes = append(notes, fmt.Sprintf("loss %.0f%%", q.Loss*100))
+	}
+	if q.Flaps > 0 {
+		notes = append(notes, fmt.Sprintf("%d flaps", q.Flaps))
+	}
+	if len(notes) == 0 {
+		return strconv.Itoa(q.Score)
+	}
+	return fmt.Sprintf("%d (%s)", q.Score, strings.Join(notes, ", "))
+}
+
+func addrs(ipv4, ipv6 string) string {
+	switch {
+	case ipv4 != "" && ipv6 != "":
+		return ipv4 + ", " + ipv6
+	case ipv4 != "":
+		return ipv4
+	default:
+		return ipv6
+	}
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,75 @@
+package token
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/rkonfj/peerguard/disco"
+	"github.com/rkonfj/peerguard/peermap/auth"
+	"github.com/spf13/cobra"
+)
+
+// SecretCmd generates the network secrets, it is shared by the deprecated `pgcli admin secret`
+func SecretCmd() *cobra.Command {
+	secretCmd := &cobra.Command{
+		Use:   "secret",
+		Short: "Generate a pre-shared network secret",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			secretKey, err := secretKey(cmd)
+			if err != nil {
+				return err
+			}
+			network, err := cmd.Flags().GetString("network")
+			if err != nil {
+				return err
+			}
+			alias, err := cmd.Flags().GetString("alias")
+			if err != nil {
+				return err
+			}
+			validDuration, err := cmd.Flags().GetDuration("duration")
+			if err != nil {
+				return err
+			}
+			scopes, err := cmd.Flags().GetStringSlice("scope")
+			if err != nil {
+				return err
+			}
+			if err := auth.CheckScopes(scopes); err != nil {
+				return err
+			}
+			tags, err := cmd.Flags().GetStringSlice("tag")
+			if err != nil {
+				return err
+			}
+			signed, err := cmd.Flags().GetBool("signed")
+			if err != nil {
+				return err
+			}
+			secret, err := auth.NewAuthenticator(secretKey).SignSecrets(signed).GenerateSecret(auth.Net{
+				Alias:  alias,
+				ID:     network,
+				Scopes: scopes,
+				Tags:   tags,
+			}, validDuration)
+			if err != nil {
+				return err
+			}
+			return json.NewEncoder(os.Stdout).Encode(disco.NetworkSecret{
+				Secret:  secret,
+				Network: network,
+				Expire:  time.Now().Add(validDuration - 10*time.Second),
+			})
+		},
+	}
+	secretCmd.Flags().String("alias", "", "network alias")
+	secretCmd.Flags().String("network", "default", "network")
+	secretCmd.Flags().Duration("duration", 365*24*time.Hour, "secret duration to expire")
+	secretCmd.Flags().Bool("signed", false, "generate an Ed25519 signed secret (JWT) rather than an encrypted one")
+	secretCmd.Flags().StringSlice("tag", nil, "acl tags of the peers joined by the secret, the acl of the network (pgcli admin set-acl) allows the peers to reach each other by the tags")
+	secretCmd.Flags().StringSlice("scope", nil, "restrict the secret for semi-trusted devices (no-relay|silence|no-neighbor)")
+
+	return secretCmd
+}
@@ -0,0 +1,88 @@
+package token
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/rkonfj/peerguard/peermap/exporter/auth"
+	"github.com/spf13/cobra"
+)
+
+var Cmd *cobra.Command
+
+func init() {
+	Cmd = &cobra.Command{
+		Use:          "token",
+		Short:        "Generate the tokens and network secrets by the secret key of pgmap",
+		SilenceUsage: true,
+	}
+	Cmd.PersistentFlags().String("secret-key", "", "the secret key of pgmap (default $PG_SECRET_KEY)")
+	Cmd.AddCommand(adminCmd())
+	Cmd.AddCommand(exporterCmd())
+	Cmd.AddCommand(SecretCmd())
+}
+
+func adminCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "admin",
+		Short: "Generate an admin token for the pgmap management api (see pgcli admin login)",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return generateToken(cmd, "")
+		},
+	}
+	cmd.Flags().Duration("duration", 30*24*time.Hour, "token duration to expire")
+	return cmd
+}
+
+func exporterCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "exporter",
+		Short: "Generate a read-only token only queries the networks, peers and devices from pgmap",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return generateToken(cmd, auth.ScopeExporter)
+		},
+	}
+	cmd.Flags().Duration("duration", 365*24*time.Hour, "token duration to expire")
+	return cmd
+}
+
+func generateToken(cmd *cobra.Command, scope string) error {
+	secretKey, err := secretKey(cmd)
+	if err != nil {
+		return err
+	}
+	validDuration, err := cmd.Flags().GetDuration("duration")
+	if err != nil {
+		return err
+	}
+	if validDuration <= 0 {
+		return errors.New("duration must be positive")
+	}
+	token, err := auth.New(secretKey).GenerateToken(auth.Instruction{
+		ExpiredAt: time.Now().Add(validDuration).Unix(),
+		Scope:     scope,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println(token)
+	return nil
+}
+
+func secretKey(cmd *cobra.Command) (string, error) {
+	secretKey, err := cmd.Flags().GetString("secret-key")
+	if err != nil {
+		return "", err
+	}
+	if secretKey == "" {
+		secretKey = os.Getenv("PG_SECRET_KEY")
+	}
+	if secretKey == "" {
+		return "", errors.New("required flag \"secret-key\" not set")
+	}
+	return secretKey, nil
+}
@@ -0,0 +1,204 @@
+package top
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rkonfj/peerguard/cmd/pgcli/localapi"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+var Cmd *cobra.Command
+
+func init() {
+	Cmd = &cobra.Command{
+		Use:   "top",
+		Short: "Show the live peers of the vpn daemon with the path, rtt and rx/tx rates",
+		Long: "Show the peers of the running vpn daemon (pgcli daemon) refreshing in place, " +
+			"the path the datagrams are sent over, the rtt and the rx/tx rates. The busiest peers are listed first",
+		Args: cobra.NoArgs,
+		RunE: run,
+	}
+	localapi.AddFlags(Cmd.Flags())
+	Cmd.Flags().DurationP("interval", "i", 2*time.Second, "refresh interval")
+	Cmd.Flags().Bool("no-rtt", false, "do not ping the peers to measure the rtt")
+}
+
+// sample is the peers at a time, the rates are the deltas between two samples
+type sample struct {
+	time  time.Time
+	peers map[string]localapi.Peer
+}
+
+type row struct {
+	localapi.Peer
+	rxRate, txRate float64 // bytes per second
+}
+
+func run(cmd *cobra.Command, args []string) error {
+	socket, err := cmd.Flags().GetString("socket")
+	if err != nil {
+		return err
+	}
+	interval, err := cmd.Flags().GetDuration("interval")
+	if err != nil {
+		return err
+	}
+	noRTT, err := cmd.Flags().GetBool("no-rtt")
+	if err != nil {
+		return err
+	}
+	if interval < 100*time.Millisecond {
+		return fmt.Errorf("interval must be at least 100ms")
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	client := localapi.NewClient(socket)
+	tty := term.IsTerminal(int(os.Stdout.Fd()))
+	if tty {
+		fmt.Print("\x1b[?1049h\x1b[?25l") // alternate screen, hide cursor
+		defer fmt.Print("\x1b[?25h\x1b[?1049l")
+	}
+
+	var last *sample
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		peers, err := client.Peers(ctx, !noRTT)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		current := &sample{time: time.Now(), peers: make(map[string]localapi.Peer, len(peers))}
+		for _, peer := range peers {
+			current.peers[peer.ID] = peer
+		}
+		render(tty, socket, rows(last, current))
+		last = current
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// rows computes the rates since the last sample, sorted by the total rate
+func rows(last, current *sample) []row {
+	rows := make([]row, 0, len(current.peers))
+	for id, peer := range current.peers {
+		r := row{Peer: peer}
+		if last != nil {
+			if prev, ok := last.peers[id]; ok {
+				elapsed := current.time.Sub(last.time).Seconds()
+				r.rxRate = float64(peer.RxBytes-min(prev.RxBytes, peer.RxBytes)) / elapsed
+				r.txRate = float64(peer.TxBytes-min(prev.TxBytes, peer.TxBytes)) / elapsed
+			}
+		}
+		rows = append(rows, r)
+	}
+	slices.SortFunc(rows, func(a, b row) int {
+		if a.rxRate+a.txRate != b.rxRate+b.txRate {
+			if a.rxRate+a.txRate > b.rxRate+b.txRate {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	return rows
+}
+
+func render(tty bool, socket string, rows []row) {
+	var direct, relay int
+	var rxRate, txRate float64
+	for _, r := range rows {
+		switch r.Path {
+		case localapi.PathDirect:
+			direct++
+		case localapi.PathRelay:
+			relay++
+		}
+		rxRate += r.rxRate
+		txRate += r.txRate
+	}
+	height := len(rows) + 3
+	if tty {
+		if _, h, err := term.GetSize(int(os.Stdout.Fd())); err == nil {
+			height = h - 1
+		}
+	}
+
+	var buf bytes.Buffer
+	if tty {
+		buf.WriteString("\x1b[H\x1b[2J")
+	}
+	fmt.Fprintf(&buf, "pgcli top - %s  %s  peers: %d (direct %d, relay %d)  rx: %s  tx: %s\n\n",
+		time.Now().Format(time.TimeOnly), socket, len(rows), direct, relay, rate(rxRate), rate(txRate))
+	w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PEER\tIPV4\tIPV6\tPATH\tRTT\tRX/S\tTX/S\tRX\tTX\tLAST SEEN")
+	for i, r := range rows {
+		if i >= height-3 {
+			break
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.ID, dash(r.IPv4), dash(r.IPv6), dash(r.Path),
+			rtt(r.RTT), rate(r.rxRate), rate(r.txRate), size(r.RxBytes), size(r.TxBytes), lastSeen(r.LastSeen))
+	}
+	w.Flush()
+	if !tty {
+		buf.WriteString("\n")
+	}
+	os.Stdout.Write(buf.Bytes())
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func rtt(d time.Duration) string {
+	if d == 0 {
+		return "-"
+	}
+	return d.Round(10 * time.Microsecond).String()
+}
+
+func lastSeen(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return time.Since(t).Round(time.Second).String() + " ago"
+}
+
+func rate(bps float64) string {
+	return size(uint64(bps)) + "/s"
+}
+
+func size(n uint64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fG", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fM", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fK", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%dB", n)
+	}
+}
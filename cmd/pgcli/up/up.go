@@ -0,0 +1,26 @@
+package up
+
+import (
+	"context"
+
+	"github.com/rkonfj/peerguard/cmd/pgcli/localapi"
+	"github.com/spf13/cobra"
+)
+
+var Cmd *cobra.Command
+
+func init() {
+	Cmd = &cobra.Command{
+		Use:   "up",
+		Short: "Resume the overlay paused by pgcli down, the routes and the forwarding are restored",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, err := localapi.NewClientFromFlags(cmd.Flags())
+			if err != nil {
+				return err
+			}
+			return client.Up(context.Background())
+		},
+	}
+	localapi.AddFlags(Cmd.Flags())
+}
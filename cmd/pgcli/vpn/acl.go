@@ -0,0 +1,52 @@
+package vpn
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/netip"
+
+	"github.com/rkonfj/peerguard/disco"
+	"github.com/rkonfj/peerguard/vpn"
+)
+
+var _ disco.Controller = (*aclController)(nil)
+
+// aclController updates the packet filter by the acl of the network sent by the peermap
+type aclController struct {
+	filter *vpn.ACLFilter
+}
+
+func (c *aclController) Name() string {
+	return "acl"
+}
+
+func (c *aclController) Type() uint8 {
+	return disco.CONTROL_UPDATE_ACL.Byte()
+}
+
+func (c *aclController) Handle(b []byte) {
+	var update disco.ACLUpdate
+	if err := json.Unmarshal(b[1:], &update); err != nil {
+		slog.Error("ACLUpdate", "err", err)
+		return
+	}
+	c.filter.Update(update)
+	slog.Info("ACLUpdated", "rules", len(update.ACL.Rules), "tags", update.Tags)
+}
+
+// peerRoute resolves the peer the ip (the overlay ip or the subnet routed) is routed to
+func (v *P2PVPN) peerRoute(ip netip.Addr) (net.Addr, bool) {
+	return v.iface.GetPeer(ip.String())
+}
+
+// peerTags are the tags assigned to the peer by the peermap
+func (v *P2PVPN) peerTags(peer net.Addr) ([]string, bool) {
+	v.peersMutex.RLock()
+	defer v.peersMutex.RUnlock()
+	meta, ok := v.peers[disco.PeerID(peer.String())]
+	if !ok {
+		return nil, false
+	}
+	return disco.PeerTags(meta), true
+}
@@ -0,0 +1,104 @@
+package vpn
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"sync/atomic"
+
+	"github.com/rkonfj/peerguard/cmd/pgcli/localapi"
+	"github.com/rkonfj/peerguard/p2p"
+)
+
+var (
+	errAlreadyUp   = errors.New("already up")
+	errAlreadyDown = errors.New("already down")
+)
+
+// packetConn is the packet conn of the data plane, the packets are dropped in both directions while the
+// overlay is paused (down), the peermap session and the peers are kept
+type packetConn struct {
+	*p2p.PeerPacketConn
+	paused  atomic.Bool
+	dropped atomic.Uint64 // the packets dropped while paused
+}
+
+func (c *packetConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	for {
+		n, addr, err = c.PeerPacketConn.ReadFrom(p)
+		if err != nil || !c.paused.Load() {
+			return
+		}
+		c.dropped.Add(1)
+	}
+}
+
+func (c *packetConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if c.paused.Load() {
+		c.dropped.Add(1)
+		return len(p), nil
+	}
+	return c.PeerPacketConn.WriteTo(p, addr)
+}
+
+// up resumes the overlay paused by down, the routes removed are added back
+func (v *P2PVPN) up() error {
+	v.upMutex.Lock()
+	defer v.upMutex.Unlock()
+	if !v.conn.paused.Load() {
+		return errAlreadyUp
+	}
+	for dst, via := range v.pausedRoutes {
+		if err := v.applyRoute(dst, via, v.addRoute); err != nil {
+			slog.Error("RestoreRoute", "dst", dst, "via", via, "err", err)
+		}
+	}
+	v.pausedRoutes = nil
+	v.serve()
+	v.conn.paused.Store(false)
+	slog.Info("Resumed")
+	return nil
+}
+
+// down pauses the overlay, the routes via the peers are removed and the forwarding is stopped,
+// while the daemon keeps the tun, the peermap session and the peers
+func (v *P2PVPN) down() error {
+	v.upMutex.Lock()
+	defer v.upMutex.Unlock()
+	if v.conn.paused.Load() {
+		return errAlreadyDown
+	}
+	v.conn.paused.Store(true)
+	v.cancelServe()
+	v.routesMutex.RLock()
+	v.pausedRoutes = make(map[string]string, len(v.routes))
+	for dst, via := range v.routes {
+		v.pausedRoutes[dst] = via
+	}
+	v.routesMutex.RUnlock()
+	for dst, via := range v.pausedRoutes {
+		if err := v.applyRoute(dst, via, v.delRoute); err != nil {
+			slog.Error("RemoveRoute", "dst", dst, "via", via, "err", err)
+		}
+	}
+	slog.Info("Paused")
+	return nil
+}
+
+// serve starts the services on the p2p conn, they are stopped by cancelServe
+func (v *P2PVPN) serve() {
+	ctx, cancel := context.WithCancel(v.ctx)
+	v.cancelServe = cancel
+	if !v.Config.NoForward {
+		go v.serveForward(ctx, v.conn.PeerPacketConn)
+	}
+}
+
+func (v *P2PVPN) applyRoute(dst, via string, apply func(*net.IPNet, net.IP) error) error {
+	ipnet, ip, err := parseRoute(localapi.Route{Dst: dst, Via: via})
+	if err != nil {
+		return err
+	}
+	return apply(ipnet, ip)
+}
@@ -0,0 +1,97 @@
+package vpn
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"net/url"
+
+	"github.com/rkonfj/peerguard/disco"
+	"github.com/rkonfj/peerguard/p2p"
+	"github.com/rkonfj/peerguard/secure"
+	"github.com/rkonfj/peerguard/vpn"
+	"github.com/rkonfj/peerguard/vpn/wg"
+)
+
+const (
+	dataPlanePeerGuard = "peerguard"
+	dataPlaneWireGuard = "wireguard"
+)
+
+// checkDataPlane refuses the features the wireguard data plane does not support, the peers are
+// the wireguard peers keyed by the curve25519 public keys and the packets are encrypted by it
+func checkDataPlane(cfg Config) error {
+	switch cfg.DataPlane {
+	case dataPlanePeerGuard:
+		return nil
+	case dataPlaneWireGuard:
+	default:
+		return fmt.Errorf("invalid data plane %s (peerguard|wireguard)", cfg.DataPlane)
+	}
+	if cfg.PrivateKey == "" && cfg.KeyFile == "" {
+		return errors.New("the wireguard data plane requires the flag \"key\" or \"key-file\"")
+	}
+	unsupported := []struct {
+		flag string
+		set  bool
+	}{
+		{"key-backend", cfg.KeyBackend != ""},
+		{"pq", cfg.PostQuantum},
+		{"cipher-suite", cfg.CipherSuite != p2p.CipherSuiteAuto},
+		{"psk", cfg.PreSharedKey != ""},
+		{"peer-psk", len(cfg.PeerPreSharedKeys) > 0},
+		{"exit-node", cfg.ExitNode != ""},
+		{"wg-listen-port", cfg.WireGuard.ListenPort > 0},
+	}
+	for _, f := range unsupported {
+		if f.set {
+			return fmt.Errorf("flag \"%s\" is not supported by the wireguard data plane", f.flag)
+		}
+	}
+	return nil
+}
+
+// newWireGuardDataPlane creates the wireguard data plane running the handlers of the vpn config,
+// the private key of the peer id is the wireguard private key
+func (v *P2PVPN) newWireGuardDataPlane(vpnConfig vpn.Config) (*wg.DataPlane, error) {
+	privateKey := v.Config.PrivateKey
+	if privateKey == "" {
+		priv, err := secure.LoadOrGenerateSealedCurve25519File(v.Config.KeyFile, v.Config.SealingKey)
+		if err != nil {
+			return nil, fmt.Errorf("load key file: %w", err)
+		}
+		privateKey = priv.String()
+	}
+	return wg.NewDataPlane(wg.DataPlaneConfig{
+		PrivateKey:       privateKey,
+		InboundHandlers:  vpnConfig.InboundHandlers,
+		OutboundHandlers: vpnConfig.OutboundHandlers,
+		Filter:           vpnConfig.Filter,
+	})
+}
+
+// addWireGuardPeer allows the overlay ips and the routes accepted of the peer to the wireguard
+// peer, the routes added by pgcli route add are not followed by the wireguard data plane
+func (v *P2PVPN) addWireGuardPeer(pi disco.PeerID, m url.Values) {
+	if v.wgPlane == nil {
+		return
+	}
+	var allowedIPs []netip.Prefix
+	for _, alias := range []string{m.Get("alias1"), m.Get("alias2")} {
+		if addr, err := netip.ParseAddr(alias); err == nil {
+			allowedIPs = append(allowedIPs, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+	if v.Config.AcceptRoutes {
+		localAddrs := v.localPrefixes()
+		for _, s := range m[p2p.MetaRoutes] {
+			if prefix, err := netip.ParsePrefix(s); err == nil && !overlaps(prefix, localAddrs) {
+				allowedIPs = append(allowedIPs, prefix)
+			}
+		}
+	}
+	if err := v.wgPlane.AddPeer(pi, allowedIPs...); err != nil {
+		slog.Error("WireGuardAddPeer", "peer", pi, "err", err)
+	}
+}
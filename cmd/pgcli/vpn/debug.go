@@ -0,0 +1,67 @@
+package vpn
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rkonfj/peerguard/disco"
+	"github.com/rkonfj/peerguard/pcap"
+)
+
+const (
+	captureIfaceTun = iota
+	captureIfacePeer
+)
+
+// capturePeer captures the decrypted datagrams exchanged with the peers
+func (v *P2PVPN) capturePeer(peerID disco.PeerID, b []byte, inbound, relayed bool) {
+	if !v.tap.Active() {
+		return
+	}
+	comment := "peer=" + peerID.String()
+	if relayed {
+		comment += " relayed"
+	}
+	dir := pcap.Outbound
+	if inbound {
+		dir = pcap.Inbound
+	}
+	v.tap.Capture(captureIfacePeer, b, dir, comment)
+}
+
+// startCapture writes the captured packets to a new pcapng file in the capture dir
+func (v *P2PVPN) startCapture(ctx context.Context) error {
+	if err := os.MkdirAll(v.Config.CaptureDir, 0700); err != nil {
+		return err
+	}
+	path := filepath.Join(v.Config.CaptureDir, fmt.Sprintf("pgcli-%s.pcapng", time.Now().Format("20060102-150405")))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	slog.Info("Capturing packets", "file", path)
+	go v.tap.AttachFile(ctx, f)
+	return nil
+}
+
+// handleCapture streams the packets captured on the iface (tun|peer|all) in pcapng until the client goes away
+func (v *P2PVPN) handleCapture(w http.ResponseWriter, r *http.Request) {
+	var ifaces []int
+	if name := r.URL.Query().Get("iface"); name != "" && name != "all" {
+		id := v.tap.Interface(name)
+		if id < 0 {
+			http.Error(w, "unknown interface "+name, http.StatusBadRequest)
+			return
+		}
+		ifaces = append(ifaces, id)
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if err := v.tap.Attach(r.Context(), w, ifaces...); err != nil {
+		slog.Debug("CaptureStream", "err", err)
+	}
+}
@@ -0,0 +1,100 @@
+package vpn
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/rkonfj/peerguard/netlink"
+	"github.com/rkonfj/peerguard/vpn"
+)
+
+// serveDNS answers the names of the peers under the dns domain on the overlay ip port 53, the
+// resolver of the system routes the queries of the domain to it until the ctx is done
+func (v *P2PVPN) serveDNS(ctx context.Context) error {
+	var server netip.Addr
+	for _, s := range []string{v.Config.IPv4, v.Config.IPv6} {
+		if prefix, err := netip.ParsePrefix(s); err == nil {
+			server = prefix.Addr()
+			break
+		}
+	}
+	upstreams := v.Config.DNSUpstreams
+	if len(upstreams) == 0 {
+		upstreams = systemResolvers(server)
+	}
+	conn, err := net.ListenPacket("udp", netip.AddrPortFrom(server, 53).String())
+	if err != nil {
+		return err
+	}
+	dns := vpn.DNS{Domain: v.Config.DNSDomain, Upstreams: upstreams, Lookup: v.lookupPeerName}
+	go dns.Serve(conn)
+	tun, _ := v.iface.Device().Name()
+	if err := netlink.SetupDNS(tun, server, v.Config.DNSDomain); err != nil {
+		conn.Close()
+		return fmt.Errorf("setup dns of %s: %w", tun, err)
+	}
+	slog.Info("DNS", "server", server, "domain", v.Config.DNSDomain, "upstreams", upstreams)
+	go func() {
+		<-ctx.Done()
+		if err := netlink.CleanupDNS(tun, v.Config.DNSDomain); err != nil {
+			slog.Error("CleanupDNS", "err", err)
+		}
+		conn.Close()
+	}()
+	return nil
+}
+
+// lookupPeerName finds the overlay ips of the peer by the name (case insensitive), this host
+// included
+func (v *P2PVPN) lookupPeerName(name string) (addrs []netip.Addr) {
+	appendAddrs := func(ips ...string) {
+		for _, ip := range ips {
+			if prefix, err := netip.ParsePrefix(ip); err == nil {
+				addrs = append(addrs, prefix.Addr())
+			} else if addr, err := netip.ParseAddr(ip); err == nil {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	if strings.EqualFold(v.Config.Hostname, name) {
+		appendAddrs(v.Config.IPv4, v.Config.IPv6)
+		return
+	}
+	v.peersMutex.RLock()
+	defer v.peersMutex.RUnlock()
+	for _, m := range v.peers {
+		if strings.EqualFold(m.Get("name"), name) {
+			appendAddrs(m.Get("alias1"), m.Get("alias2"))
+			return
+		}
+	}
+	return
+}
+
+// systemResolvers are the nameservers of /etc/resolv.conf except the server itself
+func systemResolvers(server netip.Addr) (upstreams []string) {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		addr, err := netip.ParseAddr(fields[1])
+		if err != nil || addr == server {
+			continue
+		}
+		upstreams = append(upstreams, netip.AddrPortFrom(addr, 53).String())
+	}
+	return
+}
@@ -0,0 +1,187 @@
+package vpn
+
+import (
+	"fmt"
+	"io"
+	"net/netip"
+	"runtime"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/rkonfj/peerguard/cmd/pgcli/localapi"
+	"github.com/rkonfj/peerguard/netlink"
+)
+
+// printPlan prints the changes to the system the daemon would make, nothing is applied
+func printPlan(w io.Writer, cfg Config) error {
+	var prefixes []netip.Prefix
+	for _, s := range []string{cfg.IPv4, cfg.IPv6} {
+		if s == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return fmt.Errorf("invalid address %s: %w", s, err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	tunName := cfg.TunName
+	if runtime.GOOS == "darwin" || runtime.GOOS == "openbsd" && tunName == "tun" {
+		tunName += "N (the next free " + tunName + " device)"
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Interface:\t%s (tun, created)\n", tunName)
+	fmt.Fprintf(tw, "MTU:\t%d\n", cfg.MTU)
+	if cfg.Metric > 0 {
+		fmt.Fprintf(tw, "Metric:\t%d (%s)\n", cfg.Metric, setLinkMetricAction())
+	}
+	fmt.Fprintln(tw, "Addresses:\t")
+	for _, prefix := range prefixes {
+		fmt.Fprintf(tw, "  %s\t%s\n", prefix, setupLinkAction(prefix))
+	}
+	fmt.Fprintln(tw, "Routes:\t")
+	for _, prefix := range prefixes {
+		fmt.Fprintf(tw, "  %s dev %s\t%s\n", prefix.Masked(), cfg.TunName, connectedRouteAction())
+	}
+	if cfg.AcceptRoutes {
+		fmt.Fprintln(tw, "  \tthe routes via peers are added by `pgcli route add` and for the subnets the peers advertise")
+	} else {
+		fmt.Fprintln(tw, "  \tthe routes via peers are not added until `pgcli route add`")
+	}
+	if cfg.ExitNode != "" {
+		fmt.Fprintf(tw, "  default dev %s\t%s, once the exit node %s is found\n", cfg.TunName, exitRoutesAction(), cfg.ExitNode)
+	}
+	if cfg.DNS && len(prefixes) > 0 {
+		fmt.Fprintf(tw, "DNS:\t*.%s => %s (%s)\n", cfg.DNSDomain, prefixes[0].Addr(), setupDNSAction(cfg.DNSDomain))
+	} else {
+		fmt.Fprintln(tw, "DNS:\tunchanged")
+	}
+	if cfg.AdvertiseExitNode || len(cfg.AdvertiseRoutes) > 0 {
+		nat, err := newNAT(cfg.IPv4, cfg.IPv6, cfg.AdvertiseExitNode, cfg.AdvertiseRoutes)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(tw, "Firewall:\t")
+		for _, addr := range nat.Addrs() {
+			fmt.Fprintf(tw, "  masquerade %s\t%s\n", addr, masqueradeAction())
+		}
+	} else {
+		fmt.Fprintln(tw, "Firewall:\tunchanged, no rules are added")
+	}
+	fmt.Fprintln(tw, "Listen:\t")
+	fmt.Fprintln(tw, "  udp :29877\tp2p")
+	if cfg.Socket != "" {
+		fmt.Fprintf(tw, "  unix %s\tlocal api (mode 0600)\n", cfg.Socket)
+	}
+	if cfg.Debug.Listen != "" {
+		fmt.Fprintf(tw, "  tcp %s\tpprof and expvar\n", cfg.Debug.Listen)
+	}
+	if cfg.DNS && len(prefixes) > 0 {
+		fmt.Fprintf(tw, "  udp %s\tdns of the peer names\n", netip.AddrPortFrom(prefixes[0].Addr(), 53))
+	}
+	if cfg.ServeMetrics {
+		for _, prefix := range prefixes {
+			fmt.Fprintf(tw, "  tcp %s\tmetrics to the peers\n", netip.AddrPortFrom(prefix.Addr(), localapi.MetricsPort))
+		}
+	}
+	if cfg.WireGuard.ListenPort > 0 {
+		fmt.Fprintf(tw, "  udp :%d\twireguard gateway\n", cfg.WireGuard.ListenPort)
+	}
+	if cfg.LANProxy != "" {
+		fmt.Fprintf(tw, "LAN proxy:\t%s, the ARP/NDP for the peers in its subnets are answered (%s)\n", cfg.LANProxy, lanProxyAction())
+	}
+	if len(cfg.AdvertiseRoutes) > 0 {
+		fmt.Fprintf(tw, "Advertised routes:\t%s\n", strings.Join(cfg.AdvertiseRoutes, ", "))
+	}
+	if cfg.DERPServer != "" {
+		fmt.Fprintf(tw, "Relay:\t%s (DERP), the peermap if the peer is not connected to it\n", cfg.DERPServer)
+	}
+	if len(cfg.Peers) > 0 {
+		fmt.Fprintf(tw, "Static peers:\t%s\n", strings.Join(cfg.Peers, ", "))
+	}
+	if len(cfg.WireGuard.Peers) > 0 {
+		fmt.Fprintln(tw, "WireGuard peers:\t")
+		for _, peer := range cfg.WireGuard.Peers {
+			fmt.Fprintf(tw, "  %s\t%s\n", peer.PublicKey, joinPrefixes(peer.AllowedIPs))
+		}
+	}
+	if cfg.CaptureDir != "" {
+		fmt.Fprintf(tw, "Capture:\tpcapng files in %s\n", cfg.CaptureDir)
+	}
+	return tw.Flush()
+}
+
+func joinPrefixes(prefixes []netip.Prefix) string {
+	s := make([]string, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		s = append(s, prefix.String())
+	}
+	return strings.Join(s, ", ")
+}
+
+func setupLinkAction(prefix netip.Prefix) string {
+	switch runtime.GOOS {
+	case "linux":
+		return "netlink addr add, link set up"
+	case "darwin", "freebsd", "openbsd":
+		if prefix.Addr().Is4() {
+			return fmt.Sprintf("ifconfig inet %s %s, up", prefix, prefix.Addr())
+		}
+		return fmt.Sprintf("ifconfig inet6 %s alias, up", prefix)
+	case "windows":
+		return "CreateUnicastIpAddressEntry"
+	default:
+		return "not supported on " + runtime.GOOS
+	}
+}
+
+func setLinkMetricAction() string {
+	if runtime.GOOS == "windows" {
+		return "SetIpInterfaceEntry, automatic metric disabled"
+	}
+	return "not supported on " + runtime.GOOS
+}
+
+func lanProxyAction() string {
+	if runtime.GOOS == "linux" {
+		return "ip neigh add proxy, proxy_ndp enabled for ipv6"
+	}
+	return "not supported on " + runtime.GOOS
+}
+
+func setupDNSAction(domain string) string {
+	switch runtime.GOOS {
+	case "linux":
+		return "resolvectl dns, resolvectl domain ~" + domain
+	case "darwin":
+		return "/etc/resolver/" + domain
+	case "windows":
+		return "SetInterfaceDnsSettings"
+	default:
+		return "not supported on " + runtime.GOOS
+	}
+}
+
+func exitRoutesAction() string {
+	if runtime.GOOS == "linux" {
+		return fmt.Sprintf("table %d, rule not fwmark %#x, rule main suppress_prefixlength 0", netlink.ExitMark, netlink.ExitMark)
+	}
+	return "not supported on " + runtime.GOOS
+}
+
+func masqueradeAction() string {
+	if runtime.GOOS == "linux" {
+		return "ip forwarding enabled, iptables POSTROUTING MASQUERADE, FORWARD ACCEPT"
+	}
+	return "not supported on " + runtime.GOOS
+}
+
+func connectedRouteAction() string {
+	switch runtime.GOOS {
+	case "darwin", "freebsd", "openbsd":
+		return "RTM_ADD on the route socket"
+	default:
+		return "added by the system with the address"
+	}
+}
@@ -0,0 +1,186 @@
+package vpn
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"net/url"
+	"slices"
+	"sync"
+
+	"github.com/rkonfj/peerguard/cmd/pgcli/localapi"
+	"github.com/rkonfj/peerguard/disco"
+	"github.com/rkonfj/peerguard/netlink"
+	"github.com/rkonfj/peerguard/p2p"
+	"github.com/rkonfj/peerguard/vpn"
+)
+
+// exitNAT masquerades the traffic of the peers to the internet on the exit node, or to the
+// advertised subnets on the subnet router. The NAT of the data plane rewrites them to the NAT
+// addresses the kernel masquerades
+type exitNAT struct {
+	nat *vpn.ExitNAT
+}
+
+func newExitNAT(ipv4, ipv6 string, exitNode bool, routes []string) (*exitNAT, error) {
+	nat, err := newNAT(ipv4, ipv6, exitNode, routes)
+	if err != nil {
+		return nil, err
+	}
+	for i, addr := range nat.Addrs() {
+		if err := netlink.AddMasquerade(addr.AsSlice()); err != nil {
+			for _, added := range nat.Addrs()[:i] {
+				netlink.DelMasquerade(added.AsSlice())
+			}
+			return nil, fmt.Errorf("masquerade %s: %w", addr, err)
+		}
+	}
+	slog.Info("ExitNAT", "nat", nat.Addrs(), "subnets", routes, "exit", exitNode)
+	return &exitNAT{nat: nat}, nil
+}
+
+// newNAT is the NAT of the data plane, all the destinations on the exit node, only the advertised
+// subnets on the subnet router
+func newNAT(ipv4, ipv6 string, exitNode bool, routes []string) (*vpn.ExitNAT, error) {
+	var subnets []netip.Prefix
+	for _, cidr := range routes {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, err
+		}
+		subnets = append(subnets, prefix.Masked())
+	}
+	if exitNode {
+		return vpn.NewExitNAT(ipv4, ipv6)
+	}
+	return vpn.NewSubnetNAT(ipv4, ipv6, subnets)
+}
+
+func (e *exitNAT) close() error {
+	if e == nil {
+		return nil
+	}
+	var errs []error
+	for _, addr := range e.nat.Addrs() {
+		if err := netlink.DelMasquerade(addr.AsSlice()); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// rules checks the masquerade rules of the NAT addresses against the iptables
+func (e *exitNAT) rules() []localapi.Rule {
+	if e == nil {
+		return nil
+	}
+	var rules []localapi.Rule
+	for _, addr := range e.nat.Addrs() {
+		rule := localapi.Rule{Rule: fmt.Sprintf("masquerade %s (nat POSTROUTING, filter FORWARD)", addr), State: localapi.RuleMissing}
+		ok, err := netlink.MasqueradeExists(addr.AsSlice())
+		switch {
+		case err != nil:
+			rule.State, rule.Error = localapi.RuleUnknown, err.Error()
+		case ok:
+			rule.State = localapi.RuleIntact
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// exitNode routes all the traffic via the peer advertised as the exit node. The peer is selected by
+// the id, the hostname or the overlay ip, the sockets of peerguard are marked so that the policy
+// routing keeps them out of the tun
+type exitNode struct {
+	selector  string
+	tunName   string
+	dataPlane *vpn.VPN
+
+	mutex    sync.Mutex
+	peer     disco.PeerID
+	families []bool // ipv6 or not, the exit routes are added
+}
+
+func newExitNode(selector, tunName string, dataPlane *vpn.VPN) *exitNode {
+	disco.SetSocketMark(netlink.ExitMark)
+	return &exitNode{selector: selector, tunName: tunName, dataPlane: dataPlane}
+}
+
+// peerFound uses the peer as the exit node if it is the selected one
+func (e *exitNode) peerFound(pi disco.PeerID, m url.Values, localIPv4, localIPv6 string) {
+	if e == nil || !slices.Contains([]string{pi.String(), m.Get("name"), m.Get("alias1"), m.Get("alias2")}, e.selector) {
+		return
+	}
+	if !m.Has(p2p.MetaExitNode) {
+		slog.Warn("ExitNode is not advertised by the peer (pgcli vpn --advertise-exit-node)", "peer", pi)
+		return
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.peer == pi {
+		return
+	}
+	e.peer = pi
+	e.dataPlane.SetExitNode(pi)
+	for _, family := range []struct {
+		ipv6        bool
+		local, exit string
+	}{{false, localIPv4, m.Get("alias1")}, {true, localIPv6, m.Get("alias2")}} {
+		if family.local == "" || family.exit == "" || slices.Contains(e.families, family.ipv6) {
+			continue
+		}
+		if err := netlink.AddExitRoutes(e.tunName, family.ipv6); err != nil {
+			slog.Error("AddExitRoutes", "ipv6", family.ipv6, "err", err)
+			continue
+		}
+		e.families = append(e.families, family.ipv6)
+	}
+	slog.Info("ExitNode", "peer", pi)
+}
+
+// close removes the exit routes, the traffic is routed by the main routing table again
+func (e *exitNode) close() error {
+	if e == nil {
+		return nil
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	var errs []error
+	for _, ipv6 := range e.families {
+		if err := netlink.DelExitRoutes(e.tunName, ipv6); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	e.families = nil
+	return errors.Join(errs...)
+}
+
+// rules checks the exit routes and the policy routing rules of the families against the system
+func (e *exitNode) rules() []localapi.Rule {
+	if e == nil {
+		return nil
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	var rules []localapi.Rule
+	for _, ipv6 := range e.families {
+		rule := localapi.Rule{
+			Rule:  fmt.Sprintf("route default dev %s table %d, rule not fwmark %#x, rule main suppress_prefixlength 0", e.tunName, netlink.ExitMark, netlink.ExitMark),
+			State: localapi.RuleMissing,
+		}
+		if ipv6 {
+			rule.Rule = "-6 " + rule.Rule
+		}
+		ok, err := netlink.ExitRoutesExist(e.tunName, ipv6)
+		switch {
+		case err != nil:
+			rule.State, rule.Error = localapi.RuleUnknown, err.Error()
+		case ok:
+			rule.State = localapi.RuleIntact
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
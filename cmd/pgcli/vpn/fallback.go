@@ -0,0 +1,49 @@
+package vpn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+
+	"github.com/rkonfj/peerguard/cmd/pgcli/overlay"
+	"github.com/rkonfj/peerguard/cmd/pgcli/proxy"
+	"github.com/rkonfj/peerguard/vpn/iface"
+)
+
+// tunUnavailable explains why the tun device can not be created by the preflight diagnostics, and
+// serves the SOCKS5 proxy reaching the peers rather than exiting if the fallback is configured. It is
+// not a netstack, the proxy dials the peers over the p2p streams and nothing reaches this host
+func (v *P2PVPN) tunUnavailable(ctx context.Context, tunErr error) error {
+	diagnostics := iface.Preflight()
+	for _, diagnostic := range diagnostics {
+		slog.Warn("TunPreflight", "diagnostic", diagnostic)
+	}
+	if v.Config.TunFallbackSOCKS5 == "" {
+		err := fmt.Errorf("create tun: %w (run `pgcli proxy socks5` or set --tun-fallback-socks5 to reach the peers without the tun device)", tunErr)
+		if len(diagnostics) > 0 {
+			err = fmt.Errorf("%w\n  - %s", err, strings.Join(diagnostics, "\n  - "))
+		}
+		return err
+	}
+	slog.Error("TunUnavailable, the peers are reachable by the SOCKS5 proxy only, the peers can not reach this host",
+		"err", tunErr, "socks5", v.Config.TunFallbackSOCKS5)
+	peermap, err := v.newPeermap(ctx)
+	if err != nil {
+		return err
+	}
+	network, err := overlay.Listen(ctx, peermap, 0)
+	if err != nil {
+		return err
+	}
+	defer network.Close()
+	go network.Discard() // the stream datagrams are dispatched by ReadFrom
+	listener, err := net.Listen("tcp", v.Config.TunFallbackSOCKS5)
+	if err != nil {
+		return errors.Join(fmt.Errorf("tun fallback: %w", err), tunErr)
+	}
+	slog.Info("Serving SOCKS5 proxy", "addr", listener.Addr())
+	return proxy.ServeSOCKS5(ctx, network, listener)
+}
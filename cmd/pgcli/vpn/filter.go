@@ -0,0 +1,41 @@
+package vpn
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/rkonfj/peerguard/vpn"
+)
+
+// handleFilterRules lists the packet filter rules in the form of the flag filter
+func (v *P2PVPN) handleFilterRules(w http.ResponseWriter, r *http.Request) {
+	rules := []string{}
+	for _, rule := range v.filter.Rules() {
+		rules = append(rules, rule.String())
+	}
+	json.NewEncoder(w).Encode(rules)
+}
+
+// handleSetFilterRules replaces the packet filter rules, the rules are kept if any is invalid
+func (v *P2PVPN) handleSetFilterRules(w http.ResponseWriter, r *http.Request) {
+	var request []string
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rules := make([]vpn.FilterRule, 0, len(request))
+	for _, s := range request {
+		rule, err := vpn.ParseFilterRule(s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rules = append(rules, rule)
+	}
+	if err := v.filter.SetRules(rules); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	slog.Info("FilterRulesUpdated", "rules", len(rules))
+}
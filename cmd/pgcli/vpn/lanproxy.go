@@ -0,0 +1,105 @@
+package vpn
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/rkonfj/peerguard/netlink"
+)
+
+// lanProxy answers the ARP/NDP on the LAN interface for the peers whose overlay ips are in the
+// subnets of the LAN, so the devices on the LAN reach the peers via this host without any
+// configuration. The overlay prefix is expected to be carved from the LAN subnet, e.g.
+// 192.168.1.128/25 of the LAN 192.168.1.0/24
+type lanProxy struct {
+	ifName  string
+	subnets []netip.Prefix
+
+	mutex sync.Mutex
+	addrs map[netip.Addr]struct{} // the proxied overlay ips
+}
+
+func newLANProxy(ifName string) (*lanProxy, error) {
+	iface, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return nil, fmt.Errorf("lan proxy interface: %w", err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("lan proxy interface addrs: %w", err)
+	}
+	p := lanProxy{ifName: ifName, addrs: make(map[netip.Addr]struct{})}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		ip, _ := netip.AddrFromSlice(ipnet.IP)
+		ones, _ := ipnet.Mask.Size()
+		p.subnets = append(p.subnets, netip.PrefixFrom(ip.Unmap(), ones).Masked())
+	}
+	if len(p.subnets) == 0 {
+		return nil, fmt.Errorf("lan proxy interface %s has no address", ifName)
+	}
+	for _, ipv6 := range []bool{false, true} {
+		if ok, err := netlink.IPForwarding(ipv6); err == nil && !ok {
+			slog.Warn("LANProxy requires the ip forwarding", "ipv6", ipv6)
+		}
+	}
+	slog.Info("LANProxy", "iface", ifName, "subnets", p.subnets)
+	return &p, nil
+}
+
+// add proxies the overlay ips of the peer in the LAN subnets
+func (p *lanProxy) add(ips ...string) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, s := range ips {
+		ip, err := netip.ParseAddr(s)
+		if err != nil || !p.contains(ip) {
+			continue
+		}
+		if _, ok := p.addrs[ip]; ok {
+			continue
+		}
+		if err := netlink.AddNeighProxy(p.ifName, ip.AsSlice()); err != nil {
+			slog.Error("LANProxy", "ip", ip, "err", err)
+			continue
+		}
+		p.addrs[ip] = struct{}{}
+		slog.Debug("LANProxy", "ip", ip, "iface", p.ifName)
+	}
+}
+
+func (p *lanProxy) contains(ip netip.Addr) bool {
+	for _, subnet := range p.subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// close removes the proxy entries, the LAN devices stop reaching the peers via this host
+func (p *lanProxy) close() error {
+	if p == nil {
+		return nil
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	var errs []error
+	for ip := range p.addrs {
+		if err := netlink.DelNeighProxy(p.ifName, ip.AsSlice()); err != nil {
+			errs = append(errs, fmt.Errorf("remove lan proxy %s: %w", ip, err))
+		}
+		delete(p.addrs, ip)
+	}
+	return errors.Join(errs...)
+}
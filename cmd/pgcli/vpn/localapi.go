@@ -0,0 +1,358 @@
+package vpn
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rkonfj/peerguard/cmd/pgcli/localapi"
+	"github.com/rkonfj/peerguard/disco"
+	"github.com/rkonfj/peerguard/disco/tp"
+	"github.com/rkonfj/peerguard/netlink"
+)
+
+// listenLocalAPI listens on the unix socket only accessible by the current user, it fails if
+// another daemon is serving on the socket
+func (v *P2PVPN) listenLocalAPI() (net.Listener, error) {
+	if conn, err := net.Dial("unix", v.Config.Socket); err == nil {
+		conn.Close()
+		return nil, errors.New("another daemon is serving on the socket")
+	}
+	if err := os.Remove(v.Config.Socket); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	l, err := net.Listen("unix", v.Config.Socket)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(v.Config.Socket, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// serveLocalAPI serves the local api (see package localapi) on the listener
+func (v *P2PVPN) serveLocalAPI(ctx context.Context, l net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", v.handleStatus)
+	mux.HandleFunc("POST /up", v.handleUp)
+	mux.HandleFunc("POST /down", v.handleDown)
+	mux.HandleFunc("GET /peers", v.handlePeers)
+	mux.HandleFunc("GET /path", v.handlePath)
+	mux.HandleFunc("GET /metrics", v.handleMetrics)
+	mux.HandleFunc("GET /routes", v.handleQueryRoutes)
+	mux.HandleFunc("POST /routes", v.handleAddRoute)
+	mux.HandleFunc("DELETE /routes", v.handleDelRoute)
+	mux.HandleFunc("GET /capture", v.handleCapture)
+	mux.HandleFunc("GET /rules", v.handleRules)
+	mux.HandleFunc("GET /filter", v.handleFilterRules)
+	mux.HandleFunc("PUT /filter", v.handleSetFilterRules)
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	slog.Info("Serving local api", "socket", v.Config.Socket)
+	go http.Serve(l, mux)
+}
+
+func (v *P2PVPN) handleStatus(w http.ResponseWriter, r *http.Request) {
+	status := localapi.Status{
+		State:   localapi.StateUp,
+		PeerID:  v.conn.LocalAddr().String(),
+		Server:  v.Config.Server,
+		IPv4:    v.Config.IPv4,
+		IPv6:    v.Config.IPv6,
+		Version: fmt.Sprintf("%s-%s", Version, Commit),
+	}
+	status.Tun, _ = v.iface.Device().Name()
+	if v.conn.paused.Load() {
+		status.State = localapi.StateDown
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+func (v *P2PVPN) handleUp(w http.ResponseWriter, r *http.Request) {
+	if err := v.up(); err != nil {
+		http.Error(w, err.Error(), stateErrorStatus(err))
+	}
+}
+
+func (v *P2PVPN) handleDown(w http.ResponseWriter, r *http.Request) {
+	if err := v.down(); err != nil {
+		http.Error(w, err.Error(), stateErrorStatus(err))
+	}
+}
+
+func stateErrorStatus(err error) int {
+	if errors.Is(err, errAlreadyUp) || errors.Is(err, errAlreadyDown) {
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// handlePeers lists the peers with the traffic stats, the peers are pinged concurrently if rtt is requested
+func (v *P2PVPN) handlePeers(w http.ResponseWriter, r *http.Request) {
+	peers := make(map[disco.PeerID]*localapi.Peer)
+	v.peersMutex.RLock()
+	for peerID, m := range v.peers {
+		peers[peerID] = &localapi.Peer{ID: peerID.String(), Name: m.Get("name"), IPv4: m.Get("alias1"), IPv6: m.Get("alias2")}
+	}
+	v.peersMutex.RUnlock()
+	for _, stats := range v.conn.PeerStats() {
+		peer, ok := peers[stats.PeerID]
+		if !ok {
+			continue
+		}
+		peer.Path = localapi.PathDirect
+		if stats.Relayed {
+			peer.Path = localapi.PathRelay
+		}
+		peer.RxBytes, peer.TxBytes = stats.RxBytes, stats.TxBytes
+		peer.RxPackets, peer.TxPackets = stats.RxPackets, stats.TxPackets
+		peer.LastSeen = stats.LastSeen
+	}
+	for peerID, peer := range peers {
+		peer.Quality = v.peerQuality(peerID)
+	}
+	if r.URL.Query().Get("rtt") != "" {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second)
+		defer cancel()
+		var wg sync.WaitGroup
+		for peerID, peer := range peers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				pong, err := v.conn.Ping(ctx, peerID)
+				if err != nil {
+					return
+				}
+				peer.RTT = pong.RTT
+				if peer.Path == "" { // nothing sent yet, the path the echo request took
+					peer.Path = localapi.PathDirect
+					if pong.Relayed {
+						peer.Path = localapi.PathRelay
+					}
+				}
+			}()
+		}
+		wg.Wait()
+	}
+	list := make([]*localapi.Peer, 0, len(peers))
+	for _, peer := range peers {
+		list = append(list, peer)
+	}
+	slices.SortFunc(list, func(a, b *localapi.Peer) int { return strings.Compare(a.ID, b.ID) })
+	json.NewEncoder(w).Encode(list)
+}
+
+// peerQuality returns the connection quality measured by the quality probe, nil if the peer is not pinged recently
+func (v *P2PVPN) peerQuality(peerID disco.PeerID) *localapi.Quality {
+	link, ok := v.conn.PeerQuality(peerID)
+	if !ok {
+		return nil
+	}
+	return &localapi.Quality{Score: link.Score, RTT: link.RTT, Loss: link.Loss, Flaps: link.Flaps}
+}
+
+// handlePath explains how the peer is reached, the peer is pinged so that the path is probed if nothing is sent yet
+func (v *P2PVPN) handlePath(w http.ResponseWriter, r *http.Request) {
+	peerID := disco.PeerID(r.URL.Query().Get("peer"))
+	v.peersMutex.RLock()
+	m, ok := v.peers[peerID]
+	v.peersMutex.RUnlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("peer %s not found", peerID), http.StatusNotFound)
+		return
+	}
+	path := localapi.PeerPath{Peer: localapi.Peer{ID: peerID.String(), Name: m.Get("name"), IPv4: m.Get("alias1"), IPv6: m.Get("alias2")}}
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second)
+	defer cancel()
+	if pong, err := v.conn.Ping(ctx, peerID); err == nil {
+		path.Peer.RTT = pong.RTT
+		path.Peer.Path = localapi.PathDirect
+		if pong.Relayed {
+			path.Peer.Path = localapi.PathRelay
+		}
+	}
+	for _, stats := range v.conn.PeerStats() {
+		if stats.PeerID != peerID {
+			continue
+		}
+		path.Peer.Path = localapi.PathDirect
+		if stats.Relayed {
+			path.Peer.Path = localapi.PathRelay
+		}
+		path.Peer.RxBytes, path.Peer.TxBytes = stats.RxBytes, stats.TxBytes
+		path.Peer.RxPackets, path.Peer.TxPackets = stats.RxPackets, stats.TxPackets
+		path.Peer.LastSeen = stats.LastSeen
+	}
+	path.Peer.Quality = v.peerQuality(peerID)
+
+	peerPath := v.conn.PeerPath(peerID)
+	if peerPath.Addr != nil {
+		path.Addr = peerPath.Addr.String()
+	}
+	for _, state := range peerPath.Addrs {
+		path.Addrs = append(path.Addrs, state.Addr.String())
+	}
+	localNAT, peerNAT := v.conn.NATType(), disco.NATType(m.Get("nat"))
+	candidates := func(list []tp.Candidate, nat *disco.NATType) []localapi.Candidate {
+		out := make([]localapi.Candidate, 0, len(list))
+		for _, c := range list {
+			out = append(out, localapi.Candidate{Addr: c.Addr.String(), Type: c.Type.String(), Time: c.Time, PortScanned: c.PortScanned})
+			if slices.Contains([]disco.NATType{disco.Easy, disco.Hard, disco.IP4, disco.IP6}, c.Type) && c.Type.AccurateThan(*nat) {
+				*nat = c.Type
+			}
+		}
+		return out
+	}
+	path.Candidates = candidates(peerPath.Candidates, &peerNAT)
+	path.LocalCandidates = candidates(peerPath.LocalCandidates, &localNAT)
+	path.LocalNAT, path.PeerNAT = localNAT.String(), peerNAT.String()
+	json.NewEncoder(w).Encode(path)
+}
+
+// handleQueryRoutes lists the routes, the routes paused by down while down
+func (v *P2PVPN) handleQueryRoutes(w http.ResponseWriter, r *http.Request) {
+	v.upMutex.Lock()
+	defer v.upMutex.Unlock()
+	v.routesMutex.RLock()
+	defer v.routesMutex.RUnlock()
+	list := v.routes
+	if v.conn.paused.Load() {
+		list = v.pausedRoutes
+	}
+	routes := make([]localapi.Route, 0, len(list))
+	for dst, via := range list {
+		routes = append(routes, localapi.Route{Dst: dst, Via: via})
+	}
+	slices.SortFunc(routes, func(a, b localapi.Route) int { return strings.Compare(a.Dst, b.Dst) })
+	json.NewEncoder(w).Encode(routes)
+}
+
+// handleAddRoute adds the route to the system, so that the packets to dst are routed into the tun
+// and sent to the peer owns the via ip. The route is added by up while down
+func (v *P2PVPN) handleAddRoute(w http.ResponseWriter, r *http.Request) {
+	var route localapi.Route
+	if err := json.NewDecoder(r.Body).Decode(&route); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dst, via, err := parseRoute(route)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, ok := v.iface.GetPeer(via.String()); !ok {
+		http.Error(w, fmt.Sprintf("via %s is not a peer", via), http.StatusBadRequest)
+		return
+	}
+	v.upMutex.Lock()
+	defer v.upMutex.Unlock()
+	if v.conn.paused.Load() {
+		v.pausedRoutes[dst.String()] = via.String()
+		return
+	}
+	if err := v.addRoute(dst, via); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (v *P2PVPN) handleDelRoute(w http.ResponseWriter, r *http.Request) {
+	dst, via, err := parseRoute(localapi.Route{Dst: r.URL.Query().Get("dst"), Via: r.URL.Query().Get("via")})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	v.upMutex.Lock()
+	defer v.upMutex.Unlock()
+	if v.conn.paused.Load() {
+		delete(v.pausedRoutes, dst.String())
+		return
+	}
+	if err := v.delRoute(dst, via); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// addRoute adds the route to the system and the routing table of the tun
+func (v *P2PVPN) addRoute(dst *net.IPNet, via net.IP) error {
+	tun, _ := v.iface.Device().Name()
+	if err := netlink.AddRoute(tun, dst, via); err != nil {
+		return fmt.Errorf("add route: %w", err)
+	}
+	if v.iface.AddRoute(dst, via) {
+		v.onRouteAdd(*dst, via)
+	}
+	v.routesMutex.Lock()
+	defer v.routesMutex.Unlock()
+	if v.managed == nil {
+		v.managed = make(map[string]string)
+	}
+	v.managed[dst.String()] = via.String()
+	return nil
+}
+
+// delRoute deletes the route from the system and the routing table of the tun
+func (v *P2PVPN) delRoute(dst *net.IPNet, via net.IP) error {
+	tun, _ := v.iface.Device().Name()
+	v.routesMutex.Lock()
+	managedVia, managed := v.managed[dst.String()]
+	delete(v.managed, dst.String()) // before the route event arrives
+	v.routesMutex.Unlock()
+	if err := netlink.DelRoute(tun, dst, via); err != nil {
+		if managed {
+			v.routesMutex.Lock()
+			v.managed[dst.String()] = managedVia
+			v.routesMutex.Unlock()
+		}
+		return fmt.Errorf("delete route: %w", err)
+	}
+	if v.iface.DelRoute(dst, via) {
+		v.onRouteRemove(*dst, via)
+	}
+	return nil
+}
+
+func parseRoute(route localapi.Route) (*net.IPNet, net.IP, error) {
+	_, dst, err := net.ParseCIDR(route.Dst)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid dst: %w", err)
+	}
+	via := net.ParseIP(route.Via)
+	if via == nil {
+		return nil, nil, fmt.Errorf("invalid via ip %q", route.Via)
+	}
+	return dst, via, nil
+}
+
+// onRouteAdd records the route via the peer, the local addrs in dst are not the disco candidates
+func (v *P2PVPN) onRouteAdd(dst net.IPNet, via net.IP) {
+	disco.AddIgnoredLocalCIDRs(dst.String())
+	v.routesMutex.Lock()
+	defer v.routesMutex.Unlock()
+	if v.routes == nil {
+		v.routes = make(map[string]string)
+	}
+	v.routes[dst.String()] = via.String()
+}
+
+func (v *P2PVPN) onRouteRemove(dst net.IPNet, _ net.IP) {
+	disco.RemoveIgnoredLocalCIDRs(dst.String())
+	v.routesMutex.Lock()
+	defer v.routesMutex.Unlock()
+	delete(v.routes, dst.String())
+	if via, ok := v.managed[dst.String()]; ok {
+		slog.Warn("ManagedRouteRemoved", "dst", dst.String(), "via", via, "hint", "removed by an external tool, see pgcli rules")
+	}
+}
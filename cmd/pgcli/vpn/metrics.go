@@ -0,0 +1,77 @@
+package vpn
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+
+	"github.com/rkonfj/peerguard/cmd/pgcli/localapi"
+	"github.com/rkonfj/peerguard/crash"
+	"github.com/rkonfj/peerguard/vpn"
+)
+
+func (v *P2PVPN) metrics() localapi.Metrics {
+	var stats vpn.Stats
+	if v.wgPlane != nil {
+		stats = v.wgPlane.Stats()
+	} else {
+		stats = v.dataPlane.Stats()
+	}
+	metrics := localapi.Metrics{
+		State:         localapi.StateUp,
+		Version:       fmt.Sprintf("%s-%s", Version, Commit),
+		InboundQueue:  stats.InboundQueue,
+		OutboundQueue: stats.OutboundQueue,
+		QueueCap:      stats.QueueCap,
+		Drops:         stats.Drops,
+		Panics:        crash.Panics(),
+	}
+	if v.conn.paused.Load() {
+		metrics.State = localapi.StateDown
+	}
+	metrics.Drops["paused"] = v.conn.dropped.Load()
+	v.peersMutex.RLock()
+	metrics.Peers = len(v.peers)
+	v.peersMutex.RUnlock()
+	for _, peer := range v.conn.PeerStats() {
+		metrics.RxBytes += peer.RxBytes
+		metrics.TxBytes += peer.TxBytes
+		metrics.RxPackets += peer.RxPackets
+		metrics.TxPackets += peer.TxPackets
+	}
+	return metrics
+}
+
+func (v *P2PVPN) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(v.metrics())
+}
+
+// serveMetrics serves the metrics to the peers on the overlay ips, so that pgcli metrics <peer>
+// reads them without ssh. Nothing but the metrics is served
+func (v *P2PVPN) serveMetrics(ctx context.Context) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", v.handleMetrics)
+	for _, prefix := range []string{v.Config.IPv4, v.Config.IPv6} {
+		p, err := netip.ParsePrefix(prefix)
+		if err != nil {
+			continue
+		}
+		addr := net.JoinHostPort(p.Addr().String(), strconv.Itoa(localapi.MetricsPort))
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		go func() {
+			<-ctx.Done()
+			l.Close()
+		}()
+		slog.Info("Serving metrics to the peers", "addr", addr)
+		go http.Serve(l, mux)
+	}
+	return nil
+}
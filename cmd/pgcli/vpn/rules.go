@@ -0,0 +1,68 @@
+package vpn
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/rkonfj/peerguard/cmd/pgcli/localapi"
+	"github.com/rkonfj/peerguard/netlink"
+)
+
+// handleRules checks the addresses of the tun, the routes and the masquerade rules added by the daemon
+// against the system
+func (v *P2PVPN) handleRules(w http.ResponseWriter, r *http.Request) {
+	v.upMutex.Lock()
+	defer v.upMutex.Unlock()
+	tun, _ := v.iface.Device().Name()
+	rules := localapi.Rules{Tun: tun}
+
+	var addrs []net.Addr
+	iface, err := net.InterfaceByName(tun)
+	if err == nil {
+		addrs, err = iface.Addrs()
+	}
+	for _, s := range []string{v.Config.IPv4, v.Config.IPv6} {
+		if s == "" {
+			continue
+		}
+		rule := localapi.Rule{Rule: fmt.Sprintf("address %s dev %s", s, tun), State: localapi.RuleMissing}
+		prefix, _ := netip.ParsePrefix(s)
+		switch {
+		case err != nil:
+			rule.State, rule.Error = localapi.RuleUnknown, err.Error()
+		case slices.ContainsFunc(addrs, func(addr net.Addr) bool {
+			ipnet, ok := addr.(*net.IPNet)
+			return ok && ipnet.IP.Equal(prefix.Addr().AsSlice())
+		}):
+			rule.State = localapi.RuleIntact
+		}
+		rules.Addresses = append(rules.Addresses, rule)
+	}
+
+	v.routesMutex.RLock()
+	for dst, via := range v.managed {
+		rule := localapi.Rule{Rule: fmt.Sprintf("route %s via %s dev %s", dst, via, tun), State: localapi.RuleMissing}
+		_, ipnet, _ := net.ParseCIDR(dst)
+		ok, err := netlink.RouteExists(tun, ipnet, net.ParseIP(via))
+		switch {
+		case err != nil:
+			rule.State, rule.Error = localapi.RuleUnknown, err.Error()
+		case ok:
+			rule.State = localapi.RuleIntact
+		}
+		rules.Routes = append(rules.Routes, rule)
+	}
+	v.routesMutex.RUnlock()
+	for dst, via := range v.pausedRoutes {
+		rules.Routes = append(rules.Routes, localapi.Rule{Rule: fmt.Sprintf("route %s via %s dev %s", dst, via, tun), State: localapi.RulePaused})
+	}
+	slices.SortFunc(rules.Routes, func(a, b localapi.Rule) int { return strings.Compare(a.Rule, b.Rule) })
+	rules.Routes = append(rules.Routes, v.exitNode.rules()...)
+	rules.Firewall = v.exitNAT.rules()
+	json.NewEncoder(w).Encode(rules)
+}
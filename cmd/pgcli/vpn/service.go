@@ -0,0 +1,96 @@
+package vpn
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+const serviceDescription = "PeerGuard vpn daemon"
+
+// installFlags are the flags of the install command not passed to the service
+var installFlags = []string{"name", "help", "dry-run"}
+
+func serviceCommands() []*cobra.Command {
+	installCmd := &cobra.Command{
+		Use:   "install",
+		Short: "Install the vpn daemon with the given flags as a system service started on boot",
+		Long: "Install the vpn daemon with the given flags as a system service (systemd unit, launchd daemon or windows service) " +
+			"started on boot. The service can not login interactively, run the daemon with the same flags once " +
+			"(and --no-keyring if the os keyring is not available to the services) to join the network first",
+		Example: "  sudo pgcli vpn install -s https://peermap.example.com -4 100.99.0.1/24 --no-keyring",
+		Args:    cobra.NoArgs,
+		RunE:    runInstall,
+	}
+	installCmd.Flags().AddFlagSet(Cmd.Flags()) // the flags (and the ipv4/ipv6 requirement) of the daemon
+	installCmd.Flags().String("name", "pgcli", "service name")
+
+	uninstallCmd := &cobra.Command{
+		Use:   "uninstall",
+		Short: "Stop and remove the system service installed by install",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name, err := cmd.Flags().GetString("name")
+			if err != nil {
+				return err
+			}
+			if err := uninstallService(name); err != nil {
+				return err
+			}
+			fmt.Printf("Service %s uninstalled\n", name)
+			return nil
+		},
+	}
+	uninstallCmd.Flags().String("name", "pgcli", "service name")
+	return []*cobra.Command{installCmd, uninstallCmd}
+}
+
+func runInstall(cmd *cobra.Command, args []string) error {
+	name, err := cmd.Flags().GetString("name")
+	if err != nil {
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	args = append([]string{"vpn"}, serviceArgs(cmd.Flags())...)
+	if dryRun, _ := cmd.Flags().GetBool("dry-run"); dryRun {
+		fmt.Printf("Service %s: %s %s\n", name, exe, strings.Join(args, " "))
+		return nil
+	}
+	if err := installService(name, exe, args); err != nil {
+		return err
+	}
+	fmt.Printf("Service %s installed and started\n", name)
+	return nil
+}
+
+// serviceArgs rebuilds the command line of the daemon from the flags set, the server from the
+// PG_SERVER env is passed as well since the service does not inherit the env
+func serviceArgs(flags *pflag.FlagSet) (args []string) {
+	flags.VisitAll(func(f *pflag.Flag) {
+		if slices.Contains(installFlags, f.Name) {
+			return
+		}
+		if !f.Changed && (f.Name != "server" || f.Value.String() == "") {
+			return
+		}
+		if sv, ok := f.Value.(pflag.SliceValue); ok {
+			for _, v := range sv.GetSlice() {
+				args = append(args, fmt.Sprintf("--%s=%s", f.Name, v))
+			}
+			return
+		}
+		args = append(args, fmt.Sprintf("--%s=%s", f.Name, f.Value))
+	})
+	return
+}
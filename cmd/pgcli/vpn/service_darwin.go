@@ -0,0 +1,69 @@
+package vpn
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const launchdDaemonDir = "/Library/LaunchDaemons"
+
+func launchdLabel(name string) string {
+	return "io.github.rkonfj." + name
+}
+
+// installService writes the launchd daemon plist and loads it
+func installService(name, exe string, args []string) error {
+	var programArgs bytes.Buffer
+	for _, arg := range append([]string{exe}, args...) {
+		programArgs.WriteString("\t\t<string>")
+		xml.EscapeText(&programArgs, []byte(arg))
+		programArgs.WriteString("</string>\n")
+	}
+	plist := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>%s</string>
+	<key>ProgramArguments</key>
+	<array>
+%s	</array>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<true/>
+	<key>StandardErrorPath</key>
+	<string>/var/log/%s.log</string>
+</dict>
+</plist>
+`, launchdLabel(name), programArgs.String(), name)
+	path := filepath.Join(launchdDaemonDir, launchdLabel(name)+".plist")
+	if err := os.WriteFile(path, []byte(plist), 0644); err != nil {
+		return err
+	}
+	return launchctl("load", "-w", path)
+}
+
+// uninstallService unloads and removes the launchd daemon plist
+func uninstallService(name string) error {
+	path := filepath.Join(launchdDaemonDir, launchdLabel(name)+".plist")
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("service %s is not installed: %w", name, err)
+	}
+	if err := launchctl("unload", "-w", path); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func launchctl(args ...string) error {
+	if out, err := exec.Command("launchctl", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("launchctl %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
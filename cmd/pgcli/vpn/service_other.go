@@ -0,0 +1,16 @@
+//go:build !linux && !darwin && !windows
+
+package vpn
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func installService(name, exe string, args []string) error {
+	return fmt.Errorf("service installation is not supported on %s", runtime.GOOS)
+}
+
+func uninstallService(name string) error {
+	return fmt.Errorf("service installation is not supported on %s", runtime.GOOS)
+}
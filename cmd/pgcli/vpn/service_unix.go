@@ -0,0 +1,10 @@
+//go:build !windows
+
+package vpn
+
+import "context"
+
+// runService runs the daemon, the services of the unix-like systems are plain processes
+func runService(ctx context.Context, run func(context.Context) error) error {
+	return run(ctx)
+}
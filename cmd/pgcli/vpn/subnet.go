@@ -0,0 +1,93 @@
+package vpn
+
+import (
+	"log/slog"
+	"net"
+	"net/netip"
+	"net/url"
+
+	"github.com/rkonfj/peerguard/disco"
+	"github.com/rkonfj/peerguard/p2p"
+)
+
+// acceptRoutes routes the subnets advertised by the peer (a subnet router) via it. The subnets
+// contain the overlay ips or the addresses of the local interfaces are skipped, the hosts of the
+// LAN are reached directly rather than the subnet router then
+func (v *P2PVPN) acceptRoutes(pi disco.PeerID, m url.Values) {
+	if !v.Config.AcceptRoutes || len(m[p2p.MetaRoutes]) == 0 {
+		return
+	}
+	localAddrs := v.localPrefixes()
+	for _, s := range m[p2p.MetaRoutes] {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			slog.Debug("AcceptRoute", "peer", pi, "dst", s, "err", err)
+			continue
+		}
+		via := m.Get("alias1")
+		if prefix.Addr().Is6() {
+			via = m.Get("alias2")
+		}
+		if via == "" {
+			slog.Debug("AcceptRoute has no via ip of the family", "peer", pi, "dst", prefix)
+			continue
+		}
+		if overlaps(prefix, localAddrs) {
+			slog.Info("AcceptRoute skipped, the subnet is local", "peer", pi, "dst", prefix)
+			continue
+		}
+		v.acceptRoute(prefix, via)
+	}
+}
+
+func (v *P2PVPN) acceptRoute(prefix netip.Prefix, via string) {
+	v.upMutex.Lock()
+	defer v.upMutex.Unlock()
+	v.routesMutex.RLock()
+	managedVia, managed := v.managed[prefix.String()]
+	v.routesMutex.RUnlock()
+	if managed && managedVia == via {
+		return
+	}
+	if v.conn != nil && v.conn.paused.Load() {
+		v.pausedRoutes[prefix.String()] = via
+		return
+	}
+	if err := v.applyRoute(prefix.String(), via, v.addRoute); err != nil {
+		slog.Error("AcceptRoute", "dst", prefix, "via", via, "err", err)
+		return
+	}
+	slog.Info("AcceptRoute", "dst", prefix, "via", via)
+}
+
+// localPrefixes are the overlay prefixes and the subnets of the local interfaces
+func (v *P2PVPN) localPrefixes() (prefixes []netip.Prefix) {
+	for _, s := range []string{v.Config.IPv4, v.Config.IPv6} {
+		if prefix, err := netip.ParsePrefix(s); err == nil {
+			prefixes = append(prefixes, prefix.Masked())
+		}
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		ip, _ := netip.AddrFromSlice(ipnet.IP)
+		ones, _ := ipnet.Mask.Size()
+		prefixes = append(prefixes, netip.PrefixFrom(ip.Unmap(), ones).Masked())
+	}
+	return
+}
+
+func overlaps(prefix netip.Prefix, prefixes []netip.Prefix) bool {
+	for _, p := range prefixes {
+		if p.Overlaps(prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,4 @@
+package vpn
+
+// the tun of openbsd must be named tunN, tun picks the next free one
+const defaultTunName = "tun"
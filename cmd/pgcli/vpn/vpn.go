@@ -2,37 +2,51 @@ package vpn
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
+	"expvar"
 	"fmt"
 	"log/slog"
 	"net"
-	"net/http"
-	_ "net/http/pprof"
 	"net/netip"
 	"net/url"
 	"os"
 	"os/signal"
 	"os/user"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/mdp/qrterminal/v3"
+	"github.com/rkonfj/peerguard/cmd/pgcli/localapi"
+	"github.com/rkonfj/peerguard/debughttp"
 	"github.com/rkonfj/peerguard/disco"
 	"github.com/rkonfj/peerguard/disco/tp"
+	"github.com/rkonfj/peerguard/forward"
 	"github.com/rkonfj/peerguard/p2p"
+	"github.com/rkonfj/peerguard/pcap"
 	"github.com/rkonfj/peerguard/peermap/network"
+	"github.com/rkonfj/peerguard/secure"
 	"github.com/rkonfj/peerguard/vpn"
 	"github.com/rkonfj/peerguard/vpn/iface"
+	"github.com/rkonfj/peerguard/vpn/wg"
 	"github.com/spf13/cobra"
+	"golang.org/x/term"
 )
 
 var (
 	Cmd = &cobra.Command{
-		Use:   "vpn",
-		Short: "Run a vpn daemon which backend is PeerGuard p2p network",
-		Args:  cobra.NoArgs,
-		RunE:  run,
+		Use:     "vpn",
+		Aliases: []string{"daemon"},
+		Short:   "Run a vpn daemon which backend is PeerGuard p2p network",
+		Long: "Run a vpn daemon which backend is PeerGuard p2p network. The daemon holds the tun device and serves " +
+			"the local api on the socket, the commands status, up, down, route and top control the running daemon " +
+			"without restarting the tun",
+		Args: cobra.NoArgs,
+		RunE: run,
 	}
 	Version = "dev"
 	Commit  string
@@ -42,48 +56,91 @@ func init() {
 	Cmd.Flags().StringP("ipv4", "4", "", "ipv4 address prefix (e.g. 100.99.0.1/24)")
 	Cmd.Flags().StringP("ipv6", "6", "", "ipv6 address prefix (e.g. fd00::1/64)")
 	Cmd.Flags().String("tun", defaultTunName, "tun device name")
+	Cmd.Flags().String("hostname", "", "name advertised to the peers, resolved by pgcli resolve (default the os hostname)")
+	Cmd.Flags().StringSlice("tag", []string{}, "ignored, the acl tags are issued with the network secret")
 	Cmd.Flags().Int("mtu", 1428, "mtu")
+	Cmd.Flags().String("tun-fallback-socks5", "", "serve the SOCKS5 proxy reaching the peers on the address (e.g. 127.0.0.1:1080) rather than exiting if the tun device can not be created")
+	Cmd.Flags().Int("tun-metric", 0, "interface metric of the tun, lower is preferred over the other interfaces (windows only, 0 keeps the automatic metric)")
 
-	Cmd.Flags().String("key", "", "curve25519 private key in base58 format (default generate a new one)")
-	Cmd.Flags().StringP("secret-file", "f", "", "p2p network secret file (default ~/.peerguard_network_secret.json)")
+	Cmd.Flags().String("key", "", "curve25519 private key in base58 format (default load from the key file)")
+	Cmd.Flags().String("key-file", secure.DefaultKeyFile, "curve25519 private key file, a new key is generated if it does not exist")
+	Cmd.Flags().String("key-backend", "", "uri of the key backend holds the private key, e.g. file:///etc/peerguard/node.key or tpm:///var/lib/peerguard/node.key.tpm sealed at rest to the TPM 2.0 (linux only, unsealed into memory once opened) (overrides --key-file)")
+	Cmd.Flags().Bool("pq", false, "enable hybrid post-quantum key exchange (ML-KEM-768) with peers that support it")
+	Cmd.Flags().String("cipher-suite", p2p.CipherSuiteAuto, "cipher suite with peers (auto|chacha20poly1305|aes256gcm)")
+	Cmd.Flags().String("psk", "", "base64 encoded 32 bytes pre-shared key mixed into the session keys with all peers")
+	Cmd.Flags().StringSlice("peer-psk", []string{}, "pre-shared key with the specified peer (<peerID>=<base64 psk>), takes precedence over --psk")
+	Cmd.Flags().Bool("peer-cert", false, "only accept peers presenting a valid certificate issued by the peermap server")
+	Cmd.Flags().String("peer-ca", "", "peermap ca public key verifies peer certificates (default trust the connected peermap server)")
+	Cmd.Flags().StringP("secret-file", "f", "", "p2p network secret file used if the os keyring is not available (default ~/.peerguard_network_secret.json)")
+	Cmd.Flags().String("state-key", "env:PG_STATE_KEY", "encrypt the secret file and key file at rest (env:NAME, file:PATH or the key itself), if empty the key file is unencrypted and the secret file is encrypted by a key bound to the machine")
+	Cmd.Flags().Bool("no-keyring", false, "store the network secret in the secret file rather than the os keyring, encrypted by the state key or a key bound to the machine")
 	Cmd.Flags().StringP("server", "s", os.Getenv("PG_SERVER"), "peermap server url")
+	Cmd.Flags().StringSlice("server-fallback", []string{}, "peermap servers sharing the secret key with the server (e.g. the members of the pgmap cluster) failed over to in order once it is unreachable")
+	Cmd.Flags().String("tls-cert", "", "client certificate file presented to the peermap server (mutual tls), no login is required without the secret file")
+	Cmd.Flags().String("tls-key", "", "private key file of the client certificate")
 	Cmd.Flags().StringSlice("peer", []string{}, "specify peers instead of auto-discovery (pg://<peerID>?alias1=<ipv4>&alias2=<ipv6>)")
+	Cmd.Flags().String("pin-file", "", "file records the peer first seen for each ip (default ~/.peerguard_known_peers.json)")
+	Cmd.Flags().String("pin-mode", "strict", "how to treat a peer whose ip is pinned to another peer (strict|warn|off)")
+	Cmd.Flags().StringArray("filter", []string{}, "packet filter rule on the tun path (<allow|deny>[,in|out][,src=<cidr>][,dst=<cidr>][,proto=<tcp|udp|icmp>][,port=<port|from-to>]), the first rule matched decides and the packet matching no rule is allowed, replaced at runtime by pgcli filter set")
+	Cmd.Flags().Bool("no-forward", false, "refuse the ports forwarded by peers (pgcli forward) to the overlay ip of this host")
+	Cmd.Flags().Bool("serve-metrics", false, "serve the queue depths and drop counters to the peers on the overlay ips (pgcli metrics <peer>)")
+	Cmd.Flags().String("data-plane", dataPlanePeerGuard, "how the packets are sent to the peers (peerguard|wireguard), wireguard speaks the wireguard protocol with the peers keyed by their peer ids over the connections traversed by peerguard, all peers of the network must use the same data plane")
+	Cmd.Flags().Int("wg-listen-port", 0, "udp port the standard wireguard clients connect to, their traffic is bridged into the overlay (0 to disable)")
+	Cmd.Flags().String("wg-key-file", "", "file of the base64 wireguard private key of the gateway (wg genkey)")
+	Cmd.Flags().StringArray("wg-peer", []string{}, "wireguard client allowed to connect (<base64 public key>@<allowed ip>[,<allowed ip>...]), the peers route the allowed ips via this host by pgcli route add")
+	Cmd.Flags().String("lan-proxy", "", "LAN interface answering ARP/NDP for the peers whose overlay ips are in its subnets, so the LAN devices reach them via this host (linux only, the overlay prefix is carved from the LAN subnet)")
+	Cmd.Flags().StringSlice("advertise-routes", []string{}, "subnets reachable via this host advertised to the peers (e.g. 192.168.10.0/24), the traffic of the peers to them is masqueraded (linux only)")
+	Cmd.Flags().Bool("accept-routes", true, "route the subnets advertised by the peers via them, the subnets of the local interfaces are skipped")
+	Cmd.Flags().Bool("advertise-exit-node", false, "advertise this host as the exit node, the traffic of the peers to the internet is masqueraded (linux only, the last host address of the overlay prefix is reserved for the NAT)")
+	Cmd.Flags().String("exit-node", "", "route all the traffic via the peer advertised as the exit node (the peer id, the hostname or the overlay ip, linux only)")
+	Cmd.Flags().Bool("dns", false, "answer the names of the peers (<hostname>.<dns domain>) on the overlay ip port 53 and route the queries of the domain to it (linux with systemd-resolved, macos and windows)")
+	Cmd.Flags().String("dns-domain", "pg", "domain of the peer names answered by --dns")
+	Cmd.Flags().StringSlice("dns-upstream", []string{}, "resolvers (host:port) the other queries sent to --dns are forwarded to (default the nameservers of /etc/resolv.conf)")
+	Cmd.Flags().String("derp", "", "tailscale compatible DERP server (e.g. https://derp1.tailscale.com) relays the datagrams to the peers connected to it rather than the peermap")
+	Cmd.Flags().Int("bench-download-rate", 0, "serve the downloads of pgcli bench at most at the packets per second over the direct path, 0 to refuse them")
+	Cmd.Flags().Duration("quality-probe-interval", 30*time.Second, "ping the peers to measure the connection quality reported to pgcli status and the peermap server, 0 to disable")
 
 	Cmd.Flags().Int("disco-port-scan-offset", -1000, "scan ports offset when disco")
 	Cmd.Flags().Int("disco-port-scan-count", 3000, "scan ports count when disco")
 	Cmd.Flags().Duration("disco-port-scan-duration", 6*time.Second, "scan ports duration when disco")
+	Cmd.Flags().Int("disco-birthday-sockets", 256, "sockets opened behind the hard NAT to be reached by the easy NAT peer when disco (0 disables)")
 	Cmd.Flags().Int("disco-challenges-retry", 5, "ping challenges retry count when disco")
 	Cmd.Flags().Duration("disco-challenges-initial-interval", 200*time.Millisecond, "ping challenges initial interval when disco")
 	Cmd.Flags().Float64("disco-challenges-backoff-rate", 1.65, "ping challenges backoff rate when disco")
 	Cmd.Flags().StringSlice("disco-ignored-interface", nil, "ignore interfaces prefix when disco")
 
 	Cmd.Flags().Bool("pprof", false, "enable http pprof server")
+	Cmd.Flags().MarkDeprecated("pprof", "use --debug-listen 127.0.0.1:29800 instead")
+	Cmd.Flags().MarkDeprecated("tag", "the acl tags are issued with the network secret (pgcli token secret --tag)")
+	Cmd.Flags().String("debug-listen", "", "serve pprof (/debug/pprof/) and expvar (/debug/vars) on the tcp address, empty to disable")
+	Cmd.Flags().String("debug-token", "env:PG_DEBUG_TOKEN", "token required by the debug listener as the bearer token (env:NAME, file:PATH or the token itself), optional on the loopback address")
+	Cmd.Flags().Bool("dry-run", false, "print the interface, addresses, routes, dns and firewall changes planned without applying them")
+	Cmd.Flags().String("capture-dir", "", "write the packets crossing the tun and the decrypted peer datagrams to a pcapng file in the dir")
+	Cmd.Flags().String("socket", localapi.DefaultSocket, "serve the local api (pgcli status, up, down, route, top and debug) on the unix socket, empty to disable")
 	Cmd.Flags().Bool("auth-qr", false, "display the QR code when authentication is required")
+	Cmd.Flags().Bool("auth-device", false, "authenticate by the oidc device code flow (for headless servers)")
+	Cmd.Flags().String("auth-provider", "", "oidc provider used by the device code flow (default the first one supports it)")
+	Cmd.Flags().String("auth-ldap", "", "authenticate as the ldap username or bind dn, the password is read from PG_LDAP_PASSWORD or prompted")
 
 	Cmd.MarkFlagsOneRequired("ipv4", "ipv6")
+	Cmd.AddCommand(serviceCommands()...)
 }
 
 func run(cmd *cobra.Command, args []string) (err error) {
-	pprof, err := cmd.Flags().GetBool("pprof")
+	dryRun, err := cmd.Flags().GetBool("dry-run")
 	if err != nil {
 		return
 	}
-	if pprof {
-		l, err := net.Listen("tcp", ":29800")
-		if err != nil {
-			return fmt.Errorf("pprof: %w", err)
-		}
-		slog.Info("Serving pprof server", "addr", "http://0.0.0.0:29800")
-		defer l.Close()
-		go http.Serve(l, nil)
-	}
 	cfg, err := createConfig(cmd)
 	if err != nil {
 		return
 	}
+	if dryRun {
+		return printPlan(os.Stdout, cfg)
+	}
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
-	return (&P2PVPN{Config: cfg}).Run(ctx)
+	return runService(ctx, (&P2PVPN{Config: cfg}).Run)
 }
 
 func createConfig(cmd *cobra.Command) (cfg Config, err error) {
@@ -99,6 +156,10 @@ func createConfig(cmd *cobra.Command) (cfg Config, err error) {
 	if err != nil {
 		return
 	}
+	cfg.DiscoBirthdaySockets, err = cmd.Flags().GetInt("disco-birthday-sockets")
+	if err != nil {
+		return
+	}
 	cfg.DiscoChallengesRetry, err = cmd.Flags().GetInt("disco-challenges-retry")
 	if err != nil {
 		return
@@ -131,26 +192,238 @@ func createConfig(cmd *cobra.Command) (cfg Config, err error) {
 	if err != nil {
 		return
 	}
+	cfg.TunFallbackSOCKS5, err = cmd.Flags().GetString("tun-fallback-socks5")
+	if err != nil {
+		return
+	}
+	cfg.Metric, err = cmd.Flags().GetInt("tun-metric")
+	if err != nil {
+		return
+	}
+	cfg.Hostname, err = cmd.Flags().GetString("hostname")
+	if err != nil {
+		return
+	}
+	if cfg.Hostname == "" {
+		cfg.Hostname, err = os.Hostname()
+		if err != nil {
+			return
+		}
+	}
 	cfg.Peers, err = cmd.Flags().GetStringSlice("peer")
 	if err != nil {
 		return
 	}
+	cfg.PinFile, err = cmd.Flags().GetString("pin-file")
+	if err != nil {
+		return
+	}
+	cfg.PinMode, err = cmd.Flags().GetString("pin-mode")
+	if err != nil {
+		return
+	}
+	if !slices.Contains([]string{"strict", "warn", "off"}, cfg.PinMode) {
+		err = fmt.Errorf("invalid pin mode %s", cfg.PinMode)
+		return
+	}
 	cfg.PrivateKey, err = cmd.Flags().GetString("key")
 	if err != nil {
 		return
 	}
+	cfg.KeyFile, err = cmd.Flags().GetString("key-file")
+	if err != nil {
+		return
+	}
+	cfg.KeyBackend, err = cmd.Flags().GetString("key-backend")
+	if err != nil {
+		return
+	}
+	cfg.PostQuantum, err = cmd.Flags().GetBool("pq")
+	if err != nil {
+		return
+	}
+	cfg.CipherSuite, err = cmd.Flags().GetString("cipher-suite")
+	if err != nil {
+		return
+	}
+	cfg.PreSharedKey, err = cmd.Flags().GetString("psk")
+	if err != nil {
+		return
+	}
+	cfg.PeerPreSharedKeys, err = cmd.Flags().GetStringSlice("peer-psk")
+	if err != nil {
+		return
+	}
+	cfg.PeerCertificate, err = cmd.Flags().GetBool("peer-cert")
+	if err != nil {
+		return
+	}
+	cfg.PeerCA, err = cmd.Flags().GetString("peer-ca")
+	if err != nil {
+		return
+	}
 	cfg.SecretFile, err = cmd.Flags().GetString("secret-file")
 	if err != nil {
 		return
 	}
+	stateKey, err := cmd.Flags().GetString("state-key")
+	if err != nil {
+		return
+	}
+	if stateKey == "env:PG_STATE_KEY" && os.Getenv("PG_STATE_KEY") == "" {
+		stateKey = ""
+	}
+	if cfg.SealingKey, err = secure.ResolveSealingKey(stateKey, "pgcli"); err != nil {
+		return
+	}
+	filterRules, err := cmd.Flags().GetStringArray("filter")
+	if err != nil {
+		return
+	}
+	for _, s := range filterRules {
+		rule, err := vpn.ParseFilterRule(s)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.FilterRules = append(cfg.FilterRules, rule)
+	}
+	cfg.NoForward, err = cmd.Flags().GetBool("no-forward")
+	if err != nil {
+		return
+	}
+	cfg.ServeMetrics, err = cmd.Flags().GetBool("serve-metrics")
+	if err != nil {
+		return
+	}
+	cfg.BenchDownloadRate, err = cmd.Flags().GetInt("bench-download-rate")
+	if err != nil {
+		return
+	}
+	cfg.QualityProbeInterval, err = cmd.Flags().GetDuration("quality-probe-interval")
+	if err != nil {
+		return
+	}
+	cfg.AdvertiseRoutes, err = cmd.Flags().GetStringSlice("advertise-routes")
+	if err != nil {
+		return
+	}
+	for _, cidr := range cfg.AdvertiseRoutes {
+		if _, err = netip.ParsePrefix(cidr); err != nil {
+			err = fmt.Errorf("invalid advertised route: %w", err)
+			return
+		}
+	}
+	cfg.AcceptRoutes, err = cmd.Flags().GetBool("accept-routes")
+	if err != nil {
+		return
+	}
+	cfg.AdvertiseExitNode, err = cmd.Flags().GetBool("advertise-exit-node")
+	if err != nil {
+		return
+	}
+	cfg.ExitNode, err = cmd.Flags().GetString("exit-node")
+	if err != nil {
+		return
+	}
+	cfg.DNS, err = cmd.Flags().GetBool("dns")
+	if err != nil {
+		return
+	}
+	cfg.DNSDomain, err = cmd.Flags().GetString("dns-domain")
+	if err != nil {
+		return
+	}
+	cfg.DNSUpstreams, err = cmd.Flags().GetStringSlice("dns-upstream")
+	if err != nil {
+		return
+	}
+	cfg.DERPServer, err = cmd.Flags().GetString("derp")
+	if err != nil {
+		return
+	}
+	cfg.LANProxy, err = cmd.Flags().GetString("lan-proxy")
+	if err != nil {
+		return
+	}
+	if cfg.WireGuard, err = wireGuardConfig(cmd); err != nil {
+		return
+	}
+	cfg.DataPlane, err = cmd.Flags().GetString("data-plane")
+	if err != nil {
+		return
+	}
+	if err = checkDataPlane(cfg); err != nil {
+		return
+	}
+	cfg.NoKeyring, err = cmd.Flags().GetBool("no-keyring")
+	if err != nil {
+		return
+	}
 	cfg.AuthQR, err = cmd.Flags().GetBool("auth-qr")
 	if err != nil {
 		return
 	}
+	cfg.AuthDevice, err = cmd.Flags().GetBool("auth-device")
+	if err != nil {
+		return
+	}
+	cfg.AuthProvider, err = cmd.Flags().GetString("auth-provider")
+	if err != nil {
+		return
+	}
+	cfg.AuthLDAP, err = cmd.Flags().GetString("auth-ldap")
+	if err != nil {
+		return
+	}
+	cfg.CaptureDir, err = cmd.Flags().GetString("capture-dir")
+	if err != nil {
+		return
+	}
+	cfg.Socket, err = cmd.Flags().GetString("socket")
+	if err != nil {
+		return
+	}
+	cfg.Debug.Listen, err = cmd.Flags().GetString("debug-listen")
+	if err != nil {
+		return
+	}
+	pprof, err := cmd.Flags().GetBool("pprof")
+	if err != nil {
+		return
+	}
+	if pprof && cfg.Debug.Listen == "" {
+		cfg.Debug.Listen = "127.0.0.1:29800"
+	}
+	cfg.Debug.Token, err = cmd.Flags().GetString("debug-token")
+	if err != nil {
+		return
+	}
+	if cfg.Debug.Token == "env:PG_DEBUG_TOKEN" && os.Getenv("PG_DEBUG_TOKEN") == "" {
+		cfg.Debug.Token = ""
+	}
+	if err = cfg.Debug.Check(); err != nil {
+		return
+	}
 	cfg.Server, err = cmd.Flags().GetString("server")
 	if err != nil {
 		return
 	}
+	cfg.ServerFallbacks, err = cmd.Flags().GetStringSlice("server-fallback")
+	if err != nil {
+		return
+	}
+	cfg.TLSCertFile, err = cmd.Flags().GetString("tls-cert")
+	if err != nil {
+		return
+	}
+	cfg.TLSKeyFile, err = cmd.Flags().GetString("tls-key")
+	if err != nil {
+		return
+	}
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		err = errors.New("flags \"tls-cert\" and \"tls-key\" must be set together")
+		return
+	}
 	if cfg.Server == "" {
 		err = errors.New("flag \"server\" not set")
 		return
@@ -158,61 +431,285 @@ func createConfig(cmd *cobra.Command) (cfg Config, err error) {
 	return
 }
 
+// wireGuardConfig reads the wireguard gateway flags, the gateway is disabled if the listen port is 0
+func wireGuardConfig(cmd *cobra.Command) (cfg wg.Config, err error) {
+	cfg.ListenPort, err = cmd.Flags().GetInt("wg-listen-port")
+	if err != nil || cfg.ListenPort == 0 {
+		return
+	}
+	cfg.MTU, err = cmd.Flags().GetInt("mtu")
+	if err != nil {
+		return
+	}
+	keyFile, err := cmd.Flags().GetString("wg-key-file")
+	if err != nil {
+		return
+	}
+	if keyFile == "" {
+		err = errors.New("flag \"wg-key-file\" is required by the wireguard gateway")
+		return
+	}
+	key, err := os.ReadFile(keyFile)
+	if err != nil {
+		return
+	}
+	cfg.PrivateKey = strings.TrimSpace(string(key))
+	peers, err := cmd.Flags().GetStringArray("wg-peer")
+	if err != nil {
+		return
+	}
+	for _, s := range peers {
+		peer, err := wg.ParsePeer(s)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.Peers = append(cfg.Peers, peer)
+	}
+	return
+}
+
 type Config struct {
 	iface.Config
 	DiscoPortScanOffset            int
 	DiscoPortScanCount             int
 	DiscoPortScanDuration          time.Duration
+	DiscoBirthdaySockets           int
 	DiscoChallengesRetry           int
 	DiscoChallengesInitialInterval time.Duration
 	DiscoChallengesBackoffRate     float64
 	DiscoIgnoredInterfaces         []string
 	TunName                        string
+	TunFallbackSOCKS5              string
+	Hostname                       string
 	Peers                          []string
+	PinFile                        string
+	PinMode                        string
+	FilterRules                    []vpn.FilterRule
+	NoForward                      bool
+	ServeMetrics                   bool
+	QualityProbeInterval           time.Duration
+	BenchDownloadRate              int
+	DERPServer                     string
+	LANProxy                       string
+	DNS                            bool
+	DNSDomain                      string
+	DNSUpstreams                   []string
+	AdvertiseRoutes                []string
+	AcceptRoutes                   bool
+	AdvertiseExitNode              bool
+	ExitNode                       string
+	DataPlane                      string
+	WireGuard                      wg.Config
 	PrivateKey                     string
+	KeyFile                        string
+	KeyBackend                     string
+	PostQuantum                    bool
+	CipherSuite                    string
+	PreSharedKey                   string
+	PeerPreSharedKeys              []string
+	PeerCertificate                bool
+	PeerCA                         string
 	SecretFile                     string
+	SealingKey                     []byte
+	NoKeyring                      bool
 	Server                         string
+	ServerFallbacks                []string
+	TLSCertFile                    string
+	TLSKeyFile                     string
 	AuthQR                         bool
+	AuthDevice                     bool
+	AuthProvider                   string
+	AuthLDAP                       string
+	CaptureDir                     string
+	Socket                         string
+	Debug                          debughttp.Config
 }
 
 type P2PVPN struct {
-	Config Config
-	iface  iface.Interface
+	Config    Config
+	iface     iface.Interface
+	pinStore  p2p.PinStore
+	lanProxy  *lanProxy
+	exitNAT   *exitNAT
+	exitNode  *exitNode
+	aclFilter *vpn.ACLFilter
+	filter    *vpn.PacketFilter
+	tap       *pcap.Tap
+	ctx       context.Context
+	conn      *packetConn
+	dataPlane *vpn.VPN
+	wgPlane   *wg.DataPlane
+
+	upMutex      sync.Mutex
+	cancelServe  context.CancelFunc // stops the services on the p2p conn when down
+	pausedRoutes map[string]string  // dst => via, the routes removed by down and added back by up
+
+	peersMutex sync.RWMutex
+	peers      map[disco.PeerID]url.Values // the peers added to the iface
+
+	routesMutex sync.RWMutex
+	routes      map[string]string // dst => via
+	managed     map[string]string // dst => via, the routes added by the daemon, checked by rules
 }
 
 func (v *P2PVPN) Run(ctx context.Context) error {
 	iface, err := iface.Create(v.Config.TunName, v.Config.Config)
 	if err != nil {
-		return err
+		return v.tunUnavailable(ctx, err)
 	}
 	v.iface = iface
+	v.ctx = ctx
+	v.setupDisco()
+	vpnConfig := vpn.Config{
+		MTU:           v.Config.MTU,
+		IPv4:          v.Config.IPv4,
+		IPv6:          v.Config.IPv6,
+		OnRouteAdd:    v.onRouteAdd,
+		OnRouteRemove: v.onRouteRemove,
+	}
+	if v.Config.AdvertiseExitNode || len(v.Config.AdvertiseRoutes) > 0 {
+		if v.exitNAT, err = newExitNAT(v.Config.IPv4, v.Config.IPv6, v.Config.AdvertiseExitNode, v.Config.AdvertiseRoutes); err != nil {
+			return errors.Join(err, iface.Close())
+		}
+		defer v.exitNAT.close()
+		vpnConfig.InboundHandlers = append(vpnConfig.InboundHandlers, v.exitNAT.nat)
+		vpnConfig.OutboundHandlers = append(vpnConfig.OutboundHandlers, v.exitNAT.nat)
+	}
+	if v.filter, err = vpn.NewPacketFilter(v.Config.FilterRules...); err != nil {
+		return errors.Join(err, iface.Close())
+	}
+	vpnConfig.Filter = v.filter
+	v.aclFilter = vpn.NewACLFilter(v.peerRoute, v.peerTags)
+	vpnConfig.InboundHandlers = append([]vpn.InboundHandler{v.aclFilter}, vpnConfig.InboundHandlers...)
+	vpnConfig.OutboundHandlers = append(vpnConfig.OutboundHandlers, v.aclFilter)
+	v.tap = pcap.NewTap("tun", "peer")
+	capture := &vpn.Capture{Tap: v.tap, Iface: captureIfaceTun}
+	vpnConfig.InboundHandlers = append(vpnConfig.InboundHandlers, capture)
+	vpnConfig.OutboundHandlers = append([]vpn.OutboundHandler{capture}, vpnConfig.OutboundHandlers...)
+	if v.Config.DataPlane == dataPlaneWireGuard {
+		if v.wgPlane, err = v.newWireGuardDataPlane(vpnConfig); err != nil {
+			return errors.Join(err, iface.Close())
+		}
+	}
+	if v.Config.WireGuard.ListenPort > 0 {
+		gateway, err := wg.New(v.Config.WireGuard)
+		if err != nil {
+			return errors.Join(err, iface.Close())
+		}
+		vpnConfig.Bridges = append(vpnConfig.Bridges, gateway)
+	}
+	if v.Config.CaptureDir != "" {
+		if err := v.startCapture(ctx); err != nil {
+			return errors.Join(fmt.Errorf("capture: %w", err), iface.Close())
+		}
+	}
+	if v.Config.LANProxy != "" {
+		if v.lanProxy, err = newLANProxy(v.Config.LANProxy); err != nil {
+			return errors.Join(err, iface.Close())
+		}
+		defer v.lanProxy.close()
+	}
+	var localAPI net.Listener
+	if v.Config.Socket != "" {
+		if localAPI, err = v.listenLocalAPI(); err != nil {
+			return errors.Join(fmt.Errorf("local api: %w", err), iface.Close())
+		}
+	}
+	if v.wgPlane == nil {
+		v.dataPlane = vpn.New(vpnConfig)
+	}
+	if v.Config.ExitNode != "" {
+		v.exitNode = newExitNode(v.Config.ExitNode, v.Config.TunName, v.dataPlane)
+		defer v.exitNode.close()
+	}
 	c, err := v.listenPacketConn(ctx)
 	if err != nil {
-		err1 := iface.Close()
-		return errors.Join(err, err1)
+		if localAPI != nil {
+			localAPI.Close()
+		}
+		return errors.Join(err, iface.Close())
 	}
-	return vpn.New(vpn.Config{
-		MTU:           v.Config.MTU,
-		OnRouteAdd:    func(dst net.IPNet, _ net.IP) { disco.AddIgnoredLocalCIDRs(dst.String()) },
-		OnRouteRemove: func(dst net.IPNet, _ net.IP) { disco.RemoveIgnoredLocalCIDRs(dst.String()) },
-	}).Run(ctx, iface, c)
+	v.conn = &packetConn{PeerPacketConn: c}
+	c.ControllerManager().Register(&aclController{filter: v.aclFilter})
+	v.serve()
+	if localAPI != nil {
+		v.serveLocalAPI(ctx, localAPI)
+	}
+	if v.Config.DNS {
+		if err := v.serveDNS(ctx); err != nil {
+			return errors.Join(fmt.Errorf("dns: %w", err), c.Close(), iface.Close())
+		}
+	}
+	if v.Config.ServeMetrics {
+		if err := v.serveMetrics(ctx); err != nil {
+			return errors.Join(fmt.Errorf("metrics: %w", err), c.Close(), iface.Close())
+		}
+	}
+	if v.Config.Debug.Listen != "" {
+		if expvar.Get("vpn") == nil {
+			expvar.Publish("vpn", expvar.Func(func() any { return v.metrics() }))
+		}
+		if err := debughttp.Start(ctx, v.Config.Debug); err != nil {
+			return errors.Join(err, c.Close(), iface.Close())
+		}
+	}
+	if v.wgPlane != nil {
+		return v.wgPlane.Run(ctx, iface.Device(), v.conn)
+	}
+	return v.dataPlane.Run(ctx, iface, v.conn)
 }
 
-func (v *P2PVPN) listenPacketConn(ctx context.Context) (c net.PacketConn, err error) {
-	tp.SetModifyDiscoConfig(func(cfg *tp.DiscoConfig) {
-		cfg.PortScanOffset = v.Config.DiscoPortScanOffset
-		cfg.PortScanCount = v.Config.DiscoPortScanCount
-		cfg.PortScanDuration = v.Config.DiscoPortScanDuration
-		cfg.ChallengesRetry = v.Config.DiscoChallengesRetry
-		cfg.ChallengesInitialInterval = v.Config.DiscoChallengesInitialInterval
-		cfg.ChallengesBackoffRate = v.Config.DiscoChallengesBackoffRate
-	})
-	v.Config.DiscoIgnoredInterfaces = append(v.Config.DiscoIgnoredInterfaces, "pg", "wg", "veth", "docker", "nerdctl", "tailscale")
+// serveForward accepts the ports forwarded by peers, the connections are dialed to the overlay ip
+// so that the services only listening on the loopback are not exposed
+func (v *P2PVPN) serveForward(ctx context.Context, c *p2p.PeerPacketConn) {
+	var overlayIP netip.Addr
+	for _, prefix := range []string{v.Config.IPv4, v.Config.IPv6} {
+		if p, err := netip.ParsePrefix(prefix); err == nil {
+			overlayIP = p.Addr()
+			break
+		}
+	}
+	server := forward.Server{Dial: func(ctx context.Context, port uint16) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", netip.AddrPortFrom(overlayIP, port).String())
+	}}
+	if err := server.Serve(ctx, c.StreamConn()); err != nil {
+		slog.Error("ServeForward", "err", err)
+	}
+}
+
+func (v *P2PVPN) setupDisco() {
+	v.Config.DiscoIgnoredInterfaces = append(v.Config.DiscoIgnoredInterfaces, "pg", "wg", "veth", "docker", "nerdctl", "tailscale", v.Config.TunName)
 	disco.SetIgnoredLocalInterfaceNamePrefixs(v.Config.DiscoIgnoredInterfaces...)
+}
 
+func (v *P2PVPN) listenPacketConn(ctx context.Context) (c *p2p.PeerPacketConn, err error) {
 	p2pOptions := []p2p.Option{
 		p2p.PeerMeta("version", fmt.Sprintf("%s-%s", Version, Commit)),
-		p2p.ListenPeerUp(v.addPeer),
+		p2p.PeerMeta("name", v.Config.Hostname),
+		p2p.ListenPeerUp(v.onPeer),
+		p2p.ListenPacketTap(v.capturePeer),
+		p2p.ListenQualityProbe(v.Config.QualityProbeInterval),
+		p2p.ListenBenchDownload(v.Config.BenchDownloadRate),
+		p2p.ListenDisco(tp.DiscoConfig{
+			PortScanOffset:            v.Config.DiscoPortScanOffset,
+			PortScanCount:             v.Config.DiscoPortScanCount,
+			PortScanDuration:          v.Config.DiscoPortScanDuration,
+			BirthdaySockets:           v.Config.DiscoBirthdaySockets,
+			ChallengesRetry:           v.Config.DiscoChallengesRetry,
+			ChallengesInitialInterval: v.Config.DiscoChallengesInitialInterval,
+			ChallengesBackoffRate:     v.Config.DiscoChallengesBackoffRate,
+		}),
+	}
+	if v.Config.PinMode != "off" {
+		if len(v.Config.PinFile) == 0 {
+			currentUser, err := user.Current()
+			if err != nil {
+				return nil, err
+			}
+			v.Config.PinFile = filepath.Join(currentUser.HomeDir, ".peerguard_known_peers.json")
+		}
+		v.pinStore = &p2p.FilePinStore{StoreFilePath: v.Config.PinFile}
 	}
 	if len(v.Config.Peers) > 0 {
 		p2pOptions = append(p2pOptions, p2p.PeerSilenceMode())
@@ -243,30 +740,128 @@ func (v *P2PVPN) listenPacketConn(ctx context.Context) (c net.PacketConn, err er
 		disco.AddIgnoredLocalCIDRs(v.Config.IPv6)
 		p2pOptions = append(p2pOptions, p2p.PeerAlias2(ipv6.Addr().String()))
 	}
-	if v.Config.PrivateKey != "" {
+	if v.wgPlane != nil { // the wireguard data plane encrypts the packets end to end
+		p2pOptions = append(p2pOptions, p2p.ListenPeerID(v.wgPlane.PeerID()), p2p.ListenPeerInsecure())
+	} else if v.Config.PrivateKey != "" {
 		p2pOptions = append(p2pOptions, p2p.ListenPeerCurve25519(v.Config.PrivateKey))
+	} else if v.Config.KeyBackend != "" {
+		key, err := secure.OpenKeyBackend(v.Config.KeyBackend)
+		if err != nil {
+			return nil, fmt.Errorf("open key backend: %w", err)
+		}
+		p2pOptions = append(p2pOptions, p2p.ListenPeerKey(key))
+	} else if v.Config.KeyFile != "" {
+		priv, err := secure.LoadOrGenerateSealedCurve25519File(v.Config.KeyFile, v.Config.SealingKey)
+		if err != nil {
+			return nil, fmt.Errorf("load key file: %w", err)
+		}
+		p2pOptions = append(p2pOptions, p2p.ListenPeerCurve25519(priv.String()))
 	} else {
 		p2pOptions = append(p2pOptions, p2p.ListenPeerSecure())
 	}
+	if v.Config.PostQuantum {
+		p2pOptions = append(p2pOptions, p2p.ListenPeerPostQuantum())
+	}
+	if v.Config.CipherSuite != p2p.CipherSuiteAuto {
+		p2pOptions = append(p2pOptions, p2p.ListenPeerCipherSuite(v.Config.CipherSuite))
+	}
+	if v.Config.PreSharedKey != "" {
+		p2pOptions = append(p2pOptions, p2p.PeerPreSharedKey(v.Config.PreSharedKey))
+	}
+	for _, peerPSK := range v.Config.PeerPreSharedKeys {
+		peerID, psk, ok := strings.Cut(peerPSK, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid peer psk %s, <peerID>=<base64 psk> is required", peerPSK)
+		}
+		p2pOptions = append(p2pOptions, p2p.PeerPairPreSharedKey(disco.PeerID(peerID), psk))
+	}
+	if v.Config.PeerCertificate || v.Config.PeerCA != "" {
+		p2pOptions = append(p2pOptions, p2p.RequirePeerCertificate(v.Config.PeerCA))
+	}
+	if v.Config.DERPServer != "" {
+		p2pOptions = append(p2pOptions, p2p.ListenPeerDERP(v.Config.DERPServer))
+	}
+	if v.Config.AdvertiseExitNode {
+		p2pOptions = append(p2pOptions, p2p.PeerExitNode())
+	}
+	if len(v.Config.AdvertiseRoutes) > 0 {
+		p2pOptions = append(p2pOptions, p2p.PeerAdvertiseRoutes(v.Config.AdvertiseRoutes...))
+	}
 
-	secretStore, err := v.loginIfNecessary(ctx)
+	peermap, err := v.newPeermap(ctx)
 	if err != nil {
 		return
 	}
+	return p2p.ListenPacketContext(ctx, peermap, p2pOptions...)
+}
+
+// newPeermap logs in if necessary and creates the peermap with the fallback servers and the client
+// certificate
+func (v *P2PVPN) newPeermap(ctx context.Context) (*disco.Peermap, error) {
+	secretStore, err := v.loginIfNecessary(ctx)
+	if err != nil {
+		return nil, err
+	}
 	peermapURL, err := url.Parse(v.Config.Server)
 	if err != nil {
-		return
+		return nil, err
 	}
 	peermap, err := disco.NewPeermap(peermapURL, secretStore)
 	if err != nil {
-		return
+		return nil, err
+	}
+	for _, fallback := range v.Config.ServerFallbacks {
+		if err := peermap.AddFallback(fallback); err != nil {
+			return nil, err
+		}
 	}
+	if v.Config.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(v.Config.TLSCertFile, v.Config.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		peermap.WithClientCertificate(cert)
+	}
+	return peermap, nil
+}
 
-	return p2p.ListenPacketContext(ctx, peermap, p2pOptions...)
+// onPeer adds the discovered peer after checking its ip addresses are not pinned to other peers
+func (v *P2PVPN) onPeer(pi disco.PeerID, m url.Values) {
+	if v.pinStore != nil {
+		for _, ip := range []string{m.Get("alias1"), m.Get("alias2")} {
+			if ip == "" {
+				continue
+			}
+			err := v.pinStore.Pin(ip, pi)
+			if err == nil {
+				continue
+			}
+			if !errors.Is(err, p2p.ErrPinMismatch{}) {
+				slog.Error("PinPeer", "peer", pi, "err", err)
+				continue
+			}
+			slog.Warn("!!! PEER KEY CHANGED, SOMEONE MAY BE IMPERSONATING THE PEER !!!", "err", err)
+			if v.Config.PinMode == "strict" {
+				slog.Error("RefusePeer (run `pgcli pins clear " + ip + "` if the change is expected)")
+				return
+			}
+		}
+	}
+	v.addPeer(pi, m)
 }
 
 func (v *P2PVPN) addPeer(pi disco.PeerID, m url.Values) {
 	v.iface.AddPeer(pi, m.Get("alias1"), m.Get("alias2"))
+	v.lanProxy.add(m.Get("alias1"), m.Get("alias2"))
+	v.exitNode.peerFound(pi, m, v.Config.IPv4, v.Config.IPv6)
+	v.acceptRoutes(pi, m)
+	v.addWireGuardPeer(pi, m)
+	v.peersMutex.Lock()
+	defer v.peersMutex.Unlock()
+	if v.peers == nil {
+		v.peers = make(map[disco.PeerID]url.Values)
+	}
+	v.peers[pi] = m
 }
 
 func (v *P2PVPN) loginIfNecessary(ctx context.Context) (disco.SecretStore, error) {
@@ -278,8 +873,11 @@ func (v *P2PVPN) loginIfNecessary(ctx context.Context) (disco.SecretStore, error
 		v.Config.SecretFile = filepath.Join(currentUser.HomeDir, ".peerguard_network_secret.json")
 	}
 
-	store := p2p.FileSecretStore(v.Config.SecretFile)
-	newFileStore := func() (disco.SecretStore, error) {
+	var store disco.SecretStore = p2p.EncryptedFileSecretStore(v.Config.SecretFile, v.Config.SealingKey)
+	if !v.Config.NoKeyring {
+		store = p2p.KeyringSecretStore(v.Config.Server, v.Config.SecretFile, v.Config.SealingKey)
+	}
+	newSecret := func() (disco.SecretStore, error) {
 		joined, err := v.requestNetworkSecret(ctx)
 		if err != nil {
 			return nil, fmt.Errorf("request network secret failed: %w", err)
@@ -287,20 +885,37 @@ func (v *P2PVPN) loginIfNecessary(ctx context.Context) (disco.SecretStore, error
 		return store, store.UpdateNetworkSecret(joined)
 	}
 
-	if _, err := os.Stat(v.Config.SecretFile); os.IsNotExist(err) {
-		return newFileStore()
-	}
 	secret, err := store.NetworkSecret()
+	if errors.Is(err, os.ErrNotExist) {
+		if v.Config.TLSCertFile != "" { // authenticated by the client certificate
+			return &disco.NetworkSecret{}, nil
+		}
+		return newSecret()
+	}
 	if err != nil {
 		return nil, err
 	}
 	if secret.Expired() {
-		return newFileStore()
+		if secret.RefreshToken != "" {
+			refreshed, err := network.RefreshOIDC(ctx, v.Config.Server, secret)
+			if err == nil {
+				slog.Info("NetworkSecretRefreshed", "network", refreshed.Network)
+				return store, store.UpdateNetworkSecret(refreshed)
+			}
+			slog.Warn("NetworkSecretRefresh failed, re-authentication is required", "err", err)
+		}
+		return newSecret()
 	}
 	return store, nil
 }
 
 func (v *P2PVPN) requestNetworkSecret(ctx context.Context) (disco.NetworkSecret, error) {
+	if v.Config.AuthLDAP != "" {
+		return v.requestNetworkSecretByLDAP(ctx)
+	}
+	if v.Config.AuthDevice {
+		return v.requestNetworkSecretByDevice(ctx)
+	}
 	join, err := network.JoinOIDC("", v.Config.Server)
 	if err != nil {
 		slog.Error("JoinNetwork failed", "err", err)
@@ -321,3 +936,45 @@ func (v *P2PVPN) requestNetworkSecret(ctx context.Context) (disco.NetworkSecret,
 	defer cancel()
 	return join.Wait(ctx)
 }
+
+func (v *P2PVPN) requestNetworkSecretByDevice(ctx context.Context) (disco.NetworkSecret, error) {
+	join, err := network.JoinOIDCDevice(ctx, v.Config.AuthProvider, v.Config.Server)
+	if err != nil {
+		slog.Error("JoinNetwork failed", "err", err)
+		return disco.NetworkSecret{}, err
+	}
+	fmt.Println("Open the following link on any device and enter the code to authenticate")
+	fmt.Println(join.VerificationURI)
+	fmt.Println("Code:", join.UserCode)
+	if v.Config.AuthQR && join.VerificationURIComplete != "" {
+		qrterminal.GenerateWithConfig(join.VerificationURIComplete, qrterminal.Config{
+			Level:     qrterminal.L,
+			Writer:    os.Stdout,
+			BlackChar: qrterminal.WHITE,
+			WhiteChar: qrterminal.BLACK,
+			QuietZone: 1,
+		})
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(join.ExpiresIn)*time.Second)
+	defer cancel()
+	return join.Wait(ctx)
+}
+
+func (v *P2PVPN) requestNetworkSecretByLDAP(ctx context.Context) (disco.NetworkSecret, error) {
+	password := os.Getenv("PG_LDAP_PASSWORD")
+	if password == "" {
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			return disco.NetworkSecret{}, errors.New("ldap password is required, set PG_LDAP_PASSWORD")
+		}
+		fmt.Printf("LDAP password for %s: ", v.Config.AuthLDAP)
+		b, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Println()
+		if err != nil {
+			return disco.NetworkSecret{}, err
+		}
+		password = string(b)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	return network.JoinLDAP(ctx, v.Config.Server, v.Config.AuthLDAP, password)
+}
@@ -4,13 +4,17 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log/slog"
+	"io"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"github.com/rkonfj/peerguard/crash"
+	"github.com/rkonfj/peerguard/logging"
 	"github.com/rkonfj/peerguard/peermap"
+	"github.com/rkonfj/peerguard/tracing"
 	"github.com/spf13/cobra"
 )
 
@@ -25,25 +29,48 @@ func main() {
 		Version:      fmt.Sprintf("%s, commit %s", Version, Commit),
 		Short:        "Run a peermap server daemon",
 		SilenceUsage: true,
-		PreRunE: func(cmd *cobra.Command, args []string) error {
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
 			verbose, err := cmd.Flags().GetInt("verbose")
 			if err != nil {
 				return err
 			}
-			slog.SetLogLoggerLevel(slog.Level(verbose))
-			return nil
+			if err := logging.Setup(cmd.Flags(), verbose); err != nil {
+				return err
+			}
+			if err := crash.Setup(cmd.Flags(), "pgmap"); err != nil {
+				return err
+			}
+			return tracing.Setup(cmd.Flags(), "pgmap")
 		},
 		Args: cobra.NoArgs,
 		RunE: run,
 	}
-	serveCmd.Flags().StringP("config", "c", "config.yaml", "config file")
-	serveCmd.Flags().StringP("listen", "l", "127.0.0.1:9987", "listen http address")
-	serveCmd.Flags().String("secret-key", "", "key to generate network secret (defaut generate a random one)")
-	serveCmd.Flags().StringSlice("stun", []string{}, "stun server for peers NAT traversal (leave blank to disable NAT traversal)")
-	serveCmd.Flags().String("pubnet", "", "public network (leave blank to disable public network)")
-	serveCmd.Flags().IntP("verbose", "V", 0, "logger verbosity level")
+	serveCmd.PersistentFlags().StringP("config", "c", "config.yaml", "config file")
+	serveCmd.PersistentFlags().StringP("listen", "l", "127.0.0.1:9987", "listen http address")
+	serveCmd.PersistentFlags().StringSlice("secret-key", []string{}, "key to generate network secret, followed by the previous keys still verify the secrets (defaut generate a random one)")
+	serveCmd.PersistentFlags().StringSlice("stun", []string{}, "stun server for peers NAT traversal (leave blank to disable NAT traversal)")
+	serveCmd.PersistentFlags().String("pubnet", "", "public network (leave blank to disable public network)")
+	serveCmd.PersistentFlags().IntP("verbose", "V", 0, "logger verbosity level")
+	logging.AddFlags(serveCmd.PersistentFlags())
+	crash.AddFlags(serveCmd.PersistentFlags())
+	tracing.AddFlags(serveCmd.PersistentFlags())
 
-	serveCmd.Execute()
+	serveCmd.AddCommand(&cobra.Command{
+		Use:   "check-config",
+		Short: "Validate the config and the environment it depends on without serving, exits nonzero if any check fails",
+		Long: "Load the config file and the flags the way the server starts with them, then discover the oidc providers, " +
+			"request the STUN servers and decode the state files. Unknown keys in the config file are errors",
+		Args: cobra.NoArgs,
+		RunE: checkConfig,
+	})
+
+	err := serveCmd.Execute()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	tracing.Shutdown(ctx)
+	cancel()
+	if err != nil {
+		os.Exit(1)
+	}
 }
 
 func run(cmd *cobra.Command, args []string) error {
@@ -72,12 +99,44 @@ func run(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+func checkConfig(cmd *cobra.Command, args []string) error {
+	cfg1, err := commandlineConfig(cmd)
+	if err != nil {
+		return err
+	}
+	configFile, err := cmd.Flags().GetString("config")
+	if err != nil {
+		return err
+	}
+	cfg, err := peermap.ReadConfigStrict(configFile)
+	if err != nil && !errors.Is(err, io.EOF) { // io.EOF is the empty file
+		return fmt.Errorf("read config %s: %w", configFile, err)
+	}
+	cfg.Overwrite(cfg1)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	var failed int
+	for _, check := range peermap.CheckConfig(ctx, cfg) {
+		if check.Err != nil {
+			failed++
+			fmt.Printf("FAIL  %s: %s\n", check.Name, check.Err)
+			continue
+		}
+		fmt.Printf("OK    %s\n", check.Name)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d checks failed", failed)
+	}
+	return nil
+}
+
 func commandlineConfig(cmd *cobra.Command) (opts peermap.Config, err error) {
 	opts.Listen, err = cmd.Flags().GetString("listen")
 	if err != nil {
 		return
 	}
-	opts.SecretKey, err = cmd.Flags().GetString("secret-key")
+	opts.SecretKey, err = cmd.Flags().GetStringSlice("secret-key")
 	if err != nil {
 		return
 	}
@@ -0,0 +1,131 @@
+// Package crash recovers the panics of the long-lived goroutines (the peermap read loops, the vpn
+// loops, the disco workers) and reports them to a pluggable reporter like a Sentry-style http hook,
+// so that a crash in one goroutine is captured and the process keeps running without it
+package crash
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// Report is the recovered panic of a goroutine
+type Report struct {
+	Service   string    `json:"service"`
+	Host      string    `json:"host"`
+	Goroutine string    `json:"goroutine"`
+	Panic     string    `json:"panic"`
+	Stack     string    `json:"stack"`
+	Time      time.Time `json:"time"`
+}
+
+// Reporter sends the reports, e.g. to the crash collecting service
+type Reporter interface {
+	Report(r Report) error
+}
+
+type state struct {
+	service  string
+	reporter Reporter
+}
+
+var (
+	current atomic.Pointer[state]
+	panics  atomic.Uint64
+)
+
+func init() {
+	current.Store(&state{})
+}
+
+// AddFlags adds the crash reporting flags, the panics are only logged unless the report url is set
+func AddFlags(flags *pflag.FlagSet) {
+	flags.String("crash-report-url", "", "url the recovered goroutine panics are posted to as json (Sentry-style hook, disabled if empty)")
+	flags.StringSlice("crash-report-header", nil, "header sent with the crash reports as key=value, e.g. authorization=Bearer xxx")
+}
+
+// Setup reports the panics of the service by the flags
+func Setup(flags *pflag.FlagSet, service string) error {
+	url, err := flags.GetString("crash-report-url")
+	if err != nil {
+		return err
+	}
+	headerArgs, err := flags.GetStringSlice("crash-report-header")
+	if err != nil {
+		return err
+	}
+	if url == "" {
+		SetReporter(service, nil)
+		return nil
+	}
+	header := http.Header{}
+	for _, arg := range headerArgs {
+		k, v, ok := strings.Cut(arg, "=")
+		if !ok {
+			return fmt.Errorf("invalid crash report header %q, key=value expected", arg)
+		}
+		header.Add(strings.TrimSpace(k), strings.TrimSpace(v))
+	}
+	SetReporter(service, NewHTTPReporter(url, header))
+	return nil
+}
+
+// SetReporter replaces the reporter of the service, nil only logs the panics
+func SetReporter(service string, r Reporter) {
+	current.Store(&state{service: service, reporter: r})
+}
+
+// Panics is the number of the panics recovered since the process started
+func Panics() uint64 {
+	return panics.Load()
+}
+
+// Recover recovers the panic of the goroutine named name, it must be deferred directly
+// (defer crash.Recover("vpn/tunread")). The panic is logged and reported, then the cleanups
+// run so that the state the goroutine owned (e.g. the peer connection) is released
+func Recover(name string, cleanups ...func()) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	handle(name, v, debug.Stack())
+	for _, cleanup := range cleanups {
+		cleanup()
+	}
+}
+
+// Go runs fn in a new goroutine named name whose panic is recovered
+func Go(name string, fn func()) {
+	go func() {
+		defer Recover(name)
+		fn()
+	}()
+}
+
+func handle(name string, v any, stack []byte) {
+	panics.Add(1)
+	s := current.Load()
+	slog.Error("GoroutinePanic", "goroutine", name, "panic", v, "stack", string(stack))
+	if s.reporter == nil {
+		return
+	}
+	host, _ := os.Hostname()
+	r := Report{
+		Service:   s.service,
+		Host:      host,
+		Goroutine: name,
+		Panic:     fmt.Sprint(v),
+		Stack:     string(stack),
+		Time:      time.Now(),
+	}
+	if err := s.reporter.Report(r); err != nil {
+		slog.Error("CrashReport", "goroutine", name, "err", err)
+	}
+}
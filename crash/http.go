@@ -0,0 +1,49 @@
+package crash
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// HTTPReporter posts the reports as json to the url
+type HTTPReporter struct {
+	url    string
+	header http.Header
+	client http.Client
+}
+
+// NewHTTPReporter creates the reporter posting to the url with the header
+func NewHTTPReporter(url string, header http.Header) *HTTPReporter {
+	return &HTTPReporter{
+		url:    url,
+		header: header,
+		client: http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (r *HTTPReporter) Report(report Report) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, r.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range r.header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("crash report responded %s", resp.Status)
+	}
+	return nil
+}
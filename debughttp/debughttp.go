@@ -0,0 +1,131 @@
+// Package debughttp serves net/http/pprof and expvar on a dedicated listener guarded by a token,
+// so that the cpu, memory and goroutine issues of the long running nodes and peermap servers
+// can be profiled in production
+package debughttp
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+func init() {
+	expvar.Publish("goroutines", expvar.Func(func() any { return runtime.NumGoroutine() }))
+}
+
+type Config struct {
+	// Listen is the tcp address of the debug listener, empty to disable it
+	Listen string `yaml:"listen"`
+	// Token is required by the requests as the bearer token or X-Token (env:NAME, file:PATH
+	// or the token itself), it may be empty only if the listen address is loopback
+	Token string `yaml:"token"`
+}
+
+// ResolveToken resolves the token spec, env:NAME reads the environment variable,
+// file:PATH reads the file, otherwise the spec is the token itself
+func ResolveToken(spec string) (string, error) {
+	switch {
+	case strings.HasPrefix(spec, "env:"):
+		token := os.Getenv(strings.TrimPrefix(spec, "env:"))
+		if token == "" {
+			return "", fmt.Errorf("debug token: environment variable %s is empty", strings.TrimPrefix(spec, "env:"))
+		}
+		return token, nil
+	case strings.HasPrefix(spec, "file:"):
+		b, err := os.ReadFile(strings.TrimPrefix(spec, "file:"))
+		if err != nil {
+			return "", fmt.Errorf("debug token: %w", err)
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+	return spec, nil
+}
+
+// Check validates the config, the token is required unless the listener is only reachable locally
+func (cfg Config) Check() error {
+	if cfg.Listen == "" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(cfg.Listen)
+	if err != nil {
+		return fmt.Errorf("debug: invalid listen address %s: %w", cfg.Listen, err)
+	}
+	if cfg.Token != "" {
+		return nil
+	}
+	if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		return nil
+	}
+	return fmt.Errorf("debug: token is required to listen on %s, or listen on the loopback address", cfg.Listen)
+}
+
+// Handler serves /debug/pprof/ and /debug/vars, the requests without the token are rejected
+// if the token is not empty
+func Handler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	if token == "" {
+		return mux
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := r.Header.Get("X-Token")
+		if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			got = bearer
+		}
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// Start listens on the debug listener and serves it until ctx is done, nothing is served if
+// the listen address is empty
+func Start(ctx context.Context, cfg Config) error {
+	if cfg.Listen == "" {
+		return nil
+	}
+	if err := cfg.Check(); err != nil {
+		return err
+	}
+	token, err := ResolveToken(cfg.Token)
+	if err != nil {
+		return err
+	}
+	if cfg.Token != "" && token == "" {
+		return errors.New("debug: token is empty")
+	}
+	l, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return fmt.Errorf("debug: %w", err)
+	}
+	// the cpu profile and trace last 30s by default
+	server := http.Server{Handler: Handler(token), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	go func() {
+		if err := server.Serve(l); err != nil && err != http.ErrServerClosed {
+			slog.Error("Serve debug listener", "err", err)
+		}
+	}()
+	slog.Info("Serving pprof and expvar", "listen", l.Addr().String(), "token", token != "")
+	return nil
+}
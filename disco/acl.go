@@ -0,0 +1,132 @@
+package disco
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ACLTagMeta is the metadata key of the tags of the peer, the tags are assigned by the peermap by
+// the secret the peer joined with rather than claimed by the peer
+const ACLTagMeta = "tag"
+
+// ACL is the access control policy of the network, the peer is allowed to reach the other one only
+// if a rule matches. The ACL without rules allows all
+type ACL struct {
+	Rules []ACLRule `json:"rules"`
+}
+
+// ACLRule allows the peers tagged any of the Src to reach the peers tagged any of the Dst on the
+// Ports, the tag * is any peer
+type ACLRule struct {
+	Src []string `json:"src"`
+	Dst []string `json:"dst"`
+	// Ports are the destination ports (22, 8000-8100, tcp:443 or udp:53), empty is any protocol
+	// and port
+	Ports []string `json:"ports,omitempty"`
+}
+
+// ACLUpdate is sent to the peer by CONTROL_UPDATE_ACL, Tags are the tags of the peer itself
+type ACLUpdate struct {
+	ACL  ACL      `json:"acl"`
+	Tags []string `json:"tags"`
+}
+
+// PeerTags are the tags in the metadata of the peer
+func PeerTags(meta url.Values) []string {
+	return meta[ACLTagMeta]
+}
+
+// SetPeerTags replaces the tags in the metadata of the peer, the ones claimed by the peer are
+// dropped
+func SetPeerTags(meta url.Values, tags []string) {
+	if len(tags) == 0 {
+		meta.Del(ACLTagMeta)
+		return
+	}
+	meta[ACLTagMeta] = slices.Clone(tags)
+}
+
+// Check validates the rules of the acl
+func (acl ACL) Check() error {
+	for i, rule := range acl.Rules {
+		if len(rule.Src) == 0 || len(rule.Dst) == 0 {
+			return fmt.Errorf("rule %d: src and dst are required", i)
+		}
+		for _, port := range rule.Ports {
+			if _, _, _, err := parsePortRange(port); err != nil {
+				return fmt.Errorf("rule %d: %w", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Enabled reports whether the acl restricts the peers
+func (acl ACL) Enabled() bool {
+	return len(acl.Rules) > 0
+}
+
+// Reachable reports whether the peer tagged src is allowed to reach the peer tagged dst on any port
+func (acl ACL) Reachable(src, dst []string) bool {
+	if !acl.Enabled() {
+		return true
+	}
+	return slices.ContainsFunc(acl.Rules, func(rule ACLRule) bool {
+		return rule.matches(src, dst)
+	})
+}
+
+// Allowed reports whether the peer tagged src is allowed to reach the port of the protocol (tcp,
+// udp or icmp, the port of icmp is ignored) of the peer tagged dst
+func (acl ACL) Allowed(src, dst []string, proto string, port uint16) bool {
+	if !acl.Enabled() {
+		return true
+	}
+	return slices.ContainsFunc(acl.Rules, func(rule ACLRule) bool {
+		if !rule.matches(src, dst) {
+			return false
+		}
+		if len(rule.Ports) == 0 {
+			return true
+		}
+		return slices.ContainsFunc(rule.Ports, func(s string) bool {
+			p, from, to, err := parsePortRange(s)
+			return err == nil && (p == "" || p == proto) && proto != "icmp" && port >= from && port <= to
+		})
+	})
+}
+
+func (rule ACLRule) matches(src, dst []string) bool {
+	return matchTags(rule.Src, src) && matchTags(rule.Dst, dst)
+}
+
+func matchTags(ruleTags, tags []string) bool {
+	return slices.Contains(ruleTags, "*") || slices.ContainsFunc(ruleTags, func(tag string) bool {
+		return slices.Contains(tags, tag)
+	})
+}
+
+// parsePortRange parses the port (22), the range (8000-8100) and the one prefixed with the
+// protocol (tcp:443 or udp:53)
+func parsePortRange(s string) (proto string, from, to uint16, err error) {
+	if p, ports, ok := strings.Cut(s, ":"); ok {
+		if p != "tcp" && p != "udp" {
+			return "", 0, 0, fmt.Errorf("invalid protocol %s of port %s", p, s)
+		}
+		proto, s = p, ports
+	}
+	low, high, isRange := strings.Cut(s, "-")
+	if !isRange {
+		high = low
+	}
+	n1, err1 := strconv.ParseUint(low, 10, 16)
+	n2, err2 := strconv.ParseUint(high, 10, 16)
+	if err := errors.Join(err1, err2); err != nil || n1 > n2 {
+		return "", 0, 0, fmt.Errorf("invalid port %s", s)
+	}
+	return proto, uint16(n1), uint16(n2), nil
+}
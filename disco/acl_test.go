@@ -0,0 +1,75 @@
+package disco_test
+
+import (
+	"net/url"
+	"slices"
+	"testing"
+
+	"github.com/rkonfj/peerguard/disco"
+)
+
+func TestSetPeerTagsDropsClaimed(t *testing.T) {
+	meta, err := url.ParseQuery("name=laptop&tag=admin&tag=user:root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	disco.SetPeerTags(meta, []string{"dev", "user:alice@example.com"})
+	if tags := disco.PeerTags(meta); !slices.Equal(tags, []string{"dev", "user:alice@example.com"}) {
+		t.Fatalf("expected the assigned tags only, got %v", tags)
+	}
+	disco.SetPeerTags(meta, nil)
+	if meta.Has(disco.ACLTagMeta) {
+		t.Fatalf("expected the claimed tags dropped, got %v", disco.PeerTags(meta))
+	}
+	if meta.Get("name") != "laptop" {
+		t.Fatal("expected the other metadata kept")
+	}
+}
+
+func TestACLAllowed(t *testing.T) {
+	acl := disco.ACL{Rules: []disco.ACLRule{
+		{Src: []string{"dev"}, Dst: []string{"db"}, Ports: []string{"tcp:5432"}},
+		{Src: []string{"user:alice@example.com"}, Dst: []string{"*"}},
+		{Src: []string{"ops"}, Dst: []string{"web"}, Ports: []string{"8000-8100"}},
+	}}
+	if err := acl.Check(); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		src, dst []string
+		proto    string
+		port     uint16
+		allowed  bool
+	}{
+		{[]string{"dev"}, []string{"db"}, "tcp", 5432, true},
+		{[]string{"dev"}, []string{"db"}, "udp", 5432, false},
+		{[]string{"dev"}, []string{"db"}, "icmp", 0, false},
+		{[]string{"db"}, []string{"dev"}, "tcp", 5432, false},
+		{[]string{"user:alice@example.com"}, []string{"db"}, "icmp", 0, true},
+		{[]string{"ops"}, []string{"web"}, "udp", 8100, true},
+		{[]string{"ops"}, []string{"web"}, "tcp", 8101, false},
+		{nil, []string{"web"}, "tcp", 80, false},
+	} {
+		if acl.Allowed(c.src, c.dst, c.proto, c.port) != c.allowed {
+			t.Errorf("%v -> %v %s/%d: expected allowed %v", c.src, c.dst, c.proto, c.port, c.allowed)
+		}
+	}
+	if !acl.Reachable([]string{"dev"}, []string{"db"}) || acl.Reachable([]string{"db"}, []string{"dev"}) {
+		t.Error("expected the reachability by the tags regardless of the ports")
+	}
+	if !(disco.ACL{}).Allowed(nil, nil, "tcp", 22) {
+		t.Error("expected the acl without rules allows all")
+	}
+}
+
+func TestACLCheck(t *testing.T) {
+	for _, acl := range []disco.ACL{
+		{Rules: []disco.ACLRule{{Src: []string{"dev"}}}},
+		{Rules: []disco.ACLRule{{Src: []string{"dev"}, Dst: []string{"db"}, Ports: []string{"sctp:1"}}}},
+		{Rules: []disco.ACLRule{{Src: []string{"dev"}, Dst: []string{"db"}, Ports: []string{"9-1"}}}},
+	} {
+		if err := acl.Check(); err == nil {
+			t.Errorf("expected %v refused", acl)
+		}
+	}
+}
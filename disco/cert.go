@@ -0,0 +1,64 @@
+package disco
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidCertificate = errors.New("invalid peer certificate")
+	ErrCertificateExpired = errors.New("peer certificate expired")
+)
+
+// Certificate binds the peer id (and the public key) to the network,
+// it is issued and signed by the peermap server on authentication
+type Certificate struct {
+	Network   string `json:"n"`
+	PeerID    PeerID `json:"p"`
+	PublicKey string `json:"k,omitempty"`
+	NotBefore int64  `json:"nb"`
+	NotAfter  int64  `json:"na"`
+}
+
+// IssueCertificate signs the certificate with the peermap ca key,
+// the result is in the form of base64url(json).base64url(signature)
+func IssueCertificate(caKey ed25519.PrivateKey, cert Certificate) (string, error) {
+	b, err := json.Marshal(cert)
+	if err != nil {
+		return "", err
+	}
+	sig := ed25519.Sign(caKey, b)
+	return base64.RawURLEncoding.EncodeToString(b) + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// VerifyCertificate verifies the signature and the validity period of the certificate
+func VerifyCertificate(caPubKey ed25519.PublicKey, signedCert string) (Certificate, error) {
+	payload, signature, ok := strings.Cut(signedCert, ".")
+	if !ok {
+		return Certificate{}, ErrInvalidCertificate
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return Certificate{}, ErrInvalidCertificate
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return Certificate{}, ErrInvalidCertificate
+	}
+	if len(caPubKey) != ed25519.PublicKeySize || !ed25519.Verify(caPubKey, b, sig) {
+		return Certificate{}, ErrInvalidCertificate
+	}
+	var cert Certificate
+	if err := json.Unmarshal(b, &cert); err != nil {
+		return Certificate{}, ErrInvalidCertificate
+	}
+	now := time.Now().Unix()
+	if now < cert.NotBefore || now > cert.NotAfter {
+		return cert, ErrCertificateExpired
+	}
+	return cert, nil
+}
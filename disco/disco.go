@@ -2,12 +2,14 @@ package disco
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"net/url"
 	"slices"
+	"time"
 
 	"github.com/rkonfj/peerguard/secure"
 )
@@ -24,10 +26,24 @@ func (code ControlCode) String() string {
 		return "NEW_PEER_UDP_ADDR"
 	case CONTROL_LEAD_DISCO:
 		return "LEAD_DISCO"
+	case CONTROL_KEY_EXCHANGE:
+		return "KEY_EXCHANGE"
+	case CONTROL_PEER_CERTIFICATE:
+		return "PEER_CERTIFICATE"
+	case CONTROL_EPHEMERAL_KEY_EXCHANGE:
+		return "EPHEMERAL_KEY_EXCHANGE"
 	case CONTROL_UPDATE_NETWORK_SECRET:
 		return "UPDATE_NETWORK_SECRET"
+	case CONTROL_UPDATE_NETWORK_SECRET_ACK:
+		return "UPDATE_NETWORK_SECRET_ACK"
+	case CONTROL_UPDATE_CERTIFICATE:
+		return "UPDATE_CERTIFICATE"
+	case CONTROL_UPDATE_ACL:
+		return "UPDATE_ACL"
 	case CONTROL_CONN:
 		return "CONTROL_CONN"
+	case CONTROL_QUALITY_REPORT:
+		return "QUALITY_REPORT"
 	default:
 		return "UNDEFINED"
 	}
@@ -38,12 +54,19 @@ func (code ControlCode) Byte() byte {
 }
 
 const (
-	CONTROL_RELAY                 ControlCode = 0
-	CONTROL_NEW_PEER              ControlCode = 1
-	CONTROL_NEW_PEER_UDP_ADDR     ControlCode = 2
-	CONTROL_LEAD_DISCO            ControlCode = 3
-	CONTROL_UPDATE_NETWORK_SECRET ControlCode = 20
-	CONTROL_CONN                  ControlCode = 30
+	CONTROL_RELAY                     ControlCode = 0
+	CONTROL_NEW_PEER                  ControlCode = 1
+	CONTROL_NEW_PEER_UDP_ADDR         ControlCode = 2
+	CONTROL_LEAD_DISCO                ControlCode = 3
+	CONTROL_KEY_EXCHANGE              ControlCode = 10
+	CONTROL_PEER_CERTIFICATE          ControlCode = 11
+	CONTROL_EPHEMERAL_KEY_EXCHANGE    ControlCode = 12
+	CONTROL_UPDATE_NETWORK_SECRET     ControlCode = 20
+	CONTROL_UPDATE_CERTIFICATE        ControlCode = 21
+	CONTROL_UPDATE_NETWORK_SECRET_ACK ControlCode = 22
+	CONTROL_UPDATE_ACL                ControlCode = 23
+	CONTROL_CONN                      ControlCode = 30
+	CONTROL_QUALITY_REPORT            ControlCode = 40
 )
 
 type Error struct {
@@ -98,6 +121,35 @@ const (
 	Internal NATType = "internal"
 )
 
+// NATBehavior is the mapping or the filtering behavior of the NAT (RFC 4787)
+type NATBehavior string
+
+const (
+	BehaviorUnknown         NATBehavior = ""
+	EndpointIndependent     NATBehavior = "endpoint-independent"
+	AddressDependent        NATBehavior = "address-dependent"
+	AddressAndPortDependent NATBehavior = "address-and-port-dependent"
+	// EndpointDependent is address or address and port dependent, the STUN servers do not tell
+	EndpointDependent NATBehavior = "endpoint-dependent"
+)
+
+func (b NATBehavior) String() string {
+	if b == "" {
+		return "unknown"
+	}
+	return string(b)
+}
+
+// NATInfo is the local NAT classified by the STUN servers (RFC 5780)
+type NATInfo struct {
+	Type NATType `json:"type"`
+	// MappedAddr is the addr the primary STUN server sees
+	MappedAddr string      `json:"mappedAddr,omitempty"`
+	Mapping    NATBehavior `json:"mapping,omitempty"`
+	// Filtering is unknown unless the STUN server supports the CHANGE-REQUEST (RFC 5780)
+	Filtering NATBehavior `json:"filtering,omitempty"`
+}
+
 type Disco struct {
 	Magic func() []byte
 }
@@ -134,20 +186,26 @@ type Datagram struct {
 	Data   []byte
 }
 
-// TryDecrypt the datagram from peer
+// TryDecrypt the datagram from peer, nil is returned if the datagram is replayed or it can not be
+// decrypted, the plaintext and the forged datagrams are never returned
 func (d *Datagram) TryDecrypt(symmAlgo secure.SymmAlgo) []byte {
 	if symmAlgo == nil {
 		return d.Data
 	}
 	b, err := symmAlgo.Decrypt(d.Data, d.PeerID.String())
 	if err != nil {
+		if errors.Is(err, secure.ErrReplayedData) {
+			slog.Debug("Datagram replayed", "peer", d.PeerID)
+			return nil
+		}
 		slog.Debug("Datagram decrypt error", "err", err)
-		return d.Data
+		return nil
 	}
 	return b
 }
 
-// TryEncrypt the datagram to peer
+// TryEncrypt the datagram to peer, nil is returned if it can not be encrypted rather than the
+// plaintext
 func (d *Datagram) TryEncrypt(symmAlgo secure.SymmAlgo) []byte {
 	if symmAlgo == nil {
 		return d.Data
@@ -155,7 +213,7 @@ func (d *Datagram) TryEncrypt(symmAlgo secure.SymmAlgo) []byte {
 	b, err := symmAlgo.Encrypt(d.Data, d.PeerID.String())
 	if err != nil {
 		slog.Debug("Datagram encrypt error", "err", err)
-		return d.Data
+		return nil
 	}
 	return b
 }
@@ -164,6 +222,25 @@ func (d *Datagram) TryEncrypt(symmAlgo secure.SymmAlgo) []byte {
 type Peer struct {
 	ID       PeerID
 	Metadata url.Values
+	// Certificate is the peermap signed certificate carries the peer's public key,
+	// it is not verified yet
+	Certificate string
+	// Replayed is true if the peer was introduced before the session to the peermap resumed
+	Replayed bool
+}
+
+// LinkQuality is the connection quality to the peer measured by the node, it is reported
+// to the peermap server by CONTROL_QUALITY_REPORT
+type LinkQuality struct {
+	PeerID PeerID `json:"peer"`
+	// Score is 0 (unusable) to 100 (direct, low latency and no loss)
+	Score   int           `json:"score"`
+	Relayed bool          `json:"relayed"`
+	RTT     time.Duration `json:"rtt"`
+	// Loss is the ratio of the recent pings not replied
+	Loss float64 `json:"loss"`
+	// Flaps is the number of the fallbacks from the direct path to the relay recently
+	Flaps int `json:"flaps"`
 }
 
 // PeerUDPAddr describe the peer udp addr
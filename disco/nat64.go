@@ -0,0 +1,73 @@
+package disco
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+)
+
+// the well-known ipv4 addresses of ipv4only.arpa (RFC 7050), the DNS64 synthesizes the AAAA of
+// them with the NAT64 prefix
+var ipv4OnlyAddrs = []netip.Addr{netip.MustParseAddr("192.0.0.170"), netip.MustParseAddr("192.0.0.171")}
+
+// ErrNoNAT64 is returned if the network has no DNS64/NAT64
+var ErrNoNAT64 = errors.New("no NAT64 prefix is discovered")
+
+// DiscoverNAT64 discovers the NAT64 prefix of the network by resolving the AAAA of ipv4only.arpa
+// (RFC 7050), the prefix is used to reach the ipv4 addresses (the STUN servers and the peers) on
+// the ipv6-only networks like the mobile carriers with 464XLAT
+func DiscoverNAT64(ctx context.Context) (netip.Prefix, error) {
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip6", "ipv4only.arpa")
+	if err != nil {
+		return netip.Prefix{}, errors.Join(ErrNoNAT64, err)
+	}
+	for _, addr := range addrs {
+		if !addr.Is6() || addr.Is4In6() {
+			continue
+		}
+		for _, bits := range []int{96, 64, 56, 48, 40, 32} {
+			for _, v4 := range ipv4OnlyAddrs {
+				prefix := netip.PrefixFrom(addr, bits).Masked()
+				if SynthesizeNAT64(prefix, v4) == addr {
+					return prefix, nil
+				}
+			}
+		}
+	}
+	return netip.Prefix{}, ErrNoNAT64
+}
+
+// SynthesizeNAT64 embeds the ipv4 address in the NAT64 prefix by the RFC 6052 algorithm,
+// the bits 64 to 71 (the u octet) are skipped
+func SynthesizeNAT64(prefix netip.Prefix, v4 netip.Addr) netip.Addr {
+	b := prefix.Addr().As16()
+	ip4 := v4.Unmap().As4()
+	pos := prefix.Bits() / 8
+	for _, octet := range ip4 {
+		if pos == 8 {
+			pos++
+		}
+		b[pos] = octet
+		pos++
+	}
+	return netip.AddrFrom16(b)
+}
+
+// ExtractNAT64 is the ipv4 address embedded in the ipv6 address synthesized with the prefix
+func ExtractNAT64(prefix netip.Prefix, v6 netip.Addr) (netip.Addr, bool) {
+	if !prefix.IsValid() || !v6.Is6() || v6.Is4In6() || !prefix.Contains(v6) {
+		return netip.Addr{}, false
+	}
+	b := v6.As16()
+	var ip4 [4]byte
+	pos := prefix.Bits() / 8
+	for i := range ip4 {
+		if pos == 8 {
+			pos++
+		}
+		ip4[i] = b[pos]
+		pos++
+	}
+	return netip.AddrFrom4(ip4), true
+}
@@ -0,0 +1,205 @@
+package netcheck
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/rkonfj/peerguard/disco"
+	"tailscale.com/net/stun"
+)
+
+const (
+	stunBindingRequest = 0x0001
+	stunMagicCookie    = 0x2112a442
+
+	attrChangeRequest = 0x0003
+	attrChangedAddr   = 0x0005 // RFC 3489
+	attrOtherAddr     = 0x802c // RFC 5780
+
+	changeIP   = 0x04
+	changePort = 0x02
+)
+
+// stunReply is the binding response and the addr it is sent from
+type stunReply struct {
+	from   netip.AddrPort
+	mapped netip.AddrPort
+	other  netip.AddrPort // the alternate addr of the server, invalid if it is not RFC 5780 capable
+}
+
+// ClassifyNAT classifies the mapping and the filtering behavior of the NAT the way of RFC 5780,
+// the servers telling the OTHER-ADDRESS are tested with the alternate ip and port, otherwise the
+// mapping is tested by the other servers and the filtering is unknown. The Type is ip4 if not
+// behind a NAT, easy if the mapping is endpoint-independent and hard if it is not
+func ClassifyNAT(ctx context.Context, servers []string, timeout time.Duration) (info disco.NATInfo) {
+	lc := net.ListenConfig{Control: disco.ControlSocket}
+	pc, err := lc.ListenPacket(ctx, "udp4", ":0")
+	if err != nil {
+		return
+	}
+	conn := pc.(*net.UDPConn)
+	defer conn.Close()
+	bind := func(dst netip.AddrPort, change uint32) (stunReply, error) {
+		return stunBind(ctx, conn, dst, change, timeout)
+	}
+
+	var primary netip.AddrPort
+	var r1 stunReply
+	var others []netip.AddrPort
+	for _, server := range servers {
+		uaddr, err := net.ResolveUDPAddr("udp4", server)
+		if err != nil {
+			continue
+		}
+		addr := uaddr.AddrPort()
+		if primary.IsValid() {
+			if addr.Addr() != primary.Addr() {
+				others = append(others, addr)
+			}
+			continue
+		}
+		if r1, err = bind(addr, 0); err == nil {
+			primary = addr
+		}
+	}
+	if !primary.IsValid() {
+		return
+	}
+	info.MappedAddr = r1.mapped.String()
+
+	if isLocalIP(r1.mapped.Addr()) {
+		info.Type, info.Mapping = disco.IP4, disco.EndpointIndependent
+	} else if r1.other.IsValid() {
+		// mapping test II and III
+		r2, err := bind(netip.AddrPortFrom(r1.other.Addr(), primary.Port()), 0)
+		switch {
+		case err != nil:
+		case r2.mapped == r1.mapped:
+			info.Mapping = disco.EndpointIndependent
+		default:
+			info.Mapping = disco.AddressAndPortDependent
+			if r3, err := bind(r1.other, 0); err == nil && r3.mapped == r2.mapped {
+				info.Mapping = disco.AddressDependent
+			}
+		}
+	} else {
+		for _, other := range others {
+			r2, err := bind(other, 0)
+			if err != nil {
+				continue
+			}
+			info.Mapping = disco.EndpointDependent
+			if r2.mapped == r1.mapped {
+				info.Mapping = disco.EndpointIndependent
+			}
+			break
+		}
+	}
+	if r1.other.IsValid() {
+		// filtering test II and III, the reply must be sent from the alternate addr
+		if r, err := bind(primary, changeIP|changePort); err == nil && r.from.Addr() != primary.Addr() {
+			info.Filtering = disco.EndpointIndependent
+		} else if r, err := bind(primary, changePort); err == nil && r.from.Port() != primary.Port() {
+			info.Filtering = disco.AddressDependent
+		} else {
+			info.Filtering = disco.AddressAndPortDependent
+		}
+	}
+
+	switch {
+	case info.Type == disco.IP4:
+	case info.Mapping == disco.EndpointIndependent:
+		info.Type = disco.Easy
+	case info.Mapping != disco.BehaviorUnknown:
+		info.Type = disco.Hard
+	}
+	return
+}
+
+// stunBind sends the binding request to the dst, it is retransmitted once if no reply in the
+// half of the timeout
+func stunBind(ctx context.Context, conn *net.UDPConn, dst netip.AddrPort, change uint32, timeout time.Duration) (stunReply, error) {
+	txID := stun.NewTxID()
+	req := bindingRequest(txID, change)
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	buf := make([]byte, 1500)
+	for i := range 2 {
+		if _, err := conn.WriteToUDPAddrPort(req, dst); err != nil {
+			return stunReply{}, err
+		}
+		readDeadline := deadline
+		if i == 0 {
+			readDeadline = time.Now().Add(timeout / 2)
+		}
+		conn.SetReadDeadline(readDeadline)
+		for {
+			n, from, err := conn.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				break
+			}
+			tid, mapped, err := stun.ParseResponse(buf[:n])
+			if err != nil || tid != txID {
+				continue
+			}
+			return stunReply{from: from, mapped: mapped, other: otherAddr(buf[:n])}, nil
+		}
+	}
+	return stunReply{}, errors.New("timeout")
+}
+
+// bindingRequest is the STUN binding request with the CHANGE-REQUEST if change is not 0
+func bindingRequest(txID stun.TxID, change uint32) []byte {
+	b := make([]byte, 20, 28)
+	binary.BigEndian.PutUint16(b[0:2], stunBindingRequest)
+	binary.BigEndian.PutUint32(b[4:8], stunMagicCookie)
+	copy(b[8:20], txID[:])
+	if change != 0 {
+		b = binary.BigEndian.AppendUint16(b, attrChangeRequest)
+		b = binary.BigEndian.AppendUint16(b, 4)
+		b = binary.BigEndian.AppendUint32(b, change)
+	}
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)-20))
+	return b
+}
+
+// otherAddr parses the OTHER-ADDRESS (or the CHANGED-ADDRESS) of the binding response
+func otherAddr(b []byte) netip.AddrPort {
+	if len(b) < 20 {
+		return netip.AddrPort{}
+	}
+	attrs := b[20:]
+	for len(attrs) >= 4 {
+		t, l := binary.BigEndian.Uint16(attrs[0:2]), int(binary.BigEndian.Uint16(attrs[2:4]))
+		if len(attrs) < 4+l {
+			break
+		}
+		v := attrs[4 : 4+l]
+		if (t == attrOtherAddr || t == attrChangedAddr) && l >= 8 && v[1] == 0x01 {
+			return netip.AddrPortFrom(netip.AddrFrom4([4]byte(v[4:8])), binary.BigEndian.Uint16(v[2:4]))
+		}
+		attrs = attrs[min(len(attrs), 4+(l+3)&^3):] // padded to 4 bytes
+	}
+	return netip.AddrPort{}
+}
+
+func isLocalIP(ip netip.Addr) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			if local, ok := netip.AddrFromSlice(ipnet.IP); ok && local.Unmap() == ip.Unmap() {
+				return true
+			}
+		}
+	}
+	return false
+}
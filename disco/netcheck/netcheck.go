@@ -0,0 +1,316 @@
+// Package netcheck probes the network conditions of the host that affect the
+// p2p connectivity, i.e. the NAT type, the IPv6 availability, the port mapping
+// services of the gateway and the latency to the STUN and peermap servers
+package netcheck
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/rkonfj/peerguard/disco"
+	"github.com/rkonfj/peerguard/upnp"
+	"tailscale.com/net/stun"
+)
+
+// DefaultSTUNServers is used when no STUN server is configured
+var DefaultSTUNServers = []string{"stun.cloudflare.com:3478", "stun.l.google.com:19302"}
+
+type Config struct {
+	// STUNServers are requested from the same udp socket to find the NAT type
+	STUNServers []string
+	// Peermap is the peermap server url, the latency to it is measured if not empty
+	Peermap string
+	// TLSConfig is used to connect to the peermap server, nil is the default
+	TLSConfig *tls.Config
+	// Timeout of each probe, defaults to 3s
+	Timeout time.Duration
+}
+
+type STUNResult struct {
+	Server     string        `json:"server"`
+	MappedAddr string        `json:"mappedAddr,omitempty"`
+	RTT        time.Duration `json:"rtt,omitempty"`
+	Error      string        `json:"error,omitempty"`
+}
+
+type PortMappingResult struct {
+	Available  bool   `json:"available"`
+	ExternalIP string `json:"externalIP,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+type PeermapResult struct {
+	Server  string        `json:"server"`
+	Latency time.Duration `json:"latency,omitempty"`
+	Error   string        `json:"error,omitempty"`
+}
+
+type Report struct {
+	NATType disco.NATType `json:"natType"`
+	// NAT is the mapping and the filtering behavior classified by ClassifyNAT
+	NAT disco.NATInfo `json:"nat"`
+	// IPv4 is true if the host has a global unicast ipv4 address
+	IPv4 bool `json:"ipv4"`
+	// IPv6 is true if the host has a global unicast ipv6 address
+	IPv6 bool `json:"ipv6"`
+	// IPv6Reachable is true if any STUN server responded over ipv6
+	IPv6Reachable bool              `json:"ipv6Reachable"`
+	STUN4         []STUNResult      `json:"stun4"`
+	STUN6         []STUNResult      `json:"stun6,omitempty"`
+	UPnP          PortMappingResult `json:"upnp"`
+	NATPMP        PortMappingResult `json:"natpmp"`
+	Peermap       *PeermapResult    `json:"peermap,omitempty"`
+	// NAT64 is the NAT64 prefix discovered on the ipv6-only network
+	NAT64 string `json:"nat64,omitempty"`
+}
+
+// Run runs all probes concurrently and reports the results
+func Run(ctx context.Context, cfg Config) (*Report, error) {
+	if len(cfg.STUNServers) == 0 {
+		cfg.STUNServers = DefaultSTUNServers
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 3 * time.Second
+	}
+	report := Report{}
+	var err error
+	report.IPv4, report.IPv6, err = globalAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("list interface addrs: %w", err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(6)
+	go func() {
+		defer wg.Done()
+		report.STUN4 = ProbeSTUN(ctx, "udp4", cfg.STUNServers, cfg.Timeout)
+	}()
+	go func() {
+		defer wg.Done()
+		if !report.IPv6 {
+			return
+		}
+		report.STUN6 = ProbeSTUN(ctx, "udp6", cfg.STUNServers, cfg.Timeout)
+	}()
+	go func() {
+		defer wg.Done()
+		report.NAT = ClassifyNAT(ctx, cfg.STUNServers, cfg.Timeout)
+	}()
+	go func() {
+		defer wg.Done()
+		report.UPnP = probeUPnP()
+		report.NATPMP = probeNATPMP()
+	}()
+	go func() {
+		defer wg.Done()
+		if cfg.Peermap == "" {
+			return
+		}
+		report.Peermap = probePeermap(ctx, cfg.Peermap, cfg.TLSConfig, cfg.Timeout)
+	}()
+	go func() {
+		defer wg.Done()
+		if report.IPv4 || !report.IPv6 {
+			return
+		}
+		nat64Ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+		defer cancel()
+		if prefix, err := disco.DiscoverNAT64(nat64Ctx); err == nil {
+			report.NAT64 = prefix.String()
+		}
+	}()
+	wg.Wait()
+
+	report.NATType = natType(report.STUN4)
+	if report.NATType == disco.Unknown {
+		report.NATType = report.NAT.Type
+	}
+	for _, r := range report.STUN6 {
+		if r.Error == "" {
+			report.IPv6Reachable = true
+			break
+		}
+	}
+	return &report, nil
+}
+
+// natType is easy if multiple STUN servers see the same mapped addr, the same as the disco does
+func natType(results []STUNResult) disco.NATType {
+	var mapped []string
+	for _, r := range results {
+		if r.Error == "" {
+			mapped = append(mapped, r.MappedAddr)
+		}
+	}
+	if len(mapped) < 2 {
+		return disco.Unknown
+	}
+	for _, addr := range mapped[1:] {
+		if addr != mapped[0] {
+			return disco.Hard
+		}
+	}
+	return disco.Easy
+}
+
+func globalAddrs() (ip4, ip6 bool, err error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || !ipnet.IP.IsGlobalUnicast() {
+			continue
+		}
+		ip, _ := netip.AddrFromSlice(ipnet.IP)
+		ip = ip.Unmap()
+		if ip.Is4() && !ip.IsPrivate() {
+			ip4 = true
+		}
+		if ip.Is6() && !ip.IsPrivate() {
+			ip6 = true
+		}
+	}
+	return
+}
+
+// ProbeSTUN requests all STUN servers from one socket, so the mapped addrs are comparable
+func ProbeSTUN(ctx context.Context, network string, servers []string, timeout time.Duration) []STUNResult {
+	results := make([]STUNResult, len(servers))
+	for i, server := range servers {
+		results[i].Server = server
+	}
+	conn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		for i := range results {
+			results[i].Error = err.Error()
+		}
+		return results
+	}
+	defer conn.Close()
+
+	type pending struct {
+		index int
+		sent  time.Time
+	}
+	txs := make(map[stun.TxID]pending)
+	for i, server := range servers {
+		addr, err := net.ResolveUDPAddr(network, server)
+		if err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		txID := stun.NewTxID()
+		txs[txID] = pending{index: i, sent: time.Now()}
+		if _, err := conn.WriteToUDP(stun.Request(txID), addr); err != nil {
+			delete(txs, txID)
+			results[i].Error = err.Error()
+		}
+	}
+
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetReadDeadline(deadline)
+	buf := make([]byte, 1024)
+	for len(txs) > 0 {
+		n, err := conn.Read(buf)
+		if err != nil {
+			break
+		}
+		txID, saddr, err := stun.ParseResponse(buf[:n])
+		if err != nil {
+			continue
+		}
+		p, ok := txs[txID]
+		if !ok {
+			continue
+		}
+		delete(txs, txID)
+		results[p.index].RTT = time.Since(p.sent)
+		results[p.index].MappedAddr = saddr.String()
+	}
+	for _, p := range txs {
+		results[p.index].Error = "timeout"
+	}
+	return results
+}
+
+func probeUPnP() (r PortMappingResult) {
+	nat, err := upnp.Discover()
+	if err != nil {
+		r.Error = err.Error()
+		return
+	}
+	r.Available = true
+	ip, err := nat.GetExternalAddress()
+	if err != nil {
+		r.Error = err.Error()
+		return
+	}
+	r.ExternalIP = ip.String()
+	return
+}
+
+// probeNATPMP requests the external address of the default gateway (RFC 6886)
+func probeNATPMP() (r PortMappingResult) {
+	nat, err := upnp.DiscoverNATPMP()
+	if err != nil {
+		r.Error = err.Error()
+		return
+	}
+	r.Available = true
+	ip, err := nat.GetExternalAddress()
+	if err != nil {
+		r.Error = err.Error()
+		return
+	}
+	r.ExternalIP = ip.String()
+	return
+}
+
+func probePeermap(ctx context.Context, server string, tlsConfig *tls.Config, timeout time.Duration) *PeermapResult {
+	r := PeermapResult{Server: server}
+	serverURL, err := url.Parse(server)
+	if err != nil {
+		r.Error = err.Error()
+		return &r
+	}
+	switch serverURL.Scheme {
+	case "ws":
+		serverURL.Scheme = "http"
+	case "wss":
+		serverURL.Scheme = "https"
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	serverURL.Path, serverURL.RawQuery = "/pg/ca", ""
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, serverURL.String(), nil)
+	if err != nil {
+		r.Error = err.Error()
+		return &r
+	}
+	client := http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	defer client.CloseIdleConnections()
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		r.Error = err.Error()
+		return &r
+	}
+	resp.Body.Close()
+	r.Latency = time.Since(start)
+	if resp.StatusCode != http.StatusOK {
+		r.Error = fmt.Sprintf("unexpected status %s", resp.Status)
+	}
+	return &r
+}
@@ -1,6 +1,7 @@
 package disco
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,22 +9,27 @@ import (
 	"os"
 	"slices"
 	"time"
+
+	"github.com/rkonfj/peerguard/secure"
+	"github.com/rkonfj/peerguard/secure/keyring"
 )
 
 type Peermap struct {
-	store  SecretStore
-	server *url.URL
+	store     SecretStore
+	server    *url.URL
+	fallbacks []*url.URL
+	tlsConfig *tls.Config
+	peerKey   secure.KeyBackend
 }
 
+// NewPeermap the nodes reach the peermap server by the websocket, the server url is one of the
+// http, https, ws and wss schemes. There is no QUIC transport, the server must be reachable over tcp
 func NewPeermap(server *url.URL, store SecretStore) (*Peermap, error) {
 	if store == nil {
 		return nil, errors.New("secret store is required")
 	}
-	if server == nil {
-		return nil, errors.New("peermap server is required")
-	}
-	if !slices.Contains([]string{"https", "wss", "http", "ws"}, server.Scheme) {
-		return nil, fmt.Errorf("invalid peermap server %s", server.String())
+	if err := checkServer(server); err != nil {
+		return nil, err
 	}
 	return &Peermap{
 		store:  store,
@@ -39,10 +45,70 @@ func NewPeermapURL(serverURL string, store SecretStore) (*Peermap, error) {
 	return NewPeermap(sURL, store)
 }
 
+func checkServer(server *url.URL) error {
+	if server == nil {
+		return errors.New("peermap server is required")
+	}
+	if !slices.Contains([]string{"https", "wss", "http", "ws"}, server.Scheme) {
+		return fmt.Errorf("invalid peermap server %s", server.String())
+	}
+	return nil
+}
+
+// AddFallback adds the peermap server the peer fails over to once the servers before it are
+// unreachable, it must share the secret key with the server (e.g. the member of the pgmap cluster)
+func (s *Peermap) AddFallback(serverURL string) error {
+	server, err := url.Parse(serverURL)
+	if err != nil {
+		return fmt.Errorf("invalid peermap url: %w", err)
+	}
+	if err := checkServer(server); err != nil {
+		return err
+	}
+	s.fallbacks = append(s.fallbacks, server)
+	return nil
+}
+
+// Servers are the server and the fallbacks in the order of preference
+func (s *Peermap) Servers() []string {
+	servers := []string{s.server.String()}
+	for _, fallback := range s.fallbacks {
+		servers = append(servers, fallback.String())
+	}
+	return servers
+}
+
 func (s *Peermap) SecretStore() SecretStore {
 	return s.store
 }
 
+// WithClientCertificate presents the client certificate to the peermap server (mutual tls),
+// it authenticates the peer instead of or in addition to the network secret
+func (s *Peermap) WithClientCertificate(cert tls.Certificate) *Peermap {
+	if s.tlsConfig == nil {
+		s.tlsConfig = &tls.Config{}
+	}
+	s.tlsConfig.Certificates = []tls.Certificate{cert}
+	return s
+}
+
+// WithPeerKey proves the peer id to the peermap server by the private key when it requires,
+// so that the peer id bound to the key is not squatted by others
+func (s *Peermap) WithPeerKey(key secure.KeyBackend) *Peermap {
+	s.peerKey = key
+	return s
+}
+
+// PeerKey is the private key of the peer id, nil if not set
+func (s *Peermap) PeerKey() secure.KeyBackend {
+	return s.peerKey
+}
+
+// TLSConfig is the tls config connects to the peermap server, nil is the default
+func (s *Peermap) TLSConfig() *tls.Config {
+	return s.tlsConfig
+}
+
 func (s *Peermap) String() string {
 	return s.server.String()
 }
@@ -56,6 +122,19 @@ type NetworkSecret struct {
 	Secret  string    `json:"secret"`
 	Network string    `json:"network"`
 	Expire  time.Time `json:"expire"`
+	// RefreshToken renews the secret without user interaction after it is expired
+	RefreshToken string `json:"refreshToken,omitempty"`
+}
+
+// DeviceAuthorization is the response of starting an oidc device authorization flow.
+// DeviceCode is generated by peermap, it is used to poll the network secret
+type DeviceAuthorization struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete,omitempty"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval"`
 }
 
 func (s NetworkSecret) Expired() bool {
@@ -70,33 +149,118 @@ func (s *NetworkSecret) UpdateNetworkSecret(secret NetworkSecret) error {
 	s.Secret = secret.Secret
 	s.Network = secret.Network
 	s.Expire = secret.Expire
+	s.RefreshToken = secret.RefreshToken
 	return nil
 }
 
 type FileSecretStore struct {
 	StoreFilePath string
+	// SealingKey encrypts the store file at rest if it is not nil
+	SealingKey []byte
 }
 
 func (s *FileSecretStore) NetworkSecret() (NetworkSecret, error) {
-	f, err := os.Open(s.StoreFilePath)
+	b, err := os.ReadFile(s.StoreFilePath)
 	if err != nil {
-		return NetworkSecret{}, fmt.Errorf("file secret store(%s) open failed: %s", s.StoreFilePath, err)
+		return NetworkSecret{}, fmt.Errorf("file secret store(%s) open failed: %w", s.StoreFilePath, err)
+	}
+	var keys [][]byte
+	if s.SealingKey != nil {
+		keys = append(keys, s.SealingKey)
+	}
+	if b, err = secure.Unseal(b, keys...); err != nil {
+		return NetworkSecret{}, fmt.Errorf("file secret store(%s) unseal failed: %w", s.StoreFilePath, err)
 	}
-	defer f.Close()
 	var secret NetworkSecret
-	if err = json.NewDecoder(f).Decode(&secret); err != nil {
+	if err = json.Unmarshal(b, &secret); err != nil {
 		return secret, fmt.Errorf("file secret store(%s) decode failed: %w", s.StoreFilePath, err)
 	}
 	return secret, nil
 }
 
 func (s *FileSecretStore) UpdateNetworkSecret(secret NetworkSecret) error {
-	f, err := os.Create(s.StoreFilePath)
+	b, err := json.Marshal(secret)
 	if err != nil {
+		return fmt.Errorf("save network secret failed: %w", err)
+	}
+	if s.SealingKey != nil {
+		if b, err = secure.Seal(s.SealingKey, b); err != nil {
+			return fmt.Errorf("seal network secret failed: %w", err)
+		}
+	}
+	if err := os.WriteFile(s.StoreFilePath, b, 0600); err != nil {
 		return fmt.Errorf("update network secret failed: %w", err)
 	}
-	if err := json.NewEncoder(f).Encode(secret); err != nil {
+	return nil
+}
+
+// Remove removes the store file
+func (s *FileSecretStore) Remove() error {
+	if err := os.Remove(s.StoreFilePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// KeyringSecretStore stores the network secret in the os keyring
+type KeyringSecretStore struct {
+	Keyring keyring.Keyring
+	// Account distinguishes the secrets of different peermap servers
+	Account string
+	// Migrate is the file store used before, the secret in it is moved to the keyring once
+	Migrate *FileSecretStore
+}
+
+func (s *KeyringSecretStore) NetworkSecret() (NetworkSecret, error) {
+	b, err := s.Keyring.Get(keyring.Service, s.Account)
+	if errors.Is(err, keyring.ErrNotFound) && s.Migrate != nil {
+		return s.migrate()
+	}
+	if errors.Is(err, keyring.ErrNotFound) {
+		return NetworkSecret{}, fmt.Errorf("keyring secret store(%s): %w", s.Account, os.ErrNotExist)
+	}
+	if err != nil {
+		return NetworkSecret{}, fmt.Errorf("keyring secret store(%s) get failed: %w", s.Account, err)
+	}
+	var secret NetworkSecret
+	if err = json.Unmarshal(b, &secret); err != nil {
+		return secret, fmt.Errorf("keyring secret store(%s) decode failed: %w", s.Account, err)
+	}
+	return secret, nil
+}
+
+func (s *KeyringSecretStore) UpdateNetworkSecret(secret NetworkSecret) error {
+	b, err := json.Marshal(secret)
+	if err != nil {
 		return fmt.Errorf("save network secret failed: %w", err)
 	}
-	return f.Close()
+	if err := s.Keyring.Set(keyring.Service, s.Account, b); err != nil {
+		return fmt.Errorf("update network secret failed: %w", err)
+	}
+	return nil
+}
+
+// Remove removes the network secret from the keyring (and the file not migrated yet)
+func (s *KeyringSecretStore) Remove() error {
+	if s.Migrate != nil {
+		if err := s.Migrate.Remove(); err != nil {
+			return err
+		}
+	}
+	return s.Keyring.Delete(keyring.Service, s.Account)
+}
+
+// migrate moves the secret from the file store to the keyring, the file is removed
+func (s *KeyringSecretStore) migrate() (NetworkSecret, error) {
+	secret, err := s.Migrate.NetworkSecret()
+	if err != nil {
+		return NetworkSecret{}, err
+	}
+	if err := s.UpdateNetworkSecret(secret); err != nil {
+		return NetworkSecret{}, err
+	}
+	if err := os.Remove(s.Migrate.StoreFilePath); err != nil {
+		return NetworkSecret{}, fmt.Errorf("remove the migrated secret file: %w", err)
+	}
+	return secret, nil
 }
@@ -0,0 +1,21 @@
+package disco
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+// ErrPeerKeyProofRequired is responded by the peermap requires the peer proving it holds the private key
+// of the peer id. The peermap identity key and the challenge are sent in the X-Identity and X-Challenge headers
+var ErrPeerKeyProofRequired = Error{Code: 4037, Msg: "the proof of the peer key is required"}
+
+// PeerKeyProof proves the peer holds the private key of the peer id, sharedKey is the X25519
+// shared key of the peer key and the peermap identity key, the challenge is issued by the peermap
+func PeerKeyProof(sharedKey []byte, challenge string, peerID PeerID) string {
+	mac := hmac.New(sha256.New, sharedKey)
+	mac.Write([]byte("pgpeerproof"))
+	mac.Write([]byte(challenge))
+	mac.Write(peerID.Bytes())
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,34 @@
+//go:build linux
+
+package disco
+
+import (
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+var socketMark atomic.Int32
+
+// SetSocketMark marks the packets of the sockets to the peermap server, the STUN servers, the
+// DERP servers and the peers (SO_MARK), so that the policy routing of the exit node routes them
+// by the main routing table rather than the tun. 0 disables the marking
+func SetSocketMark(mark int) {
+	socketMark.Store(int32(mark))
+}
+
+// ControlSocket is the Control of the net.Dialer and the net.ListenConfig applies the socket mark
+func ControlSocket(network, address string, c syscall.RawConn) error {
+	mark := socketMark.Load()
+	if mark == 0 {
+		return nil
+	}
+	var err error
+	if ctrlErr := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, int(mark))
+	}); ctrlErr != nil {
+		return ctrlErr
+	}
+	return err
+}
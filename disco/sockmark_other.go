@@ -0,0 +1,14 @@
+//go:build !linux
+
+package disco
+
+import "syscall"
+
+// SetSocketMark is only supported on linux
+func SetSocketMark(mark int) {
+}
+
+// ControlSocket is the Control of the net.Dialer and the net.ListenConfig, it does nothing
+func ControlSocket(network, address string, c syscall.RawConn) error {
+	return nil
+}
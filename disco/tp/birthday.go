@@ -0,0 +1,144 @@
+package tp
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/rkonfj/peerguard/disco"
+	"github.com/rkonfj/peerguard/tracing"
+)
+
+const (
+	// birthdayProbes is the random ports the easy NAT side pings, 1024 probes hit one of the 256
+	// birthday sockets at 98%
+	birthdayProbes = 1024
+	// birthdayDuration is how long the birthday sockets wait for the probes of the peer
+	birthdayDuration = 30 * time.Second
+)
+
+// traversal is the strategy punching the hole with the peer once the disco pings to its candidate
+// did not reach it
+type traversal int
+
+const (
+	traversalNone traversal = iota
+	// traversalPortScan pings the ports of the hard NAT peer, see UDPConn.portScan
+	traversalPortScan
+	// traversalBirthday opens the birthday sockets behind the local hard NAT for the probes of the
+	// easy NAT peer, see UDPConn.birthdayPunch
+	traversalBirthday
+)
+
+// selectTraversal selects the traversal by the local NAT type and the one of the peer's candidate
+func selectTraversal(local, peer disco.NATType) traversal {
+	if !slices.Contains([]disco.NATType{disco.Easy, disco.IP4, disco.IP6, disco.UPnP}, peer) {
+		return traversalPortScan
+	}
+	if peer == disco.Easy && local == disco.Hard {
+		return traversalBirthday
+	}
+	return traversalNone
+}
+
+// birthdayPunch opens the birthday sockets, each of them pings the easy NAT peer so that the local
+// hard NAT opens a mapping for the peer's probes to the random ports. The first socket the peer
+// reaches is kept for the path to the peer, the others are closed
+func (c *UDPConn) birthdayPunch(punchCtx context.Context, udpAddr disco.PeerUDPAddr) {
+	_, span := tracing.Start(punchCtx, "disco.birthday", "peer", udpAddr.ID, "addr", udpAddr.Addr)
+	defer span.End()
+	slog.Info("[UDP] BirthdayPunching", "peer", udpAddr.ID, "addr", udpAddr.Addr, "sockets", c.discoCfg.BirthdaySockets)
+	defer slog.Info("[UDP] BirthdayExit", "peer", udpAddr.ID, "addr", udpAddr.Addr)
+
+	lc := net.ListenConfig{Control: disco.ControlSocket}
+	conns := make([]*net.UDPConn, 0, c.discoCfg.BirthdaySockets)
+	for range c.discoCfg.BirthdaySockets {
+		conn, err := lc.ListenPacket(context.Background(), "udp4", ":0")
+		if err != nil {
+			slog.Warn("[UDP] BirthdaySocket", "opened", len(conns), "err", err)
+			break
+		}
+		conns = append(conns, conn.(*net.UDPConn))
+	}
+	hit := make(chan *net.UDPConn, 1)
+	for _, conn := range conns {
+		go c.runBirthdayConn(conn, udpAddr.ID, hit)
+	}
+
+	ping := c.disco.NewPing(c.cfg.ID)
+	timeout := time.NewTimer(birthdayDuration)
+	defer timeout.Stop()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var kept *net.UDPConn
+	defer func() {
+		for _, conn := range conns {
+			if conn != kept {
+				conn.Close()
+			}
+		}
+	}()
+	for {
+		for _, conn := range conns {
+			conn.WriteToUDP(ping, udpAddr.Addr)
+		}
+		select {
+		case <-c.closedSig:
+			return
+		case <-timeout.C:
+			return
+		case kept = <-hit:
+			slog.Info("[UDP] BirthdayHit", "peer", udpAddr.ID, "local", kept.LocalAddr())
+			span.SetAttr("hit_port", kept.LocalAddr().(*net.UDPAddr).Port)
+			return
+		case <-ticker.C:
+			if ctx, ok := c.findPeer(udpAddr.ID); ok && ctx.ready() {
+				return // reached by the other path
+			}
+		}
+	}
+}
+
+// runBirthdayConn waits for the ping of the peer on the birthday socket. The first socket reached
+// is kept for the peer's addr (see connTo) and handles the packets until the path is idle
+func (c *UDPConn) runBirthdayConn(conn *net.UDPConn, peerID disco.PeerID, hit chan<- *net.UDPConn) {
+	buf := make([]byte, 65535)
+	conn.SetReadDeadline(time.Now().Add(birthdayDuration))
+	var kept string
+	defer func() {
+		if kept != "" {
+			c.birthdayConns.CompareAndDelete(kept, conn)
+			conn.Close()
+		}
+	}()
+	idle := max(time.Minute, 3*c.cfg.PeerKeepaliveInterval)
+	for {
+		n, peerAddr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if kept == "" {
+			if c.disco.ParsePing(buf[:n]) != peerID {
+				continue
+			}
+			if _, loaded := c.birthdayConns.LoadOrStore(peerAddr.String(), conn); loaded {
+				return
+			}
+			kept = peerAddr.String()
+			hit <- conn
+		}
+		conn.SetReadDeadline(time.Now().Add(idle))
+		c.handlePacket(buf[:n], peerAddr)
+	}
+}
+
+// connTo is the socket the packets to the addr are sent from, the birthday socket if the addr is
+// reached by it
+func (c *UDPConn) connTo(addr *net.UDPAddr) *net.UDPConn {
+	if conn, ok := c.birthdayConns.Load(addr.String()); ok {
+		return conn.(*net.UDPConn)
+	}
+	return c.rawConn.Load()
+}
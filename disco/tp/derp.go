@@ -0,0 +1,321 @@
+package tp
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rkonfj/peerguard/crash"
+	"github.com/rkonfj/peerguard/disco"
+	"github.com/rkonfj/peerguard/secure"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/salsa20/salsa"
+	"storj.io/common/base58"
+)
+
+// The frames of the tailscale DERP protocol, a frame is the 1 byte type, the 4 bytes big endian
+// length and the payload. Only the frames used by the clients are listed
+const (
+	derpFrameServerKey     = 0x01
+	derpFrameClientInfo    = 0x02
+	derpFrameServerInfo    = 0x03
+	derpFrameSendPacket    = 0x04
+	derpFrameRecvPacket    = 0x05
+	derpFrameKeepAlive     = 0x06
+	derpFrameNotePreferred = 0x07
+	derpFramePeerGone      = 0x08
+	derpFramePing          = 0x12
+	derpFramePong          = 0x13
+
+	derpProtocolVersion = 2
+	derpMagic           = "DERP🔑"
+	derpKeyLen          = 32
+	derpMaxFrameSize    = 1 << 20
+)
+
+// DERPConn relays the datagrams by a tailscale compatible DERP server rather than the peermap,
+// the peers are addressed by the curve25519 public keys, i.e. the peer ids of the secure mode
+type DERPConn struct {
+	server    string
+	key       secure.KeyBackend
+	closedSig chan struct{}
+	closed    atomic.Bool
+	datagrams chan *disco.Datagram
+
+	conn       atomic.Pointer[derpClient]
+	writeMutex sync.Mutex
+}
+
+type derpClient struct {
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+// DialDERP connects to the DERP server (e.g. https://derp1.tailscale.com) as the key, the
+// connection is reestablished in the background once it is broken
+func DialDERP(ctx context.Context, server string, key secure.KeyBackend) (*DERPConn, error) {
+	c := &DERPConn{
+		server:    server,
+		key:       key,
+		closedSig: make(chan struct{}),
+		datagrams: make(chan *disco.Datagram, 50),
+	}
+	client, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.conn.Store(client)
+	go c.runReadLoop()
+	return c, nil
+}
+
+// ServerURL is the DERP server connected
+func (c *DERPConn) ServerURL() string {
+	return c.server
+}
+
+func (c *DERPConn) Datagrams() <-chan *disco.Datagram {
+	return c.datagrams
+}
+
+// WriteTo relays the datagram to the peer connected to the same DERP server
+func (c *DERPConn) WriteTo(p []byte, peerID disco.PeerID) error {
+	dst := base58.Decode(peerID.String())
+	if len(dst) != derpKeyLen {
+		return fmt.Errorf("peer %s is not addressable by the DERP server", peerID)
+	}
+	client := c.conn.Load()
+	if client == nil {
+		return errors.New("DERP server is not connected")
+	}
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	client.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	return writeDERPFrame(client.conn, derpFrameSendPacket, dst, p)
+}
+
+func (c *DERPConn) Close() error {
+	if !c.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+	close(c.closedSig)
+	if client := c.conn.Swap(nil); client != nil {
+		return client.conn.Close()
+	}
+	return nil
+}
+
+// dial upgrades the http connection to the DERP protocol and handshakes as the key
+func (c *DERPConn) dial(ctx context.Context) (*derpClient, error) {
+	u, err := url.Parse(c.server)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DERP server %s: %w", c.server, err)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "http" {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		} else {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		}
+	}
+	d := net.Dialer{Control: disco.ControlSocket}
+	conn, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, fmt.Errorf("dial DERP server %s: %w", c.server, err)
+	}
+	if u.Scheme != "http" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("tls handshake with DERP server %s: %w", c.server, err)
+		}
+		conn = tlsConn
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+	}
+	client, err := c.handshake(conn, u.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	slog.Info("DERPConnected", "server", c.server)
+	return client, nil
+}
+
+func (c *DERPConn) handshake(conn net.Conn, host string) (*derpClient, error) {
+	req, err := http.NewRequest(http.MethodGet, "http://"+host+"/derp", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Upgrade", "DERP")
+	req.Header.Set("Connection", "Upgrade")
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, fmt.Errorf("upgrade to DERP: %w", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("upgrade to DERP: server responded %s", resp.Status)
+	}
+
+	typ, b, err := readDERPFrame(br)
+	if err != nil {
+		return nil, fmt.Errorf("read DERP server key: %w", err)
+	}
+	if typ != derpFrameServerKey || len(b) < len(derpMagic)+derpKeyLen || string(b[:len(derpMagic)]) != derpMagic {
+		return nil, errors.New("invalid DERP server key frame")
+	}
+	serverKey := b[len(derpMagic) : len(derpMagic)+derpKeyLen]
+
+	// the client info is sealed by the nacl box of the client key and the server key
+	shared, err := c.key.SharedKey(base58.Encode(serverKey))
+	if err != nil {
+		return nil, err
+	}
+	if len(shared) != 32 {
+		return nil, errors.New("invalid shared key with the DERP server")
+	}
+	var boxKey [32]byte
+	salsa.HSalsa20(&boxKey, &[16]byte{}, (*[32]byte)(shared), &salsa.Sigma)
+	var nonce [24]byte
+	rand.Read(nonce[:])
+	info, _ := json.Marshal(map[string]any{"version": derpProtocolVersion})
+	sealed := box.SealAfterPrecomputation(nil, info, &nonce, &boxKey)
+	if err := writeDERPFrame(conn, derpFrameClientInfo, base58.Decode(c.key.Public()), nonce[:], sealed); err != nil {
+		return nil, err
+	}
+	if typ, _, err = readDERPFrame(br); err != nil {
+		return nil, fmt.Errorf("read DERP server info: %w", err)
+	}
+	if typ != derpFrameServerInfo {
+		return nil, fmt.Errorf("unexpected DERP frame %#x, server info expected", typ)
+	}
+	// this server is the home of the peer, the packets to it are delivered here
+	if err := writeDERPFrame(conn, derpFrameNotePreferred, []byte{1}); err != nil {
+		return nil, err
+	}
+	return &derpClient{conn: conn, br: br}, nil
+}
+
+func (c *DERPConn) runReadLoop() {
+	defer crash.Recover("disco/derpread")
+	for {
+		client := c.conn.Load()
+		if client == nil {
+			return
+		}
+		err := c.read(client)
+		if c.closed.Load() {
+			return
+		}
+		slog.Warn("DERPDisconnected", "server", c.server, "err", err)
+		client.conn.Close()
+		for {
+			select {
+			case <-c.closedSig:
+				return
+			case <-time.After(2 * time.Second):
+			}
+			next, err := c.dial(context.Background())
+			if err != nil {
+				slog.Error("DERPConnectFailed", "server", c.server, "err", err)
+				continue
+			}
+			if !c.conn.CompareAndSwap(client, next) { // closed
+				next.conn.Close()
+				return
+			}
+			break
+		}
+	}
+}
+
+func (c *DERPConn) read(client *derpClient) error {
+	for {
+		typ, b, err := readDERPFrame(client.br)
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case derpFrameRecvPacket:
+			if len(b) < derpKeyLen {
+				continue
+			}
+			datagram := disco.Datagram{
+				PeerID: disco.PeerID(base58.Encode(b[:derpKeyLen])),
+				Data:   b[derpKeyLen:],
+			}
+			select {
+			case c.datagrams <- &datagram:
+			case <-c.closedSig:
+				return net.ErrClosed
+			}
+		case derpFramePing:
+			c.writeMutex.Lock()
+			client.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			err := writeDERPFrame(client.conn, derpFramePong, b)
+			c.writeMutex.Unlock()
+			if err != nil {
+				return err
+			}
+		case derpFramePeerGone:
+			if len(b) >= derpKeyLen {
+				slog.Debug("DERPPeerGone", "peer", base58.Encode(b[:derpKeyLen]))
+			}
+		case derpFrameKeepAlive:
+		default: // the frames added by the newer servers are ignored
+		}
+	}
+}
+
+func writeDERPFrame(w io.Writer, typ byte, parts ...[]byte) error {
+	var size int
+	for _, p := range parts {
+		size += len(p)
+	}
+	b := make([]byte, 5, 5+size)
+	b[0] = typ
+	binary.BigEndian.PutUint32(b[1:], uint32(size))
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+func readDERPFrame(r io.Reader) (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > derpMaxFrameSize {
+		return 0, nil, fmt.Errorf("DERP frame too large: %d", size)
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, nil, err
+	}
+	return header[0], b, nil
+}
@@ -0,0 +1,146 @@
+package tp
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rkonfj/peerguard/crash"
+	"github.com/rkonfj/peerguard/disco"
+	"github.com/rkonfj/peerguard/disco/netcheck"
+	"github.com/rkonfj/peerguard/lru"
+)
+
+// Candidate is an udp addr exchanged with the peer by the peermap server for the hole punching
+type Candidate struct {
+	Addr *net.UDPAddr
+	Type disco.NATType
+	// Time is the time the candidate is sent to the peer or received from it
+	Time time.Time
+	// PortScanned is true if the ports around the candidate are scanned since the disco pings did not reach the peer
+	PortScanned bool
+}
+
+// PeerPath is how the peer is reached over udp
+type PeerPath struct {
+	// Candidates are the addrs of the peer the disco pings are sent to
+	Candidates []Candidate
+	// LocalCandidates are the local addrs sent to the peer
+	LocalCandidates []Candidate
+	// Addrs are the addrs the peer is active on (the candidates, or the ones found by the port scanning
+	// or the peer's disco pings). Addr is the one the datagrams are sent to, nil if the peer is not reachable
+	Addrs []PeerState
+	Addr  *net.UDPAddr
+}
+
+type peerCandidates struct {
+	remote, local []Candidate
+}
+
+// candidateStore records the candidates of the recent peers
+type candidateStore struct {
+	mutex sync.Mutex
+	peers *lru.Cache[disco.PeerID, *peerCandidates]
+}
+
+func newCandidateStore() *candidateStore {
+	return &candidateStore{peers: lru.New[disco.PeerID, *peerCandidates](1024)}
+}
+
+func (s *candidateStore) update(peerID disco.PeerID, local bool, addr *net.UDPAddr, modify func(*Candidate)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	peer, ok := s.peers.Get(peerID)
+	if !ok {
+		peer = &peerCandidates{}
+		s.peers.Put(peerID, peer)
+	}
+	list := &peer.remote
+	if local {
+		list = &peer.local
+	}
+	i := slices.IndexFunc(*list, func(c Candidate) bool { return c.Addr.String() == addr.String() })
+	if i < 0 {
+		*list = append(*list, Candidate{Addr: addr})
+		i = len(*list) - 1
+	}
+	modify(&(*list)[i])
+}
+
+func (s *candidateStore) get(peerID disco.PeerID) (remote, local []Candidate) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if peer, ok := s.peers.Get(peerID); ok {
+		return slices.Clone(peer.remote), slices.Clone(peer.local)
+	}
+	return
+}
+
+// received records the candidate received from the peer
+func (s *candidateStore) received(udpAddr disco.PeerUDPAddr) {
+	s.update(udpAddr.ID, false, udpAddr.Addr, func(c *Candidate) {
+		c.Type, c.Time, c.PortScanned = udpAddr.Type, time.Now(), false
+	})
+}
+
+// sent records the local candidate sent to the peer
+func (s *candidateStore) sent(udpAddr disco.PeerUDPAddr) {
+	s.update(udpAddr.ID, true, udpAddr.Addr, func(c *Candidate) {
+		c.Type, c.Time = udpAddr.Type, time.Now()
+	})
+}
+
+func (s *candidateStore) portScanned(udpAddr disco.PeerUDPAddr) {
+	s.update(udpAddr.ID, false, udpAddr.Addr, func(c *Candidate) { c.PortScanned = true })
+}
+
+// PeerPath reports the candidates exchanged with the peer and the addr the peer is reached on
+func (c *UDPConn) PeerPath(peerID disco.PeerID) (path PeerPath) {
+	path.Candidates, path.LocalCandidates = c.candidates.get(peerID)
+	c.peersIndexMutex.RLock()
+	peer, ok := c.peersIndex[peerID]
+	c.peersIndexMutex.RUnlock()
+	if !ok {
+		return
+	}
+	peer.statesMutex.RLock()
+	for _, state := range peer.states {
+		path.Addrs = append(path.Addrs, *state)
+	}
+	peer.statesMutex.RUnlock()
+	if peer.ready() {
+		path.Addr = peer.selectUDPAddr()
+	}
+	return
+}
+
+// NATType is the local NAT type detected by the STUN servers
+func (c *UDPConn) NATType() disco.NATType {
+	if t, ok := c.natType.Load().(disco.NATType); ok {
+		return t
+	}
+	return disco.Unknown
+}
+
+// NATInfo is the local NAT classified by the STUN servers, see netcheck.ClassifyNAT
+func (c *UDPConn) NATInfo() disco.NATInfo {
+	if info := c.natInfo.Load(); info != nil {
+		return *info
+	}
+	return disco.NATInfo{}
+}
+
+// classifyNAT classifies the local NAT, the NAT type is taken if the STUN requests of the disco
+// did not tell it
+func (c *UDPConn) classifyNAT(stunServers []string) {
+	defer crash.Recover("disco/classifynat")
+	info := netcheck.ClassifyNAT(context.Background(), stunServers, 3*time.Second)
+	c.natInfo.Store(&info)
+	if c.NATType() == disco.Unknown {
+		c.natType.Store(info.Type)
+	}
+	slog.Log(context.Background(), -1, "NATClassified", "type", info.Type, "mapping", info.Mapping, "filtering", info.Filtering)
+}
@@ -0,0 +1,92 @@
+package tp
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+
+	"github.com/rkonfj/peerguard/disco"
+	"github.com/rkonfj/peerguard/upnp"
+)
+
+// portMappingLifetime is the lease (seconds) of the port mapping, it is renewed by the next request
+const portMappingLifetime = 24 * 3600
+
+// portMapper maps the external port of the gateway to the internal port of this host, the mapped
+// external addr and the func deleting the mapping are returned
+type portMapper func(internalPort int) (*net.UDPAddr, func(), error)
+
+// requestPortMapping requests the port mapping of the udp socket by the UPnP IGD, the NAT-PMP or the
+// PCP in order, the mapped addr is sent to the peer as the UPnP candidate
+func (c *UDPConn) requestPortMapping(peerID disco.PeerID) {
+	udpConn := c.rawConn.Load()
+	if udpConn == nil {
+		slog.Error("PortMapping", "err", ErrUDPConnNotReady)
+		return
+	}
+	udpPort := int(netip.MustParseAddrPort(udpConn.LocalAddr().String()).Port())
+
+	var errs []error
+	for _, mapPort := range []portMapper{mapPortUPnP, mapPortNATPMP, mapPortPCP} {
+		addr, deleteMapping, err := mapPort(udpPort)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		c.deletePortMapping = deleteMapping
+		c.sendUDPAddr(&disco.PeerUDPAddr{ID: peerID, Addr: addr, Type: disco.UPnP})
+		return
+	}
+	slog.Debug("PortMapping is disabled", "err", errors.Join(errs...))
+}
+
+func mapPortUPnP(udpPort int) (*net.UDPAddr, func(), error) {
+	nat, err := upnp.Discover()
+	if err != nil {
+		return nil, nil, fmt.Errorf("upnp: %w", err)
+	}
+	externalIP, err := nat.GetExternalAddress()
+	if err != nil {
+		return nil, nil, fmt.Errorf("upnp: %w", err)
+	}
+	for i := 0; i < 20; i++ {
+		mappedPort, err := nat.AddPortMapping("udp", udpPort+i, udpPort, "peerguard", portMappingLifetime)
+		if err != nil {
+			continue
+		}
+		return &net.UDPAddr{IP: externalIP, Port: mappedPort},
+			func() { nat.DeletePortMapping("udp", mappedPort, udpPort) }, nil
+	}
+	return nil, nil, errors.New("upnp: no external port is mapped")
+}
+
+func mapPortNATPMP(udpPort int) (*net.UDPAddr, func(), error) {
+	nat, err := upnp.DiscoverNATPMP()
+	if err != nil {
+		return nil, nil, fmt.Errorf("nat-pmp: %w", err)
+	}
+	externalIP, err := nat.GetExternalAddress()
+	if err != nil {
+		return nil, nil, fmt.Errorf("nat-pmp: %w", err)
+	}
+	mappedPort, err := nat.AddPortMapping("udp", udpPort, udpPort, portMappingLifetime)
+	if err != nil {
+		return nil, nil, fmt.Errorf("nat-pmp: %w", err)
+	}
+	return &net.UDPAddr{IP: externalIP, Port: mappedPort},
+		func() { nat.DeletePortMapping("udp", mappedPort, udpPort) }, nil
+}
+
+func mapPortPCP(udpPort int) (*net.UDPAddr, func(), error) {
+	nat, err := upnp.DiscoverPCP()
+	if err != nil {
+		return nil, nil, fmt.Errorf("pcp: %w", err)
+	}
+	addr, err := nat.AddPortMapping("udp", udpPort, udpPort, portMappingLifetime)
+	if err != nil {
+		return nil, nil, fmt.Errorf("pcp: %w", err)
+	}
+	return addr, func() { nat.DeletePortMapping("udp", addr.Port, udpPort) }, nil
+}
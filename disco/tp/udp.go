@@ -15,8 +15,10 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/rkonfj/peerguard/crash"
 	"github.com/rkonfj/peerguard/disco"
-	"github.com/rkonfj/peerguard/upnp"
+	"github.com/rkonfj/peerguard/logging"
+	"github.com/rkonfj/peerguard/tracing"
 	"golang.org/x/time/rate"
 	"tailscale.com/net/stun"
 )
@@ -28,6 +30,7 @@ var defaultDiscoConfig = DiscoConfig{
 	ChallengesRetry:           5,
 	ChallengesInitialInterval: 200 * time.Millisecond,
 	ChallengesBackoffRate:     1.65,
+	BirthdaySockets:           256,
 }
 
 type DiscoConfig struct {
@@ -37,23 +40,37 @@ type DiscoConfig struct {
 	ChallengesRetry           int
 	ChallengesInitialInterval time.Duration
 	ChallengesBackoffRate     float64
+	// BirthdaySockets are opened behind the hard NAT, each of them opens a mapping for the disco pings
+	// of the easy NAT peer to the random ports (the birthday attack), 0 disables it
+	BirthdaySockets int
 }
 
+// SetModifyDiscoConfig modifies the disco config of the UDPConns listened without UDPConfig.Disco
 func SetModifyDiscoConfig(modify func(cfg *DiscoConfig)) {
 	if modify != nil {
 		modify(&defaultDiscoConfig)
 	}
-	defaultDiscoConfig.PortScanOffset = max(min(defaultDiscoConfig.PortScanOffset, 65535), -65535)
-	defaultDiscoConfig.PortScanCount = min(max(32, defaultDiscoConfig.PortScanCount), 65535-1024)
-	defaultDiscoConfig.PortScanDuration = max(time.Second, defaultDiscoConfig.PortScanDuration)
-	defaultDiscoConfig.ChallengesRetry = max(1, defaultDiscoConfig.ChallengesRetry)
-	defaultDiscoConfig.ChallengesInitialInterval = max(10*time.Millisecond, defaultDiscoConfig.ChallengesInitialInterval)
-	defaultDiscoConfig.ChallengesBackoffRate = max(1, defaultDiscoConfig.ChallengesBackoffRate)
+	defaultDiscoConfig = defaultDiscoConfig.normalize()
+}
+
+// normalize clamps the fields to the usable ranges
+func (cfg DiscoConfig) normalize() DiscoConfig {
+	cfg.PortScanOffset = max(min(cfg.PortScanOffset, 65535), -65535)
+	cfg.PortScanCount = min(max(32, cfg.PortScanCount), 65535-1024)
+	cfg.PortScanDuration = max(time.Second, cfg.PortScanDuration)
+	cfg.BirthdaySockets = min(max(0, cfg.BirthdaySockets), 1024)
+	cfg.ChallengesRetry = max(1, cfg.ChallengesRetry)
+	cfg.ChallengesInitialInterval = max(10*time.Millisecond, cfg.ChallengesInitialInterval)
+	cfg.ChallengesBackoffRate = max(1, cfg.ChallengesBackoffRate)
+	return cfg
 }
 
 var (
 	ErrUDPConnNotReady = errors.New("udpConn not ready yet")
 
+	// clatPrefix is the ipv4 service continuity prefix (RFC 7335) the CLAT of 464XLAT uses
+	clatPrefix = &net.IPNet{IP: net.IPv4(192, 0, 0, 0), Mask: net.CIDRMask(29, 32)}
+
 	_ PeerStore = (*UDPConn)(nil)
 )
 
@@ -64,11 +81,14 @@ type UDPConfig struct {
 	ID                    disco.PeerID
 	PeerKeepaliveInterval time.Duration
 	DiscoMagic            func() []byte
+	// Disco tunes the hole punching of this conn, nil uses the default (see SetModifyDiscoConfig)
+	Disco *DiscoConfig
 }
 
 type UDPConn struct {
 	rawConn      atomic.Pointer[net.UDPConn]
 	cfg          UDPConfig
+	discoCfg     DiscoConfig
 	disco        *disco.Disco
 	closedSig    chan int
 	datagrams    chan *disco.Datagram
@@ -80,18 +100,26 @@ type UDPConn struct {
 
 	stunSessionManager stunSessionManager
 
-	upnpDeleteMapping func()
+	deletePortMapping func()
+	birthdayConns     sync.Map // peer udp addr => *net.UDPConn, the socket punched by the birthday attack
 
-	natType disco.NATType
+	natType    atomic.Value // disco.NATType
+	natInfo    atomic.Pointer[disco.NATInfo]
+	candidates *candidateStore
+	nat64      atomic.Pointer[netip.Prefix] // set on the ipv6-only networks only
 }
 
 func (c *UDPConn) Close() error {
-	if c.upnpDeleteMapping != nil {
-		c.upnpDeleteMapping()
+	if c.deletePortMapping != nil {
+		c.deletePortMapping()
 	}
 	if conn := c.rawConn.Load(); conn != nil {
 		conn.Close()
 	}
+	c.birthdayConns.Range(func(k, v any) bool {
+		v.(*net.UDPConn).Close()
+		return true
+	})
 	close(c.closedSig)
 	close(c.datagrams)
 	close(c.stunResponse)
@@ -128,39 +156,8 @@ func (c *UDPConn) UDPAddrSends() <-chan *disco.PeerUDPAddr {
 }
 
 func (c *UDPConn) GenerateLocalAddrsSends(peerID disco.PeerID, stunServers []string) {
-	// UPnP
-	go func() {
-		nat, err := upnp.Discover()
-		if err != nil {
-			slog.Debug("UPnP is disabled", "err", err)
-			return
-		}
-		externalIP, err := nat.GetExternalAddress()
-		if err != nil {
-			slog.Debug("UPnP is disabled", "err", err)
-			return
-		}
-		udpConn := c.rawConn.Load()
-		if udpConn == nil {
-			slog.Error("UPnP discover", "err", ErrUDPConnNotReady)
-			return
-		}
-		udpPort := int(netip.MustParseAddrPort(udpConn.LocalAddr().String()).Port())
-
-		for i := 0; i < 20; i++ {
-			mappedPort, err := nat.AddPortMapping("udp", udpPort+i, udpPort, "peerguard", 24*3600)
-			if err != nil {
-				continue
-			}
-			c.upnpDeleteMapping = func() { nat.DeletePortMapping("udp", mappedPort, udpPort) }
-			c.udpAddrSends <- &disco.PeerUDPAddr{
-				ID:   peerID,
-				Addr: &net.UDPAddr{IP: externalIP, Port: mappedPort},
-				Type: disco.UPnP,
-			}
-			return
-		}
-	}()
+	// UPnP, NAT-PMP or PCP
+	go c.requestPortMapping(peerID)
 	// LAN
 	for _, addr := range c.localAddrs() {
 		uaddr, err := net.ResolveUDPAddr("udp", addr)
@@ -177,11 +174,11 @@ func (c *UDPConn) GenerateLocalAddrsSends(peerID disco.PeerID, stunServers []str
 				natType = disco.IP6
 			}
 		}
-		c.udpAddrSends <- &disco.PeerUDPAddr{
+		c.sendUDPAddr(&disco.PeerUDPAddr{
 			ID:   peerID,
 			Addr: uaddr,
 			Type: natType,
-		}
+		})
 	}
 	// WAN
 	time.AfterFunc(time.Second, func() {
@@ -191,6 +188,12 @@ func (c *UDPConn) GenerateLocalAddrsSends(peerID disco.PeerID, stunServers []str
 	})
 }
 
+// sendUDPAddr sends the local candidate to the peer by the peermap server
+func (c *UDPConn) sendUDPAddr(udpAddr *disco.PeerUDPAddr) {
+	c.candidates.sent(*udpAddr)
+	c.udpAddrSends <- udpAddr
+}
+
 func (c *UDPConn) tryGetPeerkeeper(peerID disco.PeerID) *peerkeeper {
 	if !c.peersIndexMutex.TryRLock() {
 		return nil
@@ -212,6 +215,7 @@ func (c *UDPConn) tryGetPeerkeeper(peerID disco.PeerID) *peerkeeper {
 
 		exitSig:           make(chan struct{}),
 		ping:              c.discoPing,
+		synthesized:       c.isNAT64Addr,
 		keepaliveInterval: c.cfg.PeerKeepaliveInterval,
 	}
 	c.peersIndex[peerID] = &pkeeper
@@ -224,20 +228,25 @@ func (c *UDPConn) RunDiscoMessageSendLoop(udpAddr disco.PeerUDPAddr) {
 	if udpConn == nil {
 		return
 	}
+	c.candidates.received(udpAddr)
 	slog.Log(context.Background(), -2, "RecvPeerAddr", "peer", udpAddr.ID, "udp", udpAddr.Addr, "nat", udpAddr.Type.String())
 	defer slog.Debug("[UDP] DiscoExit", "peer", udpAddr.ID, "addr", udpAddr.Addr)
-	c.discoPing(udpAddr.ID, udpAddr.Addr)
-	interval := defaultDiscoConfig.ChallengesInitialInterval + time.Duration(rand.Intn(50)*int(time.Millisecond))
-	for i := 0; i < defaultDiscoConfig.ChallengesRetry; i++ {
+	punchCtx, span := tracing.Start(context.Background(), "disco.punch", "peer", udpAddr.ID, "addr", udpAddr.Addr, "nat", udpAddr.Type)
+	defer span.End()
+	peerAddr := c.nat64Addr(udpAddr.Addr)
+	c.discoPing(udpAddr.ID, peerAddr)
+	interval := c.discoCfg.ChallengesInitialInterval + time.Duration(rand.Intn(50)*int(time.Millisecond))
+	for i := 0; i < c.discoCfg.ChallengesRetry; i++ {
 		time.Sleep(interval)
 		select {
 		case <-c.closedSig:
 			return
 		default:
 		}
-		c.discoPing(udpAddr.ID, udpAddr.Addr)
-		interval = time.Duration(float64(interval) * defaultDiscoConfig.ChallengesBackoffRate)
-		if c.findPeerID(udpAddr.Addr) != "" {
+		c.discoPing(udpAddr.ID, peerAddr)
+		interval = time.Duration(float64(interval) * c.discoCfg.ChallengesBackoffRate)
+		if c.findPeerID(peerAddr) != "" {
+			span.SetAttr("reached", true)
 			return
 		}
 	}
@@ -246,50 +255,69 @@ func (c *UDPConn) RunDiscoMessageSendLoop(udpAddr disco.PeerUDPAddr) {
 		return
 	}
 
-	if slices.Contains([]disco.NATType{disco.Easy, disco.IP4, disco.IP6, disco.UPnP}, udpAddr.Type) {
-		return
+	switch selectTraversal(c.NATType(), udpAddr.Type) {
+	case traversalPortScan:
+		c.portScan(punchCtx, udpConn, udpAddr, peerAddr)
+	case traversalBirthday:
+		if c.discoCfg.BirthdaySockets > 0 {
+			c.birthdayPunch(punchCtx, udpAddr)
+		}
 	}
+}
 
+// portScan pings the ports around the addr of the hard NAT peer (the port prediction), then the
+// random ports for the birthday sockets of the peer if the local NAT is not hard
+func (c *UDPConn) portScan(punchCtx context.Context, udpConn *net.UDPConn, udpAddr disco.PeerUDPAddr, peerAddr *net.UDPAddr) {
 	slog.Info("[UDP] PortScanning", "peer", udpAddr.ID, "addr", udpAddr.Addr)
-	scan := func(round int) bool {
-		limit := defaultDiscoConfig.PortScanCount / max(1, int(defaultDiscoConfig.PortScanDuration.Seconds()))
+	c.candidates.portScanned(udpAddr)
+	_, scanSpan := tracing.Start(punchCtx, "disco.port_scan", "peer", udpAddr.ID, "addr", udpAddr.Addr)
+	defer scanSpan.End()
+	limit := c.discoCfg.PortScanCount / max(1, int(c.discoCfg.PortScanDuration.Seconds()))
+	scan := func(round int, count int, port func(i int) int) bool {
 		rl := rate.NewLimiter(rate.Limit(limit), limit)
-		for port := udpAddr.Addr.Port + defaultDiscoConfig.PortScanOffset; port <= udpAddr.Addr.Port+defaultDiscoConfig.PortScanCount; port++ {
+		for i := range count {
 			select {
 			case <-c.closedSig:
 				return false
 			default:
 			}
-			p := port % 65536
+			p := port(i) % 65536
 			if p <= 1024 {
 				continue
 			}
 			if ctx, ok := c.findPeer(udpAddr.ID); ok && ctx.ready() {
 				slog.Info("[UDP] PortScanHit", "peer", udpAddr.ID, "round", round, "port", p)
+				scanSpan.SetAttr("hit_port", p)
 				return true
 			}
 			if err := rl.Wait(context.Background()); err != nil {
 				slog.Error("[UDP] PortScanRateLimiter", "err", err)
 				return false
 			}
-			udpConn.WriteToUDP(c.disco.NewPing(c.cfg.ID), &net.UDPAddr{IP: udpAddr.Addr.IP, Port: p})
+			udpConn.WriteToUDP(c.disco.NewPing(c.cfg.ID), &net.UDPAddr{IP: peerAddr.IP, Port: p})
 		}
 		return false
 	}
+	defer slog.Info("[UDP] PortScanExit", "peer", udpAddr.ID, "addr", udpAddr.Addr)
+	from := udpAddr.Addr.Port + c.discoCfg.PortScanOffset
 	for i := range 2 {
-		if scan(i + 1) {
-			break
+		if scan(i+1, c.discoCfg.PortScanCount-c.discoCfg.PortScanOffset+1, func(i int) int { return from + i }) {
+			return
 		}
 	}
-	slog.Info("[UDP] PortScanExit", "peer", udpAddr.ID, "addr", udpAddr.Addr)
+	if c.NATType() == disco.Hard {
+		return
+	}
+	// the random ports for the birthday sockets the peer behind the hard NAT opens
+	scan(3, birthdayProbes, func(int) int { return 1025 + rand.Intn(65536-1025) })
 }
 
 func (c *UDPConn) discoPing(peerID disco.PeerID, peerAddr *net.UDPAddr) {
-	udpConn := c.rawConn.Load()
+	udpConn := c.connTo(peerAddr)
 	if udpConn == nil {
 		return
 	}
-	slog.Debug("[UDP] DiscoPing", "peer", peerID, "addr", peerAddr)
+	logging.Limited(context.Background(), slog.LevelDebug, "discoping/"+peerID.String(), "[UDP] DiscoPing", "peer", peerID, "addr", peerAddr)
 	udpConn.WriteToUDP(c.disco.NewPing(c.cfg.ID), peerAddr)
 }
 
@@ -299,8 +327,22 @@ func (c *UDPConn) localAddrs() []string {
 		slog.Error("ListLocalIPsFailed", "details", err)
 		return nil
 	}
+	// the global ipv6 addrs go first, the peers having global ipv6 as well reach them directly
+	ips = slices.Clone(ips)
+	slices.SortStableFunc(ips, func(ip1, ip2 net.IP) int {
+		if g1, g2 := isGlobalIPv6(ip1), isGlobalIPv6(ip2); g1 != g2 {
+			if g1 {
+				return -1
+			}
+			return 1
+		}
+		return 0
+	})
 	var detectIPs []string
 	for _, ip := range ips {
+		if clatPrefix.Contains(ip) { // reachable by the host itself only
+			continue
+		}
 		addr := net.JoinHostPort(ip.String(), fmt.Sprintf("%d", c.cfg.Port))
 		if ip.To4() != nil {
 			if c.cfg.DisableIPv4 {
@@ -320,7 +362,13 @@ func (c *UDPConn) localAddrs() []string {
 	return detectIPs
 }
 
+// isGlobalIPv6 reports whether the ip is a global unicast ipv6 address, the ula is excluded
+func isGlobalIPv6(ip net.IP) bool {
+	return ip.To4() == nil && ip.IsGlobalUnicast() && !ip.IsPrivate()
+}
+
 func (c *UDPConn) runPacketEventLoop() {
+	defer crash.Recover("disco/udpread")
 	buf := make([]byte, 65535)
 	for {
 		select {
@@ -340,36 +388,38 @@ func (c *UDPConn) runPacketEventLoop() {
 			time.Sleep(10 * time.Millisecond) // avoid busy wait
 			continue
 		}
+		c.handlePacket(buf[:n], peerAddr)
+	}
+}
 
-		// ping
-		if peerID := c.disco.ParsePing(buf[:n]); peerID.Len() > 0 {
-			c.tryGetPeerkeeper(peerID).heartbeat(peerAddr)
-			continue
-		}
+// handlePacket handles the packet read from the udp socket, the disco ping, the stun response or
+// the datagram of the peer
+func (c *UDPConn) handlePacket(pkt []byte, peerAddr *net.UDPAddr) {
+	// ping
+	if peerID := c.disco.ParsePing(pkt); peerID.Len() > 0 {
+		c.tryGetPeerkeeper(peerID).heartbeat(peerAddr)
+		return
+	}
 
-		// stun response
-		if stun.Is(buf[:n]) {
-			slog.Log(context.Background(), -3, "RecvSTUNResponse", "from", peerAddr)
-			b := make([]byte, n)
-			copy(b, buf[:n])
-			c.stunResponse <- b
-			continue
-		}
+	// stun response
+	if stun.Is(pkt) {
+		slog.Log(context.Background(), -3, "RecvSTUNResponse", "from", peerAddr)
+		c.stunResponse <- slices.Clone(pkt)
+		return
+	}
 
-		// datagram
-		peerID := c.findPeerID(peerAddr)
-		if peerID.Len() == 0 {
-			slog.Error("RecvButPeerNotReady", "addr", peerAddr)
-			continue
-		}
-		c.tryGetPeerkeeper(peerID).heartbeat(peerAddr)
-		b := make([]byte, n)
-		copy(b, buf[:n])
-		c.datagrams <- &disco.Datagram{PeerID: peerID, Data: b}
+	// datagram
+	peerID := c.findPeerID(peerAddr)
+	if peerID.Len() == 0 {
+		slog.Error("RecvButPeerNotReady", "addr", peerAddr)
+		return
 	}
+	c.tryGetPeerkeeper(peerID).heartbeat(peerAddr)
+	c.datagrams <- &disco.Datagram{PeerID: peerID, Data: slices.Clone(pkt)}
 }
 
 func (c *UDPConn) runSTUNEventLoop() {
+	defer crash.Recover("disco/stun")
 	for {
 		select {
 		case <-c.closedSig:
@@ -401,14 +451,21 @@ func (c *UDPConn) runSTUNEventLoop() {
 			slog.Error("Skipped resolve udp addr error", "err", err)
 			continue
 		}
+		if tx.ipv6 {
+			c.ipv6AddrFound(string(txid[:]), tx, addr)
+			continue
+		}
 		tx.addrs = append(tx.addrs, addr.String())
 		natAddrFound := func(t disco.NATType) {
+			if info := c.natInfo.Load(); t == disco.Unknown && info != nil {
+				t = info.Type // less than 2 STUN servers responded
+			}
 			if tx.peerID == "" {
-				c.natType = t
+				c.natType.Store(t)
 				slog.Log(context.Background(), -1, "NATAddrFound", "addr", addr, "type", t)
 				return
 			}
-			c.udpAddrSends <- &disco.PeerUDPAddr{ID: tx.peerID, Addr: addr, Type: t}
+			c.sendUDPAddr(&disco.PeerUDPAddr{ID: tx.peerID, Addr: addr, Type: t})
 		}
 		if len(tx.addrs) == 1 {
 			tx.timer = time.AfterFunc(3*time.Second, func() {
@@ -431,7 +488,25 @@ func (c *UDPConn) runSTUNEventLoop() {
 	}
 }
 
+// ipv6AddrFound sends the ipv6 mapped addr to the peer, the addr is the same as the local one
+// unless the network translates the ipv6 prefix (NPTv6), which keeps the port as well
+func (c *UDPConn) ipv6AddrFound(txid string, tx *stunSession, addr *net.UDPAddr) {
+	if slices.Contains(tx.addrs, addr.String()) {
+		return
+	}
+	if len(tx.addrs) == 0 {
+		tx.timer = time.AfterFunc(3*time.Second, func() { c.stunSessionManager.Remove(txid) })
+	}
+	tx.addrs = append(tx.addrs, addr.String())
+	slog.Log(context.Background(), -1, "IPv6AddrFound", "addr", addr)
+	if tx.peerID == "" || slices.Contains(c.localAddrs(), addr.String()) { // sent as the local addr already
+		return
+	}
+	c.sendUDPAddr(&disco.PeerUDPAddr{ID: tx.peerID, Addr: addr, Type: disco.IP6})
+}
+
 func (c *UDPConn) runPeersHealthcheckLoop() {
+	defer crash.Recover("disco/healthcheck")
 	ticker := time.NewTicker(c.cfg.PeerKeepaliveInterval/2 + time.Second)
 	for {
 		select {
@@ -457,8 +532,16 @@ func (c *UDPConn) RequestSTUN(peerID disco.PeerID, stunServers []string) {
 	if udpConn == nil {
 		return
 	}
-	txID := stun.NewTxID()
-	c.stunSessionManager.Set(string(txID[:]), peerID)
+	// the ipv6 mapped addrs are requested in a separate transaction, they must not be mistaken
+	// for the multiple mappings of a hard NAT
+	txID, txID6 := stun.NewTxID(), stun.NewTxID()
+	c.stunSessionManager.Set(string(txID[:]), peerID, false)
+	if !c.cfg.DisableIPv6 {
+		c.stunSessionManager.Set(string(txID6[:]), peerID, true)
+	}
+	if peerID.Len() == 0 && !c.cfg.DisableIPv4 {
+		go c.classifyNAT(slices.Clone(stunServers))
+	}
 	rand.Shuffle(len(stunServers), func(i, j int) { stunServers[i], stunServers[j] = stunServers[j], stunServers[i] })
 	for _, stunServer := range stunServers {
 		uaddr, err := net.ResolveUDPAddr("udp", stunServer)
@@ -466,11 +549,17 @@ func (c *UDPConn) RequestSTUN(peerID disco.PeerID, stunServers []string) {
 			slog.Error("Invalid STUN addr", "addr", stunServer, "err", err.Error())
 			continue
 		}
-		_, err = udpConn.WriteToUDP(stun.Request(txID), uaddr)
+		_, err = udpConn.WriteToUDP(stun.Request(txID), c.nat64Addr(uaddr))
 		if err != nil {
 			slog.Error("Request STUN server failed", "err", err.Error())
 			continue
 		}
+		if !c.cfg.DisableIPv6 {
+			// the servers without the AAAA record are skipped
+			if uaddr6, err := net.ResolveUDPAddr("udp6", stunServer); err == nil && !uaddr6.IP.Equal(uaddr.IP) {
+				udpConn.WriteToUDP(stun.Request(txID6), uaddr6)
+			}
+		}
 		time.Sleep(50 * time.Millisecond)
 	}
 }
@@ -517,14 +606,20 @@ func (c *UDPConn) findPeer(peerID disco.PeerID) (*peerkeeper, bool) {
 	return nil, false
 }
 
+// PeerReachable reports whether the peer is reached over udp now
+func (c *UDPConn) PeerReachable(peerID disco.PeerID) bool {
+	_, ok := c.findPeer(peerID)
+	return ok
+}
+
 func (c *UDPConn) WriteToUDP(p []byte, peerID disco.PeerID) (int, error) {
 	if peer, ok := c.findPeer(peerID); ok {
 		if addr := peer.selectUDPAddr(); addr != nil {
-			udpConn := c.rawConn.Load()
+			udpConn := c.connTo(addr)
 			if udpConn == nil {
 				return 0, ErrUDPConnNotReady
 			}
-			slog.Log(context.Background(), -3, "[UDP] WriteTo", "peer", peerID, "addr", addr)
+			logging.Limited(context.Background(), -3, "udp/"+peerID.String(), "[UDP] WriteTo", "peer", peerID, "addr", addr)
 			return udpConn.WriteToUDP(p, addr)
 		}
 	}
@@ -571,14 +666,76 @@ func (c *UDPConn) RestartListener() error {
 	if udpConn := c.rawConn.Load(); udpConn != nil {
 		udpConn.Close()
 	}
-	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: c.cfg.Port})
+	lc := net.ListenConfig{Control: disco.ControlSocket}
+	conn, err := lc.ListenPacket(context.Background(), "udp", fmt.Sprintf(":%d", c.cfg.Port))
 	if err != nil {
 		return fmt.Errorf("listen udp error: %w", err)
 	}
-	c.rawConn.Store(conn)
+	c.rawConn.Store(conn.(*net.UDPConn))
+	go c.discoverNAT64()
 	return nil
 }
 
+// discoverNAT64 discovers the NAT64 prefix if the host has no ipv4 address, the ipv4 addresses
+// of the STUN servers and the peers are reached by the synthesized ipv6 addresses then
+func (c *UDPConn) discoverNAT64() {
+	if c.cfg.DisableIPv6 || c.hasIPv4() {
+		c.nat64.Store(nil)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	prefix, err := disco.DiscoverNAT64(ctx)
+	if err != nil {
+		slog.Debug("NAT64", "err", err)
+		c.nat64.Store(nil)
+		return
+	}
+	slog.Info("NAT64Discovered", "prefix", prefix)
+	c.nat64.Store(&prefix)
+}
+
+// hasIPv4 reports whether the host has an ipv4 address other than the one of the CLAT
+func (c *UDPConn) hasIPv4() bool {
+	ips, err := disco.ListLocalIPs()
+	if err != nil {
+		return true
+	}
+	for _, ip := range ips {
+		if ip.To4() != nil && !clatPrefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// NAT64 is the NAT64 prefix used to reach the ipv4 addresses, invalid if not discovered
+func (c *UDPConn) NAT64() netip.Prefix {
+	if prefix := c.nat64.Load(); prefix != nil {
+		return *prefix
+	}
+	return netip.Prefix{}
+}
+
+// nat64Addr translates the ipv4 addr to the ipv6 addr synthesized with the NAT64 prefix
+func (c *UDPConn) nat64Addr(addr *net.UDPAddr) *net.UDPAddr {
+	prefix := c.nat64.Load()
+	if prefix == nil || addr.IP.To4() == nil {
+		return addr
+	}
+	ip, _ := netip.AddrFromSlice(addr.IP.To4())
+	return &net.UDPAddr{IP: disco.SynthesizeNAT64(*prefix, ip).AsSlice(), Port: addr.Port}
+}
+
+func (c *UDPConn) isNAT64Addr(addr *net.UDPAddr) bool {
+	prefix := c.nat64.Load()
+	if prefix == nil || addr.IP.To4() != nil {
+		return false
+	}
+	ip, _ := netip.AddrFromSlice(addr.IP)
+	return prefix.Contains(ip)
+}
+
 func ListenUDP(cfg UDPConfig) (*UDPConn, error) {
 	if cfg.ID.Len() == 0 {
 		return nil, errors.New("peer id is required")
@@ -587,8 +744,14 @@ func ListenUDP(cfg UDPConfig) (*UDPConn, error) {
 		cfg.PeerKeepaliveInterval = 10 * time.Second
 	}
 
+	discoCfg := defaultDiscoConfig
+	if cfg.Disco != nil {
+		discoCfg = cfg.Disco.normalize()
+	}
+
 	udpConn := UDPConn{
 		cfg:                cfg,
+		discoCfg:           discoCfg,
 		disco:              &disco.Disco{Magic: cfg.DiscoMagic},
 		closedSig:          make(chan int),
 		datagrams:          make(chan *disco.Datagram),
@@ -596,6 +759,7 @@ func ListenUDP(cfg UDPConfig) (*UDPConn, error) {
 		stunResponse:       make(chan []byte, 10),
 		peersIndex:         make(map[disco.PeerID]*peerkeeper),
 		stunSessionManager: stunSessionManager{sessions: make(map[string]*stunSession)},
+		candidates:         newCandidateStore(),
 	}
 
 	if err := udpConn.RestartListener(); err != nil {
@@ -623,6 +787,7 @@ type stunSession struct {
 	cTime  time.Time
 	addrs  []string
 	timer  *time.Timer
+	ipv6   bool // requested to the servers over ipv6
 }
 
 type stunSessionManager struct {
@@ -637,10 +802,10 @@ func (m *stunSessionManager) Get(txid string) (*stunSession, bool) {
 	return s, ok
 }
 
-func (m *stunSessionManager) Set(txid string, peerID disco.PeerID) {
+func (m *stunSessionManager) Set(txid string, peerID disco.PeerID, ipv6 bool) {
 	m.Lock()
 	defer m.Unlock()
-	m.sessions[txid] = &stunSession{peerID: peerID, cTime: time.Now()}
+	m.sessions[txid] = &stunSession{peerID: peerID, cTime: time.Now(), ipv6: ipv6}
 }
 
 func (m *stunSessionManager) Remove(txid string) {
@@ -656,6 +821,7 @@ type peerkeeper struct {
 
 	exitSig           chan struct{}
 	ping              func(peerID disco.PeerID, addr *net.UDPAddr)
+	synthesized       func(addr *net.UDPAddr) bool // the addr is translated by the NAT64
 	keepaliveInterval time.Duration
 
 	statesMutex sync.RWMutex
@@ -715,7 +881,21 @@ func (peer *peerkeeper) selectUDPAddr() *net.UDPAddr {
 	if len(candidates) == 0 {
 		return nil
 	}
+	// the native paths are preferred over the ones translated by the NAT64, then the global ipv6
+	// paths over the ipv4 ones, they are not behind a NAT so the mapping never times out
 	slices.SortFunc(candidates, func(c1, c2 PeerState) int {
+		if s1, s2 := peer.synthesized(c1.Addr), peer.synthesized(c2.Addr); s1 != s2 {
+			if s2 {
+				return -1
+			}
+			return 1
+		}
+		if g1, g2 := isGlobalIPv6(c1.Addr.IP), isGlobalIPv6(c2.Addr.IP); g1 != g2 {
+			if g1 {
+				return -1
+			}
+			return 1
+		}
 		if c1.LastActiveTime.After(c2.LastActiveTime) {
 			return -1
 		}
@@ -725,6 +905,7 @@ func (peer *peerkeeper) selectUDPAddr() *net.UDPAddr {
 }
 
 func (peer *peerkeeper) run() {
+	defer crash.Recover("disco/peerkeeper")
 	ticker := time.NewTicker(peer.keepaliveInterval)
 	ping := func() {
 		addrs := make([]*net.UDPAddr, 0, len(peer.states))
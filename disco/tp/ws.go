@@ -2,14 +2,19 @@ package tp
 
 import (
 	"context"
+	"crypto/ed25519"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"math/rand/v2"
 	"net"
 	"net/http"
 	"net/url"
+	"path"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -17,7 +22,10 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/rkonfj/peerguard/crash"
 	"github.com/rkonfj/peerguard/disco"
+	"github.com/rkonfj/peerguard/logging"
+	"github.com/rkonfj/peerguard/tracing"
 	"golang.org/x/time/rate"
 )
 
@@ -26,6 +34,16 @@ var (
 	_ disco.ControllerManager = (*WSConn)(nil)
 )
 
+const (
+	// reconnectInitialBackoff and reconnectMaxBackoff bound the delay between the reconnects to
+	// the peermap, the delay doubles after each failure
+	reconnectInitialBackoff = time.Second
+	reconnectMaxBackoff     = time.Minute
+	// failbackCheckInterval is how often the preferred servers are checked while connected to
+	// the fallback
+	failbackCheckInterval = 30 * time.Second
+)
+
 type WSConn struct {
 	rawConn           atomic.Pointer[websocket.Conn]
 	server            *disco.Peermap
@@ -34,6 +52,8 @@ type WSConn struct {
 	metadata          url.Values
 	closedSig         chan int
 	closed            atomic.Bool
+	reconnecting      atomic.Bool
+	serverIndex       atomic.Int32 // the index of the peermap servers connected
 	datagrams         chan *disco.Datagram
 	peers             chan *disco.Peer
 	peersUDPAddrs     chan *disco.PeerUDPAddr
@@ -45,6 +65,17 @@ type WSConn struct {
 	streamRateLimiter *rate.Limiter
 	controllersMutex  sync.RWMutex
 	controllers       map[uint8][]disco.Controller
+	certificate       atomic.Pointer[string]
+	caPubKey          atomic.Pointer[ed25519.PublicKey]
+	peerKeyChallenge  string
+	peerKeyProof      string
+	// resumeToken resumes the session once reconnected to the same peermap, resumed reports
+	// whether the last dial resumed it
+	resumeToken string
+	resumed     atomic.Bool
+	// knownPeers are the peers introduced, replayed once the session is resumed
+	knownPeersMutex sync.Mutex
+	knownPeers      map[disco.PeerID]disco.Peer
 
 	connData chan []byte
 	connEOF  chan struct{}
@@ -135,7 +166,7 @@ func (c *WSConn) WriteTo(p []byte, peerID disco.PeerID, op disco.ControlCode) er
 }
 
 func (c *WSConn) LeadDisco(peerID disco.PeerID) error {
-	slog.Log(context.Background(), -3, "LeadDisco", "peer", peerID)
+	logging.Limited(context.Background(), -3, "leaddisco/"+peerID.String(), "LeadDisco", "peer", peerID)
 	return c.WriteTo(nil, peerID, disco.CONTROL_LEAD_DISCO)
 }
 
@@ -159,6 +190,22 @@ func (c *WSConn) ServerURL() string {
 	return c.connectedServer
 }
 
+// Certificate is the peer certificate issued by the connected peermap server
+func (c *WSConn) Certificate() string {
+	if cert := c.certificate.Load(); cert != nil {
+		return *cert
+	}
+	return ""
+}
+
+// CA is the public key of the connected peermap server for verifying the peer certificates
+func (c *WSConn) CA() ed25519.PublicKey {
+	if caPubKey := c.caPubKey.Load(); caPubKey != nil {
+		return *caPubKey
+	}
+	return nil
+}
+
 func (c *WSConn) Register(ctr disco.Controller) {
 	c.controllersMutex.Lock()
 	defer c.controllersMutex.Unlock()
@@ -177,19 +224,39 @@ func (c *WSConn) Unregister(ctr disco.Controller) {
 	c.controllers[ctr.Type()] = filterd
 }
 
-func (c *WSConn) dial(ctx context.Context, server string) error {
+func (c *WSConn) dial(ctx context.Context, server string) (err error) {
+	ctx, span := tracing.Start(ctx, "peermap.dial", "peer", c.peerID)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
 	networkSecret, err := c.server.SecretStore().NetworkSecret()
 	if err != nil {
 		return fmt.Errorf("get network secret failed: %w", err)
 	}
 	handshake := http.Header{}
+	tracing.Inject(ctx, handshake)
 	handshake.Set("X-Network", networkSecret.Secret)
 	handshake.Set("X-PeerID", c.peerID.String())
 	handshake.Set("X-Nonce", disco.NewNonce())
 	handshake.Set("X-Metadata", c.metadata.Encode())
+	handshake.Set("X-Client-Version", disco.Version)
+	capabilities := disco.Capabilities
+	if c.server.PeerKey() != nil {
+		capabilities = append(slices.Clone(capabilities), disco.CapPeerKey)
+	}
+	handshake.Set("X-Capabilities", disco.EncodeCapabilities(capabilities))
+	if c.resumeToken != "" {
+		handshake.Set("X-Resume-Token", c.resumeToken)
+	}
+	if c.peerKeyProof != "" {
+		handshake.Set("X-Peer-Proof", c.peerKeyProof)
+		handshake.Set("X-Challenge", c.peerKeyChallenge)
+	}
 	if server == "" {
 		server = c.server.String()
 	}
+	span.SetAttr("server", server)
 	peermap, err := url.Parse(server)
 	if err != nil {
 		return fmt.Errorf("invalid server(%s) format: %w", server, err)
@@ -200,7 +267,10 @@ func (c *WSConn) dial(ctx context.Context, server string) error {
 		peermap.Scheme = "wss"
 	}
 	t1 := time.Now()
-	conn, httpResp, err := websocket.DefaultDialer.DialContext(ctx, peermap.String(), handshake)
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = c.server.TLSConfig()
+	dialer.NetDialContext = (&net.Dialer{Control: disco.ControlSocket}).DialContext
+	conn, httpResp, err := dialer.DialContext(ctx, peermap.String(), handshake)
 	if httpResp != nil && httpResp.StatusCode == http.StatusBadRequest {
 		return fmt.Errorf("address: %s is already in used", c.peerID)
 	}
@@ -208,6 +278,13 @@ func (c *WSConn) dial(ctx context.Context, server string) error {
 		var err disco.Error
 		json.NewDecoder(httpResp.Body).Decode(&err)
 		defer httpResp.Body.Close()
+		if err.Code == disco.ErrPeerKeyProofRequired.Code && c.peerKeyProof == "" && c.server.PeerKey() != nil {
+			if proofErr := c.provePeerKey(httpResp.Header); proofErr != nil {
+				return proofErr
+			}
+			return c.dial(ctx, server)
+		}
+		c.peerKeyProof = ""
 		return err
 	}
 	if httpResp != nil && httpResp.StatusCode == http.StatusTemporaryRedirect {
@@ -215,9 +292,11 @@ func (c *WSConn) dial(ctx context.Context, server string) error {
 		return c.dial(ctx, httpResp.Header.Get("Location"))
 	}
 	if err != nil {
+		c.peerKeyProof = ""
 		return fmt.Errorf("dial server %s: %w", server, err)
 	}
 	slog.Info("PeermapConnected", "server", server, "latency", time.Since(t1))
+	c.peerKeyProof = ""
 
 	if err := c.configureSTUNs(httpResp.Header); err != nil {
 		return err
@@ -227,8 +306,14 @@ func (c *WSConn) dial(ctx context.Context, server string) error {
 		return err
 	}
 
+	if err := c.configureCertificate(httpResp.Header); err != nil {
+		return err
+	}
+
 	c.rawConn.Store(conn)
 	c.nonce = disco.MustParseNonce(httpResp.Header.Get("X-Nonce"))
+	c.resumeToken = httpResp.Header.Get("X-Resume-Token")
+	c.resumed.Store(httpResp.Header.Get("X-Resumed") == "true")
 	c.connectedServer = server
 	c.activeTime.Store(time.Now().Unix())
 	conn.SetPingHandler(func(appData string) error {
@@ -245,6 +330,21 @@ func (c *WSConn) dial(ctx context.Context, server string) error {
 	return nil
 }
 
+// provePeerKey answers the challenge of the peermap by the private key of the peer id
+func (c *WSConn) provePeerKey(respHeader http.Header) error {
+	identity, challenge := respHeader.Get("X-Identity"), respHeader.Get("X-Challenge")
+	if identity == "" || challenge == "" {
+		return disco.ErrPeerKeyProofRequired
+	}
+	sharedKey, err := c.server.PeerKey().SharedKey(identity)
+	if err != nil {
+		return fmt.Errorf("prove peer key: %w", err)
+	}
+	c.peerKeyChallenge = challenge
+	c.peerKeyProof = disco.PeerKeyProof(sharedKey, challenge, c.peerID)
+	return nil
+}
+
 func (c *WSConn) configureSTUNs(respHeader http.Header) error {
 	stunsArg := respHeader.Get("X-STUNs")
 	if stunsArg == "" {
@@ -306,7 +406,162 @@ func (c *WSConn) configureRatelimiter(respHeader http.Header) error {
 	return nil
 }
 
+func (c *WSConn) configureCertificate(respHeader http.Header) error {
+	caArg := respHeader.Get("X-CA")
+	if caArg == "" {
+		slog.Warn("Peer certificate is not supported by the pgmap server")
+		return nil
+	}
+	caPubKey, err := base64.StdEncoding.DecodeString(caArg)
+	if err != nil || len(caPubKey) != ed25519.PublicKeySize {
+		return errors.New("invalid pgmap server: invalid ca public key")
+	}
+	cert := respHeader.Get("X-Certificate")
+	if _, err := disco.VerifyCertificate(caPubKey, cert); err != nil {
+		return fmt.Errorf("invalid pgmap server: %w", err)
+	}
+	c.caPubKey.Store((*ed25519.PublicKey)(&caPubKey))
+	c.certificate.Store(&cert)
+	return nil
+}
+
+func (c *WSConn) updateCertificate(cert string) {
+	if _, err := disco.VerifyCertificate(c.CA(), cert); err != nil {
+		slog.Error("CertificateUpdate", "err", err)
+		return
+	}
+	c.certificate.Store(&cert)
+	slog.Debug("CertificateUpdated")
+}
+
+// reconnect dials the peermap with the exponential backoff until connected, false if the conn is
+// closed. The udp paths to the peers are kept during the outage. The session is resumed by the
+// token if the peermap still holds it, the peermap then introduces only the peers joined during
+// the outage and the known peers are replayed here. Otherwise the peermap introduces all the
+// peers again
+func (c *WSConn) reconnect() bool {
+	c.reconnecting.Store(true)
+	defer c.reconnecting.Store(false)
+	backoff := reconnectInitialBackoff
+	for attempt := 1; ; attempt++ {
+		// the jitter spreads the reconnects of the peers once the peermap is back
+		delay := backoff/2 + time.Duration(rand.Int64N(int64(backoff)))
+		select {
+		case <-c.closedSig:
+			return false
+		case <-time.After(delay):
+		}
+		if err := c.dialServers(context.Background()); err != nil {
+			slog.Error("PeermapConnectFailed", "attempt", attempt, "retry_in", backoff, "err", err)
+			backoff = min(2*backoff, reconnectMaxBackoff)
+			continue
+		}
+		slog.Info("PeermapReconnected", "attempt", attempt, "resumed", c.resumed.Load())
+		if c.resumed.Load() {
+			go c.replayPeers()
+		}
+		return true
+	}
+}
+
+// replayPeers replays the peers introduced before the session resumed
+func (c *WSConn) replayPeers() {
+	c.knownPeersMutex.Lock()
+	peers := make([]disco.Peer, 0, len(c.knownPeers))
+	for _, peer := range c.knownPeers {
+		peers = append(peers, peer)
+	}
+	c.knownPeersMutex.Unlock()
+	for _, peer := range peers {
+		peer.Replayed = true
+		select {
+		case <-c.closedSig:
+			return
+		case c.peers <- &peer:
+		}
+	}
+}
+
+// dialServers dials the server and the fallbacks of the peermap in the order of preference until
+// one of them is connected
+func (c *WSConn) dialServers(ctx context.Context) error {
+	var errs []error
+	for i, server := range c.server.Servers() {
+		if err := c.dial(ctx, server); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if i > 0 {
+			slog.Warn("PeermapFailover", "server", server)
+		}
+		c.serverIndex.Store(int32(i))
+		return nil
+	}
+	return errors.Join(errs...)
+}
+
+// runFailbackLoop checks the health of the preferred servers while connected to the fallback, the
+// signaling migrates back once one of them is healthy
+func (c *WSConn) runFailbackLoop() {
+	defer crash.Recover("disco/wsfailback")
+	ticker := time.NewTicker(failbackCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closedSig:
+			return
+		case <-ticker.C:
+		}
+		index := int(c.serverIndex.Load())
+		if index == 0 || c.reconnecting.Load() {
+			continue
+		}
+		for _, server := range c.server.Servers()[:index] {
+			if err := c.checkHealth(server); err != nil {
+				slog.Debug("PeermapUnhealthy", "server", server, "err", err)
+				continue
+			}
+			slog.Info("PeermapFailback", "server", server)
+			c.RestartListener() // the read loop reconnects to the preferred one
+			break
+		}
+	}
+}
+
+// checkHealth requests the ca of the peermap server, the server is healthy if it is served
+func (c *WSConn) checkHealth(server string) error {
+	u, err := url.Parse(server)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	}
+	u.Path = path.Join(u.Path, "/ca")
+	client := http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: c.server.TLSConfig(),
+			DialContext:     (&net.Dialer{Control: disco.ControlSocket}).DialContext,
+		},
+	}
+	defer client.CloseIdleConnections()
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
 func (c *WSConn) runConnAliveDetector() {
+	defer crash.Recover("disco/wsalive")
 	for {
 		select {
 		case <-c.closedSig:
@@ -316,13 +571,14 @@ func (c *WSConn) runConnAliveDetector() {
 		time.Sleep(time.Second)
 		sec := time.Now().Unix()
 		slog.Log(context.Background(), -6, "CheckAlive", "sec", sec, "active", c.activeTime.Load())
-		if sec-c.activeTime.Load() > 25 {
+		if sec-c.activeTime.Load() > 25 && !c.reconnecting.Load() {
 			c.RestartListener()
 		}
 	}
 }
 
 func (c *WSConn) runEventsReadLoop() {
+	defer crash.Recover("disco/wsread")
 	for {
 		select {
 		case <-c.closedSig:
@@ -345,19 +601,8 @@ func (c *WSConn) runEventsReadLoop() {
 				slog.Error("ReadLoopExited", "details", err.Error())
 			}
 			c.RestartListener()
-			for {
-				select {
-				case <-c.closedSig:
-					return
-				default:
-				}
-				time.Sleep(2 * time.Second)
-				if err := c.dial(context.Background(), ""); err != nil {
-					slog.Error("PeermapConnectFailed", "err", err)
-					time.Sleep(time.Second)
-					continue
-				}
-				break
+			if !c.reconnect() {
+				return
 			}
 			continue
 		}
@@ -380,7 +625,11 @@ func (c *WSConn) handleEvents(b []byte) {
 		c.datagrams <- &disco.Datagram{PeerID: disco.PeerID(b[2 : b[1]+2]), Data: b[b[1]+2:]}
 	case disco.CONTROL_NEW_PEER:
 		meta, _ := url.ParseQuery(string(b[b[1]+2:]))
-		event := disco.Peer{ID: disco.PeerID(b[2 : b[1]+2]), Metadata: meta}
+		event := disco.Peer{ID: disco.PeerID(b[2 : b[1]+2]), Metadata: meta, Certificate: meta.Get("cert")}
+		meta.Del("cert")
+		c.knownPeersMutex.Lock()
+		c.knownPeers[event.ID] = event
+		c.knownPeersMutex.Unlock()
 		c.peers <- &event
 	case disco.CONTROL_NEW_PEER_UDP_ADDR:
 		if b[b[1]+2] != 'a' { // old version without nat type
@@ -408,6 +657,8 @@ func (c *WSConn) handleEvents(b []byte) {
 			break
 		}
 		go c.updateNetworkSecret(secret)
+	case disco.CONTROL_UPDATE_CERTIFICATE:
+		c.updateCertificate(string(b[1:]))
 	case disco.CONTROL_CONN:
 		c.connData <- b[1:]
 	default:
@@ -437,12 +688,21 @@ func (c *WSConn) writeWS(messageType int, data []byte) error {
 }
 
 func (c *WSConn) updateNetworkSecret(secret disco.NetworkSecret) {
+	if secret.RefreshToken == "" { // keep the refresh token obtained on login
+		if current, err := c.server.SecretStore().NetworkSecret(); err == nil {
+			secret.RefreshToken = current.RefreshToken
+		}
+	}
 	for i := 0; i < 5; i++ {
 		if err := c.server.SecretStore().UpdateNetworkSecret(secret); err != nil {
 			slog.Error("NetworkSecretUpdate", "err", err)
 			time.Sleep(time.Second)
 			continue
 		}
+		// the peermap keeps accepting the previous secrets until the ack
+		if err := c.write(append([]byte{disco.CONTROL_UPDATE_NETWORK_SECRET_ACK.Byte()}, secret.Secret...)); err != nil {
+			slog.Warn("NetworkSecretUpdateAck", "err", err)
+		}
 		return
 	}
 	slog.Error("NetworkSecretUpdate give up", "secret", secret)
@@ -460,11 +720,15 @@ func DialPeermap(ctx context.Context, server *disco.Peermap, peerID disco.PeerID
 		connData:      make(chan []byte, 128),
 		connEOF:       make(chan struct{}),
 		controllers:   make(map[uint8][]disco.Controller),
+		knownPeers:    make(map[disco.PeerID]disco.Peer),
 	}
-	if err := wsConn.dial(ctx, ""); err != nil {
+	if err := wsConn.dialServers(ctx); err != nil {
 		return nil, err
 	}
 	go wsConn.runEventsReadLoop()
 	go wsConn.runConnAliveDetector()
+	if len(server.Servers()) > 1 {
+		go wsConn.runFailbackLoop()
+	}
 	return wsConn, nil
 }
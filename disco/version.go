@@ -0,0 +1,44 @@
+package disco
+
+import "strings"
+
+// The capabilities of the client reported to the peermap by the X-Capabilities upgrade header,
+// so that the operators know whether the peers still connected block a protocol upgrade
+const (
+	// CapPeerProof is the client proves the peer id by the private key when challenged
+	CapPeerProof = "peer-proof"
+	// CapSecretAck is the client acks the rotated network secret
+	CapSecretAck = "secret-ack"
+	// CapPeerCertificate is the client verifies the peer certificates issued by the peermap
+	CapPeerCertificate = "peer-cert"
+	// CapQualityReport is the client reports the connection quality to the other peers
+	CapQualityReport = "quality-report"
+	// CapPingRTT is the client echoes the payload of the websocket ping for the rtt measurement
+	CapPingRTT = "ping-rtt"
+	// CapPeerKey is the client holds the private key of the peer id and proves it when challenged,
+	// the peermap binds the public key in the certificate only then
+	CapPeerKey = "peer-key"
+)
+
+// Version is the version of the client reported to the peermap by the X-Client-Version upgrade header,
+// the commands set it on start
+var Version = "unknown"
+
+// Capabilities is the capabilities of this client
+var Capabilities = []string{CapPeerProof, CapSecretAck, CapPeerCertificate, CapQualityReport, CapPingRTT}
+
+// EncodeCapabilities encodes the capabilities as the value of the X-Capabilities header
+func EncodeCapabilities(caps []string) string {
+	return strings.Join(caps, ",")
+}
+
+// ParseCapabilities parses the value of the X-Capabilities header
+func ParseCapabilities(s string) []string {
+	var caps []string
+	for _, c := range strings.Split(s, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			caps = append(caps, c)
+		}
+	}
+	return caps
+}
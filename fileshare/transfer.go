@@ -0,0 +1,293 @@
+package fileshare
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rkonfj/peerguard/disco"
+	"github.com/rkonfj/peerguard/rdt"
+)
+
+// transfer protocol, the sender pushes a file to the receiver
+//
+//	sender   -> offer:  0 | name length(1) | name | size(8)
+//	receiver -> accept: code(1) | received size(8) | sha256 of the received part(32)
+//	sender   -> start:  offset(8) | file content from the offset ... | sha256 of the file(32)
+//	receiver -> result: code(1)
+const (
+	transferOK               byte = 0
+	transferBadRequest       byte = 1
+	transferChecksumMismatch byte = 7
+)
+
+// Sender sends files to the peer running the Receiver
+type Sender struct {
+	Network       string
+	Server        string
+	PrivateKey    string
+	ListenUDPPort int
+	ProgressBar   func(total int64, desc string) ProgressBar
+}
+
+// Send pushes the file to the peer, it resumes from the part received by the peer before
+func (s *Sender) Send(ctx context.Context, file string, peerID disco.PeerID) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.IsDir() {
+		return fmt.Errorf("%s is a directory", file)
+	}
+	name := filepath.Base(file)
+	if len(name) > 255 {
+		return errors.New("file name is too long")
+	}
+
+	pnet := PublicNetwork{Name: s.Network, Server: s.Server, PrivateKey: s.PrivateKey}
+	packetConn, err := pnet.ListenPacket(s.ListenUDPPort)
+	if err != nil {
+		return fmt.Errorf("listen p2p packet failed: %w", err)
+	}
+	listener, err := rdt.Listen(packetConn)
+	if err != nil {
+		return fmt.Errorf("listen rdt: %w", err)
+	}
+	defer listener.Close()
+	conn, err := listener.OpenStream(peerID)
+	if err != nil {
+		return fmt.Errorf("dial peer failed: %w", err)
+	}
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	offer := []byte{0, byte(len(name))}
+	offer = append(offer, name...)
+	offer = binary.BigEndian.AppendUint64(offer, uint64(stat.Size()))
+	if _, err := conn.Write(offer); err != nil {
+		return err
+	}
+	accept := make([]byte, 41)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(conn, accept); err != nil {
+		return fmt.Errorf("read accept: %w", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+	if accept[0] != transferOK {
+		return fmt.Errorf("peer refused the file (code %d)", accept[0])
+	}
+
+	sum := sha256.New()
+	offset := int64(binary.BigEndian.Uint64(accept[1:9]))
+	if offset > 0 {
+		if offset > stat.Size() {
+			offset = 0
+		} else if _, err := io.CopyN(sum, f, offset); err != nil {
+			return err
+		}
+		if offset > 0 && !bytes.Equal(sum.Sum(nil), accept[9:41]) {
+			slog.Info("The received part is not part of the file, restart", "peer", peerID, "size", offset)
+			offset = 0
+		}
+		if offset == 0 {
+			sum.Reset()
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := conn.Write(binary.BigEndian.AppendUint64(nil, uint64(offset))); err != nil {
+		return err
+	}
+
+	var bar ProgressBar = NopProgress{}
+	if s.ProgressBar != nil {
+		bar = s.ProgressBar(stat.Size(), name)
+		bar.Add(int(offset))
+	}
+	if _, err := io.Copy(io.MultiWriter(conn, bar, sum), f); err != nil {
+		return fmt.Errorf("send file failed: %w", err)
+	}
+	if _, err := conn.Write(sum.Sum(nil)); err != nil {
+		return err
+	}
+	result := make([]byte, 1)
+	if _, err := io.ReadFull(conn, result); err != nil {
+		return fmt.Errorf("read result: %w", err)
+	}
+	if result[0] != transferOK {
+		return errors.New("send file failed: checksum mismatched")
+	}
+	return nil
+}
+
+// Receiver receives the files sent by the Sender into the directory
+type Receiver struct {
+	Network       string
+	Server        string
+	PrivateKey    string
+	ListenUDPPort int
+	Dir           string
+	ProgressBar   func(total int64, desc string) ProgressBar
+	// OnReceived is called after a file is received and verified
+	OnReceived func(peerID string, path string, checksum []byte)
+}
+
+// Listen joins the network, the peer id of the receiver is the address of the listener
+func (r *Receiver) Listen() (net.Listener, error) {
+	pnet := PublicNetwork{Name: r.Network, Server: r.Server, PrivateKey: r.PrivateKey}
+	packetConn, err := pnet.ListenPacket(r.ListenUDPPort)
+	if err != nil {
+		return nil, fmt.Errorf("listen p2p packet failed: %w", err)
+	}
+	listener, err := rdt.Listen(packetConn)
+	if err != nil {
+		return nil, fmt.Errorf("listen rdt: %w", err)
+	}
+	return listener, nil
+}
+
+func (r *Receiver) Serve(ctx context.Context, listener net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return nil
+			default:
+			}
+			slog.Debug("Accept failed", "err", err)
+			continue
+		}
+		go func() {
+			defer conn.Close()
+			if err := r.receive(conn); err != nil {
+				slog.Error("Receive file failed", "peer", conn.RemoteAddr(), "err", err)
+			}
+		}()
+	}
+}
+
+func (r *Receiver) receive(conn net.Conn) error {
+	header := make([]byte, 2)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(conn, header); err != nil || header[0] != 0 {
+		conn.Write(append([]byte{transferBadRequest}, make([]byte, 40)...))
+		return fmt.Errorf("invalid offer: %v", err)
+	}
+	offer := make([]byte, int(header[1])+8)
+	if _, err := io.ReadFull(conn, offer); err != nil {
+		return fmt.Errorf("read offer: %w", err)
+	}
+	name := filepath.Base(string(offer[:header[1]]))
+	size := int64(binary.BigEndian.Uint64(offer[header[1]:]))
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		conn.Write(append([]byte{transferBadRequest}, make([]byte, 40)...))
+		return fmt.Errorf("invalid file name %q", offer[:header[1]])
+	}
+
+	path := filepath.Join(r.Dir, name)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		conn.Write(append([]byte{transferBadRequest}, make([]byte, 40)...))
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	received := stat.Size()
+	if received > size {
+		received = 0
+	}
+	sum := sha256.New()
+	if _, err := io.CopyN(sum, f, received); err != nil {
+		return err
+	}
+	accept := []byte{transferOK}
+	accept = binary.BigEndian.AppendUint64(accept, uint64(received))
+	accept = append(accept, sum.Sum(nil)...)
+	if _, err := conn.Write(accept); err != nil {
+		return err
+	}
+
+	start := make([]byte, 8)
+	if _, err := io.ReadFull(conn, start); err != nil {
+		return fmt.Errorf("read start: %w", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+	offset := int64(binary.BigEndian.Uint64(start))
+	if offset != received {
+		if offset != 0 {
+			return fmt.Errorf("invalid start offset %d", offset)
+		}
+		sum = sha256.New()
+	}
+	if offset > 0 {
+		slog.Info("Resume receiving", "file", path, "offset", offset)
+	}
+	if err := receiveContent(conn, f, sum, offset, size, r.progressBar(size, offset, name)); err != nil {
+		return err
+	}
+	checksum := make([]byte, 32)
+	if _, err := io.ReadFull(conn, checksum); err != nil {
+		return fmt.Errorf("read checksum: %w", err)
+	}
+	if !bytes.Equal(checksum, sum.Sum(nil)) {
+		conn.Write([]byte{transferChecksumMismatch})
+		return errors.New("checksum mismatched")
+	}
+	if _, err := conn.Write([]byte{transferOK}); err != nil {
+		return err
+	}
+	if r.OnReceived != nil {
+		r.OnReceived(conn.RemoteAddr().String(), path, checksum)
+	}
+	return nil
+}
+
+func (r *Receiver) progressBar(size, offset int64, desc string) ProgressBar {
+	if r.ProgressBar == nil {
+		return NopProgress{}
+	}
+	bar := r.ProgressBar(size, desc)
+	bar.Add(int(offset))
+	return bar
+}
+
+// receiveContent writes the content from the offset to the file, the received part is kept if interrupted
+func receiveContent(conn net.Conn, f *os.File, sum hash.Hash, offset, size int64, bar ProgressBar) error {
+	if err := f.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(io.MultiWriter(f, sum, bar), conn, size-offset); err != nil {
+		return fmt.Errorf("receive file failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+// Package forward tunnels tcp connections to the ports of the peers over the p2p network.
+// The connections to a peer are multiplexed (connmux) on a reliable stream (rdt)
+package forward
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rkonfj/peerguard/connmux"
+	"github.com/rkonfj/peerguard/disco"
+	"github.com/rkonfj/peerguard/rdt"
+)
+
+// request: version(1) | port(2)
+// response: code(1)
+const (
+	codeOK      byte = 0
+	codeRefused byte = 1
+	codeDenied  byte = 2
+)
+
+var (
+	ErrConnRefused = errors.New("connection refused by the peer")
+	ErrPortDenied  = errors.New("port is not allowed to forward by the peer")
+)
+
+// Client dials the ports of the peers
+type Client struct {
+	listener *rdt.RDTListener
+
+	sessionsMutex sync.Mutex
+	sessions      map[disco.PeerID]*connmux.MuxSession
+}
+
+// NewClient creates the client over the packet conn, i.e. p2p.PeerPacketConn.StreamConn()
+func NewClient(pc net.PacketConn) (*Client, error) {
+	listener, err := rdt.Listen(pc)
+	if err != nil {
+		return nil, fmt.Errorf("listen rdt: %w", err)
+	}
+	return &Client{listener: listener, sessions: make(map[disco.PeerID]*connmux.MuxSession)}, nil
+}
+
+// Dial connects to the tcp port of the peer
+func (c *Client) Dial(ctx context.Context, peerID disco.PeerID, port uint16) (net.Conn, error) {
+	session, err := c.session(peerID)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write([]byte{0, byte(port >> 8), byte(port)}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp := make(chan error, 1)
+	go func() {
+		code := make([]byte, 1)
+		if _, err := io.ReadFull(conn, code); err != nil {
+			resp <- err
+			return
+		}
+		switch code[0] {
+		case codeOK:
+			resp <- nil
+		case codeDenied:
+			resp <- ErrPortDenied
+		default:
+			resp <- ErrConnRefused
+		}
+	}()
+	select {
+	case err := <-resp:
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	case <-ctx.Done():
+		conn.Close()
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Client) session(peerID disco.PeerID) (*connmux.MuxSession, error) {
+	c.sessionsMutex.Lock()
+	defer c.sessionsMutex.Unlock()
+	if session, ok := c.sessions[peerID]; ok && !session.Closed() {
+		return session, nil
+	}
+	conn, err := c.listener.OpenStream(peerID)
+	if err != nil {
+		return nil, fmt.Errorf("open stream: %w", err)
+	}
+	session := connmux.Mux(conn, connmux.NewSeqOdd())
+	c.sessions[peerID] = session
+	return session, nil
+}
+
+func (c *Client) Close() error {
+	return c.listener.Close()
+}
+
+// Server accepts the forwarded connections from the peers
+type Server struct {
+	// Dial connects to the local port, the port is denied if it returns ErrPortDenied
+	Dial func(ctx context.Context, port uint16) (net.Conn, error)
+}
+
+// Serve serves the peers over the packet conn, i.e. p2p.PeerPacketConn.StreamConn()
+func (s *Server) Serve(ctx context.Context, pc net.PacketConn) error {
+	listener, err := rdt.Listen(pc)
+	if err != nil {
+		return fmt.Errorf("listen rdt: %w", err)
+	}
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return nil
+			default:
+			}
+			return err
+		}
+		go s.serveSession(ctx, connmux.Mux(conn, connmux.NewSeqEven()), conn.RemoteAddr())
+	}
+}
+
+func (s *Server) serveSession(ctx context.Context, session *connmux.MuxSession, peer net.Addr) {
+	defer session.Close()
+	for {
+		conn, err := session.Accept()
+		if err != nil {
+			slog.Debug("ForwardSessionClosed", "peer", peer, "err", err)
+			return
+		}
+		go s.serveConn(ctx, conn, peer)
+	}
+}
+
+func (s *Server) serveConn(ctx context.Context, conn net.Conn, peer net.Addr) {
+	defer conn.Close()
+	req := make([]byte, 3)
+	if _, err := io.ReadFull(conn, req); err != nil || req[0] != 0 {
+		slog.Debug("ForwardInvalidRequest", "peer", peer, "err", err)
+		return
+	}
+	port := binary.BigEndian.Uint16(req[1:])
+	dialCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	target, err := s.Dial(dialCtx, port)
+	cancel()
+	if errors.Is(err, ErrPortDenied) {
+		slog.Info("ForwardDenied", "peer", peer, "port", port)
+		conn.Write([]byte{codeDenied})
+		return
+	}
+	if err != nil {
+		slog.Info("ForwardDial", "peer", peer, "port", port, "err", err)
+		conn.Write([]byte{codeRefused})
+		return
+	}
+	defer target.Close()
+	if _, err := conn.Write([]byte{codeOK}); err != nil {
+		return
+	}
+	slog.Debug("Forward", "peer", peer, "port", port)
+	Pipe(conn, target)
+}
+
+// Pipe copies the data between the two connections until one of them is closed
+func Pipe(c1, c2 io.ReadWriteCloser) {
+	var once sync.Once
+	closeBoth := func() {
+		c1.Close()
+		c2.Close()
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(c1, c2)
+		once.Do(closeBoth)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(c2, c1)
+		once.Do(closeBoth)
+	}()
+	wg.Wait()
+}
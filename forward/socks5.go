@@ -0,0 +1,148 @@
+package forward
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// socks5 reply codes (RFC 1928)
+const (
+	socks5Succeeded          byte = 0
+	socks5GeneralFailure     byte = 1
+	socks5NotAllowed         byte = 2
+	socks5HostUnreachable    byte = 4
+	socks5ConnRefused        byte = 5
+	socks5CommandUnsupported byte = 7
+	socks5AddrUnsupported    byte = 8
+)
+
+// ErrHostUnreachable is returned by the SOCKS5 dial function if the host is not a peer
+var ErrHostUnreachable = errors.New("host is not a peer in the network")
+
+// SOCKS5 is a SOCKS5 server (no authentication, CONNECT only) dials the hosts by the dial function
+type SOCKS5 struct {
+	Dial func(ctx context.Context, host string, port uint16) (net.Conn, error)
+}
+
+func (s *SOCKS5) Serve(ctx context.Context, listener net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			if err := s.serveConn(ctx, conn); err != nil {
+				slog.Debug("SOCKS5", "client", conn.RemoteAddr(), "err", err)
+			}
+		}()
+	}
+}
+
+func (s *SOCKS5) serveConn(ctx context.Context, conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[0] != 5 {
+		return fmt.Errorf("unsupported socks version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+	if _, err := conn.Write([]byte{5, 0}); err != nil { // no authentication
+		return err
+	}
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return err
+	}
+	if req[1] != 1 { // CONNECT
+		s.reply(conn, socks5CommandUnsupported)
+		return fmt.Errorf("unsupported command %d", req[1])
+	}
+	var host string
+	switch req[3] {
+	case 1: // ipv4
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return err
+		}
+		host = netip.AddrFrom4([4]byte(b)).String()
+	case 3: // domain name
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return err
+		}
+		b := make([]byte, l[0])
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return err
+		}
+		host = string(b)
+	case 4: // ipv6
+		b := make([]byte, 16)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return err
+		}
+		host = netip.AddrFrom16([16]byte(b)).String()
+	default:
+		s.reply(conn, socks5AddrUnsupported)
+		return fmt.Errorf("unsupported address type %d", req[3])
+	}
+	p := make([]byte, 2)
+	if _, err := io.ReadFull(conn, p); err != nil {
+		return err
+	}
+	port := binary.BigEndian.Uint16(p)
+
+	dialCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	remote, err := s.Dial(dialCtx, host, port)
+	cancel()
+	if err != nil {
+		s.reply(conn, replyCode(err))
+		return fmt.Errorf("dial %s: %w", net.JoinHostPort(host, fmt.Sprint(port)), err)
+	}
+	defer remote.Close()
+	if err := s.reply(conn, socks5Succeeded); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	Pipe(conn, remote)
+	return nil
+}
+
+// reply replies with the unspecified bound address, the clients don't rely on it
+func (s *SOCKS5) reply(conn net.Conn, code byte) error {
+	_, err := conn.Write([]byte{5, code, 0, 1, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+func replyCode(err error) byte {
+	switch {
+	case errors.Is(err, ErrHostUnreachable):
+		return socks5HostUnreachable
+	case errors.Is(err, ErrPortDenied):
+		return socks5NotAllowed
+	case errors.Is(err, ErrConnRefused):
+		return socks5ConnRefused
+	default:
+		return socks5GeneralFailure
+	}
+}
@@ -0,0 +1,109 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Limiter limits the records logged per key, e.g. per peer, so that the verbose diagnostics
+// of the high frequency paths (per packet logs, punch retries) can stay enabled in production.
+// Within each interval the first burst records of the key are logged, then one in every
+// sample records, the others are dropped and counted by the next record logged
+type Limiter struct {
+	burst    int
+	interval time.Duration
+	sample   int
+
+	mutex sync.Mutex
+	keys  map[string]*limitState
+}
+
+type limitState struct {
+	start   time.Time
+	count   int
+	dropped int
+}
+
+// limiterMaxKeys is the number of the keys the idle ones are pruned above
+const limiterMaxKeys = 4096
+
+// NewLimiter creates the limiter, sample 0 drops all the records above the burst
+func NewLimiter(burst int, interval time.Duration, sample int) *Limiter {
+	return &Limiter{
+		burst:    burst,
+		interval: interval,
+		sample:   sample,
+		keys:     make(map[string]*limitState),
+	}
+}
+
+// Allow reports whether the record of the key is logged, dropped is the number of the records
+// of the key dropped since the last one logged
+func (l *Limiter) Allow(key string, now time.Time) (ok bool, dropped int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	s, found := l.keys[key]
+	if !found {
+		if len(l.keys) >= limiterMaxKeys {
+			l.prune(now)
+		}
+		s = &limitState{start: now}
+		l.keys[key] = s
+	}
+	if now.Sub(s.start) >= l.interval {
+		s.start, s.count = now, 0
+	}
+	s.count++
+	if s.count > l.burst && (l.sample <= 0 || (s.count-l.burst)%l.sample != 0) {
+		s.dropped++
+		return false, 0
+	}
+	dropped, s.dropped = s.dropped, 0
+	return true, dropped
+}
+
+// prune drops the keys idle for an interval, the caller must hold the lock
+func (l *Limiter) prune(now time.Time) {
+	for key, s := range l.keys {
+		if now.Sub(s.start) >= l.interval {
+			delete(l.keys, key)
+		}
+	}
+}
+
+// Log logs the record by the default logger if the key is within the limit,
+// the records not enabled by the level are not counted
+func (l *Limiter) Log(ctx context.Context, level slog.Level, key, msg string, args ...any) {
+	logger := slog.Default()
+	if !logger.Enabled(ctx, level) {
+		return
+	}
+	ok, dropped := l.Allow(key, time.Now())
+	if !ok {
+		return
+	}
+	if dropped > 0 {
+		args = append(args, "dropped", dropped)
+	}
+	logger.Log(ctx, level, msg, args...)
+}
+
+var limiter atomic.Pointer[Limiter]
+
+func init() {
+	limiter.Store(NewLimiter(10, time.Second, 100))
+}
+
+// SetLimiter replaces the limiter used by Limited
+func SetLimiter(l *Limiter) {
+	limiter.Store(l)
+}
+
+// Limited logs the record if the key is within the limit of the limiter set up by the flags
+// (10 per second then 1 in 100 by default), the key is usually the message and the peer
+func Limited(ctx context.Context, level slog.Level, key, msg string, args ...any) {
+	limiter.Load().Log(ctx, level, key, msg, args...)
+}
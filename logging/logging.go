@@ -0,0 +1,138 @@
+// Package logging configures the slog default logger of the commands, the format, level and the
+// rotated log file, so that the logs can be ingested by journald or ELK without post-processing
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+const (
+	FormatConsole = "console"
+	FormatText    = "text"
+	FormatJSON    = "json"
+)
+
+var level slog.LevelVar
+
+// AddFlags adds the logging flags, the verbose flag (-V) is kept by the commands
+func AddFlags(flags *pflag.FlagSet) {
+	flags.String("log-format", FormatConsole, "log format (console|text|json)")
+	flags.String("log-level", "", "log level (debug|info|warn|error or a number like -V), overrides -V")
+	flags.String("log-file", "", "write the logs to the file rather than stderr, the file is rotated by size")
+	flags.Int("log-max-size", 100, "max size in megabytes of the log file before it is rotated")
+	flags.Int("log-max-backups", 5, "max number of the rotated log files retained")
+	flags.Int("log-limit-burst", 10, "records of the high frequency logs (e.g. per packet, punch retries) logged per key within the limit interval")
+	flags.Duration("log-limit-interval", time.Second, "interval the log-limit-burst is counted in")
+	flags.Int("log-limit-sample", 100, "log one in every n records of the key above the burst, 0 drops them")
+}
+
+// Setup configures the default logger by the flags, verbose is the level when the log-level flag is not set
+func Setup(flags *pflag.FlagSet, verbose int) error {
+	format, err := flags.GetString("log-format")
+	if err != nil {
+		return err
+	}
+	levelText, err := flags.GetString("log-level")
+	if err != nil {
+		return err
+	}
+	file, err := flags.GetString("log-file")
+	if err != nil {
+		return err
+	}
+	maxSize, err := flags.GetInt("log-max-size")
+	if err != nil {
+		return err
+	}
+	maxBackups, err := flags.GetInt("log-max-backups")
+	if err != nil {
+		return err
+	}
+	if err := setupLimiter(flags); err != nil {
+		return err
+	}
+
+	l := slog.Level(verbose)
+	if levelText != "" {
+		if l, err = ParseLevel(levelText); err != nil {
+			return err
+		}
+	}
+	if format == FormatConsole && file == "" {
+		SetLevel(l)
+		return nil
+	}
+
+	var w io.Writer = os.Stderr
+	if file != "" {
+		if maxSize <= 0 {
+			return errors.New("log-max-size must be positive")
+		}
+		if w, err = OpenRotateFile(file, int64(maxSize)<<20, maxBackups); err != nil {
+			return err
+		}
+	}
+	opts := &slog.HandlerOptions{Level: &level}
+	var handler slog.Handler
+	switch format {
+	case FormatJSON:
+		handler = slog.NewJSONHandler(w, opts)
+	case FormatText, FormatConsole:
+		handler = slog.NewTextHandler(w, opts)
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	SetLevel(l)
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+func setupLimiter(flags *pflag.FlagSet) error {
+	burst, err := flags.GetInt("log-limit-burst")
+	if err != nil {
+		return err
+	}
+	interval, err := flags.GetDuration("log-limit-interval")
+	if err != nil {
+		return err
+	}
+	sample, err := flags.GetInt("log-limit-sample")
+	if err != nil {
+		return err
+	}
+	if burst < 0 || sample < 0 {
+		return errors.New("log-limit-burst and log-limit-sample must not be negative")
+	}
+	if interval <= 0 {
+		return errors.New("log-limit-interval must be positive")
+	}
+	SetLimiter(NewLimiter(burst, interval, sample))
+	return nil
+}
+
+// SetLevel changes the level of the default logger
+func SetLevel(l slog.Level) {
+	level.Set(l)
+	slog.SetLogLoggerLevel(l)
+}
+
+// ParseLevel parses the level name (e.g. debug, warn+2) or the number
+func ParseLevel(s string) (slog.Level, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		return slog.Level(n), nil
+	}
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(strings.TrimSpace(s))); err != nil {
+		return 0, fmt.Errorf("invalid log level %q", s)
+	}
+	return l, nil
+}
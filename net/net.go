@@ -16,11 +16,18 @@ func (deadlineError) Unwrap() error   { return os.ErrDeadlineExceeded }
 
 var ErrDeadline net.Error = &deadlineError{}
 
+// Deadline unblocks the pending operations once the deadline is exceeded. Deadline() keeps
+// delivering until the deadline is refreshed, so that all the blocked and the future operations
+// fail, and it is closed after Close
 type Deadline struct {
 	init               sync.Once
 	deadline           chan struct{}
 	deadlineTimerMutex sync.Mutex
 	deadlineTimer      *time.Timer
+	t                  time.Time
+	stop               chan struct{} // stops the exceeded deadline delivering
+	pumps              sync.WaitGroup
+	closed             bool
 }
 
 func (d *Deadline) SetDeadline(t time.Time) {
@@ -29,19 +36,56 @@ func (d *Deadline) SetDeadline(t time.Time) {
 	})
 	d.deadlineTimerMutex.Lock()
 	defer d.deadlineTimerMutex.Unlock()
-	if d.deadlineTimer != nil {
-		d.deadlineTimer.Stop()
-		d.deadlineTimer = nil
+	if d.closed {
+		return
 	}
+	d.stopTimer()
+	d.t = t
 	if t.IsZero() {
 		return
 	}
-	timeout := time.Until(t)
-	if timeout > 0 {
-		d.deadlineTimer = time.AfterFunc(timeout, func() { d.deadline <- struct{}{} })
-		return
+	stop := make(chan struct{})
+	d.stop = stop
+	d.pumps.Add(1)
+	d.deadlineTimer = time.AfterFunc(max(0, time.Until(t)), func() { d.pump(stop) })
+}
+
+// stopTimer stops the pending timer and the delivering of the exceeded deadline
+func (d *Deadline) stopTimer() {
+	if d.deadlineTimer != nil {
+		if d.deadlineTimer.Stop() {
+			d.pumps.Done()
+		}
+		d.deadlineTimer = nil
+	}
+	if d.stop != nil {
+		close(d.stop)
+		d.stop = nil
 	}
-	d.deadline <- struct{}{}
+}
+
+// pump delivers the exceeded deadline to every receiver until it is stopped
+func (d *Deadline) pump(stop chan struct{}) {
+	defer d.pumps.Done()
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		select {
+		case d.deadline <- struct{}{}:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Exceeded reports whether the deadline is set and has been exceeded
+func (d *Deadline) Exceeded() bool {
+	d.deadlineTimerMutex.Lock()
+	defer d.deadlineTimerMutex.Unlock()
+	return !d.t.IsZero() && !time.Now().Before(d.t)
 }
 
 func (d *Deadline) Deadline() <-chan struct{} {
@@ -55,6 +99,16 @@ func (d *Deadline) Close() error {
 	d.init.Do(func() {
 		d.deadline = make(chan struct{})
 	})
+	d.deadlineTimerMutex.Lock()
+	if d.closed {
+		d.deadlineTimerMutex.Unlock()
+		return nil
+	}
+	d.closed = true
+	d.stopTimer()
+	d.deadlineTimerMutex.Unlock()
+	// the delivering must be done before the channel is closed
+	d.pumps.Wait()
 	close(d.deadline)
 	return nil
 }
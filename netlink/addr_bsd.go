@@ -0,0 +1,34 @@
+//go:build darwin || freebsd || openbsd
+
+package netlink
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	"golang.org/x/net/route"
+)
+
+func AddrSubscribe(ctx context.Context, ch chan<- AddrUpdate) error {
+	return subscribeRoutingSocket(ctx, func(msg route.Message) {
+		m, ok := msg.(*route.InterfaceAddrMessage)
+		if !ok || (m.Type != syscall.RTM_NEWADDR && m.Type != syscall.RTM_DELADDR) ||
+			len(m.Addrs) <= syscall.RTAX_IFA {
+			return
+		}
+		ip := routeAddrIP(m.Addrs[syscall.RTAX_IFA])
+		if ip == nil {
+			return
+		}
+		ipnet := net.IPNet{IP: ip}
+		if mask := routeAddrIP(m.Addrs[syscall.RTAX_NETMASK]); mask != nil {
+			ipnet.Mask = net.IPMask(mask)
+		}
+		ch <- AddrUpdate{
+			New:       m.Type == syscall.RTM_NEWADDR,
+			Addr:      ipnet,
+			LinkIndex: m.Index,
+		}
+	}, func() { close(ch) })
+}
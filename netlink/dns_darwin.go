@@ -0,0 +1,31 @@
+package netlink
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SetupDNS routes the queries of the domain to the server by the resolver file of the domain
+// (/etc/resolver/<domain>), see `man 5 resolver`
+func SetupDNS(ifName string, server netip.Addr, domain string) error {
+	if err := os.MkdirAll("/etc/resolver", 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(resolverFile(domain), []byte(fmt.Sprintf("# added by peerguard\nnameserver %s\n", server)), 0644)
+}
+
+// CleanupDNS removes the resolver file of the domain
+func CleanupDNS(ifName, domain string) error {
+	err := os.Remove(resolverFile(domain))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func resolverFile(domain string) string {
+	return filepath.Join("/etc/resolver", strings.Trim(domain, "."))
+}
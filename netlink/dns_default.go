@@ -0,0 +1,16 @@
+//go:build !linux && !windows && !darwin
+
+package netlink
+
+import (
+	"errors"
+	"net/netip"
+)
+
+func SetupDNS(string, netip.Addr, string) error {
+	return errors.ErrUnsupported
+}
+
+func CleanupDNS(string, string) error {
+	return errors.ErrUnsupported
+}
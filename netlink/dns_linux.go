@@ -0,0 +1,30 @@
+package netlink
+
+import (
+	"fmt"
+	"net/netip"
+	"os/exec"
+	"strings"
+)
+
+// SetupDNS routes the queries of the domain to the server by systemd-resolved, like
+// `resolvectl dns <ifName> <server>` and `resolvectl domain <ifName> ~<domain>`
+func SetupDNS(ifName string, server netip.Addr, domain string) error {
+	if err := resolvectl("dns", ifName, server.String()); err != nil {
+		return err
+	}
+	return resolvectl("domain", ifName, "~"+strings.Trim(domain, "."))
+}
+
+// CleanupDNS reverts the dns settings of the interface
+func CleanupDNS(ifName, domain string) error {
+	return resolvectl("revert", ifName)
+}
+
+func resolvectl(args ...string) error {
+	out, err := exec.Command("resolvectl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("resolvectl %s (systemd-resolved is required): %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
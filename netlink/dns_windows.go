@@ -0,0 +1,39 @@
+//go:build windows
+
+package netlink
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"golang.org/x/sys/windows"
+	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
+)
+
+// SetupDNS sets the server and the search domain of the interface by the IP Helper API
+// (SetInterfaceDnsSettings)
+func SetupDNS(ifName string, server netip.Addr, domain string) error {
+	luid, err := luidByName(ifName)
+	if err != nil {
+		return err
+	}
+	family := winipcfg.AddressFamily(windows.AF_INET)
+	if server.Is6() {
+		family = windows.AF_INET6
+	}
+	if err := luid.SetDNS(family, []netip.Addr{server}, []string{strings.Trim(domain, ".")}); err != nil {
+		return fmt.Errorf("set dns of %s: %w", ifName, err)
+	}
+	return nil
+}
+
+// CleanupDNS flushes the dns settings of the interface
+func CleanupDNS(ifName, domain string) error {
+	luid, err := luidByName(ifName)
+	if err != nil {
+		return err
+	}
+	return errors.Join(luid.FlushDNS(windows.AF_INET), luid.FlushDNS(windows.AF_INET6))
+}
@@ -0,0 +1,217 @@
+package netlink
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	exitTable        = 0x7067
+	exitRulePriority = 28770
+)
+
+// AddExitRoutes routes all the packets but the ones marked by ExitMark to the tun like wg-quick
+// does, the more specific routes of the main routing table are still preferred:
+//
+//	28770: from all lookup main suppress_prefixlength 0
+//	28771: not from all fwmark 0x7067 lookup 28775
+//	default dev <ifName> table 28775
+func AddExitRoutes(ifName string, ipv6 bool) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return err
+	}
+	family, dst := exitFamily(ipv6)
+	err = netlink.RouteReplace(&netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       dst,
+		Scope:     netlink.SCOPE_LINK,
+		Table:     exitTable,
+	})
+	if err != nil {
+		return fmt.Errorf("add exit route: %w", err)
+	}
+	for _, rule := range exitRules(family) {
+		if err := netlink.RuleAdd(rule); err != nil && !errors.Is(err, syscall.EEXIST) {
+			return fmt.Errorf("add exit rule: %w", err)
+		}
+	}
+	return nil
+}
+
+// DelExitRoutes removes the routes and the rules added by AddExitRoutes
+func DelExitRoutes(ifName string, ipv6 bool) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return err
+	}
+	family, dst := exitFamily(ipv6)
+	var errs []error
+	for _, rule := range exitRules(family) {
+		if err := netlink.RuleDel(rule); err != nil && !errors.Is(err, syscall.ENOENT) {
+			errs = append(errs, err)
+		}
+	}
+	err = netlink.RouteDel(&netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       dst,
+		Scope:     netlink.SCOPE_LINK,
+		Table:     exitTable,
+	})
+	if err != nil && !errors.Is(err, syscall.ESRCH) {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// ExitRoutesExist reports whether the route and the rules added by AddExitRoutes are all in the
+// system
+func ExitRoutesExist(ifName string, ipv6 bool) (bool, error) {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return false, err
+	}
+	family, _ := exitFamily(ipv6)
+	routes, err := netlink.RouteListFiltered(family, &netlink.Route{LinkIndex: link.Attrs().Index, Table: exitTable},
+		netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return false, err
+	}
+	if !slices.ContainsFunc(routes, func(route netlink.Route) bool {
+		if route.Dst == nil {
+			return true
+		}
+		ones, _ := route.Dst.Mask.Size()
+		return ones == 0
+	}) {
+		return false, nil
+	}
+	rules, err := netlink.RuleList(family)
+	if err != nil {
+		return false, err
+	}
+	for _, want := range exitRules(family) {
+		if !slices.ContainsFunc(rules, func(rule netlink.Rule) bool {
+			return rule.Priority == want.Priority && rule.Table == want.Table && rule.Invert == want.Invert &&
+				rule.Mark == want.Mark && rule.SuppressPrefixlen == want.SuppressPrefixlen
+		}) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func exitFamily(ipv6 bool) (int, *net.IPNet) {
+	if ipv6 {
+		return netlink.FAMILY_V6, &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+	}
+	return netlink.FAMILY_V4, &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}
+}
+
+func exitRules(family int) []*netlink.Rule {
+	suppress := netlink.NewRule()
+	suppress.Family = family
+	suppress.Priority = exitRulePriority
+	suppress.Table = syscall.RT_TABLE_MAIN
+	suppress.SuppressPrefixlen = 0
+
+	exit := netlink.NewRule()
+	exit.Family = family
+	exit.Priority = exitRulePriority + 1
+	exit.Table = exitTable
+	exit.Mark = ExitMark
+	exit.Invert = true
+	return []*netlink.Rule{suppress, exit}
+}
+
+// AddMasquerade forwards the packets from the src (the NAT address of the exit node) and
+// masquerades them, like `iptables -t nat -A POSTROUTING -s <src> -j MASQUERADE`
+func AddMasquerade(src net.IP) error {
+	ipv6 := src.To4() == nil
+	path := "/proc/sys/net/ipv4/ip_forward"
+	if ipv6 {
+		path = "/proc/sys/net/ipv6/conf/all/forwarding"
+	}
+	if err := os.WriteFile(path, []byte("1"), 0644); err != nil {
+		return fmt.Errorf("enable ip forwarding: %w", err)
+	}
+	for _, rule := range masqueradeRules(src) {
+		// the rule is left if the daemon was not stopped gracefully
+		if rule.run(ipv6, "-C") == nil {
+			continue
+		}
+		op := "-I"
+		if rule.chain == "POSTROUTING" {
+			op = "-A"
+		}
+		if err := rule.run(ipv6, op); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DelMasquerade removes the rules added by AddMasquerade, the ip forwarding is left as it is
+func DelMasquerade(src net.IP) error {
+	ipv6 := src.To4() == nil
+	var errs []error
+	for _, rule := range masqueradeRules(src) {
+		if err := rule.run(ipv6, "-D"); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// MasqueradeExists reports whether the rules added by AddMasquerade are all in the iptables
+func MasqueradeExists(src net.IP) (bool, error) {
+	ipv6 := src.To4() == nil
+	for _, rule := range masqueradeRules(src) {
+		err := rule.run(ipv6, "-C")
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 { // the rule does not exist
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+type iptablesRule struct {
+	table, chain string
+	spec         []string
+}
+
+// masqueradeRules are the rules of the src, the FORWARD ones accept the packets even if the
+// policy is DROP (e.g. docker is installed)
+func masqueradeRules(src net.IP) []iptablesRule {
+	return []iptablesRule{
+		{table: "nat", chain: "POSTROUTING", spec: []string{"-s", src.String(), "-j", "MASQUERADE"}},
+		{table: "filter", chain: "FORWARD", spec: []string{"-s", src.String(), "-j", "ACCEPT"}},
+		{table: "filter", chain: "FORWARD", spec: []string{"-d", src.String(), "-j", "ACCEPT"}},
+	}
+}
+
+// run runs the iptables (the ip6tables) operation (-A, -I, -C or -D) of the rule
+func (r iptablesRule) run(ipv6 bool, op string) error {
+	name := "iptables"
+	if ipv6 {
+		name = "ip6tables"
+	}
+	args := append([]string{"-w", "-t", r.table, op, r.chain}, r.spec...)
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %w: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
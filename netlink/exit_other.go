@@ -0,0 +1,34 @@
+//go:build !linux
+
+package netlink
+
+import (
+	"errors"
+	"net"
+)
+
+// AddExitRoutes is only supported on linux, the policy routing keeps the packets of peerguard
+// itself out of the tun
+func AddExitRoutes(string, bool) error {
+	return errors.ErrUnsupported
+}
+
+func DelExitRoutes(string, bool) error {
+	return errors.ErrUnsupported
+}
+
+func ExitRoutesExist(string, bool) (bool, error) {
+	return false, errors.ErrUnsupported
+}
+
+func AddMasquerade(net.IP) error {
+	return errors.ErrUnsupported
+}
+
+func DelMasquerade(net.IP) error {
+	return errors.ErrUnsupported
+}
+
+func MasqueradeExists(net.IP) (bool, error) {
+	return false, errors.ErrUnsupported
+}
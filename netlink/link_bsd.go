@@ -0,0 +1,57 @@
+//go:build darwin || freebsd || openbsd
+
+package netlink
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// SetupLink assigns the address to the tun and brings it up. The tun of the BSDs and the utun of
+// darwin are point-to-point links, only the host route is added with the address, so the route to
+// the prefix is added explicitly. The mtu is set by the tun creation
+func SetupLink(ifName, cidr string) error {
+	ip, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	if ip.To4() == nil { // ipv6
+		info.IPv6 = ip.String()
+		if err := ifconfig(ifName, "inet6", cidr, "alias"); err != nil {
+			return err
+		}
+	} else {
+		info.IPv4 = ip.String()
+		if err := ifconfig(ifName, "inet", cidr, ip.String()); err != nil {
+			return err
+		}
+	}
+	if err := ifconfig(ifName, "up"); err != nil {
+		return err
+	}
+	if err := AddRoute(ifName, ipnet, nil); err != nil && !errors.Is(err, unix.EEXIST) {
+		return err
+	}
+	return nil
+}
+
+func LinkByIndex(index int) (*Link, error) {
+	iface, err := net.InterfaceByIndex(index)
+	if err != nil {
+		return nil, err
+	}
+	return &Link{Name: iface.Name, Index: index}, nil
+}
+
+func ifconfig(args ...string) error {
+	out, err := exec.Command("ifconfig", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ifconfig %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -3,26 +3,56 @@
 package netlink
 
 import (
+	"errors"
 	"fmt"
 	"net"
-	"os/exec"
+	"net/netip"
 
+	"golang.org/x/sys/windows"
 	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
 )
 
+// SetupLink assigns the address to the interface by the IP Helper API (CreateUnicastIpAddressEntry),
+// the route to the prefix is added by the system with the address
 func SetupLink(ifName, cidr string) error {
-	ip, ipnet, err := net.ParseCIDR(cidr)
+	prefix, err := netip.ParsePrefix(cidr)
 	if err != nil {
 		return err
 	}
-	if ip.To4() == nil { // ipv6
-		info.IPv6 = ip.String()
-		return exec.Command("netsh", "interface", "ipv6", "add", "address", ifName, cidr).Run()
+	if prefix.Addr().Is4() {
+		info.IPv4 = prefix.Addr().String()
+	} else {
+		info.IPv6 = prefix.Addr().String()
 	}
-	// ipv4
-	info.IPv4 = ip.String()
-	addrMask := fmt.Sprintf("%d.%d.%d.%d", ipnet.Mask[0], ipnet.Mask[1], ipnet.Mask[2], ipnet.Mask[3])
-	return exec.Command("netsh", "interface", "ipv4", "set", "address", ifName, "static", ip.String(), addrMask).Run()
+	luid, err := luidByName(ifName)
+	if err != nil {
+		return err
+	}
+	if err := luid.AddIPAddress(prefix); err != nil && !errors.Is(err, windows.ERROR_OBJECT_ALREADY_EXISTS) {
+		return fmt.Errorf("add address %s to %s: %w", prefix, ifName, err)
+	}
+	return nil
+}
+
+// SetLinkMetric disables the automatic metric of the interface and uses the metric for both
+// the ipv4 and ipv6, the lower metric takes precedence over the other interfaces
+func SetLinkMetric(ifName string, metric int) error {
+	luid, err := luidByName(ifName)
+	if err != nil {
+		return err
+	}
+	for _, family := range []winipcfg.AddressFamily{windows.AF_INET, windows.AF_INET6} {
+		row, err := luid.IPInterface(family)
+		if err != nil {
+			return fmt.Errorf("get ip interface of %s: %w", ifName, err)
+		}
+		row.UseAutomaticMetric = false
+		row.Metric = uint32(metric)
+		if err := row.Set(); err != nil {
+			return fmt.Errorf("set metric of %s: %w", ifName, err)
+		}
+	}
+	return nil
 }
 
 func LinkByIndex(index int) (*Link, error) {
@@ -36,3 +66,12 @@ func LinkByIndex(index int) (*Link, error) {
 	}
 	return &Link{Name: ifInfo.Alias(), Type: uint32(ifInfo.Type), Index: index}, nil
 }
+
+// luidByName finds the interface by the alias (the friendly name), e.g. pg0
+func luidByName(ifName string) (winipcfg.LUID, error) {
+	iface, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return 0, err
+	}
+	return winipcfg.LUIDFromIndex(uint32(iface.Index))
+}
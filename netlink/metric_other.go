@@ -0,0 +1,11 @@
+//go:build !windows
+
+package netlink
+
+import "errors"
+
+// SetLinkMetric is only supported on windows, the other systems prefer the routes by the
+// prefix length rather than the interface
+func SetLinkMetric(string, int) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package netlink
+
+import (
+	"errors"
+	"net"
+)
+
+func AddNeighProxy(string, net.IP) error {
+	return errors.ErrUnsupported
+}
+
+func DelNeighProxy(string, net.IP) error {
+	return errors.ErrUnsupported
+}
+
+func IPForwarding(bool) (bool, error) {
+	return false, errors.ErrUnsupported
+}
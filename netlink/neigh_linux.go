@@ -0,0 +1,69 @@
+package netlink
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+// AddNeighProxy answers the ARP (NDP for ipv6) requests for the ip on the interface with the
+// mac of the interface, like `ip neigh add proxy <ip> dev <ifName>`. The packets to the ip are
+// forwarded by the routes then, so ip forwarding is required
+func AddNeighProxy(ifName string, ip net.IP) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return err
+	}
+	family := netlink.FAMILY_V4
+	if ip.To4() == nil {
+		family = netlink.FAMILY_V6
+		// the ipv6 proxy entries are ignored unless proxy_ndp is enabled on the interface
+		if err := os.WriteFile(fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/proxy_ndp", ifName), []byte("1"), 0644); err != nil {
+			return fmt.Errorf("enable proxy_ndp: %w", err)
+		}
+	}
+	err = netlink.NeighAdd(&netlink.Neigh{
+		LinkIndex: link.Attrs().Index,
+		Family:    family,
+		Flags:     netlink.NTF_PROXY,
+		IP:        ip,
+	})
+	if errors.Is(err, syscall.EEXIST) {
+		return nil
+	}
+	return err
+}
+
+func DelNeighProxy(ifName string, ip net.IP) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return err
+	}
+	family := netlink.FAMILY_V4
+	if ip.To4() == nil {
+		family = netlink.FAMILY_V6
+	}
+	return netlink.NeighDel(&netlink.Neigh{
+		LinkIndex: link.Attrs().Index,
+		Family:    family,
+		Flags:     netlink.NTF_PROXY,
+		IP:        ip,
+	})
+}
+
+// IPForwarding reports whether the kernel forwards the packets of the family
+func IPForwarding(ipv6 bool) (bool, error) {
+	path := "/proc/sys/net/ipv4/ip_forward"
+	if ipv6 {
+		path = "/proc/sys/net/ipv6/conf/all/forwarding"
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	return len(b) > 0 && b[0] == '1', nil
+}
@@ -7,3 +7,7 @@ type RouteUpdate struct {
 	Dst *net.IPNet
 	Via net.IP
 }
+
+// ExitMark is the fwmark of the sockets of peerguard (see disco.SetSocketMark), the marked
+// packets are routed by the main routing table rather than the exit node
+const ExitMark = 0x7067
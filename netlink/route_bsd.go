@@ -0,0 +1,192 @@
+//go:build darwin || freebsd || openbsd
+
+package netlink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/net/route"
+	"golang.org/x/sys/unix"
+)
+
+var routeSeq atomic.Int32
+
+func RouteSubscribe(ctx context.Context, ch chan<- RouteUpdate) error {
+	return subscribeRoutingSocket(ctx, func(msg route.Message) {
+		m, ok := msg.(*route.RouteMessage)
+		if !ok || (m.Type != syscall.RTM_ADD && m.Type != syscall.RTM_DELETE) ||
+			m.Flags&syscall.RTF_GATEWAY == 0 || len(m.Addrs) <= syscall.RTAX_NETMASK {
+			return
+		}
+		dst := routeAddrIP(m.Addrs[syscall.RTAX_DST])
+		via := routeAddrIP(m.Addrs[syscall.RTAX_GATEWAY])
+		if dst == nil || via == nil {
+			return
+		}
+		mask := net.CIDRMask(len(dst)*8, len(dst)*8) // host route if no netmask
+		if ip := routeAddrIP(m.Addrs[syscall.RTAX_NETMASK]); ip != nil {
+			mask = net.IPMask(ip)
+		}
+		ch <- RouteUpdate{
+			New: m.Type == syscall.RTM_ADD,
+			Dst: &net.IPNet{IP: dst, Mask: mask},
+			Via: via,
+		}
+	}, func() { close(ch) })
+}
+
+// subscribeRoutingSocket reads the messages of the route(4) socket until the ctx is done,
+// then the closed is called
+func subscribeRoutingSocket(ctx context.Context, handle func(route.Message), closed func()) error {
+	fd, err := unix.Socket(unix.AF_ROUTE, unix.SOCK_RAW, unix.AF_UNSPEC)
+	if err != nil {
+		return fmt.Errorf("syscall socket: %w", err)
+	}
+	// non-blocking so that the pending read is interrupted by the close
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("set nonblock: %w", err)
+	}
+	f := os.NewFile(uintptr(fd), "route")
+	go func() {
+		<-ctx.Done()
+		f.Close()
+	}()
+	go func() {
+		defer closed()
+		buf := make([]byte, os.Getpagesize())
+		for {
+			n, err := f.Read(buf)
+			if err != nil {
+				if !errors.Is(err, os.ErrClosed) {
+					slog.Error("RoutingSocket", "err", fmt.Errorf("msg read loop exited: %w", err))
+				}
+				return
+			}
+			msgs, err := route.ParseRIB(route.RIBTypeRoute, buf[:n])
+			if err != nil {
+				slog.Debug("RouteParseRIB", "err", err, "msglen", n)
+				continue
+			}
+			for _, msg := range msgs {
+				handle(msg)
+			}
+		}
+	}()
+	return nil
+}
+
+// AddRoute adds the route to the interface by the route(4) socket, the via is ignored
+// since the tun is a point-to-point link and the overlay routes the packets by itself
+func AddRoute(ifName string, to *net.IPNet, _ net.IP) error {
+	return writeRouteMessage(syscall.RTM_ADD, ifName, to)
+}
+
+func DelRoute(ifName string, to *net.IPNet, _ net.IP) error {
+	return writeRouteMessage(syscall.RTM_DELETE, ifName, to)
+}
+
+func writeRouteMessage(typ int, ifName string, to *net.IPNet) error {
+	iface, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return err
+	}
+	dst, mask, err := routeDstAddrs(to)
+	if err != nil {
+		return err
+	}
+	addrs := make([]route.Addr, syscall.RTAX_NETMASK+1)
+	addrs[syscall.RTAX_DST] = dst
+	addrs[syscall.RTAX_GATEWAY] = &route.LinkAddr{Index: iface.Index, Name: iface.Name}
+	addrs[syscall.RTAX_NETMASK] = mask
+	msg := route.RouteMessage{
+		Version: syscall.RTM_VERSION,
+		Type:    typ,
+		Flags:   syscall.RTF_UP | syscall.RTF_STATIC,
+		Index:   iface.Index,
+		ID:      uintptr(os.Getpid()),
+		Seq:     int(routeSeq.Add(1)),
+		Addrs:   addrs,
+	}
+	b, err := msg.Marshal()
+	if err != nil {
+		return fmt.Errorf("marshal route message: %w", err)
+	}
+	fd, err := unix.Socket(unix.AF_ROUTE, unix.SOCK_RAW, unix.AF_UNSPEC)
+	if err != nil {
+		return fmt.Errorf("syscall socket: %w", err)
+	}
+	defer unix.Close(fd)
+	if _, err := unix.Write(fd, b); err != nil {
+		return fmt.Errorf("write route message: %w", err)
+	}
+	return nil
+}
+
+// RouteExists reports whether the route to dst on the interface is in the routing table
+func RouteExists(ifName string, to *net.IPNet, _ net.IP) (bool, error) {
+	iface, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return false, err
+	}
+	rib, err := route.FetchRIB(syscall.AF_UNSPEC, route.RIBTypeRoute, 0)
+	if err != nil {
+		return false, fmt.Errorf("fetch rib: %w", err)
+	}
+	msgs, err := route.ParseRIB(route.RIBTypeRoute, rib)
+	if err != nil {
+		return false, fmt.Errorf("parse rib: %w", err)
+	}
+	ones, _ := to.Mask.Size()
+	for _, msg := range msgs {
+		m, ok := msg.(*route.RouteMessage)
+		if !ok || m.Index != iface.Index || len(m.Addrs) <= syscall.RTAX_NETMASK {
+			continue
+		}
+		if dst := routeAddrIP(m.Addrs[syscall.RTAX_DST]); dst == nil || !dst.Equal(to.IP) {
+			continue
+		}
+		maskOnes := len(to.IP) * 8 // host route if no netmask
+		if mask := routeAddrIP(m.Addrs[syscall.RTAX_NETMASK]); mask != nil {
+			maskOnes, _ = net.IPMask(mask).Size()
+		}
+		if maskOnes == ones {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// routeDstAddrs converts the destination and the mask to the sockaddrs of the same family
+func routeDstAddrs(to *net.IPNet) (route.Addr, route.Addr, error) {
+	ones, bits := to.Mask.Size()
+	if ip4 := to.IP.To4(); ip4 != nil {
+		if bits == 8*net.IPv6len {
+			ones -= 96
+		}
+		return &route.Inet4Addr{IP: [4]byte(ip4)},
+			&route.Inet4Addr{IP: [4]byte(net.CIDRMask(ones, 32))}, nil
+	}
+	if ip6 := to.IP.To16(); ip6 != nil && bits == 8*net.IPv6len {
+		return &route.Inet6Addr{IP: [16]byte(ip6)},
+			&route.Inet6Addr{IP: [16]byte(net.CIDRMask(ones, 128))}, nil
+	}
+	return nil, nil, fmt.Errorf("invalid route destination %s", to)
+}
+
+func routeAddrIP(addr route.Addr) net.IP {
+	switch v := addr.(type) {
+	case *route.Inet4Addr:
+		return v.IP[:]
+	case *route.Inet6Addr:
+		return v.IP[:]
+	}
+	return nil
+}
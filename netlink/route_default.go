@@ -1,4 +1,4 @@
-//go:build !linux && !windows && !darwin
+//go:build !linux && !windows && !darwin && !freebsd && !openbsd
 
 package netlink
 
@@ -20,3 +20,7 @@ func DelRoute(string, *net.IPNet, net.IP) error {
 	// noop
 	return errors.ErrUnsupported
 }
+
+func RouteExists(string, *net.IPNet, net.IP) (bool, error) {
+	return false, errors.ErrUnsupported
+}
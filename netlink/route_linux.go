@@ -58,3 +58,13 @@ func DelRoute(_ string, to *net.IPNet, via net.IP) error {
 		Gw:  via,
 	})
 }
+
+// RouteExists reports whether the route to dst via is in the main routing table
+func RouteExists(_ string, to *net.IPNet, via net.IP) (bool, error) {
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Dst: to, Gw: via},
+		netlink.RT_FILTER_DST|netlink.RT_FILTER_GW)
+	if err != nil {
+		return false, err
+	}
+	return len(routes) > 0, nil
+}
@@ -2,10 +2,12 @@ package netlink
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
-	"os/exec"
+	"net/netip"
 
+	"golang.org/x/sys/windows"
 	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
 )
 
@@ -28,18 +30,72 @@ func RouteSubscribe(ctx context.Context, ch chan<- RouteUpdate) error {
 	}()
 	return nil
 }
+
+// AddRoute adds the route on the interface by the IP Helper API (CreateIpForwardEntry2), the
+// route is on-link if via is nil. The metric is relative to the metric of the interface
 func AddRoute(ifName string, to *net.IPNet, via net.IP) error {
-	if via.To4() == nil { // ipv6
-		return exec.Command("netsh", "interface", "ipv6", "add", "route", to.String(), ifName, via.String()).Run()
+	luid, dst, nextHop, err := routeEntry(ifName, to, via)
+	if err != nil {
+		return err
 	}
-	// ipv4
-	addrMask := fmt.Sprintf("%d.%d.%d.%d", to.Mask[0], to.Mask[1], to.Mask[2], to.Mask[3])
-	return exec.Command("route", "add", to.IP.String(), "mask", addrMask, via.String()).Run()
+	if err := luid.AddRoute(dst, nextHop, 0); err != nil && !errors.Is(err, windows.ERROR_OBJECT_ALREADY_EXISTS) {
+		return fmt.Errorf("add route %s via %s: %w", dst, nextHop, err)
+	}
+	return nil
 }
 
 func DelRoute(ifName string, to *net.IPNet, via net.IP) error {
-	if via.To4() == nil { // ipv6
-		return exec.Command("netsh", "interface", "ipv6", "delete", "route", to.String(), ifName, via.String()).Run()
+	luid, dst, nextHop, err := routeEntry(ifName, to, via)
+	if err != nil {
+		return err
+	}
+	if err := luid.DeleteRoute(dst, nextHop); err != nil && !errors.Is(err, windows.ERROR_NOT_FOUND) {
+		return fmt.Errorf("delete route %s via %s: %w", dst, nextHop, err)
+	}
+	return nil
+}
+
+func routeEntry(ifName string, to *net.IPNet, via net.IP) (winipcfg.LUID, netip.Prefix, netip.Addr, error) {
+	luid, err := luidByName(ifName)
+	if err != nil {
+		return 0, netip.Prefix{}, netip.Addr{}, err
+	}
+	addr, ok := netip.AddrFromSlice(to.IP)
+	if !ok {
+		return 0, netip.Prefix{}, netip.Addr{}, fmt.Errorf("invalid route destination %s", to)
+	}
+	addr = addr.Unmap()
+	ones, _ := to.Mask.Size()
+	if addr.Is4() && ones > 32 {
+		ones -= 96
+	}
+	dst := netip.PrefixFrom(addr, ones).Masked()
+	nextHop := netip.IPv4Unspecified()
+	if addr.Is6() {
+		nextHop = netip.IPv6Unspecified()
+	}
+	if via != nil {
+		if nextHop, ok = netip.AddrFromSlice(via); !ok {
+			return 0, netip.Prefix{}, netip.Addr{}, fmt.Errorf("invalid route next hop %s", via)
+		}
+		nextHop = nextHop.Unmap()
+	}
+	return luid, dst, nextHop, nil
+}
+
+// RouteExists reports whether the route to dst via is in the routing table
+func RouteExists(_ string, to *net.IPNet, via net.IP) (bool, error) {
+	rows, err := winipcfg.GetIPForwardTable2(windows.AF_UNSPEC)
+	if err != nil {
+		return false, err
+	}
+	addr, _ := netip.AddrFromSlice(to.IP)
+	ones, _ := to.Mask.Size()
+	prefix := netip.PrefixFrom(addr.Unmap(), ones)
+	for _, row := range rows {
+		if row.DestinationPrefix.Prefix() == prefix && via.Equal(row.NextHop.Addr().AsSlice()) {
+			return true, nil
+		}
 	}
-	return exec.Command("route", "delete", to.IP.String()).Run()
+	return false, nil
 }
@@ -0,0 +1,502 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rkonfj/peerguard/crash"
+	"github.com/rkonfj/peerguard/disco"
+)
+
+// bench packet (on the bench channel): type(1) | session(4) | body
+//
+//	data:             seq(4) | padding
+//	report request:
+//	report:           packets(4) | relayed packets(4) | bytes(8) | duration(8)
+//	probe(reply):     seq(4) | timestamp(8) | relay(1)
+//	download request: count(4) | size(2) | rate(4)
+const (
+	benchData          byte = 1
+	benchReportRequest byte = 2
+	benchReport        byte = 3
+	benchProbe         byte = 4
+	benchProbeReply    byte = 5
+	benchDownload      byte = 6
+
+	benchHeaderSize = 1 + 4
+
+	// BenchMinSize and BenchMaxSize are the bounds of BenchOptions.Size
+	BenchMinSize = benchHeaderSize + 4
+	BenchMaxSize = 8192
+	// BenchMaxCount is the max packets sent to the peer asks for a download
+	BenchMaxCount = 100000
+
+	benchProbes     = 5
+	benchMaxSession = 64
+	// benchMaxDownloads is the max downloads served at the same time, one per peer
+	benchMaxDownloads = 4
+)
+
+// BenchOptions is a one-way bench of the path to the peer
+type BenchOptions struct {
+	// Download asks the peer to send the packets, the packets are sent to the peer otherwise. The
+	// peer sends them over the direct path only and if it serves the downloads (ListenBenchDownload)
+	Download bool
+	// Relay forces the packets relayed by the peermap server, they go direct if possible otherwise.
+	// It is refused with Download, the peer never relays the downloads
+	Relay bool
+	// Count is the number of the packets
+	Count int
+	// Size is the size of each packet
+	Size int
+	// Rate is the packets sent per second, 0 is unlimited
+	Rate int
+}
+
+// BenchResult is the result of a bench
+type BenchResult struct {
+	Sent     int
+	Received int
+	// Relayed is the number of the received packets relayed by the peermap server
+	Relayed  int
+	Bytes    int64
+	Duration time.Duration
+	// MinRTT, AvgRTT and MaxRTT are measured by the probes on the same path, they are zero if no probe is answered
+	MinRTT, AvgRTT, MaxRTT time.Duration
+}
+
+// Loss is the ratio of the packets lost
+func (r BenchResult) Loss() float64 {
+	if r.Sent == 0 {
+		return 0
+	}
+	return float64(r.Sent-r.Received) / float64(r.Sent)
+}
+
+// Bandwidth is the bits received per second
+func (r BenchResult) Bandwidth() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Bytes*8) / r.Duration.Seconds()
+}
+
+// PPS is the packets received per second
+func (r BenchResult) PPS() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Received) / r.Duration.Seconds()
+}
+
+var errBenchReplyTimeout = errors.New("bench reply timeout")
+
+type benchKey struct {
+	peerID  disco.PeerID
+	session uint32
+}
+
+// benchSession counts the data packets received in the session
+type benchSession struct {
+	created  time.Time
+	packets  uint32
+	relayed  uint32
+	bytes    uint64
+	first    time.Time
+	last     time.Time
+	received chan struct{}
+}
+
+// bench answers the bench packets of the peers and dispatches the replies to the running benches,
+// the bench packets are handled in the conn and never returned by ReadFrom
+type bench struct {
+	mutex    sync.Mutex
+	sessions map[benchKey]*benchSession
+	// served are the downloads served, kept a minute so that the retried requests are ignored
+	served map[benchKey]time.Time
+	// serving are the peers a download is being sent to
+	serving map[disco.PeerID]struct{}
+	replies map[benchKey]chan []byte
+	// downloadRate is the max packets per second sent to a peer asks for a download, 0 refuses
+	downloadRate int
+}
+
+func newBench(downloadRate int) *bench {
+	return &bench{
+		sessions:     make(map[benchKey]*benchSession),
+		served:       make(map[benchKey]time.Time),
+		serving:      make(map[disco.PeerID]struct{}),
+		replies:      make(map[benchKey]chan []byte),
+		downloadRate: downloadRate,
+	}
+}
+
+func benchPacket(typ byte, session uint32, size int) []byte {
+	b := make([]byte, size)
+	b[0] = typ
+	binary.BigEndian.PutUint32(b[1:], session)
+	return b
+}
+
+// session returns the session counts the packets, nil if too many sessions are running
+func (b *bench) session(key benchKey) *benchSession {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if s, ok := b.sessions[key]; ok {
+		return s
+	}
+	for k, s := range b.sessions {
+		if time.Since(s.created) > time.Minute {
+			delete(b.sessions, k)
+		}
+	}
+	if len(b.sessions) >= benchMaxSession {
+		return nil
+	}
+	s := &benchSession{created: time.Now(), received: make(chan struct{}, 1)}
+	b.sessions[key] = s
+	return s
+}
+
+// handle handles the packet of the bench channel, write sends the replies to the peer and
+// writeDirect sends the packets of the download over the direct path
+func (b *bench) handle(peerID disco.PeerID, p []byte, relayed bool, write func([]byte, disco.PeerID, bool) error, writeDirect func([]byte, disco.PeerID, bool) error) {
+	if len(p) < benchHeaderSize {
+		return
+	}
+	key := benchKey{peerID: peerID, session: binary.BigEndian.Uint32(p[1:])}
+	switch p[0] {
+	case benchData:
+		s := b.session(key)
+		if s == nil {
+			return
+		}
+		b.mutex.Lock()
+		now := time.Now()
+		if s.packets == 0 {
+			s.first = now
+		}
+		s.last = now
+		s.packets++
+		s.bytes += uint64(len(p))
+		if relayed {
+			s.relayed++
+		}
+		b.mutex.Unlock()
+		select {
+		case s.received <- struct{}{}:
+		default:
+		}
+	case benchReportRequest:
+		report := benchPacket(benchReport, key.session, benchHeaderSize+24)
+		b.mutex.Lock()
+		if s, ok := b.sessions[key]; ok {
+			binary.BigEndian.PutUint32(report[5:], s.packets)
+			binary.BigEndian.PutUint32(report[9:], s.relayed)
+			binary.BigEndian.PutUint64(report[13:], s.bytes)
+			binary.BigEndian.PutUint64(report[21:], uint64(s.last.Sub(s.first)))
+		}
+		b.mutex.Unlock()
+		write(report, peerID, relayed)
+	case benchProbe:
+		if len(p) != benchHeaderSize+13 {
+			return
+		}
+		reply := bytes.Clone(p)
+		reply[0] = benchProbeReply
+		write(reply, peerID, p[17] == 1)
+	case benchDownload:
+		if len(p) != benchHeaderSize+10 || relayed { // the downloads are never sent over the relay
+			return
+		}
+		opts := BenchOptions{
+			Count: int(binary.BigEndian.Uint32(p[5:])),
+			Size:  int(binary.BigEndian.Uint16(p[9:])),
+			Rate:  int(binary.BigEndian.Uint32(p[11:])),
+		}
+		if opts.Count > BenchMaxCount || opts.Size < BenchMinSize || opts.Size > BenchMaxSize {
+			return
+		}
+		if !b.serve(key) {
+			return
+		}
+		opts.Rate = min(max(opts.Rate, 0), b.downloadRate)
+		if opts.Rate == 0 { // as fast as possible is limited as well
+			opts.Rate = b.downloadRate
+		}
+		go func() {
+			defer crash.Recover("p2p/bench")
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			benchSend(ctx, key, opts, writeDirect)
+			b.mutex.Lock()
+			delete(b.serving, key.peerID)
+			b.mutex.Unlock()
+		}()
+	case benchReport, benchProbeReply:
+		if p[0] == benchProbeReply && len(p) != benchHeaderSize+13 {
+			return
+		}
+		b.mutex.Lock()
+		ch, ok := b.replies[key]
+		b.mutex.Unlock()
+		if ok {
+			select {
+			case ch <- bytes.Clone(p):
+			default:
+			}
+		}
+	}
+}
+
+// serve reports whether the download of the session is served, it is refused if the downloads
+// are not served, the peer has one running, too many are running or it is the retried request
+func (b *bench) serve(key benchKey) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.downloadRate <= 0 {
+		return false
+	}
+	for k, served := range b.served {
+		if time.Since(served) > time.Minute {
+			delete(b.served, k)
+		}
+	}
+	if _, ok := b.served[key]; ok {
+		return false
+	}
+	if _, ok := b.serving[key.peerID]; ok || len(b.serving) >= benchMaxDownloads {
+		return false
+	}
+	b.served[key] = time.Now()
+	b.serving[key.peerID] = struct{}{}
+	return true
+}
+
+// benchSend sends the data packets of the session at the rate
+func benchSend(ctx context.Context, key benchKey, opts BenchOptions, write func([]byte, disco.PeerID, bool) error) error {
+	p := benchPacket(benchData, key.session, opts.Size)
+	start := time.Now()
+	for i := 0; i < opts.Count; i++ {
+		if opts.Rate > 0 {
+			if d := time.Until(start.Add(time.Duration(i) * time.Second / time.Duration(opts.Rate))); d > time.Millisecond {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(d):
+				}
+			}
+		}
+		binary.BigEndian.PutUint32(p[5:], uint32(i))
+		if err := write(p, key.peerID, opts.Relay); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writePath sends p to the peer on the bench channel, relayed by the peermap server if relay is true
+func (c *PeerPacketConn) writePath(p []byte, peerID disco.PeerID, relay bool) error {
+	p, err := c.channels.frame(peerID, channelBench, p)
+	if err != nil {
+		return err
+	}
+	if !relay {
+		_, err := c.write(p, peerID)
+		return err
+	}
+	if p, err = c.encrypt(p, peerID); err != nil {
+		return err
+	}
+	return c.wsConn.WriteTo(p, peerID, disco.CONTROL_RELAY)
+}
+
+// writeDirect sends p to the peer on the bench channel over the direct path only, it fails rather
+// than relaying the packet
+func (c *PeerPacketConn) writeDirect(p []byte, peerID disco.PeerID, _ bool) error {
+	p, err := c.channels.frame(peerID, channelBench, p)
+	if err != nil {
+		return err
+	}
+	if p, err = c.encrypt(p, peerID); err != nil {
+		return err
+	}
+	_, err = c.udpConn.WriteToUDP(p, peerID)
+	return err
+}
+
+// Bench measures the throughput, loss and rtt of the path to the peer in one direction,
+// ErrChannelsUnsupported is returned if the peer runs a version does not support the bench
+func (c *PeerPacketConn) Bench(ctx context.Context, peerID disco.PeerID, opts BenchOptions) (BenchResult, error) {
+	if opts.Download && opts.Relay {
+		return BenchResult{}, errors.New("the download is never relayed by the peer")
+	}
+	if opts.Size < BenchMinSize || opts.Size > BenchMaxSize {
+		return BenchResult{}, errors.New("bench packet size out of range")
+	}
+	if opts.Count <= 0 || opts.Download && opts.Count > BenchMaxCount {
+		return BenchResult{}, errors.New("bench packet count out of range")
+	}
+	key := benchKey{peerID: peerID, session: rand.Uint32()}
+	replies := make(chan []byte, 16)
+	c.bench.mutex.Lock()
+	c.bench.replies[key] = replies
+	c.bench.mutex.Unlock()
+	defer func() {
+		c.bench.mutex.Lock()
+		delete(c.bench.replies, key)
+		delete(c.bench.sessions, key)
+		c.bench.mutex.Unlock()
+	}()
+
+	result := BenchResult{Sent: opts.Count}
+	if err := c.benchProbe(ctx, key, opts.Relay, replies, &result); err != nil {
+		return result, err
+	}
+	if opts.Download {
+		return result, c.benchDownload(ctx, key, opts, &result)
+	}
+	if err := benchSend(ctx, key, opts, c.writePath); err != nil {
+		return result, err
+	}
+	// wait for the packets in flight before asking for the report
+	select {
+	case <-ctx.Done():
+		return result, ctx.Err()
+	case <-c.closedSig:
+		return result, net.ErrClosed
+	case <-time.After(time.Second):
+	}
+	for range 3 {
+		if err := c.writePath(benchPacket(benchReportRequest, key.session, benchHeaderSize), peerID, opts.Relay); err != nil {
+			return result, err
+		}
+		report, err := c.benchReply(ctx, replies, benchReport, time.Second)
+		if errors.Is(err, errBenchReplyTimeout) {
+			continue
+		}
+		if err != nil {
+			return result, err
+		}
+		if len(report) == benchHeaderSize+24 {
+			result.Received = int(binary.BigEndian.Uint32(report[5:]))
+			result.Relayed = int(binary.BigEndian.Uint32(report[9:]))
+			result.Bytes = int64(binary.BigEndian.Uint64(report[13:]))
+			result.Duration = time.Duration(binary.BigEndian.Uint64(report[21:]))
+		}
+		return result, nil
+	}
+	return result, errors.New("no report received from the peer")
+}
+
+// benchProbe measures the rtt by the probes, the probes are sent back on the same path
+func (c *PeerPacketConn) benchProbe(ctx context.Context, key benchKey, relay bool, replies chan []byte, result *BenchResult) error {
+	var sum time.Duration
+	var answered int
+	for i := range benchProbes {
+		probe := benchPacket(benchProbe, key.session, benchHeaderSize+13)
+		binary.BigEndian.PutUint32(probe[5:], uint32(i))
+		binary.BigEndian.PutUint64(probe[9:], uint64(time.Now().UnixNano()))
+		if relay {
+			probe[17] = 1
+		}
+		if err := c.writePath(probe, key.peerID, relay); err != nil {
+			return err
+		}
+		reply, err := c.benchReply(ctx, replies, benchProbeReply, time.Second)
+		if errors.Is(err, errBenchReplyTimeout) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		rtt := time.Since(time.Unix(0, int64(binary.BigEndian.Uint64(reply[9:]))))
+		if result.MinRTT == 0 || rtt < result.MinRTT {
+			result.MinRTT = rtt
+		}
+		result.MaxRTT = max(result.MaxRTT, rtt)
+		sum += rtt
+		answered++
+	}
+	if answered == 0 {
+		return errors.New("no probe answered by the peer")
+	}
+	result.AvgRTT = sum / time.Duration(answered)
+	return nil
+}
+
+// benchDownload asks the peer to send the packets, and counts them until all are received or the peer stops sending
+func (c *PeerPacketConn) benchDownload(ctx context.Context, key benchKey, opts BenchOptions, result *BenchResult) error {
+	s := c.bench.session(key)
+	if s == nil {
+		return errors.New("too many bench sessions")
+	}
+	request := benchPacket(benchDownload, key.session, benchHeaderSize+10)
+	binary.BigEndian.PutUint32(request[5:], uint32(opts.Count))
+	binary.BigEndian.PutUint16(request[9:], uint16(opts.Size))
+	binary.BigEndian.PutUint32(request[11:], uint32(opts.Rate))
+	started := false
+	for i := 0; !started; i++ {
+		if i == 3 {
+			return errors.New("no packet received from the peer, it may not serve the downloads")
+		}
+		if err := c.writePath(request, key.peerID, opts.Relay); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.closedSig:
+			return net.ErrClosed
+		case <-s.received:
+			started = true
+		case <-time.After(time.Second):
+		}
+	}
+	for {
+		c.bench.mutex.Lock()
+		result.Received = int(s.packets)
+		result.Relayed = int(s.relayed)
+		result.Bytes = int64(s.bytes)
+		result.Duration = s.last.Sub(s.first)
+		c.bench.mutex.Unlock()
+		if result.Received >= opts.Count {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.closedSig:
+			return net.ErrClosed
+		case <-s.received:
+		case <-time.After(2 * time.Second): // the rest are lost
+			return nil
+		}
+	}
+}
+
+// benchReply waits for the reply of the type
+func (c *PeerPacketConn) benchReply(ctx context.Context, replies chan []byte, typ byte, timeout time.Duration) ([]byte, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-c.closedSig:
+			return nil, net.ErrClosed
+		case <-timer.C:
+			return nil, errBenchReplyTimeout
+		case reply := <-replies:
+			if reply[0] == typ {
+				return reply, nil
+			}
+		}
+	}
+}
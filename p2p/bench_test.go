@@ -0,0 +1,84 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/rkonfj/peerguard/disco"
+)
+
+func downloadRequest(session uint32, count, size, rate int) []byte {
+	request := benchPacket(benchDownload, session, benchHeaderSize+10)
+	binary.BigEndian.PutUint32(request[5:], uint32(count))
+	binary.BigEndian.PutUint16(request[9:], uint16(size))
+	binary.BigEndian.PutUint32(request[11:], uint32(rate))
+	return request
+}
+
+func TestBenchDownloadRefused(t *testing.T) {
+	refused := func(b *bench, peerID disco.PeerID, p []byte, relayed bool) {
+		t.Helper()
+		b.handle(peerID, p, relayed, nil, func([]byte, disco.PeerID, bool) error {
+			t.Error("expected the download refused")
+			return nil
+		})
+	}
+	refused(newBench(0), "peer", downloadRequest(1, 10, BenchMinSize, 0), false)
+	b := newBench(1000)
+	refused(b, "peer", downloadRequest(1, 10, BenchMinSize, 0), true) // relayed
+	refused(b, "peer", downloadRequest(1, BenchMaxCount+1, BenchMinSize, 0), false)
+	refused(b, "peer", downloadRequest(1, 10, BenchMaxSize+1, 0), false)
+}
+
+func TestBenchServeLimits(t *testing.T) {
+	b := newBench(1000)
+	if !b.serve(benchKey{peerID: "a", session: 1}) {
+		t.Fatal("expected the download served")
+	}
+	if b.serve(benchKey{peerID: "a", session: 2}) {
+		t.Error("expected the second download of the peer refused")
+	}
+	for i := range benchMaxDownloads - 1 {
+		if !b.serve(benchKey{peerID: disco.PeerID(rune('b' + i)), session: 1}) {
+			t.Fatalf("expected the download %d served", i)
+		}
+	}
+	if b.serve(benchKey{peerID: "z", session: 1}) {
+		t.Error("expected the download refused once too many are running")
+	}
+	delete(b.serving, "a")
+	if b.serve(benchKey{peerID: "a", session: 1}) {
+		t.Error("expected the retried request refused")
+	}
+	if !b.serve(benchKey{peerID: "a", session: 3}) {
+		t.Error("expected the next download of the peer served")
+	}
+}
+
+func TestBenchDownloadDirectAndLimited(t *testing.T) {
+	b := newBench(50)
+	sent := make(chan time.Time, 8)
+	b.handle("peer", downloadRequest(1, 5, BenchMinSize, 0), false, func([]byte, disco.PeerID, bool) error {
+		t.Error("expected the download sent over the direct path")
+		return nil
+	}, func(p []byte, peerID disco.PeerID, _ bool) error {
+		sent <- time.Now()
+		return nil
+	})
+	var first, last time.Time
+	for i := range 5 {
+		select {
+		case last = <-sent:
+			if i == 0 {
+				first = last
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected 5 packets, got %d", i)
+		}
+	}
+	// 5 packets at 50 packets per second rather than as fast as possible
+	if d := last.Sub(first); d < 60*time.Millisecond {
+		t.Errorf("expected the download limited by the rate, took %s", d)
+	}
+}
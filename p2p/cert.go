@@ -0,0 +1,148 @@
+package p2p
+
+import (
+	"crypto/ed25519"
+	"log/slog"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/rkonfj/peerguard/disco"
+	"github.com/rkonfj/peerguard/disco/tp"
+	"github.com/rkonfj/peerguard/lru"
+)
+
+const (
+	certMsgHello byte = 1
+	certMsgReply byte = 2
+)
+
+var _ disco.Controller = (*certExchange)(nil)
+
+// peerCertStore stores the verified peer certificates
+type peerCertStore struct {
+	wsConn *tp.WSConn
+	ca     ed25519.PublicKey
+
+	mut   sync.Mutex
+	certs *lru.Cache[disco.PeerID, disco.Certificate]
+}
+
+func newPeerCertStore(wsConn *tp.WSConn, ca ed25519.PublicKey) *peerCertStore {
+	return &peerCertStore{
+		wsConn: wsConn,
+		ca:     ca,
+		certs:  lru.New[disco.PeerID, disco.Certificate](1024),
+	}
+}
+
+// verify verifies the certificate presented by the peer and stores it
+func (s *peerCertStore) verify(peerID disco.PeerID, signedCert string) (disco.Certificate, error) {
+	ca := s.ca
+	if len(ca) == 0 {
+		ca = s.wsConn.CA()
+	}
+	cert, err := disco.VerifyCertificate(ca, signedCert)
+	if err != nil {
+		return cert, err
+	}
+	if cert.PeerID != peerID {
+		return cert, disco.ErrInvalidCertificate
+	}
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.certs.Put(peerID, cert)
+	return cert, nil
+}
+
+// get gets the unexpired certificate of the peer
+func (s *peerCertStore) get(peerID disco.PeerID) (disco.Certificate, bool) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	cert, ok := s.certs.Get(peerID)
+	if !ok || cert.NotAfter < time.Now().Unix() {
+		return disco.Certificate{}, false
+	}
+	return cert, true
+}
+
+// certExchange exchanges the peermap issued certificates with the found peers,
+// the peer is reported to OnPeer only after its certificate is verified
+type certExchange struct {
+	wsConn *tp.WSConn
+	certs  *peerCertStore
+	onPeer OnPeer
+	logger *slog.Logger
+
+	mut     sync.Mutex
+	pending map[disco.PeerID]url.Values
+}
+
+func newCertExchange(wsConn *tp.WSConn, certs *peerCertStore, onPeer OnPeer, logger *slog.Logger) *certExchange {
+	return &certExchange{
+		wsConn:  wsConn,
+		certs:   certs,
+		onPeer:  onPeer,
+		logger:  logger,
+		pending: make(map[disco.PeerID]url.Values),
+	}
+}
+
+func (x *certExchange) Name() string {
+	return "certex"
+}
+
+func (x *certExchange) Type() uint8 {
+	return disco.CONTROL_PEER_CERTIFICATE.Byte()
+}
+
+func (x *certExchange) Handle(b []byte) {
+	peerID := disco.PeerID(b[2 : b[1]+2])
+	msg := b[b[1]+2:]
+	if len(msg) == 0 {
+		return
+	}
+	cert, err := x.certs.verify(peerID, string(msg[1:]))
+	if err != nil {
+		x.logger.Warn("[Cert] RejectPeer", "peer", peerID, "err", err)
+		return
+	}
+	x.logger.Debug("[Cert] Verified", "peer", peerID, "network", cert.Network)
+	if msg[0] == certMsgHello {
+		x.send(peerID, certMsgReply)
+	}
+
+	x.mut.Lock()
+	metadata, ok := x.pending[peerID]
+	delete(x.pending, peerID)
+	x.mut.Unlock()
+	if ok && x.onPeer != nil {
+		go x.onPeer(peerID, metadata)
+	}
+}
+
+// peerFound sends the certificate to the found peer and holds the peer until its certificate is verified.
+// The peer is reported immediately if its certificate has been verified, e.g. distributed with NEW_PEER
+func (x *certExchange) peerFound(peerID disco.PeerID, metadata url.Values) {
+	if _, ok := x.certs.get(peerID); ok {
+		if x.onPeer != nil {
+			x.onPeer(peerID, metadata)
+		}
+		return
+	}
+	x.mut.Lock()
+	x.pending[peerID] = metadata
+	x.mut.Unlock()
+	x.send(peerID, certMsgHello)
+}
+
+func (x *certExchange) send(peerID disco.PeerID, msgType byte) {
+	cert := x.wsConn.Certificate()
+	if cert == "" {
+		x.logger.Error("[Cert] NoCertificate (the pgmap server is too old?)")
+		return
+	}
+	if err := x.wsConn.WriteTo(append([]byte{msgType}, cert...), peerID, disco.CONTROL_PEER_CERTIFICATE); err != nil {
+		x.logger.Error("[Cert] SendCertificate", "peer", peerID, "err", err)
+	}
+}
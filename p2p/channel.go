@@ -0,0 +1,72 @@
+package p2p
+
+import (
+	"errors"
+	"net/url"
+	"slices"
+	"sync"
+
+	"github.com/rkonfj/peerguard/disco"
+)
+
+// metaChannels advertises the version of the channel framing the peer supports, the control
+// datagrams (the streams, the echo and the bench) are only exchanged with the peers advertised it
+const (
+	metaChannels    = "ch"
+	channelsVersion = "1"
+)
+
+// The channels of the datagrams. A datagram of the peer supports the framing is the data as is if
+// the first byte is not zero (e.g. an ip packet), otherwise it is 0x00 | channel | payload, so the
+// data leading with the zero byte is framed on the data channel rather than taken as the control
+const (
+	channelData   byte = 0
+	channelStream byte = 1
+	channelEcho   byte = 2
+	channelBench  byte = 3
+)
+
+// ErrChannelsUnsupported is returned if the peer runs a version does not support the channel
+// framing, so the streams, the echo and the bench are not available with it
+var ErrChannelsUnsupported = errors.New("channel framing is not supported by the peer")
+
+// channels frames the datagrams with the peers advertised the framing, the datagrams of the others
+// are the data as is
+type channels struct {
+	peers sync.Map // disco.PeerID -> struct{}
+}
+
+func (ch *channels) peerFound(peerID disco.PeerID, metadata url.Values) {
+	if metadata.Get(metaChannels) == channelsVersion {
+		ch.peers.Store(peerID, struct{}{})
+		return
+	}
+	ch.peers.Delete(peerID)
+}
+
+func (ch *channels) supported(peerID disco.PeerID) bool {
+	_, ok := ch.peers.Load(peerID)
+	return ok
+}
+
+// frame frames the payload of the channel to the peer, p is returned as is if it needs no framing
+func (ch *channels) frame(peerID disco.PeerID, channel byte, p []byte) ([]byte, error) {
+	if !ch.supported(peerID) {
+		if channel != channelData {
+			return nil, ErrChannelsUnsupported
+		}
+		return p, nil
+	}
+	if channel == channelData && (len(p) == 0 || p[0] != 0) {
+		return p, nil
+	}
+	return slices.Concat([]byte{0, channel}, p), nil
+}
+
+// unframe returns the channel and the payload of the datagram from the peer
+func (ch *channels) unframe(peerID disco.PeerID, b []byte) (channel byte, payload []byte) {
+	if len(b) < 2 || b[0] != 0 || !ch.supported(peerID) {
+		return channelData, b
+	}
+	return b[1], b[2:]
+}
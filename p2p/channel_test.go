@@ -0,0 +1,93 @@
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rkonfj/peerguard/disco"
+)
+
+func TestChannelsFraming(t *testing.T) {
+	var ch channels
+	ch.peerFound("new", url.Values{metaChannels: []string{channelsVersion}})
+	ch.peerFound("old", url.Values{})
+
+	for _, data := range [][]byte{{0x45, 0, 0, 20}, {0, 's', 'x'}, {0}, {}} {
+		b, err := ch.frame("new", channelData, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if channel, payload := ch.unframe("new", b); channel != channelData || !bytes.Equal(payload, data) {
+			t.Errorf("expected the data %v delivered as is, got channel %d %v", data, channel, payload)
+		}
+	}
+	b, err := ch.frame("new", channelStream, []byte("rdt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if channel, payload := ch.unframe("new", b); channel != channelStream || string(payload) != "rdt" {
+		t.Errorf("expected the stream datagram, got channel %d %q", channel, payload)
+	}
+}
+
+func TestChannelsUnsupportedPeer(t *testing.T) {
+	var ch channels
+	ch.peerFound("old", url.Values{})
+	if _, err := ch.frame("old", channelStream, []byte("rdt")); !errors.Is(err, ErrChannelsUnsupported) {
+		t.Errorf("expected the stream refused, got %v", err)
+	}
+	data := []byte{0, 's', 'x'}
+	b, err := ch.frame("old", channelData, data)
+	if err != nil || !bytes.Equal(b, data) {
+		t.Errorf("expected the data as is, got %v %v", b, err)
+	}
+	if channel, payload := ch.unframe("old", data); channel != channelData || !bytes.Equal(payload, data) {
+		t.Errorf("expected the data leading with zero delivered, got channel %d %v", channel, payload)
+	}
+	ch.peerFound("new", url.Values{metaChannels: []string{channelsVersion}})
+	ch.peerFound("new", url.Values{}) // downgraded
+	if ch.supported("new") {
+		t.Error("expected the downgraded peer unsupported")
+	}
+}
+
+func TestStreamConnDeadline(t *testing.T) {
+	c := &PeerPacketConn{closedSig: make(chan struct{})}
+	s := newStreamConn(c)
+
+	s.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	buf := make([]byte, 16)
+	if _, _, err := s.ReadFrom(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected the read deadline exceeded, got %v", err)
+	}
+	s.SetReadDeadline(time.Time{})
+	s.dispatch("peer", []byte("rdt"))
+	n, addr, err := s.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "rdt" || addr != disco.PeerID("peer") {
+		t.Fatalf("expected the datagram of the peer, got %q %v %v", buf[:n], addr, err)
+	}
+
+	s.SetWriteDeadline(time.Now().Add(-time.Second))
+	if _, err := s.WriteTo([]byte("rdt"), disco.PeerID("peer")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected the write deadline exceeded, got %v", err)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, _, err := s.ReadFrom(buf)
+		done <- err
+	}()
+	close(c.closedSig)
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected the read failed once closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the close unblocks the read")
+	}
+}
@@ -1,17 +1,27 @@
 package p2p
 
 import (
+	"crypto/ed25519"
+	"encoding/base64"
 	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
 	"net/url"
 	"time"
 
 	"github.com/rkonfj/peerguard/disco"
+	"github.com/rkonfj/peerguard/disco/tp"
 	"github.com/rkonfj/peerguard/secure"
-	"github.com/rkonfj/peerguard/secure/chacha20poly1305"
+	"github.com/rkonfj/peerguard/secure/keyring"
 )
 
-var defaultSymmAlgo func(secure.ProvideSecretKey) secure.SymmAlgo = chacha20poly1305.New
+// defaultSymmAlgo is nil means the cipher suite is selected per peer
+var defaultSymmAlgo func(secure.ProvideSecretKey) secure.SymmAlgo
 
+// SetDefaultSymmAlgo uses symmAlgo with all peers, disables the cipher suite selection.
+//
+// Deprecated: it affects all the PeerPacketConns of the process, use ListenSymmAlgo instead
 func SetDefaultSymmAlgo(symmAlgo func(secure.ProvideSecretKey) secure.SymmAlgo) {
 	defaultSymmAlgo = symmAlgo
 }
@@ -25,11 +35,53 @@ type Config struct {
 	Metadata        url.Values
 	OnPeer          OnPeer
 	KeepAlivePeriod time.Duration
+	PostQuantum     bool
+	PeerCertificate bool
+	PeerCA          ed25519.PublicKey
+	PreSharedKey    []byte
+	PreSharedKeys   map[disco.PeerID][]byte
+	CipherSuite     string
+	// Key holds the private key of the peer id, it proves the peer id to the peermap if required
+	Key secure.KeyBackend
+	Tap PacketTap
+	// QualityProbeInterval pings the peers and reports the connection quality every interval, 0 disables it
+	QualityProbeInterval time.Duration
+	// BenchDownloadRate serves the bench downloads of the peers at most at the packets per second
+	// over the direct path, 0 refuses them
+	BenchDownloadRate int
+	// DERPServer relays the datagrams by the tailscale compatible DERP server when the direct path fails
+	DERPServer string
+	// NewSymmAlgo creates the symm algo of the secure mode, nil selects the cipher suite per peer
+	NewSymmAlgo func(secure.ProvideSecretKey) secure.SymmAlgo
+	// Disco tunes the hole punching, nil uses the default
+	Disco *tp.DiscoConfig
+	// Logger is the logger of the PeerPacketConn, slog.Default() if nil
+	Logger *slog.Logger
+	// Insecure sends the datagrams to the peers in plaintext, otherwise an ephemeral key is
+	// generated if no key is chosen. It is implied by ListenPeerID since the id is not a public key
+	Insecure bool
+	// PlaintextPeers are the peers the datagrams are exchanged with in plaintext although the
+	// encryption is on, e.g. the peers run ListenPeerID or the older versions
+	PlaintextPeers []disco.PeerID
+
+	// customPeerID is the peer id chosen by ListenPeerID, the key takes precedence over it
+	customPeerID disco.PeerID
+}
+
+// preSharedKey finds the pre-shared key with the peer, the peer pair psk takes precedence
+func (cfg *Config) preSharedKey(pubKey string) []byte {
+	if psk, ok := cfg.PreSharedKeys[disco.PeerID(pubKey)]; ok {
+		return psk
+	}
+	return cfg.PreSharedKey
 }
 
 type Option func(cfg *Config) error
 type OnPeer func(disco.PeerID, url.Values)
 
+// PacketTap sees the decrypted datagrams read from or written to the peers, b must not be retained
+type PacketTap func(peerID disco.PeerID, b []byte, inbound, relayed bool)
+
 var (
 	OptionNoOp Option = func(cfg *Config) error { return nil }
 )
@@ -41,19 +93,47 @@ func ListenUDPPort(port int) Option {
 	}
 }
 
+// ListenPeerID chooses the peer id, the datagrams are sent in plaintext since the id is not a public
+// key to encrypt them by. It is ignored if the key is chosen
 func ListenPeerID(id string) Option {
 	return func(cfg *Config) error {
-		if cfg.SymmAlgo != nil {
-			return errors.New("options ListenPeerID and ListenPeerSecure/Curve25519 conflict")
-		}
-		peerID := disco.PeerID(id)
-		if peerID.Len() > 0 {
-			cfg.PeerID = peerID
+		if peerID := disco.PeerID(id); peerID.Len() > 0 {
+			cfg.customPeerID = peerID
 		}
 		return nil
 	}
 }
 
+// ListenPeerInsecure disables the end-to-end encryption with the peers, which is enabled by default
+func ListenPeerInsecure() Option {
+	return func(cfg *Config) error {
+		cfg.Insecure = true
+		return nil
+	}
+}
+
+// ListenPeerPlaintext exchanges the datagrams with the peers in plaintext although the encryption
+// is on, the undecryptable datagrams of the other peers are dropped. The downgrade is only chosen
+// locally, never by the metadata the peermap relays
+func ListenPeerPlaintext(peerIDs ...disco.PeerID) Option {
+	return func(cfg *Config) error {
+		cfg.PlaintextPeers = append(cfg.PlaintextPeers, peerIDs...)
+		return nil
+	}
+}
+
+// check checks the conflicts of the options once all applied, so that it does not depend on the
+// order of the options
+func (cfg *Config) check() error {
+	if cfg.Insecure && cfg.Key != nil {
+		return errors.New("options ListenPeerInsecure and ListenPeerSecure/Curve25519/Key conflict")
+	}
+	return nil
+}
+
+// ListenPeerSecure generates an ephemeral key, the datagrams are encrypted with all peers but the
+// ones chosen by ListenPeerPlaintext. It is the default unless a key is chosen or ListenPeerID or
+// ListenPeerInsecure is given
 func ListenPeerSecure() Option {
 	return func(cfg *Config) error {
 		priv, err := secure.GenerateCurve25519()
@@ -66,15 +146,105 @@ func ListenPeerSecure() Option {
 
 func ListenPeerCurve25519(privateKey string) Option {
 	return func(cfg *Config) error {
-		if cfg.SymmAlgo != nil {
+		if cfg.Key != nil {
 			return errors.New("repeat secure options")
 		}
 		priv, err := secure.Curve25519PrivateKey(privateKey)
 		if err != nil {
 			return err
 		}
-		cfg.SymmAlgo = defaultSymmAlgo(priv.SharedKey)
-		cfg.PeerID = disco.PeerID(priv.PublicKey.String())
+		return ListenPeerKey(priv)(cfg)
+	}
+}
+
+// ListenPeerKey uses the private key held by the key backend, e.g. a hardware-backed key
+func ListenPeerKey(key secure.KeyBackend) Option {
+	return func(cfg *Config) error {
+		if cfg.Key != nil {
+			return errors.New("repeat secure options")
+		}
+		cfg.PeerID = disco.PeerID(key.Public())
+		cfg.Key = key
+		cfg.setupSymmAlgo()
+		return nil
+	}
+}
+
+// setupSymmAlgo creates the symm algo with the key, the psk options may come after, so the psk is
+// looked up lazily
+func (cfg *Config) setupSymmAlgo() {
+	provideSecretKey := secure.WithPreSharedKey(cfg.Key.SharedKey, cfg.preSharedKey)
+	switch {
+	case cfg.NewSymmAlgo != nil:
+		cfg.SymmAlgo = cfg.NewSymmAlgo(provideSecretKey)
+	case defaultSymmAlgo != nil:
+		cfg.SymmAlgo = defaultSymmAlgo(provideSecretKey)
+	default:
+		cfg.SymmAlgo = newSuiteSymmAlgo(cfg, provideSecretKey)
+	}
+}
+
+// ListenSymmAlgo uses the symm algo created by newSymmAlgo with all peers rather than selecting the
+// cipher suite per peer, e.g. aesgcm.New. It takes effect with ListenPeerSecure/Curve25519/Key
+func ListenSymmAlgo(newSymmAlgo func(secure.ProvideSecretKey) secure.SymmAlgo) Option {
+	return func(cfg *Config) error {
+		cfg.NewSymmAlgo = newSymmAlgo
+		if cfg.Key != nil {
+			cfg.setupSymmAlgo()
+		}
+		return nil
+	}
+}
+
+// ListenPeerPostQuantum enables the hybrid (curve25519 + ML-KEM-768) key exchange
+// with the peers that also enabled it
+func ListenPeerPostQuantum() Option {
+	return func(cfg *Config) error {
+		cfg.PostQuantum = true
+		return PeerMeta(metaPostQuantum, pqKEMMLKEM768)(cfg)
+	}
+}
+
+// RequirePeerCertificate only accepts the peers presenting a valid certificate issued by the peermap
+// server. ca is the base64 encoded public key of the peermap server, leave it blank to trust the
+// connected peermap server
+func RequirePeerCertificate(ca string) Option {
+	return func(cfg *Config) error {
+		if ca != "" {
+			caPubKey, err := base64.StdEncoding.DecodeString(ca)
+			if err != nil || len(caPubKey) != ed25519.PublicKeySize {
+				return errors.New("invalid peermap ca public key")
+			}
+			cfg.PeerCA = caPubKey
+		}
+		cfg.PeerCertificate = true
+		return nil
+	}
+}
+
+// PeerPreSharedKey mixes the base64 encoded psk into the session keys with all peers in the network
+func PeerPreSharedKey(psk string) Option {
+	return func(cfg *Config) error {
+		b, err := secure.ParsePreSharedKey(psk)
+		if err != nil {
+			return err
+		}
+		cfg.PreSharedKey = b
+		return nil
+	}
+}
+
+// PeerPairPreSharedKey mixes the base64 encoded psk into the session keys with the peer
+func PeerPairPreSharedKey(peerID disco.PeerID, psk string) Option {
+	return func(cfg *Config) error {
+		b, err := secure.ParsePreSharedKey(psk)
+		if err != nil {
+			return fmt.Errorf("peer %s: %w", peerID, err)
+		}
+		if cfg.PreSharedKeys == nil {
+			cfg.PreSharedKeys = make(map[disco.PeerID][]byte)
+		}
+		cfg.PreSharedKeys[peerID] = b
 		return nil
 	}
 }
@@ -102,10 +272,91 @@ func ListenPeerUp(onPeer OnPeer) Option {
 	}
 }
 
+// ListenPacketTap calls tap with the datagrams exchanged with the peers, e.g. to capture them for debugging
+func ListenPacketTap(tap PacketTap) Option {
+	return func(cfg *Config) error {
+		cfg.Tap = tap
+		return nil
+	}
+}
+
+// ListenQualityProbe pings the peers received datagrams from recently every interval to measure the
+// connection quality, which is reported to the peermap server. The replies are dispatched by ReadFrom
+func ListenQualityProbe(interval time.Duration) Option {
+	return func(cfg *Config) error {
+		cfg.QualityProbeInterval = interval
+		return nil
+	}
+}
+
+// ListenBenchDownload serves the bench downloads (pgcli bench) the peers ask for at most at the rate
+// (packets per second), one download per peer at a time and only over the direct path
+func ListenBenchDownload(rate int) Option {
+	return func(cfg *Config) error {
+		if rate < 0 {
+			return errors.New("bench download rate must not be negative")
+		}
+		cfg.BenchDownloadRate = rate
+		return nil
+	}
+}
+
+// ListenPeerDERP relays the datagrams by the DERP server (e.g. https://derp1.tailscale.com) rather
+// than the peermap, with the peers connected to the same server. It requires ListenPeerSecure/Curve25519
+func ListenPeerDERP(server string) Option {
+	return func(cfg *Config) error {
+		cfg.DERPServer = server
+		return PeerMeta(metaDERP, server)(cfg)
+	}
+}
+
+// ListenDisco tunes the hole punching of the PeerPacketConn, the fields are clamped to the usable ranges
+func ListenDisco(discoCfg tp.DiscoConfig) Option {
+	return func(cfg *Config) error {
+		cfg.Disco = &discoCfg
+		return nil
+	}
+}
+
+// ListenLogger writes the logs of the PeerPacketConn to the logger rather than slog.Default()
+func ListenLogger(logger *slog.Logger) Option {
+	return func(cfg *Config) error {
+		cfg.Logger = logger
+		return nil
+	}
+}
+
 func FileSecretStore(storeFilePath string) disco.SecretStore {
 	return &disco.FileSecretStore{StoreFilePath: storeFilePath}
 }
 
+// SealedFileSecretStore is the FileSecretStore encrypted at rest by the sealing key
+func SealedFileSecretStore(storeFilePath string, sealingKey []byte) disco.SecretStore {
+	return &disco.FileSecretStore{StoreFilePath: storeFilePath, SealingKey: sealingKey}
+}
+
+// EncryptedFileSecretStore is the FileSecretStore sealed by the sealing key,
+// or by a key bound to the machine and the user if the sealing key is nil
+func EncryptedFileSecretStore(storeFilePath string, sealingKey []byte) *disco.FileSecretStore {
+	if sealingKey == nil {
+		sealingKey = keyring.FallbackSealingKey("pgcli")
+	}
+	return &disco.FileSecretStore{StoreFilePath: storeFilePath, SealingKey: sealingKey}
+}
+
+// KeyringSecretStore stores the network secret of the peermap server in the os keyring, the secret
+// in the store file is moved into it once. The EncryptedFileSecretStore is used instead if the
+// keyring is not available
+func KeyringSecretStore(server, storeFilePath string, sealingKey []byte) disco.SecretStore {
+	fileStore := EncryptedFileSecretStore(storeFilePath, sealingKey)
+	kr, err := keyring.Default()
+	if err != nil {
+		slog.Debug("Keyring is not available, fallback to the encrypted secret file", "err", err)
+		return fileStore
+	}
+	return &disco.KeyringSecretStore{Keyring: kr, Account: server, Migrate: fileStore}
+}
+
 func PeerSilenceMode() Option {
 	return func(cfg *Config) error {
 		if cfg.Metadata == nil {
@@ -136,6 +387,41 @@ func PeerAlias2(alias string) Option {
 	}
 }
 
+// MetaExitNode is the metadata key of the peers advertised as the exit node
+const MetaExitNode = "exitNode"
+
+// PeerExitNode advertises the peer as an exit node, the peers may route all the traffic via it
+func PeerExitNode() Option {
+	return func(cfg *Config) error {
+		if cfg.Metadata == nil {
+			cfg.Metadata = url.Values{}
+		}
+		cfg.Metadata.Set(MetaExitNode, "")
+		return nil
+	}
+}
+
+// MetaRoutes is the metadata key of the subnets (the cidr) routed via the peer
+const MetaRoutes = "routes"
+
+// PeerAdvertiseRoutes advertises the subnets reachable via the peer (a subnet router), e.g. the
+// LAN 192.168.10.0/24, the peers may route them via it
+func PeerAdvertiseRoutes(cidrs ...string) Option {
+	return func(cfg *Config) error {
+		if cfg.Metadata == nil {
+			cfg.Metadata = url.Values{}
+		}
+		for _, cidr := range cidrs {
+			prefix, err := netip.ParsePrefix(cidr)
+			if err != nil {
+				return fmt.Errorf("invalid advertised route: %w", err)
+			}
+			cfg.Metadata.Add(MetaRoutes, prefix.Masked().String())
+		}
+		return nil
+	}
+}
+
 func PeerMeta(key string, value string) Option {
 	return func(cfg *Config) error {
 		if cfg.Metadata == nil {
@@ -0,0 +1,95 @@
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"slices"
+	"testing"
+
+	"github.com/rkonfj/peerguard/disco"
+	"github.com/rkonfj/peerguard/secure"
+)
+
+func applyOptions(opts ...Option) (*Config, error) {
+	var cfg Config
+	for _, opt := range opts {
+		if err := opt(&cfg); err != nil {
+			return nil, err
+		}
+	}
+	return &cfg, cfg.check()
+}
+
+func TestOptionsOrderIndependent(t *testing.T) {
+	priv, err := secure.GenerateCurve25519()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, c := range map[string]struct {
+		opts []Option
+		ok   bool
+	}{
+		"id, insecure and key": {[]Option{ListenPeerID("id"), ListenPeerInsecure(), ListenPeerCurve25519(priv.String())}, false},
+		"insecure and key":     {[]Option{ListenPeerInsecure(), ListenPeerCurve25519(priv.String())}, false},
+		"id":                   {[]Option{ListenPeerID("id")}, true},
+		"id and key":           {[]Option{ListenPeerID("id"), ListenPeerCurve25519(priv.String())}, true},
+		"id and insecure":      {[]Option{ListenPeerID("id"), ListenPeerInsecure()}, true},
+		"key and cipher suite": {[]Option{ListenPeerCurve25519(priv.String()), ListenPeerCipherSuite(CipherSuiteAES256GCM)}, true},
+		"insecure":             {[]Option{ListenPeerInsecure(), ListenQualityProbe(0)}, true},
+	} {
+		reversed := slices.Clone(c.opts)
+		slices.Reverse(reversed)
+		for _, opts := range [][]Option{c.opts, reversed} {
+			_, err := applyOptions(opts...)
+			if (err == nil) != c.ok {
+				t.Errorf("%s: expected ok %v, got %v", name, c.ok, err)
+			}
+		}
+	}
+}
+
+// prefixSymmAlgo is the symm algo prefixes the datagrams, enough to tell the encrypted ones
+type prefixSymmAlgo struct{}
+
+func (prefixSymmAlgo) Encrypt(data []byte, pubKey string) ([]byte, error) {
+	if pubKey == "invalid" {
+		return nil, errors.New("invalid public key")
+	}
+	return append([]byte("enc:"), data...), nil
+}
+
+func (prefixSymmAlgo) Decrypt(data []byte, pubKey string) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte("enc:")) {
+		return nil, errors.New("message authentication failed")
+	}
+	return data[4:], nil
+}
+
+func (prefixSymmAlgo) SecretKey() secure.ProvideSecretKey {
+	return nil
+}
+
+func TestPlaintextPeers(t *testing.T) {
+	c := &PeerPacketConn{cfg: Config{SymmAlgo: prefixSymmAlgo{}, Logger: slog.Default()}}
+	ListenPeerPlaintext("plain")(&c.cfg)
+	p := []byte("hello")
+	if b, err := c.encrypt(p, "secure"); err != nil || !bytes.Equal(b, []byte("enc:hello")) {
+		t.Errorf("expected encrypted to the peer, got %q %v", b, err)
+	}
+	if b, err := c.encrypt(p, "plain"); err != nil || !bytes.Equal(b, p) {
+		t.Errorf("expected plaintext to the peer chosen locally, got %q %v", b, err)
+	}
+	if _, err := c.encrypt(p, "invalid"); err == nil {
+		t.Error("expected the datagram not sent in plaintext once the encryption fails")
+	}
+	if b := c.decrypt(&disco.Datagram{PeerID: "secure", Data: p}); b != nil {
+		t.Errorf("expected the plaintext datagram of the peer dropped, got %q", b)
+	}
+	if b := c.decrypt(&disco.Datagram{PeerID: "secure", Data: []byte("enc:hello")}); !bytes.Equal(b, p) {
+		t.Errorf("expected the encrypted datagram decrypted, got %q", b)
+	}
+	if b := c.decrypt(&disco.Datagram{PeerID: "plain", Data: p}); !bytes.Equal(b, p) {
+		t.Errorf("expected the plaintext datagram of the peer chosen locally accepted, got %q", b)
+	}
+}
@@ -8,14 +8,17 @@ import (
 	"io"
 	"log/slog"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/rkonfj/peerguard/crash"
 	"github.com/rkonfj/peerguard/disco"
 	"github.com/rkonfj/peerguard/disco/tp"
-	"github.com/rkonfj/peerguard/lru"
+	"github.com/rkonfj/peerguard/logging"
 	N "github.com/rkonfj/peerguard/net"
 	"github.com/rkonfj/peerguard/netlink"
+	"github.com/rkonfj/peerguard/secure"
 	"storj.io/common/base58"
 )
 
@@ -29,14 +32,26 @@ var (
 )
 
 type PeerPacketConn struct {
-	cfg               Config
-	closedSig         chan struct{}
-	udpConn           *tp.UDPConn
-	wsConn            *tp.WSConn
-	discoCooling      *lru.Cache[disco.PeerID, time.Time]
-	discoCoolingMutex sync.Mutex
-
-	deadlineRead N.Deadline
+	cfg           Config
+	closedSig     chan struct{}
+	closeOnce     sync.Once
+	udpConn       *tp.UDPConn
+	wsConn        *tp.WSConn
+	repunch       repunch
+	pqKeyExchange *pqKeyExchange
+	ekex          *ephemeralKeyExchange
+	certExchange  *certExchange
+	peerCerts     *peerCertStore
+	echo          *echo
+	bench         *bench
+	streams       *streamConn
+	channels      channels
+	stats         peerStats
+	quality       qualityTracker
+	derp          *derpRelay
+
+	deadlineRead  N.Deadline
+	deadlineWrite N.Deadline
 }
 
 // ReadFrom reads a packet from the connection,
@@ -49,24 +64,55 @@ type PeerPacketConn struct {
 // ReadFrom can be made to time out and return an error after a
 // fixed time limit; see SetDeadline and SetReadDeadline.
 func (c *PeerPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
-	select {
-	case <-c.closedSig:
-		err = net.ErrClosed
-		return
-	case _, ok := <-c.deadlineRead.Deadline():
-		if !ok {
+	for {
+		if c.deadlineRead.Exceeded() {
+			err = N.ErrDeadline
+			return
+		}
+		var datagram *disco.Datagram
+		var relayed bool
+		select {
+		case <-c.closedSig:
 			err = net.ErrClosed
 			return
+		case _, ok := <-c.deadlineRead.Deadline():
+			if !ok {
+				err = net.ErrClosed
+				return
+			}
+			err = N.ErrDeadline
+			return
+		case datagram = <-c.wsConn.Datagrams():
+			relayed = true
+		case datagram = <-c.derp.datagrams():
+			relayed = true
+		case datagram = <-c.udpConn.Datagrams():
+		}
+		b := c.decrypt(datagram)
+		if b == nil { // replayed or forged
+			continue
+		}
+		channel, b := c.channels.unframe(datagram.PeerID, b)
+		switch channel {
+		case channelData:
+		case channelStream:
+			c.streams.dispatch(datagram.PeerID, b)
+			continue
+		case channelEcho:
+			c.echo.handle(datagram.PeerID, b, relayed, c.writeEcho)
+			continue
+		case channelBench:
+			c.bench.handle(datagram.PeerID, b, relayed, c.writePath, c.writeDirect)
+			continue
+		default: // the channel of the newer version
+			continue
+		}
+		c.stats.rx(datagram.PeerID, len(b))
+		if c.cfg.Tap != nil {
+			c.cfg.Tap(datagram.PeerID, b, true, relayed)
 		}
-		err = N.ErrDeadline
-		return
-	case datagram := <-c.wsConn.Datagrams():
-		addr = datagram.PeerID
-		n = copy(p, datagram.TryDecrypt(c.cfg.SymmAlgo))
-		return
-	case datagram := <-c.udpConn.Datagrams():
 		addr = datagram.PeerID
-		n = copy(p, datagram.TryDecrypt(c.cfg.SymmAlgo))
+		n = copy(p, b)
 		return
 	}
 }
@@ -76,35 +122,85 @@ func (c *PeerPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
 // fixed time limit; see SetDeadline and SetWriteDeadline.
 // On packet-oriented connections, write timeouts are rare.
 func (c *PeerPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
-	if _, ok := addr.(disco.PeerID); !ok {
+	peerID, ok := addr.(disco.PeerID)
+	if !ok {
 		return 0, errors.New("not a p2p address")
 	}
+	if c.deadlineWrite.Exceeded() {
+		return 0, N.ErrDeadline
+	}
+	relayed, err := c.writeChannel(channelData, p, peerID)
+	if err != nil {
+		return
+	}
+	c.stats.tx(peerID, len(p), relayed)
+	if c.cfg.Tap != nil {
+		c.cfg.Tap(peerID, p, false, relayed)
+	}
+	return len(p), nil
+}
 
-	datagram := disco.Datagram{PeerID: addr.(disco.PeerID), Data: p}
-	p = datagram.TryEncrypt(c.cfg.SymmAlgo)
+// write sends the packet to the peer directly, or relays it by the DERP server shared with the
+// peer or the peermap server if the peer is not discovered yet. relayed reports the path
+func (c *PeerPacketConn) write(p []byte, peerID disco.PeerID) (relayed bool, err error) {
+	if p, err = c.encrypt(p, peerID); err != nil {
+		return false, err
+	}
+	if _, err = c.udpConn.WriteToUDP(p, peerID); err != nil {
+		c.repunch.relayed(peerID)
+		logging.Limited(context.Background(), -3, "relay/"+peerID.String(), "[Relay] WriteTo", "addr", peerID)
+		c.quality.path(peerID, true)
+		if c.derp.reachable(peerID) {
+			return true, c.derp.conn.WriteTo(p, peerID)
+		}
+		return true, c.wsConn.WriteTo(p, peerID, disco.CONTROL_RELAY)
+	}
+	if attempts := c.repunch.reached(peerID); attempts > 0 {
+		c.cfg.Logger.Info("PathUpgraded", "peer", peerID, "attempts", attempts)
+	}
+	c.quality.path(peerID, false)
+	return false, nil
+}
 
-	n, err = c.udpConn.WriteToUDP(p, datagram.PeerID)
-	if err != nil {
-		c.TryLeadDisco(datagram.PeerID)
-		slog.Log(context.Background(), -3, "[Relay] WriteTo", "addr", datagram.PeerID)
-		return len(p), c.wsConn.WriteTo(p, datagram.PeerID, disco.CONTROL_RELAY)
+// writeChannel frames p on the channel and sends it to the peer
+func (c *PeerPacketConn) writeChannel(channel byte, p []byte, peerID disco.PeerID) (relayed bool, err error) {
+	if p, err = c.channels.frame(peerID, channel, p); err != nil {
+		return false, err
 	}
-	return
+	return c.write(p, peerID)
 }
 
 // Close closes the connection.
 // Any blocked ReadFrom or WriteTo operations will be unblocked and return errors.
-func (c *PeerPacketConn) Close() error {
-	close(c.closedSig)
-	c.deadlineRead.Close()
-	var errs []error
-	if err := c.wsConn.Close(); err != nil {
-		errs = append(errs, err)
-	}
-	if err := c.udpConn.Close(); err != nil {
-		errs = append(errs, err)
-	}
-	return errors.Join(errs...)
+func (c *PeerPacketConn) Close() (err error) {
+	err = net.ErrClosed
+	c.closeOnce.Do(func() {
+		close(c.closedSig)
+		c.deadlineRead.Close()
+		c.deadlineWrite.Close()
+		c.streams.deadlineRead.Close()
+		c.streams.deadlineWrite.Close()
+		var errs []error
+		if err := c.wsConn.Close(); err != nil {
+			errs = append(errs, err)
+		}
+		if err := c.udpConn.Close(); err != nil {
+			errs = append(errs, err)
+		}
+		if c.derp != nil {
+			if err := c.derp.conn.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		err = errors.Join(errs...)
+	})
+	return
+}
+
+// closeOnPanic is the cleanup of crash.Recover closes the conn, so that the user sees the
+// conn closed instead of a silently dead loop
+func (c *PeerPacketConn) closeOnPanic() {
+	c.Close()
 }
 
 // LocalAddr returns the local network address, if known.
@@ -134,7 +230,9 @@ func (c *PeerPacketConn) LocalAddr() net.Addr {
 //
 // A zero value for t means I/O operations will not time out.
 func (c *PeerPacketConn) SetDeadline(t time.Time) error {
-	return c.SetReadDeadline(t)
+	c.deadlineRead.SetDeadline(t)
+	c.deadlineWrite.SetDeadline(t)
+	return nil
 }
 
 // SetReadDeadline sets the deadline for future ReadFrom calls
@@ -150,7 +248,11 @@ func (c *PeerPacketConn) SetReadDeadline(t time.Time) error {
 // Even if write times out, it may return n > 0, indicating that
 // some of the data was successfully written.
 // A zero value for t means WriteTo will not time out.
+//
+// The datagram is handed to the udp socket or the relay without
+// waiting, so the deadline only fails the WriteTo calls after it.
 func (c *PeerPacketConn) SetWriteDeadline(t time.Time) error {
+	c.deadlineWrite.SetDeadline(t)
 	return nil
 }
 
@@ -171,17 +273,12 @@ func (c *PeerPacketConn) Broadcast(b []byte) (int, error) {
 	return c.udpConn.Broadcast(b)
 }
 
-// TryLeadDisco try lead a peer discovery
-// disco as soon as every minute
+// TryLeadDisco try lead a peer discovery, backing off while the punching with the peer keeps
+// failing. The peers the datagrams are relayed to are punched in the background as well
 func (c *PeerPacketConn) TryLeadDisco(peerID disco.PeerID) {
-	if !c.discoCoolingMutex.TryLock() {
-		return
-	}
-	defer c.discoCoolingMutex.Unlock()
-	lastTime, ok := c.discoCooling.Get(peerID)
-	if !ok || time.Since(lastTime) > time.Minute {
+	c.repunch.relayed(peerID)
+	if c.repunch.take(peerID) {
 		c.wsConn.LeadDisco(peerID)
-		c.discoCooling.Put(peerID, time.Now())
 	}
 }
 
@@ -205,6 +302,21 @@ func (c *PeerPacketConn) PeerStore() tp.PeerStore {
 	return c.udpConn
 }
 
+// PeerPath reports the hole punching candidates exchanged with the peer and the addr it is reached on directly
+func (c *PeerPacketConn) PeerPath(peerID disco.PeerID) tp.PeerPath {
+	return c.udpConn.PeerPath(peerID)
+}
+
+// NATType is the local NAT type detected by the STUN servers
+func (c *PeerPacketConn) NATType() disco.NATType {
+	return c.udpConn.NATType()
+}
+
+// NATInfo is the mapping and the filtering behavior of the local NAT classified by the STUN servers
+func (c *PeerPacketConn) NATInfo() disco.NATInfo {
+	return c.udpConn.NATInfo()
+}
+
 // SharedKey get the key shared with the peer
 func (c *PeerPacketConn) SharedKey(peerID disco.PeerID) ([]byte, error) {
 	if c.cfg.SymmAlgo == nil {
@@ -213,14 +325,37 @@ func (c *PeerPacketConn) SharedKey(peerID disco.PeerID) ([]byte, error) {
 	return c.cfg.SymmAlgo.SecretKey()(peerID.String())
 }
 
+// PeerPublicKey get the peer's public key signed by the peermap server
+func (c *PeerPacketConn) PeerPublicKey(peerID disco.PeerID) (string, bool) {
+	cert, ok := c.peerCerts.get(peerID)
+	if !ok || cert.PublicKey == "" {
+		return "", false
+	}
+	return cert.PublicKey, true
+}
+
+// verifyPeerKey verifies the peermap signed public key distributed along with the NEW_PEER event
+func (c *PeerPacketConn) verifyPeerKey(peer *disco.Peer) {
+	cert, err := c.peerCerts.verify(peer.ID, peer.Certificate)
+	if err != nil {
+		c.cfg.Logger.Warn("InvalidPeerCertificate", "peer", peer.ID, "err", err)
+		return
+	}
+	// the peer id is the public key when the secure mode is enabled
+	if c.cfg.SymmAlgo != nil && cert.PublicKey != peer.ID.String() {
+		c.cfg.Logger.Warn("PeerPublicKeyMismatch", "peer", peer.ID, "signed", cert.PublicKey)
+	}
+}
+
 // runAddrUpdateEventLoop listen network change and restart udp and websocket listener
 func (c *PeerPacketConn) runAddrUpdateEventLoop() {
+	defer crash.Recover("p2p/addrupdate", c.closeOnPanic)
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	ch := make(chan netlink.AddrUpdate)
 	if err := netlink.AddrSubscribe(ctx, ch); err != nil {
 		close(ch)
-		slog.Error("AddrUpdateEventLoop", "err", err)
+		c.cfg.Logger.Error("AddrUpdateEventLoop", "err", err)
 		return
 	}
 
@@ -236,32 +371,58 @@ func (c *PeerPacketConn) runAddrUpdateEventLoop() {
 		if !e.New || disco.IPIgnored(e.Addr.IP) {
 			continue
 		}
-		slog.Log(context.Background(), -2, "NewAddr", "addr", e.Addr.String(), "link", e.LinkIndex)
+		c.cfg.Logger.Log(context.Background(), -2, "NewAddr", "addr", e.Addr.String(), "link", e.LinkIndex)
 		if err := c.udpConn.RestartListener(); err != nil {
-			slog.Error("RestartUDPListener", "err", err)
+			c.cfg.Logger.Error("RestartUDPListener", "err", err)
 		}
 
 		c.udpConn.RequestSTUN("", c.wsConn.STUNs()) // update NAT type
 
 		if err := c.wsConn.RestartListener(); err != nil {
-			slog.Error("RestartWebsocketListener", "err", err)
+			c.cfg.Logger.Error("RestartWebsocketListener", "err", err)
 		}
-		c.discoCoolingMutex.Lock()
-		c.discoCooling.Clear()
-		c.discoCoolingMutex.Unlock()
+		c.repunch.reset()
 	}
 }
 
 // runControlEventLoop events control loop
 func (c *PeerPacketConn) runControlEventLoop() {
+	defer crash.Recover("p2p/control", c.closeOnPanic)
 	for {
 		select {
 		case peer, ok := <-c.wsConn.Peers():
 			if !ok {
 				return
 			}
-			go c.udpConn.GenerateLocalAddrsSends(peer.ID, c.wsConn.STUNs())
-			if onPeer := c.cfg.OnPeer; onPeer != nil {
+			// the peer is introduced again once reconnected to the peermap, the udp path still
+			// alive is kept rather than punched again. The peer replayed is not introduced by the
+			// peermap, so the discovery is led to punch both sides
+			switch {
+			case c.udpConn.PeerReachable(peer.ID):
+				c.cfg.Logger.Debug("PeerPathResumed", "peer", peer.ID)
+			case peer.Replayed:
+				c.TryLeadDisco(peer.ID)
+			default:
+				go c.udpConn.GenerateLocalAddrsSends(peer.ID, c.wsConn.STUNs())
+			}
+			if peer.Certificate != "" {
+				c.verifyPeerKey(peer)
+			}
+			if suiteSymmAlgo, ok := c.cfg.SymmAlgo.(*suiteSymmAlgo); ok {
+				suiteSymmAlgo.peerFound(peer.ID, peer.Metadata)
+			}
+			c.derp.peerFound(peer.ID, peer.Metadata)
+			c.channels.peerFound(peer.ID, peer.Metadata)
+			if c.pqKeyExchange != nil && peer.Metadata.Get(metaPostQuantum) == pqKEMMLKEM768 &&
+				c.cfg.PeerID < peer.ID { // the smaller one initiates
+				go c.pqKeyExchange.initiate(peer.ID)
+			}
+			if c.ekex != nil {
+				go c.ekex.peerFound(peer.ID)
+			}
+			if c.certExchange != nil {
+				go c.certExchange.peerFound(peer.ID, peer.Metadata)
+			} else if onPeer := c.cfg.OnPeer; onPeer != nil {
 				go onPeer(peer.ID, peer.Metadata)
 			}
 		case revcUDPAddr, ok := <-c.wsConn.PeersUDPAddrs():
@@ -282,7 +443,7 @@ func (c *PeerPacketConn) runControlEventLoop() {
 					data = append(data, []byte(sendUDPAddr.Type)...)
 					err := c.wsConn.WriteTo(data, sendUDPAddr.ID, disco.CONTROL_NEW_PEER_UDP_ADDR)
 					if err == nil {
-						slog.Debug("ListenUDP", "addr", sendUDPAddr.Addr, "for", sendUDPAddr.ID)
+						c.cfg.Logger.Debug("ListenUDP", "addr", sendUDPAddr.Addr, "for", sendUDPAddr.ID)
 						break
 					}
 					time.Sleep(200 * time.Millisecond)
@@ -311,6 +472,41 @@ func ListenPacketContext(ctx context.Context, peermap *disco.Peermap, opts ...Op
 			return nil, fmt.Errorf("config error: %w", err)
 		}
 	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	if err := cfg.check(); err != nil {
+		return nil, fmt.Errorf("config error: %w", err)
+	}
+	if cfg.customPeerID != "" && cfg.Key == nil {
+		// the peer id is not a public key to encrypt the datagrams by
+		cfg.PeerID, cfg.Insecure = cfg.customPeerID, true
+	}
+	if cfg.SymmAlgo == nil && !cfg.Insecure {
+		// end-to-end encryption by default, the peer id is the public key of the ephemeral key
+		if err := ListenPeerSecure()(&cfg); err != nil {
+			return nil, fmt.Errorf("config error: %w", err)
+		}
+	}
+	if cfg.PostQuantum && cfg.SymmAlgo == nil {
+		return nil, errors.New("config error: post-quantum key exchange requires ListenPeerSecure/Curve25519")
+	}
+	if (len(cfg.PreSharedKey) > 0 || len(cfg.PreSharedKeys) > 0) && cfg.SymmAlgo == nil {
+		return nil, errors.New("config error: pre-shared key requires ListenPeerSecure/Curve25519")
+	}
+	if suiteSymmAlgo, ok := cfg.SymmAlgo.(*suiteSymmAlgo); ok {
+		if err := PeerMeta(metaCipherSuites, strings.Join(suiteSymmAlgo.preferences(), ","))(&cfg); err != nil {
+			return nil, fmt.Errorf("config error: %w", err)
+		}
+	} else if cfg.CipherSuite != "" {
+		return nil, errors.New("config error: cipher suite selection requires ListenPeerSecure/Curve25519")
+	}
+	if err := PeerMeta(metaChannels, channelsVersion)(&cfg); err != nil {
+		return nil, fmt.Errorf("config error: %w", err)
+	}
+	if cfg.DERPServer != "" && cfg.Key == nil {
+		return nil, errors.New("config error: DERP relay requires ListenPeerSecure/Curve25519")
+	}
 
 	udpConn, err := tp.ListenUDP(tp.UDPConfig{
 		Port:                  cfg.UDPPort,
@@ -318,28 +514,81 @@ func ListenPacketContext(ctx context.Context, peermap *disco.Peermap, opts ...Op
 		DisableIPv6:           cfg.DisableIPv6,
 		ID:                    cfg.PeerID,
 		PeerKeepaliveInterval: cfg.KeepAlivePeriod,
+		Disco:                 cfg.Disco,
 	})
 	if err != nil {
 		return nil, err
 	}
 
+	if cfg.Key != nil {
+		peermap.WithPeerKey(cfg.Key)
+	}
 	wsConn, err := tp.DialPeermap(ctx, peermap, cfg.PeerID, cfg.Metadata)
 	if err != nil {
 		udpConn.Close()
 		return nil, err
 	}
 
+	var derp *derpRelay
+	if cfg.DERPServer != "" {
+		derpConn, err := tp.DialDERP(ctx, cfg.DERPServer, cfg.Key)
+		if err != nil {
+			wsConn.Close()
+			udpConn.Close()
+			return nil, err
+		}
+		derp = &derpRelay{conn: derpConn}
+	}
+
 	udpConn.RequestSTUN("", wsConn.STUNs())
 
-	slog.Info("ListenPeer", "addr", cfg.PeerID)
+	cfg.Logger.Info("ListenPeer", "addr", cfg.PeerID)
 	packetConn := PeerPacketConn{
-		cfg:          cfg,
-		closedSig:    make(chan struct{}),
-		udpConn:      udpConn,
-		wsConn:       wsConn,
-		discoCooling: lru.New[disco.PeerID, time.Time](1024),
+		cfg:       cfg,
+		closedSig: make(chan struct{}),
+		udpConn:   udpConn,
+		wsConn:    wsConn,
+		peerCerts: newPeerCertStore(wsConn, cfg.PeerCA),
+		echo:      newEcho(),
+		bench:     newBench(cfg.BenchDownloadRate),
+		derp:      derp,
+	}
+	packetConn.streams = newStreamConn(&packetConn)
+	if cfg.PostQuantum {
+		pqKeyExchange, err := newPQKeyExchange(wsConn, cfg.SymmAlgo, cfg.Logger)
+		if err != nil {
+			wsConn.Close()
+			udpConn.Close()
+			return nil, err
+		}
+		packetConn.pqKeyExchange = pqKeyExchange
+		wsConn.Register(pqKeyExchange)
+	}
+	if _, ok := cfg.SymmAlgo.(secure.EphemeralMixer); ok {
+		ekex, err := newEphemeralKeyExchange(wsConn, cfg.SymmAlgo, cfg.PeerID, cfg.Logger)
+		if err != nil {
+			wsConn.Close()
+			udpConn.Close()
+			return nil, err
+		}
+		packetConn.ekex = ekex
+		wsConn.Register(ekex)
+		go ekex.run(packetConn.closedSig)
+	}
+	if cfg.PeerCertificate {
+		if wsConn.Certificate() == "" {
+			wsConn.Close()
+			udpConn.Close()
+			return nil, errors.New("peer certificate is not supported by the peermap server")
+		}
+		packetConn.certExchange = newCertExchange(wsConn, packetConn.peerCerts, cfg.OnPeer, cfg.Logger)
+		wsConn.Register(packetConn.certExchange)
 	}
 	go packetConn.runControlEventLoop()
 	go packetConn.runAddrUpdateEventLoop()
+	go packetConn.runRepunchLoop()
+	if cfg.QualityProbeInterval > 0 {
+		go packetConn.runQualityProbe(cfg.QualityProbeInterval)
+	}
 	return &packetConn, nil
 }
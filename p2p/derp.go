@@ -0,0 +1,46 @@
+package p2p
+
+import (
+	"net/url"
+	"sync"
+
+	"github.com/rkonfj/peerguard/disco"
+	"github.com/rkonfj/peerguard/disco/tp"
+)
+
+// metaDERP is the DERP server the peer is connected to, the datagrams are relayed by it
+// only if both sides connected to the same server
+const metaDERP = "derp"
+
+// derpRelay is the DERP path to the peers, a nil derpRelay disables it
+type derpRelay struct {
+	conn  *tp.DERPConn
+	peers sync.Map // disco.PeerID -> the DERP server of the peer
+}
+
+func (r *derpRelay) peerFound(peerID disco.PeerID, metadata url.Values) {
+	if r == nil {
+		return
+	}
+	if server := metadata.Get(metaDERP); server != "" {
+		r.peers.Store(peerID, server)
+		return
+	}
+	r.peers.Delete(peerID)
+}
+
+func (r *derpRelay) reachable(peerID disco.PeerID) bool {
+	if r == nil {
+		return false
+	}
+	server, ok := r.peers.Load(peerID)
+	return ok && server.(string) == r.conn.ServerURL()
+}
+
+// datagrams is nil if the DERP relay is disabled, so it never fires in the select
+func (r *derpRelay) datagrams() <-chan *disco.Datagram {
+	if r == nil {
+		return nil
+	}
+	return r.conn.Datagrams()
+}
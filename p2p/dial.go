@@ -0,0 +1,173 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rkonfj/peerguard/crash"
+	"github.com/rkonfj/peerguard/disco"
+	N "github.com/rkonfj/peerguard/net"
+)
+
+var _ net.Conn = (*PeerConn)(nil)
+
+// PeerConn is the connection bound to a single peer, the datagrams from the other peers are dropped.
+// It is a net.Conn of the unreliable datagrams, each Write is a datagram and each Read reads one
+type PeerConn struct {
+	conn      *PeerPacketConn
+	peerID    disco.PeerID
+	datagrams chan []byte
+	closedSig chan struct{} // closed by the read loop once it is stopped
+	err       error         // the error stopped the read loop, read after closedSig
+	closeOnce sync.Once
+
+	deadlineRead N.Deadline
+}
+
+// Dial connects to the peer by the first available peermap of the network, the peer is signaled,
+// the udp hole is punched and the secure handshake is done before it returns. The connection is
+// usable once returned even if the punching fails, the datagrams are relayed by the peermap then.
+// The secure mode (ListenPeerSecure) is enabled unless the opts choose the key, as ListenPacket does
+func Dial(ctx context.Context, networkSecret disco.NetworkSecret, peermaps []string, peerID disco.PeerID, opts ...Option) (*PeerConn, error) {
+	if len(peermaps) == 0 {
+		return nil, errors.New("at least one peermap is required")
+	}
+	var errs []error
+	for _, server := range peermaps {
+		secret := networkSecret
+		peermap, err := disco.NewPeermapURL(server, &secret)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		packetConn, err := ListenPacketContext(ctx, peermap, opts...)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", server, err))
+			continue
+		}
+		conn := newPeerConn(packetConn, peerID)
+		if err := conn.handshake(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+	return nil, fmt.Errorf("dial peer %s: %w", peerID, errors.Join(errs...))
+}
+
+func newPeerConn(packetConn *PeerPacketConn, peerID disco.PeerID) *PeerConn {
+	c := PeerConn{
+		conn:      packetConn,
+		peerID:    peerID,
+		datagrams: make(chan []byte, 128),
+		closedSig: make(chan struct{}),
+	}
+	go c.runReadLoop()
+	return &c
+}
+
+// handshake pings the peer until it replies, the first datagrams trigger the disco (punching)
+// and the key exchange, the reply proves the peer decrypts them
+func (c *PeerConn) handshake(ctx context.Context) error {
+	for {
+		pingCtx, cancel := context.WithTimeout(ctx, time.Second)
+		_, err := c.conn.Ping(pingCtx, c.peerID)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("handshake with peer %s: %w", c.peerID, ctx.Err())
+		}
+		if errors.Is(err, net.ErrClosed) {
+			return err
+		}
+	}
+}
+
+// runReadLoop reads the PeerPacketConn (the echo replies are dispatched by reading it) and queues
+// the datagrams of the peer, the datagram is dropped if the queue is full
+func (c *PeerConn) runReadLoop() {
+	defer crash.Recover("p2p/peerconn", func() {
+		c.err = net.ErrClosed
+		close(c.closedSig)
+		c.Close()
+	})
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := c.conn.ReadFrom(buf)
+		if err != nil {
+			c.err = err
+			close(c.closedSig)
+			return
+		}
+		if addr != c.peerID {
+			continue
+		}
+		select {
+		case c.datagrams <- append([]byte(nil), buf[:n]...):
+		default:
+		}
+	}
+}
+
+// Read reads a datagram of the peer, the rest is discarded if b is too short
+func (c *PeerConn) Read(b []byte) (int, error) {
+	select {
+	case p := <-c.datagrams:
+		return copy(b, p), nil
+	case <-c.closedSig:
+		return 0, c.err
+	case _, ok := <-c.deadlineRead.Deadline():
+		if !ok {
+			return 0, net.ErrClosed
+		}
+		return 0, N.ErrDeadline
+	}
+}
+
+// Write writes b as a datagram to the peer
+func (c *PeerConn) Write(b []byte) (int, error) {
+	return c.conn.WriteTo(b, c.peerID)
+}
+
+// Close closes the underlying PeerPacketConn
+func (c *PeerConn) Close() (err error) {
+	err = net.ErrClosed
+	c.closeOnce.Do(func() {
+		c.deadlineRead.Close()
+		err = c.conn.Close()
+	})
+	return
+}
+
+func (c *PeerConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *PeerConn) RemoteAddr() net.Addr {
+	return c.peerID
+}
+
+func (c *PeerConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *PeerConn) SetReadDeadline(t time.Time) error {
+	c.deadlineRead.SetDeadline(t)
+	return nil
+}
+
+func (c *PeerConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// PacketConn is the PeerPacketConn the connection is bound on, e.g. for the stats and the path
+func (c *PeerConn) PacketConn() *PeerPacketConn {
+	return c.conn
+}
@@ -0,0 +1,53 @@
+package p2p
+
+import (
+	"errors"
+	"slices"
+
+	"github.com/rkonfj/peerguard/disco"
+	"github.com/rkonfj/peerguard/secure"
+)
+
+// plaintextPeer reports whether the datagrams with the peer are allowed in plaintext although the
+// encryption is on, it is only chosen locally by ListenPeerPlaintext
+func (cfg *Config) plaintextPeer(peerID disco.PeerID) bool {
+	return slices.Contains(cfg.PlaintextPeers, peerID)
+}
+
+// encrypt encrypts the datagram to the peer. The datagram is sent in plaintext only if the
+// encryption is off or the peer is chosen by ListenPeerPlaintext, it is never sent in plaintext
+// because the encryption fails
+func (c *PeerPacketConn) encrypt(p []byte, peerID disco.PeerID) ([]byte, error) {
+	if c.cfg.SymmAlgo == nil || c.cfg.plaintextPeer(peerID) {
+		return p, nil
+	}
+	return c.cfg.SymmAlgo.Encrypt(p, peerID.String())
+}
+
+// decrypt decrypts the datagram from the peer, nil is returned if it is replayed or it can not be
+// decrypted, so the forged and the plaintext datagrams are dropped. The plaintext datagrams of
+// the peers chosen by ListenPeerPlaintext are accepted
+func (c *PeerPacketConn) decrypt(datagram *disco.Datagram) []byte {
+	if c.cfg.SymmAlgo == nil {
+		return datagram.Data
+	}
+	b, err := c.cfg.SymmAlgo.Decrypt(datagram.Data, datagram.PeerID.String())
+	switch {
+	case err == nil:
+		return b
+	case errors.Is(err, secure.ErrStaleSession):
+		// the peer restarted or the datagram is replayed, a new key exchange tells
+		c.cfg.Logger.Debug("Datagram of a stale session", "peer", datagram.PeerID)
+		if c.ekex != nil {
+			go c.ekex.staleSession(datagram.PeerID)
+		}
+		return nil
+	case errors.Is(err, secure.ErrReplayedData):
+		c.cfg.Logger.Debug("Datagram replayed", "peer", datagram.PeerID)
+		return nil
+	case c.cfg.plaintextPeer(datagram.PeerID):
+		return datagram.Data
+	}
+	c.cfg.Logger.Debug("Datagram dropped, decrypt error", "peer", datagram.PeerID, "err", err)
+	return nil
+}
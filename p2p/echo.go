@@ -0,0 +1,108 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rkonfj/peerguard/disco"
+)
+
+// the echo packets are carried on the echo channel
+const (
+	echoRequest byte = 1
+	echoReply   byte = 2
+
+	echoPacketSize = 1 + 4 + 8 + 1 // type | seq | timestamp | request relayed
+)
+
+// Pong is the result of a ping
+type Pong struct {
+	Seq uint32
+	RTT time.Duration
+	// Relayed is true if the request is relayed by the peermap server
+	Relayed bool
+	// ReplyRelayed is true if the reply is relayed by the peermap server
+	ReplyRelayed bool
+}
+
+// echo answers the echo requests and dispatches the replies to the pending pings,
+// the echo packets are handled in the conn and never returned by ReadFrom
+type echo struct {
+	seq          atomic.Uint32
+	pendingMutex sync.Mutex
+	pending      map[uint32]chan Pong
+}
+
+func newEcho() *echo {
+	return &echo{pending: make(map[uint32]chan Pong)}
+}
+
+func (e *echo) request(seq uint32) []byte {
+	b := make([]byte, echoPacketSize)
+	b[0] = echoRequest
+	binary.BigEndian.PutUint32(b[1:], seq)
+	binary.BigEndian.PutUint64(b[5:], uint64(time.Now().UnixNano()))
+	return b
+}
+
+// handle handles the packet of the echo channel, write sends the reply to the peer
+func (e *echo) handle(peerID disco.PeerID, b []byte, relayed bool, write func([]byte, disco.PeerID) (bool, error)) {
+	if len(b) != echoPacketSize {
+		return
+	}
+	switch b[0] {
+	case echoRequest:
+		reply := bytes.Clone(b)
+		reply[0] = echoReply
+		if relayed {
+			reply[13] = 1
+		}
+		write(reply, peerID)
+	case echoReply:
+		seq := binary.BigEndian.Uint32(b[1:])
+		sent := time.Unix(0, int64(binary.BigEndian.Uint64(b[5:])))
+		e.pendingMutex.Lock()
+		ch, ok := e.pending[seq]
+		delete(e.pending, seq)
+		e.pendingMutex.Unlock()
+		if ok {
+			ch <- Pong{Seq: seq, RTT: time.Since(sent), Relayed: b[13] == 1, ReplyRelayed: relayed}
+		}
+	}
+}
+
+// writeEcho sends the echo packet to the peer on the echo channel
+func (c *PeerPacketConn) writeEcho(p []byte, peerID disco.PeerID) (bool, error) {
+	return c.writeChannel(channelEcho, p, peerID)
+}
+
+// Ping sends an echo request to the peer over the p2p network and waits for the reply,
+// ErrChannelsUnsupported is returned if the peer runs a version does not support the echo
+func (c *PeerPacketConn) Ping(ctx context.Context, peerID disco.PeerID) (Pong, error) {
+	seq := c.echo.seq.Add(1)
+	ch := make(chan Pong, 1)
+	c.echo.pendingMutex.Lock()
+	c.echo.pending[seq] = ch
+	c.echo.pendingMutex.Unlock()
+	defer func() {
+		c.echo.pendingMutex.Lock()
+		delete(c.echo.pending, seq)
+		c.echo.pendingMutex.Unlock()
+	}()
+	if _, err := c.writeEcho(c.echo.request(seq), peerID); err != nil {
+		return Pong{}, err
+	}
+	select {
+	case pong := <-ch:
+		return pong, nil
+	case <-ctx.Done():
+		return Pong{}, ctx.Err()
+	case <-c.closedSig:
+		return Pong{}, net.ErrClosed
+	}
+}
@@ -0,0 +1,33 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rkonfj/peerguard/disco"
+)
+
+func TestEchoRequestReply(t *testing.T) {
+	e := newEcho()
+	ch := make(chan Pong, 1)
+	e.pending[7] = ch
+
+	var reply []byte
+	e.handle("peer", e.request(7), true, func(b []byte, peerID disco.PeerID) (bool, error) {
+		reply = b
+		return false, nil
+	})
+	if len(reply) != echoPacketSize || reply[0] != echoReply {
+		t.Fatalf("expected the echo reply, got %v", reply)
+	}
+	e.handle("peer", reply, false, nil)
+	select {
+	case pong := <-ch:
+		if pong.Seq != 7 || !pong.Relayed || pong.ReplyRelayed {
+			t.Errorf("unexpected pong %+v", pong)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the pong dispatched to the pending ping")
+	}
+	e.handle("peer", reply[:echoPacketSize-1], false, nil) // truncated, ignored
+}
@@ -0,0 +1,127 @@
+package p2p
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/rkonfj/peerguard/crash"
+	"github.com/rkonfj/peerguard/disco"
+	"github.com/rkonfj/peerguard/disco/tp"
+	"github.com/rkonfj/peerguard/secure"
+)
+
+var _ disco.Controller = (*ephemeralKeyExchange)(nil)
+
+// ephemeralKeyExchange runs the ephemeral key exchange with the peers once found and every rekey
+// interval, the secrets are mixed into the session keys (forward secrecy). The smaller peer id
+// initiates, either one initiates at once if the peer is found sealing by a stale session (e.g. one
+// of the peers restarted). The peers of the releases before ignore the messages
+type ephemeralKeyExchange struct {
+	wsConn   *tp.WSConn
+	exchange *secure.EphemeralExchange
+	localID  disco.PeerID
+	logger   *slog.Logger
+
+	peersMutex sync.Mutex
+	peers      map[disco.PeerID]time.Time // the time of the last exchange initiated
+}
+
+func newEphemeralKeyExchange(wsConn *tp.WSConn, symmAlgo secure.SymmAlgo, localID disco.PeerID, logger *slog.Logger) (*ephemeralKeyExchange, error) {
+	exchange, err := secure.NewEphemeralExchange(symmAlgo)
+	if err != nil {
+		return nil, err
+	}
+	return &ephemeralKeyExchange{
+		wsConn:   wsConn,
+		exchange: exchange,
+		localID:  localID,
+		logger:   logger,
+		peers:    make(map[disco.PeerID]time.Time),
+	}, nil
+}
+
+func (x *ephemeralKeyExchange) Name() string {
+	return "ekex"
+}
+
+func (x *ephemeralKeyExchange) Type() uint8 {
+	return disco.CONTROL_EPHEMERAL_KEY_EXCHANGE.Byte()
+}
+
+func (x *ephemeralKeyExchange) Handle(b []byte) {
+	peerID := disco.PeerID(b[2 : b[1]+2])
+	reply, err := x.exchange.Handle(peerID.String(), b[b[1]+2:])
+	if err != nil {
+		x.logger.Debug("[EKEX] InvalidMessage", "peer", peerID, "err", err)
+		return
+	}
+	if reply == nil {
+		x.logger.Debug("[EKEX] EphemeralKeyConfirmed", "peer", peerID)
+		return
+	}
+	if err := x.wsConn.WriteTo(reply, peerID, disco.CONTROL_EPHEMERAL_KEY_EXCHANGE); err != nil {
+		x.logger.Error("[EKEX] SendReply", "peer", peerID, "err", err)
+	}
+}
+
+// peerFound the smaller one initiates
+func (x *ephemeralKeyExchange) peerFound(peerID disco.PeerID) {
+	x.peersMutex.Lock()
+	if _, ok := x.peers[peerID]; !ok {
+		x.peers[peerID] = time.Time{}
+	}
+	x.peersMutex.Unlock()
+	if x.localID < peerID {
+		x.initiate(peerID, 0)
+	}
+}
+
+// staleSession the peer is found sealing by a stale session, the key exchange is initiated at most
+// once every 5 seconds since the stale datagrams may be replayed by anyone
+func (x *ephemeralKeyExchange) staleSession(peerID disco.PeerID) {
+	x.initiate(peerID, 5*time.Second)
+}
+
+// initiate starts a key exchange with the peer unless one is initiated within the interval
+func (x *ephemeralKeyExchange) initiate(peerID disco.PeerID, interval time.Duration) {
+	x.peersMutex.Lock()
+	if time.Since(x.peers[peerID]) < interval {
+		x.peersMutex.Unlock()
+		return
+	}
+	x.peers[peerID] = time.Now()
+	x.peersMutex.Unlock()
+	offer, err := x.exchange.Offer(peerID.String())
+	if err != nil {
+		x.logger.Error("[EKEX] Offer", "peer", peerID, "err", err)
+		return
+	}
+	if err := x.wsConn.WriteTo(offer, peerID, disco.CONTROL_EPHEMERAL_KEY_EXCHANGE); err != nil {
+		x.logger.Error("[EKEX] SendOffer", "peer", peerID, "err", err)
+	}
+}
+
+// run the smaller one initiates the key exchange with the peers every rekey interval
+func (x *ephemeralKeyExchange) run(closedSig <-chan struct{}) {
+	defer crash.Recover("p2p/ekex")
+	for {
+		interval := secure.CurrentRekeyConfig().Interval
+		select {
+		case <-closedSig:
+			return
+		case <-time.After(interval):
+		}
+		x.peersMutex.Lock()
+		var peers []disco.PeerID
+		for peerID := range x.peers {
+			if x.localID < peerID {
+				peers = append(peers, peerID)
+			}
+		}
+		x.peersMutex.Unlock()
+		for _, peerID := range peers {
+			x.initiate(peerID, interval/2)
+		}
+	}
+}
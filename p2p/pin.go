@@ -0,0 +1,114 @@
+package p2p
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/rkonfj/peerguard/disco"
+)
+
+var _ PinStore = (*FilePinStore)(nil)
+
+// PinStore records the peer (public key) first seen for an identity, e.g. the peer's
+// ip address, so that another peer claiming the same identity is detected
+type PinStore interface {
+	// Pin pins the identity to peerID if it is not pinned yet, ErrPinMismatch
+	// is returned if the identity is already pinned to another peer
+	Pin(identity string, peerID disco.PeerID) error
+	Pins() (map[string]disco.PeerID, error)
+	// Unpin removes the pins of identities, all pins are removed if none is specified
+	Unpin(identities ...string) error
+}
+
+type ErrPinMismatch struct {
+	Identity string
+	Pinned   disco.PeerID
+	PeerID   disco.PeerID
+}
+
+func (e ErrPinMismatch) Error() string {
+	return fmt.Sprintf("identity %s is pinned to peer %s, but %s is presented", e.Identity, e.Pinned, e.PeerID)
+}
+
+func (e ErrPinMismatch) Is(target error) bool {
+	_, ok := target.(ErrPinMismatch)
+	return ok
+}
+
+type FilePinStore struct {
+	StoreFilePath string
+
+	mut sync.Mutex
+}
+
+func (s *FilePinStore) Pin(identity string, peerID disco.PeerID) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	pins, err := s.load()
+	if err != nil {
+		return err
+	}
+	if pinned, ok := pins[identity]; ok {
+		if pinned != peerID {
+			return ErrPinMismatch{Identity: identity, Pinned: pinned, PeerID: peerID}
+		}
+		return nil
+	}
+	pins[identity] = peerID
+	return s.save(pins)
+}
+
+func (s *FilePinStore) Pins() (map[string]disco.PeerID, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.load()
+}
+
+func (s *FilePinStore) Unpin(identities ...string) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if len(identities) == 0 {
+		return s.save(map[string]disco.PeerID{})
+	}
+	pins, err := s.load()
+	if err != nil {
+		return err
+	}
+	for _, identity := range identities {
+		delete(pins, identity)
+	}
+	return s.save(pins)
+}
+
+func (s *FilePinStore) load() (map[string]disco.PeerID, error) {
+	pins := make(map[string]disco.PeerID)
+	f, err := os.Open(s.StoreFilePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return pins, nil
+		}
+		return nil, fmt.Errorf("file pin store(%s) open failed: %w", s.StoreFilePath, err)
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&pins); err != nil {
+		return nil, fmt.Errorf("file pin store(%s) decode failed: %w", s.StoreFilePath, err)
+	}
+	return pins, nil
+}
+
+func (s *FilePinStore) save(pins map[string]disco.PeerID) error {
+	f, err := os.OpenFile(s.StoreFilePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("file pin store(%s) open failed: %w", s.StoreFilePath, err)
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(pins); err != nil {
+		f.Close()
+		return fmt.Errorf("file pin store(%s) encode failed: %w", s.StoreFilePath, err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,129 @@
+package p2p
+
+import (
+	"crypto/mlkem"
+	"errors"
+	"log/slog"
+	"sync"
+
+	"github.com/rkonfj/peerguard/disco"
+	"github.com/rkonfj/peerguard/disco/tp"
+	"github.com/rkonfj/peerguard/secure"
+)
+
+const (
+	// metaPostQuantum is the metadata key advertising the post-quantum KEM capability
+	metaPostQuantum = "pq"
+	pqKEMMLKEM768   = "mlkem768"
+
+	pqMsgEncapsulationKey byte = 1
+	pqMsgCiphertext       byte = 2
+)
+
+var _ disco.Controller = (*pqKeyExchange)(nil)
+
+// pqKeyExchange runs a ML-KEM-768 key exchange with peers over the relay channel and
+// mixes the KEM shared secret into the curve25519 shared key (hybrid key exchange).
+// Messages are sealed with the curve25519 session, so the exchange is authenticated
+// by the long-term keys and can't be tampered by the peermap server.
+type pqKeyExchange struct {
+	wsConn   *tp.WSConn
+	symmAlgo secure.SymmAlgo
+	mixer    secure.KeyMixer
+	logger   *slog.Logger
+
+	pendingMutex sync.Mutex
+	pending      map[disco.PeerID]*mlkem.DecapsulationKey768
+}
+
+func newPQKeyExchange(wsConn *tp.WSConn, symmAlgo secure.SymmAlgo, logger *slog.Logger) (*pqKeyExchange, error) {
+	mixer, ok := symmAlgo.(secure.KeyMixer)
+	if !ok {
+		return nil, errors.New("post-quantum key exchange: symm algo does not support key mixing")
+	}
+	return &pqKeyExchange{
+		wsConn:   wsConn,
+		symmAlgo: symmAlgo,
+		mixer:    mixer,
+		logger:   logger,
+		pending:  make(map[disco.PeerID]*mlkem.DecapsulationKey768),
+	}, nil
+}
+
+func (x *pqKeyExchange) Name() string {
+	return "pqkex"
+}
+
+func (x *pqKeyExchange) Type() uint8 {
+	return disco.CONTROL_KEY_EXCHANGE.Byte()
+}
+
+func (x *pqKeyExchange) Handle(b []byte) {
+	peerID := disco.PeerID(b[2 : b[1]+2])
+	msg, err := x.symmAlgo.Decrypt(b[b[1]+2:], peerID.String())
+	if err != nil || len(msg) == 0 {
+		x.logger.Debug("[PQ] InvalidMessage", "peer", peerID, "err", err)
+		return
+	}
+	switch msg[0] {
+	case pqMsgEncapsulationKey:
+		ek, err := mlkem.NewEncapsulationKey768(msg[1:])
+		if err != nil {
+			x.logger.Error("[PQ] InvalidEncapsulationKey", "peer", peerID, "err", err)
+			return
+		}
+		sharedKey, ciphertext := ek.Encapsulate()
+		// seal the reply before mixing, the peer can't open the mixed session yet
+		if err := x.send(peerID, pqMsgCiphertext, ciphertext); err != nil {
+			x.logger.Error("[PQ] SendCiphertext", "peer", peerID, "err", err)
+			return
+		}
+		x.mix(peerID, sharedKey)
+	case pqMsgCiphertext:
+		x.pendingMutex.Lock()
+		dk, ok := x.pending[peerID]
+		delete(x.pending, peerID)
+		x.pendingMutex.Unlock()
+		if !ok {
+			x.logger.Debug("[PQ] UnexpectedCiphertext", "peer", peerID)
+			return
+		}
+		sharedKey, err := dk.Decapsulate(msg[1:])
+		if err != nil {
+			x.logger.Error("[PQ] Decapsulate", "peer", peerID, "err", err)
+			return
+		}
+		x.mix(peerID, sharedKey)
+	}
+}
+
+// initiate starts a key exchange with the peer
+func (x *pqKeyExchange) initiate(peerID disco.PeerID) {
+	dk, err := mlkem.GenerateKey768()
+	if err != nil {
+		x.logger.Error("[PQ] GenerateKey", "err", err)
+		return
+	}
+	x.pendingMutex.Lock()
+	x.pending[peerID] = dk
+	x.pendingMutex.Unlock()
+	if err := x.send(peerID, pqMsgEncapsulationKey, dk.EncapsulationKey().Bytes()); err != nil {
+		x.logger.Error("[PQ] SendEncapsulationKey", "peer", peerID, "err", err)
+	}
+}
+
+func (x *pqKeyExchange) send(peerID disco.PeerID, msgType byte, data []byte) error {
+	b, err := x.symmAlgo.Encrypt(append([]byte{msgType}, data...), peerID.String())
+	if err != nil {
+		return err
+	}
+	return x.wsConn.WriteTo(b, peerID, disco.CONTROL_KEY_EXCHANGE)
+}
+
+func (x *pqKeyExchange) mix(peerID disco.PeerID, sharedKey []byte) {
+	if err := x.mixer.MixKey(peerID.String(), sharedKey); err != nil {
+		x.logger.Error("[PQ] MixKey", "peer", peerID, "err", err)
+		return
+	}
+	x.logger.Info("[PQ] HybridKeyEstablished", "peer", peerID)
+}
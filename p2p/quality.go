@@ -0,0 +1,203 @@
+package p2p
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rkonfj/peerguard/crash"
+	"github.com/rkonfj/peerguard/disco"
+)
+
+const (
+	// qualityPings is the number of the recent pings the loss is measured over
+	qualityPings = 20
+	// qualityWindow is how long the flaps are counted, and the peers not probed are forgotten
+	qualityWindow = 10 * time.Minute
+	// qualityReportLimit caps the links reported to the peermap server
+	qualityReportLimit = 256
+)
+
+type peerQuality struct {
+	relayed   atomic.Bool
+	pathKnown atomic.Bool
+
+	mutex    sync.Mutex
+	replies  []bool // the recent pings, true if replied
+	rtt      time.Duration
+	flaps    []time.Time
+	lastPing time.Time
+}
+
+// qualityTracker measures the connection quality of the peers by the paths the datagrams
+// are sent over and the results of the pings
+type qualityTracker struct {
+	peers sync.Map // disco.PeerID => *peerQuality
+}
+
+func (t *qualityTracker) get(peerID disco.PeerID) *peerQuality {
+	if q, ok := t.peers.Load(peerID); ok {
+		return q.(*peerQuality)
+	}
+	q, _ := t.peers.LoadOrStore(peerID, &peerQuality{})
+	return q.(*peerQuality)
+}
+
+// path records the path the datagram is sent to the peer over, falling back to the relay
+// from the direct path is a flap
+func (t *qualityTracker) path(peerID disco.PeerID, relayed bool) {
+	q := t.get(peerID)
+	if !q.pathKnown.Swap(true) {
+		q.relayed.Store(relayed)
+		return
+	}
+	if q.relayed.Swap(relayed) == relayed || !relayed {
+		return
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.flaps = append(q.flaps, time.Now())
+}
+
+func (t *qualityTracker) ping(peerID disco.PeerID, pong Pong, err error) {
+	q := t.get(peerID)
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.lastPing = time.Now()
+	q.replies = append(q.replies, err == nil)
+	if len(q.replies) > qualityPings {
+		q.replies = q.replies[len(q.replies)-qualityPings:]
+	}
+	if err != nil {
+		return
+	}
+	if q.rtt == 0 {
+		q.rtt = pong.RTT
+		return
+	}
+	q.rtt = (q.rtt*7 + pong.RTT) / 8 // smoothed like the tcp srtt
+}
+
+func (q *peerQuality) link(peerID disco.PeerID, now time.Time) disco.LinkQuality {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.flaps = slices.DeleteFunc(q.flaps, func(t time.Time) bool { return now.Sub(t) > qualityWindow })
+	link := disco.LinkQuality{
+		PeerID:  peerID,
+		Relayed: q.relayed.Load(),
+		RTT:     q.rtt,
+		Flaps:   len(q.flaps),
+	}
+	var lost int
+	for _, replied := range q.replies {
+		if !replied {
+			lost++
+		}
+	}
+	if len(q.replies) > 0 {
+		link.Loss = float64(lost) / float64(len(q.replies))
+	}
+	link.Score = qualityScore(link)
+	return link
+}
+
+// qualityScore rates the link from 0 to 100. The relayed path costs 20, the rtt above 20ms
+// costs 1 per 10ms up to 30, the loss costs 2 per percent up to 40 and each flap costs 2 up to 10
+func qualityScore(link disco.LinkQuality) int {
+	score := 100.0
+	if link.Relayed {
+		score -= 20
+	}
+	score -= min(30, max(0, float64(link.RTT-20*time.Millisecond)/float64(10*time.Millisecond)))
+	score -= min(40, link.Loss*200)
+	score -= min(10, float64(link.Flaps*2))
+	return max(0, int(score))
+}
+
+// PeerQuality returns the connection quality to the peer, false if the peer is not pinged recently
+func (c *PeerPacketConn) PeerQuality(peerID disco.PeerID) (disco.LinkQuality, bool) {
+	v, ok := c.quality.peers.Load(peerID)
+	if !ok {
+		return disco.LinkQuality{}, false
+	}
+	q := v.(*peerQuality)
+	q.mutex.Lock()
+	lastPing := q.lastPing
+	q.mutex.Unlock()
+	if now := time.Now(); now.Sub(lastPing) <= qualityWindow {
+		return q.link(peerID, now), true
+	}
+	return disco.LinkQuality{}, false
+}
+
+// PeerQualities returns the connection quality to the peers pinged recently
+func (c *PeerPacketConn) PeerQualities() (links []disco.LinkQuality) {
+	c.quality.peers.Range(func(k, v any) bool {
+		if link, ok := c.PeerQuality(k.(disco.PeerID)); ok {
+			links = append(links, link)
+		}
+		return true
+	})
+	slices.SortFunc(links, func(a, b disco.LinkQuality) int { return strings.Compare(a.PeerID.String(), b.PeerID.String()) })
+	return
+}
+
+// runQualityProbe pings the peers received datagrams from recently every interval, and reports
+// the connection quality to the peermap server. The replies are dispatched by ReadFrom
+func (c *PeerPacketConn) runQualityProbe(interval time.Duration) {
+	defer crash.Recover("p2p/quality", c.closeOnPanic)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closedSig:
+			return
+		case <-ticker.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), min(interval, 2*time.Second))
+		var wg sync.WaitGroup
+		for _, stats := range c.PeerStats() {
+			if time.Since(stats.LastSeen) > qualityWindow {
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				pong, err := c.Ping(ctx, stats.PeerID)
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				c.quality.ping(stats.PeerID, pong, err)
+			}()
+		}
+		wg.Wait()
+		cancel()
+		c.reportQuality()
+	}
+}
+
+// reportQuality sends the connection quality of the peers to the peermap server,
+// the peermap server aggregates them as the health of the network
+func (c *PeerPacketConn) reportQuality() {
+	links := c.PeerQualities()
+	if len(links) > qualityReportLimit {
+		links = links[:qualityReportLimit]
+	}
+	if links == nil {
+		links = []disco.LinkQuality{}
+	}
+	b, err := json.Marshal(links)
+	if err != nil {
+		return
+	}
+	// the empty peer id is dropped by the peermap servers not support the report
+	if err := c.wsConn.WriteTo(b, "", disco.CONTROL_QUALITY_REPORT); err != nil {
+		c.cfg.Logger.Debug("QualityReport", "err", err)
+	}
+}
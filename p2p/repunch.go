@@ -0,0 +1,122 @@
+package p2p
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rkonfj/peerguard/crash"
+	"github.com/rkonfj/peerguard/disco"
+)
+
+const (
+	repunchMinInterval = 5 * time.Second
+	repunchMaxInterval = 5 * time.Minute
+	// repunchIdle forgets the peers no datagram is relayed to within it, the punching is led again
+	// by the next relayed one
+	repunchIdle = 2 * time.Minute
+)
+
+// repunch re-attempts the hole punching with the peers the datagrams are relayed to. The interval
+// grows exponentially from repunchMinInterval to repunchMaxInterval with jitter, the peer is
+// forgotten once a datagram is sent directly, i.e. the path is upgraded
+type repunch struct {
+	peers sync.Map // disco.PeerID => *repunchState
+}
+
+type repunchState struct {
+	lastRelay atomic.Int64 // unix nano
+
+	mutex    sync.Mutex
+	attempts int
+	next     time.Time
+}
+
+// relayed marks the datagram to the peer is relayed, the first one punches as soon as possible
+func (r *repunch) relayed(peerID disco.PeerID) {
+	v, ok := r.peers.Load(peerID)
+	if !ok {
+		v, _ = r.peers.LoadOrStore(peerID, &repunchState{})
+	}
+	v.(*repunchState).lastRelay.Store(time.Now().UnixNano())
+}
+
+// reached forgets the peer once the datagram is sent directly, attempts is the punching led
+// before, 0 if the peer was not relayed
+func (r *repunch) reached(peerID disco.PeerID) (attempts int) {
+	v, ok := r.peers.LoadAndDelete(peerID)
+	if !ok {
+		return 0
+	}
+	state := v.(*repunchState)
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	return state.attempts
+}
+
+// take reports whether the punching with the peer is due, and schedules the next one if so
+func (r *repunch) take(peerID disco.PeerID) bool {
+	v, ok := r.peers.Load(peerID)
+	if !ok {
+		return false
+	}
+	state := v.(*repunchState)
+	if time.Since(time.Unix(0, state.lastRelay.Load())) > repunchIdle {
+		r.peers.CompareAndDelete(peerID, state)
+		return false
+	}
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	now := time.Now()
+	if now.Before(state.next) {
+		return false
+	}
+	interval := min(repunchMaxInterval, repunchMinInterval<<min(state.attempts, 10))
+	// +-20% jitter, the peers relayed at the same time do not punch in lockstep
+	interval += time.Duration((rand.Float64()*0.4 - 0.2) * float64(interval))
+	state.attempts++
+	state.next = now.Add(interval)
+	return true
+}
+
+// due is the peers the punching is due with
+func (r *repunch) due() (peers []disco.PeerID) {
+	r.peers.Range(func(k, v any) bool {
+		if peerID := k.(disco.PeerID); r.take(peerID) {
+			peers = append(peers, peerID)
+		}
+		return true
+	})
+	return
+}
+
+// reset punches with all the relayed peers as soon as possible, e.g. the local addrs changed
+func (r *repunch) reset() {
+	r.peers.Range(func(k, v any) bool {
+		state := v.(*repunchState)
+		state.mutex.Lock()
+		state.attempts = 0
+		state.next = time.Time{}
+		state.mutex.Unlock()
+		return true
+	})
+}
+
+// runRepunchLoop leads the disco with the relayed peers once it is due
+func (c *PeerPacketConn) runRepunchLoop() {
+	defer crash.Recover("p2p/repunch", c.closeOnPanic)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closedSig:
+			return
+		case <-ticker.C:
+		}
+		for _, peerID := range c.repunch.due() {
+			c.cfg.Logger.Debug("Repunch", "peer", peerID)
+			c.wsConn.LeadDisco(peerID)
+		}
+	}
+}
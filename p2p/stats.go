@@ -0,0 +1,77 @@
+package p2p
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rkonfj/peerguard/disco"
+)
+
+// PeerStats is the traffic exchanged with the peer by ReadFrom and WriteTo,
+// the echo, bench and stream packets are not counted
+type PeerStats struct {
+	PeerID    disco.PeerID
+	RxBytes   uint64
+	TxBytes   uint64
+	RxPackets uint64
+	TxPackets uint64
+	// Relayed is true if the last datagram sent to the peer is relayed by the peermap server
+	Relayed bool
+	// LastSeen is the time the last datagram is received from the peer
+	LastSeen time.Time
+}
+
+type peerCounter struct {
+	rxBytes, txBytes     atomic.Uint64
+	rxPackets, txPackets atomic.Uint64
+	relayed              atomic.Bool
+	lastSeen             atomic.Int64
+}
+
+type peerStats struct {
+	counters sync.Map // disco.PeerID => *peerCounter
+}
+
+func (s *peerStats) counter(peerID disco.PeerID) *peerCounter {
+	if c, ok := s.counters.Load(peerID); ok {
+		return c.(*peerCounter)
+	}
+	c, _ := s.counters.LoadOrStore(peerID, &peerCounter{})
+	return c.(*peerCounter)
+}
+
+func (s *peerStats) rx(peerID disco.PeerID, n int) {
+	c := s.counter(peerID)
+	c.rxBytes.Add(uint64(n))
+	c.rxPackets.Add(1)
+	c.lastSeen.Store(time.Now().UnixNano())
+}
+
+func (s *peerStats) tx(peerID disco.PeerID, n int, relayed bool) {
+	c := s.counter(peerID)
+	c.txBytes.Add(uint64(n))
+	c.txPackets.Add(1)
+	c.relayed.Store(relayed)
+}
+
+// PeerStats returns the traffic stats of the peers exchanged datagrams with
+func (c *PeerPacketConn) PeerStats() (stats []PeerStats) {
+	c.stats.counters.Range(func(k, v any) bool {
+		counter := v.(*peerCounter)
+		s := PeerStats{
+			PeerID:    k.(disco.PeerID),
+			RxBytes:   counter.rxBytes.Load(),
+			TxBytes:   counter.txBytes.Load(),
+			RxPackets: counter.rxPackets.Load(),
+			TxPackets: counter.txPackets.Load(),
+			Relayed:   counter.relayed.Load(),
+		}
+		if lastSeen := counter.lastSeen.Load(); lastSeen > 0 {
+			s.LastSeen = time.Unix(0, lastSeen)
+		}
+		stats = append(stats, s)
+		return true
+	})
+	return
+}
@@ -0,0 +1,99 @@
+package p2p
+
+import (
+	"bytes"
+	"net"
+	"time"
+
+	"github.com/rkonfj/peerguard/disco"
+	N "github.com/rkonfj/peerguard/net"
+)
+
+var _ net.PacketConn = (*streamConn)(nil)
+
+// streamConn is a packet conn shares the p2p connection with the PeerPacketConn, so that
+// the reliable streams (rdt) can run alongside the data plane (e.g. the vpn). The datagrams are
+// carried on the stream channel, so they are never mixed up with the ones of the PeerPacketConn
+type streamConn struct {
+	c       *PeerPacketConn
+	inbound chan *disco.Datagram
+
+	deadlineRead  N.Deadline
+	deadlineWrite N.Deadline
+}
+
+func newStreamConn(c *PeerPacketConn) *streamConn {
+	return &streamConn{c: c, inbound: make(chan *disco.Datagram, 512)}
+}
+
+// dispatch queues the datagram of the stream channel, it is dropped if the queue is full
+func (s *streamConn) dispatch(peerID disco.PeerID, b []byte) {
+	select {
+	case s.inbound <- &disco.Datagram{PeerID: peerID, Data: bytes.Clone(b)}:
+	default: // dropped, the rdt retransmits
+	}
+}
+
+func (s *streamConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	if s.deadlineRead.Exceeded() {
+		return 0, nil, N.ErrDeadline
+	}
+	select {
+	case <-s.c.closedSig:
+		return 0, nil, net.ErrClosed
+	case _, ok := <-s.deadlineRead.Deadline():
+		if !ok {
+			return 0, nil, net.ErrClosed
+		}
+		return 0, nil, N.ErrDeadline
+	case datagram := <-s.inbound:
+		return copy(p, datagram.Data), datagram.PeerID, nil
+	}
+}
+
+// WriteTo fails with ErrChannelsUnsupported if the peer does not support the stream channel
+func (s *streamConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	peerID, ok := addr.(disco.PeerID)
+	if !ok {
+		return 0, net.InvalidAddrError("not a p2p address")
+	}
+	if s.deadlineWrite.Exceeded() {
+		return 0, N.ErrDeadline
+	}
+	if _, err := s.c.writeChannel(channelStream, p, peerID); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close does nothing, the StreamConn is closed along with the PeerPacketConn
+func (s *streamConn) Close() error {
+	return nil
+}
+
+func (s *streamConn) LocalAddr() net.Addr {
+	return s.c.LocalAddr()
+}
+
+func (s *streamConn) SetDeadline(t time.Time) error {
+	s.deadlineRead.SetDeadline(t)
+	s.deadlineWrite.SetDeadline(t)
+	return nil
+}
+
+func (s *streamConn) SetReadDeadline(t time.Time) error {
+	s.deadlineRead.SetDeadline(t)
+	return nil
+}
+
+// SetWriteDeadline only fails the WriteTo calls after it, the datagram is sent without waiting
+func (s *streamConn) SetWriteDeadline(t time.Time) error {
+	s.deadlineWrite.SetDeadline(t)
+	return nil
+}
+
+// StreamConn is the packet conn for the reliable streams with peers, e.g. rdt.Listen(c.StreamConn()).
+// The datagrams are dispatched by ReadFrom of the PeerPacketConn, keep reading it
+func (c *PeerPacketConn) StreamConn() net.PacketConn {
+	return c.streams
+}
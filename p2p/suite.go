@@ -0,0 +1,165 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/rkonfj/peerguard/disco"
+	"github.com/rkonfj/peerguard/secure"
+	"github.com/rkonfj/peerguard/secure/aesgcm"
+	"github.com/rkonfj/peerguard/secure/chacha20poly1305"
+	"golang.org/x/sys/cpu"
+)
+
+const (
+	// CipherSuiteAuto prefers AES-256-GCM when both peers have AES hardware acceleration
+	CipherSuiteAuto             = "auto"
+	CipherSuiteChaCha20Poly1305 = "chacha20poly1305"
+	CipherSuiteAES256GCM        = "aes256gcm"
+
+	// metaCipherSuites is the metadata key advertising the supported cipher suites in preference order
+	metaCipherSuites = "cs"
+)
+
+var (
+	_ secure.SymmAlgo = (*suiteSymmAlgo)(nil)
+	_ secure.KeyMixer = (*suiteSymmAlgo)(nil)
+
+	cipherSuites = map[string]func(secure.ProvideSecretKey) secure.SymmAlgo{
+		CipherSuiteChaCha20Poly1305: chacha20poly1305.New,
+		CipherSuiteAES256GCM:        aesgcm.New,
+	}
+)
+
+// ListenPeerCipherSuite forces the cipher suite used with all peers, for interop or compliance
+func ListenPeerCipherSuite(suite string) Option {
+	return func(cfg *Config) error {
+		if _, ok := cipherSuites[suite]; !ok && suite != CipherSuiteAuto {
+			return fmt.Errorf("unsupported cipher suite %s", suite)
+		}
+		cfg.CipherSuite = suite
+		return nil
+	}
+}
+
+// hasAESHardware reports whether the cpu accelerates AES-GCM (AES-NI and carry-less multiplication)
+func hasAESHardware() bool {
+	return cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ ||
+		cpu.ARM64.HasAES && cpu.ARM64.HasPMULL ||
+		cpu.S390X.HasAES && cpu.S390X.HasAESGCM
+}
+
+// suiteSymmAlgo selects the cipher suite per peer. ChaCha20-Poly1305 is the baseline
+// every peer supports, AES-256-GCM is used only if both peers prefer it
+type suiteSymmAlgo struct {
+	cfg              *Config
+	provideSecretKey secure.ProvideSecretKey
+	algos            map[string]secure.SymmAlgo
+	peers            sync.Map
+}
+
+func newSuiteSymmAlgo(cfg *Config, provideSecretKey secure.ProvideSecretKey) *suiteSymmAlgo {
+	algos := make(map[string]secure.SymmAlgo)
+	for suite, newSymmAlgo := range cipherSuites {
+		algos[suite] = newSymmAlgo(provideSecretKey)
+	}
+	return &suiteSymmAlgo{
+		cfg:              cfg,
+		provideSecretKey: provideSecretKey,
+		algos:            algos,
+	}
+}
+
+func (s *suiteSymmAlgo) forced() bool {
+	return s.cfg.CipherSuite != "" && s.cfg.CipherSuite != CipherSuiteAuto
+}
+
+// preferences is the local supported cipher suites in preference order
+func (s *suiteSymmAlgo) preferences() []string {
+	if s.forced() {
+		return []string{s.cfg.CipherSuite}
+	}
+	if hasAESHardware() {
+		return []string{CipherSuiteAES256GCM, CipherSuiteChaCha20Poly1305}
+	}
+	return []string{CipherSuiteChaCha20Poly1305, CipherSuiteAES256GCM}
+}
+
+// peerFound selects the cipher suite with the peer by the advertised preferences
+func (s *suiteSymmAlgo) peerFound(peerID disco.PeerID, metadata url.Values) {
+	if s.forced() {
+		return
+	}
+	var peerPrefs []string
+	if cs := metadata.Get(metaCipherSuites); cs != "" {
+		peerPrefs = strings.Split(cs, ",")
+	}
+	suite := CipherSuiteChaCha20Poly1305
+	if len(peerPrefs) == 1 { // the peer forced a cipher suite
+		if _, ok := s.algos[peerPrefs[0]]; ok {
+			suite = peerPrefs[0]
+		}
+	} else if len(peerPrefs) > 0 && peerPrefs[0] == s.preferences()[0] {
+		suite = peerPrefs[0]
+	}
+	s.peers.Store(peerID.String(), suite)
+}
+
+func (s *suiteSymmAlgo) suite(pubKey string) string {
+	if s.forced() {
+		return s.cfg.CipherSuite
+	}
+	if suite, ok := s.peers.Load(pubKey); ok {
+		return suite.(string)
+	}
+	return CipherSuiteChaCha20Poly1305
+}
+
+func (s *suiteSymmAlgo) Encrypt(data []byte, pubKey string) ([]byte, error) {
+	return s.algos[s.suite(pubKey)].Encrypt(data, pubKey)
+}
+
+func (s *suiteSymmAlgo) Decrypt(data []byte, pubKey string) ([]byte, error) {
+	suite := s.suite(pubKey)
+	plain, err := s.algos[suite].Decrypt(data, pubKey)
+	if err == nil || errors.Is(err, secure.ErrReplayedData) || s.forced() {
+		return plain, err
+	}
+	// the peer may not have selected the same suite yet
+	for name, algo := range s.algos {
+		if name == suite {
+			continue
+		}
+		if plain, err1 := algo.Decrypt(data, pubKey); err1 == nil {
+			return plain, nil
+		}
+	}
+	return nil, err
+}
+
+func (s *suiteSymmAlgo) MixKey(pubKey string, secret []byte) error {
+	var errs []error
+	for _, algo := range s.algos {
+		if mixer, ok := algo.(secure.KeyMixer); ok {
+			errs = append(errs, mixer.MixKey(pubKey, secret))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *suiteSymmAlgo) MixEphemeral(pubKey string, secret []byte, initiator bool) error {
+	var errs []error
+	for _, algo := range s.algos {
+		if mixer, ok := algo.(secure.EphemeralMixer); ok {
+			errs = append(errs, mixer.MixEphemeral(pubKey, secret, initiator))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *suiteSymmAlgo) SecretKey() secure.ProvideSecretKey {
+	return s.provideSecretKey
+}
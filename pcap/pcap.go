@@ -0,0 +1,108 @@
+// Package pcap captures the packets in the pcapng format readable by wireshark and tcpdump
+package pcap
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// LINKTYPE_RAW, the packets begin with the ip header
+const linkTypeRaw = 101
+
+const (
+	blockSectionHeader   = 0x0A0D0D0A
+	blockInterface       = 0x00000001
+	blockEnhancedPacket  = 0x00000006
+	byteOrderMagic       = 0x1A2B3C4D
+	optEndOfOpt          = 0
+	optComment           = 1
+	optIfName            = 2
+	optIfTSResol         = 9
+	optEPBFlags          = 2
+	epbFlagsInbound      = 1
+	epbFlagsOutbound     = 2
+	tsResolNanoseconds   = 9
+	blockOverhead        = 12 // type | total length | ... | total length
+	enhancedPacketHeader = 20 // interface id | timestamp | captured length | original length
+)
+
+type Direction byte
+
+const (
+	Inbound Direction = iota
+	Outbound
+)
+
+// Writer writes the packets in pcapng, the interfaces are the ids of WritePacket
+type Writer struct {
+	w io.Writer
+}
+
+// NewWriter writes the section header and the interfaces
+func NewWriter(w io.Writer, ifaces ...string) (*Writer, error) {
+	shb := binary.LittleEndian.AppendUint32(nil, byteOrderMagic)
+	shb = binary.LittleEndian.AppendUint16(shb, 1) // major version
+	shb = binary.LittleEndian.AppendUint16(shb, 0) // minor version
+	shb = binary.LittleEndian.AppendUint64(shb, 0xFFFFFFFFFFFFFFFF)
+	if _, err := w.Write(block(blockSectionHeader, shb)); err != nil {
+		return nil, err
+	}
+	for _, name := range ifaces {
+		idb := binary.LittleEndian.AppendUint16(nil, linkTypeRaw)
+		idb = binary.LittleEndian.AppendUint16(idb, 0) // reserved
+		idb = binary.LittleEndian.AppendUint32(idb, 0) // no snap length limit
+		idb = appendOption(idb, optIfName, []byte(name))
+		idb = appendOption(idb, optIfTSResol, []byte{tsResolNanoseconds})
+		idb = appendOption(idb, optEndOfOpt, nil)
+		if _, err := w.Write(block(blockInterface, idb)); err != nil {
+			return nil, err
+		}
+	}
+	return &Writer{w: w}, nil
+}
+
+// WritePacket writes the packet captured on the interface, the comment is shown along with the packet
+func (w *Writer) WritePacket(iface int, ts time.Time, data []byte, dir Direction, comment string) error {
+	nanos := uint64(ts.UnixNano())
+	epb := make([]byte, 0, enhancedPacketHeader+len(data)+3+16+len(comment)+3)
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(iface))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(nanos>>32))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(nanos))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(data)))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(data)))
+	epb = append(epb, data...)
+	epb = append(epb, make([]byte, pad(len(data)))...)
+	flags := uint32(epbFlagsInbound)
+	if dir == Outbound {
+		flags = epbFlagsOutbound
+	}
+	epb = appendOption(epb, optEPBFlags, binary.LittleEndian.AppendUint32(nil, flags))
+	if comment != "" {
+		epb = appendOption(epb, optComment, []byte(comment))
+	}
+	epb = appendOption(epb, optEndOfOpt, nil)
+	_, err := w.w.Write(block(blockEnhancedPacket, epb))
+	return err
+}
+
+func block(typ uint32, body []byte) []byte {
+	total := uint32(blockOverhead + len(body))
+	b := make([]byte, 0, total)
+	b = binary.LittleEndian.AppendUint32(b, typ)
+	b = binary.LittleEndian.AppendUint32(b, total)
+	b = append(b, body...)
+	return binary.LittleEndian.AppendUint32(b, total)
+}
+
+func appendOption(b []byte, code uint16, value []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	return append(b, make([]byte, pad(len(value)))...)
+}
+
+// pad is the padding to the 32-bit boundary
+func pad(n int) int {
+	return (4 - n%4) % 4
+}
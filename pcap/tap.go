@@ -0,0 +1,122 @@
+package pcap
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type packet struct {
+	iface   int
+	ts      time.Time
+	data    []byte
+	dir     Direction
+	comment string
+}
+
+// Tap copies the captured packets to the attached writers, the capture is skipped if none is attached
+type Tap struct {
+	ifaces []string
+
+	mutex       sync.RWMutex
+	subscribers map[chan packet][]int
+	attached    atomic.Int32
+}
+
+// NewTap creates the tap, the ifaces are the interfaces (e.g. tun) the packets are captured on
+func NewTap(ifaces ...string) *Tap {
+	return &Tap{ifaces: ifaces, subscribers: make(map[chan packet][]int)}
+}
+
+// Active reports whether any writer is attached, so that the comments are not built in vain
+func (t *Tap) Active() bool {
+	return t != nil && t.attached.Load() > 0
+}
+
+// Capture copies the packet to the attached writers, the packet is dropped for the writers can't keep up
+func (t *Tap) Capture(iface int, data []byte, dir Direction, comment string) {
+	if !t.Active() {
+		return
+	}
+	p := packet{iface: iface, ts: time.Now(), data: slices.Clone(data), dir: dir, comment: comment}
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	for ch, ifaces := range t.subscribers {
+		if len(ifaces) > 0 && !slices.Contains(ifaces, iface) {
+			continue
+		}
+		select {
+		case ch <- p:
+		default:
+		}
+	}
+}
+
+// Interface returns the id of the interface, -1 if not found
+func (t *Tap) Interface(name string) int {
+	return slices.Index(t.ifaces, name)
+}
+
+// Attach writes the packets captured on the ifaces (all if empty) to w in pcapng,
+// until ctx is done or writing fails
+func (t *Tap) Attach(ctx context.Context, w io.Writer, ifaces ...int) error {
+	bw := bufio.NewWriter(w)
+	pw, err := NewWriter(bw, t.ifaces...)
+	if err != nil {
+		return err
+	}
+	ch := make(chan packet, 1024)
+	t.mutex.Lock()
+	t.subscribers[ch] = ifaces
+	t.mutex.Unlock()
+	t.attached.Add(1)
+	defer func() {
+		t.attached.Add(-1)
+		t.mutex.Lock()
+		delete(t.subscribers, ch)
+		t.mutex.Unlock()
+	}()
+	if err := flush(bw, w); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return flush(bw, w)
+		case p := <-ch:
+			if err := pw.WritePacket(p.iface, p.ts, p.data, p.dir, p.comment); err != nil {
+				return err
+			}
+			if len(ch) > 0 {
+				continue
+			}
+			if err := flush(bw, w); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// flush pushes the buffered packets to w, and to the client if w is a http response
+func flush(bw *bufio.Writer, w io.Writer) error {
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if f, ok := w.(interface{ Flush() }); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// AttachFile writes the captured packets to the file until ctx is done
+func (t *Tap) AttachFile(ctx context.Context, w io.WriteCloser) {
+	defer w.Close()
+	if err := t.Attach(ctx, w); err != nil {
+		slog.Error("Capture packets failed", "err", err)
+	}
+}
@@ -0,0 +1,105 @@
+package peermap
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+
+	"github.com/rkonfj/peerguard/disco"
+	"github.com/rkonfj/peerguard/peermap/exporter"
+)
+
+func (ctx *networkContext) getACL() disco.ACL {
+	ctx.metaMutex.Lock()
+	defer ctx.metaMutex.Unlock()
+	return ctx.acl
+}
+
+func (ctx *networkContext) setACL(acl disco.ACL) {
+	ctx.metaMutex.Lock()
+	defer ctx.metaMutex.Unlock()
+	ctx.acl = acl
+}
+
+// aclState returns nil if the network is unrestricted
+func (ctx *networkContext) aclState() *disco.ACL {
+	acl := ctx.getACL()
+	if !acl.Enabled() {
+		return nil
+	}
+	return &acl
+}
+
+func (p *peerConn) tags() []string {
+	return disco.PeerTags(p.metadata)
+}
+
+// updateACL sends the acl of the network and the tags of the peer to the peer, the peer filters
+// the packets of the other peers by it
+func (p *peerConn) updateACL(acl disco.ACL) error {
+	b, err := json.Marshal(disco.ACLUpdate{ACL: acl, Tags: p.tags()})
+	if err != nil {
+		return err
+	}
+	if err := p.write(append([]byte{disco.CONTROL_UPDATE_ACL.Byte()}, b...)); err != nil {
+		slog.Error("ACLUpdate", "peer", p.id, "err", err)
+		return err
+	}
+	return nil
+}
+
+// relayAllowed reports whether the acls of the networks of both peers allow one of them to reach
+// the other, the ports are unknown to the peermap since the datagrams are end to end encrypted
+func relayAllowed(src, dst *peerConn) bool {
+	srcTags, dstTags := src.tags(), dst.tags()
+	for _, ctx := range slices.Compact([]*networkContext{src.networkContext, dst.networkContext}) {
+		acl := ctx.getACL()
+		if !acl.Reachable(srcTags, dstTags) && !acl.Reachable(dstTags, srcTags) {
+			return false
+		}
+	}
+	return true
+}
+
+// HandleGetNetworkACL returns the acl of the network
+func (pm *PeerMap) HandleGetNetworkACL(w http.ResponseWriter, r *http.Request) {
+	if err := pm.checkAdminToken(w, r); err != nil {
+		return
+	}
+	ctx, ok := pm.getNetwork(r.PathValue("network"))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(ctx.getACL())
+}
+
+// HandlePutNetworkACL replaces the acl of the network and sends it to the peers connected, the
+// acl without rules allows all
+func (pm *PeerMap) HandlePutNetworkACL(w http.ResponseWriter, r *http.Request) {
+	if err := pm.checkAdminToken(w, r); err != nil {
+		return
+	}
+	var request disco.ACL
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := request.Check(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	ctx, ok := pm.getNetwork(r.PathValue("network"))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	ctx.setACL(request)
+	for _, p := range ctx.snapshotPeers() {
+		p.updateACL(request)
+	}
+	pm.stream.publish(exporter.Event{Type: exporter.EventNetworkACLChanged, Network: ctx.id, ACL: &request})
+	slog.Info("NetworkACLUpdated", "network", ctx.id, "rules", len(request.Rules))
+}
@@ -0,0 +1,249 @@
+// Package alert evaluates the threshold rules against the statistics of peermap every minute
+// and notifies the webhooks or the email recipients when the rules fire and resolve, so that
+// the abuse of a public instance is noticed without watching the dashboards
+package alert
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+// The metrics the rules are evaluated against
+const (
+	// MetricRelayBandwidth is the bytes per second relayed by the peermap for the network
+	MetricRelayBandwidth = "relay_bytes_per_second"
+	// MetricAuthFailures is the failed logins and connections per minute of all networks
+	MetricAuthFailures = "auth_failures_per_minute"
+	// MetricPeerChurn is the peers joined and left per minute of the network
+	MetricPeerChurn = "peer_churn_per_minute"
+)
+
+// The alert states
+const (
+	StateFiring   = "firing"
+	StateResolved = "resolved"
+)
+
+type Config struct {
+	Rules []Rule `yaml:"rules"`
+	// Webhooks post each alert as json to the urls
+	Webhooks []WebhookConfig `yaml:"webhooks"`
+	// Email sends each alert to the recipients by the smtp server
+	Email *EmailConfig `yaml:"email,omitempty"`
+	// QueueSize is the max number of alerts pending, the alerts are dropped if the queue is full
+	QueueSize int `yaml:"queue_size"`
+}
+
+// Rule fires when the value of the metric is above the threshold, and resolves
+// when it falls back to or below the threshold
+type Rule struct {
+	Name   string `yaml:"name"`
+	Metric string `yaml:"metric"`
+	// Network only evaluates the network, empty evaluates every network.
+	// It is ignored by the metrics of all networks
+	Network   string  `yaml:"network"`
+	Threshold float64 `yaml:"threshold"`
+}
+
+type WebhookConfig struct {
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+	Timeout time.Duration     `yaml:"timeout"`
+}
+
+type EmailConfig struct {
+	// SMTP is the host:port of the smtp server, the connection is upgraded by STARTTLS if supported
+	SMTP     string `yaml:"smtp"`
+	Username string `yaml:"username"`
+	// Password authenticates the username (env:NAME, file:PATH or the password itself)
+	Password string   `yaml:"password"`
+	From     string   `yaml:"from"`
+	To       []string `yaml:"to"`
+}
+
+// Sample is the value of the metric of the network, the network is empty for the metrics of all networks
+type Sample struct {
+	Metric  string
+	Network string
+	Value   float64
+}
+
+// Alert is the notification of the rule fired or resolved
+type Alert struct {
+	Rule      string    `json:"rule"`
+	State     string    `json:"state"`
+	Time      time.Time `json:"time"`
+	Metric    string    `json:"metric"`
+	Network   string    `json:"network,omitempty"`
+	Value     float64   `json:"value"`
+	Threshold float64   `json:"threshold"`
+}
+
+func (a Alert) String() string {
+	s := fmt.Sprintf("[%s] %s: %s", a.State, a.Rule, a.Metric)
+	if a.Network != "" {
+		s += " of network " + a.Network
+	}
+	return s + fmt.Sprintf(" is %g (threshold %g)", a.Value, a.Threshold)
+}
+
+func (cfg Config) Check() error {
+	if len(cfg.Webhooks) == 0 && cfg.Email == nil {
+		return errors.New("alerts: webhooks or email is required")
+	}
+	var names []string
+	for _, rule := range cfg.Rules {
+		if rule.Name == "" {
+			return errors.New("alerts: rule name is required")
+		}
+		if slices.Contains(names, rule.Name) {
+			return fmt.Errorf("alerts: duplicated rule %s", rule.Name)
+		}
+		names = append(names, rule.Name)
+		if !slices.Contains([]string{MetricRelayBandwidth, MetricAuthFailures, MetricPeerChurn}, rule.Metric) {
+			return fmt.Errorf("alerts: rule %s: unknown metric %s (%s, %s or %s)",
+				rule.Name, rule.Metric, MetricRelayBandwidth, MetricAuthFailures, MetricPeerChurn)
+		}
+	}
+	for _, webhook := range cfg.Webhooks {
+		if webhook.URL == "" {
+			return errors.New("alerts: webhook url is required")
+		}
+	}
+	if cfg.Email != nil {
+		if cfg.Email.SMTP == "" || cfg.Email.From == "" || len(cfg.Email.To) == 0 {
+			return errors.New("alerts: email smtp, from and to are required")
+		}
+	}
+	return nil
+}
+
+type sink interface {
+	send(Alert) error
+}
+
+// Notifier evaluates the rules and notifies the alerts asynchronously, the nil Notifier evaluates nothing
+type Notifier struct {
+	rules  []Rule
+	sinks  []sink
+	alerts chan Alert
+	done   chan struct{}
+
+	mutex sync.Mutex
+	// firing is the rules fired by the networks
+	firing map[[2]string]struct{}
+	closed bool
+}
+
+func New(cfg Config) (*Notifier, error) {
+	if err := cfg.Check(); err != nil {
+		return nil, err
+	}
+	n := Notifier{
+		rules:  cfg.Rules,
+		done:   make(chan struct{}),
+		firing: make(map[[2]string]struct{}),
+	}
+	for _, webhook := range cfg.Webhooks {
+		n.sinks = append(n.sinks, newWebhookSink(webhook))
+	}
+	if cfg.Email != nil {
+		s, err := newEmailSink(*cfg.Email)
+		if err != nil {
+			return nil, err
+		}
+		n.sinks = append(n.sinks, s)
+	}
+	if cfg.QueueSize == 0 {
+		cfg.QueueSize = 256
+	}
+	n.alerts = make(chan Alert, cfg.QueueSize)
+	go n.run()
+	return &n, nil
+}
+
+// Evaluate compares the samples with the rules, the alerts are notified when the rules
+// start firing and when they are resolved. The networks absent from the samples are resolved
+func (n *Notifier) Evaluate(now time.Time, samples []Sample) {
+	if n == nil {
+		return
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.closed {
+		return
+	}
+	for _, rule := range n.rules {
+		evaluated := make(map[string]struct{})
+		for _, s := range samples {
+			if s.Metric != rule.Metric || (rule.Network != "" && s.Network != "" && s.Network != rule.Network) {
+				continue
+			}
+			evaluated[s.Network] = struct{}{}
+			key := [2]string{rule.Name, s.Network}
+			_, firing := n.firing[key]
+			switch {
+			case s.Value > rule.Threshold && !firing:
+				n.firing[key] = struct{}{}
+				n.notify(rule, StateFiring, now, s)
+			case s.Value <= rule.Threshold && firing:
+				delete(n.firing, key)
+				n.notify(rule, StateResolved, now, s)
+			}
+		}
+		for key := range n.firing {
+			if _, ok := evaluated[key[1]]; key[0] == rule.Name && !ok {
+				delete(n.firing, key)
+				n.notify(rule, StateResolved, now, Sample{Metric: rule.Metric, Network: key[1]})
+			}
+		}
+	}
+}
+
+// notify queues the alert, it never blocks
+func (n *Notifier) notify(rule Rule, state string, now time.Time, s Sample) {
+	a := Alert{
+		Rule:      rule.Name,
+		State:     state,
+		Time:      now,
+		Metric:    rule.Metric,
+		Network:   s.Network,
+		Value:     s.Value,
+		Threshold: rule.Threshold,
+	}
+	slog.Warn("Alert", "rule", a.Rule, "state", a.State, "network", a.Network, "value", a.Value, "threshold", a.Threshold)
+	select {
+	case n.alerts <- a:
+	default:
+		slog.Warn("Alert dropped, the queue is full", "rule", a.Rule)
+	}
+}
+
+func (n *Notifier) run() {
+	defer close(n.done)
+	for a := range n.alerts {
+		for _, s := range n.sinks {
+			if err := s.send(a); err != nil {
+				b, _ := json.Marshal(a)
+				slog.Error("Send alert", "alert", string(b), "err", err)
+			}
+		}
+	}
+}
+
+// Close sends the pending alerts
+func (n *Notifier) Close() {
+	if n == nil {
+		return
+	}
+	n.mutex.Lock()
+	n.closed = true
+	close(n.alerts)
+	n.mutex.Unlock()
+	<-n.done
+}
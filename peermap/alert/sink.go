@@ -0,0 +1,107 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+type webhookSink struct {
+	cfg WebhookConfig
+	c   *http.Client
+}
+
+func newWebhookSink(cfg WebhookConfig) *webhookSink {
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	return &webhookSink{cfg: cfg, c: &http.Client{Timeout: cfg.Timeout}}
+}
+
+func (s *webhookSink) send(a Alert) error {
+	b, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.Timeout)
+	defer cancel()
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, s.cfg.URL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	for k, v := range s.cfg.Headers {
+		r.Header.Set(k, v)
+	}
+	resp, err := s.c.Do(r)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("alert: webhook responded %s", resp.Status)
+	}
+	return nil
+}
+
+type emailSink struct {
+	cfg  EmailConfig
+	auth smtp.Auth
+}
+
+func newEmailSink(cfg EmailConfig) (*emailSink, error) {
+	s := emailSink{cfg: cfg}
+	if cfg.Username != "" {
+		password, err := resolvePassword(cfg.Password)
+		if err != nil {
+			return nil, err
+		}
+		host, _, err := net.SplitHostPort(cfg.SMTP)
+		if err != nil {
+			return nil, fmt.Errorf("alerts: invalid smtp address %s: %w", cfg.SMTP, err)
+		}
+		s.auth = smtp.PlainAuth("", cfg.Username, password, host)
+	}
+	return &s, nil
+}
+
+func (s *emailSink) send(a Alert) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.cfg.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.cfg.To, ", "))
+	fmt.Fprintf(&msg, "Subject: [peermap] %s\r\n", a.String())
+	fmt.Fprintf(&msg, "Date: %s\r\n", a.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "%s\r\n\r\nTime: %s\r\n", a.String(), a.Time.Format(time.RFC3339))
+	if err := smtp.SendMail(s.cfg.SMTP, s.auth, s.cfg.From, s.cfg.To, msg.Bytes()); err != nil {
+		return fmt.Errorf("alert: email: %w", err)
+	}
+	return nil
+}
+
+// resolvePassword resolves the password spec, env:NAME reads the environment variable,
+// file:PATH reads the file, otherwise the spec is the password itself
+func resolvePassword(spec string) (string, error) {
+	switch {
+	case strings.HasPrefix(spec, "env:"):
+		password := os.Getenv(strings.TrimPrefix(spec, "env:"))
+		if password == "" {
+			return "", fmt.Errorf("alerts: email password: environment variable %s is empty", strings.TrimPrefix(spec, "env:"))
+		}
+		return password, nil
+	case strings.HasPrefix(spec, "file:"):
+		b, err := os.ReadFile(strings.TrimPrefix(spec, "file:"))
+		if err != nil {
+			return "", fmt.Errorf("alerts: email password: %w", err)
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+	return spec, nil
+}
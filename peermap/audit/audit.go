@@ -0,0 +1,167 @@
+// Package audit emits the authentication events of peermap to a dedicated channel
+// (file, syslog or http) for the SIEM. The events are json objects, the schema is
+// versioned and fields are only added within the same version
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// SchemaVersion is the version of the event schema
+const SchemaVersion = 1
+
+// The event types
+const (
+	// EventLogin is the user authenticated by the identity provider (oidc, ldap, webauthn)
+	EventLogin = "auth.login"
+	// EventRefresh is the network secret renewed by the refresh token
+	EventRefresh = "auth.refresh"
+	// EventConnect is the peer authenticated to join the network
+	EventConnect = "auth.connect"
+	// EventSecretIssued is the network secret issued
+	EventSecretIssued = "auth.secret.issued"
+	// EventSecretRotated is the network secret of the connected peer rotated
+	EventSecretRotated = "auth.secret.rotated"
+	// EventSecretRevoked is the network secrets revoked by the admin or the logout
+	EventSecretRevoked = "auth.secret.revoked"
+	// EventDeviceRevoked is the device revoked by the admin
+	EventDeviceRevoked = "auth.device.revoked"
+)
+
+// The event outcomes
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// Event is the authentication event
+type Event struct {
+	Schema  int       `json:"schema"`
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Outcome string    `json:"outcome"`
+	// Method is how the subject is authenticated: oidc, oidc_device, ldap, webauthn, secret, client_certificate, admin_token
+	Method     string `json:"method,omitempty"`
+	Provider   string `json:"provider,omitempty"`
+	User       string `json:"user,omitempty"`
+	Network    string `json:"network,omitempty"`
+	PeerID     string `json:"peer_id,omitempty"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	// Reason explains the failure, or the cause of the revocation
+	Reason string `json:"reason,omitempty"`
+}
+
+type Config struct {
+	// File appends the events to the file as json lines
+	File string `yaml:"file"`
+	// Syslog sends the events to the syslog server, e.g. udp://siem.example.org:514, local for the local syslog
+	Syslog string `yaml:"syslog"`
+	// HTTP posts each event as json to the collector
+	HTTP *HTTPConfig `yaml:"http,omitempty"`
+	// QueueSize is the max number of events pending, the events are dropped if the queue is full
+	QueueSize int `yaml:"queue_size"`
+}
+
+type HTTPConfig struct {
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+	Timeout time.Duration     `yaml:"timeout"`
+}
+
+type sink interface {
+	write(b []byte) error
+	close() error
+}
+
+// Logger emits the events asynchronously to the sinks, the nil Logger discards the events
+type Logger struct {
+	sinks  []sink
+	events chan Event
+	done   chan struct{}
+}
+
+func New(cfg Config) (*Logger, error) {
+	l := Logger{done: make(chan struct{})}
+	if cfg.File != "" {
+		s, err := newFileSink(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		l.sinks = append(l.sinks, s)
+	}
+	if cfg.Syslog != "" {
+		s, err := newSyslogSink(cfg.Syslog)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		l.sinks = append(l.sinks, s)
+	}
+	if cfg.HTTP != nil {
+		s, err := newHTTPSink(*cfg.HTTP)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		l.sinks = append(l.sinks, s)
+	}
+	if len(l.sinks) == 0 {
+		return nil, errors.New("audit: file, syslog or http is required")
+	}
+	if cfg.QueueSize == 0 {
+		cfg.QueueSize = 1024
+	}
+	l.events = make(chan Event, cfg.QueueSize)
+	go l.run()
+	return &l, nil
+}
+
+// Emit queues the event, it never blocks
+func (l *Logger) Emit(e Event) {
+	if l == nil {
+		return
+	}
+	e.Schema = SchemaVersion
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	select {
+	case l.events <- e:
+	default:
+		slog.Warn("Audit event dropped, the queue is full", "type", e.Type)
+	}
+}
+
+func (l *Logger) run() {
+	defer close(l.done)
+	for e := range l.events {
+		b, err := json.Marshal(e)
+		if err != nil {
+			continue
+		}
+		for _, s := range l.sinks {
+			if err := s.write(b); err != nil {
+				slog.Error("Write audit event", "type", e.Type, "err", err)
+			}
+		}
+	}
+}
+
+// Close flushes the pending events and closes the sinks
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	if l.events != nil {
+		close(l.events)
+		<-l.done
+	}
+	var errs []error
+	for _, s := range l.sinks {
+		errs = append(errs, s.close())
+	}
+	return errors.Join(errs...)
+}
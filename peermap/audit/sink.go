@@ -0,0 +1,72 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+type fileSink struct {
+	f *os.File
+}
+
+func newFileSink(file string) (*fileSink, error) {
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("audit: %w", err)
+	}
+	return &fileSink{f: f}, nil
+}
+
+func (s *fileSink) write(b []byte) error {
+	_, err := s.f.Write(append(b, '\n'))
+	return err
+}
+
+func (s *fileSink) close() error {
+	return s.f.Close()
+}
+
+type httpSink struct {
+	cfg HTTPConfig
+	c   *http.Client
+}
+
+func newHTTPSink(cfg HTTPConfig) (*httpSink, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("audit: http url is required")
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	return &httpSink{cfg: cfg, c: &http.Client{Timeout: cfg.Timeout}}, nil
+}
+
+func (s *httpSink) write(b []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.Timeout)
+	defer cancel()
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, s.cfg.URL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	for k, v := range s.cfg.Headers {
+		r.Header.Set(k, v)
+	}
+	resp, err := s.c.Do(r)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("audit: http collector responded %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *httpSink) close() error {
+	return nil
+}
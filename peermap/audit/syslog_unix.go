@@ -0,0 +1,38 @@
+//go:build !windows && !plan9
+
+package audit
+
+import (
+	"fmt"
+	"log/syslog"
+	"net/url"
+)
+
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+// newSyslogSink dials the syslog server by the url (udp://host:514, tcp://host:514), local for the local syslog
+func newSyslogSink(addr string) (*syslogSink, error) {
+	network, raddr := "", ""
+	if addr != "local" {
+		u, err := url.Parse(addr)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("audit: invalid syslog url %s", addr)
+		}
+		network, raddr = u.Scheme, u.Host
+	}
+	w, err := syslog.Dial(network, raddr, syslog.LOG_AUTH|syslog.LOG_INFO, "peermap")
+	if err != nil {
+		return nil, fmt.Errorf("audit: %w", err)
+	}
+	return &syslogSink{w: w}, nil
+}
+
+func (s *syslogSink) write(b []byte) error {
+	return s.w.Info(string(b))
+}
+
+func (s *syslogSink) close() error {
+	return s.w.Close()
+}
@@ -0,0 +1,7 @@
+package audit
+
+import "errors"
+
+func newSyslogSink(string) (sink, error) {
+	return nil, errors.New("audit: syslog is not supported on windows")
+}
@@ -1,10 +1,14 @@
 package auth
 
 import (
+	"crypto/ed25519"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/rkonfj/peerguard/secure/aescbc"
@@ -15,35 +19,136 @@ var (
 	ErrTokenExpired = errors.New("token expired")
 )
 
+// The scopes restrict what the peer holding the secret is able to do,
+// a secret without any scope is unrestricted
+const (
+	// ScopeNoRelay forbids relaying data packets from or to the peer through the peermap server
+	ScopeNoRelay = "no-relay"
+	// ScopeSilence enforces the silence mode, the peer is never announced to other peers
+	ScopeSilence = "silence"
+	// ScopeNoNeighbor forbids reaching peers of the neighbor networks from or to the peer
+	ScopeNoNeighbor = "no-neighbor"
+)
+
+var scopes = []string{ScopeNoRelay, ScopeSilence, ScopeNoNeighbor}
+
+// CheckScopes returns an error if any scope is unknown
+func CheckScopes(s []string) error {
+	for _, scope := range s {
+		if !slices.Contains(scopes, scope) {
+			return fmt.Errorf("unknown scope %q (supported: %v)", scope, scopes)
+		}
+	}
+	return nil
+}
+
 type JSONSecret struct {
 	Network   string   `json:"n"`
 	Alias     string   `json:"n1"`
 	Neighbors []string `json:"ns"`
+	Scopes    []string `json:"s,omitempty"`
+	User      string   `json:"u,omitempty"`  // the identity the secret is issued to, oidc email or ldap dn
+	Tags      []string `json:"tg,omitempty"` // the acl tags of the peers joined by the secret
+	IssuedAt  int64    `json:"i,omitempty"`
 	Deadline  int64    `json:"t"`
 }
 
+// HasScope reports whether the secret is restricted by the scope
+func (s JSONSecret) HasScope(scope string) bool {
+	return slices.Contains(s.Scopes, scope)
+}
+
+// ACLTags are the tags of the peers joined by the secret, the tags issued with the secret (pgcli
+// token secret --tag) and the user: one of the user the secret is issued to. The user: ones issued
+// are dropped so that the rules of the users are not bypassed
+func (s JSONSecret) ACLTags() []string {
+	tags := slices.DeleteFunc(slices.Clone(s.Tags), func(tag string) bool {
+		return strings.HasPrefix(tag, "user:")
+	})
+	if s.User != "" {
+		tags = append(tags, "user:"+s.User)
+	}
+	return tags
+}
+
 type Net struct {
 	ID        string
 	Alias     string
 	Neighbors []string
+	Scopes    []string
+	User      string
+	Tags      []string
 }
 
 type Authenticator struct {
 	key []byte
+	// previousKeys only decrypt the secrets issued before the key rotation
+	previousKeys [][]byte
+	// signingKey signs the network secrets if signed is true
+	signingKey ed25519.PrivateKey
+	// verifyKeys verify the signed secrets, the current one first
+	verifyKeys []ed25519.PublicKey
+	signed     bool
 }
 
-func NewAuthenticator(key string) *Authenticator {
+func NewAuthenticator(key string, previousKeys ...string) *Authenticator {
 	sum := sha256.Sum256([]byte(key))
-	return &Authenticator{key: sum[:]}
+	auth := Authenticator{key: sum[:], signingKey: signingKey(key)}
+	auth.verifyKeys = append(auth.verifyKeys, auth.signingKey.Public().(ed25519.PublicKey))
+	for _, k := range previousKeys {
+		sum := sha256.Sum256([]byte(k))
+		auth.previousKeys = append(auth.previousKeys, sum[:])
+		auth.verifyKeys = append(auth.verifyKeys, signingKey(k).Public().(ed25519.PublicKey))
+	}
+	return &auth
+}
+
+// SignSecrets makes the authenticator issue Ed25519 signed network secrets (JWT) rather than
+// encrypted ones, so that they are verifiable by the public keys. Both are accepted anyway
+func (auth *Authenticator) SignSecrets(signed bool) *Authenticator {
+	auth.signed = signed
+	return auth
+}
+
+// JWKS is the public keys verify the signed network secrets
+func (auth *Authenticator) JWKS() JWKS {
+	var jwks JWKS
+	for _, k := range auth.verifyKeys {
+		jwks.Keys = append(jwks.Keys, NewJWK(k))
+	}
+	return jwks
+}
+
+// decrypt decrypts the data by the current key, then the previous keys
+func (auth *Authenticator) decrypt(chiperData []byte, v any) error {
+	for _, key := range append([][]byte{auth.key}, auth.previousKeys...) {
+		plainData, err := aescbc.Decrypt(key, slices.Clone(chiperData)) // decrypted in place
+		if err != nil {
+			continue
+		}
+		if err := json.Unmarshal(plainData, v); err != nil {
+			continue
+		}
+		return nil
+	}
+	return ErrInvalidToken
 }
 
 func (auth *Authenticator) GenerateSecret(n Net, validDuration time.Duration) (string, error) {
-	b, err := json.Marshal(JSONSecret{
+	secret := JSONSecret{
 		Network:   n.ID,
 		Alias:     n.Alias,
 		Neighbors: n.Neighbors,
+		Scopes:    n.Scopes,
+		User:      n.User,
+		Tags:      n.Tags,
+		IssuedAt:  time.Now().Unix(),
 		Deadline:  time.Now().Add(validDuration).Unix(),
-	})
+	}
+	if auth.signed {
+		return signSecret(auth.signingKey, secret)
+	}
+	b, err := json.Marshal(secret)
 	if err != nil {
 		return "", err
 	}
@@ -52,19 +157,16 @@ func (auth *Authenticator) GenerateSecret(n Net, validDuration time.Duration) (s
 }
 
 func (auth *Authenticator) ParseSecret(networkIDChiper string) (JSONSecret, error) {
-	chiperData, err := base64.URLEncoding.DecodeString(networkIDChiper)
-	if err != nil {
-		return JSONSecret{}, ErrInvalidToken
+	if IsSignedSecret(networkIDChiper) {
+		return VerifySecret(networkIDChiper, auth.verifyKeys...)
 	}
-	plainData, err := aescbc.Decrypt(auth.key, chiperData)
+	chiperData, err := base64.URLEncoding.DecodeString(networkIDChiper)
 	if err != nil {
 		return JSONSecret{}, ErrInvalidToken
 	}
-
 	var token JSONSecret
-	err = json.Unmarshal(plainData, &token)
-	if err != nil {
-		return JSONSecret{}, ErrInvalidToken
+	if err := auth.decrypt(chiperData, &token); err != nil {
+		return JSONSecret{}, err
 	}
 
 	if time.Until(time.Unix(token.Deadline, 0)) <= 0 {
@@ -72,3 +174,31 @@ func (auth *Authenticator) ParseSecret(networkIDChiper string) (JSONSecret, erro
 	}
 	return token, nil
 }
+
+// JSONRefreshToken wraps the refresh token issued by the oidc provider
+type JSONRefreshToken struct {
+	Provider string `json:"p"`
+	Token    string `json:"t"`
+}
+
+// GenerateRefreshToken encrypts the oidc provider's refresh token, so it is opaque to the peers
+func (auth *Authenticator) GenerateRefreshToken(provider, refreshToken string) (string, error) {
+	b, err := json.Marshal(JSONRefreshToken{Provider: provider, Token: refreshToken})
+	if err != nil {
+		return "", err
+	}
+	chiperData, err := aescbc.Encrypt(auth.key, b)
+	return base64.URLEncoding.EncodeToString(chiperData), err
+}
+
+func (auth *Authenticator) ParseRefreshToken(refreshTokenChiper string) (JSONRefreshToken, error) {
+	chiperData, err := base64.URLEncoding.DecodeString(refreshTokenChiper)
+	if err != nil {
+		return JSONRefreshToken{}, ErrInvalidToken
+	}
+	var token JSONRefreshToken
+	if err := auth.decrypt(chiperData, &token); err != nil {
+		return JSONRefreshToken{}, err
+	}
+	return token, nil
+}
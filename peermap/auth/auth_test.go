@@ -0,0 +1,33 @@
+package auth_test
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/rkonfj/peerguard/peermap/auth"
+)
+
+func TestSecretACLTags(t *testing.T) {
+	for _, signed := range []bool{false, true} {
+		authenticator := auth.NewAuthenticator("secret-key").SignSecrets(signed)
+		secret, err := authenticator.GenerateSecret(auth.Net{
+			ID:   "default",
+			User: "alice@example.com",
+			Tags: []string{"dev", "user:root"},
+		}, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jsonSecret, err := authenticator.ParseSecret(secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tags := jsonSecret.ACLTags(); !slices.Equal(tags, []string{"dev", "user:alice@example.com"}) {
+			t.Errorf("signed %v: expected the tags issued and the user one, got %v", signed, tags)
+		}
+	}
+	if tags := (auth.JSONSecret{}).ACLTags(); len(tags) != 0 {
+		t.Errorf("expected no tags, got %v", tags)
+	}
+}
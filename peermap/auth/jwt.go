@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// the signed network secret is a JWT signed by EdDSA (Ed25519), anyone has the
+// public key is able to verify it. Unlike the encrypted one, the claims are not confidential
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims struct {
+	JSONSecret
+	Exp int64 `json:"exp"`
+}
+
+// JWK is the json web key of the Ed25519 public key
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+}
+
+// JWKS is the json web key set verifies the signed network secrets
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// signingKey derives the Ed25519 key signs the network secrets from the secret key
+func signingKey(key string) ed25519.PrivateKey {
+	seed := sha256.Sum256([]byte("pgsecret" + key))
+	return ed25519.NewKeyFromSeed(seed[:])
+}
+
+// KeyID is the kid of the public key in the JWT header
+func KeyID(pubKey ed25519.PublicKey) string {
+	sum := sha256.Sum256(pubKey)
+	return base64.RawURLEncoding.EncodeToString(sum[:8])
+}
+
+// NewJWK returns the JWK of the public key
+func NewJWK(pubKey ed25519.PublicKey) JWK {
+	return JWK{
+		Kty: "OKP",
+		Crv: "Ed25519",
+		X:   base64.RawURLEncoding.EncodeToString(pubKey),
+		Kid: KeyID(pubKey),
+		Alg: "EdDSA",
+		Use: "sig",
+	}
+}
+
+// PublicKey decodes the Ed25519 public key of the JWK
+func (k JWK) PublicKey() (ed25519.PublicKey, error) {
+	b, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil || k.Kty != "OKP" || k.Crv != "Ed25519" || len(b) != ed25519.PublicKeySize {
+		return nil, ErrInvalidToken
+	}
+	return b, nil
+}
+
+func signSecret(key ed25519.PrivateKey, secret JSONSecret) (string, error) {
+	header, err := json.Marshal(jwtHeader{Alg: "EdDSA", Typ: "JWT", Kid: KeyID(key.Public().(ed25519.PublicKey))})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(jwtClaims{JSONSecret: secret, Exp: secret.Deadline})
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	sig := ed25519.Sign(key, []byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// IsSignedSecret reports whether the network secret is signed rather than encrypted
+func IsSignedSecret(secret string) bool {
+	return strings.Count(secret, ".") == 2
+}
+
+// VerifySecret verifies the signed network secret by the public keys, no secret key is required
+func VerifySecret(secret string, pubKeys ...ed25519.PublicKey) (JSONSecret, error) {
+	parts := strings.Split(secret, ".")
+	if len(parts) != 3 {
+		return JSONSecret{}, ErrInvalidToken
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return JSONSecret{}, ErrInvalidToken
+	}
+	var header jwtHeader
+	if err := json.Unmarshal(headerJSON, &header); err != nil || header.Alg != "EdDSA" {
+		return JSONSecret{}, ErrInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return JSONSecret{}, ErrInvalidToken
+	}
+	signingInput := []byte(parts[0] + "." + parts[1])
+	for _, pubKey := range pubKeys {
+		if header.Kid != "" && header.Kid != KeyID(pubKey) {
+			continue
+		}
+		if !ed25519.Verify(pubKey, signingInput, sig) {
+			continue
+		}
+		claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+		if err != nil {
+			return JSONSecret{}, ErrInvalidToken
+		}
+		var claims jwtClaims
+		if err := json.Unmarshal(claimsJSON, &claims); err != nil {
+			return JSONSecret{}, ErrInvalidToken
+		}
+		if time.Until(time.Unix(claims.Deadline, 0)) <= 0 {
+			return claims.JSONSecret, ErrTokenExpired
+		}
+		return claims.JSONSecret, nil
+	}
+	return JSONSecret{}, ErrInvalidToken
+}
@@ -0,0 +1,50 @@
+package peermap
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// writeStat is the backpressure of the writes to the peer. The writes of all the peers relaying to
+// the peer are serialized by wMut, so a single slow peer shows up as the queue and the waits here
+type writeStat struct {
+	// queue is the writes waiting for wMut
+	queue atomic.Int64
+	// writes is the number of the writes, wait and time are the total nanoseconds spent
+	// waiting for wMut and writing the websocket respectively
+	writes atomic.Uint64
+	wait   atomic.Uint64
+	time   atomic.Uint64
+	// max is the longest nanoseconds a write blocked the writer, the wait included
+	max atomic.Uint64
+	// ratelimitWait is the total nanoseconds the read loop and the stream waited for the rate limiters
+	ratelimitWait atomic.Uint64
+}
+
+func (s *writeStat) observe(wait, write time.Duration) {
+	s.writes.Add(1)
+	s.wait.Add(uint64(wait))
+	s.time.Add(uint64(write))
+	blocked := uint64(wait + write)
+	for {
+		max := s.max.Load()
+		if blocked <= max || s.max.CompareAndSwap(max, blocked) {
+			return
+		}
+	}
+}
+
+// waitN waits for the limiter and accounts the time waited, to the peer and the network
+func (p *peerConn) waitN(limiter *rate.Limiter, n int) {
+	start := time.Now()
+	limiter.WaitN(context.Background(), n)
+	wait := time.Since(start)
+	p.writeStat.ratelimitWait.Add(uint64(wait))
+	if wait > time.Millisecond { // the shorter waits are the overhead of the limiter rather than delays
+		p.networkContext.ratelimited.Add(1)
+		p.networkContext.ratelimitWait.Add(uint64(wait))
+	}
+}
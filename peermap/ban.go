@@ -0,0 +1,180 @@
+package peermap
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rkonfj/peerguard/disco"
+	"github.com/rkonfj/peerguard/peermap/exporter"
+)
+
+var ErrPeerBanned = disco.Error{Code: 4038, Msg: "the peer is banned"}
+
+// ban refuses the peers matched the target (peer id, ip or cidr) until the deadline, 0 is forever
+func (r *revocations) ban(target string, deadline int64) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.Bans[target] = deadline
+	return r.save()
+}
+
+// unban reports false if the target is not banned
+func (r *revocations) unban(target string) (bool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.Bans[target]; !ok {
+		return false, nil
+	}
+	delete(r.Bans, target)
+	return true, r.save()
+}
+
+func (r *revocations) listBans() []exporter.Ban {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	now := time.Now().Unix()
+	bans := []exporter.Ban{}
+	for target, deadline := range r.Bans {
+		if deadline > 0 && deadline < now {
+			continue
+		}
+		ban := exporter.Ban{Target: target}
+		if deadline > 0 {
+			ban.Expire = time.Unix(deadline, 0)
+		}
+		bans = append(bans, ban)
+	}
+	slices.SortFunc(bans, func(a, b exporter.Ban) int { return strings.Compare(a.Target, b.Target) })
+	return bans
+}
+
+// banned reports whether the peer id or the remote address of the peer is banned
+func (r *revocations) banned(peerID disco.PeerID, remoteAddr string) bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if len(r.Bans) == 0 {
+		return false
+	}
+	now := time.Now().Unix()
+	var addr netip.Addr
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		addr, _ = netip.ParseAddr(host)
+		addr = addr.Unmap()
+	}
+	for target, deadline := range r.Bans {
+		if deadline > 0 && deadline < now {
+			continue
+		}
+		if target == peerID.String() {
+			return true
+		}
+		if !addr.IsValid() {
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(target); err == nil && prefix.Contains(addr) {
+			return true
+		}
+		if a, err := netip.ParseAddr(target); err == nil && a.Unmap() == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// disconnectBanned disconnects the banned peers
+func (pm *PeerMap) disconnectBanned() {
+	var banned []*peerConn
+	pm.networkMapMutex.RLock()
+	for _, ctx := range pm.networkMap {
+		ctx.peersMutex.RLock()
+		for _, p := range ctx.peers {
+			if pm.revocations.banned(p.id, p.remoteAddr) {
+				banned = append(banned, p)
+			}
+		}
+		ctx.peersMutex.RUnlock()
+	}
+	pm.networkMapMutex.RUnlock()
+	for _, p := range banned {
+		slog.Info("Disconnect the banned peer", "network", p.networkSecret.Load().Network, "peer", p.id)
+		p.Close()
+	}
+}
+
+// HandleQueryBans lists the bans not expired
+func (pm *PeerMap) HandleQueryBans(w http.ResponseWriter, r *http.Request) {
+	if err := pm.checkAdminToken(w, r); err != nil {
+		return
+	}
+	json.NewEncoder(w).Encode(pm.revocations.listBans())
+}
+
+// HandleBan bans the peer id, ip or cidr and disconnects the peers matched it
+func (pm *PeerMap) HandleBan(w http.ResponseWriter, r *http.Request) {
+	if err := pm.checkAdminToken(w, r); err != nil {
+		return
+	}
+	var request exporter.Ban
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Target == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var deadline int64
+	if !request.Expire.IsZero() {
+		deadline = request.Expire.Unix()
+	}
+	if err := pm.revocations.ban(request.Target, deadline); err != nil {
+		slog.Error("Ban", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Banned", "target", request.Target, "expire", request.Expire)
+	pm.disconnectBanned()
+}
+
+// HandleUnban lifts the ban of the target query
+func (pm *PeerMap) HandleUnban(w http.ResponseWriter, r *http.Request) {
+	if err := pm.checkAdminToken(w, r); err != nil {
+		return
+	}
+	target := r.URL.Query().Get("target")
+	ok, err := pm.revocations.unban(target)
+	if err != nil {
+		slog.Error("Unban", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	slog.Info("Unbanned", "target", target)
+}
+
+// HandleKickPeer disconnects the peer, it is free to connect again unless banned or revoked
+func (pm *PeerMap) HandleKickPeer(w http.ResponseWriter, r *http.Request) {
+	if err := pm.checkAdminToken(w, r); err != nil {
+		return
+	}
+	peerID := r.PathValue("peer")
+	pm.peerMapMutex.RLock()
+	ctx, ok := pm.peerMap[peerID]
+	pm.peerMapMutex.RUnlock()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	peer, ok := ctx.getPeer(disco.PeerID(peerID))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	slog.Info("PeerKicked", "network", ctx.id, "peer", peerID)
+	peer.Close()
+}
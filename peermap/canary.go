@@ -0,0 +1,213 @@
+package peermap
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rkonfj/peerguard/crash"
+	"github.com/rkonfj/peerguard/disco"
+	"github.com/rkonfj/peerguard/p2p"
+	"github.com/rkonfj/peerguard/peermap/auth"
+	"github.com/rkonfj/peerguard/peermap/exporter"
+	"github.com/rkonfj/peerguard/secure"
+	"storj.io/common/base58"
+)
+
+// canary is the internal peer joined the network, it answers the pings of the external probes
+// (e.g. pgcli ping canary) and pings the peers of the network back, so that the traversal
+// regressions show up in the metrics before the users complain
+type canary struct {
+	cfg CanaryConfig
+	pm  *PeerMap
+
+	mutex     sync.Mutex
+	id        disco.PeerID
+	connected bool
+	probes    map[disco.PeerID]*exporter.CanaryProbe
+}
+
+// canarySecretStore issues the network secret of the canary by the pgmap itself
+type canarySecretStore struct {
+	pm      *PeerMap
+	network string
+}
+
+func (s canarySecretStore) NetworkSecret() (disco.NetworkSecret, error) {
+	n := auth.Net{ID: s.network}
+	if ctx, ok := s.pm.getNetwork(s.network); ok {
+		n.Alias = ctx.alias
+		n.Neighbors = ctx.neighbors
+	}
+	return s.pm.generateSecret(n)
+}
+
+// UpdateNetworkSecret does nothing, a new secret is issued whenever the canary reconnects
+func (s canarySecretStore) UpdateNetworkSecret(disco.NetworkSecret) error {
+	return nil
+}
+
+// run joins the network and pings the peers every interval until ctx is done
+func (c *canary) run(ctx context.Context) {
+	defer crash.Recover("peermap/canary")
+	// the key is derived from the secret key, so that the peer id of the canary is stable across restarts
+	seed := sha256.Sum256([]byte("pgcanary" + c.pm.cfg.SecretKey.Current() + c.cfg.Network))
+	key, err := secure.Curve25519PrivateKey(base58.Encode(seed[:]))
+	if err != nil {
+		slog.Error("Canary", "network", c.cfg.Network, "err", err)
+		return
+	}
+	peermap, err := disco.NewPeermapURL(c.cfg.Server, canarySecretStore{pm: c.pm, network: c.cfg.Network})
+	if err != nil {
+		slog.Error("Canary", "network", c.cfg.Network, "err", err)
+		return
+	}
+	for {
+		conn, err := p2p.ListenPacketContext(ctx, peermap,
+			p2p.ListenPeerCurve25519(key.String()),
+			p2p.ListenUDPPort(c.cfg.UDPPort),
+			p2p.PeerMeta("name", c.cfg.Name),
+		)
+		if err == nil {
+			slog.Info("Canary joined", "network", c.cfg.Network, "peer", conn.LocalAddr(), "name", c.cfg.Name)
+			c.serve(ctx, conn)
+			conn.Close()
+		} else if ctx.Err() == nil {
+			slog.Warn("Canary join failed", "network", c.cfg.Network, "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(c.cfg.Interval):
+		}
+	}
+}
+
+// serve pings the peers of the network every interval until the conn is closed or ctx is done
+func (c *canary) serve(ctx context.Context, conn *p2p.PeerPacketConn) {
+	id, _ := conn.LocalAddr().(disco.PeerID)
+	c.mutex.Lock()
+	c.id, c.connected = id, true
+	c.mutex.Unlock()
+	defer func() {
+		c.mutex.Lock()
+		c.connected = false
+		c.mutex.Unlock()
+	}()
+
+	closed := make(chan struct{})
+	go func() { // the echo requests and replies are dispatched by ReadFrom
+		defer close(closed)
+		buf := make([]byte, 65535)
+		for {
+			if _, _, err := conn.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+	}()
+	ticker := time.NewTicker(c.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-closed:
+			return
+		case <-ticker.C:
+		}
+		var wg sync.WaitGroup
+		for _, peerID := range c.peers(id) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				pingCtx, cancel := context.WithTimeout(ctx, c.cfg.Timeout)
+				defer cancel()
+				pong, err := conn.Ping(pingCtx, peerID)
+				if ctx.Err() == nil {
+					c.record(peerID, pong, err)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+// peers returns the peers connected to the network except the canary, the results
+// of the peers left are dropped
+func (c *canary) peers(self disco.PeerID) []disco.PeerID {
+	var peers []disco.PeerID
+	if ctx, ok := c.pm.getNetwork(c.cfg.Network); ok {
+		ctx.peersMutex.RLock()
+		for id := range ctx.peers {
+			if id != self.String() {
+				peers = append(peers, disco.PeerID(id))
+			}
+		}
+		ctx.peersMutex.RUnlock()
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for id := range c.probes {
+		if !slices.Contains(peers, id) {
+			delete(c.probes, id)
+		}
+	}
+	return peers
+}
+
+func (c *canary) record(peerID disco.PeerID, pong p2p.Pong, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	probe, ok := c.probes[peerID]
+	if !ok {
+		probe = &exporter.CanaryProbe{Peer: peerID.String()}
+		c.probes[peerID] = probe
+	}
+	probe.Sent++
+	if err != nil {
+		slog.Debug("CanaryPing", "network", c.cfg.Network, "peer", peerID, "err", err)
+		return
+	}
+	probe.Received++
+	probe.RTT = pong.RTT
+	probe.Relayed = pong.Relayed || pong.ReplyRelayed
+	if !probe.Relayed {
+		probe.Direct++
+	}
+	probe.LastReply = time.Now()
+}
+
+func (c *canary) snapshot() exporter.Canary {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	s := exporter.Canary{
+		Network:   c.cfg.Network,
+		Name:      c.cfg.Name,
+		ID:        c.id.String(),
+		Connected: c.connected,
+		Probes:    []exporter.CanaryProbe{},
+	}
+	for _, probe := range c.probes {
+		s.Probes = append(s.Probes, *probe)
+	}
+	slices.SortFunc(s.Probes, func(a, b exporter.CanaryProbe) int { return strings.Compare(a.Peer, b.Peer) })
+	return s
+}
+
+// HandleQueryCanaries returns the canaries and the results of pinging the peers of their networks
+func (pm *PeerMap) HandleQueryCanaries(w http.ResponseWriter, r *http.Request) {
+	if err := pm.checkAdminToken(w, r); err != nil {
+		return
+	}
+	canaries := []exporter.Canary{}
+	for _, c := range pm.canaries {
+		canaries = append(canaries, c.snapshot())
+	}
+	json.NewEncoder(w).Encode(canaries)
+}
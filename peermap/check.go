@@ -0,0 +1,114 @@
+package peermap
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/rkonfj/peerguard/disco/netcheck"
+	"github.com/rkonfj/peerguard/peermap/oidc"
+)
+
+// ConfigCheck is the result of one check of the config, Err is nil if passed
+type ConfigCheck struct {
+	Name string
+	Err  error
+}
+
+// CheckConfig validates the config the way the server starts with it, without serving. The oidc
+// providers are discovered, the STUN servers are requested and the state files are decoded.
+// The checks following a failed fatal check (e.g. invalid config) are skipped
+func CheckConfig(ctx context.Context, cfg Config) (checks []ConfigCheck) {
+	check := func(name string, err error) bool {
+		checks = append(checks, ConfigCheck{Name: name, Err: err})
+		return err == nil
+	}
+
+	if cfg.SecretKey.Current() == "" {
+		check("secret key", errors.New("secret_key is not set, the network secrets are invalid after restart"))
+	}
+	providers := cfg.OIDCProviders
+	cfg.OIDCProviders = nil // discovered below with the errors reported
+	if !check("config", cfg.applyDefaults()) {
+		return
+	}
+	if _, _, err := net.SplitHostPort(cfg.Listen); err != nil {
+		check("listen", err)
+	}
+	if cfg.TLS != nil {
+		_, err := tls.LoadX509KeyPair(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		if err == nil {
+			_, err = cfg.TLS.serverTLSConfig()
+		}
+		check("tls", err)
+	}
+
+	for _, provider := range providers {
+		check("oidc provider "+provider.Name, checkOIDCProvider(provider))
+	}
+
+	if len(cfg.STUNs) > 0 {
+		for _, r := range netcheck.ProbeSTUN(ctx, "udp", cfg.STUNs, 3*time.Second) {
+			var err error
+			if r.Error != "" {
+				err = errors.New(r.Error)
+			}
+			check("stun "+r.Server, err)
+		}
+	}
+
+	stateKeys, err := cfg.stateKeys()
+	if !check("state key", err) {
+		return
+	}
+	store, err := newStateStore(&cfg)
+	if check("state store", err) {
+		check("state "+store.String(), checkState(store, stateKeys))
+	}
+	check("revocation file "+cfg.RevocationFile, newRevocations(cfg.RevocationFile, stateKeys, cfg.PlaintextState).load())
+	if cfg.HistoryFile != "" {
+		check("history file "+cfg.HistoryFile,
+			newHistory(cfg.HistoryRetention, cfg.HistoryFile, stateKeys, cfg.PlaintextState).load())
+	}
+	if cfg.WebAuthn != nil {
+		check("webauthn credential file "+cfg.WebAuthn.CredentialFile,
+			newWebAuthnCredentials(cfg.WebAuthn.CredentialFile, stateKeys, cfg.PlaintextState).load())
+	}
+	return
+}
+
+func checkOIDCProvider(provider oidc.OIDCProviderConfig) error {
+	if provider.Name == "" {
+		return errors.New("name is required")
+	}
+	if provider.ClientID == "" {
+		return errors.New("client_id is required")
+	}
+	if provider.Issuer == "" && (provider.AuthURL == "" || provider.TokenURL == "") {
+		return errors.New("issuer or auth_url and token_url are required")
+	}
+	if err := oidc.AddProvider(provider); err != nil {
+		return fmt.Errorf("discovery: %w", err)
+	}
+	return nil
+}
+
+func checkState(store stateStore, keys [][]byte) error {
+	b, err := readState(store, keys)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var nets []NetState
+	if err := json.Unmarshal(b, &nets); err != nil && len(b) > 0 {
+		return fmt.Errorf("decode state: %w", err)
+	}
+	return nil
+}
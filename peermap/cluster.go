@@ -0,0 +1,411 @@
+package peermap
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rkonfj/peerguard/crash"
+	"github.com/rkonfj/peerguard/disco"
+	"github.com/rkonfj/peerguard/peermap/auth"
+)
+
+// the messages between the cluster members, [type][network len(2)][network][peer len][peer][payload]
+const (
+	// clusterJoin announces the peer connected to the member, the payload is the flags and the disco meta
+	clusterJoin byte = 1
+	// clusterLeave announces the peer disconnected from the member
+	clusterLeave byte = 2
+	// clusterDeliver writes the payload (a control frame) to the peer connected to the member
+	clusterDeliver byte = 3
+)
+
+const clusterFlagNoRelay byte = 1
+
+// cluster shares the peers with the other pgmap servers (the members). The member dials each of
+// the others and announces its peers on the link, the others are told the peers joined and left
+// then, so that the control frames to the peers of the others are forwarded to them. The members
+// must share the same secret key, the links are authenticated by the key derived from it
+type cluster struct {
+	pm    *PeerMap
+	cfg   ClusterConfig
+	token string
+
+	mutex   sync.RWMutex
+	links   map[string]*clusterLink                 // member name => the link dialed to it
+	remotes map[string]map[disco.PeerID]*remotePeer // network => the peers of the other members
+}
+
+// clusterLink is the websocket dialed to the member, only this member writes to it
+type clusterLink struct {
+	name  string
+	conn  *websocket.Conn
+	mutex sync.Mutex
+}
+
+func (l *clusterLink) send(b []byte) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	return l.conn.WriteMessage(websocket.BinaryMessage, b)
+}
+
+// remotePeer is the peer connected to the other member
+type remotePeer struct {
+	member  string
+	meta    []byte
+	noRelay bool
+}
+
+func newCluster(pm *PeerMap, cfg ClusterConfig) *cluster {
+	mac := hmac.New(sha256.New, []byte(pm.cfg.SecretKey.Current()))
+	mac.Write([]byte("pgcluster"))
+	return &cluster{
+		pm:      pm,
+		cfg:     cfg,
+		token:   hex.EncodeToString(mac.Sum(nil)),
+		links:   make(map[string]*clusterLink),
+		remotes: make(map[string]map[disco.PeerID]*remotePeer),
+	}
+}
+
+// clusterURL is the cluster endpoint of the peermap url, e.g. wss://pg2.example.com/pg/cluster
+func clusterURL(member string) (string, error) {
+	u, err := url.Parse(member)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "http", "ws":
+		u.Scheme = "ws"
+	case "https", "wss":
+		u.Scheme = "wss"
+	default:
+		return "", fmt.Errorf("unsupported member url %s", member)
+	}
+	u.Path = "/pg/cluster"
+	return u.String(), nil
+}
+
+// run dials the members until ctx is done
+func (c *cluster) run(ctx context.Context) {
+	if c == nil {
+		return
+	}
+	for _, member := range c.cfg.Members {
+		go c.dialLoop(ctx, member)
+	}
+}
+
+func (c *cluster) dialLoop(ctx context.Context, member string) {
+	defer crash.Recover("peermap/cluster")
+	endpoint, _ := clusterURL(member)
+	for {
+		if err := c.dial(ctx, endpoint); err != nil {
+			slog.Warn("ClusterLink", "member", member, "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// dial links to the member and announces all the peers, it returns when the link is closed
+func (c *cluster) dial(ctx context.Context, endpoint string) error {
+	header := http.Header{}
+	header.Set("X-Cluster-Token", c.token)
+	header.Set("X-Cluster-Member", c.cfg.Name)
+	conn, resp, err := websocket.DefaultDialer.DialContext(ctx, endpoint, header)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	link := clusterLink{name: resp.Header.Get("X-Cluster-Member"), conn: conn}
+	if link.name == "" || link.name == c.cfg.Name {
+		return errors.New("invalid member name " + link.name)
+	}
+	c.mutex.Lock()
+	c.links[link.name] = &link
+	c.mutex.Unlock()
+	defer func() {
+		c.mutex.Lock()
+		if c.links[link.name] == &link {
+			delete(c.links, link.name)
+		}
+		c.mutex.Unlock()
+	}()
+	slog.Info("ClusterLinked", "member", link.name, "endpoint", endpoint)
+
+	for _, p := range c.pm.localPeers() {
+		if err := link.send(joinMessage(p)); err != nil {
+			return err
+		}
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return err
+		}
+	}
+}
+
+// HandleCluster accepts the link of the member, the peers it announces are led to the local ones
+func (pm *PeerMap) HandleCluster(w http.ResponseWriter, r *http.Request) {
+	c := pm.cluster
+	if c == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !hmac.Equal([]byte(r.Header.Get("X-Cluster-Token")), []byte(c.token)) {
+		slog.Debug("ClusterAuthFailed", "addr", r.RemoteAddr)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	member := r.Header.Get("X-Cluster-Member")
+	if member == "" || member == c.cfg.Name {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	header := http.Header{}
+	header.Set("X-Cluster-Member", c.cfg.Name)
+	conn, err := pm.wsUpgrader.Upgrade(w, r, header)
+	if err != nil {
+		slog.Debug("ClusterUpgrade", "member", member, "err", err)
+		return
+	}
+	defer conn.Close()
+	defer c.dropMember(member)
+	for {
+		mt, b, err := conn.ReadMessage()
+		if err != nil {
+			slog.Info("ClusterUnlinked", "member", member, "err", err)
+			return
+		}
+		if mt != websocket.BinaryMessage {
+			continue
+		}
+		typ, network, peerID, payload, ok := parseClusterMessage(b)
+		if !ok {
+			continue
+		}
+		switch typ {
+		case clusterJoin:
+			if len(payload) > 0 {
+				c.remoteJoined(member, network, peerID, payload[0]&clusterFlagNoRelay != 0, payload[1:])
+			}
+		case clusterLeave:
+			c.remoteLeft(member, network, peerID)
+		case clusterDeliver:
+			if ctx, ok := pm.getNetwork(network); ok {
+				if p, ok := ctx.getPeer(peerID); ok {
+					p.write(payload)
+				}
+			}
+		}
+	}
+}
+
+// remoteJoined records the peer of the member and leads the disco with the local peers
+func (c *cluster) remoteJoined(member, network string, peerID disco.PeerID, noRelay bool, meta []byte) {
+	c.mutex.Lock()
+	peers, ok := c.remotes[network]
+	if !ok {
+		peers = make(map[disco.PeerID]*remotePeer)
+		c.remotes[network] = peers
+	}
+	peers[peerID] = &remotePeer{member: member, meta: meta, noRelay: noRelay}
+	c.mutex.Unlock()
+	slog.Debug("ClusterPeerJoined", "member", member, "network", network, "peer", peerID)
+
+	ctx, ok := c.pm.getNetwork(network)
+	if !ok || c.pm.cfg.PublicNetwork == network {
+		return
+	}
+	ctx.peersMutex.RLock()
+	defer ctx.peersMutex.RUnlock()
+	for _, p := range ctx.peers {
+		if p.id == peerID || p.metadata.Has("silenceMode") {
+			continue
+		}
+		p.write(newPeerFrame(peerID, meta))
+		c.deliver(member, network, peerID, newPeerFrame(p.id, p.discoMeta()))
+	}
+}
+
+func (c *cluster) remoteLeft(member, network string, peerID disco.PeerID) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if peer, ok := c.remotes[network][peerID]; ok && peer.member == member {
+		delete(c.remotes[network], peerID)
+	}
+}
+
+// dropMember forgets the peers of the member, its link is closed
+func (c *cluster) dropMember(member string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for network, peers := range c.remotes {
+		for peerID, peer := range peers {
+			if peer.member == member {
+				delete(peers, peerID)
+			}
+		}
+		if len(peers) == 0 {
+			delete(c.remotes, network)
+		}
+	}
+}
+
+func (c *cluster) remotePeer(network string, peerID disco.PeerID) (*remotePeer, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	peer, ok := c.remotes[network][peerID]
+	return peer, ok
+}
+
+// deliver sends the control frame to the peer connected to the member
+func (c *cluster) deliver(member, network string, peerID disco.PeerID, frame []byte) error {
+	c.mutex.RLock()
+	link, ok := c.links[member]
+	c.mutex.RUnlock()
+	if !ok {
+		return fmt.Errorf("member %s is not linked", member)
+	}
+	return link.send(clusterMessage(clusterDeliver, network, peerID, frame))
+}
+
+// broadcast sends the message to all the members linked
+func (c *cluster) broadcast(b []byte) {
+	c.mutex.RLock()
+	links := make([]*clusterLink, 0, len(c.links))
+	for _, link := range c.links {
+		links = append(links, link)
+	}
+	c.mutex.RUnlock()
+	for _, link := range links {
+		if err := link.send(b); err != nil {
+			slog.Debug("ClusterBroadcast", "member", link.name, "err", err)
+		}
+	}
+}
+
+// peerJoined announces the local peer to the members
+func (c *cluster) peerJoined(p *peerConn) {
+	if c == nil {
+		return
+	}
+	c.broadcast(joinMessage(p))
+}
+
+// peerLeft announces the local peer disconnected to the members
+func (c *cluster) peerLeft(p *peerConn) {
+	if c == nil || p.metadata.Has("silenceMode") {
+		return
+	}
+	c.broadcast(clusterMessage(clusterLeave, p.networkSecret.Load().Network, p.id, nil))
+}
+
+// forward forwards the control frame of the peer to the target peer connected to the other member,
+// false if the target is not found in the cluster
+func (c *cluster) forward(p *peerConn, tgtPeerID disco.PeerID, b []byte) bool {
+	if c == nil {
+		return false
+	}
+	network := p.networkSecret.Load().Network
+	tgt, ok := c.remotePeer(network, tgtPeerID)
+	if !ok {
+		return false
+	}
+	switch disco.ControlCode(b[0]) {
+	case disco.CONTROL_RELAY:
+		if p.networkSecret.Load().HasScope(auth.ScopeNoRelay) || tgt.noRelay {
+			slog.Debug("RelayDenied", "from", p.id, "to", tgtPeerID, "scope", auth.ScopeNoRelay)
+			return true
+		}
+	case disco.CONTROL_LEAD_DISCO:
+		p.write(newPeerFrame(tgtPeerID, tgt.meta))
+		if err := c.deliver(tgt.member, network, tgtPeerID, newPeerFrame(p.id, p.discoMeta())); err != nil {
+			slog.Debug("ClusterLeadDisco", "to", tgtPeerID, "err", err)
+		}
+		return true
+	case disco.CONTROL_NEW_PEER_UDP_ADDR:
+		p.updatePeerUDPAddr(b)
+	}
+	if err := c.deliver(tgt.member, network, tgtPeerID, relayFrame(b[0], p.id, b[b[1]+2:])); err != nil {
+		slog.Debug("ClusterForward", "to", tgtPeerID, "member", tgt.member, "err", err)
+		return true
+	}
+	p.stat.RelayRx.Add(uint64(len(b)))
+	p.stat.RelayRxMessages.Add(1)
+	p.networkContext.relayBytes.Add(uint64(len(b)))
+	p.networkContext.relayMessages.Add(1)
+	return true
+}
+
+// localPeers is the peers announced to the members, the silent ones and the ones of the public
+// network are not discovered by the others
+func (pm *PeerMap) localPeers() (peers []*peerConn) {
+	pm.networkMapMutex.RLock()
+	defer pm.networkMapMutex.RUnlock()
+	for network, ctx := range pm.networkMap {
+		if network == pm.cfg.PublicNetwork {
+			continue
+		}
+		ctx.peersMutex.RLock()
+		for _, p := range ctx.peers {
+			if !p.metadata.Has("silenceMode") {
+				peers = append(peers, p)
+			}
+		}
+		ctx.peersMutex.RUnlock()
+	}
+	return
+}
+
+func joinMessage(p *peerConn) []byte {
+	var flags byte
+	if p.networkSecret.Load().HasScope(auth.ScopeNoRelay) {
+		flags |= clusterFlagNoRelay
+	}
+	return clusterMessage(clusterJoin, p.networkSecret.Load().Network, p.id, append([]byte{flags}, p.discoMeta()...))
+}
+
+func clusterMessage(typ byte, network string, peerID disco.PeerID, payload []byte) []byte {
+	b := make([]byte, 0, 4+len(network)+len(peerID)+len(payload))
+	b = append(b, typ)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(network)))
+	b = append(b, network...)
+	b = append(b, peerID.Len())
+	b = append(b, peerID.Bytes()...)
+	return append(b, payload...)
+}
+
+func parseClusterMessage(b []byte) (typ byte, network string, peerID disco.PeerID, payload []byte, ok bool) {
+	if len(b) < 4 {
+		return
+	}
+	typ = b[0]
+	n := int(binary.BigEndian.Uint16(b[1:3]))
+	if len(b) < 4+n || len(b) < 4+n+int(b[3+n]) {
+		return
+	}
+	network = string(b[3 : 3+n])
+	m := int(b[3+n])
+	peerID = disco.PeerID(b[4+n : 4+n+m])
+	return typ, network, peerID, b[4+n+m:], true
+}
@@ -6,10 +6,19 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"os"
+	"slices"
 	"time"
 
+	"github.com/rkonfj/peerguard/debughttp"
+	"github.com/rkonfj/peerguard/peermap/alert"
+	"github.com/rkonfj/peerguard/peermap/audit"
+	"github.com/rkonfj/peerguard/peermap/auth"
+	"github.com/rkonfj/peerguard/peermap/ldap"
 	"github.com/rkonfj/peerguard/peermap/oidc"
+	"github.com/rkonfj/peerguard/peermap/webauthn"
+	"github.com/rkonfj/peerguard/secure"
 	"gopkg.in/yaml.v2"
 )
 
@@ -72,27 +81,224 @@ func (c *RateLimiterConfig) check() error {
 	return nil
 }
 
+// SecretKeys is the current secret key followed by the previous ones, it is unmarshaled
+// from a single key or a list. The current key issues the network secrets, the previous
+// keys keep the outstanding secrets valid while the key is being rotated
+type SecretKeys []string
+
+func (keys *SecretKeys) UnmarshalYAML(unmarshal func(any) error) error {
+	var key string
+	if err := unmarshal(&key); err == nil {
+		*keys = SecretKeys{key}
+		return nil
+	}
+	var list []string
+	if err := unmarshal(&list); err != nil {
+		return err
+	}
+	*keys = list
+	return nil
+}
+
+// Current is the key issues the network secrets
+func (keys SecretKeys) Current() string {
+	if len(keys) == 0 {
+		return ""
+	}
+	return keys[0]
+}
+
+// Previous is the keys only verify the network secrets
+func (keys SecretKeys) Previous() []string {
+	if len(keys) == 0 {
+		return nil
+	}
+	return keys[1:]
+}
+
 type Config struct {
 	Listen               string                    `yaml:"listen"`
-	SecretKey            string                    `yaml:"secret_key"`
+	SecretKey            SecretKeys                `yaml:"secret_key"`
 	STUNs                []string                  `yaml:"stuns"`
 	PublicNetwork        string                    `yaml:"public_network"`
 	OIDCProviders        []oidc.OIDCProviderConfig `yaml:"oidc_providers"`
+	LDAP                 *ldap.LDAPConfig          `yaml:"ldap,omitempty"`
+	TLS                  *TLSConfig                `yaml:"tls,omitempty"`
 	RateLimiter          *RateLimiterConfig        `yaml:"rate_limiter,omitempty"`
 	SecretRotationPeriod time.Duration             `yaml:"secret_rotation_period"`
 	SecretValidityPeriod time.Duration             `yaml:"secret_validity_period"`
 	StateFile            string                    `yaml:"state_file"`
+	RevocationFile       string                    `yaml:"revocation_file"`
+	// StateStore saves the networks state to file:PATH or redis://[:password@]host:port[/db][?key=name]
+	// instead of the state_file. The store is single-writer, of the pgmap servers sharing the redis only
+	// the one holding the lease saves, another takes over once it stops saving for 3 save intervals.
+	// The networks of the cluster members not holding the lease are not saved
+	StateStore string `yaml:"state_store"`
+	// SaveInterval saves the networks state periodically besides on SIGHUP, default 1m
+	SaveInterval time.Duration `yaml:"save_interval"`
+	// StateKey seals the state files at rest (env:NAME, file:PATH or the secret itself),
+	// a key derived from the secret key is used if it is empty
+	StateKey string `yaml:"state_key"`
+	// PlaintextState stores the state files unencrypted
+	PlaintextState bool `yaml:"plaintext_state"`
+	// ClientCertificates maps the client certificates fingerprints to the networks
+	ClientCertificates []ClientCertificate `yaml:"client_certificates"`
+	// WebAuthn requires the security key after the oidc login for the sensitive networks
+	WebAuthn *webauthn.WebAuthnConfig `yaml:"webauthn,omitempty"`
+	// AuthEvents emits the authentication events to the file, syslog or http collector for the SIEM
+	AuthEvents *audit.Config `yaml:"auth_events,omitempty"`
+
+	// SecretGracePeriod is how long the rotated secrets not acked by the peer are still accepted after they expired
+	SecretGracePeriod time.Duration `yaml:"secret_grace_period"`
+	// SecretGraceCount is the max number of the rotated secrets per peer are accepted within the grace period
+	SecretGraceCount int `yaml:"secret_grace_count"`
+	// SignedSecrets issues Ed25519 signed network secrets verifiable by the keys published at /pg/jwks
+	SignedSecrets bool `yaml:"signed_secrets"`
+	// PeerIDBinding prevents the peer ids from being squatted by other users in the shared networks,
+	// identity binds the peer id to the user enrolled it first, key requires the proof of the peer key as well
+	PeerIDBinding string `yaml:"peer_id_binding"`
+	// MaxDevicesPerUser caps the devices (peer ids) enrolled by each oidc or ldap user, 0 is unlimited
+	MaxDevicesPerUser int `yaml:"max_devices_per_user"`
+
+	CertificateValidityPeriod time.Duration `yaml:"certificate_validity_period"`
+
+	// HistoryRetention is how long the per-minute statistics of the networks are kept, default 24h
+	HistoryRetention time.Duration `yaml:"history_retention"`
+	// HistoryFile persists the statistics history across restarts, empty keeps it only in memory
+	HistoryFile string `yaml:"history_file"`
+
+	// Canaries run the internal peers in the networks, the external probes ping them and they ping
+	// the peers of the networks back, the results are exposed at /pg/canaries
+	Canaries []CanaryConfig `yaml:"canaries"`
+
+	// Alerts notify the webhooks or the email recipients when the relay bandwidth, the auth failures
+	// or the peer churn are above the thresholds
+	Alerts *alert.Config `yaml:"alerts,omitempty"`
+
+	// Debug serves pprof and expvar on a dedicated listener guarded by the token
+	Debug *debughttp.Config `yaml:"debug,omitempty"`
+
+	// Cluster shares the peers with the other pgmap servers of the same secret key, the peers of a
+	// network connected to the different servers discover and relay to each other
+	Cluster *ClusterConfig `yaml:"cluster,omitempty"`
+
+	secretKeyGenerated bool
+}
+
+type CanaryConfig struct {
+	Network string `yaml:"network"`
+	// Name is the name metadata of the canary peer the probes ping, default canary
+	Name string `yaml:"name"`
+	// Server is the peermap url the canary joins, default this pgmap on the listen address.
+	// It is required if tls is enabled, the url must match the certificate
+	Server string `yaml:"server"`
+	// UDPPort is the udp port punched by the peers, default 29890 plus the index of the canary
+	UDPPort int `yaml:"udp_port"`
+	// Interval is how often the canary pings the peers of the network, default 30s
+	Interval time.Duration `yaml:"interval"`
+	// Timeout is how long the canary waits for the reply, default 5s
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func (cfg *Config) applyCanaryDefaults() error {
+	var networks []string
+	for i := range cfg.Canaries {
+		c := &cfg.Canaries[i]
+		if c.Network == "" {
+			return errors.New("canaries: network is required")
+		}
+		if slices.Contains(networks, c.Network) {
+			return fmt.Errorf("canaries: duplicated network %s", c.Network)
+		}
+		networks = append(networks, c.Network)
+		if c.Name == "" {
+			c.Name = "canary"
+		}
+		if c.Server == "" {
+			if cfg.TLS != nil {
+				return fmt.Errorf("canaries: %s: server is required when tls is enabled", c.Network)
+			}
+			host, port, err := net.SplitHostPort(cfg.Listen)
+			if err != nil {
+				return fmt.Errorf("canaries: %w", err)
+			}
+			if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+				host = "127.0.0.1"
+			}
+			c.Server = fmt.Sprintf("http://%s/pg", net.JoinHostPort(host, port))
+		}
+		if c.UDPPort == 0 {
+			c.UDPPort = 29890 + i
+		}
+		if c.Interval == 0 {
+			c.Interval = 30 * time.Second
+		}
+		if c.Timeout == 0 {
+			c.Timeout = 5 * time.Second
+		}
+		if c.Timeout >= c.Interval {
+			return fmt.Errorf("canaries: %s: timeout must less than interval", c.Network)
+		}
+	}
+	return nil
+}
+
+type ClusterConfig struct {
+	// Name identifies this server in the cluster, default the hostname
+	Name string `yaml:"name"`
+	// Members are the peermap urls of the other servers, e.g. https://pg2.example.com/pg
+	Members []string `yaml:"members"`
+}
+
+func (c *ClusterConfig) check() error {
+	if c.Name == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("cluster: name is required: %w", err)
+		}
+		c.Name = hostname
+	}
+	if len(c.Members) == 0 {
+		return errors.New("cluster: members is required")
+	}
+	for _, member := range c.Members {
+		if _, err := clusterURL(member); err != nil {
+			return fmt.Errorf("cluster: %w", err)
+		}
+	}
+	return nil
+}
+
+// stateKeys returns the keys unseal the state files, the first one seals them.
+// The keys derived from the previous secret keys keep the state readable after rotation
+func (cfg *Config) stateKeys() ([][]byte, error) {
+	if cfg.StateKey != "" {
+		key, err := secure.ResolveSealingKey(cfg.StateKey, "state")
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{key}, nil
+	}
+	if cfg.secretKeyGenerated { // the state would be unreadable after restart
+		return nil, nil
+	}
+	var keys [][]byte
+	for _, k := range cfg.SecretKey {
+		keys = append(keys, secure.DeriveSealingKey(k, "state"))
+	}
+	return keys, nil
 }
 
 func (cfg *Config) applyDefaults() error {
 	if cfg.Listen == "" {
 		cfg.Listen = "127.0.0.1:9987"
 	}
-	if cfg.SecretKey == "" {
+	if cfg.SecretKey.Current() == "" {
 		secretKey := make([]byte, 16)
 		rand.Read(secretKey)
-		cfg.SecretKey = hex.EncodeToString(secretKey)
-		slog.Info("SecretKey " + cfg.SecretKey)
+		cfg.SecretKey = SecretKeys{hex.EncodeToString(secretKey)}
+		cfg.secretKeyGenerated = true
+		slog.Info("SecretKey " + cfg.SecretKey.Current())
 	}
 	if len(cfg.STUNs) == 0 {
 		slog.Warn("No STUN servers is set up, NAT traversal is disabled")
@@ -111,9 +317,86 @@ func (cfg *Config) applyDefaults() error {
 	if cfg.SecretRotationPeriod >= cfg.SecretValidityPeriod {
 		return errors.New("secret rotation period must less than validity period")
 	}
+	if cfg.SecretGracePeriod == 0 {
+		cfg.SecretGracePeriod = 10 * time.Minute
+	}
+	if cfg.SecretGraceCount == 0 {
+		cfg.SecretGraceCount = 2
+	}
+	if cfg.CertificateValidityPeriod == 0 {
+		cfg.CertificateValidityPeriod = time.Hour
+	}
+	if cfg.CertificateValidityPeriod < 2*time.Minute {
+		return errors.New("certificate validity period must greater than 2m")
+	}
+	if cfg.HistoryRetention == 0 {
+		cfg.HistoryRetention = 24 * time.Hour
+	}
+	if cfg.HistoryRetention < time.Minute {
+		return errors.New("history retention must greater than 1m")
+	}
 	if cfg.StateFile == "" {
 		cfg.StateFile = "state.json"
 	}
+	if cfg.SaveInterval == 0 {
+		cfg.SaveInterval = time.Minute
+	}
+	if cfg.SaveInterval < time.Second {
+		return errors.New("save interval must greater than 1s")
+	}
+	if cfg.RevocationFile == "" {
+		cfg.RevocationFile = "revocations.json"
+	}
+	if cfg.LDAP != nil {
+		if cfg.LDAP.URL == "" {
+			return errors.New("ldap: url is required")
+		}
+		if err := cfg.LDAP.Check(); err != nil {
+			return err
+		}
+		if len(cfg.LDAP.Groups) == 0 && cfg.LDAP.DefaultNetwork == "" {
+			return errors.New("ldap: groups or default_network is required")
+		}
+		for _, group := range cfg.LDAP.Groups {
+			if err := auth.CheckScopes(group.Scopes); err != nil {
+				return fmt.Errorf("ldap: group %s: %w", group.Group, err)
+			}
+		}
+	}
+	if cfg.TLS != nil && (cfg.TLS.CertFile == "" || cfg.TLS.KeyFile == "") {
+		return errors.New("tls: cert_file and key_file are required")
+	}
+	switch cfg.PeerIDBinding {
+	case "", PeerIDBindingIdentity, PeerIDBindingKey:
+	default:
+		return fmt.Errorf("unknown peer id binding %s (identity or key)", cfg.PeerIDBinding)
+	}
+	if err := cfg.checkClientCertificates(); err != nil {
+		return err
+	}
+	if cfg.WebAuthn != nil {
+		if err := cfg.WebAuthn.Check(); err != nil {
+			return err
+		}
+	}
+	if err := cfg.applyCanaryDefaults(); err != nil {
+		return err
+	}
+	if cfg.Alerts != nil {
+		if err := cfg.Alerts.Check(); err != nil {
+			return err
+		}
+	}
+	if cfg.Debug != nil {
+		if err := cfg.Debug.Check(); err != nil {
+			return err
+		}
+	}
+	if cfg.Cluster != nil {
+		if err := cfg.Cluster.check(); err != nil {
+			return err
+		}
+	}
 	for _, provider := range cfg.OIDCProviders {
 		oidc.AddProvider(provider)
 	}
@@ -136,11 +419,22 @@ func (cfg *Config) Overwrite(cfg1 Config) {
 }
 
 func ReadConfig(configFile string) (cfg Config, err error) {
+	return readConfig(configFile, false)
+}
+
+// ReadConfigStrict is ReadConfig but the unknown or duplicated keys are errors, e.g. the misspelled keys
+func ReadConfigStrict(configFile string) (cfg Config, err error) {
+	return readConfig(configFile, true)
+}
+
+func readConfig(configFile string, strict bool) (cfg Config, err error) {
 	f, err := os.Open(configFile)
 	if err != nil {
 		return
 	}
 	defer f.Close()
-	err = yaml.NewDecoder(f).Decode(&cfg)
+	decoder := yaml.NewDecoder(f)
+	decoder.SetStrict(strict)
+	err = decoder.Decode(&cfg)
 	return
 }
@@ -0,0 +1,162 @@
+package peermap
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/rkonfj/peerguard/disco"
+	"github.com/rkonfj/peerguard/peermap/audit"
+	"github.com/rkonfj/peerguard/peermap/exporter"
+)
+
+var (
+	ErrDeviceLimitExceeded = disco.Error{Code: 4032, Msg: "the device limit of the user is exceeded"}
+	ErrDeviceRevoked       = disco.Error{Code: 4033, Msg: "the device is revoked"}
+)
+
+// enrollDevice records the peer as the device of the user, the user is empty for the
+// secrets not issued to an identity (e.g. pre-shared secrets) that are not tracked.
+// enrolled reports whether the device is new
+func (ctx *networkContext) enrollDevice(user string, peerID disco.PeerID, maxDevices int) (enrolled bool, err error) {
+	if user == "" {
+		return false, nil
+	}
+	ctx.devicesMutex.Lock()
+	defer ctx.devicesMutex.Unlock()
+	now := time.Now()
+	if device, ok := ctx.devices[peerID.String()]; ok && device.User == user {
+		if device.Revoked {
+			return false, ErrDeviceRevoked
+		}
+		device.LastSeen = now
+		return false, nil
+	}
+	if maxDevices > 0 {
+		var count int
+		for _, device := range ctx.devices {
+			if device.User == user && !device.Revoked {
+				count++
+			}
+		}
+		if count >= maxDevices {
+			return false, ErrDeviceLimitExceeded.Wrap(fmt.Errorf("%d devices enrolled, revoke one first", count))
+		}
+	}
+	ctx.devices[peerID.String()] = &exporter.Device{
+		PeerID:    peerID.String(),
+		User:      user,
+		Network:   ctx.id,
+		FirstSeen: now,
+		LastSeen:  now,
+	}
+	slog.Info("DeviceEnrolled", "network", ctx.id, "user", user, "peer", peerID)
+	return true, nil
+}
+
+// unenrollDevice forgets the device enrolled by the connection failed to join
+func (ctx *networkContext) unenrollDevice(peerID disco.PeerID) {
+	ctx.devicesMutex.Lock()
+	defer ctx.devicesMutex.Unlock()
+	delete(ctx.devices, peerID.String())
+	slog.Debug("DeviceUnenrolled", "network", ctx.id, "peer", peerID)
+}
+
+// listDevices returns the devices of the user, all devices if user is empty
+func (ctx *networkContext) listDevices(user string) []exporter.Device {
+	ctx.devicesMutex.Lock()
+	defer ctx.devicesMutex.Unlock()
+	var devices []exporter.Device
+	for _, device := range ctx.devices {
+		if user != "" && device.User != user {
+			continue
+		}
+		d := *device
+		_, d.Online = ctx.getPeer(disco.PeerID(d.PeerID))
+		devices = append(devices, d)
+	}
+	return devices
+}
+
+func (ctx *networkContext) revokeDevice(peerID string) bool {
+	ctx.devicesMutex.Lock()
+	defer ctx.devicesMutex.Unlock()
+	device, ok := ctx.devices[peerID]
+	if ok {
+		device.Revoked = true
+	}
+	return ok
+}
+
+// deviceOwner is the user enrolled the peer id as the device
+func (ctx *networkContext) deviceOwner(peerID disco.PeerID) (string, bool) {
+	ctx.devicesMutex.Lock()
+	defer ctx.devicesMutex.Unlock()
+	device, ok := ctx.devices[peerID.String()]
+	if !ok {
+		return "", false
+	}
+	return device.User, true
+}
+
+func (ctx *networkContext) deviceStates() []exporter.Device {
+	ctx.devicesMutex.Lock()
+	defer ctx.devicesMutex.Unlock()
+	var devices []exporter.Device
+	for _, device := range ctx.devices {
+		devices = append(devices, *device)
+	}
+	slices.SortFunc(devices, func(a, b exporter.Device) int { return a.FirstSeen.Compare(b.FirstSeen) })
+	return devices
+}
+
+// HandleQueryDevices lists the enrolled devices, filtered by the user query
+func (pm *PeerMap) HandleQueryDevices(w http.ResponseWriter, r *http.Request) {
+	if err := pm.checkAdminToken(w, r); err != nil {
+		return
+	}
+	devices := []exporter.Device{}
+	pm.networkMapMutex.RLock()
+	for _, ctx := range pm.networkMap {
+		devices = append(devices, ctx.listDevices(r.URL.Query().Get("user"))...)
+	}
+	pm.networkMapMutex.RUnlock()
+	slices.SortFunc(devices, func(a, b exporter.Device) int { return a.FirstSeen.Compare(b.FirstSeen) })
+	json.NewEncoder(w).Encode(devices)
+}
+
+// HandleRevokeDevice revokes the device and disconnects it, the device is never accepted
+// again, even with a valid network secret
+func (pm *PeerMap) HandleRevokeDevice(w http.ResponseWriter, r *http.Request) {
+	if err := pm.checkAdminToken(w, r); err != nil {
+		return
+	}
+	peerID := r.PathValue("peer")
+	var revoked bool
+	pm.networkMapMutex.RLock()
+	for _, ctx := range pm.networkMap {
+		if !ctx.revokeDevice(peerID) {
+			continue
+		}
+		revoked = true
+		if peer, ok := ctx.getPeer(disco.PeerID(peerID)); ok {
+			go peer.Close()
+		}
+	}
+	pm.networkMapMutex.RUnlock()
+	if !revoked {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	pm.events.Emit(audit.Event{
+		Type:       audit.EventDeviceRevoked,
+		Outcome:    audit.OutcomeSuccess,
+		Method:     "admin_token",
+		PeerID:     peerID,
+		RemoteAddr: r.RemoteAddr,
+	})
+	slog.Info("DeviceRevoked", "peer", peerID)
+}
@@ -0,0 +1,75 @@
+package peermap
+
+import (
+	"net/http"
+
+	"github.com/rkonfj/peerguard/peermap/audit"
+	"github.com/rkonfj/peerguard/peermap/auth"
+	"github.com/rkonfj/peerguard/tracing"
+)
+
+// outcome returns the outcome and the reason of the authentication, the failures are counted for the alerts
+func (pm *PeerMap) outcome(err error) (string, string) {
+	if err != nil {
+		pm.authFailures.Add(1)
+		return audit.OutcomeFailure, err.Error()
+	}
+	return audit.OutcomeSuccess, ""
+}
+
+// emitLogin emits the login event of the user authenticated by the method
+func (pm *PeerMap) emitLogin(r *http.Request, method, provider, user string, err error) {
+	result, reason := pm.outcome(err)
+	pm.events.Emit(audit.Event{
+		Type:       audit.EventLogin,
+		Outcome:    result,
+		Method:     method,
+		Provider:   provider,
+		User:       user,
+		RemoteAddr: r.RemoteAddr,
+		Reason:     reason,
+	})
+}
+
+// emitRefresh emits the event of renewing the network secret by the oidc refresh token
+func (pm *PeerMap) emitRefresh(r *http.Request, provider, user string, err error) {
+	result, reason := pm.outcome(err)
+	pm.events.Emit(audit.Event{
+		Type:       audit.EventRefresh,
+		Outcome:    result,
+		Method:     "oidc",
+		Provider:   provider,
+		User:       user,
+		RemoteAddr: r.RemoteAddr,
+		Reason:     reason,
+	})
+}
+
+// emitConnect emits the event of the peer joining the network
+func (pm *PeerMap) emitConnect(r *http.Request, method string, secret auth.JSONSecret, err error) {
+	if pm.cfg.PublicNetwork != "" && secret.Network == pm.cfg.PublicNetwork {
+		method = "public"
+	}
+	result, reason := pm.outcome(err)
+	span := tracing.FromContext(r.Context())
+	span.SetAttr("network", secret.Network)
+	span.SetAttr("method", method)
+	span.SetError(err)
+	pm.events.Emit(audit.Event{
+		Type:       audit.EventConnect,
+		Outcome:    result,
+		Method:     method,
+		User:       secret.User,
+		Network:    secret.Network,
+		PeerID:     r.Header.Get("X-PeerID"),
+		RemoteAddr: r.RemoteAddr,
+		Reason:     reason,
+	})
+}
+
+func connectMethod(certAuthenticated bool) string {
+	if certAuthenticated {
+		return "client_certificate"
+	}
+	return "secret"
+}
@@ -24,8 +24,12 @@ func New(secretKey string) *Authenticator {
 	}
 }
 
+// ScopeExporter restricts the token to query (GET) the peermap only, the token without scope is an admin token
+const ScopeExporter = "exporter"
+
 type Instruction struct {
-	ExpiredAt int64 `json:"expired_at"`
+	ExpiredAt int64  `json:"expired_at"`
+	Scope     string `json:"scope,omitempty"`
 }
 
 func (a *Authenticator) CheckToken(token string) (*Instruction, error) {
@@ -1,27 +1,37 @@
 package exporter
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"path"
+	"strings"
 	"time"
 
+	"github.com/rkonfj/peerguard/disco"
 	"github.com/rkonfj/peerguard/peermap/exporter/auth"
 )
 
 type peermapTransport struct {
 	authenticator *auth.Authenticator
+	token         string
 	t             http.RoundTripper
 }
 
 func (c *peermapTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	token, err := c.authenticator.GenerateToken(auth.Instruction{ExpiredAt: time.Now().Add(10 * time.Second).Unix()})
-	if err != nil {
-		return nil, err
+	token := c.token
+	if c.authenticator != nil {
+		var err error
+		token, err = c.authenticator.GenerateToken(auth.Instruction{ExpiredAt: time.Now().Add(10 * time.Second).Unix()})
+		if err != nil {
+			return nil, err
+		}
 	}
 	req.Header.Add("X-Token", token)
 	return c.t.RoundTrip(req)
@@ -32,7 +42,17 @@ type Client struct {
 	c          *http.Client
 }
 
+// NewClient creates the client signs a short-lived token for each request by the secret key of the peermap
 func NewClient(peermapURL, secretKey string) (*Client, error) {
+	return newClient(peermapURL, &peermapTransport{authenticator: auth.New(secretKey), t: http.DefaultTransport})
+}
+
+// NewTokenClient creates the client authenticated by the token generated by the secret key of the peermap
+func NewTokenClient(peermapURL, token string) (*Client, error) {
+	return newClient(peermapURL, &peermapTransport{token: token, t: http.DefaultTransport})
+}
+
+func newClient(peermapURL string, transport *peermapTransport) (*Client, error) {
 	pURL, err := url.Parse(peermapURL)
 	if err != nil {
 		return nil, fmt.Errorf("invalid peermap url: %w", err)
@@ -43,15 +63,7 @@ func NewClient(peermapURL, secretKey string) (*Client, error) {
 	case "wss":
 		pURL.Scheme = "https"
 	}
-	return &Client{
-		peermapURL: pURL,
-		c: &http.Client{
-			Transport: &peermapTransport{
-				authenticator: auth.New(secretKey),
-				t:             http.DefaultTransport,
-			},
-		},
-	}, nil
+	return &Client{peermapURL: pURL, c: &http.Client{Transport: transport}}, nil
 }
 
 func (c *Client) Networks() ([]NetworkHead, error) {
@@ -122,3 +134,371 @@ func (c *Client) PutNetworkMeta(network string, request NetworkMeta) error {
 	}
 	return nil
 }
+
+// Devices lists the devices enrolled by the user, all devices if user is empty
+func (c *Client) Devices(user string) ([]Device, error) {
+	peermap := *c.peermapURL
+	peermap.Path = path.Join(peermap.Path, "/devices")
+	peermap.RawQuery = url.Values{"user": {user}}.Encode()
+	resp, err := c.c.Get(peermap.String())
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("got unexpected status: " + resp.Status)
+	}
+	defer resp.Body.Close()
+	var devices []Device
+	json.NewDecoder(resp.Body).Decode(&devices)
+	return devices, nil
+}
+
+// History queries the per-minute statistics of the network (all networks if empty) within since
+// and until, which are RFC3339 times or the durations ago, empty for the last hour
+func (c *Client) History(network, since, until string) ([]NetworkHistory, error) {
+	peermap := *c.peermapURL
+	peermap.Path = path.Join(peermap.Path, "/history")
+	peermap.RawQuery = url.Values{"network": {network}, "since": {since}, "until": {until}}.Encode()
+	resp, err := c.c.Get(peermap.String())
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("got unexpected status: " + resp.Status)
+	}
+	defer resp.Body.Close()
+	var networks []NetworkHistory
+	json.NewDecoder(resp.Body).Decode(&networks)
+	return networks, nil
+}
+
+// Canaries returns the canaries of the pgmap and the results of pinging the peers of their networks
+func (c *Client) Canaries() ([]Canary, error) {
+	peermap := *c.peermapURL
+	peermap.Path = path.Join(peermap.Path, "/canaries")
+	resp, err := c.c.Get(peermap.String())
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("got unexpected status: " + resp.Status)
+	}
+	defer resp.Body.Close()
+	var canaries []Canary
+	json.NewDecoder(resp.Body).Decode(&canaries)
+	return canaries, nil
+}
+
+func (c *Client) Versions() (*VersionSummary, error) {
+	peermap := *c.peermapURL
+	peermap.Path = path.Join(peermap.Path, "/versions")
+	resp, err := c.c.Get(peermap.String())
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("got unexpected status: " + resp.Status)
+	}
+	defer resp.Body.Close()
+	var summary VersionSummary
+	json.NewDecoder(resp.Body).Decode(&summary)
+	return &summary, nil
+}
+
+// Events receives the events of the network (all networks if empty) until ctx is done,
+// the stream is ended by the pgmap if fn is too slow to keep up
+func (c *Client) Events(ctx context.Context, network string, fn func(Event)) error {
+	peermap := *c.peermapURL
+	peermap.Path = path.Join(peermap.Path, "/events")
+	peermap.RawQuery = url.Values{"network": {network}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, peermap.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := c.c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("got unexpected status: " + resp.Status)
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var e Event
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			return fmt.Errorf("decode event: %w", err)
+		}
+		fn(e)
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errors.New("the event stream is ended by the pgmap")
+}
+
+// RevokeDevice revokes and disconnects the device
+func (c *Client) RevokeDevice(peerID string) error {
+	peermap := *c.peermapURL
+	peermap.Path = path.Join(peermap.Path, "/devices", url.PathEscape(peerID))
+	r, err := http.NewRequest(http.MethodDelete, peermap.String(), nil)
+	if err != nil {
+		return fmt.Errorf("build request: %w", err)
+	}
+	resp, err := c.c.Do(r)
+	if err != nil {
+		return fmt.Errorf("request: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("got unexpected status: " + resp.Status)
+	}
+	return nil
+}
+
+// Revoke revokes all secrets issued to the user or used by the peer so far
+func (c *Client) Revoke(user, peerID string) error {
+	peermap := *c.peermapURL
+	peermap.Path = path.Join(peermap.Path, "/revoke")
+	b, err := json.Marshal(map[string]string{"user": user, "peerID": peerID})
+	if err != nil {
+		return fmt.Errorf("marshal request: %w", err)
+	}
+	resp, err := c.c.Post(peermap.String(), "application/json", bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("request: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("got unexpected status: " + resp.Status)
+	}
+	return nil
+}
+
+// GrantWebAuthnEnrollment allows the user to register a new security key on the next login within 24h
+func (c *Client) GrantWebAuthnEnrollment(user string) error {
+	peermap := *c.peermapURL
+	peermap.Path = path.Join(peermap.Path, "/webauthn", url.PathEscape(user), "enrollment")
+	resp, err := c.c.Post(peermap.String(), "application/json", nil)
+	if err != nil {
+		return fmt.Errorf("request: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("got unexpected status: " + resp.Status)
+	}
+	return nil
+}
+
+// ResetWebAuthn removes all security keys registered by the user
+func (c *Client) ResetWebAuthn(user string) error {
+	peermap := *c.peermapURL
+	peermap.Path = path.Join(peermap.Path, "/webauthn", url.PathEscape(user))
+	r, err := http.NewRequest(http.MethodDelete, peermap.String(), nil)
+	if err != nil {
+		return fmt.Errorf("build request: %w", err)
+	}
+	resp, err := c.c.Do(r)
+	if err != nil {
+		return fmt.Errorf("request: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("got unexpected status: " + resp.Status)
+	}
+	return nil
+}
+
+// Kick disconnects the peer, it is free to connect again
+func (c *Client) Kick(peerID string) error {
+	peermap := *c.peermapURL
+	peermap.Path = path.Join(peermap.Path, "/peers", url.PathEscape(peerID))
+	r, err := http.NewRequest(http.MethodDelete, peermap.String(), nil)
+	if err != nil {
+		return fmt.Errorf("build request: %w", err)
+	}
+	resp, err := c.c.Do(r)
+	if err != nil {
+		return fmt.Errorf("request: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("got unexpected status: " + resp.Status)
+	}
+	return nil
+}
+
+func (c *Client) Bans() ([]Ban, error) {
+	peermap := *c.peermapURL
+	peermap.Path = path.Join(peermap.Path, "/bans")
+	resp, err := c.c.Get(peermap.String())
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("got unexpected status: " + resp.Status)
+	}
+	defer resp.Body.Close()
+	var bans []Ban
+	json.NewDecoder(resp.Body).Decode(&bans)
+	return bans, nil
+}
+
+// Ban refuses and disconnects the peers matched the peer id, ip or cidr
+func (c *Client) Ban(ban Ban) error {
+	peermap := *c.peermapURL
+	peermap.Path = path.Join(peermap.Path, "/bans")
+	b, err := json.Marshal(ban)
+	if err != nil {
+		return fmt.Errorf("marshal request: %w", err)
+	}
+	resp, err := c.c.Post(peermap.String(), "application/json", bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("request: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("got unexpected status: " + resp.Status)
+	}
+	return nil
+}
+
+func (c *Client) Unban(target string) error {
+	peermap := *c.peermapURL
+	peermap.Path = path.Join(peermap.Path, "/bans")
+	peermap.RawQuery = url.Values{"target": {target}}.Encode()
+	r, err := http.NewRequest(http.MethodDelete, peermap.String(), nil)
+	if err != nil {
+		return fmt.Errorf("build request: %w", err)
+	}
+	resp, err := c.c.Do(r)
+	if err != nil {
+		return fmt.Errorf("request: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("got unexpected status: " + resp.Status)
+	}
+	return nil
+}
+
+func (c *Client) NetworkQuota(network string) (*NetworkQuota, error) {
+	peermap := *c.peermapURL
+	peermap.Path = path.Join(peermap.Path, fmt.Sprintf("/networks/%s/quota", network))
+	resp, err := c.c.Get(peermap.String())
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("got unexpected status: " + resp.Status)
+	}
+	defer resp.Body.Close()
+	var quota NetworkQuota
+	json.NewDecoder(resp.Body).Decode(&quota)
+	return &quota, nil
+}
+
+func (c *Client) PutNetworkQuota(network string, quota NetworkQuota) error {
+	peermap := *c.peermapURL
+	peermap.Path = path.Join(peermap.Path, fmt.Sprintf("/networks/%s/quota", network))
+	b, err := json.Marshal(quota)
+	if err != nil {
+		return fmt.Errorf("marshal request: %w", err)
+	}
+	r, err := http.NewRequest(http.MethodPut, peermap.String(), bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("build request: %w", err)
+	}
+	resp, err := c.c.Do(r)
+	if err != nil {
+		return fmt.Errorf("request: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("got unexpected status: " + resp.Status)
+	}
+	return nil
+}
+
+// DeleteNetwork disconnects the peers of the network and forgets its state
+func (c *Client) DeleteNetwork(network string) error {
+	peermap := *c.peermapURL
+	peermap.Path = path.Join(peermap.Path, "/networks", url.PathEscape(network))
+	r, err := http.NewRequest(http.MethodDelete, peermap.String(), nil)
+	if err != nil {
+		return fmt.Errorf("build request: %w", err)
+	}
+	resp, err := c.c.Do(r)
+	if err != nil {
+		return fmt.Errorf("request: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("got unexpected status: " + resp.Status)
+	}
+	return nil
+}
+
+// RotateNetworkSecrets rotates the secrets of the peers connected to the network, the number of
+// the peers rotated is returned. If revoke is true the secrets issued before are revoked at once
+// rather than accepted within the grace period
+func (c *Client) RotateNetworkSecrets(network string, revoke bool) (int, error) {
+	peermap := *c.peermapURL
+	peermap.Path = path.Join(peermap.Path, "/networks", url.PathEscape(network), "rotate")
+	if revoke {
+		peermap.RawQuery = "revoke=true"
+	}
+	resp, err := c.c.Post(peermap.String(), "application/json", nil)
+	if err != nil {
+		return 0, fmt.Errorf("request: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, errors.New("got unexpected status: " + resp.Status)
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Rotated int `json:"rotated"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	return result.Rotated, nil
+}
+
+// NetworkACL is the acl of the network, the acl without rules allows all
+func (c *Client) NetworkACL(network string) (*disco.ACL, error) {
+	peermap := *c.peermapURL
+	peermap.Path = path.Join(peermap.Path, "/networks", url.PathEscape(network), "acl")
+	resp, err := c.c.Get(peermap.String())
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("got unexpected status: " + resp.Status)
+	}
+	defer resp.Body.Close()
+	var acl disco.ACL
+	json.NewDecoder(resp.Body).Decode(&acl)
+	return &acl, nil
+}
+
+// PutNetworkACL replaces the acl of the network, it is sent to the peers connected
+func (c *Client) PutNetworkACL(network string, acl disco.ACL) error {
+	peermap := *c.peermapURL
+	peermap.Path = path.Join(peermap.Path, "/networks", url.PathEscape(network), "acl")
+	b, err := json.Marshal(acl)
+	if err != nil {
+		return fmt.Errorf("marshal request: %w", err)
+	}
+	r, err := http.NewRequest(http.MethodPut, peermap.String(), bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("build request: %w", err)
+	}
+	resp, err := c.c.Do(r)
+	if err != nil {
+		return fmt.Errorf("request: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return fmt.Errorf("got unexpected status: %s %s", resp.Status, msg)
+	}
+	return nil
+}
@@ -1,19 +1,197 @@
 package exporter
 
+import (
+	"time"
+
+	"github.com/rkonfj/peerguard/disco"
+)
+
 type NetworkHead struct {
 	ID         string `json:"n"`
 	Alias      string `json:"n1"`
 	PeersCount int    `json:"c"`
 	CreateTime string `json:"t"`
+	// Quality aggregates the links reported by the peers, nil if none is reported
+	Quality *Quality `json:"q,omitempty"`
+	// Messages is the number of the messages received from the peers by the control code
+	// (RELAY, LEAD_DISCO, NEW_PEER_UDP_ADDR, CONTROL_CONN...) since the network is created
+	Messages map[string]uint64 `json:"m,omitempty"`
+	// RTT is the percentiles of the round trip time of the peers to the pgmap, nil if none is measured
+	RTT *RTTPercentiles `json:"r,omitempty"`
+}
+
+// RTTPercentiles is the distribution of the round trip time of the peers to the pgmap,
+// measured by the websocket ping/pong
+type RTTPercentiles struct {
+	Peers int           `json:"peers"`
+	P50   time.Duration `json:"p50"`
+	P90   time.Duration `json:"p90"`
+	P99   time.Duration `json:"p99"`
+	Max   time.Duration `json:"max"`
 }
 
 type Network struct {
 	ID    string   `json:"n"`
 	Alias string   `json:"n1"`
 	Peers []string `json:"p"`
+	// Stats is the accounting of the peers, absent if the pgmap is older than the field
+	Stats []PeerStat `json:"s,omitempty"`
+}
+
+// PeerStat is the accounting of the peer connected to the network. The relayed messages are
+// the ones forwarded to the other peers by the pgmap, the datagrams and the disco messages
+type PeerStat struct {
+	ID              string    `json:"id"`
+	IP              string    `json:"ip,omitempty"`
+	Name            string    `json:"name,omitempty"`
+	Version         string    `json:"version,omitempty"`
+	Capabilities    []string  `json:"capabilities,omitempty"`
+	NAT             string    `json:"nat,omitempty"`
+	RemoteAddr      string    `json:"remoteAddr"`
+	ConnectTime     time.Time `json:"connectTime"`
+	RelayRxBytes    uint64    `json:"relayRxBytes"`
+	RelayRxMessages uint64    `json:"relayRxMessages"`
+	RelayTxBytes    uint64    `json:"relayTxBytes"`
+	RelayTxMessages uint64    `json:"relayTxMessages"`
+	StreamRxBytes   uint64    `json:"streamRxBytes"`
+	StreamTxBytes   uint64    `json:"streamTxBytes"`
+	// RTT is the smoothed round trip time of the peer to the pgmap, 0 if not measured yet
+	RTT time.Duration `json:"rtt,omitempty"`
+	// WriteQueue is the writes to the peer waiting for the previous one, WriteWait and WriteTime are
+	// the total time the Writes waited for the previous ones and wrote, WriteMax is the longest one
+	WriteQueue int64         `json:"writeQueue"`
+	Writes     uint64        `json:"writes"`
+	WriteWait  time.Duration `json:"writeWait"`
+	WriteTime  time.Duration `json:"writeTime"`
+	WriteMax   time.Duration `json:"writeMax"`
+	// RatelimitWait is the total time the messages from the peer waited for the rate limiters
+	RatelimitWait time.Duration `json:"ratelimitWait"`
+	// Quality aggregates the Links, nil if the peer reports nothing
+	Quality *Quality      `json:"quality,omitempty"`
+	Links   []LinkQuality `json:"links,omitempty"`
+}
+
+// LinkQuality is the connection quality to the remote peer measured and reported by the peer
+type LinkQuality struct {
+	Peer string `json:"peer"`
+	// Score is 0 (unusable) to 100 (direct, low latency and no loss)
+	Score   int           `json:"score"`
+	Relayed bool          `json:"relayed"`
+	RTT     time.Duration `json:"rtt"`
+	Loss    float64       `json:"loss"`
+	// Flaps is the number of the fallbacks from the direct path to the relay recently
+	Flaps int `json:"flaps"`
+}
+
+// Quality is the health of the links, the simple indicator for the UIs
+type Quality struct {
+	// Score is the average score of the links
+	Score   int `json:"score"`
+	Links   int `json:"links"`
+	Relayed int `json:"relayed"`
+}
+
+// NetworkHistory is the per-minute statistics of the network
+type NetworkHistory struct {
+	Network string       `json:"network"`
+	Samples []StatSample `json:"samples"`
+}
+
+// StatSample is the statistics of the network in the minute ended at the time
+type StatSample struct {
+	Time time.Time `json:"time"`
+	// Peers is the number of the peers connected at the time
+	Peers int `json:"peers"`
+	// RelayBytes and RelayMessages are relayed by the pgmap within the minute
+	RelayBytes    uint64 `json:"relayBytes"`
+	RelayMessages uint64 `json:"relayMessages"`
+}
+
+// VersionSummary is the distribution of the client versions and capabilities of the peers connected,
+// the peers lacking a capability block the protocol upgrades depending on it
+type VersionSummary struct {
+	Peers int `json:"peers"`
+	// Versions is the number of the peers by the client version
+	Versions map[string]int `json:"versions"`
+	// Capabilities is the number of the peers supporting the capability
+	Capabilities map[string]int `json:"capabilities"`
+}
+
+// Canary is the internal peer run by the pgmap in the network for the synthetic monitoring,
+// it answers the pings of the external probes and pings the peers of the network back
+type Canary struct {
+	Network   string        `json:"network"`
+	Name      string        `json:"name"`
+	ID        string        `json:"id"`
+	Connected bool          `json:"connected"`
+	Probes    []CanaryProbe `json:"probes"`
+}
+
+// CanaryProbe is the results of pinging the peer by the canary since the peer is found
+type CanaryProbe struct {
+	Peer     string `json:"peer"`
+	Sent     uint64 `json:"sent"`
+	Received uint64 `json:"received"`
+	// Direct is the replies received without the relay of the pgmap in both directions
+	Direct uint64 `json:"direct"`
+	// RTT and Relayed are of the last reply
+	RTT       time.Duration `json:"rtt"`
+	Relayed   bool          `json:"relayed"`
+	LastReply time.Time     `json:"lastReply,omitzero"`
+}
+
+const (
+	EventPeerJoined          = "peer_joined"
+	EventPeerLeft            = "peer_left"
+	EventNetworkCreated      = "network_created"
+	EventNetworkMetaChanged  = "network_meta_changed"
+	EventNetworkQuotaChanged = "network_quota_changed"
+	EventNetworkDeleted      = "network_deleted"
+	EventNetworkACLChanged   = "network_acl_changed"
+)
+
+// Event is the change of the networks streamed by /events
+type Event struct {
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Network string    `json:"network"`
+	// Peer is the peer joined or left, the counters of the left one are the final ones
+	Peer  *PeerStat     `json:"peer,omitempty"`
+	Meta  *NetworkMeta  `json:"meta,omitempty"`
+	Quota *NetworkQuota `json:"quota,omitempty"`
+	ACL   *disco.ACL    `json:"acl,omitempty"`
 }
 
 type NetworkMeta struct {
 	Alias     string   `json:"alias"`
 	Neighbors []string `json:"neighbors"`
 }
+
+// Device is the peer enrolled by the user (oidc identity or ldap dn)
+type Device struct {
+	PeerID    string    `json:"peerID"`
+	User      string    `json:"user"`
+	Network   string    `json:"network"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Revoked   bool      `json:"revoked,omitempty"`
+	Online    bool      `json:"online,omitempty"`
+}
+
+// Ban refuses the peers matched the target (peer id, ip or cidr) until expire, zero is forever
+type Ban struct {
+	Target string    `json:"target"`
+	Expire time.Time `json:"expire,omitzero"`
+}
+
+// NetworkQuota limits the network, zero is unlimited
+type NetworkQuota struct {
+	MaxPeers int `json:"maxPeers"`
+	// RelayLimit is the bytes per second relayed by the peermap for all peers in the network
+	RelayLimit int `json:"relayLimit"`
+	RelayBurst int `json:"relayBurst"`
+	// DiscoLimit is the bytes per second of the discovery messages of all peers in the network,
+	// 0 is the default 10KiB/s
+	DiscoLimit int `json:"discoLimit,omitempty"`
+	DiscoBurst int `json:"discoBurst,omitempty"`
+}
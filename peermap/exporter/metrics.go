@@ -0,0 +1,34 @@
+package exporter
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// MetricsWriter writes the prometheus text exposition format
+type MetricsWriter struct {
+	bytes.Buffer
+}
+
+func (w *MetricsWriter) Family(name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// Sample writes the sample, labels are the name value pairs
+func (w *MetricsWriter) Sample(name string, labels []string, value float64) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteString("{")
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.WriteString(",")
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		w.WriteString("}")
+	}
+	fmt.Fprintf(w, " %g\n", value)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
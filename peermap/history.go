@@ -0,0 +1,202 @@
+package peermap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rkonfj/peerguard/crash"
+	"github.com/rkonfj/peerguard/peermap/alert"
+	"github.com/rkonfj/peerguard/peermap/exporter"
+)
+
+// history keeps the statistics of the networks sampled every minute within the retention,
+// persisted to the file if it is set so that the spikes can be investigated after restarts
+type history struct {
+	mutex     sync.RWMutex
+	retention time.Duration
+	file      string
+	keys      [][]byte
+	plaintext bool
+
+	Networks map[string][]exporter.StatSample `json:"networks"`
+
+	// relayed is the relay counters of the networks at the last sample
+	relayed map[string][2]uint64
+}
+
+func newHistory(retention time.Duration, file string, keys [][]byte, plaintext bool) *history {
+	return &history{
+		retention: retention,
+		file:      file,
+		keys:      keys,
+		plaintext: plaintext,
+		Networks:  make(map[string][]exporter.StatSample),
+		relayed:   make(map[string][2]uint64),
+	}
+}
+
+func (h *history) load() error {
+	if h.file == "" {
+		return nil
+	}
+	b, err := readStateFile(h.file, h.keys)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("load: read history file: %w", err)
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if err := json.Unmarshal(b, h); err != nil {
+		return fmt.Errorf("load: decode history: %w", err)
+	}
+	if h.Networks == nil {
+		h.Networks = make(map[string][]exporter.StatSample)
+	}
+	h.prune(time.Now())
+	return nil
+}
+
+func (h *history) save() error {
+	if h.file == "" {
+		return nil
+	}
+	h.mutex.RLock()
+	b, err := json.Marshal(h)
+	h.mutex.RUnlock()
+	if err != nil {
+		return fmt.Errorf("save: encode history: %w", err)
+	}
+	if err := writeStateFile(h.file, b, h.keys, h.plaintext); err != nil {
+		return fmt.Errorf("save history: %w", err)
+	}
+	return nil
+}
+
+// prune drops the samples older than the retention, the caller must hold the lock
+func (h *history) prune(now time.Time) {
+	deadline := now.Add(-h.retention)
+	for network, samples := range h.Networks {
+		i, _ := slices.BinarySearchFunc(samples, deadline, func(s exporter.StatSample, t time.Time) int {
+			return s.Time.Compare(t)
+		})
+		if i == len(samples) {
+			delete(h.Networks, network)
+			continue
+		}
+		h.Networks[network] = slices.Clone(samples[i:])
+	}
+}
+
+// record appends the sample of the network, relayBytes and relayMessages are the counters
+// of the network since it is created, the sample is the increments since the last one
+func (h *history) record(now time.Time, network string, peers int, relayBytes, relayMessages uint64) exporter.StatSample {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	last, ok := h.relayed[network]
+	h.relayed[network] = [2]uint64{relayBytes, relayMessages}
+	if !ok || relayBytes < last[0] || relayMessages < last[1] { // the first sample or the network is recreated
+		last = [2]uint64{}
+	}
+	sample := exporter.StatSample{
+		Time:          now,
+		Peers:         peers,
+		RelayBytes:    relayBytes - last[0],
+		RelayMessages: relayMessages - last[1],
+	}
+	h.Networks[network] = append(h.Networks[network], sample)
+	return sample
+}
+
+// query returns the samples of the network (all networks if empty) within [since, until]
+func (h *history) query(network string, since, until time.Time) []exporter.NetworkHistory {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	var networks []exporter.NetworkHistory
+	for id, samples := range h.Networks {
+		if network != "" && id != network {
+			continue
+		}
+		var filtered []exporter.StatSample
+		for _, s := range samples {
+			if !s.Time.Before(since) && !s.Time.After(until) {
+				filtered = append(filtered, s)
+			}
+		}
+		if len(filtered) > 0 {
+			networks = append(networks, exporter.NetworkHistory{Network: id, Samples: filtered})
+		}
+	}
+	slices.SortFunc(networks, func(a, b exporter.NetworkHistory) int { return strings.Compare(a.Network, b.Network) })
+	return networks
+}
+
+// runHistory samples the networks at the start of every minute, the alert rules are evaluated
+// against the samples
+func (pm *PeerMap) runHistory(ctx context.Context) {
+	defer crash.Recover("peermap/history")
+	for {
+		now := time.Now()
+		next := now.Truncate(time.Minute).Add(time.Minute)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(next.Sub(now)):
+		}
+		samples := []alert.Sample{{Metric: alert.MetricAuthFailures, Value: float64(pm.authFailures.Swap(0))}}
+		pm.networkMapMutex.RLock()
+		for id, network := range pm.networkMap {
+			sample := pm.history.record(next, id, network.peerCount(), network.relayBytes.Load(), network.relayMessages.Load())
+			samples = append(samples,
+				alert.Sample{Metric: alert.MetricRelayBandwidth, Network: id, Value: float64(sample.RelayBytes) / 60},
+				alert.Sample{Metric: alert.MetricPeerChurn, Network: id, Value: float64(network.churn.Swap(0))})
+		}
+		pm.networkMapMutex.RUnlock()
+		pm.alerts.Evaluate(next, samples)
+		pm.history.mutex.Lock()
+		pm.history.prune(next)
+		pm.history.mutex.Unlock()
+	}
+}
+
+// HandleQueryHistory returns the per-minute statistics of the networks, the query network
+// filters the network, since and until are RFC3339 times or the durations ago (default the last hour)
+func (pm *PeerMap) HandleQueryHistory(w http.ResponseWriter, r *http.Request) {
+	if err := pm.checkAdminToken(w, r); err != nil {
+		return
+	}
+	now := time.Now()
+	since, err := parseHistoryTime(r.URL.Query().Get("since"), now, now.Add(-time.Hour))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	until, err := parseHistoryTime(r.URL.Query().Get("until"), now, now)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	networks := pm.history.query(r.URL.Query().Get("network"), since, until)
+	if networks == nil {
+		networks = []exporter.NetworkHistory{}
+	}
+	json.NewEncoder(w).Encode(networks)
+}
+
+func parseHistoryTime(s string, now, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
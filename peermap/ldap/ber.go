@@ -0,0 +1,125 @@
+package ldap
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+// the subset of BER used by the LDAP messages
+
+const (
+	tagBoolean     byte = 0x01
+	tagInteger     byte = 0x02
+	tagOctetString byte = 0x04
+	tagEnumerated  byte = 0x0a
+	tagSequence    byte = 0x30
+	tagSet         byte = 0x31
+)
+
+var errMalformed = errors.New("ldap: malformed ber data")
+
+func berTLV(tag byte, contents ...[]byte) []byte {
+	var n int
+	for _, c := range contents {
+		n += len(c)
+	}
+	b := []byte{tag}
+	switch {
+	case n < 0x80:
+		b = append(b, byte(n))
+	case n <= 0xff:
+		b = append(b, 0x81, byte(n))
+	case n <= 0xffff:
+		b = append(b, 0x82, byte(n>>8), byte(n))
+	default:
+		b = append(b, 0x84, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	for _, c := range contents {
+		b = append(b, c...)
+	}
+	return b
+}
+
+func berInt(tag byte, v int) []byte {
+	b := []byte{byte(v)}
+	for v >>= 8; v > 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	if b[0]&0x80 != 0 { // keep it positive
+		b = append([]byte{0}, b...)
+	}
+	return berTLV(tag, b)
+}
+
+func berString(tag byte, s string) []byte {
+	return berTLV(tag, []byte(s))
+}
+
+func berBool(v bool) []byte {
+	if v {
+		return berTLV(tagBoolean, []byte{0xff})
+	}
+	return berTLV(tagBoolean, []byte{0})
+}
+
+// parseTLV parses the first element of b
+func parseTLV(b []byte) (tag byte, content, rest []byte, err error) {
+	if len(b) < 2 {
+		return 0, nil, nil, errMalformed
+	}
+	tag = b[0]
+	n, hdr := int(b[1]), 2
+	if n&0x80 != 0 {
+		octets := n & 0x7f
+		if octets == 0 || octets > 4 || len(b) < 2+octets {
+			return 0, nil, nil, errMalformed
+		}
+		n = 0
+		for _, o := range b[2 : 2+octets] {
+			n = n<<8 | int(o)
+		}
+		hdr += octets
+	}
+	if n < 0 || len(b) < hdr+n {
+		return 0, nil, nil, errMalformed
+	}
+	return tag, b[hdr : hdr+n], b[hdr+n:], nil
+}
+
+func parseInt(b []byte) int {
+	var v int
+	for _, o := range b {
+		v = v<<8 | int(o)
+	}
+	return v
+}
+
+// readMessage reads a whole LDAPMessage from r
+func readMessage(r *bufio.Reader) ([]byte, error) {
+	hdr := make([]byte, 2, 6)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	n := int(hdr[1])
+	if n&0x80 != 0 {
+		octets := n & 0x7f
+		if octets == 0 || octets > 4 {
+			return nil, errMalformed
+		}
+		lb := make([]byte, octets)
+		if _, err := io.ReadFull(r, lb); err != nil {
+			return nil, err
+		}
+		hdr = append(hdr, lb...)
+		n = parseInt(lb)
+	}
+	if n > 16<<20 {
+		return nil, errMalformed
+	}
+	content := make([]byte, n)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return nil, err
+	}
+	return append(hdr, content...), nil
+}
@@ -0,0 +1,396 @@
+package ldap
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	appBindRequest      byte = 0x60
+	appBindResponse     byte = 0x61
+	appUnbindRequest    byte = 0x42
+	appSearchRequest    byte = 0x63
+	appSearchResultItem byte = 0x64
+	appSearchResultDone byte = 0x65
+	appSearchResultRef  byte = 0x73
+	appExtendedRequest  byte = 0x77
+	appExtendedResponse byte = 0x78
+
+	ctxSimpleAuth  byte = 0x80
+	ctxPresent     byte = 0x87
+	ctxRequestName byte = 0x80
+	oidStartTLS         = "1.3.6.1.4.1.1466.20037"
+
+	resultSuccess            = 0
+	resultInvalidCredentials = 49
+)
+
+var ErrInvalidCredentials = errors.New("ldap: invalid credentials")
+
+// GroupNetwork maps the members of the ldap group to the network
+type GroupNetwork struct {
+	// Group is the group dn, or the group cn matched against the cn of the dn
+	Group   string `yaml:"group"`
+	Network string `yaml:"network"`
+	// Scopes restrict the network secrets issued to the members
+	Scopes []string `yaml:"scopes"`
+}
+
+type LDAPConfig struct {
+	// URL is the ldap server, ldap://host:389 or ldaps://host:636
+	URL                string `yaml:"url"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	// StartTLS upgrades the ldap:// connection to tls before binding
+	StartTLS bool `yaml:"start_tls"`
+	// InsecurePlaintext allows binding over ldap:// without StartTLS, the passwords are sent in cleartext
+	InsecurePlaintext bool `yaml:"insecure_plaintext"`
+	// BindDN is the dn template the username is bound as, e.g. uid=%s,ou=people,dc=example,dc=org
+	// or %s@corp.example.org for active directory. The username is bound as is if it is a dn already
+	BindDN string `yaml:"bind_dn"`
+	// UserDN is the dn template the groups of the user are searched with, the bind dn is used if empty.
+	// It is required for active directory, e.g. cn=%s,cn=users,dc=corp,dc=example,dc=org
+	UserDN string `yaml:"user_dn"`
+	// GroupAttribute is the attribute of the user entry lists the groups, memberOf by default
+	GroupAttribute string `yaml:"group_attribute"`
+	// Groups maps the groups to the networks, the first matched group wins
+	Groups []GroupNetwork `yaml:"groups"`
+	// DefaultNetwork is used if no group matched, the user is rejected if it is empty
+	DefaultNetwork string        `yaml:"default_network"`
+	Timeout        time.Duration `yaml:"timeout"`
+}
+
+// UserInfo is the authenticated ldap user
+type UserInfo struct {
+	DN      string
+	Groups  []string
+	Network string
+	Scopes  []string
+}
+
+// Check refuses the ldap:// url unless StartTLS is enabled or the plaintext is allowed explicitly
+func (cfg *LDAPConfig) Check() error {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return fmt.Errorf("ldap: %w", err)
+	}
+	switch u.Scheme {
+	case "ldap":
+		if !cfg.StartTLS && !cfg.InsecurePlaintext {
+			return errors.New("ldap: ldap:// sends the passwords in cleartext, use ldaps://, start_tls or insecure_plaintext")
+		}
+	case "ldaps":
+		if cfg.StartTLS {
+			return errors.New("ldap: start_tls is for ldap:// only")
+		}
+	default:
+		return fmt.Errorf("ldap: unsupported scheme %s", u.Scheme)
+	}
+	return nil
+}
+
+// Authenticate binds the username and password to the ldap server, then maps the groups of the user to the network
+func (cfg *LDAPConfig) Authenticate(ctx context.Context, username, password string) (UserInfo, error) {
+	if username == "" || password == "" { // an empty password is an unauthenticated bind in ldap
+		return UserInfo{}, ErrInvalidCredentials
+	}
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	c, err := cfg.dial(ctx)
+	if err != nil {
+		return UserInfo{}, err
+	}
+	defer c.close()
+
+	info := UserInfo{DN: expandDN(cfg.BindDN, username)}
+	if err := c.bind(info.DN, password); err != nil {
+		return UserInfo{}, err
+	}
+	userDN := info.DN
+	if cfg.UserDN != "" {
+		userDN = expandDN(cfg.UserDN, username)
+	}
+	groupAttr := cfg.GroupAttribute
+	if groupAttr == "" {
+		groupAttr = "memberOf"
+	}
+	if info.Groups, err = c.searchAttribute(userDN, groupAttr); err != nil {
+		return UserInfo{}, err
+	}
+	mapping := cfg.mapping(info.Groups)
+	info.Network, info.Scopes = mapping.Network, mapping.Scopes
+	if info.Network == "" {
+		return UserInfo{}, fmt.Errorf("ldap: user %s is not in any mapped group", username)
+	}
+	return info, nil
+}
+
+func (cfg *LDAPConfig) mapping(groups []string) GroupNetwork {
+	for _, mapping := range cfg.Groups {
+		for _, group := range groups {
+			if strings.EqualFold(mapping.Group, group) {
+				return mapping
+			}
+			if !strings.Contains(mapping.Group, "=") && strings.EqualFold("cn="+mapping.Group, strings.TrimSpace(strings.Split(group, ",")[0])) {
+				return mapping
+			}
+		}
+	}
+	return GroupNetwork{Network: cfg.DefaultNetwork}
+}
+
+func (cfg *LDAPConfig) dial(ctx context.Context) (*conn, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	tlsConfig := &tls.Config{
+		ServerName:         u.Hostname(),
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	var dialer interface {
+		DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+	} = &net.Dialer{}
+	switch u.Scheme {
+	case "ldap":
+		if !cfg.StartTLS && !cfg.InsecurePlaintext {
+			return nil, errors.New("ldap: refused to send the password in cleartext")
+		}
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "389")
+		}
+	case "ldaps":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "636")
+		}
+		dialer = &tls.Dialer{Config: tlsConfig}
+	default:
+		return nil, fmt.Errorf("ldap: unsupported scheme %s", u.Scheme)
+	}
+	nc, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		nc.SetDeadline(deadline)
+	}
+	c := &conn{Conn: nc, r: bufio.NewReader(nc)}
+	if u.Scheme == "ldap" && cfg.StartTLS {
+		if err := c.startTLS(ctx, tlsConfig); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func expandDN(template, username string) string {
+	if template == "" || strings.Contains(username, "=") {
+		return username
+	}
+	return fmt.Sprintf(template, escapeDN(username))
+}
+
+// escapeDN escapes the special characters of the rdn value (RFC 4514)
+func escapeDN(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		switch {
+		case strings.ContainsRune(`,+"\<>;=`, r),
+			i == 0 && (r == ' ' || r == '#'),
+			i == len(s)-1 && r == ' ':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// conn is the minimal ldap v3 client supports the StartTLS, the simple bind and the base object search
+type conn struct {
+	net.Conn
+	r         *bufio.Reader
+	messageID int
+}
+
+func (c *conn) send(op []byte) (int, error) {
+	c.messageID++
+	_, err := c.Write(berTLV(tagSequence, berInt(tagInteger, c.messageID), op))
+	return c.messageID, err
+}
+
+// receive reads the next protocol op of the message id
+func (c *conn) receive(id int) (tag byte, op []byte, err error) {
+	for {
+		b, err := readMessage(c.r)
+		if err != nil {
+			return 0, nil, err
+		}
+		_, msg, _, err := parseTLV(b)
+		if err != nil {
+			return 0, nil, err
+		}
+		_, msgID, rest, err := parseTLV(msg)
+		if err != nil {
+			return 0, nil, err
+		}
+		if parseInt(msgID) != id { // unsolicited notification
+			continue
+		}
+		tag, op, _, err = parseTLV(rest)
+		return tag, op, err
+	}
+}
+
+func parseResult(op []byte) error {
+	_, code, rest, err := parseTLV(op)
+	if err != nil {
+		return err
+	}
+	resultCode := parseInt(code)
+	if resultCode == resultSuccess {
+		return nil
+	}
+	if resultCode == resultInvalidCredentials {
+		return ErrInvalidCredentials
+	}
+	var diagnostic []byte
+	if _, _, rest, err = parseTLV(rest); err == nil { // matchedDN
+		_, diagnostic, _, _ = parseTLV(rest)
+	}
+	return fmt.Errorf("ldap: result code %d: %s", resultCode, diagnostic)
+}
+
+// startTLS upgrades the connection to tls (RFC 4511 4.14), nothing is sent in cleartext but the request
+func (c *conn) startTLS(ctx context.Context, config *tls.Config) error {
+	id, err := c.send(berTLV(appExtendedRequest, berString(ctxRequestName, oidStartTLS)))
+	if err != nil {
+		return err
+	}
+	tag, op, err := c.receive(id)
+	if err != nil {
+		return err
+	}
+	if tag != appExtendedResponse {
+		return errMalformed
+	}
+	if err := parseResult(op); err != nil {
+		return fmt.Errorf("ldap: start tls: %w", err)
+	}
+	if c.r.Buffered() > 0 { // the server must not send anything before the handshake
+		return errMalformed
+	}
+	tlsConn := tls.Client(c.Conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return fmt.Errorf("ldap: start tls: %w", err)
+	}
+	c.Conn, c.r = tlsConn, bufio.NewReader(tlsConn)
+	return nil
+}
+
+func (c *conn) bind(dn, password string) error {
+	id, err := c.send(berTLV(appBindRequest,
+		berInt(tagInteger, 3),
+		berString(tagOctetString, dn),
+		berString(ctxSimpleAuth, password)))
+	if err != nil {
+		return err
+	}
+	tag, op, err := c.receive(id)
+	if err != nil {
+		return err
+	}
+	if tag != appBindResponse {
+		return errMalformed
+	}
+	return parseResult(op)
+}
+
+// searchAttribute reads the values of the attribute of the entry dn
+func (c *conn) searchAttribute(dn, attribute string) ([]string, error) {
+	id, err := c.send(berTLV(appSearchRequest,
+		berString(tagOctetString, dn),
+		berInt(tagEnumerated, 0), // baseObject
+		berInt(tagEnumerated, 0), // neverDerefAliases
+		berInt(tagInteger, 0),
+		berInt(tagInteger, 0),
+		berBool(false),
+		berString(ctxPresent, "objectClass"),
+		berTLV(tagSequence, berString(tagOctetString, attribute))))
+	if err != nil {
+		return nil, err
+	}
+	var values []string
+	for {
+		tag, op, err := c.receive(id)
+		if err != nil {
+			return nil, err
+		}
+		switch tag {
+		case appSearchResultItem:
+			vals, err := parseAttribute(op, attribute)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, vals...)
+		case appSearchResultRef:
+		case appSearchResultDone:
+			return values, parseResult(op)
+		default:
+			return nil, errMalformed
+		}
+	}
+}
+
+func parseAttribute(entry []byte, attribute string) ([]string, error) {
+	_, _, rest, err := parseTLV(entry) // objectName
+	if err != nil {
+		return nil, err
+	}
+	_, attrs, _, err := parseTLV(rest)
+	if err != nil {
+		return nil, err
+	}
+	var values []string
+	for len(attrs) > 0 {
+		var attr []byte
+		if _, attr, attrs, err = parseTLV(attrs); err != nil {
+			return nil, err
+		}
+		_, typ, rest, err := parseTLV(attr)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.EqualFold(string(typ), attribute) {
+			continue
+		}
+		_, vals, _, err := parseTLV(rest)
+		if err != nil {
+			return nil, err
+		}
+		for len(vals) > 0 {
+			var val []byte
+			if _, val, vals, err = parseTLV(vals); err != nil {
+				return nil, err
+			}
+			values = append(values, string(val))
+		}
+	}
+	return values, nil
+}
+
+func (c *conn) close() error {
+	c.send(berTLV(appUnbindRequest))
+	return c.Close()
+}
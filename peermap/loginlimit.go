@@ -0,0 +1,66 @@
+package peermap
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rkonfj/peerguard/lru"
+	"golang.org/x/time/rate"
+)
+
+const (
+	loginUserLimit = rate.Limit(1.0 / 12) // 5 attempts per minute
+	loginUserBurst = 5
+	loginAddrLimit = rate.Limit(1.0 / 3) // 20 attempts per minute
+	loginAddrBurst = 20
+)
+
+var errLoginRateLimited = errors.New("too many login attempts, retry later")
+
+// loginLimiter limits the password logins per user and per remote ip. The tokens are taken before
+// the credentials are verified, so the parallel attempts are limited as well
+type loginLimiter struct {
+	mut   sync.Mutex
+	users *lru.Cache[string, *rate.Limiter]
+	addrs *lru.Cache[string, *rate.Limiter]
+}
+
+func newLoginLimiter() *loginLimiter {
+	return &loginLimiter{
+		users: lru.New[string, *rate.Limiter](4096),
+		addrs: lru.New[string, *rate.Limiter](4096),
+	}
+}
+
+// allow reports whether the login attempt of the user from the remote address is allowed,
+// the delay is how long to wait before retrying if not
+func (l *loginLimiter) allow(username, remoteAddr string) (bool, time.Duration) {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	now := time.Now()
+	addr := limiterOf(l.addrs, host, loginAddrLimit, loginAddrBurst)
+	user := limiterOf(l.users, username, loginUserLimit, loginUserBurst)
+	addrR, userR := addr.ReserveN(now, 1), user.ReserveN(now, 1)
+	delay := max(addrR.DelayFrom(now), userR.DelayFrom(now))
+	if delay > 0 { // both are given back, the refused attempts do not extend the wait
+		addrR.CancelAt(now)
+		userR.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+func limiterOf(limiters *lru.Cache[string, *rate.Limiter], key string, limit rate.Limit, burst int) *rate.Limiter {
+	if limiter, ok := limiters.Get(key); ok {
+		return limiter
+	}
+	limiter := rate.NewLimiter(limit, burst)
+	limiters.Put(key, limiter)
+	return limiter
+}
@@ -0,0 +1,90 @@
+package peermap
+
+import (
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rkonfj/peerguard/crash"
+	"github.com/rkonfj/peerguard/peermap/exporter"
+)
+
+// HandleMetrics exposes the metrics of the peermap in the prometheus text format, it is authorized
+// by the exporter token in the X-Token header or as the bearer token. The metrics are prefixed by
+// pgmap_ so that they never collide with the peermap_ ones of pgcli admin exporter polling the same
+// pgmap
+func (pm *PeerMap) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && r.Header.Get("X-Token") == "" {
+		r.Header.Set("X-Token", token)
+	}
+	if err := pm.checkAdminToken(w, r); err != nil {
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(pm.metrics())
+}
+
+func (pm *PeerMap) metrics() []byte {
+	type networkSample struct {
+		id, alias     string
+		peers         int
+		relayBytes    uint64
+		relayMessages uint64
+		messages      map[string]uint64
+		ratelimited   uint64
+		ratelimitWait time.Duration
+	}
+	pm.networkMapMutex.RLock()
+	networks := make([]networkSample, 0, len(pm.networkMap))
+	for id, ctx := range pm.networkMap {
+		networks = append(networks, networkSample{
+			id:            id,
+			alias:         ctx.alias,
+			peers:         ctx.peerCount(),
+			relayBytes:    ctx.relayBytes.Load(),
+			relayMessages: ctx.relayMessages.Load(),
+			messages:      ctx.messageCounts(),
+			ratelimited:   ctx.ratelimited.Load(),
+			ratelimitWait: time.Duration(ctx.ratelimitWait.Load()),
+		})
+	}
+	pm.networkMapMutex.RUnlock()
+	slices.SortFunc(networks, func(a, b networkSample) int { return strings.Compare(a.id, b.id) })
+
+	var w exporter.MetricsWriter
+	w.Family("pgmap_networks", "gauge", "Number of the networks")
+	w.Sample("pgmap_networks", nil, float64(len(networks)))
+	w.Family("pgmap_network_peers", "gauge", "Number of the peers connected to the network")
+	for _, n := range networks {
+		w.Sample("pgmap_network_peers", []string{"network", n.id, "alias", n.alias}, float64(n.peers))
+	}
+	w.Family("pgmap_network_relay_bytes_total", "counter", "Bytes relayed by the peermap for the peers of the network")
+	for _, n := range networks {
+		w.Sample("pgmap_network_relay_bytes_total", []string{"network", n.id}, float64(n.relayBytes))
+	}
+	w.Family("pgmap_network_relay_messages_total", "counter", "Datagrams relayed by the peermap for the peers of the network")
+	for _, n := range networks {
+		w.Sample("pgmap_network_relay_messages_total", []string{"network", n.id}, float64(n.relayMessages))
+	}
+	w.Family("pgmap_network_messages_total", "counter", "Messages received by the peermap from the peers of the network, by control code")
+	for _, n := range networks {
+		for _, code := range slices.Sorted(maps.Keys(n.messages)) {
+			w.Sample("pgmap_network_messages_total", []string{"network", n.id, "code", code}, float64(n.messages[code]))
+		}
+	}
+	w.Family("pgmap_network_ratelimited_total", "counter", "Messages of the peers of the network delayed by the rate limiters")
+	for _, n := range networks {
+		w.Sample("pgmap_network_ratelimited_total", []string{"network", n.id}, float64(n.ratelimited))
+	}
+	w.Family("pgmap_network_ratelimit_wait_seconds_total", "counter", "Time the peers of the network waited for the rate limiters")
+	for _, n := range networks {
+		w.Sample("pgmap_network_ratelimit_wait_seconds_total", []string{"network", n.id}, n.ratelimitWait.Seconds())
+	}
+	w.Family("pgmap_websocket_upgrade_failures_total", "counter", "Authenticated connections failed to upgrade to the websocket")
+	w.Sample("pgmap_websocket_upgrade_failures_total", nil, float64(pm.upgradeFailures.Load()))
+	w.Family("pgmap_panics_total", "counter", "Panics recovered by the peermap")
+	w.Sample("pgmap_panics_total", nil, float64(crash.Panics()))
+	return w.Bytes()
+}
@@ -0,0 +1,137 @@
+package peermap
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rkonfj/peerguard/disco"
+	"github.com/rkonfj/peerguard/peermap/auth"
+)
+
+const (
+	// ClientCertificateAlternative accepts the client certificate instead of the network secret
+	ClientCertificateAlternative = "alternative"
+	// ClientCertificateAdditional requires both the client certificate and the network secret
+	ClientCertificateAdditional = "additional"
+)
+
+var ErrClientCertificateRequired = disco.Error{Code: 4035, Msg: "a client certificate mapped to the network is required"}
+
+type TLSConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// ClientCAFile verifies the client certificates, the self-signed client certificates
+	// are accepted by the fingerprint only if it is empty
+	ClientCAFile string `yaml:"client_ca_file"`
+	// RequireClientCertificate refuses the tls handshake without a client certificate
+	RequireClientCertificate bool `yaml:"require_client_certificate"`
+}
+
+// ClientCertificate maps the client certificate to the network
+type ClientCertificate struct {
+	// Fingerprint is the sha256 of the certificate (DER), in hex with or without colons
+	Fingerprint string `yaml:"fingerprint"`
+	Network     string `yaml:"network"`
+	// Mode is alternative (default) or additional
+	Mode string `yaml:"mode"`
+}
+
+func (cfg *TLSConfig) serverTLSConfig() (*tls.Config, error) {
+	tlsConfig := tls.Config{ClientAuth: tls.RequestClientCert}
+	if cfg.RequireClientCertificate {
+		tlsConfig.ClientAuth = tls.RequireAnyClientCert
+	}
+	if cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls: read client ca: %w", err)
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("tls: no client ca certificate found")
+		}
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if cfg.RequireClientCertificate {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return &tlsConfig, nil
+}
+
+func normalizeFingerprint(fingerprint string) string {
+	return strings.ToLower(strings.ReplaceAll(fingerprint, ":", ""))
+}
+
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// clientCertificate finds the mapping of the client certificate presented on the tls connection
+func (pm *PeerMap) clientCertificate(r *http.Request) (ClientCertificate, *x509.Certificate, bool) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ClientCertificate{}, nil, false
+	}
+	cert := r.TLS.PeerCertificates[0]
+	if now := time.Now(); now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return ClientCertificate{}, cert, false
+	}
+	fingerprint := certFingerprint(cert)
+	for _, mapping := range pm.cfg.ClientCertificates {
+		if normalizeFingerprint(mapping.Fingerprint) == fingerprint {
+			return mapping, cert, true
+		}
+	}
+	return ClientCertificate{}, cert, false
+}
+
+// certificateRequired reports whether the network requires the client certificate in addition to the secret
+func (pm *PeerMap) certificateRequired(network string) bool {
+	for _, mapping := range pm.cfg.ClientCertificates {
+		if mapping.Network == network && mapping.Mode == ClientCertificateAdditional {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticateClientCertificate authenticates the peer by the client certificate if no network secret
+// is presented, ok is false if the request should fall back to the network secret authentication
+func (pm *PeerMap) authenticateClientCertificate(r *http.Request) (secret auth.JSONSecret, ok bool) {
+	if r.Header.Get("X-Network") != "" {
+		return
+	}
+	mapping, cert, found := pm.clientCertificate(r)
+	if !found || mapping.Mode == ClientCertificateAdditional {
+		return
+	}
+	return auth.JSONSecret{Network: mapping.Network, Deadline: cert.NotAfter.Unix()}, true
+}
+
+func (cfg *Config) checkClientCertificates() error {
+	for _, mapping := range cfg.ClientCertificates {
+		if len(normalizeFingerprint(mapping.Fingerprint)) != sha256.Size*2 {
+			return fmt.Errorf("client certificate %s: invalid sha256 fingerprint", mapping.Fingerprint)
+		}
+		if mapping.Network == "" {
+			return fmt.Errorf("client certificate %s: network is required", mapping.Fingerprint)
+		}
+		switch mapping.Mode {
+		case "", ClientCertificateAlternative, ClientCertificateAdditional:
+		default:
+			return fmt.Errorf("client certificate %s: unknown mode %s", mapping.Fingerprint, mapping.Mode)
+		}
+	}
+	if len(cfg.ClientCertificates) > 0 && cfg.TLS == nil {
+		return errors.New("client certificates require tls")
+	}
+	return nil
+}
@@ -1,13 +1,17 @@
 package network
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"path"
+	"time"
 
 	"github.com/rkonfj/peerguard/disco"
 	"storj.io/common/base58"
@@ -65,3 +69,167 @@ func JoinOIDC(oidcProvider, peermap string) (*JoinIntent, error) {
 		peermap: peermapURL,
 	}, nil
 }
+
+// DeviceJoinIntent is the intent to join the network by the device authorization flow,
+// no browser or local listener is required on the joining node
+type DeviceJoinIntent struct {
+	disco.DeviceAuthorization
+	peermap *url.URL
+}
+
+// Wait polls the peermap server until the user authorized the device
+func (intent *DeviceJoinIntent) Wait(ctx context.Context) (joined disco.NetworkSecret, err error) {
+	tokenURL := fmt.Sprintf("https://%s/oidc/device/token?device_code=%s", intent.peermap.Host, intent.DeviceCode)
+	interval := time.Duration(max(intent.Interval, 1)) * time.Second
+	for {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		case <-time.After(interval):
+		}
+		var req *http.Request
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, tokenURL, nil)
+		if err != nil {
+			return
+		}
+		var resp *http.Response
+		resp, err = client.Do(req)
+		if err != nil {
+			return
+		}
+		if resp.StatusCode == http.StatusAccepted {
+			resp.Body.Close()
+			continue
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+			err = fmt.Errorf("wait token error: %s: %s", resp.Status, msg)
+			return
+		}
+		err = json.NewDecoder(resp.Body).Decode(&joined)
+		return
+	}
+}
+
+// JoinOIDCDevice starts the device authorization flow with the oidc provider
+// (the first one supports it if oidcProvider is empty)
+func JoinOIDCDevice(ctx context.Context, oidcProvider, peermap string) (*DeviceJoinIntent, error) {
+	peermapURL, err := url.Parse(peermap)
+	if err != nil {
+		return nil, err
+	}
+	deviceURL := fmt.Sprintf("https://%s%s", peermapURL.Host, path.Join("/oidc/device", oidcProvider))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, deviceURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("device authorization error: %s: %s", resp.Status, msg)
+	}
+	intent := DeviceJoinIntent{peermap: peermapURL}
+	if err := json.NewDecoder(resp.Body).Decode(&intent.DeviceAuthorization); err != nil {
+		return nil, err
+	}
+	return &intent, nil
+}
+
+// RefreshOIDC renews the expired network secret by its refresh token without user interaction.
+// A disco.Error with code 4031 is returned if the refresh token is revoked
+func RefreshOIDC(ctx context.Context, peermap string, secret disco.NetworkSecret) (joined disco.NetworkSecret, err error) {
+	if secret.RefreshToken == "" {
+		err = errors.New("no refresh token")
+		return
+	}
+	peermapURL, err := url.Parse(peermap)
+	if err != nil {
+		return
+	}
+	body, err := json.Marshal(map[string]string{"refreshToken": secret.RefreshToken})
+	if err != nil {
+		return
+	}
+	refreshURL := fmt.Sprintf("https://%s/oidc/refresh", peermapURL.Host)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, refreshURL, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		var discoErr disco.Error
+		json.NewDecoder(resp.Body).Decode(&discoErr)
+		err = discoErr
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("refresh secret error: %s", resp.Status)
+		return
+	}
+	err = json.NewDecoder(resp.Body).Decode(&joined)
+	return
+}
+
+// JoinLDAP authenticates the ldap user (username or bind dn) by the password, the network
+// is mapped from the ldap groups of the user by the peermap server
+func JoinLDAP(ctx context.Context, peermap, username, password string) (joined disco.NetworkSecret, err error) {
+	peermapURL, err := url.Parse(peermap)
+	if err != nil {
+		return
+	}
+	body, err := json.Marshal(map[string]string{"username": username, "password": password})
+	if err != nil {
+		return
+	}
+	loginURL := fmt.Sprintf("https://%s/ldap/login", peermapURL.Host)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, loginURL, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		err = fmt.Errorf("ldap login error: %s: %s", resp.Status, msg)
+		return
+	}
+	err = json.NewDecoder(resp.Body).Decode(&joined)
+	return
+}
+
+// Logout revokes the network secret, all secrets issued to the same user if all is true.
+// The peers using the revoked secrets are disconnected
+func Logout(ctx context.Context, peermap string, secret disco.NetworkSecret, all bool) error {
+	peermapURL, err := url.Parse(peermap)
+	if err != nil {
+		return err
+	}
+	logoutURL := fmt.Sprintf("https://%s/pg/logout?all=%t", peermapURL.Host, all)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, logoutURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Network", secret.Secret)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("logout error: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rkonfj/peerguard/disco"
+	"storj.io/common/base58"
+)
+
+var (
+	ErrDeviceAuthNotSupported = errors.New("no provider supports the device authorization flow")
+
+	deviceSessions    = make(map[string]*deviceSession)
+	deviceSessionsMut sync.Mutex
+)
+
+type deviceSession struct {
+	done   bool
+	secret disco.NetworkSecret
+	err    error
+}
+
+// StartDeviceAuth starts the device authorization flow with the provider (the first provider
+// supports it if providerName is empty), issueSecret is called once the user authorized the device
+func StartDeviceAuth(providerName string, issueSecret func(providerName string, info UserInfo) (disco.NetworkSecret, error)) (disco.DeviceAuthorization, error) {
+	provider, ok := Provider(providerName)
+	if providerName == "" {
+		for name, p := range providers {
+			if p.SupportDeviceAuth() {
+				providerName, provider, ok = name, p, true
+				break
+			}
+		}
+	}
+	if !ok || !provider.SupportDeviceAuth() {
+		return disco.DeviceAuthorization{}, ErrDeviceAuthNotSupported
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	da, err := provider.DeviceAuth(ctx)
+	if err != nil {
+		return disco.DeviceAuthorization{}, err
+	}
+	if da.Expiry.IsZero() {
+		da.Expiry = time.Now().Add(15 * time.Minute)
+	}
+	deviceCode := make([]byte, 16)
+	rand.Read(deviceCode)
+	authorization := disco.DeviceAuthorization{
+		DeviceCode:              base58.Encode(deviceCode),
+		UserCode:                da.UserCode,
+		VerificationURI:         da.VerificationURI,
+		VerificationURIComplete: da.VerificationURIComplete,
+		ExpiresIn:               int64(time.Until(da.Expiry).Seconds()),
+		Interval:                max(da.Interval, 5),
+	}
+
+	session := &deviceSession{}
+	deviceSessionsMut.Lock()
+	deviceSessions[authorization.DeviceCode] = session
+	deviceSessionsMut.Unlock()
+
+	go func() {
+		ctx, cancel := context.WithDeadline(context.Background(), da.Expiry)
+		defer cancel()
+		info, err := provider.DeviceUserInfo(ctx, da)
+		if err == nil && info.Email == "" {
+			err = errors.New("email is required")
+		}
+		var secret disco.NetworkSecret
+		if err == nil {
+			secret, err = issueSecret(providerName, info)
+		}
+		if err != nil {
+			slog.Error("OIDC device authorization failed", "err", err)
+		}
+		deviceSessionsMut.Lock()
+		session.done, session.secret, session.err = true, secret, err
+		deviceSessionsMut.Unlock()
+		// keep the result for a while for the client to poll
+		time.AfterFunc(time.Minute, func() {
+			deviceSessionsMut.Lock()
+			defer deviceSessionsMut.Unlock()
+			delete(deviceSessions, authorization.DeviceCode)
+		})
+	}()
+	return authorization, nil
+}
+
+// OIDCDeviceToken polls the network secret of the device authorization flow.
+// 202 is returned while the user has not authorized the device yet
+func OIDCDeviceToken(w http.ResponseWriter, r *http.Request) {
+	deviceSessionsMut.Lock()
+	session, ok := deviceSessions[r.URL.Query().Get("device_code")]
+	var (
+		done   bool
+		secret disco.NetworkSecret
+		err    error
+	)
+	if ok {
+		done, secret, err = session.done, session.secret, session.err
+	}
+	deviceSessionsMut.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "device code not found or expired")
+		return
+	}
+	if !done {
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprint(w, "authorization pending")
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "oidc: %s", err)
+		return
+	}
+	json.NewEncoder(w).Encode(secret)
+}
@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"github.com/rkonfj/peerguard/disco"
+	"golang.org/x/oauth2"
 )
 
 var (
@@ -61,7 +62,8 @@ func OIDCAuthURL(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "provider %s not found", r.PathValue("provider"))
 		return
 	}
-	authURL := provider.oAuthConfig.AuthCodeURL(r.URL.Query().Get("state"))
+	// offline access makes the providers like google issue the refresh token
+	authURL := provider.oAuthConfig.AuthCodeURL(r.URL.Query().Get("state"), oauth2.AccessTypeOffline)
 	http.Redirect(w, r, authURL, http.StatusFound)
 }
 
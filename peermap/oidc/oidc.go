@@ -26,6 +26,8 @@ type OIDCProviderConfig struct {
 	AuthURL      string   `yaml:"auth_url"`
 	TokenURL     string   `yaml:"token_url"`
 	UserInfoURL  string   `yaml:"user_info_url"`
+	// DeviceAuthURL enables the device authorization flow for the non-standard provider
+	DeviceAuthURL string `yaml:"device_auth_url"`
 }
 
 type OIDCProvider struct {
@@ -34,26 +36,71 @@ type OIDCProvider struct {
 	oAuthConfig  *oauth2.Config
 }
 
-func (p *OIDCProvider) UserInfo(code string) (email string, extra map[string]any, err error) {
+// UserInfo is the authenticated user
+type UserInfo struct {
+	Email  string
+	Claims map[string]any
+	// RefreshToken renews the user info without user interaction, empty if the provider does not issue one
+	RefreshToken string
+}
+
+func (p *OIDCProvider) UserInfo(code string) (UserInfo, error) {
 	exchangeCtx, exchangeCancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer exchangeCancel()
 	token, err := p.oAuthConfig.Exchange(exchangeCtx, code)
 	if err != nil {
-		return
+		return UserInfo{}, err
+	}
+	return p.tokenUserInfo(token)
+}
+
+// SupportDeviceAuth reports whether the provider supports the device authorization flow
+func (p *OIDCProvider) SupportDeviceAuth() bool {
+	return p.oAuthConfig.Endpoint.DeviceAuthURL != ""
+}
+
+// DeviceAuth starts the device authorization flow
+func (p *OIDCProvider) DeviceAuth(ctx context.Context) (*oauth2.DeviceAuthResponse, error) {
+	return p.oAuthConfig.DeviceAuth(ctx)
+}
+
+// DeviceUserInfo polls the token until the user authorized the device, then gets the user info
+func (p *OIDCProvider) DeviceUserInfo(ctx context.Context, da *oauth2.DeviceAuthResponse) (UserInfo, error) {
+	token, err := p.oAuthConfig.DeviceAccessToken(ctx, da)
+	if err != nil {
+		return UserInfo{}, err
 	}
+	return p.tokenUserInfo(token)
+}
+
+// Refresh gets the user info again by the refresh token, an error is returned if
+// the refresh token is revoked or the user is disabled by the provider
+func (p *OIDCProvider) Refresh(refreshToken string) (UserInfo, error) {
+	refreshCtx, refreshCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer refreshCancel()
+	token, err := p.oAuthConfig.TokenSource(refreshCtx, &oauth2.Token{RefreshToken: refreshToken}).Token()
+	if err != nil {
+		return UserInfo{}, err
+	}
+	if token.RefreshToken == "" { // not rotated
+		token.RefreshToken = refreshToken
+	}
+	return p.tokenUserInfo(token)
+}
+
+func (p *OIDCProvider) tokenUserInfo(token *oauth2.Token) (UserInfo, error) {
 	userInfoCtx, userInfoCancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer userInfoCancel()
 	userInfo, err := p.privoder.UserInfo(userInfoCtx, p.oAuthConfig.TokenSource(context.Background(), token))
 	if err != nil {
-		return
+		return UserInfo{}, err
 	}
 	if p.standardOIDC && !userInfo.EmailVerified {
-		err = errors.New("email is not verified")
-		return
+		return UserInfo{}, errors.New("email is not verified")
 	}
-	email = userInfo.Email
-	err = userInfo.Claims(&extra)
-	return
+	info := UserInfo{Email: userInfo.Email, RefreshToken: token.RefreshToken}
+	err = userInfo.Claims(&info.Claims)
+	return info, err
 }
 
 func AddProvider(oidcProviderConfig OIDCProviderConfig) (err error) {
@@ -77,6 +124,10 @@ func AddProvider(oidcProviderConfig OIDCProviderConfig) (err error) {
 		}
 		provider = providerConfig.NewProvider(providerCtx)
 	}
+	endpoint := provider.Endpoint()
+	if len(oidcProviderConfig.DeviceAuthURL) > 0 {
+		endpoint.DeviceAuthURL = oidcProviderConfig.DeviceAuthURL
+	}
 
 	providers[oidcProviderConfig.Name] = &OIDCProvider{
 		standardOIDC: standardOIDC,
@@ -85,7 +136,7 @@ func AddProvider(oidcProviderConfig OIDCProviderConfig) (err error) {
 			ClientID:     oidcProviderConfig.ClientID,
 			ClientSecret: oidcProviderConfig.ClientSecret,
 			RedirectURL:  oidcProviderConfig.RedirectURL,
-			Endpoint:     provider.Endpoint(),
+			Endpoint:     endpoint,
 			Scopes:       oidcProviderConfig.Scopes,
 		},
 	}
@@ -0,0 +1,87 @@
+package peermap
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/rkonfj/peerguard/disco"
+	"storj.io/common/base58"
+)
+
+const (
+	// PeerIDBindingIdentity binds the peer id to the first user enrolled it as the device in the network
+	PeerIDBindingIdentity = "identity"
+	// PeerIDBindingKey binds the peer id to the identity as well, and requires the peer id is
+	// the curve25519 public key the peer proves it holds the private key of
+	PeerIDBindingKey = "key"
+)
+
+var (
+	ErrPeerIDBound = disco.Error{Code: 4036, Msg: "the peer id is bound to another user"}
+
+	// errPeerKeyProofMissing the peer is challenged, it proves the key on the next connection
+	errPeerKeyProofMissing = errors.New("peer key proof is required")
+)
+
+// checkPeerID checks the peer id is not squatted, see PeerIDBinding. The peer proves it holds the
+// private key of the peer id if the key binding is required, or if it is able to (the peer-key
+// capability) so that its certificate binds the public key. keyProven reports whether it is proved
+func (pm *PeerMap) checkPeerID(w http.ResponseWriter, r *http.Request, ctx *networkContext, user string, peerID disco.PeerID, capabilities []string) (keyProven bool, err error) {
+	if pm.cfg.PeerIDBinding == PeerIDBindingKey ||
+		(slices.Contains(capabilities, disco.CapPeerKey) && len(base58.Decode(peerID.String())) == 32) {
+		if err := pm.verifyPeerKeyProof(r, peerID); err != nil {
+			w.Header().Set("X-Identity", pm.identityKey.PublicKey.String())
+			w.Header().Set("X-Challenge", pm.peerKeyChallenge(peerID, time.Now().Unix()/60))
+			w.WriteHeader(http.StatusForbidden)
+			disco.ErrPeerKeyProofRequired.MarshalTo(w)
+			return false, err
+		}
+		keyProven = true
+	}
+	if pm.cfg.PeerIDBinding == "" {
+		return keyProven, nil
+	}
+	if owner, ok := ctx.deviceOwner(peerID); ok && owner != user {
+		w.WriteHeader(http.StatusForbidden)
+		ErrPeerIDBound.MarshalTo(w)
+		return false, fmt.Errorf("peer id is bound to %s", owner)
+	}
+	return keyProven, nil
+}
+
+// peerKeyChallenge is the stateless challenge of the peer id, valid within the minute and the next one
+func (pm *PeerMap) peerKeyChallenge(peerID disco.PeerID, minute int64) string {
+	mac := hmac.New(sha256.New, pm.challengeKey)
+	mac.Write(peerID.Bytes())
+	mac.Write([]byte(strconv.FormatInt(minute, 10)))
+	return strconv.FormatInt(minute, 10) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (pm *PeerMap) verifyPeerKeyProof(r *http.Request, peerID disco.PeerID) error {
+	if len(base58.Decode(peerID.String())) != 32 {
+		return errors.New("peer id is not a curve25519 public key")
+	}
+	proof, challenge := r.Header.Get("X-Peer-Proof"), r.Header.Get("X-Challenge")
+	if proof == "" || challenge == "" {
+		return errPeerKeyProofMissing
+	}
+	now := time.Now().Unix() / 60
+	if challenge != pm.peerKeyChallenge(peerID, now) && challenge != pm.peerKeyChallenge(peerID, now-1) {
+		return errors.New("peer key challenge is invalid or expired")
+	}
+	sharedKey, err := pm.identityKey.SharedKey(peerID.String())
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(proof), []byte(disco.PeerKeyProof(sharedKey, challenge, peerID))) {
+		return errors.New("peer key proof is invalid")
+	}
+	return nil
+}
@@ -2,12 +2,16 @@ package peermap
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"log/slog"
+	"maps"
 	"math"
 	"net"
 	"net/http"
@@ -15,31 +19,48 @@ import (
 	"os"
 	"os/signal"
 	"slices"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/rkonfj/peerguard/crash"
+	"github.com/rkonfj/peerguard/debughttp"
 	"github.com/rkonfj/peerguard/disco"
+	"github.com/rkonfj/peerguard/peermap/alert"
+	"github.com/rkonfj/peerguard/peermap/audit"
 	"github.com/rkonfj/peerguard/peermap/auth"
 	"github.com/rkonfj/peerguard/peermap/exporter"
 	exporterauth "github.com/rkonfj/peerguard/peermap/exporter/auth"
+	"github.com/rkonfj/peerguard/peermap/ldap"
 	"github.com/rkonfj/peerguard/peermap/oidc"
+	"github.com/rkonfj/peerguard/secure"
+	"github.com/rkonfj/peerguard/tracing"
 	"golang.org/x/time/rate"
+	"storj.io/common/base58"
 )
 
 var (
 	ErrAddressAlreadyInuse  = disco.Error{Code: 4000, Msg: "the network address is already in use"}
 	ErrNetworkSecretExpired = disco.Error{Code: 4030, Msg: "network secret is expired"}
+	ErrRefreshTokenRevoked  = disco.Error{Code: 4031, Msg: "refresh token is revoked"}
 
 	_ io.ReadWriter = (*peerConn)(nil)
 )
 
+// relayTraceRatio is the ratio of the relayed datagrams traced, each one is too frequent to trace
+const relayTraceRatio = 0.001
+
+// peerStat is updated by the read loops of the peer and the peers relayed to it
 type peerStat struct {
-	RelayRx  uint64
-	StreamTx uint64
-	StreamRx uint64
+	RelayRx         atomic.Uint64
+	RelayRxMessages atomic.Uint64
+	RelayTx         atomic.Uint64
+	RelayTxMessages atomic.Uint64
+	StreamTx        atomic.Uint64
+	StreamRx        atomic.Uint64
 }
 type peerConn struct {
 	conn      *websocket.Conn
@@ -47,30 +68,54 @@ type peerConn struct {
 	closeOnce sync.Once
 	peerMap   *PeerMap
 
-	networkSecret  auth.JSONSecret
+	// networkSecret is the parsed secret, replaced with the secret when it is rotated
+	networkSecret atomic.Pointer[auth.JSONSecret]
+	secret        atomic.Pointer[string]
+	// certAuthenticated is true if the peer is authenticated by the client certificate, no secret is issued to it
+	certAuthenticated bool
+	// keyProven is true if the peer proved it holds the private key of the peer id, only then the
+	// certificate binds the peer id as the public key
+	keyProven      bool
 	networkContext *networkContext
-
-	stat       peerStat
-	metadata   url.Values
-	activeTime atomic.Int64
-	id         disco.PeerID
-	nonce      byte
-	wMut       sync.Mutex
+	certNotAfter   atomic.Int64
+	certificate    atomic.Pointer[string]
+
+	stat        peerStat
+	writeStat   writeStat
+	metadata    url.Values
+	activeTime  atomic.Int64
+	connectTime time.Time
+	id          disco.PeerID
+	remoteAddr  string
+	nonce       byte
+	wMut        sync.Mutex
+
+	// version and capabilities are reported by the client in the upgrade headers
+	version      string
+	capabilities []string
 
 	relayRatelimiter *rate.Limiter
 
+	// quality is the connection quality to the other peers reported by the peer
+	quality atomic.Pointer[qualityReport]
+	// rtt is the smoothed round trip time of the websocket ping in nanoseconds, 0 if not measured yet
+	rtt atomic.Int64
+
 	connRRL  *rate.Limiter
 	connWRL  *rate.Limiter
 	connData chan []byte
 	connBuf  []byte
+
+	// resumption is the session the peer resumes by the token once reconnected
+	resumption *resumption
 }
 
 func (p *peerConn) Read(b []byte) (n int, err error) {
 	defer func() {
 		if p.connRRL != nil && n > 0 {
-			p.connRRL.WaitN(context.Background(), n)
+			p.waitN(p.connRRL, n)
 		}
-		p.stat.StreamRx += uint64(n)
+		p.stat.StreamRx.Add(uint64(n))
 	}()
 	if p.connBuf != nil {
 		n = copy(b, p.connBuf)
@@ -95,19 +140,24 @@ func (p *peerConn) Read(b []byte) (n int, err error) {
 
 func (p *peerConn) Write(b []byte) (n int, err error) {
 	if p.connWRL != nil && len(b) > 0 {
-		p.connWRL.WaitN(context.Background(), len(b))
+		p.waitN(p.connWRL, len(b))
 	}
 	err = p.write(append(append([]byte(nil), disco.CONTROL_CONN.Byte()), b...))
 	if err != nil {
 		return
 	}
-	p.stat.StreamTx += uint64(len(b))
+	p.stat.StreamTx.Add(uint64(len(b)))
 	return len(b), nil
 }
 
 func (p *peerConn) Close() error {
 	p.closeOnce.Do(func() {
-		p.peerMap.removePeer(p.networkSecret.Network, p.id)
+		p.peerMap.removePeer(p.networkSecret.Load().Network, p.id)
+		p.peerMap.cluster.peerLeft(p)
+		p.peerMap.resumptions.left(p.resumption)
+		p.networkContext.churn.Add(1)
+		stat := p.Stat()
+		p.peerMap.stream.publish(exporter.Event{Type: exporter.EventPeerLeft, Network: p.networkSecret.Load().Network, Peer: &stat})
 		_ = p.conn.WriteControl(websocket.CloseMessage,
 			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(2*time.Second))
 		p.conn.Close()
@@ -118,9 +168,9 @@ func (p *peerConn) Close() error {
 }
 
 func (p *peerConn) String() string {
-	p.metadata.Set("rrx", fmt.Sprintf("%d", p.stat.RelayRx))
-	p.metadata.Set("stx", fmt.Sprintf("%d", p.stat.StreamTx))
-	p.metadata.Set("srx", fmt.Sprintf("%d", p.stat.StreamRx))
+	p.metadata.Set("rrx", fmt.Sprintf("%d", p.stat.RelayRx.Load()))
+	p.metadata.Set("stx", fmt.Sprintf("%d", p.stat.StreamTx.Load()))
+	p.metadata.Set("srx", fmt.Sprintf("%d", p.stat.StreamRx.Load()))
 	return (&url.URL{
 		Scheme:   "pg",
 		Host:     string(p.id),
@@ -136,23 +186,33 @@ func (p *peerConn) write(b []byte) error {
 }
 
 func (p *peerConn) writeWS(messageType int, b []byte) error {
+	p.writeStat.queue.Add(1)
+	start := time.Now()
 	p.wMut.Lock()
-	defer p.wMut.Unlock()
+	p.writeStat.queue.Add(-1)
+	locked := time.Now()
+	defer func() {
+		p.wMut.Unlock()
+		p.writeStat.observe(locked.Sub(start), time.Since(locked))
+	}()
 	return p.conn.WriteMessage(messageType, b)
 }
 
-func (p *peerConn) start() {
+// start serves the peer, the peer is introduced to the others. The resumed peer (resumedSince is
+// the time it left) is introduced only to the peers joined since then, the others keep its state
+func (p *peerConn) start(resumedSince time.Time) {
 	go p.readMessageLoop()
 	go p.keepalive()
+	p.updateACL(p.networkContext.getACL())
 	if p.metadata.Has("silenceMode") {
 		return
 	}
 
-	if p.peerMap.cfg.PublicNetwork == p.networkSecret.Network {
+	if p.peerMap.cfg.PublicNetwork == p.networkSecret.Load().Network {
 		return
 	}
 
-	ctx, _ := p.peerMap.getNetwork(p.networkSecret.Network)
+	ctx, _ := p.peerMap.getNetwork(p.networkSecret.Load().Network)
 	ctx.peersMutex.RLock()
 	defer ctx.peersMutex.RUnlock()
 	for k, v := range ctx.peers {
@@ -163,29 +223,54 @@ func (p *peerConn) start() {
 		if v.metadata.Has("silenceMode") {
 			continue
 		}
+		if !resumedSince.IsZero() && v.connectTime.Before(resumedSince) {
+			continue
+		}
 		p.leadDisco(v)
 	}
+	p.peerMap.cluster.peerJoined(p)
+}
+
+// discoMeta is the metadata sent to other peers along with the NEW_PEER event,
+// the certificate is attached so that peers get the peermap signed public key
+func (p *peerConn) discoMeta() []byte {
+	cert := p.certificate.Load()
+	if cert == nil {
+		return []byte(p.metadata.Encode())
+	}
+	meta := url.Values{}
+	for k, v := range p.metadata {
+		meta[k] = v
+	}
+	meta.Set("cert", *cert)
+	return []byte(meta.Encode())
 }
 
 func (p *peerConn) leadDisco(target *peerConn) {
-	myMeta := []byte(p.metadata.Encode())
-	b := make([]byte, 2+len(p.id)+len(myMeta))
-	b[0] = disco.CONTROL_NEW_PEER.Byte()
-	b[1] = p.id.Len()
-	copy(b[2:], p.id.Bytes())
-	copy(b[len(p.id)+2:], myMeta)
-	target.write(b)
-
-	peerMeta := []byte(target.metadata.Encode())
-	b1 := make([]byte, 2+len(target.id)+len(peerMeta))
-	b1[0] = disco.CONTROL_NEW_PEER.Byte()
-	b1[1] = target.id.Len()
-	copy(b1[2:], target.id.Bytes())
-	copy(b1[len(target.id)+2:], peerMeta)
-	p.write(b1)
+	_, span := tracing.Start(context.Background(), "peermap.lead_disco",
+		"network", p.networkSecret.Load().Network, "from", p.id, "to", target.id)
+	defer span.End()
+	span.SetError(target.write(newPeerFrame(p.id, p.discoMeta())))
+	span.SetError(p.write(newPeerFrame(target.id, target.discoMeta())))
+}
+
+// newPeerFrame is the NEW_PEER event of the peer sent to the others
+func newPeerFrame(peerID disco.PeerID, meta []byte) []byte {
+	return relayFrame(disco.CONTROL_NEW_PEER.Byte(), peerID, meta)
+}
+
+// relayFrame is the control frame from the source peer, [op][src len][src][data]
+func relayFrame(op byte, src disco.PeerID, data []byte) []byte {
+	b := make([]byte, 2+len(src)+len(data))
+	b[0] = op
+	b[1] = src.Len()
+	copy(b[2:], src.Bytes())
+	copy(b[len(src)+2:], data)
+	return b
 }
 
 func (p *peerConn) readMessageLoop() {
+	defer crash.Recover("peermap/read", func() { p.Close() })
 	for {
 		select {
 		case <-p.exitSig:
@@ -207,22 +292,60 @@ func (p *peerConn) readMessageLoop() {
 		for i, v := range b {
 			b[i] = v ^ p.nonce
 		}
+		if len(b) == 0 {
+			continue
+		}
+		p.networkContext.messages[b[0]].Add(1)
 		if slices.Contains([]disco.ControlCode{disco.CONTROL_LEAD_DISCO, disco.CONTROL_NEW_PEER_UDP_ADDR}, disco.ControlCode(b[0])) {
-			p.networkContext.disoRatelimiter.WaitN(context.Background(), len(b))
-		} else if p.relayRatelimiter != nil {
-			p.relayRatelimiter.WaitN(context.Background(), len(b))
+			p.waitN(p.networkContext.disoRatelimiter, len(b))
+		} else {
+			if p.relayRatelimiter != nil {
+				p.waitN(p.relayRatelimiter, len(b))
+			}
+			if limiter := p.networkContext.relayRatelimiter.Load(); limiter != nil {
+				p.waitN(limiter, len(b))
+			}
 		}
 		if b[0] == disco.CONTROL_CONN.Byte() {
 			p.connData <- b[1:]
 			continue
 		}
-		tgtPeerID := disco.PeerID(b[2 : b[1]+2])
+		if b[0] == disco.CONTROL_QUALITY_REPORT.Byte() {
+			if len(b) >= 2 {
+				p.updateQuality(b[2:])
+			}
+			continue
+		}
+		if b[0] == disco.CONTROL_UPDATE_NETWORK_SECRET_ACK.Byte() {
+			if string(b[1:]) == *p.secret.Load() {
+				slog.Debug("NetworkSecretAcked", "peer", p.id)
+				p.peerMap.releaseRotatedSecrets(p.id)
+			}
+			continue
+		}
+		if len(b) < 2 || len(b) < int(b[1])+2 {
+			slog.Debug("MalformedControlFrame", "op", disco.ControlCode(b[0]), "from", p.id, "len", len(b))
+			continue
+		}
+		tgtPeerID := disco.PeerID(b[2 : int(b[1])+2])
 		slog.Debug("PeerEvent", "op", disco.ControlCode(b[0]), "from", p.id, "to", tgtPeerID)
-		tgtPeer, err := p.peerMap.getPeer(p.networkSecret.Network, tgtPeerID)
+		tgtPeer, err := p.peerMap.getPeer(p, tgtPeerID)
 		if err != nil {
+			if p.peerMap.cluster.forward(p, tgtPeerID, b) {
+				continue
+			}
 			slog.Debug("FindPeer failed", "detail", err)
 			continue
 		}
+		if disco.ControlCode(b[0]) == disco.CONTROL_RELAY &&
+			(p.networkSecret.Load().HasScope(auth.ScopeNoRelay) || tgtPeer.networkSecret.Load().HasScope(auth.ScopeNoRelay)) {
+			slog.Debug("RelayDenied", "from", p.id, "to", tgtPeerID, "scope", auth.ScopeNoRelay)
+			continue
+		}
+		if disco.ControlCode(b[0]) == disco.CONTROL_RELAY && !relayAllowed(p, tgtPeer) {
+			slog.Debug("RelayDenied", "from", p.id, "to", tgtPeerID, "reason", "acl")
+			continue
+		}
 		if disco.ControlCode(b[0]) == disco.CONTROL_LEAD_DISCO {
 			p.leadDisco(tgtPeer)
 			continue
@@ -230,23 +353,37 @@ func (p *peerConn) readMessageLoop() {
 		if disco.ControlCode(b[0]) == disco.CONTROL_NEW_PEER_UDP_ADDR {
 			p.updatePeerUDPAddr(b)
 		}
-		data := b[b[1]+2:]
-		bb := make([]byte, 2+len(p.id)+len(data))
-		bb[0] = b[0]
-		bb[1] = p.id.Len()
-		copy(bb[2:p.id.Len()+2], p.id.Bytes())
-		copy(bb[p.id.Len()+2:], data)
-		_ = tgtPeer.write(bb)
-		p.stat.RelayRx += uint64(len(b))
+		data := b[int(b[1])+2:]
+		bb := relayFrame(b[0], p.id, data)
+		if disco.ControlCode(b[0]) == disco.CONTROL_RELAY {
+			_, span := tracing.StartSampled(context.Background(), "peermap.relay", relayTraceRatio,
+				"network", p.networkSecret.Load().Network, "from", p.id, "to", tgtPeerID, "bytes", len(data))
+			err = tgtPeer.write(bb)
+			span.SetError(err)
+			span.End()
+		} else {
+			err = tgtPeer.write(bb)
+		}
+		p.stat.RelayRx.Add(uint64(len(b)))
+		p.stat.RelayRxMessages.Add(1)
+		p.networkContext.relayBytes.Add(uint64(len(b)))
+		p.networkContext.relayMessages.Add(1)
+		if err == nil {
+			tgtPeer.stat.RelayTx.Add(uint64(len(bb)))
+			tgtPeer.stat.RelayTxMessages.Add(1)
+		}
 	}
 }
 
 func (p *peerConn) updatePeerUDPAddr(b []byte) {
-	if b[b[1]+2] != 'a' {
+	if len(b) < int(b[1])+4 || b[int(b[1])+2] != 'a' {
+		return
+	}
+	addrLen := int(b[int(b[1])+3])
+	s := int(b[1]) + 4
+	if len(b) < s+addrLen {
 		return
 	}
-	addrLen := b[b[1]+3]
-	s := b[1] + 4
 	addr, err := net.ResolveUDPAddr("udp", string(b[s:s+addrLen]))
 	if err != nil {
 		slog.Error("Resolve udp addr error", "err", err)
@@ -265,10 +402,12 @@ func (p *peerConn) updatePeerUDPAddr(b []byte) {
 }
 
 func (p *peerConn) keepalive() {
+	defer crash.Recover("peermap/keepalive", func() { p.Close() })
 	p.activeTime.Store(time.Now().Unix())
 	p.conn.SetPongHandler(func(appData string) error {
 		p.activeTime.Store(time.Now().Unix())
-		slog.Debug("Pong", "peer", p.id)
+		p.updateRTT(appData)
+		slog.Debug("Pong", "peer", p.id, "rtt", time.Duration(p.rtt.Load()))
 		return nil
 	})
 	ticker := time.NewTicker(12 * time.Second)
@@ -283,25 +422,38 @@ func (p *peerConn) keepalive() {
 			slog.Debug("Closing inactive connection", "peer", p.id)
 			break
 		}
-		err := p.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second))
+		if p.certAuthenticated && time.Now().Unix() >= p.networkSecret.Load().Deadline {
+			slog.Debug("Closing connection of the expired client certificate", "peer", p.id)
+			break
+		}
+		err := p.conn.WriteControl(websocket.PingMessage, pingPayload(), time.Now().Add(time.Second))
 		if err != nil {
 			slog.Warn("Ping", "err", err)
 		} else {
 			slog.Debug("Ping", "peer", p.id)
 		}
-		if time.Until(time.Unix(p.networkSecret.Deadline, 0)) <
+		if time.Until(time.Unix(p.networkSecret.Load().Deadline, 0)) <
 			p.peerMap.cfg.SecretValidityPeriod-p.peerMap.cfg.SecretRotationPeriod {
 			p.updateSecret()
 		}
+		if time.Until(time.Unix(p.certNotAfter.Load(), 0)) < p.peerMap.cfg.CertificateValidityPeriod/2 {
+			p.updateCertificate()
+		}
 	}
 	p.Close()
 }
 
 func (p *peerConn) updateSecret() error {
+	if p.certAuthenticated {
+		return nil
+	}
 	secret, err := p.peerMap.generateSecret(auth.Net{
-		ID:        p.networkSecret.Network,
+		ID:        p.networkSecret.Load().Network,
 		Alias:     p.networkContext.alias,
 		Neighbors: p.networkContext.neighbors,
+		Scopes:    p.networkSecret.Load().Scopes,
+		User:      p.networkSecret.Load().User,
+		Tags:      p.networkSecret.Load().Tags,
 	})
 	if err != nil {
 		slog.Error("NetworkSecretRefresh", "err", err)
@@ -319,7 +471,55 @@ func (p *peerConn) updateSecret() error {
 		slog.Error("NetworkSecretRefresh", "err", err)
 		return err
 	}
-	p.networkSecret, _ = p.peerMap.authenticator.ParseSecret(secret.Secret)
+	p.peerMap.retainRotatedSecret(p, *p.secret.Load())
+	jsonSecret, _ := p.peerMap.authenticator.ParseSecret(secret.Secret)
+	p.networkSecret.Store(&jsonSecret)
+	p.secret.Store(&secret.Secret)
+	p.peerMap.events.Emit(audit.Event{
+		Type:    audit.EventSecretRotated,
+		Outcome: audit.OutcomeSuccess,
+		User:    p.networkSecret.Load().User,
+		Network: p.networkSecret.Load().Network,
+		PeerID:  p.id.String(),
+	})
+	return nil
+}
+
+// issueCertificate issues a certificate binds the peer id to the network, and the public key to the
+// peer id if the peer proved it holds the private key
+func (p *peerConn) issueCertificate() (string, error) {
+	now := time.Now()
+	cert := disco.Certificate{
+		Network:   p.networkSecret.Load().Network,
+		PeerID:    p.id,
+		NotBefore: now.Add(-time.Minute).Unix(),
+		NotAfter:  now.Add(p.peerMap.cfg.CertificateValidityPeriod).Unix(),
+	}
+	if p.keyProven { // the peer id is the curve25519 public key
+		cert.PublicKey = p.id.String()
+	}
+	signedCert, err := disco.IssueCertificate(p.peerMap.caKey, cert)
+	if err != nil {
+		return "", err
+	}
+	p.certNotAfter.Store(cert.NotAfter)
+	p.certificate.Store(&signedCert)
+	return signedCert, nil
+}
+
+func (p *peerConn) updateCertificate() error {
+	cert, err := p.issueCertificate()
+	if err != nil {
+		slog.Error("CertificateRefresh", "err", err)
+		return err
+	}
+	data := make([]byte, 1+len(cert))
+	data[0] = disco.CONTROL_UPDATE_CERTIFICATE.Byte()
+	copy(data[1:], cert)
+	if err = p.write(data); err != nil {
+		slog.Error("CertificateRefresh", "err", err)
+		return err
+	}
 	return nil
 }
 
@@ -348,6 +548,25 @@ type networkContext struct {
 	metaMutex sync.Mutex
 	alias     string
 	neighbors []string
+	quota     exporter.NetworkQuota
+	acl       disco.ACL
+
+	// relayRatelimiter limits the relayed bytes of all peers in the network
+	relayRatelimiter atomic.Pointer[rate.Limiter]
+	// relayBytes and relayMessages count the relayed of all peers since the network is created
+	relayBytes    atomic.Uint64
+	relayMessages atomic.Uint64
+	// messages counts the messages received from the peers by the control code
+	messages [256]atomic.Uint64
+	// churn counts the peers joined and left since the last sample
+	churn atomic.Uint64
+	// ratelimited and ratelimitWait count the messages delayed by the rate limiters and the
+	// nanoseconds waited since the network is created
+	ratelimited   atomic.Uint64
+	ratelimitWait atomic.Uint64
+
+	devicesMutex sync.Mutex
+	devices      map[string]*exporter.Device
 }
 
 func (ctx *networkContext) removePeer(id disco.PeerID) {
@@ -356,6 +575,17 @@ func (ctx *networkContext) removePeer(id disco.PeerID) {
 	delete(ctx.peers, string(id))
 }
 
+// removePeerConn removes the peer unless it is replaced by another connection of the same peer id
+func (ctx *networkContext) removePeerConn(p *peerConn) bool {
+	ctx.peersMutex.Lock()
+	defer ctx.peersMutex.Unlock()
+	if ctx.peers[p.id.String()] != p {
+		return false
+	}
+	delete(ctx.peers, p.id.String())
+	return true
+}
+
 func (ctx *networkContext) getPeer(id disco.PeerID) (*peerConn, bool) {
 	ctx.peersMutex.RLock()
 	defer ctx.peersMutex.RUnlock()
@@ -363,42 +593,67 @@ func (ctx *networkContext) getPeer(id disco.PeerID) (*peerConn, bool) {
 	return p, ok
 }
 
+// messageCounts is the messages received from the peers by the control code name
+func (ctx *networkContext) messageCounts() map[string]uint64 {
+	counts := make(map[string]uint64)
+	for code := range ctx.messages {
+		if n := ctx.messages[code].Load(); n > 0 {
+			counts[disco.ControlCode(code).String()] += n
+		}
+	}
+	return counts
+}
+
+// snapshotPeers copies the peers connected, so that they are closed or written without the lock
+func (ctx *networkContext) snapshotPeers() []*peerConn {
+	ctx.peersMutex.RLock()
+	defer ctx.peersMutex.RUnlock()
+	return slices.Collect(maps.Values(ctx.peers))
+}
+
 func (ctx *networkContext) peerCount() int {
 	ctx.peersMutex.RLock()
 	defer ctx.peersMutex.RUnlock()
 	return len(ctx.peers)
 }
 
-func (ctx *networkContext) SetIfAbsent(peerID string, p *peerConn) bool {
+func (ctx *networkContext) SetIfAbsent(peerID string, p *peerConn) error {
+	maxPeers := ctx.getQuota().MaxPeers
 	ctx.peersMutex.Lock()
 	if p1, ok := ctx.peers[peerID]; ok {
 		ctx.peersMutex.Unlock()
 		if p1.checkAlive() {
-			return false
+			return ErrAddressAlreadyInuse
 		}
 		ctx.peersMutex.Lock()
+	} else if maxPeers > 0 && len(ctx.peers) >= maxPeers {
+		ctx.peersMutex.Unlock()
+		return ErrNetworkQuotaExceeded
 	}
 	ctx.peers[peerID] = p
 	ctx.peersMutex.Unlock()
-	return true
+	return nil
 }
 
-func (ctx *networkContext) initMeta(n auth.Net, updateTime time.Time) {
+// initMeta applies the meta carried by the secret if it is newer, changed reports whether the meta differs
+func (ctx *networkContext) initMeta(n auth.Net, updateTime time.Time) (changed bool) {
 	ctx.metaMutex.Lock()
 	defer ctx.metaMutex.Unlock()
 	if ctx.updateTime.After(updateTime) {
-		return
+		return false
 	}
+	changed = ctx.alias != n.Alias || !slices.Equal(ctx.neighbors, n.Neighbors)
 	ctx.updateTime = updateTime
 	ctx.alias = n.Alias
 	ctx.neighbors = n.Neighbors
+	return
 }
 
-func (ctx *networkContext) updateMeta(n auth.Net) error {
+func (ctx *networkContext) updateMeta(n auth.Net) (changed bool, err error) {
 	ctx.metaMutex.Lock()
 	defer ctx.metaMutex.Unlock()
 	if ctx.alias == n.Alias && slices.Equal(ctx.neighbors, n.Neighbors) {
-		return nil
+		return false, nil
 	}
 	ctx.updateTime = time.Now()
 	ctx.neighbors = n.Neighbors
@@ -408,15 +663,18 @@ func (ctx *networkContext) updateMeta(n auth.Net) error {
 	for _, v := range ctx.peers {
 		v.updateSecret()
 	}
-	return nil
+	return true, nil
 }
 
 type NetState struct {
-	ID         string    `json:"id"`
-	Alias      string    `json:"alias"`
-	Neighbors  []string  `json:"neighbors"`
-	CreateTime time.Time `json:"createTime"`
-	UpdateTime time.Time `json:"updateTime"`
+	ID         string                 `json:"id"`
+	Alias      string                 `json:"alias"`
+	Neighbors  []string               `json:"neighbors"`
+	CreateTime time.Time              `json:"createTime"`
+	UpdateTime time.Time              `json:"updateTime"`
+	Devices    []exporter.Device      `json:"devices,omitempty"`
+	Quota      *exporter.NetworkQuota `json:"quota,omitempty"`
+	ACL        *disco.ACL             `json:"acl,omitempty"`
 }
 
 type PeerMap struct {
@@ -429,6 +687,131 @@ type PeerMap struct {
 	cfg                   Config
 	authenticator         *auth.Authenticator
 	exporterAuthenticator *exporterauth.Authenticator
+	caKey                 ed25519.PrivateKey
+	// identityKey and challengeKey verify the peers hold the private keys of the peer ids
+	identityKey  *secure.PrivateKey
+	challengeKey []byte
+
+	rotatedSecretsMutex sync.Mutex
+	rotatedSecrets      map[string]rotatedSecret
+
+	revocations *revocations
+	history     *history
+	stream      *eventStream
+	canaries    []*canary
+	alerts      *alert.Notifier
+	stateKeys   [][]byte
+
+	// authFailures counts the failed logins and connections since the last sample
+	authFailures atomic.Uint64
+	// upgradeFailures counts the authenticated connections failed to upgrade to the websocket
+	upgradeFailures atomic.Uint64
+
+	events *audit.Logger
+
+	// loginLimiter limits the ldap password guessing
+	loginLimiter *loginLimiter
+
+	webauthnCredentials       *webauthnCredentials
+	secondFactorSessionsMutex sync.Mutex
+	secondFactorSessions      map[string]*secondFactorSession
+
+	cluster *cluster
+	// store is where the networks state is saved
+	store stateStore
+	// resumptions are the sessions the peers reconnected resume
+	resumptions *resumptions
+}
+
+// readStateFile reads the state file, unsealed by the keys if it is sealed
+func readStateFile(file string, keys [][]byte) ([]byte, error) {
+	return readState(fileStore(file), keys)
+}
+
+// writeStateFile writes the state file, sealed by the first key unless plaintext
+func writeStateFile(file string, b []byte, keys [][]byte, plaintext bool) error {
+	return writeState(fileStore(file), b, keys, plaintext)
+}
+
+// readState loads the state from the store, unsealed by the keys if it is sealed
+func readState(store stateStore, keys [][]byte) ([]byte, error) {
+	b, err := store.load()
+	if err != nil {
+		return nil, err
+	}
+	return secure.Unseal(b, keys...)
+}
+
+// writeState saves the state to the store, sealed by the first key unless plaintext
+func writeState(store stateStore, b []byte, keys [][]byte, plaintext bool) (err error) {
+	if !plaintext && len(keys) > 0 {
+		if b, err = secure.Seal(keys[0], b); err != nil {
+			return fmt.Errorf("seal state: %w", err)
+		}
+	}
+	if err := store.save(b); err != nil {
+		return fmt.Errorf("write state %s: %w", store, err)
+	}
+	return nil
+}
+
+// rotatedSecret is the secret replaced by the rotation, still accepted
+// until the peer acked the new one or the grace period elapsed
+type rotatedSecret struct {
+	peerID  disco.PeerID
+	network string
+	until   time.Time
+}
+
+// retainRotatedSecret keeps the rotated secret of the peer acceptable, only the last
+// SecretGraceCount secrets of the peer are kept
+func (pm *PeerMap) retainRotatedSecret(p *peerConn, secret string) {
+	pm.rotatedSecretsMutex.Lock()
+	defer pm.rotatedSecretsMutex.Unlock()
+	now := time.Now()
+	var (
+		count  int
+		oldest string
+	)
+	for k, v := range pm.rotatedSecrets {
+		if now.After(v.until) {
+			delete(pm.rotatedSecrets, k)
+			continue
+		}
+		if v.peerID == p.id {
+			count++
+			if oldest == "" || v.until.Before(pm.rotatedSecrets[oldest].until) {
+				oldest = k
+			}
+		}
+	}
+	if count >= pm.cfg.SecretGraceCount {
+		delete(pm.rotatedSecrets, oldest)
+	}
+	pm.rotatedSecrets[secret] = rotatedSecret{
+		peerID:  p.id,
+		network: p.networkSecret.Load().Network,
+		until:   time.Unix(p.networkSecret.Load().Deadline, 0).Add(pm.cfg.SecretGracePeriod),
+	}
+}
+
+// releaseRotatedSecrets stops accepting the rotated secrets of the peer, it has the new one
+func (pm *PeerMap) releaseRotatedSecrets(peerID disco.PeerID) {
+	pm.rotatedSecretsMutex.Lock()
+	defer pm.rotatedSecretsMutex.Unlock()
+	for k, v := range pm.rotatedSecrets {
+		if v.peerID == peerID {
+			delete(pm.rotatedSecrets, k)
+		}
+	}
+}
+
+// acceptRotatedSecret reports whether the expired secret is rotated within the grace period
+func (pm *PeerMap) acceptRotatedSecret(secret string, peerID disco.PeerID) bool {
+	pm.rotatedSecretsMutex.Lock()
+	defer pm.rotatedSecretsMutex.Unlock()
+	rotated, ok := pm.rotatedSecrets[secret]
+	return ok && rotated.peerID == peerID && time.Now().Before(rotated.until)
 }
 
 func (pm *PeerMap) removePeer(network string, id disco.PeerID) {
@@ -448,16 +831,21 @@ func (pm *PeerMap) getNetwork(network string) (*networkContext, bool) {
 	return ctx, ok
 }
 
-func (pm *PeerMap) getPeer(network string, peerID disco.PeerID) (*peerConn, error) {
+// getPeer finds the peer reachable from the source peer, in the same network or the neighbor networks
+func (pm *PeerMap) getPeer(src *peerConn, peerID disco.PeerID) (*peerConn, error) {
+	network := src.networkSecret.Load().Network
 	if ctx, ok := pm.getNetwork(network); ok {
 		if peer, ok := ctx.getPeer(peerID); ok {
 			return peer, nil
 		}
+		if src.networkSecret.Load().HasScope(auth.ScopeNoNeighbor) {
+			return nil, fmt.Errorf("peer(%s/%s) not found: scope %s", network, peerID, auth.ScopeNoNeighbor)
+		}
 		pm.peerMapMutex.RLock()
 		neighNet, ok := pm.peerMap[peerID.String()]
 		pm.peerMapMutex.RUnlock()
 		if ok && slices.Contains(ctx.neighbors, neighNet.id) {
-			if peer, ok := neighNet.getPeer(peerID); ok {
+			if peer, ok := neighNet.getPeer(peerID); ok && !peer.networkSecret.Load().HasScope(auth.ScopeNoNeighbor) {
 				return peer, nil
 			}
 		}
@@ -493,6 +881,10 @@ func (pm *PeerMap) Serve(ctx context.Context) error {
 		if err := pm.Save(); err != nil {
 			slog.Error("Save networks", "err", err)
 		}
+		if err := pm.events.Close(); err != nil {
+			slog.Error("Close audit events", "err", err)
+		}
+		pm.alerts.Close()
 	}()
 	// load networks
 	if err := pm.Load(); err != nil {
@@ -500,38 +892,102 @@ func (pm *PeerMap) Serve(ctx context.Context) error {
 	}
 	// watch sighup for save networks
 	go pm.watchSaveCycle(ctx)
+	go pm.runHistory(ctx)
+	for _, c := range pm.canaries {
+		go c.run(ctx)
+	}
+	pm.cluster.run(ctx)
+	if pm.cfg.Debug != nil {
+		if expvar.Get("peermap") == nil {
+			expvar.Publish("peermap", expvar.Func(pm.debugVars))
+		}
+		if err := debughttp.Start(ctx, *pm.cfg.Debug); err != nil {
+			return err
+		}
+	}
 	// serving http
-	slog.Info("Serving for http now", "listen", pm.cfg.Listen)
-	err := pm.httpServer.ListenAndServe()
+	var err error
+	if pm.cfg.TLS != nil {
+		slog.Info("Serving for https now", "listen", pm.cfg.Listen)
+		err = pm.httpServer.ListenAndServeTLS(pm.cfg.TLS.CertFile, pm.cfg.TLS.KeyFile)
+	} else {
+		slog.Info("Serving for http now", "listen", pm.cfg.Listen)
+		err = pm.httpServer.ListenAndServe()
+	}
 	wg.Wait()
 	return err
 }
 
 // Load networks state
 func (pm *PeerMap) Load() error {
-	f, err := os.Open(pm.cfg.StateFile)
+	if err := pm.revocations.load(); err != nil {
+		return err
+	}
+	if err := pm.history.load(); err != nil {
+		return err
+	}
+	if pm.cfg.WebAuthn != nil {
+		if err := pm.webauthnCredentials.load(); err != nil {
+			return err
+		}
+	}
+	count, err := pm.loadNetworks()
+	if err != nil {
+		return fmt.Errorf("load: %w", err)
+	}
+	slog.Info("Load networks", "count", count)
+	return nil
+}
+
+// loadNetworks adds the networks saved to the store but absent in memory, the networks in memory
+// are newer than the saved ones
+func (pm *PeerMap) loadNetworks() (int, error) {
+	b, err := readState(pm.store, pm.stateKeys)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil
+			return 0, nil
 		}
-		return fmt.Errorf("load: open state file: %w", err)
+		return 0, fmt.Errorf("read state: %w", err)
 	}
-	defer f.Close()
 	var nets []NetState
-	if err := json.NewDecoder(f).Decode(&nets); err != nil && !errors.Is(err, io.EOF) {
-		return fmt.Errorf("load: decode state: %w", err)
+	if err := json.Unmarshal(b, &nets); err != nil && len(b) > 0 {
+		return 0, fmt.Errorf("decode state: %w", err)
 	}
 	pm.networkMapMutex.Lock()
 	defer pm.networkMapMutex.Unlock()
+	var count int
 	for _, n := range nets {
-		pm.networkMap[n.ID] = pm.newNetworkContext(n)
+		if _, ok := pm.networkMap[n.ID]; !ok {
+			pm.networkMap[n.ID] = pm.newNetworkContext(n)
+			count++
+		}
 	}
-	slog.Info("Load networks", "count", len(nets))
-	return nil
+	return count, nil
 }
 
-// Save networks state
+// Save networks state. The store is single-writer, nothing is saved while another pgmap server owns
+// the store, and the networks saved by the previous owner are merged once it is taken over
 func (pm *PeerMap) Save() error {
+	if err := pm.history.save(); err != nil {
+		return err
+	}
+	err := pm.saveNetworks()
+	if errors.Is(err, errStateStoreAcquired) {
+		count, mergeErr := pm.loadNetworks()
+		if mergeErr != nil {
+			return fmt.Errorf("save: merge: %w", mergeErr)
+		}
+		slog.Info("StateStoreAcquired", "store", pm.store, "merged", count)
+		err = pm.saveNetworks()
+	}
+	if errors.Is(err, errStateStoreNotOwner) {
+		slog.Debug("Save networks skipped", "store", pm.store, "err", err)
+		return nil
+	}
+	return err
+}
+
+func (pm *PeerMap) saveNetworks() error {
 	var nets []NetState
 	pm.networkMapMutex.RLock()
 	for _, v := range pm.networkMap {
@@ -540,26 +996,67 @@ func (pm *PeerMap) Save() error {
 			Alias:      v.alias,
 			Neighbors:  v.neighbors,
 			CreateTime: v.createTime,
-			UpdateTime: v.updateTime})
+			UpdateTime: v.updateTime,
+			Devices:    v.deviceStates(),
+			Quota:      v.quotaState(),
+			ACL:        v.aclState()})
 	}
 	pm.networkMapMutex.RUnlock()
 	if nets == nil {
 		return nil
 	}
-	f, err := os.Create(pm.cfg.StateFile)
+	b, err := json.Marshal(nets)
 	if err != nil {
-		return fmt.Errorf("save: open state file: %w", err)
-	}
-	if err := json.NewEncoder(f).Encode(nets); err != nil {
 		return fmt.Errorf("save: encode state: %w", err)
 	}
-	if err := f.Close(); err != nil {
-		return fmt.Errorf("save: close state file: %w", err)
+	if err := writeState(pm.store, b, pm.stateKeys, pm.cfg.PlaintextState); err != nil {
+		return fmt.Errorf("save: %w", err)
 	}
 	slog.Info("Save networks", "count", len(nets))
 	return nil
 }
 
+// Stat is the accounting of the peer for the exporter api
+func (p *peerConn) Stat() exporter.PeerStat {
+	links := p.links()
+	return exporter.PeerStat{
+		ID:              p.id.String(),
+		IP:              p.metadata.Get("alias1"),
+		Name:            p.metadata.Get("name"),
+		Version:         p.clientVersion(),
+		Capabilities:    p.capabilities,
+		NAT:             p.metadata.Get("nat"),
+		RemoteAddr:      p.remoteAddr,
+		ConnectTime:     p.connectTime,
+		RelayRxBytes:    p.stat.RelayRx.Load(),
+		RelayRxMessages: p.stat.RelayRxMessages.Load(),
+		RelayTxBytes:    p.stat.RelayTx.Load(),
+		RelayTxMessages: p.stat.RelayTxMessages.Load(),
+		StreamRxBytes:   p.stat.StreamRx.Load(),
+		StreamTxBytes:   p.stat.StreamTx.Load(),
+		RTT:             time.Duration(p.rtt.Load()),
+		WriteQueue:      p.writeStat.queue.Load(),
+		Writes:          p.writeStat.writes.Load(),
+		WriteWait:       time.Duration(p.writeStat.wait.Load()),
+		WriteTime:       time.Duration(p.writeStat.time.Load()),
+		WriteMax:        time.Duration(p.writeStat.max.Load()),
+		RatelimitWait:   time.Duration(p.writeStat.ratelimitWait.Load()),
+		Quality:         aggregateQuality(links),
+		Links:           links,
+	}
+}
+
+// debugVars is the expvar of the peermap, the networks and the peers connected
+func (pm *PeerMap) debugVars() any {
+	pm.networkMapMutex.RLock()
+	defer pm.networkMapMutex.RUnlock()
+	var peers int
+	for _, v := range pm.networkMap {
+		peers += v.peerCount()
+	}
+	return map[string]int{"networks": len(pm.networkMap), "peers": peers, "panics": int(crash.Panics())}
+}
+
 func (pm *PeerMap) HandleQueryNetworks(w http.ResponseWriter, r *http.Request) {
 	if err := pm.checkAdminToken(w, r); err != nil {
 		return
@@ -572,6 +1069,9 @@ func (pm *PeerMap) HandleQueryNetworks(w http.ResponseWriter, r *http.Request) {
 			Alias:      v.alias,
 			PeersCount: v.peerCount(),
 			CreateTime: fmt.Sprintf("%d", v.createTime.UnixNano()),
+			Quality:    v.quality(),
+			Messages:   v.messageCounts(),
+			RTT:        v.rttPercentiles(),
 		})
 	}
 	pm.networkMapMutex.RUnlock()
@@ -586,12 +1086,14 @@ func (pm *PeerMap) HandleQueryNetworkPeers(w http.ResponseWriter, r *http.Reques
 	pm.networkMapMutex.RLock()
 	for k, v := range pm.networkMap {
 		var peers []string
+		var stats []exporter.PeerStat
 		v.peersMutex.RLock()
 		for _, peer := range v.peers {
 			peers = append(peers, peer.String())
+			stats = append(stats, peer.Stat())
 		}
 		v.peersMutex.RUnlock()
-		networks = append(networks, exporter.Network{ID: k, Alias: v.alias, Peers: peers})
+		networks = append(networks, exporter.Network{ID: k, Alias: v.alias, Peers: peers, Stats: stats})
 	}
 	pm.networkMapMutex.RUnlock()
 	json.NewEncoder(w).Encode(networks)
@@ -624,12 +1126,105 @@ func (pm *PeerMap) HandlePutNetworkMeta(w http.ResponseWriter, r *http.Request)
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
-	if err := ctx.updateMeta(auth.Net{
+	changed, err := ctx.updateMeta(auth.Net{
 		Alias:     request.Alias,
 		Neighbors: request.Neighbors,
-	}); err != nil {
+	})
+	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if changed {
+		pm.stream.publish(exporter.Event{Type: exporter.EventNetworkMetaChanged, Network: network, Meta: &request})
+	}
+}
+
+// HandleDeleteNetwork disconnects the peers of the network and forgets its state, the peers holding
+// the valid secrets are free to join again unless revoked
+func (pm *PeerMap) HandleDeleteNetwork(w http.ResponseWriter, r *http.Request) {
+	if err := pm.checkAdminToken(w, r); err != nil {
+		return
+	}
+	network := r.PathValue("network")
+	ctx, ok := pm.getNetwork(network)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	peers := ctx.snapshotPeers()
+	for _, p := range peers {
+		p.Close()
+	}
+	pm.networkMapMutex.Lock()
+	delete(pm.networkMap, network)
+	pm.networkMapMutex.Unlock()
+	pm.stream.publish(exporter.Event{Type: exporter.EventNetworkDeleted, Network: network})
+	slog.Info("NetworkDeleted", "network", network, "peers", len(peers))
+}
+
+// HandleRotateNetworkSecrets rotates the secrets of the peers connected to the network now, the
+// replaced secrets are still accepted within the grace period. With revoke=true all the secrets of
+// the network issued before are revoked at once, the leaked ones included
+func (pm *PeerMap) HandleRotateNetworkSecrets(w http.ResponseWriter, r *http.Request) {
+	if err := pm.checkAdminToken(w, r); err != nil {
+		return
+	}
+	ctx, ok := pm.getNetwork(r.PathValue("network"))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	revoke := r.URL.Query().Get("revoke") == "true"
+	if revoke && ctx.id == pm.cfg.PublicNetwork {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("the secrets of the public network can not be revoked"))
+		return
+	}
+	var rotated int
+	replaced := make(map[string]int64)
+	for _, p := range ctx.snapshotPeers() {
+		if p.certAuthenticated {
+			continue
+		}
+		secret, deadline := *p.secret.Load(), p.networkSecret.Load().Deadline
+		if p.updateSecret() == nil {
+			rotated++
+		}
+		replaced[secret] = deadline
+		if revoke {
+			pm.releaseRotatedSecrets(p.id)
+		}
 	}
+	if revoke {
+		if err := pm.revocations.revokeNetwork(ctx.id, replaced); err != nil {
+			slog.Error("RevokeNetworkSecrets", "network", ctx.id, "err", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		pm.events.Emit(audit.Event{
+			Type:       audit.EventSecretRevoked,
+			Outcome:    audit.OutcomeSuccess,
+			Method:     "admin_token",
+			Network:    ctx.id,
+			RemoteAddr: r.RemoteAddr,
+			Reason:     "rotate",
+		})
+		// the peers failed to get the new secret are still on the revoked one
+		pm.disconnectRevoked()
+	}
+	slog.Info("NetworkSecretsRotated", "network", ctx.id, "peers", rotated, "revoke", revoke)
+	json.NewEncoder(w).Encode(map[string]int{"rotated": rotated})
+}
+
+// HandleGetCA returns the public key verifies the peer certificates
+func (pm *PeerMap) HandleGetCA(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(base64.StdEncoding.EncodeToString(pm.caKey.Public().(ed25519.PublicKey))))
+}
+
+// HandleGetJWKS returns the public keys verify the signed network secrets
+func (pm *PeerMap) HandleGetJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pm.authenticator.JWKS())
 }
 
 func (pm *PeerMap) HandleOIDCAuthorize(w http.ResponseWriter, r *http.Request) {
@@ -638,24 +1233,26 @@ func (pm *PeerMap) HandleOIDCAuthorize(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	email, _, err := provider.UserInfo(r.URL.Query().Get("code"))
+	userInfo, err := provider.UserInfo(r.URL.Query().Get("code"))
 	if err != nil {
+		pm.emitLogin(r, "oidc", r.PathValue("provider"), "", err)
 		slog.Error("OIDC get userInfo error", "err", err)
 		w.WriteHeader(http.StatusBadGateway)
 		w.Write([]byte(fmt.Sprintf("oidc: %s", err)))
 		return
 	}
-	if email == "" {
+	if userInfo.Email == "" {
+		pm.emitLogin(r, "oidc", r.PathValue("provider"), "", errors.New("email is required"))
 		w.WriteHeader(http.StatusBadGateway)
 		w.Write([]byte("odic: email is required"))
 		return
 	}
-	n := auth.Net{ID: email}
-	if ctx, ok := pm.getNetwork(email); ok {
-		n.Alias = ctx.alias
-		n.Neighbors = ctx.neighbors
+	pm.emitLogin(r, "oidc", r.PathValue("provider"), userInfo.Email, nil)
+	if pm.secondFactorRequired(userInfo.Email) {
+		pm.startSecondFactor(w, r.URL.Query().Get("state"), r.PathValue("provider"), userInfo)
+		return
 	}
-	secret, err := pm.generateSecret(n)
+	secret, err := pm.generateOIDCSecret(r.PathValue("provider"), userInfo)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -668,24 +1265,178 @@ func (pm *PeerMap) HandleOIDCAuthorize(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("ok"))
 }
 
+func (pm *PeerMap) HandleOIDCDeviceAuthorize(w http.ResponseWriter, r *http.Request) {
+	authorization, err := oidc.StartDeviceAuth(r.PathValue("provider"), func(provider string, userInfo oidc.UserInfo) (disco.NetworkSecret, error) {
+		secret, err := pm.generateOIDCSecret(provider, userInfo)
+		pm.emitLogin(r, "oidc_device", provider, userInfo.Email, err)
+		return secret, err
+	})
+	if errors.Is(err, oidc.ErrDeviceAuthNotSupported) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		slog.Error("OIDC device authorization error", "err", err)
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(fmt.Sprintf("oidc: %s", err)))
+		return
+	}
+	json.NewEncoder(w).Encode(authorization)
+}
+
+// HandleOIDCRefresh renews the network secret by the refresh token without user interaction
+func (pm *PeerMap) HandleOIDCRefresh(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	refreshToken, err := pm.authenticator.ParseRefreshToken(request.RefreshToken)
+	if err != nil {
+		pm.emitRefresh(r, "", "", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		ErrRefreshTokenRevoked.Wrap(err).MarshalTo(w)
+		return
+	}
+	provider, ok := oidc.Provider(refreshToken.Provider)
+	if !ok {
+		pm.emitRefresh(r, refreshToken.Provider, "", errors.New("provider not found"))
+		w.WriteHeader(http.StatusUnauthorized)
+		ErrRefreshTokenRevoked.Wrap(fmt.Errorf("provider %s not found", refreshToken.Provider)).MarshalTo(w)
+		return
+	}
+	userInfo, err := provider.Refresh(refreshToken.Token)
+	if err != nil {
+		pm.emitRefresh(r, refreshToken.Provider, "", err)
+		slog.Debug("OIDC refresh error", "err", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		ErrRefreshTokenRevoked.Wrap(err).MarshalTo(w)
+		return
+	}
+	secret, err := pm.generateOIDCSecret(refreshToken.Provider, userInfo)
+	pm.emitRefresh(r, refreshToken.Provider, userInfo.Email, err)
+	if errors.Is(err, ErrSecondFactorRequired) {
+		w.WriteHeader(http.StatusUnauthorized)
+		ErrRefreshTokenRevoked.Wrap(err).MarshalTo(w)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(secret)
+}
+
+// HandleLDAPLogin issues the network secret mapped from the ldap groups of the user
+func (pm *PeerMap) HandleLDAPLogin(w http.ResponseWriter, r *http.Request) {
+	if pm.cfg.LDAP == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("ldap: not enabled"))
+		return
+	}
+	var request struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if ok, delay := pm.loginLimiter.allow(request.Username, r.RemoteAddr); !ok {
+		pm.emitLogin(r, "ldap", "", request.Username, errLoginRateLimited)
+		slog.Info("LDAP login rate limited", "user", request.Username, "addr", r.RemoteAddr)
+		w.Header().Set("Retry-After", strconv.Itoa(int(delay.Seconds())+1))
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(errLoginRateLimited.Error()))
+		return
+	}
+	userInfo, err := pm.cfg.LDAP.Authenticate(r.Context(), request.Username, request.Password)
+	if errors.Is(err, ldap.ErrInvalidCredentials) {
+		pm.emitLogin(r, "ldap", "", request.Username, err)
+		slog.Info("LDAP invalid credentials", "user", request.Username, "addr", r.RemoteAddr)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		pm.emitLogin(r, "ldap", "", request.Username, err)
+		slog.Error("LDAP authenticate error", "user", request.Username, "err", err)
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	n := auth.Net{ID: userInfo.Network, Scopes: userInfo.Scopes, User: userInfo.DN}
+	if ctx, ok := pm.getNetwork(userInfo.Network); ok {
+		n.Alias = ctx.alias
+		n.Neighbors = ctx.neighbors
+	}
+	secret, err := pm.generateSecret(n)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	pm.emitLogin(r, "ldap", "", userInfo.DN, nil)
+	slog.Info("LDAP user joined", "user", userInfo.DN, "network", userInfo.Network)
+	json.NewEncoder(w).Encode(secret)
+}
+
 func (pm *PeerMap) HandlePeerPacketConnect(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracing.Start(tracing.Extract(r.Context(), r.Header), "peermap.connect",
+		"peer", r.Header.Get("X-PeerID"), "remote_addr", r.RemoteAddr)
+	defer span.End()
+	r = r.WithContext(ctx)
 	networkSecrest := r.Header.Get("X-Network")
 	jsonSecret := auth.JSONSecret{
 		Network:  networkSecrest,
 		Deadline: math.MaxInt64,
 	}
-	if len(pm.cfg.PublicNetwork) == 0 || pm.cfg.PublicNetwork != networkSecrest {
+	peerID := r.Header.Get("X-PeerID")
+	if pm.revocations.banned(disco.PeerID(peerID), r.RemoteAddr) {
+		pm.emitConnect(r, "secret", jsonSecret, ErrPeerBanned)
+		slog.Debug("Peer refused", "err", "banned", "peer", peerID, "addr", r.RemoteAddr)
+		w.WriteHeader(http.StatusForbidden)
+		ErrPeerBanned.MarshalTo(w)
+		return
+	}
+	certSecret, certAuthenticated := pm.authenticateClientCertificate(r)
+	if certAuthenticated {
+		jsonSecret = certSecret
+		slog.Debug("Authenticated by the client certificate", "network", jsonSecret.Network, "peer", peerID)
+	} else if len(pm.cfg.PublicNetwork) == 0 || pm.cfg.PublicNetwork != networkSecrest {
 		secret, err := pm.authenticator.ParseSecret(networkSecrest)
+		if errors.Is(err, auth.ErrTokenExpired) && pm.acceptRotatedSecret(networkSecrest, disco.PeerID(peerID)) {
+			slog.Info("Accepted the rotated secret within the grace period", "network", secret.Network, "peer", peerID)
+			err = nil
+		}
 		if err != nil {
+			pm.emitConnect(r, "secret", secret, err)
 			slog.Debug("Authenticate failed", "err", err, "network", jsonSecret.Network, "secret", r.Header.Get("X-Network"))
 			w.WriteHeader(http.StatusForbidden)
 			ErrNetworkSecretExpired.MarshalTo(w)
 			return
 		}
 		jsonSecret = secret
+		if pm.revocations.revoked(jsonSecret, networkSecrest, disco.PeerID(peerID)) {
+			pm.emitConnect(r, "secret", jsonSecret, errors.New("revoked"))
+			slog.Debug("Authenticate failed", "err", "revoked", "network", jsonSecret.Network, "peer", peerID)
+			w.WriteHeader(http.StatusForbidden)
+			ErrNetworkSecretRevoked.MarshalTo(w)
+			return
+		}
+	}
+	if !certAuthenticated && pm.certificateRequired(jsonSecret.Network) {
+		if mapping, _, ok := pm.clientCertificate(r); !ok || mapping.Network != jsonSecret.Network {
+			pm.emitConnect(r, "secret", jsonSecret, errors.New("client certificate required"))
+			slog.Debug("Authenticate failed", "err", "client certificate required", "network", jsonSecret.Network, "peer", peerID)
+			w.WriteHeader(http.StatusForbidden)
+			ErrClientCertificateRequired.MarshalTo(w)
+			return
+		}
 	}
 
-	peerID := r.Header.Get("X-PeerID")
 	nonce := disco.MustParseNonce(r.Header.Get("X-Nonce"))
 
 	pm.networkMapMutex.RLock()
@@ -702,11 +1453,18 @@ func (pm *PeerMap) HandlePeerPacketConnect(w http.ResponseWriter, r *http.Reques
 			pm.networkMap[jsonSecret.Network] = networkCtx
 		}
 		pm.networkMapMutex.Unlock()
+		if !ok {
+			pm.stream.publish(exporter.Event{Type: exporter.EventNetworkCreated, Network: jsonSecret.Network})
+		}
 	}
 
-	networkCtx.initMeta(
-		auth.Net{Alias: jsonSecret.Alias, Neighbors: jsonSecret.Neighbors},
-		time.Unix(jsonSecret.Deadline, 0).Add(-pm.cfg.SecretValidityPeriod))
+	if !certAuthenticated { // the client certificate carries no network meta
+		meta := auth.Net{Alias: jsonSecret.Alias, Neighbors: jsonSecret.Neighbors}
+		if networkCtx.initMeta(meta, time.Unix(jsonSecret.Deadline, 0).Add(-pm.cfg.SecretValidityPeriod)) {
+			pm.stream.publish(exporter.Event{Type: exporter.EventNetworkMetaChanged, Network: jsonSecret.Network,
+				Meta: &exporter.NetworkMeta{Alias: meta.Alias, Neighbors: meta.Neighbors}})
+		}
+	}
 
 	var rateLimiter, srLimiter, swLimiter *rate.Limiter
 	if pm.cfg.RateLimiter != nil && pm.cfg.RateLimiter.Relay.Limit > 0 {
@@ -719,18 +1477,24 @@ func (pm *PeerMap) HandlePeerPacketConnect(w http.ResponseWriter, r *http.Reques
 		srLimiter = rate.NewLimiter(rate.Limit(pm.cfg.RateLimiter.StreamW.Limit), pm.cfg.RateLimiter.StreamW.Burst)
 	}
 	peer := peerConn{
-		exitSig:          make(chan struct{}),
-		peerMap:          pm,
-		networkSecret:    jsonSecret,
-		networkContext:   networkCtx,
-		id:               disco.PeerID(peerID),
-		nonce:            nonce,
-		relayRatelimiter: rateLimiter,
-		connRRL:          srLimiter,
-		connWRL:          swLimiter,
-		connData:         make(chan []byte, 128),
-	}
-
+		exitSig:           make(chan struct{}),
+		peerMap:           pm,
+		certAuthenticated: certAuthenticated,
+		networkContext:    networkCtx,
+		id:                disco.PeerID(peerID),
+		remoteAddr:        r.RemoteAddr,
+		nonce:             nonce,
+		relayRatelimiter:  rateLimiter,
+		connRRL:           srLimiter,
+		connWRL:           swLimiter,
+		connData:          make(chan []byte, 128),
+		connectTime:       time.Now(),
+		version:           r.Header.Get("X-Client-Version"),
+		capabilities:      disco.ParseCapabilities(r.Header.Get("X-Capabilities")),
+	}
+
+	peer.networkSecret.Store(&jsonSecret)
+	peer.secret.Store(&networkSecrest)
 	peer.metadata = url.Values{}
 	metadata := r.Header.Get("X-Metadata")
 	if len(metadata) > 0 {
@@ -746,20 +1510,79 @@ func (pm *PeerMap) HandlePeerPacketConnect(w http.ResponseWriter, r *http.Reques
 		}
 		peer.metadata = meta
 	}
+	if jsonSecret.HasScope(auth.ScopeSilence) {
+		peer.metadata.Set("silenceMode", "")
+	}
+	disco.SetPeerTags(peer.metadata, jsonSecret.ACLTags()) // the tags claimed by the peer are ignored
+
+	keyProven, err := pm.checkPeerID(w, r, networkCtx, jsonSecret.User, disco.PeerID(peerID), peer.capabilities)
+	if errors.Is(err, errPeerKeyProofMissing) && pm.cfg.PeerIDBinding != PeerIDBindingKey {
+		slog.Debug("PeerKey challenged", "network", jsonSecret.Network, "peer", peerID)
+		return
+	}
+	if err != nil {
+		pm.emitConnect(r, connectMethod(certAuthenticated), jsonSecret, err)
+		slog.Info("PeerID refused", "network", jsonSecret.Network, "user", jsonSecret.User, "peer", peerID, "err", err)
+		return
+	}
+	peer.keyProven = keyProven
 
-	if ok := networkCtx.SetIfAbsent(peerID, &peer); !ok {
-		slog.Debug("Address is already in used", "addr", peerID)
+	enrolled, err := networkCtx.enrollDevice(jsonSecret.User, disco.PeerID(peerID), pm.cfg.MaxDevicesPerUser)
+	if err != nil {
+		pm.emitConnect(r, connectMethod(certAuthenticated), jsonSecret, err)
+		slog.Info("Device refused", "network", jsonSecret.Network, "user", jsonSecret.User, "peer", peerID, "err", err)
 		w.WriteHeader(http.StatusForbidden)
-		ErrAddressAlreadyInuse.MarshalTo(w)
+		json.NewEncoder(w).Encode(err)
+		return
+	}
+
+	if err := networkCtx.SetIfAbsent(peerID, &peer); err != nil {
+		if enrolled {
+			networkCtx.unenrollDevice(disco.PeerID(peerID))
+		}
+		span.SetError(err)
+		slog.Debug("Join network refused", "network", jsonSecret.Network, "peer", peerID, "err", err)
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(err)
 		return
 	}
 	pm.peerMapMutex.Lock()
 	pm.peerMap[peerID] = networkCtx
 	pm.peerMapMutex.Unlock()
+	// rollback forgets the peer and the device enrolled by this connection once it failed to upgrade
+	rollback := func() {
+		if networkCtx.removePeerConn(&peer) {
+			pm.peerMapMutex.Lock()
+			if pm.peerMap[peerID] == networkCtx {
+				delete(pm.peerMap, peerID)
+			}
+			pm.peerMapMutex.Unlock()
+		}
+		if enrolled {
+			networkCtx.unenrollDevice(disco.PeerID(peerID))
+		}
+	}
 	upgradeHeader := http.Header{}
 	upgradeHeader.Set("X-Nonce", r.Header.Get("X-Nonce"))
+	resumedSince, resumed := pm.resumptions.resume(r.Header.Get("X-Resume-Token"), jsonSecret.Network, disco.PeerID(peerID))
+	if resumed {
+		upgradeHeader.Set("X-Resumed", "true")
+	}
+	resumeToken, resumption := pm.resumptions.issue(jsonSecret.Network, disco.PeerID(peerID))
+	peer.resumption = resumption
+	upgradeHeader.Set("X-Resume-Token", resumeToken)
 	stuns, _ := json.Marshal(pm.cfg.STUNs)
 	upgradeHeader.Set("X-STUNs", base64.StdEncoding.EncodeToString(stuns))
+	cert, err := peer.issueCertificate()
+	if err != nil {
+		rollback()
+		span.SetError(err)
+		slog.Error("IssueCertificate", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	upgradeHeader.Set("X-Certificate", cert)
+	upgradeHeader.Set("X-CA", base64.StdEncoding.EncodeToString(pm.caKey.Public().(ed25519.PublicKey)))
 	if pm.cfg.RateLimiter != nil {
 		if pm.cfg.RateLimiter.Relay.Limit > 0 {
 			upgradeHeader.Set("X-Limiter-Burst", fmt.Sprintf("%d", pm.cfg.RateLimiter.Relay.Burst))
@@ -772,49 +1595,81 @@ func (pm *PeerMap) HandlePeerPacketConnect(w http.ResponseWriter, r *http.Reques
 	}
 	wsConn, err := pm.wsUpgrader.Upgrade(w, r, upgradeHeader)
 	if err != nil {
+		rollback()
+		pm.upgradeFailures.Add(1)
+		span.SetError(err)
 		slog.Error(err.Error())
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 	peer.conn = wsConn
-	peer.start()
-	slog.Debug("PeerConnected", "network", jsonSecret.Network, "peer", peerID)
+	pm.emitConnect(r, connectMethod(certAuthenticated), jsonSecret, nil)
+	peer.start(resumedSince)
+	peer.networkContext.churn.Add(1)
+	stat := peer.Stat()
+	pm.stream.publish(exporter.Event{Type: exporter.EventPeerJoined, Network: jsonSecret.Network, Peer: &stat})
+	if time.Now().Unix() >= jsonSecret.Deadline { // joined by the rotated secret
+		peer.updateSecret()
+	}
+	slog.Debug("PeerConnected", "network", jsonSecret.Network, "peer", peerID, "resumed", resumed)
 }
 
+// watchSaveCycle saves the networks state every save interval and on SIGHUP, so that the state
+// survives the crash
 func (pm *PeerMap) watchSaveCycle(ctx context.Context) {
+	defer crash.Recover("peermap/savecycle")
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGHUP)
+	defer signal.Stop(sig)
+	ticker := time.NewTicker(pm.cfg.SaveInterval)
+	defer ticker.Stop()
 	for {
-		sig := make(chan os.Signal, 2)
-		signal.Notify(sig, syscall.SIGHUP)
 		select {
 		case <-ctx.Done():
-			close(sig)
 			return
 		case <-sig:
-			close(sig)
-			if err := pm.Save(); err != nil {
-				slog.Error("Save networks", "err", err)
-			}
+		case <-ticker.C:
+		}
+		if err := pm.Save(); err != nil {
+			slog.Error("Save networks", "err", err)
 		}
 	}
 }
 
 func (pm *PeerMap) newNetworkContext(state NetState) *networkContext {
-	return &networkContext{
+	devices := make(map[string]*exporter.Device)
+	for _, device := range state.Devices {
+		devices[device.PeerID] = &device
+	}
+	ctx := &networkContext{
+		devices:         devices,
 		id:              state.ID,
 		peers:           make(map[string]*peerConn),
-		disoRatelimiter: rate.NewLimiter(rate.Limit(10*1024), 128*1024),
+		disoRatelimiter: rate.NewLimiter(defaultDiscoLimit, defaultDiscoBurst),
 		createTime:      state.CreateTime,
 		updateTime:      state.UpdateTime,
 		alias:           state.Alias,
 		neighbors:       state.Neighbors,
 	}
+	if state.Quota != nil {
+		ctx.setQuota(*state.Quota)
+	}
+	if state.ACL != nil {
+		ctx.acl = *state.ACL
+	}
+	return ctx
 }
 
 func (pm *PeerMap) generateSecret(n auth.Net) (disco.NetworkSecret, error) {
-	secret, err := auth.NewAuthenticator(pm.cfg.SecretKey).GenerateSecret(n, pm.cfg.SecretValidityPeriod)
+	_, span := tracing.Start(context.Background(), "peermap.secret.issue", "network", n.ID, "user", n.User)
+	defer span.End()
+	secret, err := pm.authenticator.GenerateSecret(n, pm.cfg.SecretValidityPeriod)
 	if err != nil {
+		span.SetError(err)
+		pm.events.Emit(audit.Event{Type: audit.EventSecretIssued, Outcome: audit.OutcomeFailure, User: n.User, Network: n.ID, Reason: err.Error()})
 		return disco.NetworkSecret{}, err
 	}
+	pm.events.Emit(audit.Event{Type: audit.EventSecretIssued, Outcome: audit.OutcomeSuccess, User: n.User, Network: n.ID})
 	return disco.NetworkSecret{
 		Network: n.ID,
 		Secret:  secret,
@@ -822,15 +1677,53 @@ func (pm *PeerMap) generateSecret(n auth.Net) (disco.NetworkSecret, error) {
 	}, nil
 }
 
+// generateOIDCSecret issues the network secret to the oidc user, it fails if the network
+// requires the webauthn second factor which is only verified on the browser login
+func (pm *PeerMap) generateOIDCSecret(provider string, userInfo oidc.UserInfo) (disco.NetworkSecret, error) {
+	if pm.secondFactorRequired(userInfo.Email) {
+		return disco.NetworkSecret{}, ErrSecondFactorRequired
+	}
+	return pm.issueOIDCSecret(provider, userInfo)
+}
+
+// issueOIDCSecret generates the network secret for the oidc user,
+// the refresh token is attached for renewing the secret silently
+func (pm *PeerMap) issueOIDCSecret(provider string, userInfo oidc.UserInfo) (disco.NetworkSecret, error) {
+	n := auth.Net{ID: userInfo.Email, User: userInfo.Email}
+	if ctx, ok := pm.getNetwork(userInfo.Email); ok {
+		n.Alias = ctx.alias
+		n.Neighbors = ctx.neighbors
+	}
+	secret, err := pm.generateSecret(n)
+	if err != nil {
+		return disco.NetworkSecret{}, err
+	}
+	if userInfo.RefreshToken != "" {
+		secret.RefreshToken, err = pm.authenticator.GenerateRefreshToken(provider, userInfo.RefreshToken)
+		if err != nil {
+			return disco.NetworkSecret{}, err
+		}
+	}
+	return secret, nil
+}
+
 func (pm *PeerMap) checkAdminToken(w http.ResponseWriter, r *http.Request) error {
 	exporterToken := r.Header.Get("X-Token")
-	_, err := pm.exporterAuthenticator.CheckToken(exporterToken)
+	ins, err := pm.exporterAuthenticator.CheckToken(exporterToken)
 	if err != nil {
 		err = fmt.Errorf("exporter auth: %w", err)
+		pm.emitLogin(r, "admin_token", "", "", err)
 		slog.Debug("ExporterAuthFailed", "err", err)
 		w.WriteHeader(http.StatusUnauthorized)
 		return err
 	}
+	if ins.Scope == exporterauth.ScopeExporter && r.Method != http.MethodGet {
+		err = fmt.Errorf("exporter auth: %s %s is not allowed by the exporter token", r.Method, r.URL.Path)
+		pm.emitLogin(r, "admin_token", "", "", err)
+		slog.Debug("ExporterAuthFailed", "err", err)
+		w.WriteHeader(http.StatusForbidden)
+		return err
+	}
 	return nil
 }
 
@@ -839,26 +1732,114 @@ func New(cfg Config) (*PeerMap, error) {
 		return nil, err
 	}
 
+	// the ca key is derived from the secret key, so that all peermap
+	// servers share the same secret key issue the same certificates
+	caSeed := sha256.Sum256([]byte("pgca" + cfg.SecretKey.Current()))
+
+	stateKeys, err := cfg.stateKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	identitySeed := sha256.Sum256([]byte("pgidentity" + cfg.SecretKey.Current()))
+	identityKey, err := secure.Curve25519PrivateKey(base58.Encode(identitySeed[:]))
+	if err != nil {
+		return nil, err
+	}
+	challengeKey := sha256.Sum256([]byte("pgchallenge" + cfg.SecretKey.Current()))
+
+	store, err := newStateStore(&cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	pm := PeerMap{
+		caKey:                 ed25519.NewKeyFromSeed(caSeed[:]),
+		identityKey:           identityKey,
+		challengeKey:          challengeKey[:],
 		wsUpgrader:            &websocket.Upgrader{},
 		networkMap:            make(map[string]*networkContext),
 		peerMap:               make(map[string]*networkContext),
-		authenticator:         auth.NewAuthenticator(cfg.SecretKey),
-		exporterAuthenticator: exporterauth.New(cfg.SecretKey),
+		authenticator:         auth.NewAuthenticator(cfg.SecretKey.Current(), cfg.SecretKey.Previous()...).SignSecrets(cfg.SignedSecrets),
+		exporterAuthenticator: exporterauth.New(cfg.SecretKey.Current()),
 		cfg:                   cfg,
+		rotatedSecrets:        make(map[string]rotatedSecret),
+		revocations:           newRevocations(cfg.RevocationFile, stateKeys, cfg.PlaintextState),
+		stream:                newEventStream(),
+		history:               newHistory(cfg.HistoryRetention, cfg.HistoryFile, stateKeys, cfg.PlaintextState),
+		stateKeys:             stateKeys,
+		store:                 store,
+		secondFactorSessions:  make(map[string]*secondFactorSession),
+		loginLimiter:          newLoginLimiter(),
+		resumptions:           newResumptions(),
+	}
+	if cfg.Alerts != nil {
+		if pm.alerts, err = alert.New(*cfg.Alerts); err != nil {
+			return nil, err
+		}
+	}
+	for _, c := range cfg.Canaries {
+		pm.canaries = append(pm.canaries, &canary{cfg: c, pm: &pm, probes: make(map[disco.PeerID]*exporter.CanaryProbe)})
+	}
+	if cfg.Cluster != nil {
+		pm.cluster = newCluster(&pm, *cfg.Cluster)
+	}
+	if cfg.AuthEvents != nil {
+		if pm.events, err = audit.New(*cfg.AuthEvents); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.WebAuthn != nil {
+		pm.webauthnCredentials = newWebAuthnCredentials(cfg.WebAuthn.CredentialFile, stateKeys, cfg.PlaintextState)
 	}
 
 	mux := http.NewServeMux()
 	pm.httpServer = &http.Server{Handler: mux, Addr: cfg.Listen}
+	pm.httpServer.RegisterOnShutdown(pm.stream.close)
+	if cfg.TLS != nil {
+		if pm.httpServer.TLSConfig, err = cfg.TLS.serverTLSConfig(); err != nil {
+			return nil, err
+		}
+	}
 	mux.HandleFunc("GET /pg", pm.HandlePeerPacketConnect)
+	mux.HandleFunc("GET /metrics", pm.HandleMetrics)
+	mux.HandleFunc("GET /pg/ca", pm.HandleGetCA)
+	mux.HandleFunc("GET /pg/jwks", pm.HandleGetJWKS)
 	mux.HandleFunc("GET /pg/networks", pm.HandleQueryNetworks)
 	mux.HandleFunc("GET /pg/peers", pm.HandleQueryNetworkPeers)
+	mux.HandleFunc("GET /pg/history", pm.HandleQueryHistory)
+	mux.HandleFunc("GET /pg/events", pm.HandleEvents)
+	mux.HandleFunc("GET /pg/canaries", pm.HandleQueryCanaries)
+	mux.HandleFunc("GET /pg/versions", pm.HandleQueryVersions)
+	mux.HandleFunc("GET /pg/cluster", pm.HandleCluster)
 	mux.HandleFunc("GET /pg/networks/{network}/meta", pm.HandleGetNetworkMeta)
 	mux.HandleFunc("PUT /pg/networks/{network}/meta", pm.HandlePutNetworkMeta)
+	mux.HandleFunc("DELETE /pg/networks/{network}", pm.HandleDeleteNetwork)
+	mux.HandleFunc("POST /pg/networks/{network}/rotate", pm.HandleRotateNetworkSecrets)
+	mux.HandleFunc("GET /pg/networks/{network}/quota", pm.HandleGetNetworkQuota)
+	mux.HandleFunc("PUT /pg/networks/{network}/quota", pm.HandlePutNetworkQuota)
+	mux.HandleFunc("GET /pg/networks/{network}/acl", pm.HandleGetNetworkACL)
+	mux.HandleFunc("PUT /pg/networks/{network}/acl", pm.HandlePutNetworkACL)
+	mux.HandleFunc("DELETE /pg/peers/{peer}", pm.HandleKickPeer)
+	mux.HandleFunc("GET /pg/bans", pm.HandleQueryBans)
+	mux.HandleFunc("POST /pg/bans", pm.HandleBan)
+	mux.HandleFunc("DELETE /pg/bans", pm.HandleUnban)
+	mux.HandleFunc("GET /pg/devices", pm.HandleQueryDevices)
+	mux.HandleFunc("DELETE /pg/devices/{peer}", pm.HandleRevokeDevice)
+	mux.HandleFunc("POST /pg/revoke", pm.HandleRevoke)
+	mux.HandleFunc("POST /pg/logout", pm.HandleLogout)
+	mux.HandleFunc("POST /pg/webauthn/{user}/enrollment", pm.HandleGrantWebAuthnEnrollment)
+	mux.HandleFunc("DELETE /pg/webauthn/{user}", pm.HandleResetWebAuthn)
 
 	mux.HandleFunc("GET /oidc", oidc.OIDCSelector)
 	mux.HandleFunc("GET /oidc/secret", oidc.OIDCSecret)
 	mux.HandleFunc("GET /oidc/{provider}", oidc.OIDCAuthURL)
 	mux.HandleFunc("GET /oidc/authorize/{provider}", pm.HandleOIDCAuthorize)
+	mux.HandleFunc("POST /oidc/webauthn/{session}", pm.HandleSecondFactor)
+	mux.HandleFunc("POST /oidc/device", pm.HandleOIDCDeviceAuthorize)
+	mux.HandleFunc("POST /oidc/device/{provider}", pm.HandleOIDCDeviceAuthorize)
+	mux.HandleFunc("GET /oidc/device/token", oidc.OIDCDeviceToken)
+	mux.HandleFunc("POST /oidc/refresh", pm.HandleOIDCRefresh)
+	mux.HandleFunc("POST /ldap/login", pm.HandleLDAPLogin)
 	return &pm, nil
 }
@@ -0,0 +1,72 @@
+package peermap
+
+import (
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/rkonfj/peerguard/peermap/exporter"
+)
+
+const (
+	// qualityReportTTL is how long the quality report of the peer is valid, the peers report every 30s by default
+	qualityReportTTL = 3 * time.Minute
+	// qualityReportLimit caps the links of the report kept
+	qualityReportLimit = 256
+)
+
+type qualityReport struct {
+	time  time.Time
+	links []exporter.LinkQuality
+}
+
+// updateQuality keeps the connection quality to the other peers reported by the peer
+func (p *peerConn) updateQuality(b []byte) {
+	var links []exporter.LinkQuality
+	if err := json.Unmarshal(b, &links); err != nil {
+		slog.Debug("QualityReport", "peer", p.id, "err", err)
+		return
+	}
+	if len(links) > qualityReportLimit {
+		links = links[:qualityReportLimit]
+	}
+	p.quality.Store(&qualityReport{time: time.Now(), links: links})
+}
+
+// links returns the links reported by the peer recently
+func (p *peerConn) links() []exporter.LinkQuality {
+	report := p.quality.Load()
+	if report == nil || time.Since(report.time) > qualityReportTTL {
+		return nil
+	}
+	return report.links
+}
+
+// aggregateQuality averages the scores of the links, nil if there is no link
+func aggregateQuality(links []exporter.LinkQuality) *exporter.Quality {
+	if len(links) == 0 {
+		return nil
+	}
+	var q exporter.Quality
+	var sum int
+	for _, link := range links {
+		sum += link.Score
+		if link.Relayed {
+			q.Relayed++
+		}
+	}
+	q.Links = len(links)
+	q.Score = sum / len(links)
+	return &q
+}
+
+// quality aggregates the links reported by the peers of the network
+func (ctx *networkContext) quality() *exporter.Quality {
+	ctx.peersMutex.RLock()
+	defer ctx.peersMutex.RUnlock()
+	var links []exporter.LinkQuality
+	for _, peer := range ctx.peers {
+		links = append(links, peer.links()...)
+	}
+	return aggregateQuality(links)
+}
@@ -0,0 +1,91 @@
+package peermap
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/rkonfj/peerguard/disco"
+	"github.com/rkonfj/peerguard/peermap/exporter"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// defaultDiscoLimit and defaultDiscoBurst limit the discovery messages of the network
+	// unless the quota sets them
+	defaultDiscoLimit = rate.Limit(10 * 1024)
+	defaultDiscoBurst = 128 * 1024
+)
+
+var ErrNetworkQuotaExceeded = disco.Error{Code: 4039, Msg: "the peer quota of the network is exceeded"}
+
+func (ctx *networkContext) getQuota() exporter.NetworkQuota {
+	ctx.metaMutex.Lock()
+	defer ctx.metaMutex.Unlock()
+	return ctx.quota
+}
+
+func (ctx *networkContext) setQuota(quota exporter.NetworkQuota) {
+	ctx.metaMutex.Lock()
+	defer ctx.metaMutex.Unlock()
+	ctx.quota = quota
+	if quota.DiscoLimit > 0 {
+		ctx.disoRatelimiter.SetLimit(rate.Limit(quota.DiscoLimit))
+		ctx.disoRatelimiter.SetBurst(max(quota.DiscoBurst, quota.DiscoLimit))
+	} else {
+		ctx.disoRatelimiter.SetLimit(defaultDiscoLimit)
+		ctx.disoRatelimiter.SetBurst(defaultDiscoBurst)
+	}
+	if quota.RelayLimit <= 0 {
+		ctx.relayRatelimiter.Store(nil)
+		return
+	}
+	ctx.relayRatelimiter.Store(rate.NewLimiter(rate.Limit(quota.RelayLimit), max(quota.RelayBurst, quota.RelayLimit)))
+}
+
+// HandleGetNetworkQuota returns the quota of the network
+func (pm *PeerMap) HandleGetNetworkQuota(w http.ResponseWriter, r *http.Request) {
+	if err := pm.checkAdminToken(w, r); err != nil {
+		return
+	}
+	ctx, ok := pm.getNetwork(r.PathValue("network"))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(ctx.getQuota())
+}
+
+// HandlePutNetworkQuota replaces the quota of the network, the connected peers
+// exceeded the max peers are kept
+func (pm *PeerMap) HandlePutNetworkQuota(w http.ResponseWriter, r *http.Request) {
+	if err := pm.checkAdminToken(w, r); err != nil {
+		return
+	}
+	var request exporter.NetworkQuota
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil ||
+		request.MaxPeers < 0 || request.RelayLimit < 0 || request.RelayBurst < 0 ||
+		request.DiscoLimit < 0 || request.DiscoBurst < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	ctx, ok := pm.getNetwork(r.PathValue("network"))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	ctx.setQuota(request)
+	pm.stream.publish(exporter.Event{Type: exporter.EventNetworkQuotaChanged, Network: ctx.id, Quota: &request})
+	slog.Info("NetworkQuotaUpdated", "network", ctx.id, "maxPeers", request.MaxPeers,
+		"relayLimit", request.RelayLimit, "relayBurst", request.RelayBurst,
+		"discoLimit", request.DiscoLimit, "discoBurst", request.DiscoBurst)
+}
+
+// quotaState returns nil if the network is unlimited
+func (ctx *networkContext) quotaState() *exporter.NetworkQuota {
+	quota := ctx.getQuota()
+	if quota == (exporter.NetworkQuota{}) {
+		return nil
+	}
+	return &quota
+}
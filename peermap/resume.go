@@ -0,0 +1,73 @@
+package peermap
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/rkonfj/peerguard/disco"
+	"github.com/rkonfj/peerguard/lru"
+)
+
+// resumeWindow is how long the session of the disconnected peer can be resumed
+const resumeWindow = 2 * time.Minute
+
+// resumption is the session of the peer, the peer resumes it by the token once reconnected
+type resumption struct {
+	network  string
+	peerID   disco.PeerID
+	leftTime time.Time // zero while the peer is connected
+}
+
+// resumptions are the sessions can be resumed. The other peers keep the state of the peer
+// disconnected (the peermap never tells them the peer left), so the resumed peer is introduced
+// only to the peers joined since it left rather than to all the peers again
+type resumptions struct {
+	mut      sync.Mutex
+	sessions *lru.Cache[string, *resumption]
+}
+
+func newResumptions() *resumptions {
+	return &resumptions{sessions: lru.New[string, *resumption](4096)}
+}
+
+// issue issues the token of the session of the peer
+func (r *resumptions) issue(network string, peerID disco.PeerID) (string, *resumption) {
+	b := make([]byte, 16)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+	s := &resumption{network: network, peerID: peerID}
+	r.mut.Lock()
+	r.sessions.Put(token, s)
+	r.mut.Unlock()
+	return token, s
+}
+
+// resume consumes the token, the time the peer left is returned if the session is resumed
+func (r *resumptions) resume(token, network string, peerID disco.PeerID) (time.Time, bool) {
+	if token == "" {
+		return time.Time{}, false
+	}
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	s, ok := r.sessions.Get(token)
+	if !ok || s == nil || s.network != network || s.peerID != peerID {
+		return time.Time{}, false
+	}
+	r.sessions.Put(token, nil)
+	if s.leftTime.IsZero() || time.Since(s.leftTime) > resumeWindow {
+		return time.Time{}, false
+	}
+	return s.leftTime, true
+}
+
+// left starts the resume window of the session
+func (r *resumptions) left(s *resumption) {
+	if s == nil {
+		return
+	}
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	s.leftTime = time.Now()
+}
@@ -0,0 +1,253 @@
+package peermap
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rkonfj/peerguard/disco"
+	"github.com/rkonfj/peerguard/peermap/audit"
+	"github.com/rkonfj/peerguard/peermap/auth"
+)
+
+var ErrNetworkSecretRevoked = disco.Error{Code: 4034, Msg: "network secret is revoked"}
+
+// revocations are the revoked network secrets, persisted so that they survive restarts
+type revocations struct {
+	mutex     sync.RWMutex
+	file      string
+	keys      [][]byte
+	plaintext bool
+
+	// Users revokes the secrets issued to the user before the time
+	Users map[string]int64 `json:"users"`
+	// Peers revokes the secrets issued before the time used by the peer
+	Peers map[string]int64 `json:"peers"`
+	// Secrets revokes the secrets (sha256) until they expire
+	Secrets map[string]int64 `json:"secrets"`
+	// Networks revokes the secrets of the network issued before the time
+	Networks map[string]int64 `json:"networks"`
+	// Bans refuses the peers (peer id, ip or cidr) until the time, 0 is forever
+	Bans map[string]int64 `json:"bans"`
+}
+
+func newRevocations(file string, keys [][]byte, plaintext bool) *revocations {
+	return &revocations{
+		file:      file,
+		keys:      keys,
+		plaintext: plaintext,
+		Users:     make(map[string]int64),
+		Peers:     make(map[string]int64),
+		Secrets:   make(map[string]int64),
+		Networks:  make(map[string]int64),
+		Bans:      make(map[string]int64),
+	}
+}
+
+func secretDigest(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func (r *revocations) load() error {
+	b, err := readStateFile(r.file, r.keys)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("load: read revocation file: %w", err)
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err := json.Unmarshal(b, r); err != nil {
+		return fmt.Errorf("load: decode revocations: %w", err)
+	}
+	return nil
+}
+
+// save persists the revocations, the caller must hold the lock
+func (r *revocations) save() error {
+	now := time.Now().Unix()
+	for k, deadline := range r.Secrets {
+		if deadline < now {
+			delete(r.Secrets, k)
+		}
+	}
+	for k, deadline := range r.Bans {
+		if deadline > 0 && deadline < now {
+			delete(r.Bans, k)
+		}
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("save: encode revocations: %w", err)
+	}
+	if err := writeStateFile(r.file, b, r.keys, r.plaintext); err != nil {
+		return fmt.Errorf("save revocations: %w", err)
+	}
+	return nil
+}
+
+func (r *revocations) revoke(user, peerID string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := time.Now().Unix()
+	if user != "" {
+		r.Users[user] = now
+	}
+	if peerID != "" {
+		r.Peers[peerID] = now
+	}
+	return r.save()
+}
+
+func (r *revocations) revokeSecret(secret string, deadline int64) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.Secrets[secretDigest(secret)] = deadline
+	return r.save()
+}
+
+// revokeNetwork revokes the secrets of the network issued before now and the secrets (to their
+// deadlines) replaced by the rotation, the ones issued in this second are revoked by the latter
+func (r *revocations) revokeNetwork(network string, secrets map[string]int64) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.Networks[network] = time.Now().Unix()
+	for secret, deadline := range secrets {
+		r.Secrets[secretDigest(secret)] = deadline
+	}
+	return r.save()
+}
+
+// revoked reports whether the secret presented by the peer is revoked
+func (r *revocations) revoked(jsonSecret auth.JSONSecret, secret string, peerID disco.PeerID) bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if t, ok := r.Users[jsonSecret.User]; ok && jsonSecret.User != "" && jsonSecret.IssuedAt <= t {
+		return true
+	}
+	if t, ok := r.Peers[peerID.String()]; ok && jsonSecret.IssuedAt <= t {
+		return true
+	}
+	// the certificates and the public network have no secret issued
+	if t, ok := r.Networks[jsonSecret.Network]; ok && jsonSecret.IssuedAt > 0 && jsonSecret.IssuedAt < t {
+		return true
+	}
+	_, ok := r.Secrets[secretDigest(secret)]
+	return ok
+}
+
+// disconnectRevoked disconnects the peers using the revoked secrets
+func (pm *PeerMap) disconnectRevoked() {
+	var revoked []*peerConn
+	pm.networkMapMutex.RLock()
+	for _, ctx := range pm.networkMap {
+		ctx.peersMutex.RLock()
+		for _, p := range ctx.peers {
+			if pm.revocations.revoked(*p.networkSecret.Load(), *p.secret.Load(), p.id) {
+				revoked = append(revoked, p)
+			}
+		}
+		ctx.peersMutex.RUnlock()
+	}
+	pm.networkMapMutex.RUnlock()
+	for _, p := range revoked {
+		slog.Info("Disconnect the peer using the revoked secret", "network", p.networkSecret.Load().Network, "peer", p.id)
+		p.Close()
+	}
+}
+
+// HandleRevoke revokes all secrets issued to the user or used by the peer (device) so far
+func (pm *PeerMap) HandleRevoke(w http.ResponseWriter, r *http.Request) {
+	if err := pm.checkAdminToken(w, r); err != nil {
+		return
+	}
+	var request struct {
+		User   string `json:"user"`
+		PeerID string `json:"peerID"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.User == "" && request.PeerID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if request.PeerID != "" {
+		// the secret may be copied to another device, so revoke the secret itself as well
+		pm.peerMapMutex.RLock()
+		ctx, ok := pm.peerMap[request.PeerID]
+		pm.peerMapMutex.RUnlock()
+		if ok {
+			if p, ok := ctx.getPeer(disco.PeerID(request.PeerID)); ok {
+				if err := pm.revocations.revokeSecret(*p.secret.Load(), p.networkSecret.Load().Deadline); err != nil {
+					slog.Error("RevokeSecret", "err", err)
+				}
+			}
+		}
+	}
+	if err := pm.revocations.revoke(request.User, request.PeerID); err != nil {
+		slog.Error("Revoke", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	pm.events.Emit(audit.Event{
+		Type:       audit.EventSecretRevoked,
+		Outcome:    audit.OutcomeSuccess,
+		Method:     "admin_token",
+		User:       request.User,
+		PeerID:     request.PeerID,
+		RemoteAddr: r.RemoteAddr,
+		Reason:     "admin",
+	})
+	slog.Info("SecretsRevoked", "user", request.User, "peer", request.PeerID)
+	pm.disconnectRevoked()
+}
+
+// HandleLogout revokes the presented network secret, or all secrets issued to
+// the same user if all is true
+func (pm *PeerMap) HandleLogout(w http.ResponseWriter, r *http.Request) {
+	secret := r.Header.Get("X-Network")
+	jsonSecret, err := pm.authenticator.ParseSecret(secret)
+	if err != nil && !errors.Is(err, auth.ErrTokenExpired) {
+		pm.events.Emit(audit.Event{
+			Type:       audit.EventSecretRevoked,
+			Outcome:    audit.OutcomeFailure,
+			Method:     "secret",
+			RemoteAddr: r.RemoteAddr,
+			Reason:     "logout: " + err.Error(),
+		})
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Query().Get("all") == "true" && jsonSecret.User != "" {
+		err = pm.revocations.revoke(jsonSecret.User, "")
+	} else {
+		err = pm.revocations.revokeSecret(secret, jsonSecret.Deadline)
+	}
+	if err != nil {
+		slog.Error("Logout", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	reason := "logout"
+	if r.URL.Query().Get("all") == "true" {
+		reason = "logout_all"
+	}
+	pm.events.Emit(audit.Event{
+		Type:       audit.EventSecretRevoked,
+		Outcome:    audit.OutcomeSuccess,
+		Method:     "secret",
+		User:       jsonSecret.User,
+		Network:    jsonSecret.Network,
+		RemoteAddr: r.RemoteAddr,
+		Reason:     reason,
+	})
+	slog.Info("Logout", "network", jsonSecret.Network, "user", jsonSecret.User, "all", r.URL.Query().Get("all"))
+	pm.disconnectRevoked()
+}
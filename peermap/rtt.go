@@ -0,0 +1,61 @@
+package peermap
+
+import (
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/rkonfj/peerguard/peermap/exporter"
+)
+
+// pingPayload is the send time carried by the websocket ping, the peers echo it in the pong
+func pingPayload() []byte {
+	return strconv.AppendInt(nil, time.Now().UnixNano(), 10)
+}
+
+// updateRTT measures the round trip time by the pong echoing the ping payload. It is smoothed
+// like the srtt of tcp (7/8 of the last plus 1/8 of the sample) so a single slow pong does not
+// move the percentiles of the network much
+func (p *peerConn) updateRTT(appData string) {
+	sent, err := strconv.ParseInt(appData, 10, 64)
+	if err != nil { // the pong of the ping without the payload
+		return
+	}
+	sample := time.Since(time.Unix(0, sent))
+	if sample < 0 || sample > time.Minute {
+		return
+	}
+	srtt := time.Duration(p.rtt.Load())
+	if srtt == 0 {
+		srtt = sample
+	} else {
+		srtt += (sample - srtt) / 8
+	}
+	p.rtt.Store(int64(srtt))
+}
+
+// rttPercentiles is the percentiles of the rtt of the peers of the network, nil if none is measured
+func (ctx *networkContext) rttPercentiles() *exporter.RTTPercentiles {
+	ctx.peersMutex.RLock()
+	rtts := make([]time.Duration, 0, len(ctx.peers))
+	for _, peer := range ctx.peers {
+		if rtt := peer.rtt.Load(); rtt > 0 {
+			rtts = append(rtts, time.Duration(rtt))
+		}
+	}
+	ctx.peersMutex.RUnlock()
+	if len(rtts) == 0 {
+		return nil
+	}
+	slices.Sort(rtts)
+	percentile := func(p int) time.Duration {
+		return rtts[(len(rtts)-1)*p/100]
+	}
+	return &exporter.RTTPercentiles{
+		Peers: len(rtts),
+		P50:   percentile(50),
+		P90:   percentile(90),
+		P99:   percentile(99),
+		Max:   rtts[len(rtts)-1],
+	}
+}
@@ -0,0 +1,380 @@
+package peermap
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rkonfj/peerguard/peermap/oidc"
+	"github.com/rkonfj/peerguard/peermap/webauthn"
+	"storj.io/common/base58"
+)
+
+var ErrSecondFactorRequired = errors.New("the network requires the webauthn second factor, login in the browser")
+
+// webauthnCredentials are the webauthn credentials registered by the users, persisted with the state
+type webauthnCredentials struct {
+	mutex     sync.Mutex
+	file      string
+	keys      [][]byte
+	plaintext bool
+
+	Users map[string][]webauthn.Credential `json:"users"`
+	// Enrollments allow the users to register a credential before the time even if the enrollment is disabled
+	Enrollments map[string]int64 `json:"enrollments"`
+}
+
+func newWebAuthnCredentials(file string, keys [][]byte, plaintext bool) *webauthnCredentials {
+	return &webauthnCredentials{
+		file:        file,
+		keys:        keys,
+		plaintext:   plaintext,
+		Users:       make(map[string][]webauthn.Credential),
+		Enrollments: make(map[string]int64),
+	}
+}
+
+func (c *webauthnCredentials) load() error {
+	b, err := readStateFile(c.file, c.keys)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("load: read webauthn credential file: %w", err)
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := json.Unmarshal(b, c); err != nil {
+		return fmt.Errorf("load: decode webauthn credentials: %w", err)
+	}
+	return nil
+}
+
+// save persists the credentials, the caller must hold the lock
+func (c *webauthnCredentials) save() error {
+	now := time.Now().Unix()
+	for user, deadline := range c.Enrollments {
+		if deadline < now {
+			delete(c.Enrollments, user)
+		}
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("save: encode webauthn credentials: %w", err)
+	}
+	if err := writeStateFile(c.file, b, c.keys, c.plaintext); err != nil {
+		return fmt.Errorf("save webauthn credentials: %w", err)
+	}
+	return nil
+}
+
+func (c *webauthnCredentials) get(user string) []webauthn.Credential {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return slices.Clone(c.Users[user])
+}
+
+// enrollable reports whether the user is allowed to register a new credential
+func (c *webauthnCredentials) enrollable(user string, allowEnrollment bool) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if deadline, ok := c.Enrollments[user]; ok && time.Now().Unix() < deadline {
+		return true
+	}
+	return allowEnrollment && len(c.Users[user]) == 0
+}
+
+func (c *webauthnCredentials) register(user string, credential webauthn.Credential) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.Enrollments, user)
+	c.Users[user] = append(c.Users[user], credential)
+	return c.save()
+}
+
+// update stores the sign count of the credential after the assertion
+func (c *webauthnCredentials) update(user string, credential webauthn.Credential) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for i, cred := range c.Users[user] {
+		if slices.Equal(cred.ID, credential.ID) {
+			c.Users[user][i].SignCount = credential.SignCount
+		}
+	}
+	return c.save()
+}
+
+func (c *webauthnCredentials) grantEnrollment(user string, validDuration time.Duration) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.Enrollments[user] = time.Now().Add(validDuration).Unix()
+	return c.save()
+}
+
+func (c *webauthnCredentials) reset(user string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.Users, user)
+	return c.save()
+}
+
+// secondFactorSession is the webauthn ceremony pending after the oidc login
+type secondFactorSession struct {
+	state     string
+	provider  string
+	userInfo  oidc.UserInfo
+	challenge []byte
+	register  bool
+	expire    time.Time
+}
+
+// secondFactorRequired reports whether the network requires the webauthn assertion
+func (pm *PeerMap) secondFactorRequired(network string) bool {
+	return pm.cfg.WebAuthn != nil && pm.cfg.WebAuthn.Sensitive(network)
+}
+
+func (pm *PeerMap) newSecondFactorSession(state, provider string, userInfo oidc.UserInfo) (string, *secondFactorSession) {
+	pm.secondFactorSessionsMutex.Lock()
+	defer pm.secondFactorSessionsMutex.Unlock()
+	now := time.Now()
+	for id, session := range pm.secondFactorSessions {
+		if now.After(session.expire) {
+			delete(pm.secondFactorSessions, id)
+		}
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	id := base58.Encode(b)
+	session := &secondFactorSession{
+		state:     state,
+		provider:  provider,
+		userInfo:  userInfo,
+		challenge: webauthn.NewChallenge(),
+		register:  len(pm.webauthnCredentials.get(userInfo.Email)) == 0,
+		// the oidc secret waiting on the state times out in 2 minutes
+		expire: now.Add(2 * time.Minute),
+	}
+	pm.secondFactorSessions[id] = session
+	return id, session
+}
+
+// takeSecondFactorSession removes the session, so that each challenge is answered once
+func (pm *PeerMap) takeSecondFactorSession(id string) (*secondFactorSession, bool) {
+	pm.secondFactorSessionsMutex.Lock()
+	defer pm.secondFactorSessionsMutex.Unlock()
+	session, ok := pm.secondFactorSessions[id]
+	delete(pm.secondFactorSessions, id)
+	if !ok || time.Now().After(session.expire) {
+		return nil, false
+	}
+	return session, true
+}
+
+// startSecondFactor renders the webauthn page instead of releasing the network secret on the oidc callback
+func (pm *PeerMap) startSecondFactor(w http.ResponseWriter, state, provider string, userInfo oidc.UserInfo) {
+	id, session := pm.newSecondFactorSession(state, provider, userInfo)
+	if session.register && !pm.webauthnCredentials.enrollable(userInfo.Email, pm.cfg.WebAuthn.AllowEnrollment) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("webauthn: no security key is enrolled for " + userInfo.Email + ", ask the administrator to allow the enrollment"))
+		return
+	}
+	allowCredentials := []string{}
+	for _, cred := range pm.webauthnCredentials.get(userInfo.Email) {
+		allowCredentials = append(allowCredentials, base64.RawURLEncoding.EncodeToString(cred.ID))
+	}
+	w.Header().Set("Content-Type", "text/html")
+	err := secondFactorPage.Execute(w, map[string]any{
+		"Session":          id,
+		"Register":         session.register,
+		"Challenge":        base64.RawURLEncoding.EncodeToString(session.challenge),
+		"RPID":             pm.cfg.WebAuthn.RPID,
+		"RPName":           pm.cfg.WebAuthn.RPName,
+		"User":             userInfo.Email,
+		"AllowCredentials": allowCredentials,
+		"UserVerification": map[bool]string{true: "required", false: "preferred"}[pm.cfg.WebAuthn.RequireUserVerification],
+	})
+	if err != nil {
+		slog.Error("Render webauthn page", "err", err)
+	}
+}
+
+// HandleSecondFactor verifies the webauthn response of the page, then releases the network secret
+func (pm *PeerMap) HandleSecondFactor(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		ID                string `json:"id"`
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	session, ok := pm.takeSecondFactorSession(r.PathValue("session"))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("webauthn: session expired, login again"))
+		return
+	}
+	user := session.userInfo.Email
+	if err := pm.verifySecondFactor(session, request.ID, request.ClientDataJSON,
+		request.AttestationObject, request.AuthenticatorData, request.Signature); err != nil {
+		pm.emitLogin(r, "webauthn", session.provider, user, err)
+		slog.Info("WebAuthn verification failed", "user", user, "err", err)
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	pm.emitLogin(r, "webauthn", session.provider, user, nil)
+	// the refresh token is not issued, the secret is only renewed by the webauthn assertion again
+	session.userInfo.RefreshToken = ""
+	secret, err := pm.issueOIDCSecret(session.provider, session.userInfo)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err := oidc.NotifyToken(session.state, secret); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	slog.Info("WebAuthn verified", "user", user, "register", session.register)
+	w.Write([]byte("ok"))
+}
+
+func (pm *PeerMap) verifySecondFactor(session *secondFactorSession, id, clientDataJSON, attestationObject, authenticatorData, signature string) error {
+	user := session.userInfo.Email
+	decode := base64.RawURLEncoding.DecodeString
+	clientData, err := decode(clientDataJSON)
+	if err != nil {
+		return webauthn.ErrVerificationFailed
+	}
+	if session.register {
+		attestation, err := decode(attestationObject)
+		if err != nil {
+			return webauthn.ErrVerificationFailed
+		}
+		credential, err := pm.cfg.WebAuthn.VerifyRegistration(session.challenge, clientData, attestation)
+		if err != nil {
+			return err
+		}
+		if !pm.webauthnCredentials.enrollable(user, pm.cfg.WebAuthn.AllowEnrollment) {
+			return errors.New("webauthn: enrollment is not allowed")
+		}
+		return pm.webauthnCredentials.register(user, credential)
+	}
+	credentialID, err := decode(id)
+	if err != nil {
+		return webauthn.ErrVerificationFailed
+	}
+	authData, err := decode(authenticatorData)
+	if err != nil {
+		return webauthn.ErrVerificationFailed
+	}
+	sig, err := decode(signature)
+	if err != nil {
+		return webauthn.ErrVerificationFailed
+	}
+	for _, credential := range pm.webauthnCredentials.get(user) {
+		if !slices.Equal(credential.ID, credentialID) {
+			continue
+		}
+		if err := pm.cfg.WebAuthn.VerifyAssertion(session.challenge, &credential, clientData, authData, sig); err != nil {
+			return err
+		}
+		return pm.webauthnCredentials.update(user, credential)
+	}
+	return webauthn.ErrCredentialNotFound
+}
+
+// HandleGrantWebAuthnEnrollment allows the user to register a new security key on the next login
+func (pm *PeerMap) HandleGrantWebAuthnEnrollment(w http.ResponseWriter, r *http.Request) {
+	if err := pm.checkAdminToken(w, r); err != nil {
+		return
+	}
+	if pm.cfg.WebAuthn == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("webauthn: not enabled"))
+		return
+	}
+	if err := pm.webauthnCredentials.grantEnrollment(r.PathValue("user"), 24*time.Hour); err != nil {
+		slog.Error("Grant webauthn enrollment", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	slog.Info("WebAuthn enrollment granted", "user", r.PathValue("user"))
+}
+
+// HandleResetWebAuthn removes all security keys registered by the user
+func (pm *PeerMap) HandleResetWebAuthn(w http.ResponseWriter, r *http.Request) {
+	if err := pm.checkAdminToken(w, r); err != nil {
+		return
+	}
+	if pm.cfg.WebAuthn == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("webauthn: not enabled"))
+		return
+	}
+	if err := pm.webauthnCredentials.reset(r.PathValue("user")); err != nil {
+		slog.Error("Reset webauthn credentials", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	slog.Info("WebAuthn credentials reset", "user", r.PathValue("user"))
+}
+
+var secondFactorPage = template.Must(template.New("webauthn").Parse(`<!DOCTYPE html>
+<meta name="viewport" content="width=device-width, initial-scale=1.0">
+<style>body{font-size: 18px;line-height: 26px;margin: 0;padding: 10px}</style>
+<b>{{if .Register}}Register a security key{{else}}Verify with your security key{{end}} for {{.User}}</b>
+<p id="status">Waiting for the security key...</p>
+<button id="retry" style="display:none" onclick="run()">Retry</button>
+<script>
+const b64 = (buf) => btoa(String.fromCharCode(...new Uint8Array(buf))).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+const unb64 = (s) => Uint8Array.from(atob(s.replace(/-/g, "+").replace(/_/g, "/")), c => c.charCodeAt(0));
+const register = {{.Register}};
+const challenge = unb64({{.Challenge}});
+async function run() {
+  const status = document.getElementById("status");
+  document.getElementById("retry").style.display = "none";
+  try {
+    let body;
+    if (register) {
+      const cred = await navigator.credentials.create({publicKey: {
+        challenge: challenge,
+        rp: {id: {{.RPID}}, name: {{.RPName}}},
+        user: {id: new TextEncoder().encode({{.User}}), name: {{.User}}, displayName: {{.User}}},
+        pubKeyCredParams: [{type: "public-key", alg: -8}, {type: "public-key", alg: -7}],
+        authenticatorSelection: {userVerification: {{.UserVerification}}},
+        attestation: "none",
+      }});
+      body = {id: b64(cred.rawId), clientDataJSON: b64(cred.response.clientDataJSON), attestationObject: b64(cred.response.attestationObject)};
+    } else {
+      const cred = await navigator.credentials.get({publicKey: {
+        challenge: challenge,
+        rpId: {{.RPID}},
+        allowCredentials: {{.AllowCredentials}}.map(id => ({type: "public-key", id: unb64(id)})),
+        userVerification: {{.UserVerification}},
+      }});
+      body = {id: b64(cred.rawId), clientDataJSON: b64(cred.response.clientDataJSON),
+        authenticatorData: b64(cred.response.authenticatorData), signature: b64(cred.response.signature)};
+    }
+    const resp = await fetch("../webauthn/{{.Session}}", {method: "POST", body: JSON.stringify(body)});
+    status.textContent = resp.ok ? "ok" : await resp.text();
+  } catch (e) {
+    status.textContent = e.message;
+    document.getElementById("retry").style.display = "";
+  }
+}
+run();
+</script>
+`))
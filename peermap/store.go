@@ -0,0 +1,272 @@
+package peermap
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// errStateStoreNotOwner the state is saved by another pgmap server holding the lease of the store
+	errStateStoreNotOwner = errors.New("the state store is owned by another pgmap server")
+	// errStateStoreAcquired the lease of the store is taken over, the state saved by the previous
+	// owner is merged before saving
+	errStateStoreAcquired = errors.New("the state store is taken over")
+)
+
+// stateStore is where the state of the networks is saved, the state is sealed before saving. The
+// store is single-writer, only one pgmap server saves the state to it at a time
+type stateStore interface {
+	// load returns os.ErrNotExist if nothing is saved yet
+	load() ([]byte, error)
+	save(b []byte) error
+	String() string
+}
+
+// newStateStore opens the state_store url, the state_file is used if it is empty. Only the file and
+// the redis stores are built in, the embedded databases (bbolt, SQLite) are not dependencies of the tree
+func newStateStore(cfg *Config) (stateStore, error) {
+	if cfg.StateStore == "" {
+		return fileStore(cfg.StateFile), nil
+	}
+	u, err := url.Parse(cfg.StateStore)
+	if err != nil {
+		return nil, fmt.Errorf("state store: %w", err)
+	}
+	switch u.Scheme {
+	case "file":
+		return fileStore(u.Path), nil
+	case "redis", "rediss":
+		return newRedisStore(u, 3*cfg.SaveInterval)
+	}
+	return nil, fmt.Errorf("state store: unsupported scheme %s (file, redis or rediss)", u.Scheme)
+}
+
+// fileStore saves the state to the local file
+type fileStore string
+
+func (f fileStore) load() ([]byte, error) {
+	return os.ReadFile(string(f))
+}
+
+func (f fileStore) save(b []byte) error {
+	return writeFileAtomic(string(f), b)
+}
+
+func (f fileStore) String() string {
+	return "file:" + string(f)
+}
+
+// writeFileAtomic writes the file by renaming the temp file, the file is never half written
+// if the process crashed
+func writeFileAtomic(file string, b []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		return err
+	}
+	// the rename is durable once the directory is synced, not every platform supports it
+	if dir, err := os.Open(filepath.Dir(file)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// redisStore saves the state to the key of the redis (redis://[:password@]host:port[/db][?key=name]).
+// The pgmap servers of the HA deployment share it, but only the one holding the lease (the key
+// suffixed :owner) saves the state, the lease is renewed on every save. Once the owner stops saving
+// for the lease duration, the next server saving takes it over and merges the saved state first
+type redisStore struct {
+	addr     string
+	tls      bool
+	username string
+	password string
+	db       int
+	key      string
+	owner    string
+	lease    time.Duration
+}
+
+// redisSaveScript saves the state (ARGV[2]) if the lease (KEYS[2]) is held by the owner (ARGV[1]) and
+// renews it. The lease not held by anyone is acquired without saving, so that the state saved by the
+// previous owner is merged first
+const redisSaveScript = `local owner = redis.call('GET', KEYS[2])
+if owner and owner ~= ARGV[1] then
+	return redis.error_reply('NOTOWNER')
+end
+redis.call('SET', KEYS[2], ARGV[1], 'PX', ARGV[3])
+if not owner then
+	return 'ACQUIRED'
+end
+redis.call('SET', KEYS[1], ARGV[2])
+return 'SAVED'`
+
+func newRedisStore(u *url.URL, lease time.Duration) (*redisStore, error) {
+	owner := make([]byte, 16)
+	if _, err := rand.Read(owner); err != nil {
+		return nil, err
+	}
+	s := redisStore{addr: u.Host, tls: u.Scheme == "rediss", key: u.Query().Get("key"),
+		owner: hex.EncodeToString(owner), lease: lease}
+	if u.Port() == "" {
+		s.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		s.username = u.User.Username()
+		s.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		n, err := strconv.Atoi(db)
+		if err != nil {
+			return nil, fmt.Errorf("state store: invalid redis db %s", db)
+		}
+		s.db = n
+	}
+	if s.key == "" {
+		s.key = "peerguard:state"
+	}
+	return &s, nil
+}
+
+func (s *redisStore) load() ([]byte, error) {
+	reply, err := s.do("GET", s.key)
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, os.ErrNotExist
+	}
+	return reply, nil
+}
+
+func (s *redisStore) save(b []byte) error {
+	reply, err := s.do("EVAL", redisSaveScript, "2", s.key, s.key+":owner",
+		s.owner, string(b), strconv.FormatInt(s.lease.Milliseconds(), 10))
+	if err != nil {
+		if strings.Contains(err.Error(), "NOTOWNER") {
+			return errStateStoreNotOwner
+		}
+		return err
+	}
+	if string(reply) == "ACQUIRED" {
+		return errStateStoreAcquired
+	}
+	return nil
+}
+
+func (s *redisStore) String() string {
+	return fmt.Sprintf("redis:%s/%d/%s", s.addr, s.db, s.key)
+}
+
+// do runs the command on a new connection, the state is loaded and saved rarely
+func (s *redisStore) do(args ...string) ([]byte, error) {
+	dialer := net.Dialer{Timeout: 5 * time.Second}
+	var conn net.Conn
+	var err error
+	if s.tls {
+		host, _, _ := net.SplitHostPort(s.addr)
+		conn, err = tls.DialWithDialer(&dialer, "tcp", s.addr, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", s.addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(conn)
+	var cmds [][]string
+	if s.password != "" {
+		if s.username != "" {
+			cmds = append(cmds, []string{"AUTH", s.username, s.password})
+		} else {
+			cmds = append(cmds, []string{"AUTH", s.password})
+		}
+	}
+	if s.db != 0 {
+		cmds = append(cmds, []string{"SELECT", strconv.Itoa(s.db)})
+	}
+	cmds = append(cmds, args)
+	var reply []byte
+	for _, cmd := range cmds {
+		if _, err := conn.Write(redisCommand(cmd)); err != nil {
+			return nil, fmt.Errorf("redis: %w", err)
+		}
+		if reply, err = readRedisReply(r); err != nil {
+			return nil, fmt.Errorf("redis %s: %w", cmd[0], err)
+		}
+	}
+	return reply, nil
+}
+
+// redisCommand encodes the command as the array of the bulk strings (RESP)
+func redisCommand(args []string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return []byte(b.String())
+}
+
+// readRedisReply reads the simple string, the integer or the bulk string reply, nil if the bulk
+// string is null
+func readRedisReply(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty reply")
+	}
+	switch line[0] {
+	case '+', ':':
+		return []byte(line[1:]), nil
+	case '-':
+		return nil, errors.New(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+	return nil, fmt.Errorf("unexpected reply %q", line)
+}
@@ -0,0 +1,113 @@
+package peermap
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rkonfj/peerguard/peermap/exporter"
+)
+
+// eventStream fans out the events of the networks to the subscribers of /events,
+// the subscribers too slow to keep up are disconnected rather than blocking the signaling
+type eventStream struct {
+	mutex       sync.Mutex
+	subscribers map[chan exporter.Event]struct{}
+}
+
+func newEventStream() *eventStream {
+	return &eventStream{subscribers: make(map[chan exporter.Event]struct{})}
+}
+
+func (s *eventStream) publish(e exporter.Event) {
+	e.Time = time.Now()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for ch := range s.subscribers {
+		select {
+		case ch <- e:
+		default:
+			delete(s.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+func (s *eventStream) subscribe() chan exporter.Event {
+	ch := make(chan exporter.Event, 256)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.subscribers[ch] = struct{}{}
+	return ch
+}
+
+func (s *eventStream) unsubscribe(ch chan exporter.Event) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.subscribers[ch]; ok {
+		delete(s.subscribers, ch)
+		close(ch)
+	}
+}
+
+// close ends the streams, e.g. the server is shutting down
+func (s *eventStream) close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for ch := range s.subscribers {
+		delete(s.subscribers, ch)
+		close(ch)
+	}
+}
+
+// HandleEvents streams the events of the networks as the server-sent events, the query network
+// filters the network. The stream ends if the client is too slow to receive the events
+func (pm *PeerMap) HandleEvents(w http.ResponseWriter, r *http.Request) {
+	if err := pm.checkAdminToken(w, r); err != nil {
+		return
+	}
+	network := r.URL.Query().Get("network")
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	events := pm.stream.subscribe()
+	defer pm.stream.unsubscribe(events)
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case e, ok := <-events:
+			if !ok {
+				slog.Debug("EventsSubscriberDropped", "remote", r.RemoteAddr)
+				return
+			}
+			if network != "" && e.Network != network {
+				continue
+			}
+			b, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, b); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package peermap
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/rkonfj/peerguard/peermap/exporter"
+)
+
+// clientVersion is the version reported in the upgrade header, the older clients only put it in the metadata
+func (p *peerConn) clientVersion() string {
+	if p.version != "" {
+		return p.version
+	}
+	if v := p.metadata.Get("version"); v != "" {
+		return v
+	}
+	return "unknown"
+}
+
+// versionSummary counts the client versions and capabilities of the peers connected
+func (pm *PeerMap) versionSummary() exporter.VersionSummary {
+	summary := exporter.VersionSummary{
+		Versions:     make(map[string]int),
+		Capabilities: make(map[string]int),
+	}
+	pm.networkMapMutex.RLock()
+	defer pm.networkMapMutex.RUnlock()
+	for _, network := range pm.networkMap {
+		network.peersMutex.RLock()
+		for _, peer := range network.peers {
+			summary.Peers++
+			summary.Versions[peer.clientVersion()]++
+			for _, c := range peer.capabilities {
+				summary.Capabilities[c]++
+			}
+		}
+		network.peersMutex.RUnlock()
+	}
+	return summary
+}
+
+func (pm *PeerMap) HandleQueryVersions(w http.ResponseWriter, r *http.Request) {
+	if err := pm.checkAdminToken(w, r); err != nil {
+		return
+	}
+	json.NewEncoder(w).Encode(pm.versionSummary())
+}
@@ -0,0 +1,104 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+var errMalformed = errors.New("webauthn: malformed cbor")
+
+// decodeCBOR decodes the first cbor data item (RFC 8949) of b, it supports the subset used by
+// webauthn: integers (int64), byte and text strings, arrays, maps, simple values and floats.
+// Indefinite lengths and tags are not supported
+func decodeCBOR(b []byte) (v any, rest []byte, err error) {
+	if len(b) == 0 {
+		return nil, nil, errMalformed
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+	b = b[1:]
+	var arg uint64
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info == 24 && len(b) >= 1:
+		arg, b = uint64(b[0]), b[1:]
+	case info == 25 && len(b) >= 2:
+		arg, b = uint64(binary.BigEndian.Uint16(b)), b[2:]
+	case info == 26 && len(b) >= 4:
+		arg, b = uint64(binary.BigEndian.Uint32(b)), b[4:]
+	case info == 27 && len(b) >= 8:
+		arg, b = binary.BigEndian.Uint64(b), b[8:]
+	default:
+		return nil, nil, errMalformed
+	}
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, nil, errMalformed
+		}
+		return int64(arg), b, nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, nil, errMalformed
+		}
+		return -1 - int64(arg), b, nil
+	case 2, 3:
+		if uint64(len(b)) < arg {
+			return nil, nil, errMalformed
+		}
+		if major == 3 {
+			return string(b[:arg]), b[arg:], nil
+		}
+		return b[:arg], b[arg:], nil
+	case 4:
+		if uint64(len(b)) < arg { // each item is one byte at least
+			return nil, nil, errMalformed
+		}
+		items := make([]any, 0, arg)
+		for range arg {
+			if v, b, err = decodeCBOR(b); err != nil {
+				return nil, nil, err
+			}
+			items = append(items, v)
+		}
+		return items, b, nil
+	case 5:
+		if uint64(len(b)) < arg*2 {
+			return nil, nil, errMalformed
+		}
+		m := make(map[any]any, arg)
+		for range arg {
+			var k any
+			if k, b, err = decodeCBOR(b); err != nil {
+				return nil, nil, err
+			}
+			switch k.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errMalformed
+			}
+			if v, b, err = decodeCBOR(b); err != nil {
+				return nil, nil, err
+			}
+			m[k] = v
+		}
+		return m, b, nil
+	case 7:
+		switch info {
+		case 20:
+			return false, b, nil
+		case 21:
+			return true, b, nil
+		case 22, 23:
+			return nil, b, nil
+		case 25: // half precision is never used by webauthn, decoded as zero
+			return float64(0), b, nil
+		case 26:
+			return float64(math.Float32frombits(uint32(arg))), b, nil
+		case 27:
+			return math.Float64frombits(arg), b, nil
+		}
+	}
+	return nil, nil, errMalformed
+}
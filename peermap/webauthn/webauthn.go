@@ -0,0 +1,245 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"slices"
+	"time"
+)
+
+const (
+	flagUserPresent  byte = 0x01
+	flagUserVerified byte = 0x04
+	flagAttestedData byte = 0x40
+
+	coseKeyTypeOKP   = 1
+	coseKeyTypeEC2   = 2
+	coseAlgEdDSA     = -8
+	coseAlgES256     = -7
+	coseCurveP256    = 1
+	coseCurveEd25519 = 6
+)
+
+var (
+	ErrVerificationFailed = errors.New("webauthn: verification failed")
+	ErrCredentialNotFound = errors.New("webauthn: credential not found")
+)
+
+type WebAuthnConfig struct {
+	// Origin is the origin of the peermap server the browser sees, e.g. https://peermap.example.org
+	Origin string `yaml:"origin"`
+	// RPID is the relying party id, the host of the origin by default
+	RPID   string `yaml:"rp_id"`
+	RPName string `yaml:"rp_name"`
+	// SensitiveNetworks require the webauthn assertion after the oidc login, * matches all networks
+	SensitiveNetworks []string `yaml:"sensitive_networks"`
+	// AllowEnrollment lets the users without any credential register one right after the oidc login.
+	// Otherwise the credentials must be enrolled in advance
+	AllowEnrollment bool `yaml:"allow_enrollment"`
+	// RequireUserVerification requires the authenticator verified the user (pin or biometrics)
+	RequireUserVerification bool `yaml:"require_user_verification"`
+	// CredentialFile stores the registered credentials
+	CredentialFile string `yaml:"credential_file"`
+}
+
+// Credential is the public key credential registered by the user
+type Credential struct {
+	ID         []byte    `json:"id"`
+	PublicKey  []byte    `json:"publicKey"` // PKIX, ASN.1 DER
+	SignCount  uint32    `json:"signCount"`
+	CreateTime time.Time `json:"createTime"`
+}
+
+// Check validates the config and fills the defaults
+func (cfg *WebAuthnConfig) Check() error {
+	u, err := url.Parse(cfg.Origin)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("webauthn: invalid origin %q", cfg.Origin)
+	}
+	if cfg.RPID == "" {
+		cfg.RPID = u.Hostname()
+	}
+	if cfg.RPName == "" {
+		cfg.RPName = "PeerGuard"
+	}
+	if cfg.CredentialFile == "" {
+		cfg.CredentialFile = "webauthn.json"
+	}
+	return nil
+}
+
+// Sensitive reports whether the network requires the webauthn assertion
+func (cfg *WebAuthnConfig) Sensitive(network string) bool {
+	return slices.Contains(cfg.SensitiveNetworks, network) || slices.Contains(cfg.SensitiveNetworks, "*")
+}
+
+// NewChallenge generates the random challenge of the ceremony
+func NewChallenge() []byte {
+	challenge := make([]byte, 32)
+	rand.Read(challenge)
+	return challenge
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+func (cfg *WebAuthnConfig) checkClientData(clientDataJSON []byte, typ string, challenge []byte) error {
+	var data clientData
+	if err := json.Unmarshal(clientDataJSON, &data); err != nil {
+		return ErrVerificationFailed
+	}
+	c, err := base64.RawURLEncoding.DecodeString(data.Challenge)
+	if err != nil || data.Type != typ || subtle.ConstantTimeCompare(c, challenge) != 1 {
+		return ErrVerificationFailed
+	}
+	if data.Origin != cfg.Origin {
+		return fmt.Errorf("webauthn: origin %s mismatched", data.Origin)
+	}
+	return nil
+}
+
+// checkAuthenticatorData checks the rp id hash and the flags, returns the flags, sign count and the rest data
+func (cfg *WebAuthnConfig) checkAuthenticatorData(authData []byte) (byte, uint32, []byte, error) {
+	if len(authData) < 37 {
+		return 0, 0, nil, ErrVerificationFailed
+	}
+	rpIDHash := sha256.Sum256([]byte(cfg.RPID))
+	if !bytes.Equal(authData[:32], rpIDHash[:]) {
+		return 0, 0, nil, errors.New("webauthn: rp id mismatched")
+	}
+	flags := authData[32]
+	if flags&flagUserPresent == 0 {
+		return 0, 0, nil, errors.New("webauthn: user not present")
+	}
+	if cfg.RequireUserVerification && flags&flagUserVerified == 0 {
+		return 0, 0, nil, errors.New("webauthn: user not verified")
+	}
+	return flags, binary.BigEndian.Uint32(authData[33:37]), authData[37:], nil
+}
+
+// VerifyRegistration verifies the response of navigator.credentials.create and returns the new credential.
+// The attestation statement is not verified, any authenticator is accepted (attestation none)
+func (cfg *WebAuthnConfig) VerifyRegistration(challenge, clientDataJSON, attestationObject []byte) (Credential, error) {
+	if err := cfg.checkClientData(clientDataJSON, "webauthn.create", challenge); err != nil {
+		return Credential{}, err
+	}
+	v, _, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return Credential{}, err
+	}
+	attestation, ok := v.(map[any]any)
+	if !ok {
+		return Credential{}, errMalformed
+	}
+	authData, ok := attestation["authData"].([]byte)
+	if !ok {
+		return Credential{}, errMalformed
+	}
+	flags, signCount, rest, err := cfg.checkAuthenticatorData(authData)
+	if err != nil {
+		return Credential{}, err
+	}
+	if flags&flagAttestedData == 0 || len(rest) < 18 {
+		return Credential{}, errMalformed
+	}
+	idLen := int(binary.BigEndian.Uint16(rest[16:18])) // skip aaguid
+	if len(rest) < 18+idLen {
+		return Credential{}, errMalformed
+	}
+	credential := Credential{
+		ID:         slices.Clone(rest[18 : 18+idLen]),
+		SignCount:  signCount,
+		CreateTime: time.Now(),
+	}
+	coseKey, _, err := decodeCBOR(rest[18+idLen:])
+	if err != nil {
+		return Credential{}, err
+	}
+	pubKey, err := parseCOSEKey(coseKey)
+	if err != nil {
+		return Credential{}, err
+	}
+	if credential.PublicKey, err = x509.MarshalPKIXPublicKey(pubKey); err != nil {
+		return Credential{}, err
+	}
+	return credential, nil
+}
+
+// VerifyAssertion verifies the response of navigator.credentials.get signed by the credential,
+// the sign count of the credential is updated on success
+func (cfg *WebAuthnConfig) VerifyAssertion(challenge []byte, credential *Credential, clientDataJSON, authenticatorData, signature []byte) error {
+	if err := cfg.checkClientData(clientDataJSON, "webauthn.get", challenge); err != nil {
+		return err
+	}
+	_, signCount, _, err := cfg.checkAuthenticatorData(authenticatorData)
+	if err != nil {
+		return err
+	}
+	pubKey, err := x509.ParsePKIXPublicKey(credential.PublicKey)
+	if err != nil {
+		return err
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(slices.Clone(authenticatorData), clientDataHash[:]...)
+	switch k := pubKey.(type) {
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, signed, signature) {
+			return ErrVerificationFailed
+		}
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(signed)
+		if !ecdsa.VerifyASN1(k, digest[:], signature) {
+			return ErrVerificationFailed
+		}
+	default:
+		return ErrVerificationFailed
+	}
+	// a sign count not increased indicates the authenticator may be cloned
+	if (signCount != 0 || credential.SignCount != 0) && signCount <= credential.SignCount {
+		return errors.New("webauthn: sign count not increased, the authenticator may be cloned")
+	}
+	credential.SignCount = signCount
+	return nil
+}
+
+func parseCOSEKey(v any) (any, error) {
+	key, ok := v.(map[any]any)
+	if !ok {
+		return nil, errMalformed
+	}
+	kty, _ := key[int64(1)].(int64)
+	alg, _ := key[int64(3)].(int64)
+	crv, _ := key[int64(-1)].(int64)
+	x, _ := key[int64(-2)].([]byte)
+	switch {
+	case kty == coseKeyTypeOKP && alg == coseAlgEdDSA && crv == coseCurveEd25519 && len(x) == ed25519.PublicKeySize:
+		return ed25519.PublicKey(x), nil
+	case kty == coseKeyTypeEC2 && alg == coseAlgES256 && crv == coseCurveP256:
+		y, _ := key[int64(-3)].([]byte)
+		if len(x) != 32 || len(y) != 32 {
+			return nil, errMalformed
+		}
+		if _, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil { // not on the curve
+			return nil, errMalformed
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("webauthn: unsupported public key (kty %d, alg %d), ES256 or EdDSA is required", kty, alg)
+}
@@ -0,0 +1,209 @@
+package webauthn_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/rkonfj/peerguard/peermap/webauthn"
+)
+
+// the cbor encoding of the test authenticator, the map pairs are encoded in order
+func cborHead(major byte, n int) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n < 256:
+		return []byte{major<<5 | 24, byte(n)}
+	default:
+		return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+	}
+}
+
+func cborInt(n int) []byte {
+	if n < 0 {
+		return cborHead(1, -1-n)
+	}
+	return cborHead(0, n)
+}
+
+func cborBytes(b []byte) []byte { return append(cborHead(2, len(b)), b...) }
+
+func cborText(s string) []byte { return append(cborHead(3, len(s)), s...) }
+
+func cborMap(pairs ...[]byte) []byte {
+	return slices.Concat(append([][]byte{cborHead(5, len(pairs)/2)}, pairs...)...)
+}
+
+type authenticator struct {
+	signer    crypto.Signer
+	coseKey   []byte
+	id        []byte
+	signCount uint32
+}
+
+func newAuthenticator(t *testing.T, ed bool) *authenticator {
+	if ed {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &authenticator{signer: priv, id: []byte("ed25519"),
+			coseKey: cborMap(cborInt(1), cborInt(1), cborInt(3), cborInt(-8), cborInt(-1), cborInt(6), cborInt(-2), cborBytes(pub))}
+	}
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &authenticator{signer: priv, id: []byte("es256"),
+		coseKey: cborMap(cborInt(1), cborInt(2), cborInt(3), cborInt(-7), cborInt(-1), cborInt(1),
+			cborInt(-2), cborBytes(priv.X.FillBytes(make([]byte, 32))), cborInt(-3), cborBytes(priv.Y.FillBytes(make([]byte, 32))))}
+}
+
+func (a *authenticator) authData(rpID string, flags byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	return binary.BigEndian.AppendUint32(append(rpIDHash[:], flags), a.signCount)
+}
+
+func (a *authenticator) create(rpID string, flags byte) []byte {
+	authData := a.authData(rpID, flags|0x40)
+	authData = append(authData, make([]byte, 16)...) // aaguid
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(a.id)))
+	authData = slices.Concat(authData, a.id, a.coseKey)
+	return cborMap(cborText("fmt"), cborText("none"), cborText("attStmt"), cborMap(), cborText("authData"), cborBytes(authData))
+}
+
+func (a *authenticator) get(t *testing.T, rpID string, flags byte, clientDataJSON []byte) (authData, signature []byte) {
+	a.signCount++
+	authData = a.authData(rpID, flags)
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(slices.Clone(authData), clientDataHash[:]...)
+	var err error
+	if _, ok := a.signer.(ed25519.PrivateKey); ok {
+		signature, err = a.signer.Sign(rand.Reader, signed, crypto.Hash(0))
+	} else {
+		digest := sha256.Sum256(signed)
+		signature, err = a.signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return authData, signature
+}
+
+func clientData(typ string, challenge []byte, origin string) []byte {
+	b, _ := json.Marshal(map[string]string{
+		"type":      typ,
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":    origin,
+	})
+	return b
+}
+
+func newConfig(t *testing.T) *webauthn.WebAuthnConfig {
+	cfg := webauthn.WebAuthnConfig{Origin: "https://peermap.example.org"}
+	if err := cfg.Check(); err != nil {
+		t.Fatal(err)
+	}
+	return &cfg
+}
+
+func TestRegistrationAndAssertion(t *testing.T) {
+	cfg := newConfig(t)
+	for _, ed := range []bool{false, true} {
+		a := newAuthenticator(t, ed)
+		challenge := webauthn.NewChallenge()
+		credential, err := cfg.VerifyRegistration(challenge, clientData("webauthn.create", challenge, cfg.Origin), a.create(cfg.RPID, 0x01))
+		if err != nil {
+			t.Fatalf("ed25519 %v: %v", ed, err)
+		}
+		if string(credential.ID) != string(a.id) {
+			t.Errorf("expected the credential id %s, got %s", a.id, credential.ID)
+		}
+
+		challenge = webauthn.NewChallenge()
+		clientDataJSON := clientData("webauthn.get", challenge, cfg.Origin)
+		authData, signature := a.get(t, cfg.RPID, 0x01, clientDataJSON)
+		if err := cfg.VerifyAssertion(challenge, &credential, clientDataJSON, authData, signature); err != nil {
+			t.Fatalf("ed25519 %v: %v", ed, err)
+		}
+		if credential.SignCount != a.signCount {
+			t.Errorf("expected the sign count %d updated, got %d", a.signCount, credential.SignCount)
+		}
+		// the same assertion is replayed, the sign count is not increased
+		if err := cfg.VerifyAssertion(challenge, &credential, clientDataJSON, authData, signature); err == nil {
+			t.Errorf("ed25519 %v: expected the replayed assertion refused", ed)
+		}
+		signature[len(signature)-1] ^= 0xff
+		a.signCount++
+		if err := cfg.VerifyAssertion(challenge, &credential, clientDataJSON, authData, signature); !errors.Is(err, webauthn.ErrVerificationFailed) {
+			t.Errorf("ed25519 %v: expected the tampered signature refused, got %v", ed, err)
+		}
+	}
+}
+
+func TestAssertionRefused(t *testing.T) {
+	cfg := newConfig(t)
+	a := newAuthenticator(t, false)
+	challenge := webauthn.NewChallenge()
+	credential, err := cfg.VerifyRegistration(challenge, clientData("webauthn.create", challenge, cfg.Origin), a.create(cfg.RPID, 0x01))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, c := range map[string]struct {
+		clientDataJSON []byte
+		rpID           string
+		flags          byte
+		uv             bool
+	}{
+		"other challenge":      {clientDataJSON: clientData("webauthn.get", webauthn.NewChallenge(), cfg.Origin), rpID: cfg.RPID, flags: 0x01},
+		"other origin":         {clientDataJSON: clientData("webauthn.get", challenge, "https://evil.example.org"), rpID: cfg.RPID, flags: 0x01},
+		"create ceremony":      {clientDataJSON: clientData("webauthn.create", challenge, cfg.Origin), rpID: cfg.RPID, flags: 0x01},
+		"other rp id":          {clientDataJSON: clientData("webauthn.get", challenge, cfg.Origin), rpID: "evil.example.org", flags: 0x01},
+		"user not present":     {clientDataJSON: clientData("webauthn.get", challenge, cfg.Origin), rpID: cfg.RPID},
+		"user not verified":    {clientDataJSON: clientData("webauthn.get", challenge, cfg.Origin), rpID: cfg.RPID, flags: 0x01, uv: true},
+		"malformed clientdata": {clientDataJSON: []byte("{"), rpID: cfg.RPID, flags: 0x01},
+	} {
+		cfg.RequireUserVerification = c.uv
+		authData, signature := a.get(t, c.rpID, c.flags, c.clientDataJSON)
+		if err := cfg.VerifyAssertion(challenge, &credential, c.clientDataJSON, authData, signature); err == nil {
+			t.Errorf("%s: expected the assertion refused", name)
+		}
+	}
+}
+
+func TestRegistrationMalformed(t *testing.T) {
+	cfg := newConfig(t)
+	challenge := webauthn.NewChallenge()
+	clientDataJSON := clientData("webauthn.create", challenge, cfg.Origin)
+	valid := newAuthenticator(t, false).create(cfg.RPID, 0x01)
+	rsa := &authenticator{id: []byte("rs256"), coseKey: cborMap(cborInt(1), cborInt(3), cborInt(3), cborInt(-257))}
+	offCurve := &authenticator{id: []byte("es256"), coseKey: cborMap(cborInt(1), cborInt(2), cborInt(3), cborInt(-7),
+		cborInt(-1), cborInt(1), cborInt(-2), cborBytes(make([]byte, 32)), cborInt(-3), cborBytes(make([]byte, 32)))}
+	for name, attestationObject := range map[string][]byte{
+		"empty":              {},
+		"truncated":          valid[:len(valid)-1],
+		"not a map":          cborBytes(valid),
+		"indefinite length":  append([]byte{0xbf}, valid[1:]...),
+		"huge array":         {0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"huge map":           {0xbb, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"byte string key":    cborMap(cborBytes([]byte("authData")), cborBytes(make([]byte, 37))),
+		"tagged":             {0xc0, 0x60},
+		"no attested data":   cborMap(cborText("authData"), cborBytes(newAuthenticator(t, false).authData(cfg.RPID, 0x01))),
+		"unsupported key":    rsa.create(cfg.RPID, 0x01),
+		"point not on curve": offCurve.create(cfg.RPID, 0x01),
+	} {
+		if _, err := cfg.VerifyRegistration(challenge, clientDataJSON, attestationObject); err == nil {
+			t.Errorf("%s: expected the attestation object refused", name)
+		}
+	}
+}
@@ -246,7 +246,10 @@ func (c *rdtConn) resend(nck nck) {
 	}
 	c.sendMutex.Unlock()
 	defer func() { recover() }()
-	c.sendEvent <- struct{}{}
+	select { // wakes up the blocked Write, never blocks the nck loop if there is none
+	case c.sendEvent <- struct{}{}:
+	default:
+	}
 }
 
 func (c *rdtConn) send(pkt []byte) {
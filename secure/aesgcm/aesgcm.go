@@ -0,0 +1,84 @@
+package aesgcm
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/rkonfj/peerguard/secure"
+)
+
+var (
+	_ secure.SymmAlgo = (*AESGCM)(nil)
+	_ secure.KeyMixer = (*AESGCM)(nil)
+)
+
+type AESGCM struct {
+	sessions         *secure.Sessions
+	provideSecretKey secure.ProvideSecretKey
+}
+
+func (s *AESGCM) Encrypt(data []byte, pubKey string) ([]byte, error) {
+	if s == nil {
+		return nil, errors.New("enc is disabled")
+	}
+	return s.sessions.Seal(data, pubKey)
+}
+
+func (s *AESGCM) Decrypt(data []byte, pubKey string) ([]byte, error) {
+	if s == nil {
+		return nil, errors.New("dec is disabled")
+	}
+	plain, err := s.sessions.Open(data, pubKey)
+	if errors.Is(err, secure.ErrReplayedData) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, errors.New("invalid data")
+	}
+	return plain, nil
+}
+
+func (s *AESGCM) MixKey(pubKey string, secret []byte) error {
+	return s.sessions.MixKey(pubKey, secret)
+}
+
+func (s *AESGCM) MixEphemeral(pubKey string, secret []byte, initiator bool) error {
+	return s.sessions.MixEphemeral(pubKey, secret, initiator)
+}
+
+func (s *AESGCM) SecretKey() secure.ProvideSecretKey {
+	return s.provideSecretKey
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// New AES-256-GCM SymmAlgo. The key shared with the peer is separated from the one
+// used by other suites, so the same key is never used with two different ciphers
+func New(provideSecretKey secure.ProvideSecretKey) secure.SymmAlgo {
+	suiteKey := func(pubKey string) ([]byte, error) {
+		sharedKey, err := provideSecretKey(pubKey)
+		if err != nil {
+			return nil, err
+		}
+		key := make([]byte, 32)
+		if _, err := io.ReadFull(hkdf.New(sha256.New, sharedKey, nil, []byte("pgaes256gcm")), key); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	return &AESGCM{
+		sessions:         secure.NewSessions(newAEAD, suiteKey),
+		provideSecretKey: provideSecretKey,
+	}
+}
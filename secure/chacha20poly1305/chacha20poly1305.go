@@ -1,97 +1,59 @@
 package chacha20poly1305
 
 import (
-	"crypto/cipher"
-	"encoding/binary"
 	"errors"
-	"sync"
-	"time"
 
 	"golang.org/x/crypto/chacha20poly1305"
 
-	"github.com/rkonfj/peerguard/lru"
 	"github.com/rkonfj/peerguard/secure"
 )
 
-var _ secure.SymmAlgo = (*Chacha20Poly1305)(nil)
+var (
+	_ secure.SymmAlgo = (*Chacha20Poly1305)(nil)
+	_ secure.KeyMixer = (*Chacha20Poly1305)(nil)
+)
 
 type Chacha20Poly1305 struct {
-	mut              sync.RWMutex
-	cipher           *lru.Cache[string, cipher.AEAD]
-	provideSecretKey secure.ProvideSecretKey
+	sessions *secure.Sessions
 }
 
 func (s *Chacha20Poly1305) Encrypt(data []byte, pubKey string) ([]byte, error) {
 	if s == nil {
 		return nil, errors.New("enc is disabled")
 	}
-	aead, err := s.ensureChiperAEAD(pubKey)
-	if err != nil {
-		return nil, err
-	}
-	nonce := make([]byte, aead.NonceSize())
-	binary.LittleEndian.PutUint64(nonce[aead.NonceSize()-8:], uint64(time.Now().Unix()/5))
-	return aead.Seal(nil, nonce, data, nil), nil
+	return s.sessions.Seal(data, pubKey)
 }
 
 func (s *Chacha20Poly1305) Decrypt(data []byte, pubKey string) ([]byte, error) {
 	if s == nil {
 		return nil, errors.New("dec is disabled")
 	}
-	aead, err := s.ensureChiperAEAD(pubKey)
-	if err != nil {
+	plain, err := s.sessions.Open(data, pubKey)
+	if errors.Is(err, secure.ErrReplayedData) {
 		return nil, err
 	}
-	nonce := make([]byte, aead.NonceSize())
-	startIndex := aead.NonceSize() - 8
-	nowUnix := time.Now().Unix()
-
-	binary.LittleEndian.PutUint64(nonce[startIndex:], uint64(nowUnix/5))
-	plain, err := aead.Open(nil, nonce, data, nil)
 	if err != nil {
-		binary.LittleEndian.PutUint64(nonce[startIndex:], uint64(nowUnix/5+1))
-		plain, err = aead.Open(nil, nonce, data, nil)
-		if err != nil {
-			binary.LittleEndian.PutUint64(nonce[startIndex:], uint64(nowUnix/5-1))
-			plain, err = aead.Open(nil, nonce, data, nil)
-			if err != nil {
-				return nil, errors.New("invalid data")
-			}
-		}
+		return nil, errors.New("invalid data")
 	}
 	return plain, nil
 }
 
-func (s *Chacha20Poly1305) SecretKey() secure.ProvideSecretKey {
-	return s.provideSecretKey
+func (s *Chacha20Poly1305) MixKey(pubKey string, secret []byte) error {
+	return s.sessions.MixKey(pubKey, secret)
 }
 
-func (s *Chacha20Poly1305) ensureChiperAEAD(pubKey string) (cipher.AEAD, error) {
-	s.mut.RLock()
-	aead, ok := s.cipher.Get(pubKey)
-	s.mut.RUnlock()
-	if !ok {
-		secretKey, err := s.provideSecretKey(pubKey)
-		if err != nil {
-			return nil, err
-		}
-		b, err := chacha20poly1305.New(secretKey)
-		if err != nil {
-			return nil, err
-		}
-		aead = b
-		s.mut.Lock()
-		s.cipher.Put(pubKey, aead)
-		s.mut.Unlock()
-	}
-
-	return aead, nil
+func (s *Chacha20Poly1305) MixEphemeral(pubKey string, secret []byte, initiator bool) error {
+	return s.sessions.MixEphemeral(pubKey, secret, initiator)
+}
 
+func (s *Chacha20Poly1305) SecretKey() secure.ProvideSecretKey {
+	return s.sessions.SecretKey()
 }
 
+// New chacha20poly1305 SymmAlgo, the datagrams of the peers running the releases before the session
+// keys are still opened since they only know this cipher
 func New(provideSecretKey secure.ProvideSecretKey) secure.SymmAlgo {
-	return &Chacha20Poly1305{
-		cipher:           lru.New[string, cipher.AEAD](128),
-		provideSecretKey: provideSecretKey,
-	}
+	sessions := secure.NewSessions(chacha20poly1305.New, provideSecretKey)
+	sessions.EnableLegacy()
+	return &Chacha20Poly1305{sessions: sessions}
 }
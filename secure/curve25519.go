@@ -2,6 +2,7 @@ package secure
 
 import (
 	"crypto/rand"
+	"errors"
 
 	"golang.org/x/crypto/curve25519"
 	"storj.io/common/base58"
@@ -51,6 +52,9 @@ func GenerateCurve25519() (*PrivateKey, error) {
 
 func Curve25519PrivateKey(privateKey string) (*PrivateKey, error) {
 	priv := base58.Decode(privateKey)
+	if len(priv) != 32 {
+		return nil, errors.New("invalid curve25519 private key")
+	}
 	var pub [32]byte
 	curve25519.ScalarBaseMult(&pub, (*[32]byte)(priv))
 	return &PrivateKey{b: priv, PublicKey: PublicKey{b: pub[:]}}, nil
@@ -0,0 +1,182 @@
+package secure
+
+import (
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/rkonfj/peerguard/lru"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	ephemeralOffer   byte = 1
+	ephemeralReply   byte = 2
+	ephemeralConfirm byte = 3
+)
+
+var ErrInvalidEphemeralMessage = errors.New("invalid ephemeral key exchange message")
+
+// EphemeralExchange runs the ephemeral X25519 key exchanges with the peers, the secrets are mixed
+// into the session keys by the EphemeralMixer so that the sessions can not be opened by the long-term
+// keys leaked later. The offer and the reply are sealed by the key derived from the long-term shared
+// key rather than the sessions, so that they still work once one of the peers restarted. The offer
+// is refused unless it is newer than the last one of the peer, the reply is bound to the offer
+type EphemeralExchange struct {
+	symmAlgo SymmAlgo
+	mixer    EphemeralMixer
+
+	mut     sync.Mutex
+	pending *lru.Cache[string, *ecdh.PrivateKey]
+	offered *lru.Cache[string, int64]
+}
+
+func NewEphemeralExchange(symmAlgo SymmAlgo) (*EphemeralExchange, error) {
+	mixer, ok := symmAlgo.(EphemeralMixer)
+	if !ok {
+		return nil, errors.New("ephemeral key exchange: symm algo does not support ephemeral mixing")
+	}
+	return &EphemeralExchange{
+		symmAlgo: symmAlgo,
+		mixer:    mixer,
+		pending:  lru.New[string, *ecdh.PrivateKey](128),
+		offered:  lru.New[string, int64](1024),
+	}, nil
+}
+
+// Offer starts a key exchange with the peer identified by pubKey, the message is sent to the peer
+func (x *EphemeralExchange) Offer(pubKey string) ([]byte, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	x.mut.Lock()
+	x.pending.Put(pubKey, priv)
+	x.mut.Unlock()
+	return x.seal(pubKey, ephemeralOffer, priv.PublicKey().Bytes(), nil)
+}
+
+// Handle handles the message of the peer identified by pubKey, the message returned (if any) is sent
+// back to the peer
+func (x *EphemeralExchange) Handle(pubKey string, msg []byte) ([]byte, error) {
+	if len(msg) == 0 {
+		return nil, ErrInvalidEphemeralMessage
+	}
+	switch msg[0] {
+	case ephemeralOffer:
+		ts, peerPub, err := x.open(pubKey, msg, nil)
+		if err != nil {
+			return nil, err
+		}
+		x.mut.Lock()
+		if last, ok := x.offered.Get(pubKey); ok && ts <= last {
+			x.mut.Unlock()
+			return nil, ErrReplayedData
+		}
+		x.offered.Put(pubKey, ts)
+		x.mut.Unlock()
+		priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		secret, err := priv.ECDH(peerPub)
+		if err != nil {
+			return nil, err
+		}
+		reply, err := x.seal(pubKey, ephemeralReply, priv.PublicKey().Bytes(), peerPub.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		if err := x.mixer.MixEphemeral(pubKey, secret, false); err != nil {
+			return nil, err
+		}
+		return reply, nil
+	case ephemeralReply:
+		x.mut.Lock()
+		priv, ok := x.pending.Get(pubKey)
+		x.mut.Unlock()
+		if !ok || priv == nil {
+			return nil, ErrInvalidEphemeralMessage
+		}
+		_, peerPub, err := x.open(pubKey, msg, priv.PublicKey().Bytes())
+		if err != nil {
+			return nil, err
+		}
+		x.mut.Lock()
+		x.pending.Put(pubKey, nil)
+		x.mut.Unlock()
+		secret, err := priv.ECDH(peerPub)
+		if err != nil {
+			return nil, err
+		}
+		if err := x.mixer.MixEphemeral(pubKey, secret, true); err != nil {
+			return nil, err
+		}
+		// sealed by the mixed session, the peer seals by it since opened
+		confirm, err := x.symmAlgo.Encrypt([]byte{ephemeralConfirm}, pubKey)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte{ephemeralConfirm}, confirm...), nil
+	case ephemeralConfirm:
+		_, err := x.symmAlgo.Decrypt(msg[1:], pubKey)
+		return nil, err
+	}
+	return nil, ErrInvalidEphemeralMessage
+}
+
+// seal seals the timestamp and the ephemeral public key, the message type and the associated data
+// are authenticated
+func (x *EphemeralExchange) seal(pubKey string, msgType byte, ephemeralPub, ad []byte) ([]byte, error) {
+	aead, err := x.aead(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 1+aead.NonceSize(), 1+aead.NonceSize()+8+len(ephemeralPub)+aead.Overhead())
+	out[0] = msgType
+	if _, err := io.ReadFull(rand.Reader, out[1:]); err != nil {
+		return nil, err
+	}
+	plain := binary.BigEndian.AppendUint64(nil, uint64(time.Now().UnixMilli()))
+	plain = append(plain, ephemeralPub...)
+	return aead.Seal(out, out[1:], plain, append([]byte{msgType}, ad...)), nil
+}
+
+func (x *EphemeralExchange) open(pubKey string, msg, ad []byte) (int64, *ecdh.PublicKey, error) {
+	aead, err := x.aead(pubKey)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(msg) < 1+aead.NonceSize() {
+		return 0, nil, ErrInvalidEphemeralMessage
+	}
+	nonce := msg[1 : 1+aead.NonceSize()]
+	plain, err := aead.Open(nil, nonce, msg[1+aead.NonceSize():], append([]byte{msg[0]}, ad...))
+	if err != nil || len(plain) < 8 {
+		return 0, nil, ErrInvalidEphemeralMessage
+	}
+	peerPub, err := ecdh.X25519().NewPublicKey(plain[8:])
+	if err != nil {
+		return 0, nil, ErrInvalidEphemeralMessage
+	}
+	return int64(binary.BigEndian.Uint64(plain)), peerPub, nil
+}
+
+func (x *EphemeralExchange) aead(pubKey string) (cipher.AEAD, error) {
+	sharedKey, err := x.symmAlgo.SecretKey()(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, sharedKey, nil, []byte("pgephemeral")), key); err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.New(key)
+}
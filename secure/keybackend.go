@@ -0,0 +1,71 @@
+package secure
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+)
+
+var (
+	_ KeyBackend = (*PrivateKey)(nil)
+
+	keyBackendsMutex sync.RWMutex
+	keyBackends      = map[string]OpenKeyBackendFunc{
+		"file": openFileKeyBackend,
+		"tpm":  openTPMKeyBackend,
+	}
+)
+
+// KeyBackend holds the node's curve25519 private key, it only exposes the public key
+// and the key agreement operation. The file backend stores the key on the disk, the
+// tpm backend (linux only) seals it at rest to the TPM 2.0. Neither keeps the key out
+// of the process memory, the TPM does not implement X25519 so the key is unsealed
+// once opened
+type KeyBackend interface {
+	// Public is the base58 encoded public key
+	Public() string
+	// SharedKey computes the X25519 shared key with the peer's base58 encoded public key
+	SharedKey(pubKey string) ([]byte, error)
+}
+
+// OpenKeyBackendFunc opens the key backend described by the uri, e.g. file:///etc/peerguard/node.key
+type OpenKeyBackendFunc func(uri *url.URL) (KeyBackend, error)
+
+// RegisterKeyBackend registers the key backend for the uri scheme. Only the file and the
+// tpm backends are built in, there is no Windows CNG or macOS Secure Enclave backend, the
+// embedding programs register such backends themselves
+func RegisterKeyBackend(scheme string, open OpenKeyBackendFunc) {
+	keyBackendsMutex.Lock()
+	defer keyBackendsMutex.Unlock()
+	keyBackends[scheme] = open
+}
+
+// OpenKeyBackend opens the key backend by uri, the scheme selects the backend
+func OpenKeyBackend(uri string) (KeyBackend, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key backend uri %s: %w", uri, err)
+	}
+	keyBackendsMutex.RLock()
+	open, ok := keyBackends[u.Scheme]
+	keyBackendsMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("key backend %s is not registered", u.Scheme)
+	}
+	return open(u)
+}
+
+func (key *PrivateKey) Public() string {
+	return key.PublicKey.String()
+}
+
+func openFileKeyBackend(uri *url.URL) (KeyBackend, error) {
+	keyFile := uri.Path
+	if uri.Opaque != "" { // file:relative/path
+		keyFile = uri.Opaque
+	}
+	if keyFile == "" {
+		return nil, fmt.Errorf("file key backend: key file path is required")
+	}
+	return LoadOrGenerateCurve25519File(keyFile)
+}
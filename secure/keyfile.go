@@ -0,0 +1,122 @@
+package secure
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// LoadCurve25519File loads the base58 encoded private key from keyFile.
+// The key file must not be accessible by group or others
+func LoadCurve25519File(keyFile string) (*PrivateKey, error) {
+	return loadCurve25519File(keyFile, nil)
+}
+
+// LoadSealedCurve25519File is LoadCurve25519File with the key file encrypted at rest by the sealing key.
+// A plaintext key file is still loaded
+func LoadSealedCurve25519File(keyFile string, sealingKey []byte) (*PrivateKey, error) {
+	return loadCurve25519File(keyFile, sealingKey)
+}
+
+func loadCurve25519File(keyFile string, sealingKey []byte) (*PrivateKey, error) {
+	stat, err := os.Stat(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if runtime.GOOS != "windows" && stat.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("key file %s permissions %#o are too open, 0600 is required", keyFile, stat.Mode().Perm())
+	}
+	b, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	var keys [][]byte
+	if sealingKey != nil {
+		keys = append(keys, sealingKey)
+	}
+	if b, err = Unseal(b, keys...); err != nil {
+		return nil, fmt.Errorf("key file %s: %w", keyFile, err)
+	}
+	key, err := Curve25519PrivateKey(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, fmt.Errorf("key file %s: %w", keyFile, err)
+	}
+	return key, nil
+}
+
+// StoreCurve25519File stores the private key to keyFile with 0600 permissions
+func StoreCurve25519File(keyFile string, key *PrivateKey) error {
+	return storeCurve25519File(keyFile, key, nil)
+}
+
+// StoreSealedCurve25519File is StoreCurve25519File with the key file encrypted at rest by the sealing key,
+// the key file is plaintext if the sealing key is nil
+func StoreSealedCurve25519File(keyFile string, key *PrivateKey, sealingKey []byte) error {
+	return storeCurve25519File(keyFile, key, sealingKey)
+}
+
+func storeCurve25519File(keyFile string, key *PrivateKey, sealingKey []byte) error {
+	data := []byte(key.String() + "\n")
+	if sealingKey != nil {
+		sealed, err := Seal(sealingKey, data)
+		if err != nil {
+			return fmt.Errorf("seal key file: %w", err)
+		}
+		data = sealed
+	}
+	return writeKeyFile(keyFile, data)
+}
+
+// writeKeyFile writes the data to keyFile with 0600 permissions atomically
+func writeKeyFile(keyFile string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(keyFile), 0700); err != nil {
+		return fmt.Errorf("create key dir: %w", err)
+	}
+	f, err := os.CreateTemp(filepath.Dir(keyFile), ".pgkey-*")
+	if err != nil {
+		return fmt.Errorf("create key file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	if err := f.Chmod(0600); err != nil && runtime.GOOS != "windows" {
+		f.Close()
+		return fmt.Errorf("chmod key file: %w", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("write key file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("close key file: %w", err)
+	}
+	return os.Rename(f.Name(), keyFile)
+}
+
+// LoadOrGenerateCurve25519File loads the private key from keyFile,
+// a new one is generated and stored if keyFile does not exist
+func LoadOrGenerateCurve25519File(keyFile string) (*PrivateKey, error) {
+	return LoadOrGenerateSealedCurve25519File(keyFile, nil)
+}
+
+// LoadOrGenerateSealedCurve25519File is LoadOrGenerateCurve25519File with the key file
+// encrypted at rest by the sealing key. A plaintext key file is still loaded
+func LoadOrGenerateSealedCurve25519File(keyFile string, sealingKey []byte) (*PrivateKey, error) {
+	key, err := loadCurve25519File(keyFile, sealingKey)
+	if err == nil {
+		return key, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	key, err = GenerateCurve25519()
+	if err != nil {
+		return nil, err
+	}
+	if err := storeCurve25519File(keyFile, key, sealingKey); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,4 @@
+package secure
+
+// DefaultKeyFile is the machine-scoped path of the node private key
+const DefaultKeyFile = "/Library/Application Support/PeerGuard/node.key"
@@ -0,0 +1,6 @@
+//go:build !windows && !darwin
+
+package secure
+
+// DefaultKeyFile is the machine-scoped path of the node private key
+const DefaultKeyFile = "/var/lib/peerguard/node.key"
@@ -0,0 +1,10 @@
+package secure
+
+import (
+	"cmp"
+	"os"
+	"path/filepath"
+)
+
+// DefaultKeyFile is the machine-scoped path of the node private key
+var DefaultKeyFile = filepath.Join(cmp.Or(os.Getenv("ProgramData"), `C:\ProgramData`), "PeerGuard", "node.key")
@@ -0,0 +1,52 @@
+// Package keyring stores the secrets in the platform keyring, the Keychain on macOS,
+// the Secret Service (secret-tool) on linux and the DPAPI protected files on windows
+package keyring
+
+import (
+	"errors"
+	"os"
+	"os/user"
+	"strings"
+
+	"github.com/rkonfj/peerguard/secure"
+)
+
+var (
+	ErrNotFound    = errors.New("keyring: secret not found")
+	ErrUnsupported = errors.New("keyring: not available on this system")
+)
+
+// Service is the keyring service name the peerguard secrets are stored under
+const Service = "peerguard"
+
+type Keyring interface {
+	Get(service, account string) ([]byte, error)
+	Set(service, account string, data []byte) error
+	Delete(service, account string) error
+}
+
+// Default returns the platform keyring, ErrUnsupported if it is not available
+// (e.g. no Secret Service in the headless linux session)
+func Default() (Keyring, error) {
+	return platformKeyring()
+}
+
+// FallbackSealingKey is the key seals the secret files if the keyring is not available. It is derived
+// from the machine id and the user, so that the file is useless once copied to another machine,
+// but it does not protect against the local attackers. Use a dedicated state key for that
+func FallbackSealingKey(usage string) []byte {
+	var id []string
+	for _, file := range []string{"/etc/machine-id", "/var/lib/dbus/machine-id"} {
+		if b, err := os.ReadFile(file); err == nil {
+			id = append(id, strings.TrimSpace(string(b)))
+			break
+		}
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		id = append(id, hostname)
+	}
+	if u, err := user.Current(); err == nil {
+		id = append(id, u.Uid)
+	}
+	return secure.DeriveSealingKey(strings.Join(id, "/"), usage)
+}
@@ -0,0 +1,51 @@
+package keyring
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// keychain stores the secrets as the generic passwords of the login keychain by the security command
+type keychain struct{}
+
+func platformKeyring() (Keyring, error) {
+	if _, err := exec.LookPath("security"); err != nil {
+		return nil, ErrUnsupported
+	}
+	return keychain{}, nil
+}
+
+func (keychain) Get(service, account string) ([]byte, error) {
+	out, err := exec.Command("security", "find-generic-password", "-s", service, "-a", account, "-w").Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 44 { // errSecItemNotFound
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("keyring: %w", err)
+	}
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(string(out)))
+}
+
+func (keychain) Set(service, account string, data []byte) error {
+	// the interactive mode reads the command from stdin, so that the secret is not exposed in the process args
+	cmd := exec.Command("security", "-i")
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("add-generic-password -U -s %q -a %q -w %q\n",
+		service, account, base64.StdEncoding.EncodeToString(data)))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("keyring: %w: %s", err, out)
+	}
+	return nil
+}
+
+func (keychain) Delete(service, account string) error {
+	err := exec.Command("security", "delete-generic-password", "-s", service, "-a", account).Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 44 {
+		return nil
+	}
+	return err
+}
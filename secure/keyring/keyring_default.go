@@ -0,0 +1,7 @@
+//go:build !linux && !windows && !darwin
+
+package keyring
+
+func platformKeyring() (Keyring, error) {
+	return nil, ErrUnsupported
+}
@@ -0,0 +1,48 @@
+package keyring
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// secretService stores the secrets in the Secret Service (gnome-keyring, kwallet) by the secret-tool command
+type secretService struct{}
+
+func platformKeyring() (Keyring, error) {
+	if os.Getenv("DBUS_SESSION_BUS_ADDRESS") == "" {
+		return nil, ErrUnsupported
+	}
+	if _, err := exec.LookPath("secret-tool"); err != nil {
+		return nil, ErrUnsupported
+	}
+	return secretService{}, nil
+}
+
+func (secretService) Get(service, account string) ([]byte, error) {
+	out, err := exec.Command("secret-tool", "lookup", "service", service, "account", account).Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && len(out) == 0 {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("keyring: %w", err)
+	}
+	return base64.StdEncoding.DecodeString(string(bytes.TrimSpace(out)))
+}
+
+func (secretService) Set(service, account string, data []byte) error {
+	cmd := exec.Command("secret-tool", "store", "--label", service+" "+account, "service", service, "account", account)
+	cmd.Stdin = bytes.NewReader([]byte(base64.StdEncoding.EncodeToString(data)))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("keyring: %w: %s", err, out)
+	}
+	return nil
+}
+
+func (secretService) Delete(service, account string) error {
+	return exec.Command("secret-tool", "clear", "service", service, "account", account).Run()
+}
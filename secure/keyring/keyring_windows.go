@@ -0,0 +1,72 @@
+package keyring
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// dpapi stores the secrets in the files protected by the DPAPI of the current user
+type dpapi struct {
+	dir string
+}
+
+func platformKeyring() (Keyring, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return nil, ErrUnsupported
+	}
+	return dpapi{dir: filepath.Join(dir, "peerguard", "keyring")}, nil
+}
+
+func (k dpapi) file(service, account string) string {
+	sum := sha256.Sum256([]byte(service + "/" + account))
+	return filepath.Join(k.dir, hex.EncodeToString(sum[:16]))
+}
+
+func (k dpapi) Get(service, account string) ([]byte, error) {
+	b, err := os.ReadFile(k.file(service, account))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("keyring: %w", err)
+	}
+	var out windows.DataBlob
+	if err := windows.CryptUnprotectData(newBlob(b), nil, nil, 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN, &out); err != nil {
+		return nil, fmt.Errorf("keyring: unprotect: %w", err)
+	}
+	defer windows.LocalFree(windows.Handle(unsafe.Pointer(out.Data)))
+	return append([]byte(nil), unsafe.Slice(out.Data, out.Size)...), nil
+}
+
+func (k dpapi) Set(service, account string, data []byte) error {
+	var out windows.DataBlob
+	if err := windows.CryptProtectData(newBlob(data), nil, nil, 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN, &out); err != nil {
+		return fmt.Errorf("keyring: protect: %w", err)
+	}
+	defer windows.LocalFree(windows.Handle(unsafe.Pointer(out.Data)))
+	if err := os.MkdirAll(k.dir, 0700); err != nil {
+		return fmt.Errorf("keyring: %w", err)
+	}
+	return os.WriteFile(k.file(service, account), unsafe.Slice(out.Data, out.Size), 0600)
+}
+
+func (k dpapi) Delete(service, account string) error {
+	if err := os.Remove(k.file(service, account)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func newBlob(b []byte) *windows.DataBlob {
+	if len(b) == 0 {
+		return &windows.DataBlob{}
+	}
+	return &windows.DataBlob{Size: uint32(len(b)), Data: &b[0]}
+}
@@ -0,0 +1,45 @@
+package secure
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// PreSharedKeySize is the size of the pre-shared key, the same as WireGuard's
+const PreSharedKeySize = 32
+
+// ProvidePreSharedKey returns the pre-shared key with the peer, nil if there is none
+type ProvidePreSharedKey func(pubKey string) []byte
+
+// ParsePreSharedKey parses the base64 encoded 32 bytes pre-shared key
+func ParsePreSharedKey(psk string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(psk)
+	if err != nil || len(b) != PreSharedKeySize {
+		return nil, errors.New("invalid pre-shared key, 32 bytes base64 encoded is required")
+	}
+	return b, nil
+}
+
+// WithPreSharedKey mixes the pre-shared key into the key shared with the peer, so the
+// sessions keep confidential as long as either the key exchange or the psk is not broken
+func WithPreSharedKey(provideSecretKey ProvideSecretKey, providePSK ProvidePreSharedKey) ProvideSecretKey {
+	return func(pubKey string) ([]byte, error) {
+		sharedKey, err := provideSecretKey(pubKey)
+		if err != nil {
+			return nil, err
+		}
+		psk := providePSK(pubKey)
+		if len(psk) == 0 {
+			return sharedKey, nil
+		}
+		mixed := make([]byte, len(sharedKey))
+		if _, err := io.ReadFull(hkdf.New(sha256.New, sharedKey, psk, []byte("pgpsk")), mixed); err != nil {
+			return nil, err
+		}
+		return mixed, nil
+	}
+}
@@ -0,0 +1,66 @@
+package secure
+
+import "sync"
+
+const (
+	replayWindowSize = 2048
+	// one extra word so that sliding never drops counters still inside the window
+	replayWindowWords = replayWindowSize/64 + 1
+	replayWindowBits  = replayWindowWords * 64
+)
+
+// replayWindow is a sliding window over the counters received under one key.
+// Counters that were already seen, or that fall behind the window, are rejected.
+type replayWindow struct {
+	mut    sync.Mutex
+	last   uint64
+	bitmap [replayWindowWords]uint64
+}
+
+// check reports whether counter is acceptable without updating the window
+func (w *replayWindow) check(counter uint64) bool {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+	return w.acceptable(counter)
+}
+
+// update marks counter as received, it returns false if counter was replayed
+func (w *replayWindow) update(counter uint64) bool {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+	if !w.acceptable(counter) {
+		return false
+	}
+	if counter > w.last {
+		w.slide(counter)
+	}
+	index := counter % replayWindowBits
+	w.bitmap[index/64] |= 1 << (index % 64)
+	return true
+}
+
+func (w *replayWindow) acceptable(counter uint64) bool {
+	if counter == 0 {
+		return false
+	}
+	if counter > w.last {
+		return true
+	}
+	if w.last-counter >= replayWindowSize {
+		return false
+	}
+	index := counter % replayWindowBits
+	return w.bitmap[index/64]&(1<<(index%64)) == 0
+}
+
+func (w *replayWindow) slide(counter uint64) {
+	current, next := w.last/64, counter/64
+	if next-current >= replayWindowWords {
+		clear(w.bitmap[:])
+	} else {
+		for i := current + 1; i <= next; i++ {
+			w.bitmap[i%replayWindowWords] = 0
+		}
+	}
+	w.last = counter
+}
@@ -0,0 +1,104 @@
+package secure
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// sealedMagic prefixes the data sealed at rest, the data without it is plaintext
+var sealedMagic = []byte("PGSEALED1")
+
+var ErrSealingKeyRequired = errors.New("the data is sealed, a sealing key is required")
+
+// DeriveSealingKey derives the 32 bytes key seals the data at rest from the secret,
+// usage separates the keys derived from the same secret for different files
+func DeriveSealingKey(secret, usage string) []byte {
+	key := make([]byte, 32)
+	io.ReadFull(hkdf.New(sha256.New, []byte(secret), nil, []byte("peerguard sealing key "+usage)), key)
+	return key
+}
+
+// ResolveSealingKey resolves the sealing key spec, env:NAME reads the secret from the environment
+// variable, file:PATH reads it from the file (e.g. provisioned by an external KMS), otherwise the spec
+// is the secret itself. nil is returned if the spec is empty
+func ResolveSealingKey(spec, usage string) ([]byte, error) {
+	secret := spec
+	switch {
+	case spec == "":
+		return nil, nil
+	case strings.HasPrefix(spec, "env:"):
+		secret = os.Getenv(strings.TrimPrefix(spec, "env:"))
+		if secret == "" {
+			return nil, fmt.Errorf("sealing key: environment variable %s is empty", strings.TrimPrefix(spec, "env:"))
+		}
+	case strings.HasPrefix(spec, "file:"):
+		b, err := os.ReadFile(strings.TrimPrefix(spec, "file:"))
+		if err != nil {
+			return nil, fmt.Errorf("sealing key: %w", err)
+		}
+		secret = strings.TrimSpace(string(b))
+	}
+	return DeriveSealingKey(secret, usage), nil
+}
+
+// IsSealed reports whether the data is sealed by Seal
+func IsSealed(data []byte) bool {
+	return bytes.HasPrefix(data, sealedMagic)
+}
+
+// Seal encrypts the data by AES-256-GCM
+func Seal(key, data []byte) ([]byte, error) {
+	aead, err := sealingAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := append(bytes.Clone(sealedMagic), nonce...)
+	return aead.Seal(sealed, nonce, data, sealedMagic), nil
+}
+
+// Unseal decrypts the sealed data by the keys in order, the plaintext data is returned as is
+func Unseal(data []byte, keys ...[]byte) ([]byte, error) {
+	if !IsSealed(data) {
+		return data, nil
+	}
+	if len(keys) == 0 {
+		return nil, ErrSealingKeyRequired
+	}
+	data = data[len(sealedMagic):]
+	for _, key := range keys {
+		aead, err := sealingAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) < aead.NonceSize() {
+			return nil, errors.New("sealed data is too short")
+		}
+		plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], sealedMagic)
+		if err == nil {
+			return plain, nil
+		}
+	}
+	return nil, errors.New("unseal: wrong sealing key or the data is corrupted")
+}
+
+func sealingAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
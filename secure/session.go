@@ -0,0 +1,525 @@
+package secure
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rkonfj/peerguard/lru"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// SessionHeaderSize is the size of the header prepended to every sealed datagram
+	// version (1 byte) + session id (8 bytes) + key generation (4 bytes) + counter (8 bytes)
+	SessionHeaderSize = 21
+
+	// sessionVersion is the first byte of the header, it is bumped once the header or the key
+	// derivation changes so that the datagrams of the other versions are told apart
+	sessionVersion byte = 1
+)
+
+var (
+	ErrInvalidSessionData = errors.New("invalid session data")
+	ErrReplayedData       = errors.New("replayed data")
+	// ErrStaleSession the datagram is authentic but sealed by a session older than the one
+	// the peer is found sending by, it is refused as it may be recorded and replayed
+	ErrStaleSession = fmt.Errorf("%w: stale session", ErrReplayedData)
+
+	lastSessionID atomic.Uint64
+
+	defaultRekeyConfig atomic.Pointer[RekeyConfig]
+)
+
+func init() {
+	defaultRekeyConfig.Store(&RekeyConfig{
+		Interval: 2 * time.Minute,
+		Bytes:    64 << 30,
+	})
+}
+
+// RekeyConfig controls when the session key used to seal datagrams to a peer is rotated
+type RekeyConfig struct {
+	// Interval rotate the key after it has been used for this long
+	Interval time.Duration
+	// Bytes rotate the key after this many bytes have been sealed with it
+	Bytes uint64
+}
+
+// SetModifyRekeyConfig modifies the copy of the rekey config and replaces it, it is safe to be
+// called while the sessions are sealing
+func SetModifyRekeyConfig(modify func(cfg *RekeyConfig)) {
+	cfg := *defaultRekeyConfig.Load()
+	if modify != nil {
+		modify(&cfg)
+	}
+	cfg.Interval = max(10*time.Second, cfg.Interval)
+	cfg.Bytes = max(1<<20, cfg.Bytes)
+	defaultRekeyConfig.Store(&cfg)
+}
+
+// CurrentRekeyConfig returns the rekey config in use
+func CurrentRekeyConfig() RekeyConfig {
+	return *defaultRekeyConfig.Load()
+}
+
+// NewAEAD creates an AEAD from a 32 bytes key
+type NewAEAD func(key []byte) (cipher.AEAD, error)
+
+// Sessions seals and opens datagrams with per-peer session keys derived from
+// the shared key and the secret of the last ephemeral key exchange (see
+// EphemeralExchange). The sending key is rotated when it gets too old or has sealed
+// too much data. Peers follow the rotation by the key generation carried in the
+// header, and the previous key is kept so that in-flight datagrams still open.
+type Sessions struct {
+	mut              sync.Mutex
+	peers            *lru.Cache[string, *session]
+	newAEAD          NewAEAD
+	provideSecretKey ProvideSecretKey
+	legacy           bool
+}
+
+func NewSessions(newAEAD NewAEAD, provideSecretKey ProvideSecretKey) *Sessions {
+	return &Sessions{
+		peers:            lru.New[string, *session](128),
+		newAEAD:          newAEAD,
+		provideSecretKey: provideSecretKey,
+	}
+}
+
+// Seal encrypts data for the peer identified by pubKey
+func (s *Sessions) Seal(data []byte, pubKey string) ([]byte, error) {
+	sess, err := s.ensureSession(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	return sess.seal(data)
+}
+
+// EnableLegacy opens the datagrams sealed without the session header by the releases before the
+// session keys, and seals the datagrams to the peer the same way once one of them is opened, until
+// the peer sends the datagram of the session. It must be called before the sessions are used
+func (s *Sessions) EnableLegacy() {
+	s.legacy = true
+}
+
+// Open decrypts data received from the peer identified by pubKey
+func (s *Sessions) Open(data []byte, pubKey string) ([]byte, error) {
+	versioned := len(data) >= SessionHeaderSize && data[0] == sessionVersion
+	if !versioned && !s.legacy {
+		return nil, ErrInvalidSessionData
+	}
+	sess, err := s.ensureSession(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	if !versioned {
+		return sess.openLegacy(data)
+	}
+	plain, err := sess.open(data)
+	if err != nil && !errors.Is(err, ErrReplayedData) && s.legacy {
+		// the legacy datagram starts with the version byte by chance
+		if plain, legacyErr := sess.openLegacy(data); legacyErr == nil {
+			return plain, nil
+		}
+	}
+	return plain, err
+}
+
+// MixKey mixes secret into the key shared with the peer identified by pubKey
+// (e.g. a post-quantum KEM shared secret). A new sending session is started with
+// the mixed key, keys the peer derived from the previous shared key remain valid
+// until it catches up.
+func (s *Sessions) MixKey(pubKey string, secret []byte) error {
+	sess, err := s.ensureSession(pubKey)
+	if err != nil {
+		return err
+	}
+	return sess.mix(secret)
+}
+
+// MixEphemeral mixes the secret of an ephemeral key exchange with the peer identified by pubKey
+// into the session keys, the sessions can not be opened by the long-term keys since. The initiator
+// seals by the mixed keys at once, the responder once the initiator is found sealing by them
+func (s *Sessions) MixEphemeral(pubKey string, secret []byte, initiator bool) error {
+	sess, err := s.ensureSession(pubKey)
+	if err != nil {
+		return err
+	}
+	return sess.mixEphemeral(secret, initiator)
+}
+
+func (s *Sessions) SecretKey() ProvideSecretKey {
+	return s.provideSecretKey
+}
+
+func (s *Sessions) ensureSession(pubKey string) (*session, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if sess, ok := s.peers.Get(pubKey); ok {
+		return sess, nil
+	}
+	sharedKey, err := s.provideSecretKey(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	id, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+	sess := &session{
+		id:        id,
+		baseKey:   sharedKey,
+		sharedKey: sharedKey,
+		newAEAD:   s.newAEAD,
+	}
+	if s.legacy {
+		if sess.legacyAEAD, err = s.newAEAD(sharedKey); err != nil {
+			return nil, err
+		}
+	}
+	s.peers.Put(pubKey, sess)
+	return sess, nil
+}
+
+type sessionKey struct {
+	id         uint64
+	gen        uint32
+	epoch      uint64
+	aead       cipher.AEAD
+	counter    uint64
+	sealed     uint64
+	createTime time.Time
+
+	// receiving keys only
+	window replayWindow
+}
+
+func (k *sessionKey) expired() bool {
+	cfg := defaultRekeyConfig.Load()
+	return time.Since(k.createTime) > cfg.Interval ||
+		k.sealed >= cfg.Bytes ||
+		k.counter == math.MaxUint64
+}
+
+type session struct {
+	newAEAD NewAEAD
+
+	keyMutex      sync.RWMutex
+	baseKey       []byte // from the key exchange of the long-term keys
+	sharedKey     []byte // baseKey with extra secret mixed in
+	prevSharedKey []byte
+
+	// the secrets of the ephemeral key exchanges, the staged one is exchanged as the responder
+	// and becomes the current one once the peer is found sealing by it. The epoch orders them
+	epoch                                     uint64
+	ephemeral, stagedEphemeral, prevEphemeral ephemeralSecret
+
+	sendMutex sync.Mutex
+	id        uint64 // chosen by us, identify our sending keys
+	send      *sessionKey
+
+	recvMutex sync.RWMutex
+	recv      *sessionKey
+	recvPrev  *sessionKey
+
+	// legacyAEAD is the aead of the shared key if the legacy is enabled, the datagrams are sealed
+	// by it while the peer is legacy
+	legacyAEAD cipher.AEAD
+	legacyPeer atomic.Bool
+}
+
+func (s *session) seal(data []byte) ([]byte, error) {
+	if s.legacyPeer.Load() {
+		return s.sealLegacy(data), nil
+	}
+	s.sendMutex.Lock()
+	defer s.sendMutex.Unlock()
+	if s.send == nil || s.send.expired() {
+		var gen uint32
+		if s.send != nil {
+			gen = s.send.gen + 1
+		}
+		s.keyMutex.RLock()
+		key, err := deriveKey(s.sharedKey, s.ephemeral, s.newAEAD, s.id, gen)
+		s.keyMutex.RUnlock()
+		if err != nil {
+			return nil, err
+		}
+		s.send = key
+	}
+	key := s.send
+	key.counter++
+	key.sealed += uint64(len(data))
+
+	out := make([]byte, SessionHeaderSize, SessionHeaderSize+len(data)+key.aead.Overhead())
+	out[0] = sessionVersion
+	binary.BigEndian.PutUint64(out[1:], key.id)
+	binary.BigEndian.PutUint32(out[9:], key.gen)
+	binary.BigEndian.PutUint64(out[13:], key.counter)
+	return key.aead.Seal(out, nonce(key.aead, key.counter), data, out[:SessionHeaderSize]), nil
+}
+
+func (s *session) open(data []byte) ([]byte, error) {
+	plain, err := s.openSession(data)
+	if err == nil {
+		s.legacyPeer.Store(false)
+	}
+	return plain, err
+}
+
+func (s *session) openSession(data []byte) ([]byte, error) {
+	id := binary.BigEndian.Uint64(data[1:])
+	gen := binary.BigEndian.Uint32(data[9:])
+	counter := binary.BigEndian.Uint64(data[13:])
+
+	s.recvMutex.RLock()
+	key := s.recvKey(id, gen)
+	s.recvMutex.RUnlock()
+
+	if key != nil {
+		if !key.window.check(counter) {
+			return nil, ErrReplayedData
+		}
+		plain, err := key.aead.Open(nil, nonce(key.aead, counter), data[SessionHeaderSize:], data[:SessionHeaderSize])
+		if err != nil {
+			return nil, err
+		}
+		if !key.window.update(counter) {
+			return nil, ErrReplayedData
+		}
+		return plain, nil
+	}
+
+	// the peer rekeyed, restarted or has not mixed the same secret yet
+	s.keyMutex.RLock()
+	sharedKeys := [][]byte{s.sharedKey}
+	for _, k := range [][]byte{s.prevSharedKey, s.baseKey} {
+		if k != nil && !slices.ContainsFunc(sharedKeys, func(e []byte) bool { return bytes.Equal(e, k) }) {
+			sharedKeys = append(sharedKeys, k)
+		}
+	}
+	// the keys without the ephemeral secret are tried last, the peer may have restarted
+	var ephemerals []ephemeralSecret
+	for _, e := range []ephemeralSecret{s.ephemeral, s.stagedEphemeral, s.prevEphemeral, {}} {
+		if !slices.ContainsFunc(ephemerals, func(x ephemeralSecret) bool { return x.epoch == e.epoch }) &&
+			(e.secret != nil || e.epoch == 0) {
+			ephemerals = append(ephemerals, e)
+		}
+	}
+	staged := s.stagedEphemeral.epoch
+	s.keyMutex.RUnlock()
+	var (
+		plain []byte
+		err   error
+	)
+	for _, sharedKey := range sharedKeys {
+		for _, ephemeral := range ephemerals {
+			key, err = deriveKey(sharedKey, ephemeral, s.newAEAD, id, gen)
+			if err != nil {
+				return nil, err
+			}
+			plain, err = key.aead.Open(nil, nonce(key.aead, counter), data[SessionHeaderSize:], data[:SessionHeaderSize])
+			if err == nil {
+				break
+			}
+		}
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := s.acceptRecv(key, counter); err != nil {
+		return nil, err
+	}
+	if staged != 0 && key.epoch == staged {
+		// the initiator is found sealing by the staged secret
+		if err := s.promoteEphemeral(staged); err != nil {
+			return nil, err
+		}
+	}
+	return plain, nil
+}
+
+func (s *session) acceptRecv(key *sessionKey, counter uint64) error {
+	s.recvMutex.Lock()
+	defer s.recvMutex.Unlock()
+	if existing := s.recvKey(key.id, key.gen); existing != nil {
+		key = existing // derived concurrently by another datagram
+	} else if s.newerThanRecv(key) {
+		s.recvPrev, s.recv = s.recv, key
+	} else {
+		return ErrStaleSession
+	}
+	if !key.window.update(counter) {
+		return ErrReplayedData
+	}
+	return nil
+}
+
+// newerThanRecv reports whether the key supersedes the current receiving key. Only the strictly
+// newer keys are accepted, so that the recorded sessions can't be replayed no matter how long the
+// current one has been idle. The keys of a newer ephemeral key exchange are newer whatever the id,
+// the peer restarted with its clock set back is accepted once the key exchange is done
+func (s *session) newerThanRecv(key *sessionKey) bool {
+	if s.recv == nil {
+		return true
+	}
+	if key.epoch != s.recv.epoch {
+		return key.epoch > s.recv.epoch
+	}
+	if key.id != s.recv.id {
+		return key.id > s.recv.id
+	}
+	return key.gen > s.recv.gen
+}
+
+// sealLegacy seals the datagram with the nonce of the 5 seconds time slot, no header is prepended
+func (s *session) sealLegacy(data []byte) []byte {
+	return s.legacyAEAD.Seal(nil, legacyNonce(s.legacyAEAD, time.Now().Unix()/5), data, nil)
+}
+
+// openLegacy opens the datagram sealed in the time slot around now, the peer is legacy since
+func (s *session) openLegacy(data []byte) ([]byte, error) {
+	if s.legacyAEAD == nil {
+		return nil, ErrInvalidSessionData
+	}
+	slot := time.Now().Unix() / 5
+	for _, n := range []int64{slot, slot + 1, slot - 1} {
+		if plain, err := s.legacyAEAD.Open(nil, legacyNonce(s.legacyAEAD, n), data, nil); err == nil {
+			s.legacyPeer.Store(true)
+			return plain, nil
+		}
+	}
+	return nil, ErrInvalidSessionData
+}
+
+func (s *session) recvKey(id uint64, gen uint32) *sessionKey {
+	for _, key := range []*sessionKey{s.recv, s.recvPrev} {
+		if key != nil && key.id == id && key.gen == gen {
+			return key
+		}
+	}
+	return nil
+}
+
+func (s *session) mix(secret []byte) error {
+	mixed := make([]byte, 32)
+	s.keyMutex.RLock()
+	_, err := io.ReadFull(hkdf.New(sha256.New, s.baseKey, secret, []byte("pgmix")), mixed)
+	s.keyMutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	s.keyMutex.Lock()
+	s.prevSharedKey, s.sharedKey = s.sharedKey, mixed
+	s.keyMutex.Unlock()
+
+	return s.restartSend()
+}
+
+func (s *session) mixEphemeral(secret []byte, initiator bool) error {
+	s.keyMutex.Lock()
+	s.epoch++
+	ephemeral := ephemeralSecret{secret: secret, epoch: s.epoch}
+	if !initiator {
+		s.stagedEphemeral = ephemeral
+		s.keyMutex.Unlock()
+		return nil
+	}
+	s.prevEphemeral, s.ephemeral = s.ephemeral, ephemeral
+	s.keyMutex.Unlock()
+	return s.restartSend()
+}
+
+// promoteEphemeral seals by the staged secret since, the older secret is dropped
+func (s *session) promoteEphemeral(epoch uint64) error {
+	s.keyMutex.Lock()
+	if s.stagedEphemeral.epoch != epoch {
+		s.keyMutex.Unlock()
+		return nil // promoted concurrently
+	}
+	s.prevEphemeral, s.ephemeral, s.stagedEphemeral = s.ephemeral, s.stagedEphemeral, ephemeralSecret{}
+	s.keyMutex.Unlock()
+	return s.restartSend()
+}
+
+// restartSend starts a new sending session, the key is derived once sealing
+func (s *session) restartSend() error {
+	id, err := newSessionID()
+	if err != nil {
+		return err
+	}
+	s.sendMutex.Lock()
+	defer s.sendMutex.Unlock()
+	s.id, s.send = id, nil
+	return nil
+}
+
+// newSessionID unix seconds in the high half orders sessions across restarts, random low half
+// avoids reusing keys when restarted within the same second. The ids are strictly increasing
+// within the process so that the peer accepts every new session
+func newSessionID() (uint64, error) {
+	var b [8]byte
+	binary.BigEndian.PutUint32(b[:], uint32(time.Now().Unix()))
+	if _, err := io.ReadFull(rand.Reader, b[4:]); err != nil {
+		return 0, err
+	}
+	id := binary.BigEndian.Uint64(b[:])
+	for {
+		last := lastSessionID.Load()
+		next := max(id, last+1)
+		if lastSessionID.CompareAndSwap(last, next) {
+			return next, nil
+		}
+	}
+}
+
+// ephemeralSecret the secret of an ephemeral key exchange, the zero value derives the keys by the
+// long-term keys only
+type ephemeralSecret struct {
+	secret []byte
+	epoch  uint64
+}
+
+// deriveKey the ephemeral secret salts the key derivation, so that the recorded sessions can not be
+// opened by the long-term keys leaked later (forward secrecy)
+func deriveKey(sharedKey []byte, ephemeral ephemeralSecret, newAEAD NewAEAD, id uint64, gen uint32) (*sessionKey, error) {
+	info := make([]byte, 0, 21)
+	info = append(info, "pgsession"...)
+	info = binary.BigEndian.AppendUint64(info, id)
+	info = binary.BigEndian.AppendUint32(info, gen)
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, sharedKey, ephemeral.secret, info), key); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &sessionKey{id: id, gen: gen, epoch: ephemeral.epoch, aead: aead, createTime: time.Now()}, nil
+}
+
+func legacyNonce(aead cipher.AEAD, slot int64) []byte {
+	b := make([]byte, aead.NonceSize())
+	binary.LittleEndian.PutUint64(b[len(b)-8:], uint64(slot))
+	return b
+}
+
+func nonce(aead cipher.AEAD, counter uint64) []byte {
+	b := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(b[len(b)-8:], counter)
+	return b
+}
@@ -0,0 +1,342 @@
+package secure_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rkonfj/peerguard/secure"
+	pgchacha20poly1305 "github.com/rkonfj/peerguard/secure/chacha20poly1305"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+func newSessionsPair(t *testing.T) (alice, bob *secure.Sessions, alicePub, bobPub string) {
+	alicePriv, err := secure.GenerateCurve25519()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobPriv, err := secure.GenerateCurve25519()
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice = secure.NewSessions(chacha20poly1305.New, alicePriv.SharedKey)
+	bob = secure.NewSessions(chacha20poly1305.New, bobPriv.SharedKey)
+	return alice, bob, alicePriv.PublicKey.String(), bobPriv.PublicKey.String()
+}
+
+func TestSessionsSealOpen(t *testing.T) {
+	alice, bob, alicePub, bobPub := newSessionsPair(t)
+	for _, msg := range []string{"hello", "peerguard", ""} {
+		sealed, err := alice.Seal([]byte(msg), bobPub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain, err := bob.Open(sealed, alicePub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(plain) != msg {
+			t.Fatalf("expected %q, got %q", msg, plain)
+		}
+	}
+}
+
+func TestSessionsRejectReplay(t *testing.T) {
+	alice, bob, alicePub, bobPub := newSessionsPair(t)
+
+	var sealed [][]byte
+	for range 3000 {
+		b, err := alice.Seal([]byte("data"), bobPub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sealed = append(sealed, b)
+	}
+
+	// out of order delivery inside the window is fine
+	for _, i := range []int{10, 5, 11, 0} {
+		if _, err := bob.Open(sealed[i], alicePub); err != nil {
+			t.Fatalf("open datagram %d: %s", i, err)
+		}
+	}
+
+	if _, err := bob.Open(sealed[5], alicePub); !errors.Is(err, secure.ErrReplayedData) {
+		t.Fatalf("expected replayed data error, got %v", err)
+	}
+
+	if _, err := bob.Open(sealed[2999], alicePub); err != nil {
+		t.Fatal(err)
+	}
+
+	// fell behind the window
+	if _, err := bob.Open(sealed[20], alicePub); !errors.Is(err, secure.ErrReplayedData) {
+		t.Fatalf("expected replayed data error, got %v", err)
+	}
+
+	// still inside the window
+	if _, err := bob.Open(sealed[2999-2000], alicePub); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionsMixKey(t *testing.T) {
+	alice, bob, alicePub, bobPub := newSessionsPair(t)
+	roundTrip := func(from, to *secure.Sessions, fromPub, toPub string) error {
+		sealed, err := from.Seal([]byte("data"), toPub)
+		if err != nil {
+			return err
+		}
+		_, err = to.Open(sealed, fromPub)
+		return err
+	}
+	if err := roundTrip(alice, bob, alicePub, bobPub); err != nil {
+		t.Fatal(err)
+	}
+
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	if err := alice.MixKey(bobPub, secret); err != nil {
+		t.Fatal(err)
+	}
+	// bob has not mixed yet
+	if err := roundTrip(bob, alice, bobPub, alicePub); err != nil {
+		t.Fatal(err)
+	}
+	if err := roundTrip(alice, bob, alicePub, bobPub); err == nil {
+		t.Fatal("expected bob failed to open the mixed session")
+	}
+
+	if err := bob.MixKey(alicePub, secret); err != nil {
+		t.Fatal(err)
+	}
+	if err := roundTrip(alice, bob, alicePub, bobPub); err != nil {
+		t.Fatal(err)
+	}
+	if err := roundTrip(bob, alice, bobPub, alicePub); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionsRejectStaleSession(t *testing.T) {
+	alicePriv, _ := secure.GenerateCurve25519()
+	bobPriv, _ := secure.GenerateCurve25519()
+	alicePub, bobPub := alicePriv.PublicKey.String(), bobPriv.PublicKey.String()
+	bob := secure.NewSessions(chacha20poly1305.New, bobPriv.SharedKey)
+
+	// the datagrams of the alice's session recorded, then alice restarts twice
+	var recorded [][]byte
+	for range 3 {
+		alice := secure.NewSessions(chacha20poly1305.New, alicePriv.SharedKey)
+		sealed, err := alice.Seal([]byte("data"), bobPub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bob.Open(sealed, alicePub); err != nil {
+			t.Fatal(err)
+		}
+		if sealed, err = alice.Seal([]byte("data"), bobPub); err != nil {
+			t.Fatal(err)
+		}
+		recorded = append(recorded, sealed)
+	}
+	if _, err := bob.Open(recorded[0], alicePub); !errors.Is(err, secure.ErrStaleSession) {
+		t.Fatalf("expected the stale session refused, got %v", err)
+	}
+	if !errors.Is(secure.ErrStaleSession, secure.ErrReplayedData) {
+		t.Fatal("expected the stale session is the replayed data")
+	}
+	for _, sealed := range recorded[1:] {
+		if _, err := bob.Open(sealed, alicePub); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestEphemeralExchange(t *testing.T) {
+	alicePriv, _ := secure.GenerateCurve25519()
+	bobPriv, _ := secure.GenerateCurve25519()
+	alicePub, bobPub := alicePriv.PublicKey.String(), bobPriv.PublicKey.String()
+	bob := pgchacha20poly1305.New(bobPriv.SharedKey)
+	bobExchange, err := secure.NewEphemeralExchange(bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip := func(from, to secure.SymmAlgo, fromPub, toPub string) error {
+		sealed, err := from.Encrypt([]byte("data"), toPub)
+		if err != nil {
+			return err
+		}
+		_, err = to.Decrypt(sealed, fromPub)
+		return err
+	}
+	exchange := func(aliceExchange *secure.EphemeralExchange) {
+		offer, err := aliceExchange.Offer(bobPub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply, err := bobExchange.Handle(alicePub, offer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bobExchange.Handle(alicePub, offer); !errors.Is(err, secure.ErrReplayedData) {
+			t.Fatalf("expected the replayed offer refused, got %v", err)
+		}
+		confirm, err := aliceExchange.Handle(bobPub, reply)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := aliceExchange.Handle(bobPub, reply); err == nil {
+			t.Fatal("expected the replayed reply refused")
+		}
+		if msg, err := bobExchange.Handle(alicePub, confirm); err != nil || msg != nil {
+			t.Fatalf("confirm: %v %v", msg, err)
+		}
+	}
+
+	alice := pgchacha20poly1305.New(alicePriv.SharedKey)
+	aliceExchange, err := secure.NewEphemeralExchange(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := roundTrip(alice, bob, alicePub, bobPub); err != nil {
+		t.Fatal(err)
+	}
+	exchange(aliceExchange)
+	for range 2 {
+		if err := roundTrip(alice, bob, alicePub, bobPub); err != nil {
+			t.Fatal(err)
+		}
+		if err := roundTrip(bob, alice, bobPub, alicePub); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the long-term keys leaked later can't open the sessions
+	eve := pgchacha20poly1305.New(bobPriv.SharedKey)
+	if err := roundTrip(alice, eve, alicePub, bobPub); err == nil {
+		t.Fatal("expected the session opened by the long-term keys only refused")
+	}
+
+	// alice restarted, the sessions by the long-term keys only are stale until the key exchange
+	time.Sleep(2 * time.Millisecond)
+	alice = pgchacha20poly1305.New(alicePriv.SharedKey)
+	if aliceExchange, err = secure.NewEphemeralExchange(alice); err != nil {
+		t.Fatal(err)
+	}
+	if err := roundTrip(alice, bob, alicePub, bobPub); !errors.Is(err, secure.ErrStaleSession) {
+		t.Fatalf("expected the stale session refused, got %v", err)
+	}
+	exchange(aliceExchange)
+	if err := roundTrip(alice, bob, alicePub, bobPub); err != nil {
+		t.Fatal(err)
+	}
+	if err := roundTrip(bob, alice, bobPub, alicePub); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionsPreSharedKey(t *testing.T) {
+	alicePriv, _ := secure.GenerateCurve25519()
+	bobPriv, _ := secure.GenerateCurve25519()
+	psk := func(b byte) secure.ProvidePreSharedKey {
+		return func(string) []byte { return bytes.Repeat([]byte{b}, secure.PreSharedKeySize) }
+	}
+	alice := secure.NewSessions(chacha20poly1305.New, secure.WithPreSharedKey(alicePriv.SharedKey, psk(1)))
+	bob := secure.NewSessions(chacha20poly1305.New, secure.WithPreSharedKey(bobPriv.SharedKey, psk(1)))
+	eve := secure.NewSessions(chacha20poly1305.New, secure.WithPreSharedKey(bobPriv.SharedKey, psk(2)))
+
+	sealed, err := alice.Seal([]byte("data"), bobPriv.PublicKey.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := eve.Open(sealed, alicePriv.PublicKey.String()); err == nil {
+		t.Fatal("expected open failed with the mismatched psk")
+	}
+	if _, err := bob.Open(sealed, alicePriv.PublicKey.String()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionsLegacyPeer(t *testing.T) {
+	alicePriv, _ := secure.GenerateCurve25519()
+	bobPriv, _ := secure.GenerateCurve25519()
+	alicePub, bobPub := alicePriv.PublicKey.String(), bobPriv.PublicKey.String()
+	alice := secure.NewSessions(chacha20poly1305.New, alicePriv.SharedKey)
+	alice.EnableLegacy()
+
+	// bob runs the release before the session keys
+	sharedKey, err := bobPriv.SharedKey(alicePub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := chacha20poly1305.New(sharedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacyNonce := func() []byte {
+		b := make([]byte, bob.NonceSize())
+		binary.LittleEndian.PutUint64(b[len(b)-8:], uint64(time.Now().Unix()/5))
+		return b
+	}
+
+	sealed, err := alice.Seal([]byte("data"), bobPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.Open(nil, legacyNonce(), sealed, nil); err == nil {
+		t.Fatal("expected the legacy peer failed to open the session datagram")
+	}
+
+	plain, err := alice.Open(bob.Seal(nil, legacyNonce(), []byte("hello"), nil), bobPub)
+	if err != nil || string(plain) != "hello" {
+		t.Fatalf("open the legacy datagram: %q %v", plain, err)
+	}
+	// alice seals to bob the legacy way since then
+	sealed, err = alice.Seal([]byte("data"), bobPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := bob.Open(nil, legacyNonce(), sealed, nil); err != nil || string(plain) != "data" {
+		t.Fatalf("legacy peer open: %q %v", plain, err)
+	}
+
+	// the legacy datagrams are refused unless enabled
+	strict := secure.NewSessions(chacha20poly1305.New, alicePriv.SharedKey)
+	if _, err := strict.Open(bob.Seal(nil, legacyNonce(), []byte("hello"), nil), bobPub); err == nil {
+		t.Fatal("expected the legacy datagram refused")
+	}
+}
+
+func TestSessionsHeaderVersion(t *testing.T) {
+	alice, bob, alicePub, bobPub := newSessionsPair(t)
+	sealed, err := alice.Seal([]byte("data"), bobPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sealed) != secure.SessionHeaderSize+len("data")+16 {
+		t.Fatalf("unexpected sealed size %d", len(sealed))
+	}
+	sealed[0]++
+	if _, err := bob.Open(sealed, alicePub); !errors.Is(err, secure.ErrInvalidSessionData) {
+		t.Fatalf("expected the unknown version refused, got %v", err)
+	}
+}
+
+func TestSetModifyRekeyConfigConcurrently(t *testing.T) {
+	alice, _, _, bobPub := newSessionsPair(t)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 100 {
+			secure.SetModifyRekeyConfig(func(cfg *secure.RekeyConfig) { cfg.Interval = time.Minute })
+		}
+	}()
+	for range 100 {
+		if _, err := alice.Seal([]byte("data"), bobPub); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+	secure.SetModifyRekeyConfig(func(cfg *secure.RekeyConfig) { cfg.Interval = 2 * time.Minute })
+}
@@ -7,3 +7,15 @@ type SymmAlgo interface {
 	Decrypt(data []byte, pubKey string) ([]byte, error)
 	SecretKey() ProvideSecretKey
 }
+
+// KeyMixer is implemented by the SymmAlgo that is able to mix an extra secret
+// into the key shared with a peer
+type KeyMixer interface {
+	MixKey(pubKey string, secret []byte) error
+}
+
+// EphemeralMixer is implemented by the SymmAlgo that is able to mix the secret of an ephemeral key
+// exchange into the session keys with a peer
+type EphemeralMixer interface {
+	MixEphemeral(pubKey string, secret []byte, initiator bool) error
+}
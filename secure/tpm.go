@@ -0,0 +1,267 @@
+package secure
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"runtime"
+
+	"storj.io/common/base58"
+)
+
+// The TPM 2.0 key backend seals the private key to the TPM, only the sealed blob is stored on the
+// disk and it is unsealed by the same TPM only. The TPM does not implement X25519, so the key is
+// unsealed into the memory of the process once it is opened, e.g. tpm:///var/lib/peerguard/node.key.tpm
+// or tpm:///var/lib/peerguard/node.key.tpm?device=/dev/tpm0
+func openTPMKeyBackend(uri *url.URL) (KeyBackend, error) {
+	blobFile := uri.Path
+	if uri.Opaque != "" { // tpm:relative/path
+		blobFile = uri.Opaque
+	}
+	if blobFile == "" {
+		return nil, fmt.Errorf("tpm key backend: sealed key file path is required")
+	}
+	tpm, err := openTPM(uri.Query().Get("device"))
+	if err != nil {
+		return nil, fmt.Errorf("tpm key backend: %w", err)
+	}
+	defer tpm.Close()
+	return loadOrGenerateTPMKey(tpm, blobFile)
+}
+
+func loadOrGenerateTPMKey(tpm io.ReadWriter, blobFile string) (*PrivateKey, error) {
+	stat, err := os.Stat(blobFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		key, err := GenerateCurve25519()
+		if err != nil {
+			return nil, err
+		}
+		blob, err := tpmSeal(tpm, key.b)
+		if err != nil {
+			return nil, fmt.Errorf("tpm seal: %w", err)
+		}
+		if err := writeKeyFile(blobFile, blob); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if runtime.GOOS != "windows" && stat.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("sealed key file %s permissions %#o are too open, 0600 is required", blobFile, stat.Mode().Perm())
+	}
+	blob, err := os.ReadFile(blobFile)
+	if err != nil {
+		return nil, err
+	}
+	b, err := tpmUnseal(tpm, blob)
+	if err != nil {
+		return nil, fmt.Errorf("tpm unseal %s: %w", blobFile, err)
+	}
+	return Curve25519PrivateKey(base58.Encode(b))
+}
+
+const (
+	tpmSTNoSessions uint16 = 0x8001
+	tpmSTSessions   uint16 = 0x8002
+
+	tpmRHOwner uint32 = 0x40000001
+	tpmRSPW    uint32 = 0x40000009 // the password authorization session
+
+	tpmCCCreatePrimary uint32 = 0x0131
+	tpmCCCreate        uint32 = 0x0153
+	tpmCCLoad          uint32 = 0x0157
+	tpmCCUnseal        uint32 = 0x015e
+	tpmCCFlushContext  uint32 = 0x0165
+
+	tpmAlgAES       uint16 = 0x0006
+	tpmAlgKeyedHash uint16 = 0x0008
+	tpmAlgSHA256    uint16 = 0x000b
+	tpmAlgNull      uint16 = 0x0010
+	tpmAlgECC       uint16 = 0x0023
+	tpmAlgCFB       uint16 = 0x0043
+	tpmECCNISTP256  uint16 = 0x0003
+
+	// fixedTPM | fixedParent | sensitiveDataOrigin | userWithAuth | noDA | restricted | decrypt
+	tpmSRKAttributes uint32 = 0x00030472
+	// fixedTPM | fixedParent | userWithAuth | noDA, the sealed data is provided rather than generated
+	tpmSealedAttributes uint32 = 0x00000452
+)
+
+// tpmSeal seals the data under the storage root key (the ECC P-256 primary key of the owner
+// hierarchy, derived from the same template each time), the blob is TPM2B_PRIVATE | TPM2B_PUBLIC
+func tpmSeal(tpm io.ReadWriter, data []byte) ([]byte, error) {
+	srk, err := tpmCreatePrimary(tpm)
+	if err != nil {
+		return nil, err
+	}
+	defer tpmFlushContext(tpm, srk)
+
+	var params []byte
+	params = binary.BigEndian.AppendUint16(params, uint16(4+len(data))) // TPM2B_SENSITIVE_CREATE
+	params = binary.BigEndian.AppendUint16(params, 0)                   // userAuth
+	params = tpmAppend2B(params, data)
+	public := binary.BigEndian.AppendUint16(nil, tpmAlgKeyedHash)
+	public = binary.BigEndian.AppendUint16(public, tpmAlgSHA256)
+	public = binary.BigEndian.AppendUint32(public, tpmSealedAttributes)
+	public = binary.BigEndian.AppendUint16(public, 0)          // authPolicy
+	public = binary.BigEndian.AppendUint16(public, tpmAlgNull) // scheme
+	public = binary.BigEndian.AppendUint16(public, 0)          // unique
+	params = tpmAppend2B(params, public)
+	params = binary.BigEndian.AppendUint16(params, 0) // outsideInfo
+	params = binary.BigEndian.AppendUint32(params, 0) // creationPCR
+
+	_, resp, err := tpmCommand(tpm, tpmCCCreate, []uint32{srk}, params, 0)
+	if err != nil {
+		return nil, err
+	}
+	private, resp, err := tpmRead2B(resp)
+	if err != nil {
+		return nil, err
+	}
+	outPublic, _, err := tpmRead2B(resp)
+	if err != nil {
+		return nil, err
+	}
+	return append(tpmAppend2B(nil, private), tpmAppend2B(nil, outPublic)...), nil
+}
+
+// tpmUnseal loads the sealed blob under the storage root key and unseals the data
+func tpmUnseal(tpm io.ReadWriter, blob []byte) ([]byte, error) {
+	private, rest, err := tpmRead2B(blob)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sealed blob: %w", err)
+	}
+	public, _, err := tpmRead2B(rest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sealed blob: %w", err)
+	}
+	srk, err := tpmCreatePrimary(tpm)
+	if err != nil {
+		return nil, err
+	}
+	defer tpmFlushContext(tpm, srk)
+
+	params := append(tpmAppend2B(nil, private), tpmAppend2B(nil, public)...)
+	handles, _, err := tpmCommand(tpm, tpmCCLoad, []uint32{srk}, params, 1)
+	if err != nil {
+		return nil, err
+	}
+	defer tpmFlushContext(tpm, handles[0])
+
+	_, resp, err := tpmCommand(tpm, tpmCCUnseal, handles, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	data, _, err := tpmRead2B(resp)
+	return data, err
+}
+
+func tpmCreatePrimary(tpm io.ReadWriter) (uint32, error) {
+	public := binary.BigEndian.AppendUint16(nil, tpmAlgECC)
+	public = binary.BigEndian.AppendUint16(public, tpmAlgSHA256)
+	public = binary.BigEndian.AppendUint32(public, tpmSRKAttributes)
+	public = binary.BigEndian.AppendUint16(public, 0) // authPolicy
+	public = binary.BigEndian.AppendUint16(public, tpmAlgAES)
+	public = binary.BigEndian.AppendUint16(public, 128)
+	public = binary.BigEndian.AppendUint16(public, tpmAlgCFB)
+	public = binary.BigEndian.AppendUint16(public, tpmAlgNull) // scheme
+	public = binary.BigEndian.AppendUint16(public, tpmECCNISTP256)
+	public = binary.BigEndian.AppendUint16(public, tpmAlgNull) // kdf
+	public = tpmAppend2B(public, make([]byte, 32))             // unique.x
+	public = tpmAppend2B(public, make([]byte, 32))             // unique.y
+
+	params := binary.BigEndian.AppendUint16(nil, 4) // TPM2B_SENSITIVE_CREATE, empty userAuth and data
+	params = binary.BigEndian.AppendUint32(params, 0)
+	params = tpmAppend2B(params, public)
+	params = binary.BigEndian.AppendUint16(params, 0) // outsideInfo
+	params = binary.BigEndian.AppendUint32(params, 0) // creationPCR
+	handles, _, err := tpmCommand(tpm, tpmCCCreatePrimary, []uint32{tpmRHOwner}, params, 1)
+	if err != nil {
+		return 0, err
+	}
+	return handles[0], nil
+}
+
+func tpmFlushContext(tpm io.ReadWriter, handle uint32) error {
+	cmd := binary.BigEndian.AppendUint16(nil, tpmSTNoSessions)
+	cmd = binary.BigEndian.AppendUint32(cmd, 14)
+	cmd = binary.BigEndian.AppendUint32(cmd, tpmCCFlushContext)
+	cmd = binary.BigEndian.AppendUint32(cmd, handle)
+	_, err := tpmTransmit(tpm, cmd)
+	return err
+}
+
+// tpmCommand runs the command authorized by the empty password, the response
+// handles (outHandles of them) and parameters are returned
+func tpmCommand(tpm io.ReadWriter, cc uint32, handles []uint32, params []byte, outHandles int) ([]uint32, []byte, error) {
+	cmd := binary.BigEndian.AppendUint16(nil, tpmSTSessions)
+	cmd = binary.BigEndian.AppendUint32(cmd, 0) // the size is set below
+	cmd = binary.BigEndian.AppendUint32(cmd, cc)
+	for _, handle := range handles {
+		cmd = binary.BigEndian.AppendUint32(cmd, handle)
+	}
+	// the commands authorize the first handle only
+	cmd = binary.BigEndian.AppendUint32(cmd, 9) // authorizationSize
+	cmd = binary.BigEndian.AppendUint32(cmd, tpmRSPW)
+	cmd = binary.BigEndian.AppendUint16(cmd, 0) // nonce
+	cmd = append(cmd, 0)                        // sessionAttributes
+	cmd = binary.BigEndian.AppendUint16(cmd, 0) // hmac
+	cmd = append(cmd, params...)
+	binary.BigEndian.PutUint32(cmd[2:], uint32(len(cmd)))
+
+	resp, err := tpmTransmit(tpm, cmd)
+	if err != nil {
+		return nil, nil, fmt.Errorf("tpm command %#x: %w", cc, err)
+	}
+	if len(resp) < 4*outHandles+4 {
+		return nil, nil, fmt.Errorf("tpm command %#x: short response", cc)
+	}
+	var out []uint32
+	for range outHandles {
+		out = append(out, binary.BigEndian.Uint32(resp))
+		resp = resp[4:]
+	}
+	paramSize := binary.BigEndian.Uint32(resp)
+	if int(paramSize) > len(resp)-4 {
+		return nil, nil, fmt.Errorf("tpm command %#x: short response", cc)
+	}
+	return out, resp[4 : 4+paramSize], nil
+}
+
+// tpmTransmit writes the command and reads the response, the response after the header is returned
+func tpmTransmit(tpm io.ReadWriter, cmd []byte) ([]byte, error) {
+	if _, err := tpm.Write(cmd); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, 4096)
+	n, err := tpm.Read(resp)
+	if err != nil {
+		return nil, err
+	}
+	resp = resp[:n]
+	if len(resp) < 10 || int(binary.BigEndian.Uint32(resp[2:])) != len(resp) {
+		return nil, errors.New("malformed response")
+	}
+	if rc := binary.BigEndian.Uint32(resp[6:]); rc != 0 {
+		return nil, fmt.Errorf("response code %#x", rc)
+	}
+	return resp[10:], nil
+}
+
+func tpmAppend2B(b, data []byte) []byte {
+	return append(binary.BigEndian.AppendUint16(b, uint16(len(data))), data...)
+}
+
+func tpmRead2B(b []byte) (data, rest []byte, err error) {
+	if len(b) < 2 || int(binary.BigEndian.Uint16(b)) > len(b)-2 {
+		return nil, nil, errors.New("short sized buffer")
+	}
+	size := 2 + int(binary.BigEndian.Uint16(b))
+	return b[2:size], b[size:], nil
+}
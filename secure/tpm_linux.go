@@ -0,0 +1,20 @@
+package secure
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+)
+
+// openTPM opens the TPM character device, the in-kernel resource manager is preferred
+func openTPM(device string) (io.ReadWriteCloser, error) {
+	if device != "" {
+		return os.OpenFile(device, os.O_RDWR, 0)
+	}
+	f, err := os.OpenFile("/dev/tpmrm0", os.O_RDWR, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		return os.OpenFile("/dev/tpm0", os.O_RDWR, 0)
+	}
+	return f, err
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package secure
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+)
+
+func openTPM(string) (io.ReadWriteCloser, error) {
+	return nil, fmt.Errorf("tpm is not supported on %s: %w", runtime.GOOS, errors.ErrUnsupported)
+}
@@ -0,0 +1,137 @@
+package secure
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeTPM seals the data to itself, enough to check the commands and the responses are framed
+type fakeTPM struct {
+	t      *testing.T
+	rc     uint32 // the response code of all the commands
+	resp   []byte
+	loaded map[uint32][]byte
+	next   uint32
+}
+
+func (tpm *fakeTPM) Write(cmd []byte) (int, error) {
+	if len(cmd) < 10 || int(binary.BigEndian.Uint32(cmd[2:])) != len(cmd) {
+		tpm.t.Fatalf("malformed command %x", cmd)
+	}
+	cc := binary.BigEndian.Uint32(cmd[6:])
+	if cc == tpmCCFlushContext {
+		delete(tpm.loaded, binary.BigEndian.Uint32(cmd[10:]))
+		tpm.respond(tpmSTNoSessions, nil, nil)
+		return len(cmd), nil
+	}
+	handle := binary.BigEndian.Uint32(cmd[10:])
+	if size := binary.BigEndian.Uint32(cmd[14:]); size != 9 || binary.BigEndian.Uint32(cmd[18:]) != tpmRSPW {
+		tpm.t.Fatalf("command %#x: expected the password session", cc)
+	}
+	params := cmd[27:]
+	tpm.next++
+	switch cc {
+	case tpmCCCreatePrimary:
+		tpm.loaded[0x80000000+tpm.next] = nil
+		tpm.respond(tpmSTSessions, []uint32{0x80000000 + tpm.next}, nil)
+	case tpmCCCreate:
+		if _, ok := tpm.loaded[handle]; !ok {
+			tpm.t.Fatalf("create: parent %#x not loaded", handle)
+		}
+		data, _, err := tpmRead2B(params[4:])
+		if err != nil {
+			tpm.t.Fatal(err)
+		}
+		sealed := append(tpmAppend2B(nil, bytes.Repeat([]byte{0x5a}, 8)), tpmAppend2B(nil, data)...)
+		tpm.respond(tpmSTSessions, nil, append(sealed, 0, 0)) // the creation data is ignored
+	case tpmCCLoad:
+		_, rest, err := tpmRead2B(params)
+		if err != nil {
+			tpm.t.Fatal(err)
+		}
+		public, _, err := tpmRead2B(rest)
+		if err != nil {
+			tpm.t.Fatal(err)
+		}
+		tpm.loaded[0x80000000+tpm.next] = public
+		tpm.respond(tpmSTSessions, []uint32{0x80000000 + tpm.next}, tpmAppend2B(nil, []byte("name")))
+	case tpmCCUnseal:
+		data, ok := tpm.loaded[handle]
+		if !ok {
+			tpm.t.Fatalf("unseal: %#x not loaded", handle)
+		}
+		tpm.respond(tpmSTSessions, nil, tpmAppend2B(nil, data))
+	default:
+		tpm.t.Fatalf("unexpected command %#x", cc)
+	}
+	return len(cmd), nil
+}
+
+func (tpm *fakeTPM) respond(tag uint16, handles []uint32, params []byte) {
+	resp := binary.BigEndian.AppendUint16(nil, tag)
+	resp = binary.BigEndian.AppendUint32(resp, 0)
+	resp = binary.BigEndian.AppendUint32(resp, tpm.rc)
+	if tpm.rc != 0 {
+		binary.BigEndian.PutUint32(resp[2:], uint32(len(resp)))
+		tpm.resp = resp
+		return
+	}
+	for _, handle := range handles {
+		resp = binary.BigEndian.AppendUint32(resp, handle)
+	}
+	if tag == tpmSTSessions {
+		resp = binary.BigEndian.AppendUint32(resp, uint32(len(params)))
+		resp = append(append(resp, params...), 0, 0, 0, 0, 0)
+	}
+	binary.BigEndian.PutUint32(resp[2:], uint32(len(resp)))
+	tpm.resp = resp
+}
+
+func (tpm *fakeTPM) Read(b []byte) (int, error) {
+	if tpm.resp == nil {
+		return 0, fmt.Errorf("no response")
+	}
+	n := copy(b, tpm.resp)
+	tpm.resp = nil
+	return n, nil
+}
+
+func TestTPMKeyBackend(t *testing.T) {
+	tpm := &fakeTPM{t: t, loaded: make(map[uint32][]byte)}
+	blobFile := filepath.Join(t.TempDir(), "node.key.tpm")
+	key, err := loadOrGenerateTPMKey(tpm, blobFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := os.ReadFile(blobFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(blob, key.b) {
+		t.Fatal("expected the fake tpm sealed the private key")
+	}
+	loaded, err := loadOrGenerateTPMKey(tpm, blobFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Public() != key.Public() {
+		t.Errorf("expected the key %s unsealed, got %s", key.Public(), loaded.Public())
+	}
+	if len(tpm.loaded) != 0 {
+		t.Errorf("expected all the handles flushed, %d left", len(tpm.loaded))
+	}
+}
+
+func TestTPMResponseCode(t *testing.T) {
+	tpm := &fakeTPM{t: t, rc: 0x922, loaded: make(map[uint32][]byte)} // TPM_RC_RETRY
+	if _, err := tpmSeal(tpm, []byte("key")); err == nil {
+		t.Fatal("expected the response code reported")
+	}
+	if _, err := tpmUnseal(tpm, []byte{0, 8, 1}); err == nil {
+		t.Fatal("expected the truncated blob refused")
+	}
+}
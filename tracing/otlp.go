@@ -0,0 +1,243 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	maxQueueSize  = 2048
+	maxBatchSize  = 512
+	flushInterval = 5 * time.Second
+)
+
+// exporter batches the ended spans and posts them as the OTLP/HTTP json
+type exporter struct {
+	endpoint    string
+	header      http.Header
+	serviceName string
+	ratio       float64
+	client      http.Client
+	queue       chan otlpSpan
+	closed      chan struct{}
+	done        chan struct{}
+}
+
+func newExporter(endpoint string, header http.Header, serviceName string, ratio float64) *exporter {
+	e := &exporter{
+		endpoint:    endpoint,
+		header:      header,
+		serviceName: serviceName,
+		ratio:       ratio,
+		client:      http.Client{Timeout: 10 * time.Second},
+		queue:       make(chan otlpSpan, maxQueueSize),
+		closed:      make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+// export queues the span, it is dropped if the queue is full rather than blocking the signaling
+func (e *exporter) export(s *Span, end time.Time) {
+	span := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              1, // internal
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+		Attributes:        attributes(s.attrs),
+	}
+	if s.parentID != [8]byte{} {
+		span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	if s.err != "" {
+		span.Status = &otlpStatus{Code: 2, Message: s.err}
+	}
+	select {
+	case e.queue <- span:
+	default:
+		slog.Debug("TracingSpanDropped", "span", s.name)
+	}
+}
+
+func (e *exporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	var batch []otlpSpan
+	post := func() {
+		if len(batch) > 0 {
+			if err := e.post(batch); err != nil {
+				slog.Debug("TracingExport", "spans", len(batch), "err", err)
+			}
+			batch = nil
+		}
+	}
+	drain := func() {
+		for {
+			select {
+			case span := <-e.queue:
+				batch = append(batch, span)
+				if len(batch) >= maxBatchSize {
+					post()
+				}
+			default:
+				post()
+				return
+			}
+		}
+	}
+	for {
+		select {
+		case span := <-e.queue:
+			batch = append(batch, span)
+			if len(batch) >= maxBatchSize {
+				post()
+			}
+		case <-ticker.C:
+			post()
+		case <-e.closed:
+			drain()
+			return
+		}
+	}
+}
+
+func (e *exporter) shutdown(ctx context.Context) error {
+	close(e.closed)
+	select {
+	case <-e.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *exporter) post(spans []otlpSpan) error {
+	body, err := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: attributes([]any{"service.name", e.serviceName})},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/rkonfj/peerguard"},
+			Spans: spans,
+		}},
+	}}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range e.header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector responded %s", resp.Status)
+	}
+	return nil
+}
+
+// attributes converts the key value pairs to the OTLP attributes
+func attributes(kvs []any) []otlpKeyValue {
+	var attrs []otlpKeyValue
+	for i := 0; i+1 < len(kvs); i += 2 {
+		key, ok := kvs[i].(string)
+		if !ok {
+			continue
+		}
+		var v otlpAnyValue
+		switch val := kvs[i+1].(type) {
+		case bool:
+			v.BoolValue = &val
+		case int:
+			s := strconv.Itoa(val)
+			v.IntValue = &s
+		case int64:
+			s := strconv.FormatInt(val, 10)
+			v.IntValue = &s
+		case uint64:
+			s := strconv.FormatUint(val, 10)
+			v.IntValue = &s
+		case float64:
+			v.DoubleValue = &val
+		case time.Duration:
+			s := strconv.FormatInt(val.Milliseconds(), 10)
+			v.IntValue = &s
+			key += "_ms"
+		case fmt.Stringer:
+			s := val.String()
+			v.StringValue = &s
+		default:
+			s := fmt.Sprint(val)
+			v.StringValue = &s
+		}
+		attrs = append(attrs, otlpKeyValue{Key: key, Value: v})
+	}
+	return attrs
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            *otlpStatus    `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
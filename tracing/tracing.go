@@ -0,0 +1,207 @@
+// Package tracing records the spans of the signaling operations (peermap connect, secret issuance,
+// lead-disco, relay forwarding, the websocket dial and the hole punching) and exports them to an
+// OpenTelemetry collector by OTLP/HTTP, the trace context is propagated by the W3C traceparent header
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+var exp atomic.Pointer[exporter]
+
+// AddFlags adds the tracing flags, the tracing is disabled unless the otlp endpoint is set
+func AddFlags(flags *pflag.FlagSet) {
+	flags.String("otlp-endpoint", "", "OTLP/HTTP endpoint the spans are exported to, e.g. http://127.0.0.1:4318 (default $OTEL_EXPORTER_OTLP_ENDPOINT, tracing is disabled if empty)")
+	flags.StringSlice("otlp-header", nil, "header sent with the exported spans as key=value, e.g. authorization=Bearer xxx")
+	flags.Float64("trace-sample-ratio", 1, "ratio of the root spans sampled, the child spans follow the parent")
+}
+
+// Setup starts exporting the spans of the service by the flags
+func Setup(flags *pflag.FlagSet, serviceName string) error {
+	endpoint, err := flags.GetString("otlp-endpoint")
+	if err != nil {
+		return err
+	}
+	headerArgs, err := flags.GetStringSlice("otlp-header")
+	if err != nil {
+		return err
+	}
+	ratio, err := flags.GetFloat64("trace-sample-ratio")
+	if err != nil {
+		return err
+	}
+	if endpoint == "" {
+		endpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	}
+	if endpoint == "" {
+		return nil
+	}
+	if ratio < 0 || ratio > 1 {
+		return errors.New("trace-sample-ratio must be within [0, 1]")
+	}
+	header := http.Header{}
+	for _, arg := range headerArgs {
+		k, v, ok := strings.Cut(arg, "=")
+		if !ok {
+			return fmt.Errorf("invalid otlp header %q, key=value expected", arg)
+		}
+		header.Add(strings.TrimSpace(k), strings.TrimSpace(v))
+	}
+	if !strings.HasSuffix(endpoint, "/v1/traces") {
+		endpoint = strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+	}
+	if old := exp.Swap(newExporter(endpoint, header, serviceName, ratio)); old != nil {
+		old.shutdown(context.Background())
+	}
+	return nil
+}
+
+// Shutdown exports the buffered spans and stops the tracing
+func Shutdown(ctx context.Context) error {
+	if e := exp.Swap(nil); e != nil {
+		return e.shutdown(ctx)
+	}
+	return nil
+}
+
+// Span is an operation of a trace, the nil span (tracing is disabled) ignores all the calls
+type Span struct {
+	exp      *exporter
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	sampled  bool
+	name     string
+	start    time.Time
+	attrs    []any
+	err      string
+	ended    atomic.Bool
+}
+
+type spanContextKey struct{}
+
+// Start starts the span as a child of the span in ctx (or the one extracted from the traceparent),
+// a new trace is sampled by the trace-sample-ratio. attrs are the key value pairs like slog
+func Start(ctx context.Context, name string, attrs ...any) (context.Context, *Span) {
+	return start(ctx, name, 1, attrs)
+}
+
+// StartSampled is Start but only the ratio of the new traces are sampled additionally,
+// for the operations too frequent to trace each one like the relay forwarding
+func StartSampled(ctx context.Context, name string, ratio float64, attrs ...any) (context.Context, *Span) {
+	return start(ctx, name, ratio, attrs)
+}
+
+func start(ctx context.Context, name string, ratio float64, attrs []any) (context.Context, *Span) {
+	e := exp.Load()
+	if e == nil {
+		return ctx, nil
+	}
+	span := &Span{exp: e, name: name, start: time.Now(), attrs: attrs}
+	rand.Read(span.spanID[:])
+	if parent, ok := ctx.Value(spanContextKey{}).(*Span); ok {
+		span.traceID, span.parentID, span.sampled = parent.traceID, parent.spanID, parent.sampled
+	} else {
+		rand.Read(span.traceID[:])
+		span.sampled = sample(e.ratio * ratio)
+	}
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+// FromContext returns the span started in ctx, nil if none
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanContextKey{}).(*Span)
+	if span == nil || span.exp == nil {
+		return nil
+	}
+	return span
+}
+
+// SetAttr adds the attribute to the span
+func (s *Span) SetAttr(key string, value any) {
+	if s == nil || !s.sampled {
+		return
+	}
+	s.attrs = append(s.attrs, key, value)
+}
+
+// SetError marks the span failed, nil err is ignored
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.err = err.Error()
+}
+
+// End ends the span and queues it to be exported, the calls after the first one are ignored
+func (s *Span) End() {
+	if s == nil || !s.sampled || s.ended.Swap(true) {
+		return
+	}
+	s.exp.export(s, time.Now())
+}
+
+// Inject writes the traceparent of the span in ctx to the header
+func Inject(ctx context.Context, header http.Header) {
+	span, ok := ctx.Value(spanContextKey{}).(*Span)
+	if !ok {
+		return
+	}
+	flags := "00"
+	if span.sampled {
+		flags = "01"
+	}
+	header.Set("traceparent", fmt.Sprintf("00-%s-%s-%s",
+		hex.EncodeToString(span.traceID[:]), hex.EncodeToString(span.spanID[:]), flags))
+}
+
+// Extract returns ctx carrying the remote span of the traceparent header,
+// the spans started by the returned ctx join the trace of the remote
+func Extract(ctx context.Context, header http.Header) context.Context {
+	parts := strings.Split(header.Get("traceparent"), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return ctx
+	}
+	var remote Span
+	if _, err := hex.Decode(remote.traceID[:], []byte(parts[1])); err != nil {
+		return ctx
+	}
+	if _, err := hex.Decode(remote.spanID[:], []byte(parts[2])); err != nil {
+		return ctx
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return ctx
+	}
+	if remote.traceID == [16]byte{} || remote.spanID == [8]byte{} {
+		return ctx
+	}
+	remote.sampled = flags[0]&1 == 1
+	return context.WithValue(ctx, spanContextKey{}, &remote)
+}
+
+func sample(ratio float64) bool {
+	if ratio >= 1 {
+		return true
+	}
+	if ratio <= 0 {
+		return false
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(1<<53))
+	if err != nil {
+		return false
+	}
+	return float64(n.Int64()) < ratio*(1<<53)
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package upnp
+
+import (
+	"errors"
+	"net"
+)
+
+func DefaultGateway() (net.IP, error) {
+	return nil, errors.New("default gateway lookup is not supported on this platform")
+}
@@ -0,0 +1,118 @@
+package upnp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// natpmpPort is the port the NAT-PMP and the PCP servers of the gateway listen on
+const natpmpPort = 5351
+
+// NATPMP is the NAT-PMP client of the default gateway (RFC 6886)
+type NATPMP struct {
+	gateway net.IP
+}
+
+// DiscoverNATPMP finds the default gateway and checks that it answers the NAT-PMP requests
+func DiscoverNATPMP() (*NATPMP, error) {
+	gw, err := DefaultGateway()
+	if err != nil {
+		return nil, err
+	}
+	nat := NATPMP{gateway: gw}
+	if _, err := nat.GetExternalAddress(); err != nil {
+		return nil, err
+	}
+	return &nat, nil
+}
+
+func (n *NATPMP) GetExternalAddress() (net.IP, error) {
+	resp, err := exchangeGateway(n.gateway, []byte{0, 0}, 12)
+	if err != nil {
+		return nil, err
+	}
+	if err := natpmpResult(resp, 0); err != nil {
+		return nil, err
+	}
+	return net.IP(resp[8:12]), nil
+}
+
+// AddPortMapping requests the gateway to map the external port (suggested only) to the internal
+// port of this host, the external port assigned by the gateway is returned
+func (n *NATPMP) AddPortMapping(protocol string, externalPort, internalPort int, timeout int) (mappedExternalPort int, err error) {
+	op, err := natpmpOp(protocol)
+	if err != nil {
+		return 0, err
+	}
+	req := make([]byte, 12)
+	req[1] = op
+	binary.BigEndian.PutUint16(req[4:6], uint16(internalPort))
+	binary.BigEndian.PutUint16(req[6:8], uint16(externalPort))
+	binary.BigEndian.PutUint32(req[8:12], uint32(timeout))
+	resp, err := exchangeGateway(n.gateway, req, 16)
+	if err != nil {
+		return 0, err
+	}
+	if err := natpmpResult(resp, op); err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint16(resp[10:12])), nil
+}
+
+// DeletePortMapping deletes the mapping of the internal port
+func (n *NATPMP) DeletePortMapping(protocol string, externalPort, internalPort int) error {
+	_, err := n.AddPortMapping(protocol, 0, internalPort, 0)
+	return err
+}
+
+func natpmpOp(protocol string) (uint8, error) {
+	switch protocol {
+	case "udp":
+		return 1, nil
+	case "tcp":
+		return 2, nil
+	}
+	return 0, fmt.Errorf("unsupported protocol %s", protocol)
+}
+
+func natpmpResult(resp []byte, op uint8) error {
+	if resp[0] != 0 || resp[1] != 128+op {
+		return errors.New("malformed nat-pmp response")
+	}
+	if code := binary.BigEndian.Uint16(resp[2:4]); code != 0 {
+		return fmt.Errorf("nat-pmp result code %d", code)
+	}
+	return nil
+}
+
+// exchangeGateway sends the request to the port mapping server of the gateway, it is retransmitted
+// with the doubled timeout (250ms at first) until the response of minLen bytes at least is read
+func exchangeGateway(gateway net.IP, req []byte, minLen int) ([]byte, error) {
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: gateway, Port: natpmpPort})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	buf := make([]byte, 1100)
+	timeout := 250 * time.Millisecond
+	for range 3 {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				break
+			}
+			if n >= minLen {
+				return buf[:n], nil
+			}
+		}
+		timeout *= 2
+	}
+	return nil, fmt.Errorf("gateway %s does not respond", gateway)
+}
@@ -0,0 +1,109 @@
+package upnp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+const (
+	pcpVersion = 2
+
+	pcpOpAnnounce = 0
+	pcpOpMap      = 1
+)
+
+// PCP is the Port Control Protocol client of the default gateway (RFC 6887), the successor of the
+// NAT-PMP
+type PCP struct {
+	gateway  net.IP
+	clientIP net.IP
+	nonce    [12]byte // the mappings of this client are refreshed and deleted by it
+}
+
+// DiscoverPCP finds the default gateway and checks that it answers the PCP requests
+func DiscoverPCP() (*PCP, error) {
+	gw, err := DefaultGateway()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: gw, Port: natpmpPort})
+	if err != nil {
+		return nil, err
+	}
+	clientIP := conn.LocalAddr().(*net.UDPAddr).IP
+	conn.Close()
+	pcp := PCP{gateway: gw, clientIP: clientIP}
+	rand.Read(pcp.nonce[:])
+	resp, err := exchangeGateway(gw, pcp.header(pcpOpAnnounce, 0), 24)
+	if err != nil {
+		return nil, err
+	}
+	if err := pcpResult(resp, pcpOpAnnounce); err != nil {
+		return nil, err
+	}
+	return &pcp, nil
+}
+
+// AddPortMapping requests the gateway to map the external port (suggested only) to the internal
+// port of this host, the external address assigned by the gateway is returned
+func (p *PCP) AddPortMapping(protocol string, externalPort, internalPort int, timeout int) (*net.UDPAddr, error) {
+	var proto uint8
+	switch protocol {
+	case "udp":
+		proto = 17
+	case "tcp":
+		proto = 6
+	default:
+		return nil, fmt.Errorf("unsupported protocol %s", protocol)
+	}
+	req := p.header(pcpOpMap, timeout)
+	data := make([]byte, 36)
+	copy(data[0:12], p.nonce[:])
+	data[12] = proto
+	binary.BigEndian.PutUint16(data[16:18], uint16(internalPort))
+	binary.BigEndian.PutUint16(data[18:20], uint16(externalPort))
+	copy(data[20:36], net.IPv4zero.To16()) // any external ipv4 address
+	resp, err := exchangeGateway(p.gateway, append(req, data...), 60)
+	if err != nil {
+		return nil, err
+	}
+	if err := pcpResult(resp, pcpOpMap); err != nil {
+		return nil, err
+	}
+	if string(resp[24:36]) != string(p.nonce[:]) {
+		return nil, errors.New("pcp nonce mismatch")
+	}
+	return &net.UDPAddr{
+		IP:   net.IP(resp[44:60]).To4(),
+		Port: int(binary.BigEndian.Uint16(resp[42:44])),
+	}, nil
+}
+
+// DeletePortMapping deletes the mapping of the internal port
+func (p *PCP) DeletePortMapping(protocol string, externalPort, internalPort int) error {
+	_, err := p.AddPortMapping(protocol, externalPort, internalPort, 0)
+	return err
+}
+
+// header is the common request header, the client ip is in the ipv4-mapped ipv6 form
+func (p *PCP) header(op uint8, lifetime int) []byte {
+	b := make([]byte, 24)
+	b[0] = pcpVersion
+	b[1] = op
+	binary.BigEndian.PutUint32(b[4:8], uint32(lifetime))
+	copy(b[8:24], p.clientIP.To16())
+	return b
+}
+
+func pcpResult(resp []byte, op uint8) error {
+	if resp[0] != pcpVersion || resp[1] != 0x80|op {
+		return errors.New("malformed pcp response")
+	}
+	if code := resp[3]; code != 0 {
+		return fmt.Errorf("pcp result code %d", code)
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package vpn
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rkonfj/peerguard/disco"
+)
+
+// ACLFilter drops the packets of the peers not allowed by the acl of the network. It is the
+// inbound and the outbound handler of the data plane, the flows initiated by this host are tracked
+// so that the replies of the peers are accepted. It should be the first inbound handler and the
+// last outbound handler so that the packets are filtered as they are between the peers. The
+// source ip of the packet must be routed to the peer sent it, so that the peer can not claim the
+// tags of the others by spoofing
+type ACLFilter struct {
+	// Route resolves the peer the ip (the overlay ip or the subnet routed) is routed to
+	Route func(ip netip.Addr) (net.Addr, bool)
+	// Tags resolves the tags of the peer
+	Tags func(peer net.Addr) ([]string, bool)
+
+	update atomic.Pointer[disco.ACLUpdate]
+
+	mutex     sync.Mutex
+	flows     map[flowKey]time.Time
+	lastSweep time.Time
+}
+
+// flowKey is the flow initiated by this host, the ports of the icmp echo are the echo id
+type flowKey struct {
+	proto      uint8
+	local      netip.Addr
+	remote     netip.Addr
+	localPort  uint16
+	remotePort uint16
+}
+
+// NewACLFilter creates the filter allows all until the acl is updated
+func NewACLFilter(route func(ip netip.Addr) (net.Addr, bool), tags func(peer net.Addr) ([]string, bool)) *ACLFilter {
+	return &ACLFilter{Route: route, Tags: tags, flows: make(map[flowKey]time.Time)}
+}
+
+// Update replaces the acl and the tags of this host
+func (f *ACLFilter) Update(update disco.ACLUpdate) {
+	f.update.Store(&update)
+}
+
+func (f *ACLFilter) Name() string {
+	return "acl"
+}
+
+// VerifySender drops the packet whose source ip is routed to the other peer than the sender, the
+// one not routed to any peer (e.g. from the internet via the exit node) is left to In which only
+// accepts it as the reply of the flow tracked
+func (f *ACLFilter) VerifySender(packet []byte, peer net.Addr) bool {
+	if update := f.update.Load(); update == nil || !update.ACL.Enabled() {
+		return true
+	}
+	src, _, _, _, ok := parseIP(packet[IPPacketOffset:])
+	if !ok {
+		return false
+	}
+	routed, ok := f.Route(src)
+	return !ok || routed.String() == peer.String()
+}
+
+// Out tracks the flow of the packet to the peer
+func (f *ACLFilter) Out(packet []byte) []byte {
+	if update := f.update.Load(); update == nil || !update.ACL.Enabled() {
+		return packet
+	}
+	src, dst, proto, l4, ok := parseIP(packet[IPPacketOffset:])
+	if !ok {
+		return packet
+	}
+	if srcPort, dstPort, ok := flowPorts(proto, l4, true); ok {
+		f.track(flowKey{proto: proto, local: src, remote: dst, localPort: srcPort, remotePort: dstPort})
+	}
+	return packet
+}
+
+// In drops the packet of the peer unless it is the reply of the flow tracked or the acl allows
+// the peer to reach the destination port
+func (f *ACLFilter) In(packet []byte) []byte {
+	update := f.update.Load()
+	if update == nil || !update.ACL.Enabled() {
+		return packet
+	}
+	src, dst, proto, l4, ok := parseIP(packet[IPPacketOffset:])
+	if !ok {
+		return nil
+	}
+	srcPort, dstPort, ok := flowPorts(proto, l4, false)
+	if ok && f.tracked(flowKey{proto: proto, local: dst, remote: src, localPort: dstPort, remotePort: srcPort}) {
+		return packet
+	}
+	peer, ok := f.Route(src)
+	if !ok {
+		return nil
+	}
+	tags, ok := f.Tags(peer)
+	if !ok {
+		return nil
+	}
+	var protoName string
+	var port uint16
+	switch proto {
+	case protoTCP, protoUDP:
+		protoName, port = "tcp", dstPort
+		if proto == protoUDP {
+			protoName = "udp"
+		}
+	case protoICMP, protoICMPv6:
+		protoName = "icmp"
+	}
+	if !update.ACL.Allowed(tags, update.Tags, protoName, port) {
+		return nil
+	}
+	return packet
+}
+
+func (f *ACLFilter) track(key flowKey) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	now := time.Now()
+	if now.Sub(f.lastSweep) > natICMPTimeout {
+		f.lastSweep = now
+		for k, expires := range f.flows {
+			if now.After(expires) {
+				delete(f.flows, k)
+			}
+		}
+	}
+	f.flows[key] = now.Add(natTimeout(key.proto))
+}
+
+func (f *ACLFilter) tracked(key flowKey) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	expires, ok := f.flows[key]
+	return ok && time.Now().Before(expires)
+}
+
+// flowPorts are the source and the destination ports of the tcp and the udp, the echo id of the
+// icmp echo request (or the reply if not request) as both
+func flowPorts(proto uint8, l4 []byte, request bool) (srcPort, dstPort uint16, ok bool) {
+	switch proto {
+	case protoTCP, protoUDP:
+		srcPort, ok1 := l4Port(proto, l4, true)
+		dstPort, ok2 := l4Port(proto, l4, false)
+		return srcPort, dstPort, ok1 && ok2
+	case protoICMP, protoICMPv6:
+		id, ok := l4Port(proto, l4, request)
+		return id, id, ok
+	}
+	return 0, 0, false
+}
@@ -0,0 +1,92 @@
+package vpn_test
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/rkonfj/peerguard/disco"
+	"github.com/rkonfj/peerguard/vpn"
+)
+
+// newACLFilter creates the filter of the host tagged db, 10.0.0.2 is routed to the peer dev and
+// 10.0.0.3 to the peer guest
+func newACLFilter(t *testing.T) *vpn.ACLFilter {
+	t.Helper()
+	routes := map[netip.Addr]disco.PeerID{
+		netip.MustParseAddr("10.0.0.2"): "dev",
+		netip.MustParseAddr("10.0.0.3"): "guest",
+	}
+	tags := map[disco.PeerID][]string{"dev": {"dev"}, "guest": {"guest"}}
+	f := vpn.NewACLFilter(func(ip netip.Addr) (net.Addr, bool) {
+		peer, ok := routes[ip]
+		return peer, ok
+	}, func(peer net.Addr) ([]string, bool) {
+		peerTags, ok := tags[disco.PeerID(peer.String())]
+		return peerTags, ok
+	})
+	acl := disco.ACL{Rules: []disco.ACLRule{{Src: []string{"dev"}, Dst: []string{"db"}, Ports: []string{"tcp:5432"}}}}
+	f.Update(disco.ACLUpdate{ACL: acl, Tags: []string{"db"}})
+	return f
+}
+
+// offset prepends the headroom the data plane reserves before the ip packet
+func offset(pkt []byte) []byte {
+	return append(make([]byte, vpn.IPPacketOffset), pkt...)
+}
+
+func TestACLFilterTags(t *testing.T) {
+	f := newACLFilter(t)
+	if f.In(offset(ipv4Packet("10.0.0.2", "10.0.0.1", 6, 0, tcpHeader(5432)))) == nil {
+		t.Error("expected the dev allowed to reach the db")
+	}
+	if f.In(offset(ipv4Packet("10.0.0.3", "10.0.0.1", 6, 0, tcpHeader(5432)))) != nil {
+		t.Error("expected the guest denied")
+	}
+	if f.In(offset(ipv4Packet("10.0.0.9", "10.0.0.1", 6, 0, tcpHeader(5432)))) != nil {
+		t.Error("expected the ip routed to no peer denied")
+	}
+}
+
+func TestACLFilterTrackedReply(t *testing.T) {
+	f := newACLFilter(t)
+	request := tcpHeader(22)
+	f.Out(offset(ipv4Packet("10.0.0.1", "10.0.0.3", 6, 0, request)))
+	reply := tcpHeader(40000)
+	reply[0], reply[1] = 0, 22
+	if f.In(offset(ipv4Packet("10.0.0.3", "10.0.0.1", 6, 0, reply))) == nil {
+		t.Error("expected the reply of the flow tracked allowed")
+	}
+}
+
+func TestACLFilterSpoofedSource(t *testing.T) {
+	f := newACLFilter(t)
+	// the guest claims the source ip of the dev to be allowed by the tags of the dev
+	spoofed := offset(ipv4Packet("10.0.0.2", "10.0.0.1", 6, 0, tcpHeader(5432)))
+	if f.VerifySender(spoofed, disco.PeerID("guest")) {
+		t.Error("expected the packet of the guest spoofing the dev refused")
+	}
+	if !f.VerifySender(spoofed, disco.PeerID("dev")) {
+		t.Error("expected the packet of the dev accepted")
+	}
+	// the source routed to no peer (e.g. via the exit node) is left to In
+	internet := offset(ipv4Packet("1.1.1.1", "10.0.0.1", 6, 0, tcpHeader(5432)))
+	if !f.VerifySender(internet, disco.PeerID("guest")) {
+		t.Error("expected the source routed to no peer left to In")
+	}
+	if f.In(internet) != nil {
+		t.Error("expected the source routed to no peer denied unless the flow is tracked")
+	}
+	if f.VerifySender(offset([]byte{0x45}), disco.PeerID("dev")) {
+		t.Error("expected the malformed packet refused")
+	}
+}
+
+func TestACLFilterDisabled(t *testing.T) {
+	f := newACLFilter(t)
+	f.Update(disco.ACLUpdate{})
+	spoofed := offset(ipv4Packet("10.0.0.2", "10.0.0.1", 6, 0, tcpHeader(5432)))
+	if !f.VerifySender(spoofed, disco.PeerID("guest")) || f.In(spoofed) == nil {
+		t.Error("expected all allowed without rules")
+	}
+}
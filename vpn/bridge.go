@@ -0,0 +1,53 @@
+package vpn
+
+import "net"
+
+// Bridge is a network bridged into the data plane besides the tun, e.g. the wireguard clients of the
+// gateway. The packets to the ips the bridge contains are written to it rather than the tun or the
+// peers, the packets sent by it are routed like the ones read from the tun. The packets carry the
+// IPPacketOffset headroom in both directions
+type Bridge interface {
+	Name() string
+	Contains(ip net.IP) bool
+	// Start starts the bridge, send queues the copy of the packet sent by the bridge to be routed
+	Start(send func(packet []byte)) error
+	// Write writes the packet to the bridge, the packet is reused by the data plane after Write
+	// returns so the bridge copies it if it is queued
+	Write(packet []byte) error
+	Close() error
+}
+
+// bridge finds the bridge contains the destination of the packet
+func (vpn *VPN) bridge(packet []byte) Bridge {
+	if len(vpn.cfg.Bridges) == 0 {
+		return nil
+	}
+	dst := destination(packet[IPPacketOffset:])
+	if dst == nil {
+		return nil
+	}
+	for _, b := range vpn.cfg.Bridges {
+		if b.Contains(dst) {
+			return b
+		}
+	}
+	return nil
+}
+
+func (vpn *VPN) writeBridge(b Bridge, packet []byte) {
+	if err := b.Write(packet); err != nil {
+		vpn.drops.writeBridge.Add(1)
+		vpn.logger.Debug("WriteToBridgeError", "bridge", b.Name(), "detail", err.Error())
+	}
+}
+
+// destination is the destination ip of the ip packet, nil if the packet is too short
+func destination(pkt []byte) net.IP {
+	if len(pkt) >= 20 && pkt[0]>>4 == 4 {
+		return net.IP(pkt[16:20])
+	}
+	if len(pkt) >= 40 && pkt[0]>>4 == 6 {
+		return net.IP(pkt[24:40])
+	}
+	return nil
+}
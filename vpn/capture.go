@@ -0,0 +1,24 @@
+package vpn
+
+import "github.com/rkonfj/peerguard/pcap"
+
+// Capture copies the packets crossing the tun device to the tap. It should be the last inbound
+// handler and the first outbound handler so that the packets are captured as they are on the tun
+type Capture struct {
+	Tap   *pcap.Tap
+	Iface int
+}
+
+func (c *Capture) Name() string {
+	return "capture"
+}
+
+func (c *Capture) In(pkt []byte) []byte {
+	c.Tap.Capture(c.Iface, pkt[IPPacketOffset:], pcap.Inbound, "")
+	return pkt
+}
+
+func (c *Capture) Out(pkt []byte) []byte {
+	c.Tap.Capture(c.Iface, pkt[IPPacketOffset:], pcap.Outbound, "")
+	return pkt
+}
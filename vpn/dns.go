@@ -0,0 +1,167 @@
+package vpn
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/rkonfj/peerguard/crash"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DNS answers the A and the AAAA queries of the peer names under the domain with the overlay ips
+// of the peers (e.g. laptop.pg), the other queries are forwarded to the upstreams
+type DNS struct {
+	// Domain is the domain of the peer names, e.g. pg
+	Domain string
+	// Upstreams are the addresses (host:port) of the resolvers the other queries are forwarded to,
+	// the queries are refused if empty
+	Upstreams []string
+	// Lookup returns the overlay ips of the peer named name (lower case), nil if not found
+	Lookup func(name string) []netip.Addr
+	// Logger is slog.Default() if nil
+	Logger *slog.Logger
+}
+
+// Serve answers the queries read from the conn until it is closed
+func (d *DNS) Serve(conn net.PacketConn) error {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			defer crash.Recover("vpn/dns")
+			resp, err := d.handle(query)
+			if err != nil {
+				d.logger().Debug("DNSQuery", "from", addr, "err", err)
+				return
+			}
+			conn.WriteTo(resp, addr)
+		}()
+	}
+}
+
+func (d *DNS) logger() *slog.Logger {
+	if d.Logger == nil {
+		return slog.Default()
+	}
+	return d.Logger
+}
+
+// handle answers the query, the names out of the domain are forwarded
+func (d *DNS) handle(query []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	name, ok := d.peerName(q.Name.String())
+	if !ok {
+		return d.forward(header, q, query)
+	}
+	addrs := d.Lookup(name)
+	rh := dnsmessage.Header{
+		ID:                 header.ID,
+		Response:           true,
+		Authoritative:      true,
+		RecursionDesired:   header.RecursionDesired,
+		RecursionAvailable: len(d.Upstreams) > 0,
+	}
+	if len(addrs) == 0 {
+		rh.RCode = dnsmessage.RCodeNameError
+	}
+	resp := dnsmessage.NewBuilder(nil, rh)
+	resp.EnableCompression()
+	if err := resp.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := resp.Question(q); err != nil {
+		return nil, err
+	}
+	if err := resp.StartAnswers(); err != nil {
+		return nil, err
+	}
+	answer := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}
+	for _, addr := range addrs {
+		switch {
+		case addr.Is4() && (q.Type == dnsmessage.TypeA || q.Type == dnsmessage.TypeALL):
+			err = resp.AResource(answer, dnsmessage.AResource{A: addr.As4()})
+		case addr.Is6() && (q.Type == dnsmessage.TypeAAAA || q.Type == dnsmessage.TypeALL):
+			err = resp.AAAAResource(answer, dnsmessage.AAAAResource{AAAA: addr.As16()})
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return resp.Finish()
+}
+
+// peerName is the peer name of the fqdn under the domain, e.g. laptop of laptop.pg.
+func (d *DNS) peerName(fqdn string) (string, bool) {
+	suffix := "." + strings.Trim(strings.ToLower(d.Domain), ".") + "."
+	name, ok := strings.CutSuffix(strings.ToLower(fqdn), suffix)
+	return name, ok && name != "" && !strings.Contains(name, ".")
+}
+
+// forward forwards the query to the upstreams in order, SERVFAIL (REFUSED if there is no upstream)
+// is answered if all of them fail
+func (d *DNS) forward(header dnsmessage.Header, q dnsmessage.Question, query []byte) ([]byte, error) {
+	rcode := dnsmessage.RCodeRefused
+	for _, upstream := range d.Upstreams {
+		resp, err := exchange(upstream, query)
+		if err == nil {
+			return resp, nil
+		}
+		rcode = dnsmessage.RCodeServerFailure
+		d.logger().Debug("DNSForward", "upstream", upstream, "name", q.Name, "err", err)
+	}
+	resp := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:               header.ID,
+		Response:         true,
+		RecursionDesired: header.RecursionDesired,
+		RCode:            rcode,
+	})
+	if err := resp.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := resp.Question(q); err != nil {
+		return nil, err
+	}
+	return resp.Finish()
+}
+
+func exchange(upstream string, query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", upstream)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
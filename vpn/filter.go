@@ -0,0 +1,303 @@
+package vpn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	FilterAllow = "allow"
+	FilterDeny  = "deny"
+
+	// FilterIn is the direction of the packets from the peers to the tun, FilterOut is the one
+	// from the tun to the peers
+	FilterIn  = "in"
+	FilterOut = "out"
+)
+
+// FilterRule allows or denies the packets matched, the empty fields match any
+type FilterRule struct {
+	Action    string `json:"action"`
+	Direction string `json:"direction,omitempty"`
+	// Src and Dst are the cidrs (or the ips) of the source and the destination
+	Src string `json:"src,omitempty"`
+	Dst string `json:"dst,omitempty"`
+	// Proto is tcp, udp or icmp
+	Proto string `json:"proto,omitempty"`
+	// Ports are the destination port (22) or the range (8000-8100) of the tcp and the udp
+	Ports string `json:"ports,omitempty"`
+
+	src, dst          netip.Prefix
+	proto             []uint8
+	portLow, portHigh uint16
+}
+
+// ParseFilterRule parses the rule of the form
+// <allow|deny>[,in|out][,src=<cidr>][,dst=<cidr>][,proto=<tcp|udp|icmp>][,port=<port|from-to>],
+// e.g. deny,in,proto=tcp,port=22
+func ParseFilterRule(s string) (FilterRule, error) {
+	fields := strings.Split(s, ",")
+	rule := FilterRule{Action: fields[0]}
+	for _, field := range fields[1:] {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case FilterIn, FilterOut:
+			rule.Direction = key
+		case "src":
+			rule.Src = value
+		case "dst":
+			rule.Dst = value
+		case "proto":
+			rule.Proto = value
+		case "port":
+			rule.Ports = value
+		default:
+			return rule, fmt.Errorf("filter rule %s: unknown field %s", s, field)
+		}
+	}
+	if err := rule.compile(); err != nil {
+		return rule, fmt.Errorf("filter rule %s: %w", s, err)
+	}
+	return rule, nil
+}
+
+// String is the form parsed by ParseFilterRule
+func (r FilterRule) String() string {
+	fields := []string{r.Action}
+	if r.Direction != "" {
+		fields = append(fields, r.Direction)
+	}
+	for _, kv := range [][2]string{{"src", r.Src}, {"dst", r.Dst}, {"proto", r.Proto}, {"port", r.Ports}} {
+		if kv[1] != "" {
+			fields = append(fields, kv[0]+"="+kv[1])
+		}
+	}
+	return strings.Join(fields, ",")
+}
+
+func (r *FilterRule) compile() (err error) {
+	if r.Action != FilterAllow && r.Action != FilterDeny {
+		return fmt.Errorf("invalid action %q (allow|deny)", r.Action)
+	}
+	if r.Direction != "" && r.Direction != FilterIn && r.Direction != FilterOut {
+		return fmt.Errorf("invalid direction %q (in|out)", r.Direction)
+	}
+	if r.src, err = parseFilterPrefix(r.Src); err != nil {
+		return
+	}
+	if r.dst, err = parseFilterPrefix(r.Dst); err != nil {
+		return
+	}
+	switch r.Proto {
+	case "":
+		r.proto = nil
+	case "tcp":
+		r.proto = []uint8{protoTCP}
+	case "udp":
+		r.proto = []uint8{protoUDP}
+	case "icmp":
+		r.proto = []uint8{protoICMP, protoICMPv6}
+	default:
+		return fmt.Errorf("invalid proto %q (tcp|udp|icmp)", r.Proto)
+	}
+	r.portLow, r.portHigh = 0, 0
+	if r.Ports == "" {
+		return nil
+	}
+	if r.Proto != "tcp" && r.Proto != "udp" {
+		return errors.New("ports require the proto tcp or udp")
+	}
+	low, high, isRange := strings.Cut(r.Ports, "-")
+	if !isRange {
+		high = low
+	}
+	n1, err1 := strconv.ParseUint(low, 10, 16)
+	n2, err2 := strconv.ParseUint(high, 10, 16)
+	if err1 != nil || err2 != nil || n1 > n2 {
+		return fmt.Errorf("invalid ports %q", r.Ports)
+	}
+	r.portLow, r.portHigh = uint16(n1), uint16(n2)
+	return nil
+}
+
+func parseFilterPrefix(s string) (netip.Prefix, error) {
+	if s == "" {
+		return netip.Prefix{}, nil
+	}
+	if ip, err := netip.ParseAddr(s); err == nil {
+		return netip.PrefixFrom(ip, ip.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return prefix, fmt.Errorf("invalid cidr %q", s)
+	}
+	return prefix.Masked(), nil
+}
+
+func (r *FilterRule) match(direction string, pkt *filterPacket) bool {
+	if r.Direction != "" && r.Direction != direction {
+		return false
+	}
+	if (r.src.IsValid() && !r.src.Contains(pkt.src)) || (r.dst.IsValid() && !r.dst.Contains(pkt.dst)) {
+		return false
+	}
+	if r.proto != nil && pkt.proto != r.proto[0] && (len(r.proto) == 1 || pkt.proto != r.proto[1]) {
+		return false
+	}
+	if r.Ports == "" {
+		return true
+	}
+	if pkt.fragment { // no ports in the fragment, the first one is decided by the ports
+		return false
+	}
+	port := binary.BigEndian.Uint16(pkt.l4[2:4])
+	return port >= r.portLow && port <= r.portHigh
+}
+
+// filterPacket is the ip packet parsed for the rules
+type filterPacket struct {
+	src, dst netip.Addr
+	proto    uint8
+	// l4 is the layer 4 of the packet, it is nil if the packet is the fragment except the first one
+	l4       []byte
+	fragment bool
+}
+
+const (
+	ipv6HopByHop    = 0
+	ipv6Routing     = 43
+	ipv6Fragment    = 44
+	ipv6AuthHeader  = 51
+	ipv6DestOptions = 60
+
+	// maxIPv6ExtHeaders bounds the walk of the extension headers of the crafted packets
+	maxIPv6ExtHeaders = 8
+)
+
+// parseFilterPacket parses the addresses and the protocol of the ipv4 and the ipv6 packets, the
+// ipv6 extension headers are walked to the upper layer. The ports of the tcp and the udp must be
+// in the packet unless it is the fragment except the first one, false if the packet is malformed
+func parseFilterPacket(pkt []byte) (p filterPacket, ok bool) {
+	switch {
+	case len(pkt) >= 20 && pkt[0]>>4 == 4:
+		ihl := int(pkt[0]&0x0f) * 4
+		if ihl < 20 || len(pkt) < ihl {
+			return
+		}
+		p.src, _ = netip.AddrFromSlice(pkt[12:16])
+		p.dst, _ = netip.AddrFromSlice(pkt[16:20])
+		p.proto = pkt[9]
+		if binary.BigEndian.Uint16(pkt[6:8])&0x1fff != 0 {
+			p.fragment = true
+			return p, true
+		}
+		p.l4 = pkt[ihl:]
+	case len(pkt) >= 40 && pkt[0]>>4 == 6:
+		p.src, _ = netip.AddrFromSlice(pkt[8:24])
+		p.dst, _ = netip.AddrFromSlice(pkt[24:40])
+		next, rest := pkt[6], pkt[40:]
+	walk:
+		for i := 0; ; i++ {
+			if i > maxIPv6ExtHeaders {
+				return
+			}
+			var size int
+			switch next {
+			case ipv6HopByHop, ipv6Routing, ipv6DestOptions:
+				if len(rest) < 8 {
+					return
+				}
+				size = (int(rest[1]) + 1) * 8
+			case ipv6AuthHeader:
+				if len(rest) < 8 {
+					return
+				}
+				size = (int(rest[1]) + 2) * 4
+			case ipv6Fragment:
+				if len(rest) < 8 {
+					return
+				}
+				size = 8
+				if binary.BigEndian.Uint16(rest[2:4])>>3 != 0 {
+					p.proto, p.fragment = rest[0], true
+					return p, true
+				}
+			default:
+				p.proto, p.l4 = next, rest
+				break walk
+			}
+			if len(rest) < size {
+				return
+			}
+			next, rest = rest[0], rest[size:]
+		}
+	default:
+		return
+	}
+	if (p.proto == protoTCP || p.proto == protoUDP) && len(p.l4) < 4 {
+		return
+	}
+	return p, true
+}
+
+// PacketFilter allows or denies the packets on the tun path by the rules, the first rule matched
+// decides and the packet matching no rule is allowed. The malformed packets are denied if there is
+// any rule. The fragments except the first one are matched by the rules without the ports, the
+// ports are decided by the first fragment. The rules are replaced at runtime by SetRules
+type PacketFilter struct {
+	rules atomic.Pointer[[]FilterRule]
+}
+
+// NewPacketFilter creates the filter with the rules, invalid rules are refused
+func NewPacketFilter(rules ...FilterRule) (*PacketFilter, error) {
+	var f PacketFilter
+	if err := f.SetRules(rules); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// SetRules replaces the rules, the rules are kept if any of the new ones is invalid
+func (f *PacketFilter) SetRules(rules []FilterRule) error {
+	compiled := make([]FilterRule, len(rules))
+	for i, rule := range rules {
+		if err := rule.compile(); err != nil {
+			return fmt.Errorf("filter rule %d: %w", i, err)
+		}
+		compiled[i] = rule
+	}
+	f.rules.Store(&compiled)
+	return nil
+}
+
+// Rules returns the rules in order
+func (f *PacketFilter) Rules() []FilterRule {
+	if rules := f.rules.Load(); rules != nil {
+		return append([]FilterRule(nil), *rules...)
+	}
+	return nil
+}
+
+// Allowed reports whether the ip packet (without the IPPacketOffset headroom) of the direction is
+// allowed
+func (f *PacketFilter) Allowed(direction string, pkt []byte) bool {
+	rules := f.rules.Load()
+	if rules == nil || len(*rules) == 0 {
+		return true
+	}
+	p, ok := parseFilterPacket(pkt)
+	if !ok {
+		return false
+	}
+	for i := range *rules {
+		if rule := &(*rules)[i]; rule.match(direction, &p) {
+			return rule.Action == FilterAllow
+		}
+	}
+	return true
+}
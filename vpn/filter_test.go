@@ -0,0 +1,177 @@
+package vpn_test
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+
+	"github.com/rkonfj/peerguard/vpn"
+)
+
+// ipv4Packet builds the ipv4 packet, the fragment offset is in 8 bytes units
+func ipv4Packet(src, dst string, proto uint8, fragOffset uint16, payload []byte) []byte {
+	pkt := make([]byte, 20+len(payload))
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	binary.BigEndian.PutUint16(pkt[6:8], fragOffset)
+	pkt[8] = 64
+	pkt[9] = proto
+	copy(pkt[12:16], netip.MustParseAddr(src).AsSlice())
+	copy(pkt[16:20], netip.MustParseAddr(dst).AsSlice())
+	copy(pkt[20:], payload)
+	return pkt
+}
+
+// ipv6Packet builds the ipv6 packet, the headers are the extension headers and the upper layer
+// chained by their first byte
+func ipv6Packet(src, dst string, next uint8, headers ...[]byte) []byte {
+	pkt := make([]byte, 40)
+	pkt[0] = 0x60
+	pkt[6] = next
+	pkt[7] = 64
+	copy(pkt[8:24], netip.MustParseAddr(src).AsSlice())
+	copy(pkt[24:40], netip.MustParseAddr(dst).AsSlice())
+	for _, h := range headers {
+		pkt = append(pkt, h...)
+	}
+	binary.BigEndian.PutUint16(pkt[4:6], uint16(len(pkt)-40))
+	return pkt
+}
+
+func tcpHeader(dstPort uint16) []byte {
+	h := make([]byte, 20)
+	binary.BigEndian.PutUint16(h[0:2], 40000)
+	binary.BigEndian.PutUint16(h[2:4], dstPort)
+	h[12] = 5 << 4
+	return h
+}
+
+func ipv6FragmentHeader(next uint8, offset uint16) []byte {
+	h := make([]byte, 8)
+	h[0] = next
+	binary.BigEndian.PutUint16(h[2:4], offset<<3|1)
+	return h
+}
+
+func newFilter(t *testing.T, rules ...string) *vpn.PacketFilter {
+	t.Helper()
+	var parsed []vpn.FilterRule
+	for _, s := range rules {
+		rule, err := vpn.ParseFilterRule(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed = append(parsed, rule)
+	}
+	f, err := vpn.NewPacketFilter(parsed...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestParseFilterRule(t *testing.T) {
+	for _, s := range []string{"deny,in,proto=tcp,port=22", "allow,out,src=10.0.0.0/8,dst=10.1.1.1", "deny,proto=udp,port=8000-8100", "allow"} {
+		rule, err := vpn.ParseFilterRule(s)
+		if err != nil {
+			t.Fatalf("parse %s: %s", s, err)
+		}
+		if rule.String() != s {
+			t.Errorf("expected %s, got %s", s, rule.String())
+		}
+	}
+	for _, s := range []string{"drop", "deny,up", "deny,port=22", "deny,proto=tcp,port=9-1", "deny,src=x", "deny,proto=sctp", "deny,foo=1"} {
+		if _, err := vpn.ParseFilterRule(s); err == nil {
+			t.Errorf("expected %s refused", s)
+		}
+	}
+}
+
+func TestPacketFilterFirstMatchDecides(t *testing.T) {
+	f := newFilter(t, "allow,in,src=10.0.0.2,proto=tcp,port=22", "deny,in,proto=tcp,port=22")
+	if !f.Allowed(vpn.FilterIn, ipv4Packet("10.0.0.2", "10.0.0.1", 6, 0, tcpHeader(22))) {
+		t.Error("expected the ssh of 10.0.0.2 allowed")
+	}
+	if f.Allowed(vpn.FilterIn, ipv4Packet("10.0.0.3", "10.0.0.1", 6, 0, tcpHeader(22))) {
+		t.Error("expected the ssh of 10.0.0.3 denied")
+	}
+	if !f.Allowed(vpn.FilterIn, ipv4Packet("10.0.0.3", "10.0.0.1", 6, 0, tcpHeader(80))) {
+		t.Error("expected the packet matching no rule allowed")
+	}
+	if !f.Allowed(vpn.FilterOut, ipv4Packet("10.0.0.1", "10.0.0.3", 6, 0, tcpHeader(22))) {
+		t.Error("expected the rules of the other direction skipped")
+	}
+
+	if err := f.SetRules(nil); err != nil {
+		t.Fatal(err)
+	}
+	if !f.Allowed(vpn.FilterIn, ipv4Packet("10.0.0.3", "10.0.0.1", 6, 0, tcpHeader(22))) {
+		t.Error("expected all allowed without rules")
+	}
+	if err := f.SetRules([]vpn.FilterRule{{Action: "drop"}}); err == nil {
+		t.Error("expected the invalid rule refused")
+	}
+}
+
+func TestPacketFilterMalformedDenied(t *testing.T) {
+	f := newFilter(t, "deny,in,proto=tcp,port=22")
+	for name, pkt := range map[string][]byte{
+		"not ip":              {0x10, 0, 0, 0},
+		"truncated ipv4":      ipv4Packet("10.0.0.2", "10.0.0.1", 6, 0, nil)[:12],
+		"tcp without ports":   ipv4Packet("10.0.0.2", "10.0.0.1", 6, 0, []byte{0, 22}),
+		"truncated ext":       ipv6Packet("fd00::2", "fd00::1", 0, []byte{6, 0, 0, 0}),
+		"oversized ext":       ipv6Packet("fd00::2", "fd00::1", 60, []byte{6, 4, 0, 0, 0, 0, 0, 0}),
+		"too many ext header": ipv6Packet("fd00::2", "fd00::1", 60, repeat(make([]byte, 8), 10, 60)...),
+	} {
+		if f.Allowed(vpn.FilterIn, pkt) {
+			t.Errorf("expected the malformed packet (%s) denied", name)
+		}
+	}
+	if !newFilter(t).Allowed(vpn.FilterIn, []byte{0x10}) {
+		t.Error("expected all allowed without rules")
+	}
+}
+
+func repeat(h []byte, n int, next uint8) [][]byte {
+	headers := make([][]byte, n)
+	for i := range headers {
+		headers[i] = append([]byte{next}, h[1:]...)
+	}
+	return headers
+}
+
+func TestPacketFilterIPv6ExtensionHeaders(t *testing.T) {
+	f := newFilter(t, "deny,in,proto=tcp,port=22")
+	hopByHop := []byte{60, 0, 1, 4, 0, 0, 0, 0}
+	destOpts := []byte{6, 0, 1, 4, 0, 0, 0, 0}
+	pkt := ipv6Packet("fd00::2", "fd00::1", 0, hopByHop, destOpts, tcpHeader(22))
+	if f.Allowed(vpn.FilterIn, pkt) {
+		t.Error("expected the ssh behind the extension headers denied")
+	}
+	pkt = ipv6Packet("fd00::2", "fd00::1", 44, ipv6FragmentHeader(6, 0), tcpHeader(22))
+	if f.Allowed(vpn.FilterIn, pkt) {
+		t.Error("expected the first fragment of the ssh denied")
+	}
+	pkt = ipv6Packet("fd00::2", "fd00::1", 44, ipv6FragmentHeader(6, 0), tcpHeader(80))
+	if !f.Allowed(vpn.FilterIn, pkt) {
+		t.Error("expected the first fragment of the http allowed")
+	}
+}
+
+func TestPacketFilterFragments(t *testing.T) {
+	f := newFilter(t, "deny,in,src=10.0.0.3", "deny,in,src=fd00::3", "deny,in,proto=udp", "deny,in,proto=tcp,port=22")
+	for name, pkt := range map[string][]byte{
+		"ipv4 src": ipv4Packet("10.0.0.3", "10.0.0.1", 6, 100, make([]byte, 8)),
+		"ipv6 src": ipv6Packet("fd00::3", "fd00::1", 44, ipv6FragmentHeader(6, 100), make([]byte, 8)),
+		"ipv4 udp": ipv4Packet("10.0.0.2", "10.0.0.1", 17, 100, make([]byte, 8)),
+		"ipv6 udp": ipv6Packet("fd00::2", "fd00::1", 44, ipv6FragmentHeader(17, 100), make([]byte, 8)),
+	} {
+		if f.Allowed(vpn.FilterIn, pkt) {
+			t.Errorf("expected the fragment (%s) denied", name)
+		}
+	}
+	// the ports are decided by the first fragment
+	if !f.Allowed(vpn.FilterIn, ipv4Packet("10.0.0.2", "10.0.0.1", 6, 100, make([]byte, 8))) {
+		t.Error("expected the tcp fragment allowed")
+	}
+}
@@ -21,6 +21,8 @@ type Interface interface {
 type Config struct {
 	MTU        int
 	IPv4, IPv6 string
+	// Metric is the interface metric of the tun, 0 keeps the one chosen by the system
+	Metric int
 }
 
 var _ RoutingTable = (*TunInterface)(nil)
@@ -33,8 +35,14 @@ type TunInterface struct {
 	peersMutex sync.RWMutex
 }
 
+// Preflight checks the requirements of creating the tun device, the problems found are returned as
+// the diagnostics. It is nil if nothing is found or the checks are not supported on the os
+func Preflight() []string {
+	return preflight()
+}
+
 func Create(tunName string, cfg Config) (*TunInterface, error) {
-	device, err := tun.CreateTUN(tunName, cfg.MTU)
+	device, err := createTUN(tunName, cfg)
 	if err != nil {
 		return nil, fmt.Errorf("create tun device (%s): %w", tunName, err)
 	}
@@ -42,11 +50,19 @@ func Create(tunName string, cfg Config) (*TunInterface, error) {
 	if err != nil {
 		return nil, fmt.Errorf("get tun device name: %w", err)
 	}
-	if cfg.IPv4 != "" {
-		netlink.SetupLink(deviceName, cfg.IPv4)
+	for _, cidr := range []string{cfg.IPv4, cfg.IPv6} {
+		if cidr == "" {
+			continue
+		}
+		if err := netlink.SetupLink(deviceName, cidr); err != nil {
+			device.Close()
+			return nil, fmt.Errorf("setup tun device (%s) address %s: %w", deviceName, cidr, err)
+		}
 	}
-	if cfg.IPv6 != "" {
-		netlink.SetupLink(deviceName, cfg.IPv6)
+	if cfg.Metric > 0 {
+		if err := netlink.SetLinkMetric(deviceName, cfg.Metric); err != nil {
+			slog.Warn("SetLinkMetric", "metric", cfg.Metric, "err", err)
+		}
 	}
 	return &TunInterface{
 		dev:     device,
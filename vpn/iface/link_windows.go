@@ -0,0 +1,86 @@
+package iface
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// wintunHardwareID is the hardware id of the adapters created by the wintun
+const wintunHardwareID = "Wintun"
+
+// guidDevClassNet is the device setup class of the network adapters
+var guidDevClassNet = windows.GUID{Data1: 0x4d36e972, Data2: 0xe325, Data3: 0x11ce, Data4: [8]byte{0xbf, 0xc1, 0x08, 0x00, 0x2b, 0xe1, 0x03, 0x18}}
+
+// orphanedAdapters counts the wintun adapters left by the crashed processes and removes them if
+// remove, they are not present but still registered and keep the names the new adapters want
+func orphanedAdapters(remove bool) (int, error) {
+	devInfo, err := windows.SetupDiGetClassDevsEx(&guidDevClassNet, "", 0, 0, 0, "")
+	if err != nil {
+		return 0, fmt.Errorf("list network adapters: %w", err)
+	}
+	defer devInfo.Close()
+	var n int
+	var errs []error
+	for i := 0; ; i++ {
+		data, err := devInfo.EnumDeviceInfo(i)
+		if errors.Is(err, windows.ERROR_NO_MORE_ITEMS) {
+			break
+		}
+		if err != nil {
+			continue
+		}
+		property, err := devInfo.DeviceRegistryProperty(data, windows.SPDRP_HARDWAREID)
+		hardwareIDs, ok := property.([]string)
+		if err != nil || !ok || !slices.ContainsFunc(hardwareIDs, func(id string) bool {
+			return strings.EqualFold(id, wintunHardwareID)
+		}) {
+			continue
+		}
+		var status, problem uint32
+		if err := windows.CM_Get_DevNode_Status(&status, &problem, data.DevInst, 0); !errors.Is(err, windows.CR_NO_SUCH_DEVINST) {
+			continue // present, owned by a running process
+		}
+		n++
+		if !remove {
+			continue
+		}
+		params := windows.RemoveDeviceParams{
+			ClassInstallHeader: *windows.MakeClassInstallHeader(windows.DIF_REMOVE),
+			Scope:              windows.DI_REMOVEDEVICE_GLOBAL,
+		}
+		if err := devInfo.SetClassInstallParams(data, &params.ClassInstallHeader, uint32(unsafe.Sizeof(params))); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := devInfo.CallClassInstaller(windows.DIF_REMOVE, data); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return n, errors.Join(errs...)
+}
+
+// preflight checks the privilege, the wintun.dll, the orphaned adapters and the tap-windows6
+// adapter the fallback needs
+func preflight() []string {
+	var diagnostics []string
+	if !windows.GetCurrentProcessToken().IsElevated() {
+		diagnostics = append(diagnostics, "not running as administrator, the adapter can not be created")
+	}
+	if err := checkWintun(); err != nil {
+		diagnostics = append(diagnostics, fmt.Sprintf("wintun is not usable: %s", err))
+	}
+	if n, err := orphanedAdapters(false); err != nil {
+		diagnostics = append(diagnostics, fmt.Sprintf("the orphaned adapters are not checked: %s", err))
+	} else if n > 0 {
+		diagnostics = append(diagnostics, fmt.Sprintf("%d wintun adapters are orphaned by the crashed processes, they are removed on the next start as administrator", n))
+	}
+	if _, _, err := findTAPAdapter(""); err != nil {
+		diagnostics = append(diagnostics, fmt.Sprintf("the tap-windows6 fallback is not available: %s", err))
+	}
+	return diagnostics
+}
@@ -0,0 +1,232 @@
+package iface
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// the tap-windows6 driver installed by openvpn, the adapter must be installed beforehand
+const (
+	tapComponentID     = "tap0901"
+	tapAdapterClassKey = `SYSTEM\CurrentControlSet\Control\Class\{4d36e972-e325-11ce-bfc1-08002be10318}`
+	tapNetworkKey      = `SYSTEM\CurrentControlSet\Control\Network\{4D36E972-E325-11CE-BFC1-08002BE10318}`
+
+	tapIoctlGetMTU         = 0x22000c // CTL_CODE(FILE_DEVICE_UNKNOWN, 3, METHOD_BUFFERED, FILE_ANY_ACCESS)
+	tapIoctlSetMediaStatus = 0x220018 // CTL_CODE(FILE_DEVICE_UNKNOWN, 6, METHOD_BUFFERED, FILE_ANY_ACCESS)
+	tapIoctlConfigTun      = 0x220028 // CTL_CODE(FILE_DEVICE_UNKNOWN, 10, METHOD_BUFFERED, FILE_ANY_ACCESS)
+)
+
+var _ tun.Device = (*tapDevice)(nil)
+
+// tapDevice is the tap-windows6 adapter in the tun mode, the driver strips the ethernet headers and
+// answers the arp of the subnet itself, so the ip packets are read and written as is
+type tapDevice struct {
+	handle windows.Handle
+	name   string
+	mtu    int
+	events chan tun.Event
+
+	readMutex  sync.Mutex
+	readOv     windows.Overlapped
+	writeMutex sync.Mutex
+	writeOv    windows.Overlapped
+	closeOnce  sync.Once
+}
+
+// createTAP opens the tap-windows6 adapter named ifName, or the first one found if there is no such
+// adapter, and configures it to the tun mode of the ipv4 subnet
+func createTAP(ifName string, cfg Config) (tun.Device, error) {
+	guid, name, err := findTAPAdapter(ifName)
+	if err != nil {
+		return nil, err
+	}
+	path, err := windows.UTF16PtrFromString(`\\.\Global\` + guid + `.tap`)
+	if err != nil {
+		return nil, err
+	}
+	handle, err := windows.CreateFile(path, windows.GENERIC_READ|windows.GENERIC_WRITE, 0, nil,
+		windows.OPEN_EXISTING, windows.FILE_ATTRIBUTE_SYSTEM|windows.FILE_FLAG_OVERLAPPED, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open tap adapter %s: %w", name, err)
+	}
+	dev := tapDevice{handle: handle, name: name, mtu: cfg.MTU, events: make(chan tun.Event, 1)}
+	for _, ov := range []*windows.Overlapped{&dev.readOv, &dev.writeOv} {
+		if ov.HEvent, err = windows.CreateEvent(nil, 1, 0, nil); err != nil {
+			dev.Close()
+			return nil, err
+		}
+	}
+	if cfg.IPv4 != "" {
+		prefix, err := netip.ParsePrefix(cfg.IPv4)
+		if err != nil {
+			dev.Close()
+			return nil, err
+		}
+		// local ip, remote network and netmask, in the network byte order
+		var b [12]byte
+		copy(b[0:4], prefix.Addr().AsSlice())
+		copy(b[4:8], prefix.Masked().Addr().AsSlice())
+		binary.BigEndian.PutUint32(b[8:12], ^uint32(0)<<(32-prefix.Bits()))
+		if err := dev.ioctl(tapIoctlConfigTun, b[:]); err != nil {
+			dev.Close()
+			return nil, fmt.Errorf("configure tap adapter %s to tun mode: %w", name, err)
+		}
+	}
+	var mtu [4]byte
+	if err := dev.ioctl(tapIoctlGetMTU, mtu[:]); err == nil && dev.mtu == 0 {
+		dev.mtu = int(binary.LittleEndian.Uint32(mtu[:]))
+	}
+	connected := [4]byte{1}
+	if err := dev.ioctl(tapIoctlSetMediaStatus, connected[:]); err != nil {
+		dev.Close()
+		return nil, fmt.Errorf("connect tap adapter %s: %w", name, err)
+	}
+	dev.events <- tun.EventUp
+	return &dev, nil
+}
+
+// findTAPAdapter finds the instance guid and the connection name of the tap adapter
+func findTAPAdapter(ifName string) (guid, name string, err error) {
+	class, err := registry.OpenKey(registry.LOCAL_MACHINE, tapAdapterClassKey, registry.READ)
+	if err != nil {
+		return "", "", err
+	}
+	defer class.Close()
+	subkeys, err := class.ReadSubKeyNames(-1)
+	if err != nil {
+		return "", "", err
+	}
+	for _, subkey := range subkeys {
+		adapter, err := registry.OpenKey(class, subkey, registry.READ)
+		if err != nil {
+			continue
+		}
+		componentID, _, _ := adapter.GetStringValue("ComponentId")
+		instanceID, _, _ := adapter.GetStringValue("NetCfgInstanceId")
+		adapter.Close()
+		if strings.TrimPrefix(strings.ToLower(componentID), `root\`) != tapComponentID || instanceID == "" {
+			continue
+		}
+		connName := instanceID
+		if conn, err := registry.OpenKey(registry.LOCAL_MACHINE, tapNetworkKey+`\`+instanceID+`\Connection`, registry.READ); err == nil {
+			if s, _, err := conn.GetStringValue("Name"); err == nil {
+				connName = s
+			}
+			conn.Close()
+		}
+		if guid == "" || connName == ifName {
+			guid, name = instanceID, connName
+		}
+		if connName == ifName {
+			break
+		}
+	}
+	if guid == "" {
+		return "", "", errors.New("no tap-windows6 adapter is installed")
+	}
+	return guid, name, nil
+}
+
+func (dev *tapDevice) ioctl(code uint32, b []byte) error {
+	var n uint32
+	ov := windows.Overlapped{}
+	event, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		return err
+	}
+	defer windows.CloseHandle(event)
+	ov.HEvent = event
+	err = windows.DeviceIoControl(dev.handle, code, &b[0], uint32(len(b)), &b[0], uint32(len(b)), &n, &ov)
+	if errors.Is(err, windows.ERROR_IO_PENDING) {
+		err = windows.GetOverlappedResult(dev.handle, &ov, &n, true)
+	}
+	return err
+}
+
+func (dev *tapDevice) File() *os.File {
+	return nil
+}
+
+func (dev *tapDevice) Read(bufs [][]byte, sizes []int, offset int) (int, error) {
+	dev.readMutex.Lock()
+	defer dev.readMutex.Unlock()
+	var n uint32
+	err := windows.ReadFile(dev.handle, bufs[0][offset:], &n, &dev.readOv)
+	if errors.Is(err, windows.ERROR_IO_PENDING) {
+		err = windows.GetOverlappedResult(dev.handle, &dev.readOv, &n, true)
+	}
+	if err != nil {
+		if errors.Is(err, windows.ERROR_OPERATION_ABORTED) || errors.Is(err, windows.ERROR_INVALID_HANDLE) {
+			return 0, os.ErrClosed
+		}
+		return 0, err
+	}
+	sizes[0] = int(n)
+	return 1, nil
+}
+
+func (dev *tapDevice) Write(bufs [][]byte, offset int) (int, error) {
+	dev.writeMutex.Lock()
+	defer dev.writeMutex.Unlock()
+	for i, buf := range bufs {
+		var n uint32
+		err := windows.WriteFile(dev.handle, buf[offset:], &n, &dev.writeOv)
+		if errors.Is(err, windows.ERROR_IO_PENDING) {
+			err = windows.GetOverlappedResult(dev.handle, &dev.writeOv, &n, true)
+		}
+		if err != nil {
+			if errors.Is(err, windows.ERROR_OPERATION_ABORTED) || errors.Is(err, windows.ERROR_INVALID_HANDLE) {
+				return i, os.ErrClosed
+			}
+			return i, err
+		}
+	}
+	return len(bufs), nil
+}
+
+func (dev *tapDevice) MTU() (int, error) {
+	return dev.mtu, nil
+}
+
+func (dev *tapDevice) Name() (string, error) {
+	return dev.name, nil
+}
+
+func (dev *tapDevice) Events() <-chan tun.Event {
+	return dev.events
+}
+
+func (dev *tapDevice) BatchSize() int {
+	return 1
+}
+
+func (dev *tapDevice) Close() error {
+	var err error
+	dev.closeOnce.Do(func() {
+		disconnected := [4]byte{0}
+		dev.ioctl(tapIoctlSetMediaStatus, disconnected[:])
+		windows.CancelIoEx(dev.handle, nil)
+		// the pending read and write return before the handle and the events are closed
+		dev.readMutex.Lock()
+		dev.writeMutex.Lock()
+		err = windows.CloseHandle(dev.handle)
+		for _, ov := range []*windows.Overlapped{&dev.readOv, &dev.writeOv} {
+			if ov.HEvent != 0 {
+				windows.CloseHandle(ov.HEvent)
+			}
+		}
+		dev.writeMutex.Unlock()
+		dev.readMutex.Unlock()
+		close(dev.events)
+	})
+	return err
+}
@@ -0,0 +1,39 @@
+//go:build freebsd
+
+package iface
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os/exec"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// createTUN destroys the tun of the same name left by the process crashed before, wireguard-go
+// refuses the name of the existing interface. The tun opened by another process is kept
+func createTUN(tunName string, cfg Config) (tun.Device, error) {
+	if err := checkTunName("freebsd", tunName); err != nil {
+		return nil, err
+	}
+	if _, err := net.InterfaceByName(tunName); err == nil {
+		out, err := exec.Command("ifconfig", tunName).CombinedOutput()
+		if err != nil {
+			return nil, fmt.Errorf("ifconfig %s: %w: %s", tunName, err, strings.TrimSpace(string(out)))
+		}
+		if !staleTun(string(out)) {
+			return nil, fmt.Errorf("interface %s already exists", tunName)
+		}
+		slog.Warn("DestroyStaleTun", "name", tunName)
+		if out, err := exec.Command("ifconfig", tunName, "destroy").CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("ifconfig %s destroy: %w: %s", tunName, err, strings.TrimSpace(string(out)))
+		}
+	}
+	return tun.CreateTUN(tunName, cfg.MTU)
+}
+
+func preflight() []string {
+	return nil
+}
@@ -0,0 +1,20 @@
+//go:build !windows && !freebsd
+
+package iface
+
+import (
+	"runtime"
+
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+func createTUN(tunName string, cfg Config) (tun.Device, error) {
+	if err := checkTunName(runtime.GOOS, tunName); err != nil {
+		return nil, err
+	}
+	return tun.CreateTUN(tunName, cfg.MTU)
+}
+
+func preflight() []string {
+	return nil
+}
@@ -0,0 +1,41 @@
+package iface
+
+import "testing"
+
+func TestCheckTunName(t *testing.T) {
+	for _, c := range []struct {
+		goos, name string
+		ok         bool
+	}{
+		{"openbsd", "tun", true},
+		{"openbsd", "tun3", true},
+		{"openbsd", "pg0", false},
+		{"openbsd", "tunx", false},
+		{"openbsd", "tun-1", false},
+		{"darwin", "utun", true},
+		{"darwin", "utun7", true},
+		{"darwin", "tun0", false},
+		{"freebsd", "pg0", true},
+		{"freebsd", "peerguard-tunnel0", false},
+		{"linux", "pg0", true},
+		{"windows", "peerguard wintun adapter", true},
+	} {
+		if err := checkTunName(c.goos, c.name); (err == nil) != c.ok {
+			t.Errorf("%s %q: expected ok %v, got %v", c.goos, c.name, c.ok, err)
+		}
+	}
+}
+
+func TestStaleTun(t *testing.T) {
+	stale := "pg0: flags=8010<POINTOPOINT,MULTICAST> metric 0 mtu 1500\n\toptions=80000<LINKSTATE>\n\tgroups: tun\n\tnd6 options=29<PERFORMNUD,IFDISABLED,AUTO_LINKLOCAL>\n"
+	if !staleTun(stale) {
+		t.Error("expected the tun not opened stale")
+	}
+	opened := "pg0: flags=8051<UP,POINTOPOINT,RUNNING,MULTICAST> metric 0 mtu 1420\n\toptions=80000<LINKSTATE>\n\tinet 100.64.0.1 --> 100.64.0.1 netmask 0xffffff00\n\tgroups: tun\n\tOpened by PID 1234\n"
+	if staleTun(opened) {
+		t.Error("expected the tun opened by the process kept")
+	}
+	if staleTun("em0: flags=8843<UP,BROADCAST,RUNNING,SIMPLEX,MULTICAST> metric 0 mtu 1500\n") {
+		t.Error("expected the interface other than tun kept")
+	}
+}
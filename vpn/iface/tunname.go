@@ -0,0 +1,38 @@
+package iface
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// checkTunName checks the tun name against the rules of the os before the tun is created. The tun
+// of openbsd is tunN and the one of darwin is utunN, the bare prefix picks the next free one. The
+// interface names are at most 15 bytes (IFNAMSIZ) on the unixes
+func checkTunName(goos, name string) error {
+	switch goos {
+	case "windows":
+		return nil
+	case "darwin", "openbsd":
+		prefix := "tun"
+		if goos == "darwin" {
+			prefix = "utun"
+		}
+		if name != prefix {
+			index, ok := strings.CutPrefix(name, prefix)
+			if _, err := strconv.ParseUint(index, 10, 16); !ok || err != nil {
+				return fmt.Errorf("the tun name must be %s or %sN on %s, got %q", prefix, prefix, goos, name)
+			}
+		}
+	}
+	if len(name) > 15 {
+		return fmt.Errorf("the tun name %q is longer than 15 bytes", name)
+	}
+	return nil
+}
+
+// staleTun reports whether the ifconfig output is of the tun not opened by any process, the tun of
+// freebsd survives the close of the device so the one of the process crashed is left behind
+func staleTun(ifconfigOutput string) bool {
+	return strings.Contains(ifconfigOutput, "groups: tun") && !strings.Contains(ifconfigOutput, "Opened by PID")
+}
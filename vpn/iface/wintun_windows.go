@@ -0,0 +1,199 @@
+package iface
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// the official wintun build, the zip is pinned by the hash and the dll is signed by wireguard llc
+const (
+	wintunURL    = "https://www.wintun.net/builds/wintun-0.14.1.zip"
+	wintunSHA256 = "07c256185d6ee3652e09fa55c0b673e2624b565e02c4b9091c79ca7d2f24ef51"
+
+	// wintunMinVersion is the oldest wintun.dll exporting the api of the wintun package (0.14)
+	wintunMinVersion = 0x0000000e
+)
+
+// createTUN creates the wintun adapter, the wintun.dll is provisioned into the app directory if it
+// is missing, broken or too old. The adapters orphaned by the crashed processes are removed first.
+// The tap-windows6 adapter is used if the wintun keeps failing, e.g. the device is not ready on some
+// systems
+func createTUN(tunName string, cfg Config) (tun.Device, error) {
+	if err := checkWintun(); err != nil {
+		slog.Warn("WintunUnavailable", "err", err)
+		if err := provisionWintun(); err != nil {
+			slog.Error("WintunProvision", "err", err)
+		}
+	}
+	if n, err := orphanedAdapters(true); err != nil {
+		slog.Warn("RemoveOrphanedAdapters", "removed", n, "err", err)
+	} else if n > 0 {
+		slog.Info("OrphanedAdaptersRemoved", "count", n)
+	}
+	var errs []error
+	for i := range 3 {
+		if i > 0 {
+			time.Sleep(time.Duration(i) * time.Second)
+		}
+		device, err := tun.CreateTUN(tunName, cfg.MTU)
+		if err == nil {
+			return device, nil
+		}
+		slog.Warn("CreateWintunAdapter", "retry", i, "err", err)
+		errs = append(errs, err)
+	}
+	device, err := createTAP(tunName, cfg)
+	if err != nil {
+		return nil, errors.Join(append(errs, fmt.Errorf("fallback to tap-windows6: %w", err))...)
+	}
+	slog.Info("TAPAdapterFallback", "name", tunName)
+	return device, nil
+}
+
+// checkWintun loads the wintun.dll the same way as the wintun package does and checks its version
+func checkWintun() error {
+	module, err := windows.LoadLibraryEx("wintun.dll", 0, windows.LOAD_LIBRARY_SEARCH_APPLICATION_DIR|windows.LOAD_LIBRARY_SEARCH_SYSTEM32)
+	if err != nil {
+		return fmt.Errorf("load wintun.dll: %w", err)
+	}
+	defer windows.FreeLibrary(module)
+	var path [windows.MAX_PATH]uint16
+	n, err := windows.GetModuleFileName(module, &path[0], uint32(len(path)))
+	if err != nil {
+		return fmt.Errorf("locate wintun.dll: %w", err)
+	}
+	dll := windows.UTF16ToString(path[:n])
+	version, err := fileVersion(dll)
+	if err != nil {
+		return fmt.Errorf("version of %s: %w", dll, err)
+	}
+	if version>>32 < wintunMinVersion {
+		return fmt.Errorf("%s is version %d.%d, 0.14 or later is required", dll, version>>48, version>>32&0xffff)
+	}
+	return nil
+}
+
+// fileVersion is the file version of the version resource, the major and the minor are the high
+// 32 bits
+func fileVersion(path string) (uint64, error) {
+	size, err := windows.GetFileVersionInfoSize(path, nil)
+	if err != nil {
+		return 0, err
+	}
+	buf := make([]byte, size)
+	if err := windows.GetFileVersionInfo(path, 0, size, unsafe.Pointer(&buf[0])); err != nil {
+		return 0, err
+	}
+	var info *windows.VS_FIXEDFILEINFO
+	var n uint32
+	if err := windows.VerQueryValue(unsafe.Pointer(&buf[0]), `\`, unsafe.Pointer(&info), &n); err != nil {
+		return 0, err
+	}
+	if info == nil || n < uint32(unsafe.Sizeof(*info)) {
+		return 0, errors.New("no version resource")
+	}
+	return uint64(info.FileVersionMS)<<32 | uint64(info.FileVersionLS), nil
+}
+
+// provisionWintun downloads the wintun build of the architecture into the app directory
+func provisionWintun() error {
+	arch, ok := map[string]string{"amd64": "amd64", "386": "x86", "arm64": "arm64", "arm": "arm"}[runtime.GOARCH]
+	if !ok {
+		return fmt.Errorf("wintun is not available on %s", runtime.GOARCH)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, wintunURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("download wintun: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download wintun: %s", resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 10<<20))
+	if err != nil {
+		return fmt.Errorf("download wintun: %w", err)
+	}
+	if sum := sha256.Sum256(b); hex.EncodeToString(sum[:]) != wintunSHA256 {
+		return errors.New("download wintun: sha256 mismatch")
+	}
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return err
+	}
+	f, err := zr.Open("wintun/bin/" + arch + "/wintun.dll")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dll := filepath.Join(filepath.Dir(exe), "wintun.dll")
+	tmp, err := os.CreateTemp(filepath.Dir(exe), "wintun-*.dll")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, f); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := verifySignature(tmp.Name()); err != nil {
+		return fmt.Errorf("verify wintun.dll: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), dll); err != nil {
+		return err
+	}
+	slog.Info("WintunProvisioned", "path", dll)
+	return nil
+}
+
+// verifySignature verifies the authenticode signature of the file
+func verifySignature(path string) error {
+	path16, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return err
+	}
+	data := windows.WinTrustData{
+		Size:             uint32(unsafe.Sizeof(windows.WinTrustData{})),
+		UIChoice:         windows.WTD_UI_NONE,
+		RevocationChecks: windows.WTD_REVOKE_NONE,
+		UnionChoice:      windows.WTD_CHOICE_FILE,
+		StateAction:      windows.WTD_STATEACTION_VERIFY,
+		FileOrCatalogOrBlobOrSgnrOrCert: unsafe.Pointer(&windows.WinTrustFileInfo{
+			Size:     uint32(unsafe.Sizeof(windows.WinTrustFileInfo{})),
+			FilePath: path16,
+		}),
+	}
+	verifyErr := windows.WinVerifyTrustEx(windows.InvalidHWND, &windows.WINTRUST_ACTION_GENERIC_VERIFY_V2, &data)
+	data.StateAction = windows.WTD_STATEACTION_CLOSE
+	windows.WinVerifyTrustEx(windows.InvalidHWND, &windows.WINTRUST_ACTION_GENERIC_VERIFY_V2, &data)
+	return verifyErr
+}
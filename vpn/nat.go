@@ -0,0 +1,365 @@
+package vpn
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	natPortMin = 20000
+	natPortMax = 60999
+
+	natTCPTimeout  = 30 * time.Minute
+	natUDPTimeout  = 2 * time.Minute
+	natICMPTimeout = 30 * time.Second
+)
+
+const (
+	protoICMP   = 1
+	protoTCP    = 6
+	protoUDP    = 17
+	protoICMPv6 = 58
+)
+
+// ExitNAT is the source NAT of the exit node. The packets of the peers to the ips out of the
+// overlay are rewritten to the NAT address (the last host address of the tun prefix, it must not
+// be assigned to any peer), the kernel forwards them to the internet and masquerades the NAT
+// address, the replies routed back to the tun are rewritten to the peers then. It is the inbound
+// and the outbound handler of the data plane. The tcp, the udp and the icmp echo are supported,
+// the other packets out of the overlay are dropped
+type ExitNAT struct {
+	overlay []netip.Prefix
+	addrs   []netip.Addr
+	subnets []netip.Prefix // the destinations rewritten, all if empty
+
+	mutex     sync.Mutex
+	mappings  map[natKey]*natMapping
+	reverse   map[natKey]*natMapping
+	nextPort  uint16
+	lastSweep time.Time
+}
+
+type natKey struct {
+	proto uint8
+	addr  netip.Addr
+	port  uint16
+}
+
+type natMapping struct {
+	src     natKey
+	port    uint16
+	expires time.Time
+}
+
+// NewExitNAT creates the NAT of the tun prefixes (the cidr), the empty one is ignored
+func NewExitNAT(ipv4, ipv6 string) (*ExitNAT, error) {
+	nat := ExitNAT{
+		mappings: make(map[natKey]*natMapping),
+		reverse:  make(map[natKey]*natMapping),
+		nextPort: natPortMin,
+	}
+	for _, cidr := range []string{ipv4, ipv6} {
+		if cidr == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, err
+		}
+		prefix = prefix.Masked()
+		nat.overlay = append(nat.overlay, prefix)
+		nat.addrs = append(nat.addrs, lastHost(prefix))
+	}
+	return &nat, nil
+}
+
+// NewSubnetNAT creates the NAT of the subnet router, only the packets to the subnets are rewritten
+// so that the hosts of the subnets reply to the subnet router without the routes to the overlay
+func NewSubnetNAT(ipv4, ipv6 string, subnets []netip.Prefix) (*ExitNAT, error) {
+	nat, err := NewExitNAT(ipv4, ipv6)
+	if err != nil {
+		return nil, err
+	}
+	nat.subnets = subnets
+	return nat, nil
+}
+
+// Addrs is the NAT addresses the kernel masquerades
+func (nat *ExitNAT) Addrs() []netip.Addr {
+	return nat.addrs
+}
+
+func (nat *ExitNAT) Name() string {
+	return "exitnat"
+}
+
+// In rewrites the source of the packet of the peer to the NAT address if it leaves the overlay
+func (nat *ExitNAT) In(packet []byte) []byte {
+	pkt := packet[IPPacketOffset:]
+	src, dst, proto, l4, ok := parseIP(pkt)
+	if !ok {
+		return packet
+	}
+	if nat.inOverlay(dst) || !nat.inSubnets(dst) {
+		return packet
+	}
+	natAddr, ok := nat.addrOf(dst)
+	if !ok || !nat.inOverlay(src) {
+		return nil
+	}
+	port, ok := l4Port(proto, l4, true)
+	if !ok {
+		return nil
+	}
+	natPort, ok := nat.allocate(natKey{proto: proto, addr: src, port: port})
+	if !ok {
+		return nil
+	}
+	rewrite(pkt, proto, l4, natAddr, natPort, true)
+	return packet
+}
+
+// Out rewrites the destination of the reply to the NAT address back to the peer
+func (nat *ExitNAT) Out(packet []byte) []byte {
+	pkt := packet[IPPacketOffset:]
+	_, dst, proto, l4, ok := parseIP(pkt)
+	if !ok {
+		return packet
+	}
+	natAddr, ok := nat.addrOf(dst)
+	if !ok || natAddr != dst {
+		return packet
+	}
+	port, ok := l4Port(proto, l4, false)
+	if !ok {
+		return nil
+	}
+	src, ok := nat.lookup(natKey{proto: proto, addr: natAddr, port: port})
+	if !ok {
+		return nil
+	}
+	rewrite(pkt, proto, l4, src.addr, src.port, false)
+	return packet
+}
+
+func (nat *ExitNAT) inOverlay(addr netip.Addr) bool {
+	for _, prefix := range nat.overlay {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (nat *ExitNAT) inSubnets(addr netip.Addr) bool {
+	if len(nat.subnets) == 0 {
+		return true
+	}
+	for _, prefix := range nat.subnets {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrOf is the NAT address of the ip family
+func (nat *ExitNAT) addrOf(addr netip.Addr) (netip.Addr, bool) {
+	for _, natAddr := range nat.addrs {
+		if natAddr.Is4() == addr.Is4() {
+			return natAddr, true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// allocate finds or allocates the NAT port of the source, the mapping is endpoint-independent
+func (nat *ExitNAT) allocate(src natKey) (uint16, bool) {
+	nat.mutex.Lock()
+	defer nat.mutex.Unlock()
+	now := time.Now()
+	if m, ok := nat.mappings[src]; ok && now.Before(m.expires) {
+		m.expires = now.Add(natTimeout(src.proto))
+		return m.port, true
+	}
+	if now.Sub(nat.lastSweep) > natICMPTimeout {
+		nat.sweep(now)
+	}
+	natAddr, _ := nat.addrOf(src.addr)
+	for range natPortMax - natPortMin + 1 {
+		port := nat.nextPort
+		if nat.nextPort++; nat.nextPort > natPortMax {
+			nat.nextPort = natPortMin
+		}
+		key := natKey{proto: src.proto, addr: natAddr, port: port}
+		if m, ok := nat.reverse[key]; ok && now.Before(m.expires) {
+			continue
+		}
+		m := &natMapping{src: src, port: port, expires: now.Add(natTimeout(src.proto))}
+		nat.mappings[src] = m
+		nat.reverse[key] = m
+		return port, true
+	}
+	return 0, false
+}
+
+func (nat *ExitNAT) lookup(key natKey) (natKey, bool) {
+	nat.mutex.Lock()
+	defer nat.mutex.Unlock()
+	m, ok := nat.reverse[key]
+	if !ok || time.Now().After(m.expires) {
+		return natKey{}, false
+	}
+	return m.src, true
+}
+
+func (nat *ExitNAT) sweep(now time.Time) {
+	nat.lastSweep = now
+	for key, m := range nat.reverse {
+		if now.After(m.expires) {
+			delete(nat.reverse, key)
+			if nat.mappings[m.src] == m {
+				delete(nat.mappings, m.src)
+			}
+		}
+	}
+}
+
+func natTimeout(proto uint8) time.Duration {
+	switch proto {
+	case protoTCP:
+		return natTCPTimeout
+	case protoUDP:
+		return natUDPTimeout
+	}
+	return natICMPTimeout
+}
+
+// lastHost is the last host address of the prefix, e.g. 100.99.0.254 of 100.99.0.0/24
+func lastHost(prefix netip.Prefix) netip.Addr {
+	b := prefix.Addr().AsSlice()
+	for i := prefix.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 1 << (7 - i%8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	if addr.Is4() && prefix.Bits() < 31 {
+		return addr.Prev() // skip the broadcast address
+	}
+	return addr
+}
+
+// parseIP parses the addresses, the protocol and the layer 4 of the packet. The ipv4 fragments
+// except the first one and the ipv6 extension headers are not parsed
+func parseIP(pkt []byte) (src, dst netip.Addr, proto uint8, l4 []byte, ok bool) {
+	if len(pkt) >= 20 && pkt[0]>>4 == 4 {
+		ihl := int(pkt[0]&0x0f) * 4
+		if ihl < 20 || len(pkt) < ihl || binary.BigEndian.Uint16(pkt[6:8])&0x1fff != 0 {
+			return
+		}
+		src, _ = netip.AddrFromSlice(pkt[12:16])
+		dst, _ = netip.AddrFromSlice(pkt[16:20])
+		return src, dst, pkt[9], pkt[ihl:], true
+	}
+	if len(pkt) >= 40 && pkt[0]>>4 == 6 {
+		src, _ = netip.AddrFromSlice(pkt[8:24])
+		dst, _ = netip.AddrFromSlice(pkt[24:40])
+		return src, dst, pkt[6], pkt[40:], true
+	}
+	return
+}
+
+// l4Port is the source (or the destination) port of the tcp and the udp, the id of the icmp echo
+// request (or the echo reply)
+func l4Port(proto uint8, l4 []byte, src bool) (uint16, bool) {
+	switch proto {
+	case protoTCP, protoUDP:
+		if (proto == protoTCP && len(l4) < 20) || len(l4) < 8 {
+			return 0, false
+		}
+		if src {
+			return binary.BigEndian.Uint16(l4[0:2]), true
+		}
+		return binary.BigEndian.Uint16(l4[2:4]), true
+	case protoICMP, protoICMPv6:
+		if len(l4) < 8 {
+			return 0, false
+		}
+		request, reply := uint8(8), uint8(0)
+		if proto == protoICMPv6 {
+			request, reply = 128, 129
+		}
+		if (src && l4[0] != request) || (!src && l4[0] != reply) {
+			return 0, false
+		}
+		return binary.BigEndian.Uint16(l4[4:6]), true
+	}
+	return 0, false
+}
+
+// rewrite rewrites the source (or the destination) address and port of the packet, the checksums
+// are updated incrementally (RFC 1624)
+func rewrite(pkt []byte, proto uint8, l4 []byte, addr netip.Addr, port uint16, src bool) {
+	var oldAddr []byte
+	if pkt[0]>>4 == 4 {
+		oldAddr = pkt[16:20]
+		if src {
+			oldAddr = pkt[12:16]
+		}
+	} else {
+		oldAddr = pkt[24:40]
+		if src {
+			oldAddr = pkt[8:24]
+		}
+	}
+	newAddr := addr.AsSlice()
+	var portOff, sumOff int
+	pseudo := true
+	switch proto {
+	case protoTCP:
+		portOff, sumOff = 2, 16
+	case protoUDP:
+		portOff, sumOff = 2, 6
+	case protoICMP:
+		portOff, sumOff, pseudo = 4, 2, false
+	case protoICMPv6:
+		portOff, sumOff = 4, 2
+	}
+	if src && proto != protoICMP && proto != protoICMPv6 {
+		portOff = 0
+	}
+	sum := binary.BigEndian.Uint16(l4[sumOff:])
+	// the zero udp checksum over ipv4 means no checksum
+	updateSum := proto != protoUDP || pkt[0]>>4 == 6 || sum != 0
+	if pseudo && updateSum {
+		sum = checksumUpdate(sum, oldAddr, newAddr)
+	}
+	var newPort [2]byte
+	binary.BigEndian.PutUint16(newPort[:], port)
+	if updateSum {
+		sum = checksumUpdate(sum, l4[portOff:portOff+2], newPort[:])
+		if sum == 0 && proto == protoUDP {
+			sum = 0xffff
+		}
+		binary.BigEndian.PutUint16(l4[sumOff:], sum)
+	}
+	copy(l4[portOff:], newPort[:])
+	if pkt[0]>>4 == 4 {
+		binary.BigEndian.PutUint16(pkt[10:12], checksumUpdate(binary.BigEndian.Uint16(pkt[10:12]), oldAddr, newAddr))
+	}
+	copy(oldAddr, newAddr)
+}
+
+// checksumUpdate is the checksum after the 16-bit aligned old bytes are replaced by the new ones
+func checksumUpdate(sum uint16, old, new []byte) uint16 {
+	acc := uint32(^sum)
+	for i := 0; i+1 < len(old); i += 2 {
+		acc += uint32(^binary.BigEndian.Uint16(old[i:]))
+		acc += uint32(binary.BigEndian.Uint16(new[i:]))
+	}
+	for acc > 0xffff {
+		acc = acc&0xffff + acc>>16
+	}
+	return ^uint16(acc)
+}
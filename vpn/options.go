@@ -0,0 +1,92 @@
+package vpn
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+)
+
+type Option func(cfg *Config) error
+
+// NewVPN creates the data plane by the options, the mtu is 1428 unless WithMTU is given
+func NewVPN(opts ...Option) (*VPN, error) {
+	cfg := Config{MTU: 1428}
+	for _, opt := range opts {
+		if err := opt(&cfg); err != nil {
+			return nil, fmt.Errorf("config error: %w", err)
+		}
+	}
+	return New(cfg), nil
+}
+
+func WithMTU(mtu int) Option {
+	return func(cfg *Config) error {
+		if mtu < 576 || mtu > 65535 {
+			return errors.New("mtu out of range [576, 65535]")
+		}
+		cfg.MTU = mtu
+		return nil
+	}
+}
+
+// WithAddrs are the addresses (the ip or the cidr) of the tun, the packets to them are looped back
+func WithAddrs(ipv4, ipv6 string) Option {
+	return func(cfg *Config) error {
+		cfg.IPv4, cfg.IPv6 = ipv4, ipv6
+		return nil
+	}
+}
+
+// WithInboundHandler appends the handler of the packets read from the peers
+func WithInboundHandler(handler InboundHandler) Option {
+	return func(cfg *Config) error {
+		cfg.InboundHandlers = append(cfg.InboundHandlers, handler)
+		return nil
+	}
+}
+
+// WithOutboundHandler appends the handler of the packets read from the tun and the bridges
+func WithOutboundHandler(handler OutboundHandler) Option {
+	return func(cfg *Config) error {
+		cfg.OutboundHandlers = append(cfg.OutboundHandlers, handler)
+		return nil
+	}
+}
+
+// WithBridge bridges the network into the data plane, e.g. the wireguard gateway
+func WithBridge(bridge Bridge) Option {
+	return func(cfg *Config) error {
+		cfg.Bridges = append(cfg.Bridges, bridge)
+		return nil
+	}
+}
+
+// WithFilterRules filters the packets on the tun path by the rules, see PacketFilter
+func WithFilterRules(rules ...FilterRule) Option {
+	return func(cfg *Config) error {
+		filter, err := NewPacketFilter(rules...)
+		if err != nil {
+			return err
+		}
+		cfg.Filter = filter
+		return nil
+	}
+}
+
+// WithRouteHooks is called once the route of the system routing table via a peer is added to
+// or removed from the data plane
+func WithRouteHooks(onAdd, onRemove func(dst net.IPNet, via net.IP)) Option {
+	return func(cfg *Config) error {
+		cfg.OnRouteAdd, cfg.OnRouteRemove = onAdd, onRemove
+		return nil
+	}
+}
+
+// WithLogger writes the logs of the data plane to the logger rather than slog.Default()
+func WithLogger(logger *slog.Logger) Option {
+	return func(cfg *Config) error {
+		cfg.Logger = logger
+		return nil
+	}
+}
@@ -1,5 +1,7 @@
 package vpn
 
+import "net"
+
 type InboundHandler interface {
 	Name() string
 	In([]byte) []byte
@@ -9,3 +11,9 @@ type OutboundHandler interface {
 	Name() string
 	Out([]byte) []byte
 }
+
+// SenderVerifier is the inbound handler verifies the peer the packet is read from, the packet is
+// dropped before it is queued if the peer is not allowed to send it (e.g. the source ip spoofed)
+type SenderVerifier interface {
+	VerifySender(packet []byte, peer net.Addr) bool
+}
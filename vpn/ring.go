@@ -0,0 +1,112 @@
+package vpn
+
+import "sync"
+
+// packetPool is the free list of the preallocated packet buffers. The buffer is owned by the one
+// got it until it is put back, the packets are never copied between the tun and the peers
+type packetPool struct {
+	mutex sync.Mutex
+	free  [][]byte
+}
+
+func newPacketPool(n int, newBuf func() []byte) *packetPool {
+	p := packetPool{free: make([][]byte, 0, n)}
+	for range n {
+		p.free = append(p.free, newBuf())
+	}
+	return &p
+}
+
+// get returns nil if all the buffers are owned
+func (p *packetPool) get() []byte {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if len(p.free) == 0 {
+		return nil
+	}
+	b := p.free[len(p.free)-1]
+	p.free = p.free[:len(p.free)-1]
+	return b
+}
+
+// put gives the buffer back, b may be shortened but must start at the buffer got from the pool
+func (p *packetPool) put(b []byte) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.free = append(p.free, b[:cap(b)])
+}
+
+// packetRing is the bounded queue of the packets with one consumer. push never blocks, the packet
+// is refused if the ring is full so that the producers are not stuck by the slow consumer
+type packetRing struct {
+	mutex  sync.Mutex
+	slots  [][]byte
+	head   int
+	size   int
+	closed bool
+	ready  chan struct{} // signaled when a packet is pushed or the ring is closed
+}
+
+func newPacketRing(capacity int) *packetRing {
+	return &packetRing{slots: make([][]byte, capacity), ready: make(chan struct{}, 1)}
+}
+
+// push queues the packet, false if the ring is full or closed and the caller still owns the packet
+func (r *packetRing) push(packet []byte) bool {
+	r.mutex.Lock()
+	if r.closed || r.size == len(r.slots) {
+		r.mutex.Unlock()
+		return false
+	}
+	r.slots[(r.head+r.size)%len(r.slots)] = packet
+	r.size++
+	r.mutex.Unlock()
+	r.signal()
+	return true
+}
+
+// pop waits for the packet, false if the ring is closed
+func (r *packetRing) pop() ([]byte, bool) {
+	for {
+		r.mutex.Lock()
+		if r.closed {
+			r.mutex.Unlock()
+			return nil, false
+		}
+		if r.size > 0 {
+			packet := r.slots[r.head]
+			r.slots[r.head] = nil
+			r.head = (r.head + 1) % len(r.slots)
+			r.size--
+			r.mutex.Unlock()
+			return packet, true
+		}
+		r.mutex.Unlock()
+		<-r.ready
+	}
+}
+
+// close wakes up the consumer, the packets queued are dropped
+func (r *packetRing) close() {
+	r.mutex.Lock()
+	r.closed = true
+	r.mutex.Unlock()
+	r.signal()
+}
+
+func (r *packetRing) len() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.size
+}
+
+func (r *packetRing) cap() int {
+	return len(r.slots)
+}
+
+func (r *packetRing) signal() {
+	select {
+	case r.ready <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,126 @@
+package vpn
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPacketPoolOwnership(t *testing.T) {
+	pool := newPacketPool(2, func() []byte { return make([]byte, 64) })
+	a, b := pool.get(), pool.get()
+	if a == nil || b == nil {
+		t.Fatal("expected the preallocated buffers")
+	}
+	if pool.get() != nil {
+		t.Fatal("expected nil when all the buffers are owned")
+	}
+	pool.put(a[:20]) // resliced by the owner
+	c := pool.get()
+	if len(c) != 64 || &c[0] != &a[0] {
+		t.Fatal("expected the buffer put back in full")
+	}
+}
+
+func TestPacketRingOrderAndFull(t *testing.T) {
+	r := newPacketRing(3)
+	for i := range 3 {
+		if !r.push([]byte{byte(i)}) {
+			t.Fatalf("push %d refused", i)
+		}
+	}
+	if r.push([]byte{3}) {
+		t.Fatal("expected the full ring refused the packet")
+	}
+	if r.len() != 3 || r.cap() != 3 {
+		t.Fatalf("unexpected len %d cap %d", r.len(), r.cap())
+	}
+	for i := range 3 {
+		packet, ok := r.pop()
+		if !ok || packet[0] != byte(i) {
+			t.Fatalf("expected packet %d, got %v %v", i, packet, ok)
+		}
+	}
+	// wraps around
+	for i := range 5 {
+		if !r.push([]byte{byte(i)}) {
+			t.Fatalf("push %d refused", i)
+		}
+		if packet, ok := r.pop(); !ok || packet[0] != byte(i) {
+			t.Fatalf("expected packet %d, got %v %v", i, packet, ok)
+		}
+	}
+}
+
+func TestPacketRingClose(t *testing.T) {
+	r := newPacketRing(4)
+	r.push([]byte{1})
+	popped := make(chan bool)
+	go func() {
+		r.pop()
+		_, ok := r.pop() // waits until closed
+		popped <- ok
+	}()
+	time.Sleep(10 * time.Millisecond)
+	r.close()
+	select {
+	case ok := <-popped:
+		if ok {
+			t.Fatal("expected pop failed after close")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected close wakes up the consumer")
+	}
+	if r.push([]byte{2}) {
+		t.Fatal("expected the closed ring refused the packet")
+	}
+}
+
+func TestPacketRingProducers(t *testing.T) {
+	const producers, packets = 4, 1000
+	pool := newPacketPool(64, func() []byte { return make([]byte, 8) })
+	r := newPacketRing(16)
+	var wg sync.WaitGroup
+	for p := range producers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < packets; {
+				buf := pool.get()
+				if buf == nil {
+					time.Sleep(time.Microsecond)
+					continue
+				}
+				buf[0], buf[1] = byte(p), byte(i)
+				if !r.push(buf) {
+					pool.put(buf) // the producer still owns the refused packet
+					time.Sleep(time.Microsecond)
+					continue
+				}
+				i++
+			}
+		}()
+	}
+	next := make([]int, producers)
+	for range producers * packets {
+		packet, ok := r.pop()
+		if !ok {
+			t.Fatal("unexpected closed ring")
+		}
+		p := packet[0]
+		if packet[1] != byte(next[p]) {
+			t.Fatalf("producer %d: expected packet %d, got %d", p, byte(next[p]), packet[1])
+		}
+		next[p]++
+		pool.put(packet)
+	}
+	wg.Wait()
+	if r.len() != 0 {
+		t.Fatalf("expected the ring drained, %d left", r.len())
+	}
+	for range 64 {
+		if pool.get() == nil {
+			t.Fatal("expected all the buffers back in the pool")
+		}
+	}
+}
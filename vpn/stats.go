@@ -0,0 +1,52 @@
+package vpn
+
+import "sync/atomic"
+
+// Stats is the queue depths and the drop counters of the data plane
+type Stats struct {
+	InboundQueue  int `json:"inboundQueue"`
+	OutboundQueue int `json:"outboundQueue"`
+	QueueCap      int `json:"queueCap"`
+	// Drops is the number of the packets dropped by reason
+	Drops map[string]uint64 `json:"drops"`
+}
+
+const (
+	DropInboundHandler  = "inbound_handler"
+	DropOutboundHandler = "outbound_handler"
+	DropMulticast       = "multicast"
+	DropPeerNotFound    = "peer_not_found"
+	DropWritePeer       = "write_peer_error"
+	DropWriteTun        = "write_tun_error"
+	DropWriteBridge     = "write_bridge_error"
+	DropQueueFull       = "queue_full"
+	DropFilter          = "filter"
+	DropMalformed       = "malformed"
+	DropSpoofed         = "spoofed"
+)
+
+type drops struct {
+	inboundHandler, outboundHandler, multicast, peerNotFound, writePeer, writeTun, writeBridge, queueFull, filter, malformed, spoofed atomic.Uint64
+}
+
+// Stats returns the queue depths and the drop counters
+func (vpn *VPN) Stats() Stats {
+	return Stats{
+		InboundQueue:  vpn.inbound.len(),
+		OutboundQueue: vpn.outbound.len(),
+		QueueCap:      vpn.inbound.cap(),
+		Drops: map[string]uint64{
+			DropInboundHandler:  vpn.drops.inboundHandler.Load(),
+			DropOutboundHandler: vpn.drops.outboundHandler.Load(),
+			DropMulticast:       vpn.drops.multicast.Load(),
+			DropPeerNotFound:    vpn.drops.peerNotFound.Load(),
+			DropWritePeer:       vpn.drops.writePeer.Load(),
+			DropWriteTun:        vpn.drops.writeTun.Load(),
+			DropWriteBridge:     vpn.drops.writeBridge.Load(),
+			DropQueueFull:       vpn.drops.queueFull.Load(),
+			DropFilter:          vpn.drops.filter.Load(),
+			DropMalformed:       vpn.drops.malformed.Load(),
+			DropSpoofed:         vpn.drops.spoofed.Load(),
+		},
+	}
+}
@@ -4,12 +4,18 @@ import (
 	"context"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"log/slog"
 	"net"
+	"net/netip"
 	"os"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 
+	"github.com/rkonfj/peerguard/crash"
+	"github.com/rkonfj/peerguard/logging"
 	"github.com/rkonfj/peerguard/netlink"
 	"github.com/rkonfj/peerguard/vpn/iface"
 	"golang.org/x/net/ipv4"
@@ -19,57 +25,182 @@ import (
 
 const (
 	IPPacketOffset = 16
+
+	// queueCap is the capacity of the inbound and the outbound rings, the pool preallocates the
+	// buffers of both rings and the batches read from the tun
+	queueCap = 512
+	poolSize = 2*queueCap + 256
 )
 
+// ErrLoopPanicked is the cause Run returns with if one of its loops panicked
+var ErrLoopPanicked = errors.New("data plane loop panicked")
+
+// Config is the config of the data plane, see the Options for the fields
 type Config struct {
-	MTU              int
+	MTU int
+	// IPv4 and IPv6 are the addresses (the ip or the cidr) of the tun, the packets to them are
+	// looped back to the tun rather than sent to the peers
+	IPv4, IPv6       string
 	InboundHandlers  []InboundHandler
 	OutboundHandlers []OutboundHandler
 	OnRouteAdd       func(net.IPNet, net.IP)
 	OnRouteRemove    func(net.IPNet, net.IP)
+	// Bridges are started by Run and closed before it returns
+	Bridges []Bridge
+	// Filter filters the packets after the inbound handlers and before the outbound handlers, an
+	// empty one is created if nil. Its rules are replaced at runtime by SetFilterRules
+	Filter *PacketFilter
+	// Logger is the logger of the data plane, slog.Default() if nil
+	Logger *slog.Logger
 }
 
 type VPN struct {
 	rt       iface.RoutingTable
 	cfg      Config
-	outbound chan []byte
-	inbound  chan []byte
+	outbound *packetRing
+	inbound  *packetRing
+	pool     *packetPool
 	newBuf   func() []byte
+	drops    drops
+	logger   *slog.Logger
+	localIPs []netip.Addr
+	exitNode atomic.Pointer[net.Addr]
+	filter   *PacketFilter
 }
 
+// New creates the data plane by the config, NewVPN is the same with the options
 func New(cfg Config) *VPN {
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	var localIPs []netip.Addr
+	for _, addr := range []string{cfg.IPv4, cfg.IPv6} {
+		if prefix, err := netip.ParsePrefix(addr); err == nil {
+			localIPs = append(localIPs, prefix.Addr())
+		} else if ip, err := netip.ParseAddr(addr); err == nil {
+			localIPs = append(localIPs, ip)
+		}
+	}
+	newBuf := func() []byte { return make([]byte, cfg.MTU+IPPacketOffset+40) }
+	filter := cfg.Filter
+	if filter == nil {
+		filter = &PacketFilter{}
+	}
 	return &VPN{
 		cfg:      cfg,
-		outbound: make(chan []byte, 512),
-		inbound:  make(chan []byte, 512),
-		newBuf:   func() []byte { return make([]byte, cfg.MTU+IPPacketOffset+40) },
+		outbound: newPacketRing(queueCap),
+		inbound:  newPacketRing(queueCap),
+		pool:     newPacketPool(poolSize, newBuf),
+		newBuf:   newBuf,
+		logger:   logger,
+		localIPs: localIPs,
+		filter:   filter,
 	}
 }
 
+// SetFilterRules replaces the rules of the packet filter, the rules are kept if any of the new
+// ones is invalid
+func (vpn *VPN) SetFilterRules(rules []FilterRule) error {
+	return vpn.filter.SetRules(rules)
+}
+
+// FilterRules returns the rules of the packet filter
+func (vpn *VPN) FilterRules() []FilterRule {
+	return vpn.filter.Rules()
+}
+
+// Run forwards the packets between the device and the peers of the packetConn until the ctx is
+// done, the iface (the device) and the packetConn (the transport, e.g. a p2p.PeerPacketConn) are
+// closed before it returns. It returns the error once a loop failed (e.g. ErrLoopPanicked) so that
+// the caller restarts it or exits rather than running without forwarding
 func (vpn *VPN) Run(ctx context.Context, iface iface.Interface, packetConn net.PacketConn) error {
 	vpn.rt = iface
+	for i, b := range vpn.cfg.Bridges {
+		if err := b.Start(vpn.sendBridged); err != nil {
+			for _, started := range vpn.cfg.Bridges[:i] {
+				started.Close()
+			}
+			return fmt.Errorf("start bridge %s: %w", b.Name(), err)
+		}
+	}
+	// the loops stop the data plane by the cause if they failed, e.g. panicked, rather than
+	// leaving the others running without forwarding
+	parent := ctx
+	ctx, stop := context.WithCancelCause(ctx)
+	defer stop(nil)
 	var wg sync.WaitGroup
 	wg.Add(5)
-	go vpn.runRoutingTableUpdateEventLoop(ctx, &wg)
-	go vpn.runTunReadEventLoop(&wg, iface.Device())
-	go vpn.runTunWriteEventLoop(&wg, iface.Device())
-	go vpn.runPacketConnReadEventLoop(&wg, packetConn)
-	go vpn.runPacketConnWriteEventLoop(&wg, packetConn)
+	go vpn.runRoutingTableUpdateEventLoop(ctx, &wg, stop)
+	go vpn.runTunReadEventLoop(&wg, iface.Device(), stop)
+	go vpn.runTunWriteEventLoop(&wg, iface.Device(), stop)
+	go vpn.runPacketConnReadEventLoop(&wg, packetConn, stop)
+	go vpn.runPacketConnWriteEventLoop(&wg, packetConn, stop)
 
 	<-ctx.Done()
+	for _, b := range vpn.cfg.Bridges {
+		b.Close()
+	}
 	packetConn.Close()
 	iface.Close()
-	close(vpn.inbound)
-	close(vpn.outbound)
+	vpn.inbound.close()
+	vpn.outbound.close()
 	wg.Wait()
+	if parent.Err() == nil {
+		return context.Cause(ctx)
+	}
 	return nil
 }
 
-func (vpn *VPN) runRoutingTableUpdateEventLoop(ctx context.Context, wg *sync.WaitGroup) {
+// sendBridged queues the copy of the packet sent by the bridge like the one read from the tun
+func (vpn *VPN) sendBridged(packet []byte) {
+	buf := vpn.pool.get()
+	if buf == nil || len(packet) > len(buf) {
+		vpn.dropQueueFull(buf)
+		return
+	}
+	vpn.enqueue(vpn.outbound, buf[:copy(buf, packet)])
+}
+
+// enqueue passes the owner of the buffer to the consumer of the ring, the buffer is dropped if
+// the ring is full
+func (vpn *VPN) enqueue(ring *packetRing, packet []byte) {
+	if !ring.push(packet) {
+		vpn.dropQueueFull(packet)
+	}
+}
+
+// dropQueueFull counts the packet can not be queued and puts its buffer back if any
+func (vpn *VPN) dropQueueFull(buf []byte) {
+	vpn.drops.queueFull.Add(1)
+	if buf != nil {
+		vpn.pool.put(buf)
+	}
+	logging.Limited(context.Background(), -10, "DropQueueFull", "DropQueueFull")
+}
+
+// verifySender reports whether the inbound handlers verifying the sender allow the peer to send
+// the packet
+func (vpn *VPN) verifySender(packet []byte, peer net.Addr) bool {
+	for _, in := range vpn.cfg.InboundHandlers {
+		if v, ok := in.(SenderVerifier); ok && !v.VerifySender(packet, peer) {
+			return false
+		}
+	}
+	return true
+}
+
+// panicked is the cleanup of crash.Recover stops the data plane
+func panicked(name string, stop context.CancelCauseFunc) func() {
+	return func() { stop(fmt.Errorf("%s: %w", name, ErrLoopPanicked)) }
+}
+
+func (vpn *VPN) runRoutingTableUpdateEventLoop(ctx context.Context, wg *sync.WaitGroup, stop context.CancelCauseFunc) {
 	defer wg.Done()
+	defer crash.Recover("vpn/routes", panicked("vpn/routes", stop))
 	ch := make(chan netlink.RouteUpdate)
 	if err := netlink.RouteSubscribe(ctx, ch); err != nil {
-		slog.Debug("RouteSubscribe", "err", err)
+		vpn.logger.Debug("RouteSubscribe", "err", err)
 		return
 	}
 	for r := range ch {
@@ -85,14 +216,16 @@ func (vpn *VPN) runRoutingTableUpdateEventLoop(ctx context.Context, wg *sync.Wai
 	}
 }
 
-func (vpn *VPN) runTunReadEventLoop(wg *sync.WaitGroup, device tun.Device) {
+func (vpn *VPN) runTunReadEventLoop(wg *sync.WaitGroup, device tun.Device, stop context.CancelCauseFunc) {
 	defer wg.Done()
+	defer crash.Recover("vpn/tunread", panicked("vpn/tunread", stop))
 
+	// the packet read is swapped with the free buffer of the pool rather than copied
 	bufs := make([][]byte, device.BatchSize())
 	sizes := make([]int, device.BatchSize())
 
 	for i := range bufs {
-		bufs[i] = make([]byte, vpn.cfg.MTU+IPPacketOffset+40)
+		bufs[i] = vpn.newBuf()
 	}
 
 	for {
@@ -101,117 +234,218 @@ func (vpn *VPN) runTunReadEventLoop(wg *sync.WaitGroup, device tun.Device) {
 			return
 		}
 		if err != nil {
-			panic(err)
+			stop(fmt.Errorf("read tun: %w", err))
+			return
 		}
 		for i := 0; i < n; i++ {
-			packet := vpn.newBuf()
-			copy(packet, bufs[i][:sizes[i]+IPPacketOffset])
-			vpn.outbound <- packet[:sizes[i]+IPPacketOffset]
+			free := vpn.pool.get()
+			if free == nil {
+				vpn.dropQueueFull(nil)
+				continue
+			}
+			vpn.enqueue(vpn.outbound, bufs[i][:sizes[i]+IPPacketOffset])
+			bufs[i] = free
 		}
 	}
 }
 
-func (vpn *VPN) runTunWriteEventLoop(wg *sync.WaitGroup, device tun.Device) {
+func (vpn *VPN) runTunWriteEventLoop(wg *sync.WaitGroup, device tun.Device, stop context.CancelCauseFunc) {
 	defer wg.Done()
+	defer crash.Recover("vpn/tunwrite", panicked("vpn/tunwrite", stop))
 	handle := func(pkt []byte) []byte {
 		for _, in := range vpn.cfg.InboundHandlers {
 			if pkt = in.In(pkt); pkt == nil {
-				slog.Debug("DropInbound", "handler", in.Name())
+				vpn.drops.inboundHandler.Add(1)
+				vpn.logger.Debug("DropInbound", "handler", in.Name())
 				return nil
 			}
 		}
+		if !vpn.filter.Allowed(FilterIn, pkt[IPPacketOffset:]) {
+			vpn.drops.filter.Add(1)
+			return nil
+		}
 		return pkt
 	}
-	for {
-		pkt, ok := <-vpn.inbound
-		if !ok {
+	write := func(pkt []byte) {
+		if pkt = handle(pkt); pkt == nil {
 			return
 		}
-		if pkt = handle(pkt); pkt == nil {
-			continue
+		if b := vpn.bridge(pkt); b != nil {
+			vpn.writeBridge(b, pkt)
+			return
 		}
 		_, err := device.Write([][]byte{pkt}, IPPacketOffset)
 		if err != nil {
-			slog.Debug("WriteToTunError", "detail", err.Error())
+			vpn.drops.writeTun.Add(1)
+			vpn.logger.Debug("WriteToTunError", "detail", err.Error())
 		}
 	}
+	for {
+		buf, ok := vpn.inbound.pop()
+		if !ok {
+			return
+		}
+		write(buf)
+		vpn.pool.put(buf)
+	}
 }
 
-func (vpn *VPN) runPacketConnReadEventLoop(wg *sync.WaitGroup, packetConn net.PacketConn) {
+func (vpn *VPN) runPacketConnReadEventLoop(wg *sync.WaitGroup, packetConn net.PacketConn, stop context.CancelCauseFunc) {
 	defer wg.Done()
-	buf := make([]byte, vpn.cfg.MTU+40)
+	defer crash.Recover("vpn/connread", panicked("vpn/connread", stop))
+	buf := vpn.newBuf()
 	for {
-		n, _, err := packetConn.ReadFrom(buf)
+		n, peer, err := packetConn.ReadFrom(buf[IPPacketOffset:])
 		if err != nil {
 			if errors.Is(err, net.ErrClosed) {
 				return
 			}
-			panic(err)
+			stop(fmt.Errorf("read packet conn: %w", err))
+			return
 		}
-		pkt := vpn.newBuf()
-		copy(pkt[IPPacketOffset:], buf[:n])
-		vpn.inbound <- pkt[:n+IPPacketOffset]
+		if !vpn.verifySender(buf[:n+IPPacketOffset], peer) {
+			vpn.drops.spoofed.Add(1)
+			logging.Limited(context.Background(), -10, "DropSpoofed/"+peer.String(), "DropSpoofed", "peer", peer)
+			continue
+		}
+		free := vpn.pool.get()
+		if free == nil {
+			vpn.dropQueueFull(nil)
+			continue
+		}
+		vpn.enqueue(vpn.inbound, buf[:n+IPPacketOffset])
+		buf = free
 	}
 }
 
-func (vpn *VPN) runPacketConnWriteEventLoop(wg *sync.WaitGroup, packetConn net.PacketConn) {
+func (vpn *VPN) runPacketConnWriteEventLoop(wg *sync.WaitGroup, packetConn net.PacketConn, stop context.CancelCauseFunc) {
 	defer wg.Done()
+	defer crash.Recover("vpn/connwrite", panicked("vpn/connwrite", stop))
 	sendPacketToPeer := func(packet []byte, dstIP net.IP) {
 		if dstIP.IsMulticast() {
-			slog.Log(context.Background(), -10, "DropMulticastIP", "dst", dstIP)
+			vpn.drops.multicast.Add(1)
+			logging.Limited(context.Background(), -10, "DropMulticastIP", "DropMulticastIP", "dst", dstIP)
 			return
 		}
-		if peer, ok := vpn.rt.GetPeer(dstIP.String()); ok {
+		if b := vpn.bridge(packet); b != nil {
+			vpn.writeBridge(b, packet)
+			return
+		}
+		peer, ok := vpn.rt.GetPeer(dstIP.String())
+		if !ok {
+			peer, ok = vpn.exitPeer()
+		}
+		if ok {
 			_, err := packetConn.WriteTo(packet[IPPacketOffset:], peer)
 			if err != nil {
-				slog.Error("WriteTo peer failed", "peer", peer, "detail", err)
+				vpn.drops.writePeer.Add(1)
+				logging.Limited(context.Background(), slog.LevelError, "writepeer/"+peer.String(), "WriteTo peer failed", "peer", peer, "detail", err)
 			}
 			return
 		}
-		slog.Log(context.Background(), -10, "DropPacketPeerNotFound", "ip", dstIP)
+		vpn.drops.peerNotFound.Add(1)
+		logging.Limited(context.Background(), -10, "DropPacketPeerNotFound", "DropPacketPeerNotFound", "ip", dstIP)
 	}
 	handle := func(pkt []byte) []byte {
+		if !vpn.filter.Allowed(FilterOut, pkt[IPPacketOffset:]) {
+			vpn.drops.filter.Add(1)
+			return nil
+		}
 		for _, out := range vpn.cfg.OutboundHandlers {
 			if pkt = out.Out(pkt); pkt == nil {
-				slog.Debug("DropOutbound", "handler", out.Name())
+				vpn.drops.outboundHandler.Add(1)
+				vpn.logger.Debug("DropOutbound", "handler", out.Name())
 				return nil
 			}
 		}
 		return pkt
 	}
-	for {
-		packet, ok := <-vpn.outbound
-		if !ok {
-			return
+	// loopback queues the packet to the tun, the buffer is passed to the inbound ring if the
+	// handlers returned the packet in it
+	loopback := func(buf, packet []byte) bool {
+		if len(packet) > 0 && len(buf) > 0 && &buf[:1][0] == &packet[:1][0] {
+			vpn.enqueue(vpn.inbound, packet)
+			return true
 		}
-		if packet = handle(packet); packet == nil {
-			continue
+		free := vpn.pool.get()
+		if free == nil || len(packet) > len(free) {
+			vpn.dropQueueFull(free)
+			return false
+		}
+		vpn.enqueue(vpn.inbound, free[:copy(free, packet)])
+		return false
+	}
+	// send routes the packet, it reports whether the buffer is passed to the inbound ring
+	send := func(buf []byte) bool {
+		packet := handle(buf)
+		if packet == nil {
+			return false
 		}
 		pkt := packet[IPPacketOffset:]
+		if len(pkt) == 0 {
+			vpn.drops.malformed.Add(1)
+			return false
+		}
 		if pkt[0]>>4 == 4 {
 			header, err := ipv4.ParseHeader(pkt)
 			if err != nil {
-				panic(err)
+				vpn.drops.malformed.Add(1)
+				vpn.logger.Debug("DropMalformed", "err", err)
+				return false
 			}
-			if header.Dst.String() == netlink.Show().IPv4 {
-				vpn.inbound <- packet
-				continue
+			if vpn.isLocal(header.Dst) {
+				return loopback(buf, packet)
 			}
 			sendPacketToPeer(packet, header.Dst)
-			continue
+			return false
 		}
 		if pkt[0]>>4 == 6 {
 			header, err := ipv6.ParseHeader(pkt)
 			if err != nil {
-				panic(err)
+				vpn.drops.malformed.Add(1)
+				vpn.logger.Debug("DropMalformed", "err", err)
+				return false
 			}
-			if header.Dst.String() == netlink.Show().IPv6 {
-				vpn.inbound <- packet
-				continue
+			if vpn.isLocal(header.Dst) {
+				return loopback(buf, packet)
 			}
 			sendPacketToPeer(packet, header.Dst)
-			continue
+			return false
+		}
+		vpn.drops.malformed.Add(1)
+		vpn.logger.Debug("DropMalformed", "packet", hex.EncodeToString(pkt))
+		return false
+	}
+	for {
+		buf, ok := vpn.outbound.pop()
+		if !ok {
+			return
 		}
-		slog.Warn("Received invalid packet", "packet", hex.EncodeToString(pkt))
+		if !send(buf) {
+			vpn.pool.put(buf)
+		}
+	}
+}
+
+// SetExitNode routes the packets to the ips no peer is found for to the exit peer, i.e. the
+// default route of the data plane. nil removes the exit peer
+func (vpn *VPN) SetExitNode(peer net.Addr) {
+	if peer == nil {
+		vpn.exitNode.Store(nil)
+		return
 	}
+	vpn.exitNode.Store(&peer)
+}
+
+func (vpn *VPN) exitPeer() (net.Addr, bool) {
+	if peer := vpn.exitNode.Load(); peer != nil {
+		return *peer, true
+	}
+	return nil, false
+}
+
+// isLocal reports whether the ip is the address of the tun
+func (vpn *VPN) isLocal(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	return ok && slices.Contains(vpn.localIPs, addr.Unmap())
 }
@@ -0,0 +1,331 @@
+package wg
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rkonfj/peerguard/disco"
+	"github.com/rkonfj/peerguard/secure"
+	"github.com/rkonfj/peerguard/vpn"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun"
+	"storj.io/common/base58"
+)
+
+// DataPlaneConfig is the config of the wireguard data plane
+type DataPlaneConfig struct {
+	// PrivateKey is the base58 curve25519 private key of the peer id, it is the wireguard private key
+	PrivateKey string
+	// InboundHandlers and OutboundHandlers are the same with the ones of vpn.Config
+	InboundHandlers  []vpn.InboundHandler
+	OutboundHandlers []vpn.OutboundHandler
+	// Filter filters the packets after the inbound handlers and before the outbound handlers
+	// like the one of vpn.Config, nil allows all
+	Filter *vpn.PacketFilter
+	// Logger is the logger of the data plane, slog.Default() if nil
+	Logger *slog.Logger
+}
+
+// DataPlane is the data plane speaks the wireguard protocol with the peers rather than the vpn
+// package does. The peers are the wireguard peers keyed by their peer ids (the curve25519 public
+// keys), the wireguard messages are sent to the peer ids over the p2p conn so that the peerguard
+// only discovers the endpoints and traverses the NATs. All peers of the network must use it
+type DataPlane struct {
+	cfg    DataPlaneConfig
+	peerID string
+	logger *slog.Logger
+	drops  struct{ inbound, outbound, filter atomic.Uint64 }
+
+	mutex sync.Mutex
+	dev   *device.Device
+	peers map[disco.PeerID]string // the uapi config of the peer
+}
+
+// NewDataPlane checks the private key, the device is created by Run
+func NewDataPlane(cfg DataPlaneConfig) (*DataPlane, error) {
+	priv, err := secure.Curve25519PrivateKey(cfg.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("wireguard data plane: %w", err)
+	}
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &DataPlane{cfg: cfg, peerID: priv.PublicKey.String(), logger: logger, peers: make(map[disco.PeerID]string)}, nil
+}
+
+// PeerID is the public key of the private key, the p2p conn must listen on it
+func (d *DataPlane) PeerID() string {
+	return d.peerID
+}
+
+// Run forwards the packets between the device and the peers by the wireguard device until the ctx
+// is done, the tun device and the packetConn are closed before it returns
+func (d *DataPlane) Run(ctx context.Context, tunDevice tun.Device, packetConn net.PacketConn) error {
+	logger := &device.Logger{
+		Verbosef: func(format string, args ...any) { d.logger.Debug("WireGuard", "msg", fmt.Sprintf(format, args...)) },
+		Errorf:   func(format string, args ...any) { d.logger.Error("WireGuard", "msg", fmt.Sprintf(format, args...)) },
+	}
+	bind := newPeerBind(packetConn)
+	dev := device.NewDevice(&handlerTun{Device: tunDevice, d: d}, bind, logger)
+	uapi := fmt.Sprintf("private_key=%s\n", hex.EncodeToString(base58.Decode(d.cfg.PrivateKey)))
+	if err := dev.IpcSet(uapi); err != nil {
+		dev.Close()
+		packetConn.Close()
+		return fmt.Errorf("configure wireguard device: %w", err)
+	}
+	d.mutex.Lock()
+	d.dev = dev
+	for peerID, peer := range d.peers { // the peers found before the device is created
+		if err := dev.IpcSet(peer); err != nil {
+			d.logger.Error("WireGuardAddPeer", "peer", peerID, "err", err)
+		}
+	}
+	d.mutex.Unlock()
+	if err := dev.Up(); err != nil {
+		dev.Close()
+		packetConn.Close()
+		return fmt.Errorf("up wireguard device: %w", err)
+	}
+	d.logger.Info("WireGuard data plane started")
+	<-ctx.Done()
+	packetConn.Close()
+	dev.Close()
+	return nil
+}
+
+// AddPeer adds or replaces the wireguard peer of the peer id, the packets to the allowed ips are
+// sent to it. The peer id not being a curve25519 public key is refused
+func (d *DataPlane) AddPeer(peerID disco.PeerID, allowedIPs ...netip.Prefix) error {
+	publicKey := base58.Decode(peerID.String())
+	if len(publicKey) != device.NoisePublicKeySize {
+		return fmt.Errorf("peer %s is not keyed by the curve25519 public key", peerID)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "public_key=%s\nendpoint=%s\npersistent_keepalive_interval=25\nreplace_allowed_ips=true\n",
+		hex.EncodeToString(publicKey), peerID)
+	for _, prefix := range allowedIPs {
+		fmt.Fprintf(&b, "allowed_ip=%s\n", prefix.Masked())
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.peers[peerID] = b.String()
+	if d.dev == nil {
+		return nil
+	}
+	return d.dev.IpcSet(b.String())
+}
+
+// RemovePeer removes the wireguard peer of the peer id
+func (d *DataPlane) RemovePeer(peerID disco.PeerID) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	delete(d.peers, peerID)
+	if d.dev == nil {
+		return nil
+	}
+	return d.dev.IpcSet(fmt.Sprintf("public_key=%s\nremove=true\n", hex.EncodeToString(base58.Decode(peerID.String()))))
+}
+
+// Stats returns the drop counters of the handlers, the queues are inside the wireguard device
+func (d *DataPlane) Stats() vpn.Stats {
+	return vpn.Stats{Drops: map[string]uint64{
+		vpn.DropInboundHandler:  d.drops.inbound.Load(),
+		vpn.DropOutboundHandler: d.drops.outbound.Load(),
+		vpn.DropFilter:          d.drops.filter.Load(),
+	}}
+}
+
+// handlerTun runs the handlers of the data plane on the packets crossing the tun device
+type handlerTun struct {
+	tun.Device
+	d *DataPlane
+}
+
+// handling reports whether the packets are handled, the device is read and written directly if not
+func (t *handlerTun) handling() bool {
+	return t.d.cfg.Filter != nil || len(t.d.cfg.InboundHandlers) > 0 || len(t.d.cfg.OutboundHandlers) > 0
+}
+
+// Read reads the packets to the peers, the ones dropped by the outbound handlers are skipped
+func (t *handlerTun) Read(bufs [][]byte, sizes []int, offset int) (int, error) {
+	for {
+		n, err := t.Device.Read(bufs, sizes, offset)
+		if n == 0 || err != nil || !t.handling() || offset < vpn.IPPacketOffset {
+			return n, err
+		}
+		kept := 0
+		for i := range n {
+			pkt := bufs[i][offset-vpn.IPPacketOffset : offset+sizes[i]]
+			if f := t.d.cfg.Filter; f != nil && !f.Allowed(vpn.FilterOut, pkt[vpn.IPPacketOffset:]) {
+				t.d.drops.filter.Add(1)
+				continue
+			}
+			for _, out := range t.d.cfg.OutboundHandlers {
+				if pkt = out.Out(pkt); pkt == nil {
+					t.d.drops.outbound.Add(1)
+					break
+				}
+			}
+			if pkt == nil {
+				continue
+			}
+			sizes[kept] = copy(bufs[kept][offset:], pkt[vpn.IPPacketOffset:])
+			kept++
+		}
+		if kept > 0 {
+			return kept, nil
+		}
+	}
+}
+
+// Write writes the packets from the peers, the ones dropped by the inbound handlers are skipped
+func (t *handlerTun) Write(bufs [][]byte, offset int) (int, error) {
+	if !t.handling() || offset < vpn.IPPacketOffset {
+		return t.Device.Write(bufs, offset)
+	}
+	kept := make([][]byte, 0, len(bufs))
+	for _, buf := range bufs {
+		pkt := buf[offset-vpn.IPPacketOffset:]
+		for _, in := range t.d.cfg.InboundHandlers {
+			if pkt = in.In(pkt); pkt == nil {
+				t.d.drops.inbound.Add(1)
+				break
+			}
+		}
+		if f := t.d.cfg.Filter; pkt != nil && f != nil && !f.Allowed(vpn.FilterIn, pkt[vpn.IPPacketOffset:]) {
+			t.d.drops.filter.Add(1)
+			pkt = nil
+		}
+		if pkt != nil {
+			kept = append(kept, buf[:offset-vpn.IPPacketOffset+len(pkt)])
+		}
+	}
+	if len(kept) == 0 {
+		return len(bufs), nil
+	}
+	if _, err := t.Device.Write(kept, offset); err != nil {
+		return 0, err
+	}
+	return len(bufs), nil
+}
+
+// peerEndpoint is the wireguard endpoint of the peer id
+type peerEndpoint disco.PeerID
+
+func (ep peerEndpoint) ClearSrc()           {}
+func (ep peerEndpoint) SrcToString() string { return "" }
+func (ep peerEndpoint) DstToString() string { return string(ep) }
+func (ep peerEndpoint) DstToBytes() []byte  { return []byte(ep) }
+func (ep peerEndpoint) DstIP() netip.Addr   { return netip.Addr{} }
+func (ep peerEndpoint) SrcIP() netip.Addr   { return netip.Addr{} }
+
+type datagram struct {
+	b    []byte
+	from peerEndpoint
+}
+
+// peerBind is the wireguard bind sends the messages to the peer ids over the p2p conn. The device
+// opens and closes the bind more than once, the conn is read by one goroutine for all of them
+type peerBind struct {
+	packetConn net.PacketConn
+	datagrams  chan datagram
+	readErr    chan struct{}
+
+	mutex  sync.Mutex
+	closed chan struct{}
+}
+
+func newPeerBind(packetConn net.PacketConn) *peerBind {
+	b := peerBind{
+		packetConn: packetConn,
+		datagrams:  make(chan datagram, 512),
+		readErr:    make(chan struct{}),
+		closed:     make(chan struct{}),
+	}
+	close(b.closed)
+	go b.runReadLoop()
+	return &b
+}
+
+func (b *peerBind) runReadLoop() {
+	defer close(b.readErr)
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := b.packetConn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		b.datagrams <- datagram{b: append([]byte(nil), buf[:n]...), from: peerEndpoint(addr.String())}
+	}
+}
+
+func (b *peerBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	select {
+	case <-b.closed:
+	default:
+		return nil, 0, conn.ErrBindAlreadyOpen
+	}
+	closed := make(chan struct{})
+	b.closed = closed
+	receive := func(packets [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+		select {
+		case <-closed:
+			return 0, net.ErrClosed
+		case <-b.readErr:
+			return 0, net.ErrClosed
+		case d := <-b.datagrams:
+			sizes[0] = copy(packets[0], d.b)
+			eps[0] = d.from
+			return 1, nil
+		}
+	}
+	return []conn.ReceiveFunc{receive}, port, nil
+}
+
+func (b *peerBind) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	select {
+	case <-b.closed:
+	default:
+		close(b.closed)
+	}
+	return nil
+}
+
+func (b *peerBind) SetMark(mark uint32) error {
+	return nil
+}
+
+func (b *peerBind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	peerID := disco.PeerID(ep.DstToString())
+	for _, buf := range bufs {
+		if _, err := b.packetConn.WriteTo(buf, peerID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *peerBind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	if s == "" {
+		return nil, errors.New("empty peer id")
+	}
+	return peerEndpoint(s), nil
+}
+
+func (b *peerBind) BatchSize() int {
+	return 1
+}
@@ -0,0 +1,249 @@
+// Package wg bridges the standard wireguard clients (e.g. the official apps on the phones) into the
+// overlay. The gateway speaks the wireguard protocol on the udp port, the packets decrypted from the
+// clients are routed to the peers like the ones read from the tun and vice versa
+package wg
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/rkonfj/peerguard/vpn"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+var _ vpn.Bridge = (*Gateway)(nil)
+
+type Config struct {
+	// ListenPort is the udp port the clients connect to
+	ListenPort int
+	// PrivateKey is the base64 wireguard private key of the gateway (wg genkey)
+	PrivateKey string
+	MTU        int
+	Peers      []Peer
+}
+
+// Peer is the wireguard client allowed to connect to the gateway
+type Peer struct {
+	// PublicKey is the base64 wireguard public key of the client
+	PublicKey string
+	// AllowedIPs are the addresses of the client, usually a /32 in the overlay prefix
+	AllowedIPs []netip.Prefix
+}
+
+// ParsePeer parses the peer in the format <public key>@<allowed ip>[,<allowed ip>...]
+func ParsePeer(s string) (Peer, error) {
+	publicKey, ips, ok := strings.Cut(s, "@")
+	if !ok {
+		return Peer{}, fmt.Errorf("invalid wireguard peer %q, <public key>@<allowed ip> is required", s)
+	}
+	peer := Peer{PublicKey: publicKey}
+	for _, ip := range strings.Split(ips, ",") {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(ip))
+		if err != nil {
+			return Peer{}, fmt.Errorf("invalid allowed ip of the wireguard peer: %w", err)
+		}
+		peer.AllowedIPs = append(peer.AllowedIPs, prefix.Masked())
+	}
+	return peer, nil
+}
+
+// Gateway is the vpn bridge of the wireguard clients
+type Gateway struct {
+	cfg      Config
+	prefixes []netip.Prefix
+	tun      *bridgeTun
+	dev      *device.Device
+}
+
+// New creates the gateway, the keys and the allowed ips are checked here
+func New(cfg Config) (*Gateway, error) {
+	if cfg.ListenPort <= 0 || cfg.ListenPort > 65535 {
+		return nil, fmt.Errorf("invalid wireguard listen port %d", cfg.ListenPort)
+	}
+	if _, err := hexKey(cfg.PrivateKey); err != nil {
+		return nil, fmt.Errorf("wireguard private key: %w", err)
+	}
+	g := Gateway{cfg: cfg}
+	for _, peer := range cfg.Peers {
+		if _, err := hexKey(peer.PublicKey); err != nil {
+			return nil, fmt.Errorf("wireguard peer public key: %w", err)
+		}
+		g.prefixes = append(g.prefixes, peer.AllowedIPs...)
+	}
+	return &g, nil
+}
+
+func (g *Gateway) Name() string {
+	return "wireguard"
+}
+
+func (g *Gateway) Contains(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range g.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *Gateway) Start(send func(packet []byte)) error {
+	g.tun = &bridgeTun{
+		mtu:     g.cfg.MTU,
+		send:    send,
+		packets: make(chan []byte, 512),
+		events:  make(chan tun.Event, 1),
+		closed:  make(chan struct{}),
+	}
+	g.tun.events <- tun.EventUp
+	logger := &device.Logger{
+		Verbosef: func(format string, args ...any) { slog.Debug("WireGuard", "msg", fmt.Sprintf(format, args...)) },
+		Errorf:   func(format string, args ...any) { slog.Error("WireGuard", "msg", fmt.Sprintf(format, args...)) },
+	}
+	g.dev = device.NewDevice(g.tun, conn.NewDefaultBind(), logger)
+	uapi, err := g.uapiConfig()
+	if err != nil {
+		g.dev.Close()
+		return err
+	}
+	if err := g.dev.IpcSet(uapi); err != nil {
+		g.dev.Close()
+		return fmt.Errorf("configure wireguard device: %w", err)
+	}
+	if err := g.dev.Up(); err != nil {
+		g.dev.Close()
+		return fmt.Errorf("up wireguard device: %w", err)
+	}
+	slog.Info("WireGuard gateway started", "port", g.cfg.ListenPort, "peers", len(g.cfg.Peers))
+	return nil
+}
+
+// uapiConfig is the config of the device in the wireguard cross-platform userspace api format
+func (g *Gateway) uapiConfig() (string, error) {
+	var b strings.Builder
+	privateKey, err := hexKey(g.cfg.PrivateKey)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(&b, "private_key=%s\nlisten_port=%d\nreplace_peers=true\n", privateKey, g.cfg.ListenPort)
+	for _, peer := range g.cfg.Peers {
+		publicKey, err := hexKey(peer.PublicKey)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "public_key=%s\nreplace_allowed_ips=true\n", publicKey)
+		for _, prefix := range peer.AllowedIPs {
+			fmt.Fprintf(&b, "allowed_ip=%s\n", prefix)
+		}
+	}
+	return b.String(), nil
+}
+
+// Write queues the packet from the overlay to the clients, it is dropped if the queue is full
+func (g *Gateway) Write(packet []byte) error {
+	select {
+	case <-g.tun.closed:
+		return os.ErrClosed
+	case g.tun.packets <- slices.Clone(packet):
+		return nil
+	default:
+		return errors.New("wireguard queue is full")
+	}
+}
+
+func (g *Gateway) Close() error {
+	if g.dev != nil {
+		g.dev.Close()
+	}
+	return nil
+}
+
+// hexKey converts the base64 key (wg genkey, wg pubkey) to the hex key of the uapi
+func hexKey(key string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return "", fmt.Errorf("invalid base64 key: %w", err)
+	}
+	if len(b) != device.NoisePublicKeySize {
+		return "", fmt.Errorf("invalid key length %d", len(b))
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// bridgeTun is the tun.Device of the wireguard device exchanges the packets with the vpn
+// rather than the os
+type bridgeTun struct {
+	mtu       int
+	send      func(packet []byte)
+	packets   chan []byte
+	events    chan tun.Event
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (t *bridgeTun) File() *os.File {
+	return nil
+}
+
+// Read reads the packets to the clients, wireguard encrypts and sends them
+func (t *bridgeTun) Read(bufs [][]byte, sizes []int, offset int) (int, error) {
+	select {
+	case <-t.closed:
+		return 0, os.ErrClosed
+	case packet := <-t.packets:
+		sizes[0] = copy(bufs[0][offset:], packet[vpn.IPPacketOffset:])
+		return 1, nil
+	}
+}
+
+// Write writes the packets decrypted from the clients, they are routed by the vpn
+func (t *bridgeTun) Write(bufs [][]byte, offset int) (int, error) {
+	select {
+	case <-t.closed:
+		return 0, os.ErrClosed
+	default:
+	}
+	for _, buf := range bufs { // send copies the packet, the headroom of the device is reused
+		t.send(buf[offset-vpn.IPPacketOffset:])
+	}
+	return len(bufs), nil
+}
+
+func (t *bridgeTun) MTU() (int, error) {
+	return t.mtu, nil
+}
+
+func (t *bridgeTun) Name() (string, error) {
+	return "pgwg", nil
+}
+
+func (t *bridgeTun) Events() <-chan tun.Event {
+	return t.events
+}
+
+func (t *bridgeTun) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.closed)
+		close(t.events)
+	})
+	return nil
+}
+
+func (t *bridgeTun) BatchSize() int {
+	return 1
+}